@@ -0,0 +1,328 @@
+// Command loadgen seeds a database with partitions of items, processes them with in-process
+// watchers and a no-op or fixed latency processor, and prints throughput, latency, conflict
+// and query counts, for tuning BatchSize, PollInterval and the schema.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state/statetest"
+	"gorm.io/driver/sqlite"
+	"gorm.io/driver/sqlserver"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+// seedBatchSize is the number of items created per statement.
+const seedBatchSize = 500
+
+func main() {
+	os.Exit(run(context.Background(), os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// config holds the flags.
+type config struct {
+	sqlConnStr   string
+	sqlitePath   string
+	tablePrefix  string
+	partitions   int
+	items        int
+	watchers     int
+	batchSize    int
+	pollInterval time.Duration
+	latency      time.Duration
+	fetchOrder   state.ItemOrder
+	timeout      time.Duration
+}
+
+func (c *config) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.sqlConnStr, "sql_connection", "", "sql server connection string, a temporary sqlite database is used if empty")
+	fs.StringVar(&c.sqlitePath, "sqlite_path", "", "path of the sqlite database, a temporary file if empty")
+	fs.StringVar(&c.tablePrefix, "table_prefix", "loadgen_", "the table prefix to use, keep it apart from real data")
+	fs.IntVar(&c.partitions, "partitions", 10, "number of partitions to seed")
+	fs.IntVar(&c.items, "items", 1000, "number of items to seed in each partition")
+	fs.IntVar(&c.watchers, "watchers", 2, "number of watchers to run")
+	fs.IntVar(&c.batchSize, "batch_size", 10, "BatchSize of each watcher")
+	fs.DurationVar(&c.pollInterval, "poll_interval", 100*time.Millisecond, "PollInterval of each watcher")
+	fs.DurationVar(&c.latency, "latency", 0, "how long the processor takes per item, 0 for a no-op processor")
+	fs.Var(&c.fetchOrder, "fetch_order", "FetchOrder of each watcher: updated_at, sequence, created_at or priority")
+	fs.DurationVar(&c.timeout, "timeout", 10*time.Minute, "give up if the items aren't all processed by then")
+}
+
+func (c *config) repo() (*state.GormRepo, func(), error) {
+	cleanup := func() {}
+	var dialector gorm.Dialector
+	if c.sqlConnStr != "" {
+		dialector = sqlserver.Open(c.sqlConnStr)
+	} else {
+		path := c.sqlitePath
+		if path == "" {
+			dir, err := ioutil.TempDir("", "loadgen_")
+			if err != nil {
+				return nil, nil, err
+			}
+			cleanup = func() { os.RemoveAll(dir) }
+			path = filepath.Join(dir, "loadgen.db")
+		}
+		dialector = sqlite.Open(path)
+	}
+	db, err := gorm.Open(dialector, &gorm.Config{
+		Logger:         logger.Default.LogMode(logger.Silent),
+		NamingStrategy: schema.NamingStrategy{TablePrefix: c.tablePrefix},
+	})
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	repo, err := state.NewGormRepo(db)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if err := repo.AutoMigrate(); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return repo, func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+		cleanup()
+	}, nil
+}
+
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	c := &config{}
+	fs := flag.NewFlagSet("loadgen", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	c.register(fs)
+	// Accept glog's flags too, e.g. --logtostderr, and mark them parsed so that it logs to its
+	// files rather than complaining on stderr.
+	flag.CommandLine.VisitAll(func(f *flag.Flag) { fs.Var(f.Value, f.Name, f.Usage) })
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	flag.CommandLine.Parse(nil)
+	if c.partitions <= 0 || c.items <= 0 || c.watchers <= 0 {
+		fmt.Fprintln(stderr, "--partitions, --items and --watchers must be positive")
+		return 2
+	}
+	repo, cleanup, err := c.repo()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer cleanup()
+
+	runID := time.Now().UTC().Format("20060102T150405")
+	fmt.Fprintf(stderr, "seeding %d partitions of %d items\n", c.partitions, c.items)
+	if err := seed(ctx, repo, runID, c.partitions, c.items); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	fmt.Fprintf(stderr, "processing with %d watchers\n", c.watchers)
+	res, err := c.process(ctx, repo)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	res.print(stdout, c.partitions*c.items)
+	return 0
+}
+
+// seed creates the partitions and their items, with IDs unique to the run.
+func seed(ctx context.Context, repo state.Repo, runID string, partitions, items int) error {
+	for p := 0; p < partitions; p++ {
+		id := fmt.Sprintf("loadgen-%s-%d", runID, p)
+		if err := repo.CreatePartition(ctx, &state.Partition{BaseModel: state.BaseModel{ID: id}}); err != nil {
+			return fmt.Errorf("error creating partition %s: %w", id, err)
+		}
+		for start := 0; start < items; start += seedBatchSize {
+			var batch []*state.Item
+			for i := start; i < items && i < start+seedBatchSize; i++ {
+				batch = append(batch, &state.Item{BaseModel: state.BaseModel{ID: fmt.Sprintf("%s-%d", id, i)}, PartitionID: id, Data: []byte(`{}`)})
+			}
+			if err := repo.CreateItems(ctx, batch...); err != nil {
+				return fmt.Errorf("error creating items of partition %s: %w", id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// result is the outcome of a run.
+type result struct {
+	elapsed   time.Duration
+	completed int
+	// latencies are from the processor being called for an item to the item being saved.
+	latencies []time.Duration
+	conflicts int64
+	queries   map[string]int
+}
+
+// process runs the watchers until every item is complete.
+func (c *config) process(ctx context.Context, repo *state.GormRepo) (*result, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	counting := &statetest.CountingRepo{Repo: repo, CountOnly: true}
+	proc := &latencyProcessor{latency: c.latency}
+	total := c.partitions * c.items
+	res := &result{}
+	var mu sync.Mutex
+	done := make(chan struct{})
+
+	var watchers []*state.Watcher
+	var wg sync.WaitGroup
+	start := time.Now()
+	for n := 0; n < c.watchers; n++ {
+		w := &state.Watcher{
+			Processor:    proc,
+			Repo:         counting,
+			BatchSize:    c.batchSize,
+			PollInterval: c.pollInterval,
+			FetchOrder:   c.fetchOrder,
+			AutoClose:    true,
+		}
+		events := w.Events()
+		watchers = append(watchers, w)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			w.Start(ctx)
+		}()
+		go func() {
+			defer wg.Done()
+			for e := range events {
+				if e.Type != state.ItemCompleted {
+					continue
+				}
+				mu.Lock()
+				res.completed++
+				if started, ok := proc.started.Load(e.ItemID); ok {
+					res.latencies = append(res.latencies, e.Time.Sub(started.(time.Time)))
+				}
+				if res.completed == total {
+					close(done)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %s", c.timeout)
+	}
+	res.elapsed = time.Since(start)
+	cancel()
+	wg.Wait()
+	for _, w := range watchers {
+		res.conflicts += w.Stats().SaveConflicts
+	}
+	res.queries = counting.Counts()
+	return res, err
+}
+
+func (r *result) print(out io.Writer, total int) {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Items:\t%d of %d completed in %s\n", r.completed, total, r.elapsed.Round(time.Millisecond))
+	fmt.Fprintf(tw, "Throughput:\t%.1f items/s\n", float64(r.completed)/r.elapsed.Seconds())
+	fmt.Fprintf(tw, "OCC conflicts:\t%d\n", r.conflicts)
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+	for _, p := range []float64{0.5, 0.9, 0.99} {
+		fmt.Fprintf(tw, "Latency p%g:\t%s\n", p*100, percentile(r.latencies, p))
+	}
+	fmt.Fprintf(tw, "Latency max:\t%s\n", percentile(r.latencies, 1))
+	tw.Flush()
+
+	fmt.Fprintln(out, "\nLatency histogram:")
+	tw = tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, b := range histogram(r.latencies) {
+		fmt.Fprintf(tw, "  < %s\t%d\n", b.upper, b.count)
+	}
+	tw.Flush()
+
+	fmt.Fprintln(out, "\nQueries:")
+	tw = tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	var methods []string
+	var queries int
+	for m, n := range r.queries {
+		methods = append(methods, m)
+		queries += n
+	}
+	sort.Strings(methods)
+	for _, m := range methods {
+		fmt.Fprintf(tw, "  %s\t%d\n", m, r.queries[m])
+	}
+	if r.completed > 0 {
+		fmt.Fprintf(tw, "  per item\t%.2f\n", float64(queries)/float64(r.completed))
+	}
+	tw.Flush()
+}
+
+// percentile returns the pth percentile of the sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+type bucket struct {
+	upper time.Duration
+	count int
+}
+
+// histogram counts the sorted durations in buckets doubling from 1ms, up to the largest.
+func histogram(sorted []time.Duration) []bucket {
+	if len(sorted) == 0 {
+		return nil
+	}
+	buckets := []bucket{{upper: time.Millisecond}}
+	for _, d := range sorted {
+		for d >= buckets[len(buckets)-1].upper {
+			buckets = append(buckets, bucket{upper: 2 * buckets[len(buckets)-1].upper})
+		}
+		buckets[len(buckets)-1].count++
+	}
+	return buckets
+}
+
+// latencyProcessor completes every item after a fixed latency, recording when it started.
+type latencyProcessor struct {
+	latency time.Duration
+	started sync.Map
+}
+
+func (p *latencyProcessor) Process(id string, b []byte) (*state.ProcessorResponse, error) {
+	p.started.Store(id, time.Now())
+	if p.latency > 0 {
+		time.Sleep(p.latency)
+	}
+	return &state.ProcessorResponse{Complete: true, Data: b}, nil
+}
+
+func (p *latencyProcessor) Healthcheck(ctx context.Context) error {
+	return nil
+}
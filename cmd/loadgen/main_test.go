@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	args := []string{"--partitions=3", "--items=20", "--watchers=2", "--batch_size=4", "--poll_interval=10ms", "--latency=1ms", "--timeout=1m"}
+	if code := run(context.Background(), args, &stdout, &stderr); code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, stderr.String())
+	}
+	out := stdout.String()
+	for _, want := range []string{"60 of 60 completed", "Throughput:", "OCC conflicts:", "Latency p99:", "< 2ms", "SaveWithOutbox", "per item"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output is missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestRunInvalidFlags(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := run(context.Background(), []string{"--watchers=0"}, &stdout, &stderr); code != 2 {
+		t.Errorf("unexpected exit code %d", code)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	ms := time.Millisecond
+	got := histogram([]time.Duration{ms / 2, ms, 3 * ms, 3 * ms, 9 * ms})
+	want := []bucket{{ms, 1}, {2 * ms, 1}, {4 * ms, 2}, {8 * ms, 0}, {16 * ms, 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected histogram %v, want %v", got, want)
+	}
+	if p := percentile([]time.Duration{ms, 2 * ms, 3 * ms, 4 * ms}, 0.5); p != 2*ms {
+		t.Errorf("unexpected p50 %s", p)
+	}
+}
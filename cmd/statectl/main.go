@@ -0,0 +1,532 @@
+// Command statectl performs common operations against the state database, such as listing
+// failed partitions, retrying failed items, and enqueueing new items.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/adminapi"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+	"github.com/google/uuid"
+	"gorm.io/driver/sqlite"
+	"gorm.io/driver/sqlserver"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+const (
+	exitOK = iota
+	exitError
+	exitUsage
+	exitNotFound
+)
+
+const usage = `usage: statectl <command> [flags] [args]
+
+commands:
+  partitions list [--status=failed] [--owner=o] [--prefix=p] [--labels=k=v,...]
+  partitions create <id> [--labels=k=v,...] [--depends_on=<id>] [--gate_plan=name,...] [--max_gate=n]
+  partitions retry-failed <id> [--yes]
+  partitions reopen <id> [--gate=n] [--yes]
+  partitions export <id> [--file=path]
+  partitions import [--file=path] [--partition=<id>] [--item_prefix=p] [--reset_statuses] [--reset_retries]
+  items list [--partition=<id>] [--status=failed] [--last_owner=o] [--processed_within=1h]
+  items show <id>
+  items enqueue --partition=<id> --data=<json|@file> [--id=<id>] [--gate=n] [--metadata=k=v,...] [--idempotency_key=<key>]
+
+Run "statectl <command> -h" for the flags of each command.
+`
+
+func main() {
+	os.Exit(run(context.Background(), os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// env holds the flags common to every command, and where to read input and write output.
+type env struct {
+	sqlConnStr  string
+	local       bool
+	sqlitePath  string
+	tablePrefix string
+	tenant      string
+	output      string
+	yes         bool
+
+	stdin  *bufio.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func (e *env) register(fs *flag.FlagSet) {
+	fs.StringVar(&e.sqlConnStr, "sql_connection", "", "sql connection string")
+	fs.BoolVar(&e.local, "local", false, "whether to use a local sqlite3 database")
+	fs.StringVar(&e.sqlitePath, "sqlite_path", "test.db", "path of the sqlite3 database when --local is set")
+	fs.StringVar(&e.tablePrefix, "table_prefix", "", "the table prefix to use")
+	fs.StringVar(&e.tenant, "tenant", "", "only operate on the partitions and items of this tenant")
+	fs.StringVar(&e.output, "o", "table", "output format, one of table or json")
+}
+
+func (e *env) repo() (*state.GormRepo, error) {
+	gConf := &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+		NamingStrategy: schema.NamingStrategy{
+			TablePrefix: e.tablePrefix,
+		},
+	}
+	var dialector gorm.Dialector
+	if e.local {
+		dialector = sqlite.Open(e.sqlitePath)
+	} else {
+		dialector = sqlserver.Open(e.sqlConnStr)
+	}
+	db, err := gorm.Open(dialector, gConf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	r, err := state.NewGormRepo(db)
+	if err != nil {
+		return nil, err
+	}
+	r.Tenant = e.tenant
+	return r, nil
+}
+
+// confirm asks the user to confirm a destructive action, unless --yes was given.
+func (e *env) confirm(prompt string) bool {
+	if e.yes {
+		return true
+	}
+	fmt.Fprintf(e.stderr, "%s [y/N]: ", prompt)
+	answer, _ := e.stdin.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+type usageError struct{ error }
+
+type command struct {
+	name string
+	// flags registers the command's flags, and returns the function that runs it.
+	flags func(fs *flag.FlagSet, e *env) func(ctx context.Context, repo state.Repo, args []string) error
+}
+
+var commands = []command{
+	{"partitions list", partitionsList},
+	{"partitions create", partitionsCreate},
+	{"partitions retry-failed", partitionsRetryFailed},
+	{"partitions reopen", partitionsReopen},
+	{"partitions export", partitionsExport},
+	{"partitions import", partitionsImport},
+	{"items list", itemsList},
+	{"items show", itemsShow},
+	{"items enqueue", itemsEnqueue},
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) < 2 {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+	name := args[0] + " " + args[1]
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+		e := &env{stdin: bufio.NewReader(stdin), stdout: stdout, stderr: stderr}
+		fs := flag.NewFlagSet("statectl "+name, flag.ContinueOnError)
+		fs.SetOutput(stderr)
+		e.register(fs)
+		runFunc := c.flags(fs, e)
+		positional, err := parse(fs, args[2:])
+		if err != nil {
+			return exitUsage
+		}
+		if e.output != "table" && e.output != "json" {
+			fmt.Fprintf(stderr, "unknown output format %q\n", e.output)
+			return exitUsage
+		}
+		repo, err := e.repo()
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		err = runFunc(ctx, repo, positional)
+		var uerr usageError
+		switch {
+		case err == nil:
+			return exitOK
+		case errors.As(err, &uerr):
+			fmt.Fprintln(stderr, err)
+			fs.Usage()
+			return exitUsage
+		case state.IsNotFound(err):
+			fmt.Fprintln(stderr, err)
+			return exitNotFound
+		default:
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+	}
+	fmt.Fprintf(stderr, "unknown command %q\n%s", name, usage)
+	return exitUsage
+}
+
+// parse parses flags which may be interspersed with positional arguments, as in
+// "partitions reopen p1 --gate=2", returning the positional arguments.
+func parse(fs *flag.FlagSet, args []string) (positional []string, err error) {
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func oneID(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", usageError{errors.New("expected exactly one ID argument")}
+	}
+	return args[0], nil
+}
+
+func (e *env) printJSON(v interface{}) error {
+	enc := json.NewEncoder(e.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (e *env) printPartitions(partitions []*state.Partition) error {
+	if e.output == "json" {
+		out := []adminapi.Partition{}
+		for _, p := range partitions {
+			out = append(out, adminapi.NewPartition(p))
+		}
+		return e.printJSON(out)
+	}
+	tw := tabwriter.NewWriter(e.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATUS\tGATE\tOWNER\tLEASED UNTIL\tUPDATED\tLABELS\tREASON")
+	for _, p := range partitions {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", p.ID, p.Status, p.GateName(), p.Owner,
+			p.Until.Format(time.RFC3339), p.UpdatedAt.Format(time.RFC3339), p.Labels, p.StatusReason)
+	}
+	return tw.Flush()
+}
+
+func (e *env) printItem(i *state.Item) error {
+	if e.output == "json" {
+		return e.printJSON(adminapi.NewItem(i))
+	}
+	tw := tabwriter.NewWriter(e.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID:\t%s\n", i.ID)
+	fmt.Fprintf(tw, "Partition:\t%s\n", i.PartitionID)
+	fmt.Fprintf(tw, "Status:\t%s\n", i.Status)
+	fmt.Fprintf(tw, "Gate:\t%d\n", i.Gate)
+	fmt.Fprintf(tw, "Retries:\t%d\n", i.RetryCount)
+	fmt.Fprintf(tw, "Version:\t%d\n", i.Version)
+	fmt.Fprintf(tw, "Created:\t%s\n", i.CreatedAt.Format(time.RFC3339))
+	fmt.Fprintf(tw, "Updated:\t%s\n", i.UpdatedAt.Format(time.RFC3339))
+	if i.LastProcessedAt != nil {
+		fmt.Fprintf(tw, "Last owner:\t%s at %s\n", i.LastOwner, i.LastProcessedAt.Format(time.RFC3339))
+	}
+	fmt.Fprintf(tw, "Errors:\t%s\n", strings.ReplaceAll(i.ErrorMessages, "\n", "\n\t"))
+	fmt.Fprintf(tw, "Metadata:\t%s\n", state.PartitionLabels(i.Metadata))
+	fmt.Fprintf(tw, "Data:\t%s\n", i.Data)
+	return tw.Flush()
+}
+
+func (e *env) printItems(items []*state.Item) error {
+	if e.output == "json" {
+		out := []adminapi.Item{}
+		for _, i := range items {
+			out = append(out, adminapi.NewItem(i))
+		}
+		return e.printJSON(out)
+	}
+	tw := tabwriter.NewWriter(e.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tPARTITION\tSTATUS\tGATE\tRETRIES\tLAST OWNER\tLAST PROCESSED")
+	for _, i := range items {
+		processed := ""
+		if i.LastProcessedAt != nil {
+			processed = i.LastProcessedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\t%s\n", i.ID, i.PartitionID, i.Status, i.Gate, i.RetryCount, i.LastOwner, processed)
+	}
+	return tw.Flush()
+}
+
+func partitionsList(fs *flag.FlagSet, e *env) func(context.Context, state.Repo, []string) error {
+	status := fs.String("status", "", "only list partitions with this status")
+	owner := fs.String("owner", "", "only list partitions leased by this owner")
+	prefix := fs.String("prefix", "", "only list partitions whose ID starts with this prefix")
+	var labels state.PartitionLabels
+	fs.Var(&labels, "labels", "only list partitions with all of these labels, as key=value,...")
+	return func(ctx context.Context, repo state.Repo, args []string) error {
+		filter := state.PartitionFilter{Owner: *owner, IDPrefix: *prefix, Labels: labels}
+		if *status != "" {
+			st, err := state.ParseStatus(*status)
+			if err != nil {
+				return usageError{err}
+			}
+			filter.Status = st
+		}
+		var all []*state.Partition
+		page := state.PageRequest{}
+		for {
+			partitions, token, err := repo.ListPartitions(ctx, filter, page)
+			if err != nil {
+				return err
+			}
+			all = append(all, partitions...)
+			if token == "" {
+				break
+			}
+			page.Token = token
+		}
+		return e.printPartitions(all)
+	}
+}
+
+func partitionsCreate(fs *flag.FlagSet, e *env) func(context.Context, state.Repo, []string) error {
+	var labels state.PartitionLabels
+	fs.Var(&labels, "labels", "labels of the new partition, as key=value,...")
+	dependsOn := fs.String("depends_on", "", "ID of a partition that must complete before the new partition is leased")
+	var plan state.GatePlan
+	fs.Var(&plan, "gate_plan", "names of the new partition's gates, in order, as name,...")
+	maxGate := fs.Int("max_gate", 0, "last gate of the new partition, which completes once every item up to it is done, 0 for no limit")
+	return func(ctx context.Context, repo state.Repo, args []string) error {
+		id, err := oneID(args)
+		if err != nil {
+			return err
+		}
+		p := &state.Partition{BaseModel: state.BaseModel{ID: id}, Labels: labels, DependsOn: *dependsOn, GatePlan: plan, MaxGate: *maxGate}
+		if err := repo.CreatePartition(ctx, p); err != nil {
+			return err
+		}
+		return e.printPartitions([]*state.Partition{p})
+	}
+}
+
+func partitionsRetryFailed(fs *flag.FlagSet, e *env) func(context.Context, state.Repo, []string) error {
+	fs.BoolVar(&e.yes, "yes", false, "don't prompt for confirmation")
+	return func(ctx context.Context, repo state.Repo, args []string) error {
+		id, err := oneID(args)
+		if err != nil {
+			return err
+		}
+		if _, err := repo.GetPartition(ctx, id); err != nil {
+			return err
+		}
+		if !e.confirm(fmt.Sprintf("Retry all failed items in partition %s?", id)) {
+			return errors.New("aborted")
+		}
+		n, err := repo.RetryFailedItems(ctx, id)
+		if err != nil {
+			return err
+		}
+		if e.output == "json" {
+			return e.printJSON(adminapi.RetryResult{Retried: n})
+		}
+		fmt.Fprintf(e.stdout, "retried %d items in partition %s\n", n, id)
+		return nil
+	}
+}
+
+func partitionsReopen(fs *flag.FlagSet, e *env) func(context.Context, state.Repo, []string) error {
+	fs.BoolVar(&e.yes, "yes", false, "don't prompt for confirmation")
+	gate := fs.Int("gate", -1, "move the partition to this gate, instead of leaving the gate unchanged")
+	return func(ctx context.Context, repo state.Repo, args []string) error {
+		id, err := oneID(args)
+		if err != nil {
+			return err
+		}
+		if _, err := repo.GetPartition(ctx, id); err != nil {
+			return err
+		}
+		var g *int
+		prompt := fmt.Sprintf("Reopen partition %s?", id)
+		if *gate >= 0 {
+			g = gate
+			prompt = fmt.Sprintf("Reopen partition %s at gate %d?", id, *gate)
+		}
+		if !e.confirm(prompt) {
+			return errors.New("aborted")
+		}
+		if err := repo.ReopenPartition(ctx, id, g); err != nil {
+			return err
+		}
+		p, err := repo.GetPartition(ctx, id)
+		if err != nil {
+			return err
+		}
+		return e.printPartitions([]*state.Partition{p})
+	}
+}
+
+func partitionsExport(fs *flag.FlagSet, e *env) func(context.Context, state.Repo, []string) error {
+	file := fs.String("file", "", "write the export to this file instead of stdout")
+	return func(ctx context.Context, repo state.Repo, args []string) error {
+		id, err := oneID(args)
+		if err != nil {
+			return err
+		}
+		if *file == "" {
+			return repo.ExportPartition(ctx, id, e.stdout)
+		}
+		f, err := os.Create(*file)
+		if err != nil {
+			return err
+		}
+		if err := repo.ExportPartition(ctx, id, f); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+}
+
+func partitionsImport(fs *flag.FlagSet, e *env) func(context.Context, state.Repo, []string) error {
+	file := fs.String("file", "", "read the export from this file instead of stdin")
+	opts := state.ImportOptions{}
+	fs.StringVar(&opts.PartitionID, "partition", "", "import the partition under this ID instead of its own")
+	fs.StringVar(&opts.ItemIDPrefix, "item_prefix", "", "prefix the IDs of the imported items with this")
+	fs.BoolVar(&opts.ResetStatuses, "reset_statuses", false, "make the partition and its items available")
+	fs.BoolVar(&opts.ResetRetries, "reset_retries", false, "zero the retry counts of the items")
+	return func(ctx context.Context, repo state.Repo, args []string) error {
+		if len(args) != 0 {
+			return usageError{fmt.Errorf("unexpected arguments %v", args)}
+		}
+		var r io.Reader = e.stdin
+		if *file != "" {
+			f, err := os.Open(*file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		p, err := repo.ImportPartition(ctx, r, opts)
+		if err != nil {
+			return err
+		}
+		return e.printPartitions([]*state.Partition{p})
+	}
+}
+
+func itemsList(fs *flag.FlagSet, e *env) func(context.Context, state.Repo, []string) error {
+	partition := fs.String("partition", "", "only list the items of this partition")
+	status := fs.String("status", "", "only list items with this status")
+	lastOwner := fs.String("last_owner", "", "only list items last processed by this owner")
+	within := fs.Duration("processed_within", 0, "only list items last processed within this long")
+	return func(ctx context.Context, repo state.Repo, args []string) error {
+		if len(args) != 0 {
+			return usageError{fmt.Errorf("unexpected arguments %v", args)}
+		}
+		filter := state.ItemFilter{PartitionID: *partition, LastOwner: *lastOwner}
+		if *status != "" {
+			st, err := state.ParseStatus(*status)
+			if err != nil {
+				return usageError{err}
+			}
+			filter.Status = st
+		}
+		if *within > 0 {
+			filter.ProcessedSince = time.Now().Add(-*within)
+		}
+		var all []*state.Item
+		page := state.PageRequest{}
+		for {
+			items, token, err := repo.ListItems(ctx, filter, page)
+			if err != nil {
+				return err
+			}
+			all = append(all, items...)
+			if token == "" {
+				break
+			}
+			page.Token = token
+		}
+		return e.printItems(all)
+	}
+}
+
+func itemsShow(fs *flag.FlagSet, e *env) func(context.Context, state.Repo, []string) error {
+	return func(ctx context.Context, repo state.Repo, args []string) error {
+		id, err := oneID(args)
+		if err != nil {
+			return err
+		}
+		i, err := repo.GetItem(ctx, id)
+		if err != nil {
+			return err
+		}
+		return e.printItem(i)
+	}
+}
+
+func itemsEnqueue(fs *flag.FlagSet, e *env) func(context.Context, state.Repo, []string) error {
+	partition := fs.String("partition", "", "the partition to add the item to")
+	id := fs.String("id", "", "the item ID, defaults to a random UUID")
+	gate := fs.Int("gate", 0, "the gate of the new item")
+	data := fs.String("data", "", "the item data, or @path to read it from a file")
+	var metadata state.PartitionLabels
+	fs.Var(&metadata, "metadata", "metadata for the processor, as key=value,...")
+	key := fs.String("idempotency_key", "", "enqueue the item only if no item of the partition has this key, printing the existing item otherwise")
+	return func(ctx context.Context, repo state.Repo, args []string) error {
+		if len(args) != 0 {
+			return usageError{fmt.Errorf("unexpected arguments %v", args)}
+		}
+		if *partition == "" || *data == "" {
+			return usageError{errors.New("--partition and --data are required")}
+		}
+		buf := []byte(*data)
+		if strings.HasPrefix(*data, "@") {
+			var err error
+			if buf, err = ioutil.ReadFile(strings.TrimPrefix(*data, "@")); err != nil {
+				return err
+			}
+		}
+		if _, err := repo.GetPartition(ctx, *partition); err != nil {
+			return err
+		}
+		if *id == "" {
+			*id = uuid.New().String()
+		}
+		i := &state.Item{
+			BaseModel:   state.BaseModel{ID: *id},
+			PartitionID: *partition,
+			Gate:        *gate,
+			Data:        buf,
+			Metadata:    state.ItemMetadata(metadata),
+		}
+		if *key != "" {
+			i.IdempotencyKey = key
+		}
+		if err := repo.CreateItems(ctx, i); err != nil {
+			return err
+		}
+		if i.IdempotencyKey != nil {
+			// The item may already have existed, print it as stored.
+			existing, err := repo.GetItem(ctx, i.ID)
+			if err != nil {
+				return err
+			}
+			i = existing
+		}
+		return e.printItem(i)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/adminapi"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+)
+
+// testDB seeds a sqlite database, and returns the flags to connect to it and the repo.
+func testDB(t *testing.T) ([]string, *state.GormRepo) {
+	dir, err := ioutil.TempDir("", "statectl_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	e := &env{local: true, sqlitePath: filepath.Join(dir, "test.db"), tablePrefix: "ctl_"}
+	repo, err := e.repo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := repo.DB.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	if err := repo.AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	repo.Save(ctx, &state.Partition{BaseModel: state.BaseModel{ID: "p1"}, Status: state.Failed})
+	repo.Save(ctx, &state.Partition{BaseModel: state.BaseModel{ID: "p2"}, Status: state.Available})
+	repo.Save(ctx, &state.Item{BaseModel: state.BaseModel{ID: "i1"}, PartitionID: "p1", Status: state.Failed, RetryCount: 5, Data: []byte(`{"a":1}`)})
+	return []string{"--local", "--sqlite_path=" + e.sqlitePath, "--table_prefix=ctl_"}, repo
+}
+
+func runCmd(t *testing.T, stdin string, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestPartitionsList(t *testing.T) {
+	conn, _ := testDB(t)
+
+	code, out, errOut := runCmd(t, "", append([]string{"partitions", "list", "--status=failed"}, conn...)...)
+	if code != exitOK {
+		t.Fatalf("unexpected exit code %d: %s", code, errOut)
+	}
+	if !strings.Contains(out, "p1") || strings.Contains(out, "p2") {
+		t.Errorf("unexpected table output:\n%s", out)
+	}
+
+	code, out, _ = runCmd(t, "", append([]string{"partitions", "list", "-o", "json"}, conn...)...)
+	if code != exitOK {
+		t.Fatalf("unexpected exit code %d", code)
+	}
+	var partitions []adminapi.Partition
+	if err := json.Unmarshal([]byte(out), &partitions); err != nil {
+		t.Fatal(err)
+	}
+	if len(partitions) != 2 {
+		t.Errorf("expected 2 partitions, got %+v", partitions)
+	}
+
+	if code, _, _ := runCmd(t, "", append([]string{"partitions", "list", "--status=bogus"}, conn...)...); code != exitUsage {
+		t.Errorf("expected usage exit code for an unknown status, got %d", code)
+	}
+}
+
+func TestPartitionsCreate(t *testing.T) {
+	conn, repo := testDB(t)
+
+	code, _, errOut := runCmd(t, "", append([]string{"partitions", "create", "p3", "--labels=gpu=true,zone=a"}, conn...)...)
+	if code != exitOK {
+		t.Fatalf("unexpected exit code %d: %s", code, errOut)
+	}
+	p, err := repo.GetPartition(context.Background(), "p3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != state.Available || p.Labels.String() != "gpu=true,zone=a" {
+		t.Errorf("unexpected partition %+v", p)
+	}
+
+	code, out, _ := runCmd(t, "", append([]string{"partitions", "list", "--labels=gpu=true"}, conn...)...)
+	if code != exitOK || !strings.Contains(out, "p3") || strings.Contains(out, "p2") {
+		t.Errorf("unexpected output for labels, exit code %d:\n%s", code, out)
+	}
+	if code, _, _ := runCmd(t, "", append([]string{"partitions", "create", "p3"}, conn...)...); code != exitError {
+		t.Errorf("expected creating an existing partition to fail, got %d", code)
+	}
+	if code, _, _ := runCmd(t, "", append([]string{"partitions", "create", "p4", "--labels=gpu"}, conn...)...); code != exitUsage {
+		t.Errorf("expected usage exit code for invalid labels, got %d", code)
+	}
+	if code, _, errOut := runCmd(t, "", append([]string{"partitions", "create", "p5", "--depends_on=p3"}, conn...)...); code != exitOK {
+		t.Fatalf("unexpected exit code %d: %s", code, errOut)
+	}
+	if p, err := repo.GetPartition(context.Background(), "p5"); err != nil || p.DependsOn != "p3" {
+		t.Errorf("expected p5 to depend on p3, got %+v, %v", p, err)
+	}
+	if code, _, _ := runCmd(t, "", append([]string{"partitions", "create", "p6", "--depends_on=p6"}, conn...)...); code != exitError {
+		t.Errorf("expected a partition depending on itself to fail, got %d", code)
+	}
+	code, out, errOut = runCmd(t, "", append([]string{"partitions", "create", "p7", "--gate_plan=validate,upload", "--max_gate=1"}, conn...)...)
+	if code != exitOK || !strings.Contains(out, "validate") {
+		t.Errorf("expected the gate name in the output, exit code %d: %s%s", code, out, errOut)
+	}
+	if p, err := repo.GetPartition(context.Background(), "p7"); err != nil || p.MaxGate != 1 {
+		t.Errorf("expected p7 to stop at gate 1, got %+v, %v", p, err)
+	}
+	if code, _, _ := runCmd(t, "", append([]string{"partitions", "create", "p8", "--gate_plan=a,a"}, conn...)...); code != exitUsage {
+		t.Errorf("expected usage exit code for an invalid gate plan, got %d", code)
+	}
+}
+
+func TestItemsShow(t *testing.T) {
+	conn, _ := testDB(t)
+
+	code, out, _ := runCmd(t, "", append([]string{"items", "show", "i1", "-o", "json"}, conn...)...)
+	if code != exitOK {
+		t.Fatalf("unexpected exit code %d", code)
+	}
+	var item adminapi.Item
+	if err := json.Unmarshal([]byte(out), &item); err != nil {
+		t.Fatal(err)
+	}
+	var data bytes.Buffer
+	if err := json.Compact(&data, item.Data); err != nil {
+		t.Fatal(err)
+	}
+	if item.ID != "i1" || item.Status != state.Failed || data.String() != `{"a":1}` {
+		t.Errorf("unexpected item %+v", item)
+	}
+
+	code, out, _ = runCmd(t, "", append([]string{"items", "show", "i1"}, conn...)...)
+	if code != exitOK || !strings.Contains(out, "Failed") {
+		t.Errorf("unexpected table output %d:\n%s", code, out)
+	}
+
+	if code, _, _ := runCmd(t, "", append([]string{"items", "show", "missing"}, conn...)...); code != exitNotFound {
+		t.Errorf("expected not found exit code, got %d", code)
+	}
+	if code, _, _ := runCmd(t, "", append([]string{"items", "show"}, conn...)...); code != exitUsage {
+		t.Errorf("expected usage exit code without an ID, got %d", code)
+	}
+}
+
+func TestItemsList(t *testing.T) {
+	conn, repo := testDB(t)
+	ctx := context.Background()
+	recently, earlier := time.Now().Add(-time.Minute), time.Now().Add(-2*time.Hour)
+	repo.Save(ctx, &state.Item{BaseModel: state.BaseModel{ID: "i2"}, PartitionID: "p2", Status: state.Complete, Data: []byte(`{}`), LastOwner: "pod-a", LastProcessedAt: &recently})
+	repo.Save(ctx, &state.Item{BaseModel: state.BaseModel{ID: "i3"}, PartitionID: "p2", Status: state.Complete, Data: []byte(`{}`), LastOwner: "pod-a", LastProcessedAt: &earlier})
+	repo.Save(ctx, &state.Item{BaseModel: state.BaseModel{ID: "i4"}, PartitionID: "p2", Status: state.Complete, Data: []byte(`{}`), LastOwner: "pod-b", LastProcessedAt: &recently})
+
+	code, out, errOut := runCmd(t, "", append([]string{"items", "list", "--last_owner=pod-a", "--processed_within=1h", "-o", "json"}, conn...)...)
+	if code != exitOK {
+		t.Fatalf("unexpected exit code %d: %s", code, errOut)
+	}
+	var items []adminapi.Item
+	if err := json.Unmarshal([]byte(out), &items); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].ID != "i2" || items[0].LastOwner != "pod-a" {
+		t.Errorf("expected only the item pod-a processed within the hour, got %+v", items)
+	}
+
+	code, out, _ = runCmd(t, "", append([]string{"items", "list", "--partition=p1"}, conn...)...)
+	if code != exitOK || !strings.Contains(out, "i1") || strings.Contains(out, "i2") {
+		t.Errorf("unexpected table output %d:\n%s", code, out)
+	}
+}
+
+func TestPartitionsRetryFailed(t *testing.T) {
+	conn, repo := testDB(t)
+	ctx := context.Background()
+
+	// Declining the prompt must not change anything.
+	if code, _, _ := runCmd(t, "n\n", append([]string{"partitions", "retry-failed", "p1"}, conn...)...); code != exitError {
+		t.Errorf("expected error exit code when aborting, got %d", code)
+	}
+	if i, _ := repo.GetItem(ctx, "i1"); i.Status != state.Failed {
+		t.Errorf("expected item to remain failed, got %s", i.Status)
+	}
+
+	code, out, errOut := runCmd(t, "y\n", append([]string{"partitions", "retry-failed", "p1"}, conn...)...)
+	if code != exitOK {
+		t.Fatalf("unexpected exit code %d: %s", code, errOut)
+	}
+	if !strings.Contains(out, "retried 1 items") {
+		t.Errorf("unexpected output %s", out)
+	}
+	if i, _ := repo.GetItem(ctx, "i1"); i.Status != state.Available || i.RetryCount != 0 {
+		t.Errorf("expected item to be retried, got %s with %d retries", i.Status, i.RetryCount)
+	}
+
+	if code, _, _ := runCmd(t, "", append([]string{"partitions", "retry-failed", "missing", "--yes"}, conn...)...); code != exitNotFound {
+		t.Errorf("expected not found exit code, got %d", code)
+	}
+}
+
+func TestPartitionsReopen(t *testing.T) {
+	conn, repo := testDB(t)
+
+	code, _, errOut := runCmd(t, "", append([]string{"partitions", "reopen", "p1", "--gate=2", "--yes"}, conn...)...)
+	if code != exitOK {
+		t.Fatalf("unexpected exit code %d: %s", code, errOut)
+	}
+	p, err := repo.GetPartition(context.Background(), "p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != state.Available || p.Gate != 2 {
+		t.Errorf("unexpected partition %+v", p)
+	}
+	if code, _, _ := runCmd(t, "", append([]string{"partitions", "reopen", "missing", "--yes"}, conn...)...); code != exitNotFound {
+		t.Errorf("expected not found exit code, got %d", code)
+	}
+}
+
+func TestPartitionsExportImport(t *testing.T) {
+	conn, repo := testDB(t)
+
+	code, export, errOut := runCmd(t, "", append([]string{"partitions", "export", "p1"}, conn...)...)
+	if code != exitOK {
+		t.Fatalf("unexpected exit code %d: %s", code, errOut)
+	}
+	code, out, errOut := runCmd(t, export, append([]string{"partitions", "import", "--partition=replay", "--item_prefix=replay-", "--reset_statuses", "--reset_retries"}, conn...)...)
+	if code != exitOK || !strings.Contains(out, "replay") {
+		t.Fatalf("unexpected exit code %d: %s%s", code, out, errOut)
+	}
+	i, err := repo.GetItem(context.Background(), "replay-i1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.PartitionID != "replay" || i.Status != state.Available || i.RetryCount != 0 || string(i.Data) != `{"a":1}` {
+		t.Errorf("unexpected item %+v", i)
+	}
+	// The partition exists already.
+	if code, _, _ := runCmd(t, export, append([]string{"partitions", "import"}, conn...)...); code != exitError {
+		t.Errorf("expected error exit code, got %d", code)
+	}
+	if code, _, _ := runCmd(t, "", append([]string{"partitions", "export", "missing"}, conn...)...); code != exitNotFound {
+		t.Errorf("expected not found exit code, got %d", code)
+	}
+}
+
+func TestItemsEnqueue(t *testing.T) {
+	conn, repo := testDB(t)
+	f, err := ioutil.TempFile("", "statectl_data_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"from":"file"}`)
+	f.Close()
+
+	code, _, errOut := runCmd(t, "", append([]string{"items", "enqueue", "--partition=p2", "--id=new", "--gate=1", "--metadata=model=v2", "--data=@" + f.Name()}, conn...)...)
+	if code != exitOK {
+		t.Fatalf("unexpected exit code %d: %s", code, errOut)
+	}
+	i, err := repo.GetItem(context.Background(), "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.PartitionID != "p2" || i.Gate != 1 || i.Status != state.Available || string(i.Data) != `{"from":"file"}` || i.Metadata["model"] != "v2" {
+		t.Errorf("unexpected item %+v", i)
+	}
+
+	code, _, _ = runCmd(t, "", append([]string{"items", "enqueue", "--partition=p2", `--data={"inline":true}`}, conn...)...)
+	if code != exitOK {
+		t.Errorf("unexpected exit code %d", code)
+	}
+	for _, id := range []string{"keyed", "retried"} {
+		code, out, errOut := runCmd(t, "", append([]string{"items", "enqueue", "--partition=p2", "--id=" + id, "--idempotency_key=k", "--data={}"}, conn...)...)
+		if code != exitOK || !strings.Contains(out, "keyed") {
+			t.Errorf("expected the keyed item, got exit code %d: %s%s", code, out, errOut)
+		}
+	}
+	if _, err := repo.GetItem(context.Background(), "retried"); !state.IsNotFound(err) {
+		t.Errorf("expected the retried enqueue not to create an item, got %v", err)
+	}
+	if code, _, _ := runCmd(t, "", append([]string{"items", "enqueue", "--partition=missing", "--data={}"}, conn...)...); code != exitNotFound {
+		t.Errorf("expected not found exit code, got %d", code)
+	}
+	if code, _, _ := runCmd(t, "", append([]string{"items", "enqueue", "--data={}"}, conn...)...); code != exitUsage {
+		t.Errorf("expected usage exit code without a partition, got %d", code)
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	if code, _, _ := runCmd(t, "", "partitions", "explode"); code != exitUsage {
+		t.Errorf("expected usage exit code, got %d", code)
+	}
+}
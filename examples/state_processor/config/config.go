@@ -0,0 +1,445 @@
+// Package config loads the settings of the example state processor from a YAML or JSON
+// file, the environment and its flags.
+//
+// Every setting is also a flag, named by its flag tag, and an environment variable, named
+// by EnvPrefix followed by the flag's name in upper case, e.g. STATE_SQL_CONNECTION. Flags
+// set on the command line take precedence over the environment, which takes precedence over
+// the file, which takes precedence over the flags' defaults.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/processors/httprocessor"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of the environment variables overriding the settings.
+const EnvPrefix = "STATE_"
+
+// Config is the configuration of the example state processor.
+type Config struct {
+	Database  Database  `yaml:"database"`
+	Watcher   Watcher   `yaml:"watcher"`
+	Processor Processor `yaml:"processor"`
+	Server    Server    `yaml:"server"`
+	// Pipelines, if any, each run a watcher of their own, sharing the database pool. Their
+	// settings override the watcher's and processor's.
+	Pipelines []Pipeline `yaml:"pipelines"`
+	// Schedules create recurring partitions ahead of their activation, see state.Scheduler.
+	Schedules []Schedule `yaml:"schedules"`
+}
+
+// Database configures the connection to the database and the repo.
+type Database struct {
+	SQLConnection    string        `yaml:"sql_connection" flag:"sql_connection"`
+	Local            bool          `yaml:"local" flag:"local"`
+	TablePrefix      string        `yaml:"table_prefix" flag:"table_prefix"`
+	BlobDir          string        `yaml:"blob_dir" flag:"blob_dir"`
+	LogLevel         string        `yaml:"log_level" flag:"db_log_level"`
+	MaxOpenConns     int           `yaml:"max_open_conns" flag:"db_max_open_conns"`
+	MaxIdleConns     int           `yaml:"max_idle_conns" flag:"db_max_idle_conns"`
+	ConnMaxLifetime  time.Duration `yaml:"conn_max_lifetime" flag:"db_conn_max_lifetime"`
+	StatementTimeout time.Duration `yaml:"statement_timeout" flag:"db_statement_timeout"`
+	MigrateOnly      bool          `yaml:"migrate_only" flag:"migrate_only"`
+}
+
+// Watcher configures the watcher leasing and processing the partitions.
+type Watcher struct {
+	PollInterval           time.Duration     `yaml:"poll_interval" flag:"poll_interval"`
+	IdleMaxInterval        time.Duration     `yaml:"idle_max_interval" flag:"idle_max_interval"`
+	BatchSize              int               `yaml:"batch_size" flag:"batch_size"`
+	RateLimit              float64           `yaml:"rate_limit" flag:"rate_limit"`
+	RateBurst              int               `yaml:"rate_burst" flag:"rate_burst"`
+	FetchOrder             string            `yaml:"fetch_order" flag:"fetch_order"`
+	Tenant                 string            `yaml:"tenant" flag:"tenant"`
+	Selector               map[string]string `yaml:"selector" flag:"selector"`
+	StealFromDeadOwners    bool              `yaml:"steal_from_dead_owners" flag:"steal_from_dead_owners"`
+	LeaseFailedPartitions  bool              `yaml:"lease_failed_partitions" flag:"lease_failed_partitions"`
+	LeaderElection         string            `yaml:"leader_election" flag:"leader_election"`
+	KeepRetriesAcrossGates bool              `yaml:"keep_retries_across_gates" flag:"keep_retries_across_gates"`
+	DedupeByHash           bool              `yaml:"dedupe_by_hash" flag:"dedupe_by_hash"`
+	MaxGateSkip            int               `yaml:"max_gate_skip" flag:"max_gate_skip"`
+	BreakerThreshold       int               `yaml:"breaker_threshold" flag:"breaker_threshold"`
+	BreakerCooldown        time.Duration     `yaml:"breaker_cooldown" flag:"breaker_cooldown"`
+	GlobalBreaker          bool              `yaml:"global_breaker" flag:"global_breaker"`
+	ProcessingTimeout      time.Duration     `yaml:"processing_timeout" flag:"processing_timeout"`
+	FetchTimeout           time.Duration     `yaml:"fetch_timeout" flag:"fetch_timeout"`
+	SaveTimeout            time.Duration     `yaml:"save_timeout" flag:"save_timeout"`
+	DeadlineSweepInterval  time.Duration     `yaml:"deadline_sweep_interval" flag:"deadline_sweep_interval"`
+	StuckSweepInterval     time.Duration     `yaml:"stuck_sweep_interval" flag:"stuck_sweep_interval"`
+	CriticalHealthChecks   []string          `yaml:"critical_health_checks" flag:"critical_health_checks"`
+	ShutdownTimeout        time.Duration     `yaml:"shutdown_timeout" flag:"shutdown_timeout"`
+	LogEvents              bool              `yaml:"log_events" flag:"log_events"`
+}
+
+// Processor configures the HTTP processor posting the items to the target, and the webhook
+// notified of finished partitions.
+type Processor struct {
+	Target             string            `yaml:"target" flag:"target"`
+	GateTargets        map[string]string `yaml:"gate_targets" flag:"gate_targets"`
+	Timeout            time.Duration     `yaml:"timeout" flag:"target_timeout"`
+	Method             string            `yaml:"method" flag:"http_method"`
+	Codec              string            `yaml:"codec" flag:"codec"`
+	FormEncode         bool              `yaml:"form_encode" flag:"form_encode"`
+	GzipThreshold      int               `yaml:"gzip_threshold" flag:"gzip_threshold"`
+	MaxResponseBytes   int64             `yaml:"max_response_bytes" flag:"max_response_bytes"`
+	TLSCert            string            `yaml:"tls_cert" flag:"tls_cert"`
+	TLSKey             string            `yaml:"tls_key" flag:"tls_key"`
+	TLSRootCA          string            `yaml:"tls_root_ca" flag:"tls_root_ca"`
+	SigningKeys        map[string]string `yaml:"signing_keys" flag:"signing_keys"`
+	WebhookURL         string            `yaml:"webhook_url" flag:"webhook_url"`
+	WebhookSigningKeys map[string]string `yaml:"webhook_signing_keys" flag:"webhook_signing_keys"`
+}
+
+// Server configures the healthcheck, admin and debug endpoints.
+type Server struct {
+	HealthcheckAddress   string `yaml:"healthcheck_address" flag:"healthcheck_address"`
+	AdminAPI             bool   `yaml:"admin_api" flag:"admin_api"`
+	EnableDebugEndpoints bool   `yaml:"enable_debug_endpoints" flag:"enable_debug_endpoints"`
+	DebugAddress         string `yaml:"debug_address" flag:"debug_address"`
+}
+
+// Pipeline configures one of several watchers run by the binary. Its unset settings default
+// to the watcher's and processor's.
+type Pipeline struct {
+	// Name suffixes the watcher's owner ID, e.g. <owner>-ingest, under which its stats and
+	// health are served.
+	Name        string            `yaml:"name"`
+	Tenant      string            `yaml:"tenant"`
+	Selector    map[string]string `yaml:"selector"`
+	Target      string            `yaml:"target"`
+	GateTargets map[string]string `yaml:"gate_targets"`
+	BatchSize   int               `yaml:"batch_size"`
+}
+
+// Schedule configures a state.Scheduler.
+type Schedule struct {
+	// Cron is a standard cron expression, e.g. "0 2 * * *", evaluated in Location, UTC by
+	// default.
+	Cron     string `yaml:"cron"`
+	Location string `yaml:"location"`
+	// IDPrefix and IDFormat name each occurrence's partition, e.g. daily-report- and
+	// 2006-01-02 for daily-report-2024-05-01.
+	IDPrefix string            `yaml:"id_prefix"`
+	IDFormat string            `yaml:"id_format"`
+	Lead     time.Duration     `yaml:"lead"`
+	Labels   map[string]string `yaml:"labels"`
+	// Items are cloned into each occurrence's partition.
+	Items []ScheduleItem `yaml:"items"`
+}
+
+// ScheduleItem is an item cloned into each partition of a Schedule.
+type ScheduleItem struct {
+	ID   string `yaml:"id"`
+	Gate int    `yaml:"gate"`
+	// Data is the item's JSON payload. Defaults to {}.
+	Data string `yaml:"data"`
+}
+
+// Load returns the configuration given by the defaults of fs's flags, overridden by the
+// file at path if any, then by the environment variables looked up with lookupEnv, then by
+// the flags set on fs's command line, and validated.
+func Load(fs *flag.FlagSet, path string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	c := &Config{}
+	var errs []error
+	c.each(func(s setting) {
+		if f := fs.Lookup(s.flag); f != nil {
+			errs = append(errs, s.set(f.DefValue, "default of -"+s.flag))
+		}
+	})
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.decode(b); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	c.each(func(s setting) {
+		if v, ok := lookupEnv(s.env()); ok {
+			errs = append(errs, s.set(v, s.env()))
+		}
+	})
+	fs.Visit(func(f *flag.Flag) {
+		c.each(func(s setting) {
+			if s.flag == f.Name {
+				errs = append(errs, s.set(f.Value.String(), "-"+s.flag))
+			}
+		})
+	})
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// decode reads YAML, or JSON, over c, rejecting unknown settings.
+func (c *Config) decode(b []byte) error {
+	d := yaml.NewDecoder(bytes.NewReader(b))
+	d.KnownFields(true)
+	if err := d.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// Apply sets each of fs's flags to its setting, so that the flags reflect the configuration.
+func (c *Config) Apply(fs *flag.FlagSet) error {
+	var errs []error
+	c.each(func(s setting) {
+		f := fs.Lookup(s.flag)
+		if f == nil {
+			return
+		}
+		if v := s.String(); v != f.Value.String() {
+			if err := fs.Set(s.flag, v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", s.path, err))
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// Validate checks that the settings are consistent, returning an error naming each invalid
+// one.
+func (c *Config) Validate() error {
+	var errs []error
+	invalid := func(path, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+	}
+
+	if c.Database.SQLConnection == "" && !c.Database.Local {
+		invalid("database.sql_connection", "required unless database.local is set")
+	}
+	switch c.Database.LogLevel {
+	case "", "silent", "error", "warn", "info":
+	default:
+		invalid("database.log_level", "must be one of silent, error, warn or info, got %q", c.Database.LogLevel)
+	}
+	if c.Database.MaxOpenConns < 0 {
+		invalid("database.max_open_conns", "must not be negative, got %d", c.Database.MaxOpenConns)
+	}
+	if c.Database.StatementTimeout <= 0 {
+		invalid("database.statement_timeout", "must be positive, got %s", c.Database.StatementTimeout)
+	}
+
+	if c.Watcher.PollInterval <= 0 {
+		invalid("watcher.poll_interval", "must be positive, got %s", c.Watcher.PollInterval)
+	}
+	if c.Watcher.BatchSize <= 0 {
+		invalid("watcher.batch_size", "must be positive, got %d", c.Watcher.BatchSize)
+	}
+	if c.Watcher.RateLimit < 0 {
+		invalid("watcher.rate_limit", "must not be negative, got %g", c.Watcher.RateLimit)
+	}
+	if _, err := state.ParseItemOrder(c.Watcher.FetchOrder); err != nil {
+		invalid("watcher.fetch_order", "%s", err)
+	}
+	if c.Watcher.MaxGateSkip < 1 {
+		invalid("watcher.max_gate_skip", "must be at least 1, got %d", c.Watcher.MaxGateSkip)
+	}
+	for _, check := range c.Watcher.CriticalHealthChecks {
+		if check != state.HealthCheckRepo && check != state.HealthCheckProcessor {
+			invalid("watcher.critical_health_checks", "must be %s or %s, got %q", state.HealthCheckRepo, state.HealthCheckProcessor, check)
+		}
+	}
+
+	hasTarget := c.Processor.Target != "" || len(c.Processor.GateTargets) > 0
+	if !hasTarget && len(c.Pipelines) == 0 && !c.Database.MigrateOnly {
+		invalid("processor.target", "required unless processor.gate_targets are set")
+	}
+	checkGateTargets(invalid, "processor.gate_targets", c.Processor.GateTargets)
+
+	if _, err := httprocessor.ParseCodec(c.Processor.Codec); err != nil {
+		invalid("processor.codec", "%s, expected json, json-envelope or protobuf", err)
+	}
+	if c.Processor.Method == "" {
+		invalid("processor.method", "required")
+	}
+	if (c.Processor.TLSCert == "") != (c.Processor.TLSKey == "") {
+		invalid("processor.tls_key", "tls_cert and tls_key must be set together")
+	}
+	if len(c.Processor.WebhookSigningKeys) > 0 && c.Processor.WebhookURL == "" {
+		invalid("processor.webhook_signing_keys", "set without processor.webhook_url")
+	}
+
+	if c.Server.HealthcheckAddress == "" {
+		invalid("server.healthcheck_address", "required")
+	}
+	if c.Server.EnableDebugEndpoints && c.Server.DebugAddress == "" {
+		invalid("server.debug_address", "required with server.enable_debug_endpoints")
+	}
+
+	names := map[string]bool{}
+	for n, p := range c.Pipelines {
+		path := fmt.Sprintf("pipelines[%d]", n)
+		switch {
+		case p.Name == "":
+			invalid(path+".name", "required")
+		case strings.ContainsAny(p.Name, "/ "):
+			invalid(path+".name", "must not contain slashes or spaces, got %q", p.Name)
+		case names[p.Name]:
+			invalid(path+".name", "%q is taken by another pipeline", p.Name)
+		}
+		names[p.Name] = true
+		if !hasTarget && p.Target == "" && len(p.GateTargets) == 0 && !c.Database.MigrateOnly {
+			invalid(path+".target", "required unless its gate_targets, processor.target or processor.gate_targets are set")
+		}
+		checkGateTargets(invalid, path+".gate_targets", p.GateTargets)
+		if p.BatchSize < 0 {
+			invalid(path+".batch_size", "must not be negative, got %d", p.BatchSize)
+		}
+		if p.Tenant != "" && c.Watcher.Tenant != "" {
+			invalid(path+".tenant", "must not be set with watcher.tenant, which scopes the whole database to tenant %q", c.Watcher.Tenant)
+		}
+	}
+
+	prefixes := map[string]bool{}
+	for n, sched := range c.Schedules {
+		path := fmt.Sprintf("schedules[%d]", n)
+		if _, err := state.ParseSchedule(sched.Cron); err != nil {
+			invalid(path+".cron", "%s", err)
+		}
+		if _, err := time.LoadLocation(sched.Location); err != nil {
+			invalid(path+".location", "%s", err)
+		}
+		switch {
+		case sched.IDPrefix == "":
+			invalid(path+".id_prefix", "required")
+		case prefixes[sched.IDPrefix]:
+			invalid(path+".id_prefix", "%q is taken by another schedule", sched.IDPrefix)
+		}
+		prefixes[sched.IDPrefix] = true
+		if sched.Lead < 0 {
+			invalid(path+".lead", "must not be negative, got %s", sched.Lead)
+		}
+		for m, i := range sched.Items {
+			if i.ID == "" {
+				invalid(fmt.Sprintf("%s.items[%d].id", path, m), "required")
+			}
+			if i.Data != "" && !json.Valid([]byte(i.Data)) {
+				invalid(fmt.Sprintf("%s.items[%d].data", path, m), "must be JSON, got %q", i.Data)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkGateTargets checks that the gate targets at path map gate numbers to absolute URLs.
+func checkGateTargets(invalid func(path, format string, args ...interface{}), path string, targets map[string]string) {
+	gates := make([]string, 0, len(targets))
+	for gate := range targets {
+		gates = append(gates, gate)
+	}
+	sort.Strings(gates)
+	for _, gate := range gates {
+		if _, err := strconv.Atoi(gate); err != nil {
+			invalid(path, "gates must be numbers, got %q", gate)
+		}
+		if u, err := url.Parse(targets[gate]); err != nil || !u.IsAbs() {
+			invalid(path, "target of gate %s must be an absolute URL, got %q", gate, targets[gate])
+		}
+	}
+}
+
+// setting is one of the fields of a Config.
+type setting struct {
+	// path is the setting's name in the file, e.g. database.sql_connection.
+	path string
+	flag string
+	v    reflect.Value
+}
+
+// each calls fn for each setting of c.
+func (c *Config) each(fn func(s setting)) {
+	sections := reflect.ValueOf(c).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Type().Field(i).Tag.Get("yaml")
+		fields := sections.Field(i)
+		if fields.Kind() != reflect.Struct {
+			// Pipelines have no flags.
+			continue
+		}
+		for j := 0; j < fields.NumField(); j++ {
+			f := fields.Type().Field(j)
+			fn(setting{path: section + "." + f.Tag.Get("yaml"), flag: f.Tag.Get("flag"), v: fields.Field(j)})
+		}
+	}
+}
+
+// env returns the name of the environment variable overriding the setting.
+func (s setting) env() string {
+	return EnvPrefix + strings.ToUpper(s.flag)
+}
+
+// set parses the setting from the format of its flag, found at source.
+func (s setting) set(v, source string) error {
+	var err error
+	switch p := s.v.Addr().Interface().(type) {
+	case *string:
+		*p = v
+	case *bool:
+		*p, err = strconv.ParseBool(v)
+	case *int:
+		*p, err = strconv.Atoi(v)
+	case *int64:
+		*p, err = strconv.ParseInt(v, 10, 64)
+	case *float64:
+		*p, err = strconv.ParseFloat(v, 64)
+	case *time.Duration:
+		*p, err = time.ParseDuration(v)
+	case *[]string:
+		*p = nil
+		if v != "" {
+			*p = strings.Split(v, ",")
+		}
+	case *map[string]string:
+		var l state.PartitionLabels
+		l, err = state.ParseLabels(v)
+		*p = l
+		if len(l) == 0 {
+			*p = nil
+		}
+	default:
+		panic(fmt.Sprintf("config: unsupported type of %s", s.path))
+	}
+	if err != nil {
+		return fmt.Errorf("%s: invalid %s %q: %w", s.path, source, v, err)
+	}
+	return nil
+}
+
+// String formats the setting like its flag.
+func (s setting) String() string {
+	switch v := s.v.Interface().(type) {
+	case []string:
+		return strings.Join(v, ",")
+	case map[string]string:
+		return state.PartitionLabels(v).String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
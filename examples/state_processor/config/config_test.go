@@ -0,0 +1,130 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+// testFlags returns some of the example's flags, with their defaults.
+func testFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("sql_connection", "", "")
+	fs.Bool("local", false, "")
+	fs.Duration("db_statement_timeout", 30*time.Second, "")
+	fs.Duration("poll_interval", 10*time.Second, "")
+	fs.Int("batch_size", 50, "")
+	fs.String("fetch_order", "updated_at", "")
+	fs.Int("max_gate_skip", 1, "")
+	fs.String("target", "", "")
+	fs.Duration("target_timeout", 10*time.Second, "")
+	fs.String("http_method", "POST", "")
+	fs.String("codec", "json", "")
+	fs.String("healthcheck_address", ":8080", "")
+	fs.String("debug_address", "localhost:6060", "")
+	return fs
+}
+
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+// checkGolden compares got to the golden file of name, or rewrites it with -update.
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("%s differs from %s, run with -update if expected:\n%s", name, path, got)
+	}
+}
+
+func marshal(t *testing.T, c *Config) string {
+	t.Helper()
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestLoad(t *testing.T) {
+	for _, file := range []string{"full.yaml", "full.json"} {
+		t.Run(file, func(t *testing.T) {
+			c, err := Load(testFlags(), filepath.Join("testdata", file), env(nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Both formats describe the same configuration.
+			checkGolden(t, "full", marshal(t, c))
+		})
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	fs := testFlags()
+	if err := fs.Parse([]string{"-batch_size=5", "-target=https://flag/process"}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(fs, filepath.Join("testdata", "precedence.yaml"), env(map[string]string{
+		"STATE_SQL_CONNECTION": "from-env",
+		"STATE_BATCH_SIZE":     "20",
+		"STATE_CODEC":          "protobuf",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "precedence", marshal(t, c))
+
+	if err := c.Apply(fs); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"sql_connection": "from-env",
+		"poll_interval":  "5s",
+		"batch_size":     "5",
+		"codec":          "protobuf",
+		"target":         "https://flag/process",
+		"http_method":    "POST",
+	} {
+		if got := fs.Lookup(name).Value.String(); got != want {
+			t.Errorf("expected -%s=%s once applied, got %s", name, want, got)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, name := range []string{"invalid", "unknown", "malformed"} {
+		t.Run(name, func(t *testing.T) {
+			_, err := Load(testFlags(), filepath.Join("testdata", name+".yaml"), env(nil))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			checkGolden(t, name, err.Error()+"\n")
+		})
+	}
+
+	_, err := Load(testFlags(), "", env(map[string]string{"STATE_LOCAL": "yes please", "STATE_TARGET": "https://svc"}))
+	if err == nil || !strings.Contains(err.Error(), `database.local: invalid STATE_LOCAL "yes please"`) {
+		t.Errorf("expected the invalid environment variable to be named, got %v", err)
+	}
+}
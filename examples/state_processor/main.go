@@ -2,15 +2,27 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/examples/state_processor/config"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/adminapi"
 	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/processors/httprocessor"
 	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state/migrations"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/webhook"
 	"github.com/etherlabsio/healthcheck"
 	"github.com/golang/glog"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"gorm.io/driver/sqlite"
 	"gorm.io/driver/sqlserver"
@@ -20,20 +32,79 @@ import (
 )
 
 var (
-	target          = flag.String("target", "", "target to send post requests to")
+	configFile      = flag.String("config", "", "YAML or JSON file of settings, overridden by the STATE_<FLAG> environment variables and by flags")
+	target          = flag.String("target", "", "target to send post requests to, optionally a template of the item's request, e.g. https://{{.Labels.region}}.svc/process")
+	gateTargets     = flag.String("gate_targets", "", "targets of the items of particular gates in place of target, as gate=url,..., e.g. 0=https://svc/validate,1=https://svc/transform")
 	sqlConnStr      = flag.String("sql_connection", "", "sql connection string")
 	local           = flag.Bool("local", false, "whether to use a local sqlite3 server")
 	pollInterval    = flag.Duration("poll_interval", 10*time.Second, "how long to wait to poll sql")
 	batchSize       = flag.Int("batch_size", 50, "number of states to process simultaneously")
+	idleMaxInterval = flag.Duration("idle_max_interval", time.Minute, "how far to stretch the poll interval while there is no work, 0 to always poll at poll_interval")
+	rateLimit       = flag.Float64("rate_limit", 0, "maximum number of items to process per second, 0 for unlimited")
+	rateBurst       = flag.Int("rate_burst", 1, "number of items that may be processed in a burst above the rate limit")
 	tablePrefix     = flag.String("table_prefix", "", "the table prefix to use, useful for namespacing or running tests. Not compatible when setting the err_table_schema flag")
 	healthcheckAddr = flag.String("healthcheck_address", ":8080", "healthcheck address and port")
+	criticalChecks  = flag.String("critical_health_checks", "", "health checks whose failure fails readiness, rather than degrading it, as repo,processor. Defaults to repo")
+	shutdownTimeout = flag.Duration("shutdown_timeout", 30*time.Second, "how long to wait for in-flight items to finish on SIGTERM before exiting")
+	tenant          = flag.String("tenant", "", "only lease the partitions of this tenant")
+	blobDir         = flag.String("blob_dir", "", "directory to offload large item payloads to, instead of the database")
+	targetTimeout   = flag.Duration("target_timeout", 10*time.Second, "how long each request to the target may take")
+	tlsCert         = flag.String("tls_cert", "", "PEM file of the client certificate to present to the target, reloaded when it changes")
+	tlsKey          = flag.String("tls_key", "", "PEM file of the key of tls_cert")
+	tlsRootCA       = flag.String("tls_root_ca", "", "PEM file of the CAs to verify the target's certificate against, in place of the system's")
+	signingKeys     = flag.String("signing_keys", "", "keys to sign the requests to the target with, as id=secret,...")
+	gzipThreshold   = flag.Int("gzip_threshold", 0, "gzip the request bodies to the target of at least this many bytes, or none if 0")
+	maxResponse     = flag.Int64("max_response_bytes", httprocessor.DefaultMaxResponseBytes, "most bytes of each response of the target, past which its item fails")
+	httpMethod      = flag.String("http_method", http.MethodPost, "HTTP method of the requests to the target")
+	formEncode      = flag.Bool("form_encode", false, "send each item's data to the target as a form, flattening its JSON object into fields, in place of the codec")
+	codec           = flag.String("codec", "json", "codec for requests to the target: json, json-envelope to wrap the data with the item's identity and metadata, or protobuf to exchange protobuf messages")
+	stealDead       = flag.Bool("steal_from_dead_owners", false, "take over the partitions of watchers that stopped sending heartbeats, without waiting for their leases to expire")
+	leaseFailed     = flag.Bool("lease_failed_partitions", false, "keep leasing failed partitions whose failed items haven't been retried or cancelled")
+	leaderElection  = flag.String("leader_election", "", "only lease partitions while leading this election among the replicas sharing it")
+	deadlineSweep   = flag.Duration("deadline_sweep_interval", 0, "how often to fail the items past their deadline in every partition, including those nobody leases, 0 to disable")
+	keepRetries     = flag.Bool("keep_retries_across_gates", false, "keep counting an item's retries when it moves to a later gate, rather than starting afresh")
+	dedupeByHash    = flag.Bool("dedupe_by_hash", false, "complete items whose payload matches an item of their partition already completed at their gate with its result, without posting them to the target")
+	maxGateSkip     = flag.Int("max_gate_skip", 1, "number of gates the target may move an item ahead by at once")
+	breakerLimit    = flag.Int("breaker_threshold", 0, "number of consecutive target errors in a partition after which to pause it for breaker_cooldown, 0 to disable")
+	breakerCooldown = flag.Duration("breaker_cooldown", time.Minute, "how long to pause a partition once its circuit breaker opens, before probing the target again")
+	globalBreaker   = flag.Bool("global_breaker", false, "also pause every partition after breaker_threshold consecutive target errors across them")
+	procTimeout     = flag.Duration("processing_timeout", 0, "how long the target may take over an item before the attempt fails, 0 for no limit")
+	fetchTimeout    = flag.Duration("fetch_timeout", 0, "how long each lease scan and poll of a partition may take to read from the database, 0 for the statement timeout only")
+	saveTimeout     = flag.Duration("save_timeout", 0, "how long each save of a partition or item may take, 0 for the statement timeout only")
+	stuckSweep      = flag.Duration("stuck_sweep_interval", 0, "how often to reclaim the items stuck in processing for twice processing_timeout in every partition, 0 to disable")
+	dbMaxOpenConns  = flag.Int("db_max_open_conns", 0, "most connections to open to the database, 0 for unlimited")
+	dbMaxIdleConns  = flag.Int("db_max_idle_conns", 2, "most idle connections to keep open to the database")
+	dbConnLifetime  = flag.Duration("db_conn_max_lifetime", 0, "how long to keep a database connection open, 0 for indefinitely")
+	dbStmtTimeout   = flag.Duration("db_statement_timeout", state.DefaultTimeout, "how long a database statement may take before it is cancelled")
+	migrateOnly     = flag.Bool("migrate_only", false, "apply the pending schema migrations and exit, e.g. from a job ahead of a rollout")
+	logEvents       = flag.Bool("log_events", false, "log each item and partition state transition")
+	webhookURL      = flag.String("webhook_url", "", "URL to notify when partitions complete or fail, delivered at least once through the outbox")
+	webhookKeys     = flag.String("webhook_signing_keys", "", "keys to sign the webhook notifications with, as id=secret,...")
+	enableDebug     = flag.Bool("enable_debug_endpoints", false, "publish the watcher's stats through expvar, and serve them along with pprof on debug_address")
+	debugAddr       = flag.String("debug_address", "localhost:6060", "address and port of the debug endpoints, local only by default")
+	enableAdminAPI  = flag.Bool("admin_api", false, "serve the admin API for inspecting and remediating partitions and items on the healthcheck address")
 
+	cfg        *config.Config
 	dbLogLevel gormLogFlag
+	fetchOrder state.ItemOrder
+	selector   state.PartitionLabels
 )
 
 func init() {
 	flag.Var(&dbLogLevel, "db_log_level", "database log level")
+	flag.Var(&selector, "selector", "only lease partitions with all of these labels, as key=value,...")
+	flag.Var(&fetchOrder, "fetch_order", "order in which to process each partition's items: updated_at, sequence, created_at or priority")
 	flag.Parse()
+
+	var err error
+	cfg, err = config.Load(flag.CommandLine, *configFile, os.LookupEnv)
+	if err == nil {
+		err = cfg.Apply(flag.CommandLine)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%s\n", err)
+		os.Exit(2)
+	}
 }
 
 // helpers for gorm flags
@@ -83,30 +154,286 @@ func main() {
 		panic("failed to connect database")
 	}
 
-	var netClient = &http.Client{
-		Timeout: time.Second * 10,
+	repo, err := state.NewGormRepo(db,
+		state.WithMaxOpenConns(*dbMaxOpenConns),
+		state.WithMaxIdleConns(*dbMaxIdleConns),
+		state.WithConnMaxLifetime(*dbConnLifetime),
+		state.WithStatementTimeout(*dbStmtTimeout),
+	)
+	if err != nil {
+		glog.Fatal(err)
 	}
-	w := state.Watcher{
-		Repo: &state.GormRepo{DB: db},
-		Processor: &httprocessor.Processor{
-			Client: netClient,
-			Target: *target,
-		},
-		PollInterval: *pollInterval,
-		BatchSize:    *batchSize,
+	if *migrateOnly {
+		if err := repo.AutoMigrate(); err != nil {
+			glog.Fatalf("failed to migrate DB: %s ", err)
+		}
+		glog.Infof("migrated DB to schema version %d", migrations.Latest())
+		return
+	}
+	repo.Notifications = &state.Notifications{}
+	repo.OutboxEnabled = *webhookURL != ""
+	// Pipelines only set tenants of their own without -tenant, each watcher then scoping a copy
+	// of the repo.
+	repo.Tenant = *tenant
+	repo.StealFromDeadOwners = *stealDead
+	repo.LeaseFailedPartitions = *leaseFailed
+	if *blobDir != "" {
+		repo.Blobs = &state.FileBlobStore{Dir: *blobDir}
+	}
+	pipelines := cfg.Pipelines
+	if len(pipelines) == 0 {
+		pipelines = []config.Pipeline{{}}
+	}
+	// The watchers of the pipelines are told apart by the suffixes of their owner IDs.
+	ownerID := uuid.New().String()
+	group := &state.WatcherGroup{}
+	var watchers []adminapi.StatsProvider
+	for _, p := range pipelines {
+		w, err := newWatcher(repo, p)
+		if err != nil {
+			glog.Fatalf("pipeline %q: %s", p.Name, err)
+		}
+		w.OwnerID = ownerID
+		if p.Name != "" {
+			w.OwnerID += "-" + p.Name
+		}
+		group.Watchers = append(group.Watchers, w)
+		watchers = append(watchers, w)
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	// Fail readiness as soon as shutdown begins, so that the load balancer drains traffic.
+	var shuttingDown int32
+	health := adminapi.HealthHandler(group, adminapi.DefaultHealthTimeout)
+	readiness := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&shuttingDown) == 1 {
+			http.Error(rw, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		health.ServeHTTP(rw, req)
+	})
 	r := mux.NewRouter()
 
-	r.Handle("/healthcheck", healthcheck.Handler(healthcheck.WithTimeout(5*time.Second),
+	r.Handle("/healthcheck", readiness)
+	r.Handle("/readiness", readiness)
+	r.Handle("/liveness", healthcheck.Handler(healthcheck.WithTimeout(5*time.Second),
 		healthcheck.WithChecker(
-			"state_processor", healthcheck.CheckerFunc(w.Healthcheck),
+			"state_processor", healthcheck.CheckerFunc(group.Liveness),
 		)))
+	if *enableAdminAPI {
+		(&adminapi.Server{Repo: repo, Watchers: watchers}).Register(r)
+	}
 
-	if err := w.AutoMigrate(); err != nil {
+	if err := repo.AutoMigrate(); err != nil {
 		glog.Fatalf("failed to migrate DB: %s ", err)
 	}
 
-	go w.Start(context.Background())
-	glog.Info(http.ListenAndServe(*healthcheckAddr, r))
+	if *logEvents {
+		for _, w := range group.Watchers {
+			go func(owner string, events <-chan state.Event) {
+				for e := range events {
+					glog.Infof("event %s: owner=%s partition=%s item=%s gate=%s->%s err=%v", e.Type, owner, e.PartitionID, e.ItemID, e.FromGateName, e.ToGateName, e.Err)
+				}
+			}(w.OwnerID, w.Events())
+		}
+	}
+
+	watcherDone := make(chan struct{})
+	go func() {
+		group.Start(ctx)
+		close(watcherDone)
+	}()
+	if *webhookURL != "" {
+		sink := &webhook.Sink{URL: *webhookURL}
+		if sink.SigningKeys, err = parseSigningKeys(*webhookKeys); err != nil {
+			glog.Fatalf("invalid webhook signing keys: %s", err)
+		}
+		go (&state.OutboxPublisher{Repo: repo, Sink: sink}).Start(ctx)
+	}
+
+	for _, sched := range cfg.Schedules {
+		s, err := newScheduler(repo, sched)
+		if err != nil {
+			glog.Fatalf("schedule %q: %s", sched.IDPrefix, err)
+		}
+		go func() {
+			if err := s.Start(ctx); err != nil {
+				glog.Errorf("scheduler %q stopped: %s", s.IDPrefix, err)
+			}
+		}()
+	}
+
+	srv := &http.Server{Addr: *healthcheckAddr, Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			glog.Fatalf("healthcheck server failed: %s", err)
+		}
+	}()
+
+	var debugSrv *http.Server
+	if *enableDebug {
+		adminapi.PublishStats(watchers...)
+		dr := mux.NewRouter()
+		adminapi.RegisterDebug(dr)
+		debugSrv = &http.Server{Addr: *debugAddr, Handler: dr}
+		go func() {
+			if err := debugSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				glog.Errorf("debug server failed: %s", err)
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	stop()
+	atomic.StoreInt32(&shuttingDown, 1)
+	glog.Info("shutting down, waiting for in-flight items to finish")
+
+	// The watchers release their leases as they stop.
+	select {
+	case <-watcherDone:
+	case <-time.After(*shutdownTimeout):
+		glog.Warningf("watchers did not stop within %s, exiting anyway", *shutdownTimeout)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		glog.Warningf("error shutting down healthcheck server: %s", err)
+	}
+	if debugSrv != nil {
+		debugSrv.Close()
+	}
+	glog.Flush()
+}
+
+// newScheduler returns the scheduler of the configured schedule.
+func newScheduler(repo *state.GormRepo, sched config.Schedule) (*state.Scheduler, error) {
+	loc, err := time.LoadLocation(sched.Location)
+	if err != nil {
+		return nil, err
+	}
+	s := &state.Scheduler{
+		Repo:     repo,
+		Schedule: sched.Cron,
+		Location: loc,
+		Template: state.Partition{Labels: sched.Labels},
+		IDPrefix: sched.IDPrefix,
+		IDFormat: sched.IDFormat,
+		Lead:     sched.Lead,
+	}
+	for _, i := range sched.Items {
+		data := i.Data
+		if data == "" {
+			data = "{}"
+		}
+		s.Items = append(s.Items, &state.Item{BaseModel: state.BaseModel{ID: i.ID}, Gate: i.Gate, Data: []byte(data)})
+	}
+	return s, nil
+}
+
+// newWatcher returns the watcher of pipeline p, whose unset settings default to the flags.
+func newWatcher(repo *state.GormRepo, p config.Pipeline) (*state.Watcher, error) {
+	procCodec, err := httprocessor.ParseCodec(*codec)
+	if err != nil {
+		return nil, err
+	}
+	procOpts := []httprocessor.Option{
+		httprocessor.WithTimeout(*targetTimeout),
+		httprocessor.WithGzipThreshold(*gzipThreshold),
+		httprocessor.WithMaxResponseBytes(*maxResponse),
+	}
+	if *tlsCert != "" {
+		procOpts = append(procOpts, httprocessor.WithClientCert(*tlsCert, *tlsKey))
+	}
+	if *tlsRootCA != "" {
+		procOpts = append(procOpts, httprocessor.WithRootCAFile(*tlsRootCA))
+	}
+	gates := p.GateTargets
+	if len(gates) == 0 {
+		if gates, err = state.ParseLabels(*gateTargets); err != nil {
+			return nil, fmt.Errorf("invalid gate targets: %w", err)
+		}
+	}
+	if len(gates) > 0 {
+		byGate := map[int]string{}
+		for gate, url := range gates {
+			n, err := strconv.Atoi(gate)
+			if err != nil {
+				return nil, fmt.Errorf("invalid gate %q of the gate targets", gate)
+			}
+			byGate[n] = url
+		}
+		procOpts = append(procOpts, httprocessor.WithGateTargets(byGate))
+	}
+	if *signingKeys != "" {
+		signing, err := parseSigningKeys(*signingKeys)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signing keys: %w", err)
+		}
+		procOpts = append(procOpts, httprocessor.WithSigningKeys(signing...))
+	}
+	procTarget := p.Target
+	if procTarget == "" {
+		procTarget = *target
+	}
+	proc, err := httprocessor.NewProcessor(procTarget, procOpts...)
+	if err != nil {
+		return nil, err
+	}
+	proc.Codec = procCodec
+	proc.Method = *httpMethod
+	if *formEncode {
+		proc.RequestEncoder = httprocessor.FormEncoder
+	}
+
+	w := &state.Watcher{
+		Repo:            repo,
+		Processor:       proc,
+		PollInterval:    *pollInterval,
+		BatchSize:       *batchSize,
+		RateLimit:       *rateLimit,
+		RateBurst:       *rateBurst,
+		IdleMaxInterval: *idleMaxInterval,
+		FetchOrder:      fetchOrder,
+		Selector:        selector,
+		Tenant:          p.Tenant,
+		LeaderElection:  *leaderElection,
+		MaxGateSkip:     *maxGateSkip,
+		GlobalBreaker:   *globalBreaker,
+
+		KeepRetriesAcrossGates: *keepRetries,
+		DedupeByHash:           *dedupeByHash,
+		DeadlineSweepInterval:  *deadlineSweep,
+		ProcessingTimeout:      *procTimeout,
+		FetchTimeout:           *fetchTimeout,
+		SaveTimeout:            *saveTimeout,
+		StuckSweepInterval:     *stuckSweep,
+		BreakerThreshold:       *breakerLimit,
+		BreakerCooldown:        *breakerCooldown,
+	}
+	if p.BatchSize != 0 {
+		w.BatchSize = p.BatchSize
+	}
+	if len(p.Selector) > 0 {
+		w.Selector = p.Selector
+	}
+	if *criticalChecks != "" {
+		w.CriticalHealthChecks = strings.Split(*criticalChecks, ",")
+	}
+	return w, nil
+}
+
+// parseSigningKeys parses keys given as id=secret,...
+func parseSigningKeys(s string) ([]httprocessor.SigningKey, error) {
+	keys, err := state.ParseLabels(s)
+	if err != nil {
+		return nil, err
+	}
+	var signing []httprocessor.SigningKey
+	for id, secret := range keys {
+		signing = append(signing, httprocessor.SigningKey{ID: id, Secret: []byte(secret)})
+	}
+	return signing, nil
 }
@@ -0,0 +1,765 @@
+// Package adminapi exposes an HTTP API for inspecting and remediating partitions and items,
+// so that operators don't need to connect to the database by hand.
+package adminapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+// StatsProvider is implemented by state.Watcher.
+type StatsProvider interface {
+	Stats() state.Stats
+}
+
+// Server serves the admin API.
+type Server struct {
+	Repo state.Repo
+	// Watchers running in this process, whose stats are served at /watchers/{owner}/stats,
+	// and health report at /watchers/{owner}/health if they are also HealthReporters.
+	Watchers []StatsProvider
+}
+
+// NewRouter returns a router serving the admin API.
+func NewRouter(s *Server) *mux.Router {
+	r := mux.NewRouter()
+	s.Register(r)
+	return r
+}
+
+// Register adds the admin API routes to r.
+func (s *Server) Register(r *mux.Router) {
+	r.HandleFunc("/partitions", s.listPartitions).Methods(http.MethodGet)
+	r.HandleFunc("/partitions/{id}", s.getPartition).Methods(http.MethodGet)
+	r.HandleFunc("/partitions/{id}/items", s.listItems).Methods(http.MethodGet)
+	r.HandleFunc("/partitions/{id}/progress", s.partitionProgress).Methods(http.MethodGet)
+	r.HandleFunc("/partitions/{id}/lease-history", s.leaseHistory).Methods(http.MethodGet)
+	r.HandleFunc("/partitions/{id}/retry-failed", s.retryFailed).Methods(http.MethodPost)
+	r.HandleFunc("/partitions/{id}/reopen", s.reopen).Methods(http.MethodPost)
+	r.HandleFunc("/partitions/{id}/max-retries", s.setPartitionMaxRetries).Methods(http.MethodPost)
+	r.HandleFunc("/partitions/{id}/quota", s.partitionQuota).Methods(http.MethodGet)
+	r.HandleFunc("/partitions/{id}/quota", s.setPartitionQuota).Methods(http.MethodPost)
+	r.HandleFunc("/items", s.listAllItems).Methods(http.MethodGet)
+	r.HandleFunc("/items/{id}/cancel", s.cancelItem).Methods(http.MethodPost)
+	r.HandleFunc("/items/{id}/max-retries", s.setItemMaxRetries).Methods(http.MethodPost)
+	r.HandleFunc("/watchers", s.listWatchers).Methods(http.MethodGet)
+	r.HandleFunc("/watchers/{owner}/stats", s.watcherStats).Methods(http.MethodGet)
+	r.HandleFunc("/watchers/{owner}/health", s.watcherHealth).Methods(http.MethodGet)
+	r.HandleFunc("/owners", s.listOwners).Methods(http.MethodGet)
+	r.HandleFunc("/tenants/{tenant}/quota", s.tenantQuota).Methods(http.MethodGet)
+	r.HandleFunc("/tenants/{tenant}/quota", s.setTenantQuota).Methods(http.MethodPost)
+}
+
+// Partition is the JSON representation of a state.Partition.
+type Partition struct {
+	ID        string            `json:"id"`
+	Tenant    string            `json:"tenant,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	DependsOn string            `json:"depends_on,omitempty"`
+	Version   int               `json:"version"`
+	Gate      int               `json:"gate"`
+	GateName  string            `json:"gate_name"`
+	GatePlan  []string          `json:"gate_plan,omitempty"`
+	MaxGate   int               `json:"max_gate,omitempty"`
+	Status    state.Status      `json:"status"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+	Lease     Lease             `json:"lease"`
+	// StatusReason is why the partition last failed or completed, if it still is.
+	StatusReason string `json:"status_reason,omitempty"`
+	// MaxRetries overrides the watchers' MaxRetries for the partition's items, -1 retries
+	// indefinitely.
+	MaxRetries *int `json:"max_retries,omitempty"`
+	// FailureTolerance overrides the watchers' FailureTolerance for the partition: the
+	// fraction of its items which may fail without failing it.
+	FailureTolerance *float64 `json:"failure_tolerance,omitempty"`
+	// ActivateAt is when the partition may first be leased, if it was scheduled ahead of time.
+	ActivateAt *time.Time `json:"activate_at,omitempty"`
+	// MaxPendingItems caps the partition's Available items, see the quota endpoints.
+	MaxPendingItems *int `json:"max_pending_items,omitempty"`
+	// LeaseableAfter is when the partition may be leased again, after a watcher found nothing
+	// to do in it.
+	LeaseableAfter *time.Time `json:"leaseable_after,omitempty"`
+	// MaxPartitionRetries is how many times the partition is retried once failed, after its
+	// cooldown, PartitionRetryCount the retries so far, and RetryAt when the next one is due.
+	MaxPartitionRetries           int        `json:"max_partition_retries,omitempty"`
+	PartitionRetryCooldownSeconds float64    `json:"partition_retry_cooldown_seconds,omitempty"`
+	PartitionRetryCount           int        `json:"partition_retry_count,omitempty"`
+	RetryAt                       *time.Time `json:"retry_at,omitempty"`
+	// MaxConcurrency is the most items of the partition processed at once, and ClaimedCount
+	// the number of its items claimed in item lease mode, as of the last claim of its items.
+	MaxConcurrency int `json:"max_concurrency,omitempty"`
+	ClaimedCount   int `json:"claimed_count,omitempty"`
+}
+
+// Lease describes the current owner of a partition. State is Unleased, Active or Expired,
+// and LeasedAt is when the partition was last leased, if ever.
+type Lease struct {
+	State    state.LeaseStatus `json:"state"`
+	Owner    string            `json:"owner"`
+	LeasedAt *time.Time        `json:"leased_at,omitempty"`
+	Until    time.Time         `json:"until"`
+	Expired  bool              `json:"expired"`
+	Fence    int64             `json:"fence"`
+}
+
+// LeaseEvent is the JSON representation of a state.LeaseEvent.
+type LeaseEvent struct {
+	OldOwner   string                 `json:"old_owner"`
+	NewOwner   string                 `json:"new_owner"`
+	Reason     state.LeaseEventReason `json:"reason"`
+	AcquiredAt time.Time              `json:"acquired_at"`
+	Until      time.Time              `json:"until"`
+	Fence      int64                  `json:"fence"`
+}
+
+// LeaseHistory is the latest lease events of a partition, latest first.
+type LeaseHistory struct {
+	Events []LeaseEvent `json:"events"`
+}
+
+// PartitionDetail is a partition along with the count of its items by status, of its items
+// that failed past their deadline, and the dependency blocking it from being leased, if any.
+type PartitionDetail struct {
+	Partition
+	Counts         map[state.Status]int `json:"counts"`
+	DeadlineMisses int                  `json:"deadline_misses"`
+	BlockedBy      string               `json:"blocked_by,omitempty"`
+}
+
+// Item is the JSON representation of a state.Item. Data is inlined when it is valid JSON,
+// otherwise it is base64 encoded in DataBase64.
+type Item struct {
+	ID            string            `json:"id"`
+	Tenant        string            `json:"tenant,omitempty"`
+	Version       int               `json:"version"`
+	PartitionID   string            `json:"partition_id"`
+	Gate          int               `json:"gate"`
+	Status        state.Status      `json:"status"`
+	RetryCount    int               `json:"retry_count"`
+	ErrorMessages string            `json:"error_messages,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	Deadline      *time.Time        `json:"deadline,omitempty"`
+	// IdempotencyKey is the key the producer enqueued the item with, if any.
+	IdempotencyKey *string `json:"idempotency_key,omitempty"`
+	// MaxRetries overrides the MaxRetries of the item's partition and the watchers.
+	MaxRetries *int `json:"max_retries,omitempty"`
+	// RetryAt is when the item may be retried, if its processor asked to retry it later.
+	RetryAt *time.Time `json:"retry_at,omitempty"`
+	// ProcessingStartedAt is when the attempt in progress started, if the watcher records it.
+	ProcessingStartedAt *time.Time `json:"processing_started_at,omitempty"`
+	// SchemaVersion is the version of the format of Data.
+	SchemaVersion int `json:"schema_version,omitempty"`
+	// DataHash is the hash of Data, see state.HashData.
+	DataHash string `json:"data_hash,omitempty"`
+	// LastOwner is the watcher that last attempted the item, at LastProcessedAt.
+	LastOwner       string     `json:"last_owner,omitempty"`
+	LastProcessedAt *time.Time `json:"last_processed_at,omitempty"`
+	// TraceContext is the W3C trace context the item was enqueued with.
+	TraceContext string `json:"trace_context,omitempty"`
+	// Data and Result are inlined when they are valid JSON, and base64 encoded otherwise.
+	Data         json.RawMessage `json:"data,omitempty"`
+	DataBase64   []byte          `json:"data_base64,omitempty"`
+	Result       json.RawMessage `json:"result,omitempty"`
+	ResultBase64 []byte          `json:"result_base64,omitempty"`
+}
+
+// PartitionList is a page of partitions.
+type PartitionList struct {
+	Partitions    []Partition     `json:"partitions"`
+	NextPageToken state.PageToken `json:"next_page_token,omitempty"`
+}
+
+// ItemList is a page of items.
+type ItemList struct {
+	Items         []Item          `json:"items"`
+	NextPageToken state.PageToken `json:"next_page_token,omitempty"`
+}
+
+// Owner is the JSON representation of a state.Owner.
+type Owner struct {
+	ID               string    `json:"id"`
+	Hostname         string    `json:"hostname"`
+	Version          string    `json:"version,omitempty"`
+	StartedAt        time.Time `json:"started_at"`
+	LastHeartbeat    time.Time `json:"last_heartbeat"`
+	LeasedPartitions int       `json:"leased_partitions"`
+	Dead             bool      `json:"dead"`
+}
+
+// OwnerList is every registered watcher instance.
+type OwnerList struct {
+	Owners []Owner `json:"owners"`
+}
+
+// WatcherList is the stats of every watcher running in the process.
+type WatcherList struct {
+	Watchers []state.Stats `json:"watchers"`
+}
+
+// RetryResult is returned by the retry-failed endpoint.
+type RetryResult struct {
+	Retried int `json:"retried"`
+}
+
+// ReopenRequest is the optional body of the reopen endpoint.
+type ReopenRequest struct {
+	Gate *int `json:"gate"`
+}
+
+// MaxRetriesRequest is the body of the max-retries endpoints. A null MaxRetries clears the
+// override.
+type MaxRetriesRequest struct {
+	MaxRetries *int `json:"max_retries"`
+}
+
+// Quota is the number of Available items of a partition or tenant, and its limit, if any.
+type Quota struct {
+	Pending         int  `json:"pending"`
+	MaxPendingItems *int `json:"max_pending_items"`
+}
+
+// QuotaRequest is the body of the quota endpoints. A null MaxPendingItems clears the limit.
+type QuotaRequest struct {
+	MaxPendingItems *int `json:"max_pending_items"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// NewPartition converts a state.Partition to its JSON representation.
+func NewPartition(p *state.Partition) Partition {
+	lease := p.LeaseState()
+	return Partition{
+		ID:        p.ID,
+		Tenant:    p.Tenant,
+		Labels:    p.Labels,
+		DependsOn: p.DependsOn,
+		Version:   p.Version,
+		Gate:      p.Gate,
+		GateName:  p.GateName(),
+		GatePlan:  p.GatePlan,
+		MaxGate:   p.MaxGate,
+		Status:    p.Status,
+		CreatedAt: p.CreatedAt,
+		UpdatedAt: p.UpdatedAt,
+		Lease: Lease{
+			State:    lease.Status,
+			Owner:    lease.Owner,
+			LeasedAt: lease.LeasedAt,
+			Until:    lease.Until,
+			Expired:  lease.Status == state.LeaseExpired,
+			Fence:    p.Fence,
+		},
+		StatusReason:     p.StatusReason,
+		MaxRetries:       p.MaxRetries,
+		FailureTolerance: p.FailureTolerance,
+		ActivateAt:       p.ActivateAt,
+		MaxPendingItems:  p.MaxPendingItems,
+		LeaseableAfter:   p.LeaseableAfter,
+
+		MaxPartitionRetries:           p.MaxPartitionRetries,
+		PartitionRetryCooldownSeconds: p.PartitionRetryCooldown.Seconds(),
+		PartitionRetryCount:           p.PartitionRetryCount,
+		RetryAt:                       p.RetryAt,
+
+		MaxConcurrency: p.MaxConcurrency,
+		ClaimedCount:   p.ClaimedCount,
+	}
+}
+
+// NewItem converts a state.Item to its JSON representation.
+func NewItem(i *state.Item) Item {
+	item := Item{
+		ID:            i.ID,
+		Tenant:        i.Tenant,
+		Version:       i.Version,
+		PartitionID:   i.PartitionID,
+		Gate:          i.Gate,
+		Status:        i.Status,
+		RetryCount:    i.RetryCount,
+		ErrorMessages: i.ErrorMessages,
+		CreatedAt:     i.CreatedAt,
+		UpdatedAt:     i.UpdatedAt,
+		Metadata:      i.Metadata,
+		Deadline:      i.Deadline,
+
+		IdempotencyKey:      i.IdempotencyKey,
+		MaxRetries:          i.MaxRetries,
+		RetryAt:             i.RetryAt,
+		ProcessingStartedAt: i.ProcessingStartedAt,
+		SchemaVersion:       i.SchemaVersion,
+		DataHash:            i.DataHash,
+		LastOwner:           i.LastOwner,
+		LastProcessedAt:     i.LastProcessedAt,
+		TraceContext:        i.TraceContext,
+	}
+	item.Data, item.DataBase64 = payload(i.Data)
+	item.Result, item.ResultBase64 = payload(i.Result)
+	return item
+}
+
+// NewOwner converts a state.Owner to its JSON representation.
+func NewOwner(o *state.Owner) Owner {
+	return Owner{
+		ID:               o.OwnerID,
+		Hostname:         o.Hostname,
+		Version:          o.Version,
+		StartedAt:        o.StartedAt,
+		LastHeartbeat:    o.LastHeartbeat,
+		LeasedPartitions: o.LeasedPartitions,
+		Dead:             o.Dead,
+	}
+}
+
+func payload(b []byte) (json.RawMessage, []byte) {
+	if b == nil {
+		return nil, nil
+	}
+	if json.Valid(b) {
+		return b, nil
+	}
+	return nil, b
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.Warningf("error writing admin api response: %s", err)
+	}
+}
+
+type badRequest struct{ error }
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	var br badRequest
+	switch {
+	case state.IsNotFound(err):
+		code = http.StatusNotFound
+	case errors.As(err, &br), state.IsValidation(err):
+		code = http.StatusBadRequest
+	case state.IsVersionConflict(err), state.IsQuotaExceeded(err):
+		code = http.StatusConflict
+	default:
+		glog.Errorf("admin api error: %s", err)
+	}
+	writeJSON(w, code, errorResponse{Error: err.Error()})
+}
+
+func pageRequest(r *http.Request) (state.PageRequest, error) {
+	page := state.PageRequest{Token: state.PageToken(r.URL.Query().Get("page_token"))}
+	if s := r.URL.Query().Get("page_size"); s != "" {
+		size, err := strconv.Atoi(s)
+		if err != nil {
+			return page, badRequest{err}
+		}
+		page.Size = size
+	}
+	return page, nil
+}
+
+func statusParam(r *http.Request) (state.Status, error) {
+	s := r.URL.Query().Get("status")
+	if s == "" {
+		return state.Unknown, nil
+	}
+	st, err := state.ParseStatus(s)
+	if err != nil {
+		return st, badRequest{err}
+	}
+	return st, nil
+}
+
+func (s *Server) listPartitions(w http.ResponseWriter, r *http.Request) {
+	status, err := statusParam(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	page, err := pageRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	labels, err := state.ParseLabels(r.URL.Query().Get("labels"))
+	if err != nil {
+		writeError(w, badRequest{err})
+		return
+	}
+	filter := state.PartitionFilter{
+		Status:   status,
+		Owner:    r.URL.Query().Get("owner"),
+		IDPrefix: r.URL.Query().Get("prefix"),
+		Labels:   labels,
+	}
+	partitions, token, err := s.Repo.ListPartitions(r.Context(), filter, page)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp := PartitionList{Partitions: []Partition{}, NextPageToken: token}
+	for _, p := range partitions {
+		resp.Partitions = append(resp.Partitions, NewPartition(p))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) getPartition(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	p, err := s.Repo.GetPartition(r.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	counts, err := s.Repo.GetCountByStatus(r.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	misses, err := s.Repo.CountDeadlineMisses(r.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	blockedBy, err := s.blockedBy(r.Context(), p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, PartitionDetail{Partition: NewPartition(p), Counts: counts, DeadlineMisses: misses, BlockedBy: blockedBy})
+}
+
+// blockedBy returns the partition's dependency if it isn't complete, including when it
+// doesn't exist yet.
+func (s *Server) blockedBy(ctx context.Context, p *state.Partition) (string, error) {
+	if p.DependsOn == "" {
+		return "", nil
+	}
+	dep, err := s.Repo.GetPartition(ctx, p.DependsOn)
+	if state.IsNotFound(err) {
+		return p.DependsOn, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if dep.Status != state.Complete {
+		return dep.ID, nil
+	}
+	return "", nil
+}
+
+func (s *Server) partitionProgress(w http.ResponseWriter, r *http.Request) {
+	progress, err := s.Repo.GetPartitionProgress(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, progress)
+}
+
+// DefaultLeaseHistoryLimit is the number of lease events returned by the lease-history
+// endpoint, unless its limit parameter is set.
+const DefaultLeaseHistoryLimit = 100
+
+func (s *Server) leaseHistory(w http.ResponseWriter, r *http.Request) {
+	limit := DefaultLeaseHistoryLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			writeError(w, badRequest{err})
+			return
+		}
+		limit = n
+	}
+	events, err := s.Repo.GetLeaseHistory(r.Context(), mux.Vars(r)["id"], limit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp := LeaseHistory{Events: []LeaseEvent{}}
+	for _, e := range events {
+		resp.Events = append(resp.Events, LeaseEvent{
+			OldOwner:   e.OldOwner,
+			NewOwner:   e.NewOwner,
+			Reason:     e.Reason,
+			AcquiredAt: e.AcquiredAt,
+			Until:      e.Until,
+			Fence:      e.Fence,
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) listItems(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, err := s.Repo.GetPartition(r.Context(), id); err != nil {
+		writeError(w, err)
+		return
+	}
+	page, err := pageRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	filter, err := itemFilter(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	filter.PartitionID = id
+	s.writeItems(w, r, filter, page)
+}
+
+// listAllItems lists the items of every partition, e.g. those an owner processed recently.
+func (s *Server) listAllItems(w http.ResponseWriter, r *http.Request) {
+	page, err := pageRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	filter, err := itemFilter(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s.writeItems(w, r, filter, page)
+}
+
+// itemFilter parses the status, metadata, last_owner and processed_since parameters of the
+// item listings. processed_since is either an RFC 3339 time or a duration before now.
+func itemFilter(r *http.Request) (state.ItemFilter, error) {
+	status, err := statusParam(r)
+	if err != nil {
+		return state.ItemFilter{}, err
+	}
+	metadata, err := state.ParseLabels(r.URL.Query().Get("metadata"))
+	if err != nil {
+		return state.ItemFilter{}, badRequest{err}
+	}
+	filter := state.ItemFilter{Status: status, Metadata: metadata, LastOwner: r.URL.Query().Get("last_owner")}
+	if s := r.URL.Query().Get("processed_since"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil {
+			filter.ProcessedSince = time.Now().Add(-d)
+		} else if filter.ProcessedSince, err = time.Parse(time.RFC3339, s); err != nil {
+			return filter, badRequest{fmt.Errorf("processed_since must be an RFC 3339 time or a duration, got %q", s)}
+		}
+	}
+	return filter, nil
+}
+
+func (s *Server) writeItems(w http.ResponseWriter, r *http.Request, filter state.ItemFilter, page state.PageRequest) {
+	items, token, err := s.Repo.ListItems(r.Context(), filter, page)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp := ItemList{Items: []Item{}, NextPageToken: token}
+	for _, i := range items {
+		resp.Items = append(resp.Items, NewItem(i))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) retryFailed(w http.ResponseWriter, r *http.Request) {
+	n, err := s.Repo.RetryFailedItems(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, RetryResult{Retried: n})
+}
+
+func (s *Server) reopen(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	req := ReopenRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, badRequest{err})
+		return
+	}
+	if err := s.Repo.ReopenPartition(r.Context(), id, req.Gate); err != nil {
+		writeError(w, err)
+		return
+	}
+	p, err := s.Repo.GetPartition(r.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, NewPartition(p))
+}
+
+func (s *Server) setPartitionMaxRetries(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	req := MaxRetriesRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, badRequest{err})
+		return
+	}
+	if err := s.Repo.SetPartitionMaxRetries(r.Context(), id, req.MaxRetries); err != nil {
+		writeError(w, err)
+		return
+	}
+	p, err := s.Repo.GetPartition(r.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, NewPartition(p))
+}
+
+func (s *Server) partitionQuota(w http.ResponseWriter, r *http.Request) {
+	usage, err := s.Repo.GetPartitionQuotaUsage(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, Quota(*usage))
+}
+
+func (s *Server) setPartitionQuota(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	req, err := quotaRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.Repo.SetPartitionMaxPendingItems(r.Context(), id, req.MaxPendingItems); err != nil {
+		writeError(w, err)
+		return
+	}
+	s.partitionQuota(w, r)
+}
+
+func (s *Server) tenantQuota(w http.ResponseWriter, r *http.Request) {
+	usage, err := s.Repo.GetTenantQuotaUsage(r.Context(), mux.Vars(r)["tenant"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, Quota(*usage))
+}
+
+func (s *Server) setTenantQuota(w http.ResponseWriter, r *http.Request) {
+	tenant := mux.Vars(r)["tenant"]
+	req, err := quotaRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.Repo.SetTenantMaxPendingItems(r.Context(), tenant, req.MaxPendingItems); err != nil {
+		writeError(w, err)
+		return
+	}
+	s.tenantQuota(w, r)
+}
+
+func quotaRequest(r *http.Request) (QuotaRequest, error) {
+	req := QuotaRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, badRequest{err}
+	}
+	return req, nil
+}
+
+func (s *Server) setItemMaxRetries(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	req := MaxRetriesRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, badRequest{err})
+		return
+	}
+	if err := s.Repo.SetItemMaxRetries(r.Context(), id, req.MaxRetries); err != nil {
+		writeError(w, err)
+		return
+	}
+	i, err := s.Repo.GetItem(r.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, NewItem(i))
+}
+
+func (s *Server) cancelItem(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := s.Repo.CancelItem(r.Context(), id); err != nil {
+		writeError(w, err)
+		return
+	}
+	i, err := s.Repo.GetItem(r.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, NewItem(i))
+}
+
+func (s *Server) listWatchers(w http.ResponseWriter, r *http.Request) {
+	resp := WatcherList{Watchers: []state.Stats{}}
+	for _, watcher := range s.Watchers {
+		resp.Watchers = append(resp.Watchers, watcher.Stats())
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// watcher returns the watcher with the owner ID of the request.
+func (s *Server) watcher(r *http.Request) (StatsProvider, state.Stats, error) {
+	owner := mux.Vars(r)["owner"]
+	for _, watcher := range s.Watchers {
+		if stats := watcher.Stats(); stats.OwnerID == owner {
+			return watcher, stats, nil
+		}
+	}
+	return nil, state.Stats{}, &state.ErrNotFound{Kind: "watcher", ID: owner}
+}
+
+func (s *Server) watcherStats(w http.ResponseWriter, r *http.Request) {
+	_, stats, err := s.watcher(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (s *Server) watcherHealth(w http.ResponseWriter, r *http.Request) {
+	watcher, stats, err := s.watcher(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	reporter, ok := watcher.(HealthReporter)
+	if !ok {
+		writeError(w, &state.ErrNotFound{Kind: "health report of watcher", ID: stats.OwnerID})
+		return
+	}
+	HealthHandler(reporter, DefaultHealthTimeout).ServeHTTP(w, r)
+}
+
+func (s *Server) listOwners(w http.ResponseWriter, r *http.Request) {
+	owners, err := s.Repo.ListOwners(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp := OwnerList{Owners: []Owner{}}
+	for _, o := range owners {
+		resp.Owners = append(resp.Owners, NewOwner(o))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
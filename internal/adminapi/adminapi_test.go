@@ -0,0 +1,592 @@
+package adminapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state/statetest"
+	"github.com/gorilla/mux"
+)
+
+type fakeWatcher struct {
+	stats state.Stats
+}
+
+func (f *fakeWatcher) Stats() state.Stats {
+	return f.stats
+}
+
+func newTestServer(t *testing.T) (*httptest.Server, state.Repo) {
+	repo := statetest.NewSQLiteRepo(t)
+	ctx := context.Background()
+	repo.Save(ctx, &state.Partition{BaseModel: state.BaseModel{ID: "p1"}, Status: state.Failed, Owner: "w1"})
+	repo.Save(ctx, &state.Partition{BaseModel: state.BaseModel{ID: "p2"}, Status: state.Available, Owner: "w2", Labels: state.PartitionLabels{"gpu": "true"}})
+	repo.Save(ctx, &state.Item{BaseModel: state.BaseModel{ID: "i1"}, PartitionID: "p1", Status: state.Failed, RetryCount: 5, Data: []byte(`{"a":1}`)})
+	repo.Save(ctx, &state.Item{BaseModel: state.BaseModel{ID: "i2"}, PartitionID: "p1", Status: state.Complete, Data: []byte(`{"a":2}`), Metadata: state.ItemMetadata{"model": "v2"}})
+	repo.Save(ctx, &state.Item{BaseModel: state.BaseModel{ID: "i3"}, PartitionID: "p2", Status: state.Available, Data: []byte{0xff}})
+
+	s := &Server{
+		Repo:     repo,
+		Watchers: []StatsProvider{&fakeWatcher{stats: state.Stats{OwnerID: "w1", Leases: []string{"p1"}}}},
+	}
+	srv := httptest.NewServer(NewRouter(s))
+	t.Cleanup(srv.Close)
+	return srv, repo
+}
+
+func do(t *testing.T, method, url, body string, out interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("error decoding %s %s: %s", method, url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestListPartitions(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	var list PartitionList
+	if code := do(t, http.MethodGet, srv.URL+"/partitions", "", &list); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if len(list.Partitions) != 2 {
+		t.Errorf("expected 2 partitions, got %d", len(list.Partitions))
+	}
+
+	list = PartitionList{}
+	do(t, http.MethodGet, srv.URL+"/partitions?status=failed", "", &list)
+	if len(list.Partitions) != 1 || list.Partitions[0].ID != "p1" || list.Partitions[0].Status != state.Failed {
+		t.Errorf("unexpected failed partitions %+v", list.Partitions)
+	}
+
+	list = PartitionList{}
+	do(t, http.MethodGet, srv.URL+"/partitions?owner=w2", "", &list)
+	if len(list.Partitions) != 1 || list.Partitions[0].ID != "p2" {
+		t.Errorf("unexpected partitions for owner %+v", list.Partitions)
+	}
+
+	list = PartitionList{}
+	do(t, http.MethodGet, srv.URL+"/partitions?labels=gpu=true", "", &list)
+	if len(list.Partitions) != 1 || list.Partitions[0].ID != "p2" || list.Partitions[0].Labels["gpu"] != "true" {
+		t.Errorf("unexpected partitions for labels %+v", list.Partitions)
+	}
+
+	if code := do(t, http.MethodGet, srv.URL+"/partitions?status=bogus", "", nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for unknown status, got %d", code)
+	}
+	if code := do(t, http.MethodGet, srv.URL+"/partitions?labels=gpu", "", nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid labels, got %d", code)
+	}
+}
+
+func TestStatusSerializedAsString(t *testing.T) {
+	srv, _ := newTestServer(t)
+	var raw map[string]interface{}
+	do(t, http.MethodGet, srv.URL+"/partitions/p1", "", &raw)
+	if raw["status"] != "Failed" {
+		t.Errorf("expected status as a string, got %#v", raw["status"])
+	}
+	counts, _ := raw["counts"].(map[string]interface{})
+	if counts["Failed"] != float64(1) || counts["Complete"] != float64(1) {
+		t.Errorf("unexpected counts %#v", raw["counts"])
+	}
+}
+
+func TestPartitionDeadlineMisses(t *testing.T) {
+	srv, repo := newTestServer(t)
+	past := time.Now().Add(-time.Minute)
+	repo.Save(context.Background(), &state.Item{BaseModel: state.BaseModel{ID: "i4"}, PartitionID: "p1", Status: state.Failed, Data: []byte(`{}`), Deadline: &past})
+
+	var detail PartitionDetail
+	do(t, http.MethodGet, srv.URL+"/partitions/p1", "", &detail)
+	if detail.DeadlineMisses != 1 || detail.Counts[state.Failed] != 2 {
+		t.Errorf("expected 1 of the 2 failed items to have missed its deadline, got %+v", detail)
+	}
+	var list ItemList
+	do(t, http.MethodGet, srv.URL+"/partitions/p1/items?status=failed", "", &list)
+	for _, i := range list.Items {
+		if (i.ID == "i4") != (i.Deadline != nil) {
+			t.Errorf("unexpected deadline of item %s: %v", i.ID, i.Deadline)
+		}
+	}
+}
+
+func TestPartitionBlockedBy(t *testing.T) {
+	srv, repo := newTestServer(t)
+	ctx := context.Background()
+	if err := repo.CreatePartition(ctx, &state.Partition{BaseModel: state.BaseModel{ID: "p3"}, DependsOn: "p2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var detail PartitionDetail
+	do(t, http.MethodGet, srv.URL+"/partitions/p3", "", &detail)
+	if detail.DependsOn != "p2" || detail.BlockedBy != "p2" {
+		t.Errorf("expected p3 to be blocked by p2, got %+v", detail)
+	}
+	p, err := repo.GetPartition(ctx, "p2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Status = state.Complete
+	repo.Save(ctx, p)
+	detail = PartitionDetail{}
+	do(t, http.MethodGet, srv.URL+"/partitions/p3", "", &detail)
+	if detail.DependsOn != "p2" || detail.BlockedBy != "" {
+		t.Errorf("expected p3 to be unblocked once p2 completes, got %+v", detail)
+	}
+}
+
+func TestPartitionLeaseState(t *testing.T) {
+	srv, repo := newTestServer(t)
+	ctx := context.Background()
+	repo.Save(ctx, &state.Partition{BaseModel: state.BaseModel{ID: "p3"}})
+	p4 := &state.Partition{BaseModel: state.BaseModel{ID: "p4"}}
+	repo.Save(ctx, p4)
+	if ok, err := repo.AcquireLease(ctx, p4, "w4", time.Now().Add(time.Minute)); err != nil || !ok {
+		t.Fatalf("error leasing p4: %t, %v", ok, err)
+	}
+	for id, expected := range map[string]Lease{
+		"p1": {State: state.LeaseExpired, Owner: "w1", Expired: true},
+		"p3": {State: state.Unleased},
+		"p4": {State: state.LeaseActive, Owner: "w4", Fence: 1},
+	} {
+		var detail PartitionDetail
+		do(t, http.MethodGet, srv.URL+"/partitions/"+id, "", &detail)
+		l := detail.Lease
+		if l.State != expected.State || l.Owner != expected.Owner || l.Expired != expected.Expired || l.Fence != expected.Fence || (l.LeasedAt != nil) != (id == "p4") {
+			t.Errorf("expected the lease of %s to be %+v, got %+v", id, expected, l)
+		}
+	}
+}
+
+func TestLeaseHistory(t *testing.T) {
+	srv, repo := newTestServer(t)
+	ctx := context.Background()
+	p := &state.Partition{BaseModel: state.BaseModel{ID: "p3"}}
+	repo.Save(ctx, p)
+	if ok, err := repo.AcquireLease(ctx, p, "w1", time.Now().Add(time.Minute)); err != nil || !ok {
+		t.Fatalf("error leasing p3: %t, %v", ok, err)
+	}
+	if err := repo.ReleaseLease(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+
+	var history LeaseHistory
+	if code := do(t, http.MethodGet, srv.URL+"/partitions/p3/lease-history", "", &history); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if len(history.Events) != 2 {
+		t.Fatalf("expected 2 lease events, got %+v", history.Events)
+	}
+	if e := history.Events[0]; e.Reason != state.LeaseReleased || e.OldOwner != "w1" || e.NewOwner != "" || e.Fence != 1 {
+		t.Errorf("expected the release first, got %+v", e)
+	}
+	if e := history.Events[1]; e.Reason != state.LeaseAcquired || e.OldOwner != "" || e.NewOwner != "w1" || e.Fence != 1 {
+		t.Errorf("expected the acquisition last, got %+v", e)
+	}
+
+	history = LeaseHistory{}
+	do(t, http.MethodGet, srv.URL+"/partitions/p3/lease-history?limit=1", "", &history)
+	if len(history.Events) != 1 || history.Events[0].Reason != state.LeaseReleased {
+		t.Errorf("expected the latest event only, got %+v", history.Events)
+	}
+	if code := do(t, http.MethodGet, srv.URL+"/partitions/p3/lease-history?limit=x", "", nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid limit, got %d", code)
+	}
+	if code := do(t, http.MethodGet, srv.URL+"/partitions/missing/lease-history", "", nil); code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", code)
+	}
+}
+
+func TestPartitionGateName(t *testing.T) {
+	srv, repo := newTestServer(t)
+	repo.Save(context.Background(), &state.Partition{BaseModel: state.BaseModel{ID: "p3"}, Gate: 1, GatePlan: state.GatePlan{"validate", "upload"}})
+
+	var detail PartitionDetail
+	do(t, http.MethodGet, srv.URL+"/partitions/p3", "", &detail)
+	if detail.GateName != "upload" || len(detail.GatePlan) != 2 {
+		t.Errorf("expected p3 to be at the upload gate of its plan, got %+v", detail)
+	}
+	detail = PartitionDetail{}
+	do(t, http.MethodGet, srv.URL+"/partitions/p1", "", &detail)
+	if detail.GateName != "0" || detail.GatePlan != nil {
+		t.Errorf("expected p1 to have no plan, got %+v", detail)
+	}
+}
+
+func TestGetPartitionNotFound(t *testing.T) {
+	srv, _ := newTestServer(t)
+	if code := do(t, http.MethodGet, srv.URL+"/partitions/missing", "", nil); code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", code)
+	}
+	if code := do(t, http.MethodGet, srv.URL+"/partitions/missing/items", "", nil); code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", code)
+	}
+}
+
+func TestPartitionProgress(t *testing.T) {
+	srv, _ := newTestServer(t)
+	var progress state.PartitionProgress
+	if code := do(t, http.MethodGet, srv.URL+"/partitions/p1/progress", "", &progress); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if progress.Total != 2 || progress.Complete != 1 || progress.Failed != 1 || progress.RecentRatePerMinute <= 0 {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+	if code := do(t, http.MethodGet, srv.URL+"/partitions/missing/progress", "", nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing partition, got %d", code)
+	}
+}
+
+func TestListItems(t *testing.T) {
+	srv, _ := newTestServer(t)
+	var list ItemList
+	do(t, http.MethodGet, srv.URL+"/partitions/p1/items?page_size=1", "", &list)
+	if len(list.Items) != 1 || list.NextPageToken == "" {
+		t.Fatalf("expected a single item and a next page, got %+v", list)
+	}
+	first := list.Items[0].ID
+
+	next := ItemList{}
+	do(t, http.MethodGet, srv.URL+"/partitions/p1/items?page_size=1&page_token="+string(list.NextPageToken), "", &next)
+	if len(next.Items) != 1 || next.Items[0].ID == first {
+		t.Errorf("unexpected second page %+v", next)
+	}
+
+	list = ItemList{}
+	do(t, http.MethodGet, srv.URL+"/partitions/p2/items", "", &list)
+	if len(list.Items) != 1 || list.Items[0].Data != nil || string(list.Items[0].DataBase64) != "\xff" {
+		t.Errorf("expected non JSON data to be base64 encoded, got %+v", list.Items)
+	}
+
+	list = ItemList{}
+	do(t, http.MethodGet, srv.URL+"/partitions/p1/items?metadata=model=v2", "", &list)
+	if len(list.Items) != 1 || list.Items[0].ID != "i2" || list.Items[0].Metadata["model"] != "v2" {
+		t.Errorf("unexpected items for metadata %+v", list.Items)
+	}
+	if code := do(t, http.MethodGet, srv.URL+"/partitions/p1/items?metadata=model", "", nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid metadata, got %d", code)
+	}
+}
+
+func TestListAllItems(t *testing.T) {
+	srv, repo := newTestServer(t)
+	ctx := context.Background()
+	recently, earlier := time.Now().Add(-time.Minute), time.Now().Add(-2*time.Hour)
+	repo.Save(ctx, &state.Item{BaseModel: state.BaseModel{ID: "i4"}, PartitionID: "p1", Status: state.Complete, Data: []byte(`{}`), LastOwner: "pod-a", LastProcessedAt: &recently})
+	repo.Save(ctx, &state.Item{BaseModel: state.BaseModel{ID: "i5"}, PartitionID: "p2", Status: state.Failed, Data: []byte(`{}`), LastOwner: "pod-a", LastProcessedAt: &recently})
+	repo.Save(ctx, &state.Item{BaseModel: state.BaseModel{ID: "i6"}, PartitionID: "p2", Status: state.Complete, Data: []byte(`{}`), LastOwner: "pod-a", LastProcessedAt: &earlier})
+	repo.Save(ctx, &state.Item{BaseModel: state.BaseModel{ID: "i7"}, PartitionID: "p2", Status: state.Complete, Data: []byte(`{}`), LastOwner: "pod-b", LastProcessedAt: &recently})
+
+	var list ItemList
+	do(t, http.MethodGet, srv.URL+"/items?last_owner=pod-a&processed_since=1h", "", &list)
+	got := map[string]bool{}
+	for _, i := range list.Items {
+		got[i.ID] = true
+		if i.LastOwner != "pod-a" || i.LastProcessedAt == nil {
+			t.Errorf("unexpected item %+v", i)
+		}
+	}
+	if len(got) != 2 || !got["i4"] || !got["i5"] {
+		t.Errorf("expected the items pod-a processed in the last hour across partitions, got %v", got)
+	}
+
+	list = ItemList{}
+	since := time.Now().Add(-3 * time.Hour).UTC().Format(time.RFC3339)
+	do(t, http.MethodGet, srv.URL+"/partitions/p2/items?last_owner=pod-a&status=complete&processed_since="+since, "", &list)
+	if len(list.Items) != 1 || list.Items[0].ID != "i6" {
+		t.Errorf("expected the filters to apply to the items of a partition, got %+v", list.Items)
+	}
+	if code := do(t, http.MethodGet, srv.URL+"/items?processed_since=yesterday", "", nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid processed_since, got %d", code)
+	}
+}
+
+func TestRetryFailed(t *testing.T) {
+	srv, repo := newTestServer(t)
+	var res RetryResult
+	if code := do(t, http.MethodPost, srv.URL+"/partitions/p1/retry-failed", "", &res); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if res.Retried != 1 {
+		t.Errorf("expected 1 retried item, got %d", res.Retried)
+	}
+	i, err := repo.GetItem(context.Background(), "i1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Status != state.Available || i.RetryCount != 0 {
+		t.Errorf("expected item to be available with no retries, got %s %d", i.Status, i.RetryCount)
+	}
+	p, err := repo.GetPartition(context.Background(), "p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != state.Available {
+		t.Errorf("expected partition to be available, got %s", p.Status)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	srv, _ := newTestServer(t)
+	var p Partition
+	if code := do(t, http.MethodPost, srv.URL+"/partitions/p1/reopen", `{"gate": 2}`, &p); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if p.Status != state.Available || p.Gate != 2 {
+		t.Errorf("unexpected reopened partition %+v", p)
+	}
+
+	p = Partition{}
+	do(t, http.MethodPost, srv.URL+"/partitions/p1/reopen", "", &p)
+	if p.Gate != 2 {
+		t.Errorf("expected reopen without a gate to leave the gate unchanged, got %d", p.Gate)
+	}
+	if code := do(t, http.MethodPost, srv.URL+"/partitions/missing/reopen", "", nil); code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", code)
+	}
+	if code := do(t, http.MethodPost, srv.URL+"/partitions/p1/reopen", `{"gate": -1}`, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a negative gate, got %d", code)
+	}
+}
+
+func TestWriteErrorCodes(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{&state.ErrNotFound{Kind: "partition", ID: "p"}, http.StatusNotFound},
+		{fmt.Errorf("wrapped: %w", &state.ErrValidation{Field: "gate", Reason: "negative"}), http.StatusBadRequest},
+		{&state.ErrVersionConflict{Kind: "item", ID: "i"}, http.StatusConflict},
+		{&state.ErrQuotaExceeded{Kind: "tenant", ID: "t"}, http.StatusConflict},
+		{errors.New("connection refused"), http.StatusInternalServerError},
+	} {
+		rec := httptest.NewRecorder()
+		writeError(rec, tc.err)
+		if rec.Code != tc.want {
+			t.Errorf("%v: expected %d, got %d", tc.err, tc.want, rec.Code)
+		}
+	}
+}
+
+func TestSetMaxRetries(t *testing.T) {
+	srv, _ := newTestServer(t)
+	var p Partition
+	if code := do(t, http.MethodPost, srv.URL+"/partitions/p1/max-retries", `{"max_retries": -1}`, &p); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if p.MaxRetries == nil || *p.MaxRetries != -1 {
+		t.Errorf("expected p1 to retry indefinitely, got %+v", p)
+	}
+	var i Item
+	if code := do(t, http.MethodPost, srv.URL+"/items/i1/max-retries", `{"max_retries": 20}`, &i); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if i.MaxRetries == nil || *i.MaxRetries != 20 {
+		t.Errorf("expected i1 to retry 20 times, got %+v", i)
+	}
+	i = Item{}
+	do(t, http.MethodPost, srv.URL+"/items/i1/max-retries", `{"max_retries": null}`, &i)
+	if i.ID != "i1" || i.MaxRetries != nil {
+		t.Errorf("expected the override of i1 to be cleared, got %+v", i)
+	}
+	if code := do(t, http.MethodPost, srv.URL+"/items/i1/max-retries", "", nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a body, got %d", code)
+	}
+	if code := do(t, http.MethodPost, srv.URL+"/partitions/missing/max-retries", `{"max_retries": 1}`, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", code)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	srv, _ := newTestServer(t)
+	var q Quota
+	if code := do(t, http.MethodPost, srv.URL+"/partitions/p1/quota", `{"max_pending_items": 100}`, &q); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if q.MaxPendingItems == nil || *q.MaxPendingItems != 100 {
+		t.Errorf("expected p1 to be limited to 100 pending items, got %+v", q)
+	}
+	var p Partition
+	do(t, http.MethodGet, srv.URL+"/partitions/p1", "", &p)
+	if p.MaxPendingItems == nil || *p.MaxPendingItems != 100 {
+		t.Errorf("expected the limit on the partition, got %+v", p)
+	}
+	q = Quota{}
+	if code := do(t, http.MethodPost, srv.URL+"/tenants/acme/quota", `{"max_pending_items": 5}`, &q); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if q.Pending != 0 || q.MaxPendingItems == nil || *q.MaxPendingItems != 5 {
+		t.Errorf("expected acme to be limited to 5 pending items, got %+v", q)
+	}
+	q = Quota{}
+	do(t, http.MethodPost, srv.URL+"/tenants/acme/quota", `{"max_pending_items": null}`, &q)
+	if q.MaxPendingItems != nil {
+		t.Errorf("expected the limit of acme to be cleared, got %+v", q)
+	}
+	if code := do(t, http.MethodPost, srv.URL+"/partitions/p1/quota", `{"max_pending_items": -1}`, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a negative limit, got %d", code)
+	}
+	if code := do(t, http.MethodGet, srv.URL+"/partitions/missing/quota", "", nil); code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", code)
+	}
+}
+
+func TestCancelItem(t *testing.T) {
+	srv, _ := newTestServer(t)
+	var i Item
+	if code := do(t, http.MethodPost, srv.URL+"/items/i3/cancel", "", &i); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if i.Status != state.Cancelled {
+		t.Errorf("expected cancelled item, got %s", i.Status)
+	}
+
+	i = Item{}
+	do(t, http.MethodPost, srv.URL+"/items/i2/cancel", "", &i)
+	if i.Status != state.Complete {
+		t.Errorf("expected complete item to be unchanged, got %s", i.Status)
+	}
+	if code := do(t, http.MethodPost, srv.URL+"/items/missing/cancel", "", nil); code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", code)
+	}
+}
+
+func TestWatcherStats(t *testing.T) {
+	srv, _ := newTestServer(t)
+	var stats state.Stats
+	if code := do(t, http.MethodGet, srv.URL+"/watchers/w1/stats", "", &stats); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if len(stats.Leases) != 1 || stats.Leases[0] != "p1" {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if code := do(t, http.MethodGet, srv.URL+"/watchers/w2/stats", "", nil); code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", code)
+	}
+
+	var list WatcherList
+	if code := do(t, http.MethodGet, srv.URL+"/watchers", "", &list); code != http.StatusOK || len(list.Watchers) != 1 || list.Watchers[0].OwnerID != "w1" {
+		t.Errorf("unexpected watchers %d %+v", code, list)
+	}
+	if code := do(t, http.MethodGet, srv.URL+"/watchers/w1/health", "", nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 for a watcher without a health report, got %d", code)
+	}
+}
+
+type fakeHealthyWatcher struct {
+	fakeWatcher
+	fakeReporter
+}
+
+func TestWatcherHealth(t *testing.T) {
+	r := mux.NewRouter()
+	(&Server{Watchers: []StatsProvider{
+		&fakeHealthyWatcher{
+			fakeWatcher:  fakeWatcher{stats: state.Stats{OwnerID: "ingest"}},
+			fakeReporter: fakeReporter{report: state.HealthReport{Status: state.HealthOK}},
+		},
+		&fakeHealthyWatcher{
+			fakeWatcher:  fakeWatcher{stats: state.Stats{OwnerID: "export"}},
+			fakeReporter: fakeReporter{report: state.HealthReport{Status: state.HealthDown}},
+		},
+	}}).Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	var report state.HealthReport
+	if code := do(t, http.MethodGet, srv.URL+"/watchers/ingest/health", "", &report); code != http.StatusOK || report.Status != state.HealthOK {
+		t.Errorf("unexpected health of ingest %d %+v", code, report)
+	}
+	if code := do(t, http.MethodGet, srv.URL+"/watchers/export/health", "", nil); code != http.StatusServiceUnavailable {
+		t.Errorf("expected export to be down, got %d", code)
+	}
+}
+
+func TestListOwners(t *testing.T) {
+	srv, repo := newTestServer(t)
+	var list OwnerList
+	if code := do(t, http.MethodGet, srv.URL+"/owners", "", &list); code != http.StatusOK || len(list.Owners) != 0 {
+		t.Fatalf("expected no owners, got %d %+v", code, list)
+	}
+	if err := repo.Heartbeat(context.Background(), &state.Owner{OwnerID: "w1", Hostname: "host", LeasedPartitions: 1}); err != nil {
+		t.Fatal(err)
+	}
+	do(t, http.MethodGet, srv.URL+"/owners", "", &list)
+	if len(list.Owners) != 1 || list.Owners[0].ID != "w1" || list.Owners[0].Hostname != "host" || list.Owners[0].LeasedPartitions != 1 || list.Owners[0].Dead {
+		t.Errorf("unexpected owners %+v", list.Owners)
+	}
+}
+
+type fakeReporter struct {
+	report state.HealthReport
+}
+
+func (f *fakeReporter) HealthReport(ctx context.Context) state.HealthReport {
+	return f.report
+}
+
+func TestHealthHandler(t *testing.T) {
+	reporter := &fakeReporter{report: state.HealthReport{
+		Status: state.HealthDegraded,
+		Checks: []state.HealthCheckResult{
+			{Name: state.HealthCheckRepo, Critical: true, OK: true},
+			{Name: state.HealthCheckProcessor, Error: "unreachable"},
+		},
+	}}
+	srv := httptest.NewServer(HealthHandler(reporter, time.Second))
+	defer srv.Close()
+
+	var report state.HealthReport
+	if code := do(t, http.MethodGet, srv.URL, "", &report); code != http.StatusOK {
+		t.Errorf("expected a degraded watcher to be ready, got %d", code)
+	}
+	if report.Status != state.HealthDegraded || len(report.Checks) != 2 || report.Checks[1].Error != "unreachable" {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	reporter.report.Status = state.HealthDown
+	if code := do(t, http.MethodGet, srv.URL, "", nil); code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 when a critical check failed, got %d", code)
+	}
+}
+
+func TestDebugVars(t *testing.T) {
+	PublishStats(&fakeWatcher{stats: state.Stats{OwnerID: "w1", QueueDepth: 3}})
+	r := mux.NewRouter()
+	RegisterDebug(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	var vars struct {
+		Watchers map[string]state.Stats `json:"watchers"`
+	}
+	if code := do(t, http.MethodGet, srv.URL+"/debug/vars", "", &vars); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if s, ok := vars.Watchers["w1"]; !ok || s.QueueDepth != 3 {
+		t.Errorf("expected the watcher's stats, got %+v", vars.Watchers)
+	}
+	if code := do(t, http.MethodGet, srv.URL+"/debug/pprof/goroutine?debug=1", "", nil); code != http.StatusOK {
+		t.Errorf("expected goroutine stacks, got %d", code)
+	}
+}
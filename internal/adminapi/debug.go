@@ -0,0 +1,46 @@
+package adminapi
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http/pprof"
+
+	"github.com/gorilla/mux"
+)
+
+// StatsVarName is the name under which PublishStats publishes the watchers' stats.
+const StatsVarName = "watchers"
+
+// StatsVar is an expvar.Var of the stats of watchers, keyed by their owner ID.
+type StatsVar []StatsProvider
+
+// String returns the stats as JSON.
+func (v StatsVar) String() string {
+	stats := make(map[string]interface{}, len(v))
+	for _, w := range v {
+		s := w.Stats()
+		stats[s.OwnerID] = s
+	}
+	b, err := json.Marshal(stats)
+	if err != nil {
+		return "null"
+	}
+	return string(b)
+}
+
+// PublishStats publishes the stats of watchers through expvar, as StatsVarName. Like
+// expvar.Publish, it panics if called more than once.
+func PublishStats(watchers ...StatsProvider) {
+	expvar.Publish(StatsVarName, StatsVar(watchers))
+}
+
+// RegisterDebug adds the expvar and pprof handlers to r, at /debug/vars and /debug/pprof/.
+// They expose the process's internals, so r should only be served on a private address.
+func RegisterDebug(r *mux.Router) {
+	r.Handle("/debug/vars", expvar.Handler())
+	r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	r.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	r.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	r.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+}
@@ -0,0 +1,34 @@
+package adminapi
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+)
+
+// DefaultHealthTimeout is how long the health checks of a watcher served by the admin API
+// may take.
+const DefaultHealthTimeout = 5 * time.Second
+
+// HealthReporter is implemented by state.Watcher and state.WatcherGroup.
+type HealthReporter interface {
+	HealthReport(ctx context.Context) state.HealthReport
+}
+
+// HealthHandler serves the reporter's HealthReport as JSON, giving the checks up to timeout.
+// It responds with a 503 when a critical check failed, and otherwise a 200, including while
+// degraded, so that a slow optional dependency doesn't take the watcher out of rotation.
+func HealthHandler(reporter HealthReporter, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		report := reporter.HealthReport(ctx)
+		code := http.StatusOK
+		if report.Status == state.HealthDown {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, report)
+	})
+}
@@ -0,0 +1,110 @@
+// Package client enqueues work for watchers to process.
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Client adds items to existing partitions.
+type Client struct {
+	Repo state.Repo
+	// Codec marshals typed items, and must match the one used by the TypedProcessor. Defaults
+	// to state.JSONCodec.
+	Codec state.Codec
+	// Gate is the gate new items start at.
+	Gate int
+	// MaxRetries overrides the partition's MaxRetries for new items, when set.
+	MaxRetries *int
+	// SchemaVersion is the version of the format of new items' payloads, see
+	// state.Watcher.CurrentSchemaVersion.
+	SchemaVersion int
+	// TracerProvider, if set, traces each Enqueue call with a span, whose context the new
+	// items carry to the watchers processing them. Otherwise they carry the context of the
+	// span active in the caller's context, if any.
+	TracerProvider trace.TracerProvider
+}
+
+func (c *Client) codec() state.Codec {
+	if c.Codec == nil {
+		return state.JSONCodec{}
+	}
+	return c.Codec
+}
+
+// Enqueue adds an item with a random ID to the partition for each payload, and returns them.
+func (c *Client) Enqueue(ctx context.Context, partitionID string, payloads ...[]byte) (_ []*state.Item, err error) {
+	if c.TracerProvider != nil {
+		var span trace.Span
+		ctx, span = c.TracerProvider.Tracer(state.TracerName).Start(ctx, "enqueue "+partitionID,
+			trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(attribute.String("partition.id", partitionID), attribute.Int("items", len(payloads))))
+		defer func() {
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+			span.End()
+		}()
+	}
+	traceContext := state.TraceContextFromContext(ctx)
+	items := make([]*state.Item, len(payloads))
+	for n, b := range payloads {
+		items[n] = c.newItem(uuid.New().String(), partitionID, b, traceContext)
+	}
+	if err := c.Repo.CreateItems(ctx, items...); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// EnqueueOnce adds an item with the given ID to the partition unless it already exists, and
+// returns the stored item along with whether it was created, so that producers deriving IDs
+// from their input can safely enqueue the same input more than once.
+func (c *Client) EnqueueOnce(ctx context.Context, partitionID, id string, payload []byte) (*state.Item, bool, error) {
+	return c.Repo.GetOrCreateItem(ctx, c.newItem(id, partitionID, payload, state.TraceContextFromContext(ctx)))
+}
+
+// EnsurePartition creates the partition unless it already exists, and returns the stored
+// partition along with whether it was created, so that producers racing to create the same
+// partition all succeed.
+func (c *Client) EnsurePartition(ctx context.Context, p *state.Partition) (*state.Partition, bool, error) {
+	return c.Repo.GetOrCreatePartition(ctx, p)
+}
+
+func (c *Client) newItem(id, partitionID string, b []byte, traceContext string) *state.Item {
+	return &state.Item{
+		BaseModel:     state.BaseModel{ID: id},
+		PartitionID:   partitionID,
+		Gate:          c.Gate,
+		Data:          b,
+		MaxRetries:    c.MaxRetries,
+		SchemaVersion: c.SchemaVersion,
+		TraceContext:  traceContext,
+	}
+}
+
+// SetMaxRetries overrides the MaxRetries of an existing item, or clears its override when
+// maxRetries is nil.
+func (c *Client) SetMaxRetries(ctx context.Context, itemID string, maxRetries *int) error {
+	return c.Repo.SetItemMaxRetries(ctx, itemID, maxRetries)
+}
+
+// EnqueueTyped marshals each object with the client's codec, and enqueues them.
+func EnqueueTyped[T any](ctx context.Context, c *Client, partitionID string, objs ...T) ([]*state.Item, error) {
+	payloads := make([][]byte, len(objs))
+	for n, obj := range objs {
+		b, err := c.codec().Marshal(obj)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding item %d: %w", n, err)
+		}
+		payloads[n] = b
+	}
+	return c.Enqueue(ctx, partitionID, payloads...)
+}
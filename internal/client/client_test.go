@@ -0,0 +1,36 @@
+package client
+
+import (
+	"context"
+	"testing"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state/statetest"
+)
+
+func TestEnqueueOnce(t *testing.T) {
+	repo := statetest.NewSQLiteRepo(t)
+	ctx := context.Background()
+	c := &Client{Repo: repo, Gate: 2}
+	for _, want := range []bool{true, false} {
+		if _, created, err := c.EnsurePartition(ctx, &state.Partition{BaseModel: state.BaseModel{ID: "study-1"}}); err != nil || created != want {
+			t.Fatalf("expected the partition to be created %t, got %t, %v", want, created, err)
+		}
+	}
+
+	i, created, err := c.EnqueueOnce(ctx, "study-1", "series-1", []byte(`{"n":1}`))
+	if err != nil || !created {
+		t.Fatalf("expected the item to be created, got %t, %v", created, err)
+	}
+	if i.Gate != 2 || i.Status != state.Available {
+		t.Errorf("expected the item at the client's gate, got %+v", i)
+	}
+	// The same input enqueued again leaves the item as it is.
+	i, created, err = c.EnqueueOnce(ctx, "study-1", "series-1", []byte(`{"n":2}`))
+	if err != nil || created {
+		t.Fatalf("expected the existing item, got %t, %v", created, err)
+	}
+	if string(i.Data) != `{"n":1}` {
+		t.Errorf("expected the existing item's data, got %s", i.Data)
+	}
+}
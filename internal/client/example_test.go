@@ -0,0 +1,86 @@
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/client"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Resume is the payload of each item, marshaled for you by the client and processor.
+type Resume struct {
+	Candidate string `json:"candidate"`
+	Score     int    `json:"score"`
+}
+
+func Example() {
+	dir, err := os.MkdirTemp("", "client_example_")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := gorm.Open(sqlite.Open(filepath.Join(dir, "state.db")), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		panic(err)
+	}
+	repo := &state.GormRepo{DB: db}
+	if err := repo.AutoMigrate(); err != nil {
+		panic(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	repo.Save(ctx, &state.Partition{BaseModel: state.BaseModel{ID: "applications"}})
+	c := &client.Client{Repo: repo}
+	items, err := client.EnqueueTyped(ctx, c, "applications", Resume{Candidate: "ada"})
+	if err != nil {
+		panic(err)
+	}
+
+	// Score the resume at gate 0, then complete it at gate 1.
+	w := &state.Watcher{
+		Repo: repo,
+		Processor: &state.TypedProcessor[Resume]{
+			Func: func(ctx context.Context, id string, r Resume) (Resume, state.Decision, error) {
+				if r.Score == 0 {
+					r.Score = len(r.Candidate)
+					return r, state.Decision{NextGate: 1}, nil
+				}
+				return r, state.Decision{Complete: true, NextGate: 1}, nil
+			},
+		},
+		PollInterval: 10 * time.Millisecond,
+		AutoClose:    true,
+	}
+	done := make(chan struct{})
+	go func() {
+		w.Start(ctx)
+		close(done)
+	}()
+	for {
+		if p, err := repo.GetPartition(ctx, "applications"); err == nil && p.Status == state.Complete {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	i, err := repo.GetItem(context.Background(), items[0].ID)
+	if err != nil {
+		panic(err)
+	}
+	var r Resume
+	if err := (state.JSONCodec{}).Unmarshal(i.Result, &r); err != nil {
+		panic(err)
+	}
+	fmt.Printf("%s %s scored %d\n", i.Status, r.Candidate, r.Score)
+	// Output: Complete ada scored 3
+}
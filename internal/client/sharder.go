@@ -0,0 +1,120 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+)
+
+// Sharder spreads a single stream of items across a fixed number of partitions, or shards,
+// named prefix-0 to prefix-(n-1), for watchers to balance. Items are routed by a consistent
+// hash of their key, so that the items of a key share a shard and are processed in the order
+// they were enqueued by watchers with state.OrderBySequence.
+//
+// Shards are created as items are first routed to them, from Template.
+//
+// Resharding, with Reshard, only applies to new items: the items already enqueued stay in
+// their shards. Growing from n to m shards moves about (m-n)/m of the keys, each to one of the
+// new shards, and leaves the rest in place. Until the items of a moved key in its old shard are
+// processed, its new items may be processed ahead of them, so producers needing strict order
+// per key should wait for the shards to drain before resharding. Shrinking isn't supported, as
+// it would strand the items of the dropped shards' keys.
+type Sharder struct {
+	Client
+	Prefix string
+	// Template is copied for each shard as it is created, e.g. with labels matching the
+	// watchers' selector, or a gate plan. Its ID is replaced with the shard's.
+	Template state.Partition
+
+	mu      sync.Mutex
+	n       int
+	created map[string]bool
+}
+
+// NewSharder returns a Sharder of repo across n shards named after prefix.
+func NewSharder(repo state.Repo, prefix string, n int) *Sharder {
+	if n < 1 {
+		n = 1
+	}
+	return &Sharder{Client: Client{Repo: repo}, Prefix: prefix, n: n, created: map[string]bool{}}
+}
+
+// Shards returns the number of shards.
+func (s *Sharder) Shards() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.n
+}
+
+// Reshard grows the number of shards to n, for new items only, see Sharder.
+func (s *Sharder) Reshard(n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n < s.n {
+		return fmt.Errorf("can't shrink from %d to %d shards", s.n, n)
+	}
+	s.n = n
+	return nil
+}
+
+// Shard returns the ID of the partition the items of key are routed to.
+func (s *Sharder) Shard(key string) string {
+	return fmt.Sprintf("%s-%d", s.Prefix, jumpHash(hashKey(key), s.Shards()))
+}
+
+// EnqueueSharded adds an item with a random ID and the payload to the shard of key, creating
+// the shard if it doesn't exist yet, and returns the item.
+func (s *Sharder) EnqueueSharded(ctx context.Context, key string, data []byte) (*state.Item, error) {
+	shard := s.Shard(key)
+	if err := s.ensure(ctx, shard); err != nil {
+		return nil, err
+	}
+	items, err := s.Enqueue(ctx, shard, data)
+	if err != nil {
+		return nil, err
+	}
+	return items[0], nil
+}
+
+// ensure creates the shard, unless it already exists.
+func (s *Sharder) ensure(ctx context.Context, shard string) error {
+	s.mu.Lock()
+	created := s.created[shard]
+	s.mu.Unlock()
+	if created {
+		return nil
+	}
+
+	p := s.Template
+	p.BaseModel = state.BaseModel{ID: shard}
+	// Another producer may create it first.
+	if _, _, err := s.Repo.GetOrCreatePartition(ctx, &p); err != nil {
+		return fmt.Errorf("error creating shard %s: %w", shard, err)
+	}
+	s.mu.Lock()
+	s.created[shard] = true
+	s.mu.Unlock()
+	return nil
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// jumpHash maps the key to one of n buckets, moving only 1/n of the keys, each to the new
+// bucket, when n grows by one. See Lamping and Veach, "A Fast, Minimal Memory, Consistent
+// Hash Algorithm".
+func jumpHash(key uint64, n int) int {
+	var b, j int64 = -1, 0
+	for j < int64(n) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
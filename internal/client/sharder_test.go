@@ -0,0 +1,100 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state/statetest"
+)
+
+func TestShardDistribution(t *testing.T) {
+	s := NewSharder(nil, "events", 16)
+	const keys = 16000
+	counts := map[string]int{}
+	for n := 0; n < keys; n++ {
+		counts[s.Shard(fmt.Sprintf("customer-%d", n))]++
+	}
+	if len(counts) != 16 {
+		t.Fatalf("expected keys in all 16 shards, got %d", len(counts))
+	}
+	for shard, count := range counts {
+		if count < keys/16*8/10 || count > keys/16*12/10 {
+			t.Errorf("expected about %d keys per shard, %s has %d", keys/16, shard, count)
+		}
+	}
+}
+
+func TestShardStable(t *testing.T) {
+	s := NewSharder(nil, "events", 16)
+	// The mapping must not change across releases, or items of a key would be split.
+	for key, want := range map[string]string{"": "events-13", "a": "events-12", "customer-1": "events-13"} {
+		if got := s.Shard(key); got != want {
+			t.Errorf("expected %q in %s, got %s", key, want, got)
+		}
+	}
+	if NewSharder(nil, "events", 16).Shard("customer-1") != s.Shard("customer-1") {
+		t.Error("expected sharders to agree")
+	}
+
+	before := map[string]string{}
+	for n := 0; n < 1000; n++ {
+		key := fmt.Sprint(n)
+		before[key] = s.Shard(key)
+	}
+	if err := s.Reshard(20); err != nil {
+		t.Fatal(err)
+	}
+	moved := 0
+	for key, shard := range before {
+		after := s.Shard(key)
+		if after == shard {
+			continue
+		}
+		moved++
+		var n int
+		fmt.Sscanf(strings.TrimPrefix(after, "events-"), "%d", &n)
+		if n < 16 {
+			t.Errorf("expected %q to move to a new shard, moved from %s to %s", key, shard, after)
+		}
+	}
+	// About 4/20 of the keys move.
+	if moved < 150 || moved > 250 {
+		t.Errorf("expected about 200 keys to move, %d did", moved)
+	}
+	if err := s.Reshard(8); err == nil {
+		t.Error("expected shrinking to fail")
+	}
+}
+
+func TestEnqueueSharded(t *testing.T) {
+	repo := statetest.NewSQLiteRepo(t)
+	ctx := context.Background()
+	s := NewSharder(repo, "events", 4)
+	s.Template = state.Partition{Labels: state.PartitionLabels{"stream": "events"}}
+
+	var first, second *state.Item
+	var err error
+	if first, err = s.EnqueueSharded(ctx, "customer-1", []byte(`{"n":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	// Another producer finds the shard created.
+	if second, err = NewSharder(repo, "events", 4).EnqueueSharded(ctx, "customer-1", []byte(`{"n":2}`)); err != nil {
+		t.Fatal(err)
+	}
+	if first.PartitionID != s.Shard("customer-1") || second.PartitionID != first.PartitionID {
+		t.Errorf("expected the key's items in its shard, got %s and %s", first.PartitionID, second.PartitionID)
+	}
+	if second.Sequence <= first.Sequence {
+		t.Errorf("expected the key's items to be ordered, got sequences %d and %d", first.Sequence, second.Sequence)
+	}
+	p, err := repo.GetPartition(ctx, first.PartitionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Labels["stream"] != "events" {
+		t.Errorf("expected the shard to be created from the template, got labels %v", p.Labels)
+	}
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/processors/httprocessor"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state/statetest"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTraceContinuesThroughQueue(t *testing.T) {
+	repo := statetest.NewSQLiteRepo(t)
+	ctx := context.Background()
+	repo.Save(ctx, &state.Partition{BaseModel: state.BaseModel{ID: "p"}})
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	// The upstream request enqueues the item.
+	reqCtx, upstream := tp.Tracer("upstream").Start(ctx, "upstream request")
+	c := &Client{Repo: repo, TracerProvider: tp}
+	items, err := c.Enqueue(reqCtx, "p", []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.End()
+	if items[0].TraceContext == "" {
+		t.Fatal("expected the item to carry the trace context")
+	}
+
+	traceparents := make(chan string, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents <- r.Header.Get("traceparent")
+		w.Write([]byte(`{"complete": true}`))
+	}))
+	defer target.Close()
+	proc, err := httprocessor.NewProcessor(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &state.Watcher{Processor: proc, Repo: repo, OwnerID: "w", PollInterval: 10 * time.Millisecond, TracerProvider: tp}
+	watchCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		w.Start(watchCtx)
+		close(done)
+	}()
+	var traceparent string
+	select {
+	case traceparent = <-traceparents:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the item wasn't processed")
+	}
+	cancel()
+	<-done
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range exporter.GetSpans().Snapshots() {
+		spans[s.Name()] = s
+	}
+	enqueue, process := spans["enqueue p"], spans["process p"]
+	if enqueue == nil || process == nil {
+		t.Fatalf("expected enqueue and process spans, got %v", spans)
+	}
+	if enqueue.Parent().SpanID() != upstream.SpanContext().SpanID() || enqueue.SpanKind() != trace.SpanKindProducer {
+		t.Errorf("expected the enqueue span to be a child of the upstream request, got parent %s", enqueue.Parent().SpanID())
+	}
+	if process.Parent().SpanID() != enqueue.SpanContext().SpanID() || process.SpanContext().TraceID() != upstream.SpanContext().TraceID() || !process.Parent().IsRemote() {
+		t.Errorf("expected the process span to continue the enqueue span's trace, got parent %s of trace %s", process.Parent().SpanID(), process.SpanContext().TraceID())
+	}
+	if want := "00-" + process.SpanContext().TraceID().String() + "-" + process.SpanContext().SpanID().String() + "-01"; traceparent != want {
+		t.Errorf("expected the target to receive the process span's context %s, got %s", want, traceparent)
+	}
+}
+
+func TestTraceContextWithoutTracer(t *testing.T) {
+	repo := statetest.NewSQLiteRepo(t)
+	ctx := context.Background()
+	repo.Save(ctx, &state.Partition{BaseModel: state.BaseModel{ID: "p"}})
+	c := &Client{Repo: repo}
+
+	items, err := c.Enqueue(ctx, "p", []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items[0].TraceContext != "" {
+		t.Errorf("expected no trace context without a span, got %q", items[0].TraceContext)
+	}
+
+	tp := sdktrace.NewTracerProvider()
+	spanCtx, span := tp.Tracer("upstream").Start(ctx, "upstream request")
+	defer span.End()
+	if items, err = c.Enqueue(spanCtx, "p", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	got := trace.SpanContextFromContext(state.ContextWithTraceContext(ctx, items[0].TraceContext))
+	if !got.Equal(span.SpanContext().WithRemote(true)) {
+		t.Errorf("expected the item to carry the active span's context, got %+v", got)
+	}
+}
@@ -0,0 +1,70 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func received(c <-chan time.Time) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestFakeAfter(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+	c := f.After(time.Second)
+	if f.Waiters() != 1 {
+		t.Errorf("expected 1 waiter, got %d", f.Waiters())
+	}
+	f.Advance(999 * time.Millisecond)
+	if received(c) {
+		t.Error("timer fired early")
+	}
+	f.Advance(time.Millisecond)
+	if !received(c) {
+		t.Error("timer did not fire")
+	}
+	if f.Waiters() != 0 {
+		t.Errorf("expected fired timer to be removed, got %d waiters", f.Waiters())
+	}
+	if got := f.Since(start); got != time.Second {
+		t.Errorf("expected 1s to have passed, got %s", got)
+	}
+	if !received(f.After(0)) {
+		t.Error("expected a zero duration timer to fire immediately")
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	f := NewFake(time.Unix(0, 0))
+	tick := f.NewTicker(time.Second)
+	f.Advance(time.Second)
+	if !received(tick.C()) {
+		t.Error("ticker did not tick")
+	}
+	// Ticks are dropped when the receiver falls behind, like a time.Ticker.
+	f.Advance(3 * time.Second)
+	if !received(tick.C()) || received(tick.C()) {
+		t.Error("expected exactly one buffered tick")
+	}
+	tick.Stop()
+	f.Advance(time.Second)
+	if received(tick.C()) {
+		t.Error("stopped ticker ticked")
+	}
+}
+
+func TestOr(t *testing.T) {
+	if _, ok := Or(nil).(Real); !ok {
+		t.Error("expected a real clock for nil")
+	}
+	f := NewFake(time.Now())
+	if Or(f) != f {
+		t.Error("expected the given clock")
+	}
+}
@@ -0,0 +1,298 @@
+package httprocessor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+)
+
+// Codec encodes items into request bodies, and decodes the handler's responses.
+type Codec interface {
+	// ContentType is sent as the request's Content-Type header.
+	ContentType() string
+	EncodeRequest(req *state.ProcessRequest) ([]byte, error)
+	// DecodeResponse returns a *ResponseError if the handler reported an error.
+	DecodeResponse(body []byte) (*state.ProcessorResponse, error)
+}
+
+// ResponseError is an error reported by the handler in its response body.
+type ResponseError struct {
+	Message string
+	NoRetry bool
+}
+
+func (e *ResponseError) Error() string {
+	return e.Message
+}
+
+// ParseCodec returns the codec with the given name, "json", "json-envelope" or "protobuf".
+func ParseCodec(name string) (Codec, error) {
+	switch name {
+	case "", "json":
+		return JSONCodec{}, nil
+	case "json-envelope":
+		return JSONCodec{EnvelopeMode: true}, nil
+	case "protobuf":
+		return ProtobufCodec{}, nil
+	}
+	return nil, fmt.Errorf("unknown codec %q", name)
+}
+
+// JSONCodec posts the item's data as is, and expects a JSON response of the form
+// {"gate": 1, "complete": false, "response": {...}, "error": {"message": "", "no_retry": false},
+// "metadata": {...}, "new_items": [{"partition_id": "", "id": "", "gate": 0, "data": {...},
+// "priority": 0}]}, where metadata, if present, replaces the item's metadata, and new_items
+// are created along with saving the item. Gates that aren't integers fail the item.
+type JSONCodec struct {
+	// EnvelopeMode posts {"id": "", "partition_id": "", "gate": 0, "retry_count": 0,
+	// "metadata": {...}, "fence": 1, "data": ...} instead of the item's data. Data that isn't
+	// valid JSON is sent base64 encoded as "data_base64" instead.
+	EnvelopeMode bool
+}
+
+type envelope struct {
+	ID          string             `json:"id"`
+	PartitionID string             `json:"partition_id"`
+	Gate        int                `json:"gate"`
+	RetryCount  int                `json:"retry_count"`
+	Metadata    state.ItemMetadata `json:"metadata"`
+	Fence       int64              `json:"fence,omitempty"`
+	Data        json.RawMessage    `json:"data,omitempty"`
+	DataBase64  []byte             `json:"data_base64,omitempty"`
+}
+
+func (JSONCodec) ContentType() string {
+	return "application/json"
+}
+
+func (c JSONCodec) EncodeRequest(req *state.ProcessRequest) ([]byte, error) {
+	if !c.EnvelopeMode {
+		return req.Data, nil
+	}
+	e := envelope{ID: req.ID, PartitionID: req.PartitionID, Gate: req.Gate, RetryCount: req.RetryCount, Metadata: req.Metadata, Fence: req.Fence}
+	if e.Metadata == nil {
+		e.Metadata = state.ItemMetadata{}
+	}
+	if json.Valid(req.Data) {
+		e.Data = req.Data
+	} else {
+		e.DataBase64 = req.Data
+	}
+	return json.Marshal(e)
+}
+
+func (JSONCodec) DecodeResponse(body []byte) (*state.ProcessorResponse, error) {
+	respObj := &response{}
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(respObj); err != nil {
+		return nil, invalidGate(err)
+	}
+	if respObj.Error != nil {
+		return nil, &ResponseError{Message: respObj.Error.Message, NoRetry: respObj.Error.NoRetry}
+	}
+	return respObj.procResponse()
+}
+
+// invalidGate returns a non-retryable error for a response whose gate, or the gate of one of
+// its new items, isn't an integer, as a handler sending one would send it every time.
+// Other decoding errors are returned as is.
+func invalidGate(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && (typeErr.Field == "gate" || strings.HasPrefix(typeErr.Field, "new_items.") && strings.HasSuffix(typeErr.Field, ".gate")) {
+		return state.NonRetryableError(fmt.Sprintf("invalid %s %s, expected an integer", typeErr.Field, typeErr.Value))
+	}
+	return err
+}
+
+// ProtobufCodec exchanges protobuf messages with the handler, carrying the item's data and
+// the handler's response as opaque bytes, typically serialized messages of the handler's own
+// types:
+//
+//	message ProcessRequest {
+//	  string id = 1;
+//	  bytes data = 2;
+//	  map<string, string> metadata = 3;
+//	  // The fencing token of the watcher's lease, see state.ProcessRequest.Fence.
+//	  int64 fence = 4;
+//	  string partition_id = 5;
+//	  int32 gate = 6;
+//	  // The number of the item's attempts that failed before this one.
+//	  int32 retry_count = 7;
+//	}
+//
+//	message ProcessResponse {
+//	  int32 gate = 1;
+//	  bool complete = 2;
+//	  bytes response = 3;
+//	  Error error = 4;
+//	  // Replaces the item's metadata, if present.
+//	  map<string, string> metadata = 5;
+//	}
+//
+//	message Error {
+//	  string message = 1;
+//	  bool no_retry = 2;
+//	}
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) ContentType() string {
+	return "application/x-protobuf"
+}
+
+func (ProtobufCodec) EncodeRequest(req *state.ProcessRequest) ([]byte, error) {
+	var b []byte
+	b = appendBytesField(b, 1, []byte(req.ID))
+	b = appendBytesField(b, 2, req.Data)
+	keys := make([]string, 0, len(req.Metadata))
+	for k := range req.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		// Map fields are encoded as repeated key/value entry messages.
+		entry := appendBytesField(appendBytesField(nil, 1, []byte(k)), 2, []byte(req.Metadata[k]))
+		b = appendBytesField(b, 3, entry)
+	}
+	b = appendVarintField(b, 4, uint64(req.Fence))
+	if req.PartitionID != "" {
+		b = appendBytesField(b, 5, []byte(req.PartitionID))
+	}
+	// int32 values are sign extended to 64 bits.
+	b = appendVarintField(b, 6, uint64(int64(int32(req.Gate))))
+	b = appendVarintField(b, 7, uint64(req.RetryCount))
+	return b, nil
+}
+
+func (ProtobufCodec) DecodeResponse(body []byte) (*state.ProcessorResponse, error) {
+	resp := &state.ProcessorResponse{Data: []byte{}}
+	var respErr *ResponseError
+	err := decodeFields(body, func(num int, varint uint64, b []byte) error {
+		switch num {
+		case 1:
+			// int32 values are sign extended to 64 bits, rather than truncated.
+			if v := int64(varint); v < math.MinInt32 || v > math.MaxInt32 {
+				return state.NonRetryableError(fmt.Sprintf("invalid gate %d, out of the range of int32", v))
+			}
+			resp.NextGate = int(int32(varint))
+		case 2:
+			resp.Complete = varint != 0
+		case 3:
+			resp.Data = append([]byte(nil), b...)
+		case 4:
+			respErr = &ResponseError{}
+			return decodeFields(b, func(num int, varint uint64, b []byte) error {
+				switch num {
+				case 1:
+					respErr.Message = string(b)
+				case 2:
+					respErr.NoRetry = varint != 0
+				}
+				return nil
+			})
+		case 5:
+			var k, v string
+			if err := decodeFields(b, func(num int, _ uint64, b []byte) error {
+				switch num {
+				case 1:
+					k = string(b)
+				case 2:
+					v = string(b)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			if resp.Metadata == nil {
+				resp.Metadata = state.ItemMetadata{}
+			}
+			resp.Metadata[k] = v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if respErr != nil {
+		return nil, respErr
+	}
+	return resp, nil
+}
+
+const (
+	wireVarint = 0
+	wireI64    = 1
+	wireBytes  = 2
+	wireI32    = 5
+)
+
+// appendVarintField appends a varint field, unless it has the default value of zero.
+func appendVarintField(b []byte, num int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(num)<<3|wireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendBytesField(b []byte, num int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(num)<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+var errTruncated = errors.New("truncated protobuf message")
+
+// decodeFields calls f with each field of the message, passing the value of varint fields, or
+// the contents of length delimited ones. Fixed width fields are skipped.
+func decodeFields(b []byte, f func(num int, varint uint64, b []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errTruncated
+		}
+		b = b[n:]
+		num := int(tag >> 3)
+		if num == 0 {
+			return errors.New("invalid protobuf field number 0")
+		}
+		var varint uint64
+		var value []byte
+		switch tag & 7 {
+		case wireVarint:
+			if varint, n = binary.Uvarint(b); n <= 0 {
+				return errTruncated
+			}
+			b = b[n:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errTruncated
+			}
+			value, b = b[n:n+int(l)], b[n+int(l):]
+		case wireI64:
+			if len(b) < 8 {
+				return errTruncated
+			}
+			b = b[8:]
+			continue
+		case wireI32:
+			if len(b) < 4 {
+				return errTruncated
+			}
+			b = b[4:]
+			continue
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", tag&7)
+		}
+		if err := f(num, varint, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
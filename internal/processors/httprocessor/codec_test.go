@@ -0,0 +1,340 @@
+package httprocessor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+)
+
+// binaryPayload is not valid UTF-8.
+var binaryPayload = []byte{0x00, 0xff, 0xfe, 0xc3, 0x28, 0x80, '\n', 0xf8}
+
+// recordingHTTPClient records the request, and replies with resp.
+type recordingHTTPClient struct {
+	code        int
+	resp        []byte
+	contentType string
+	body        []byte
+}
+
+func (c *recordingHTTPClient) Post(url, contentType string, body io.Reader) (*http.Response, error) {
+	c.contentType = contentType
+	c.body, _ = io.ReadAll(body)
+	return &http.Response{
+		StatusCode: c.code,
+		Status:     fmt.Sprintf("HTTP %d", c.code),
+		Body:       ioutil.NopCloser(bytes.NewReader(c.resp)),
+	}, nil
+}
+
+func (c *recordingHTTPClient) Get(url string) (*http.Response, error) {
+	return nil, nil
+}
+
+func TestProtobufCodec(t *testing.T) {
+	var resp []byte
+	resp = appendVarintField(resp, 1, 2)
+	resp = appendVarintField(resp, 2, 1)
+	resp = appendBytesField(resp, 3, binaryPayload)
+	// Unknown fields are skipped.
+	resp = appendVarintField(resp, 9, 42)
+	resp = binary.LittleEndian.AppendUint32(binary.AppendUvarint(resp, 10<<3|wireI32), 7)
+	client := &recordingHTTPClient{code: 200, resp: resp}
+	p := &Processor{Client: client, Codec: ProtobufCodec{}}
+
+	got, err := p.Process("id", binaryPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &state.ProcessorResponse{NextGate: 2, Complete: true, Data: binaryPayload}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted response %#v, got %#v", want, got)
+	}
+	if client.contentType != "application/x-protobuf" {
+		t.Errorf("expected the protobuf content type, got %q", client.contentType)
+	}
+	var id string
+	var data []byte
+	err = decodeFields(client.body, func(num int, varint uint64, b []byte) error {
+		switch num {
+		case 1:
+			id = string(b)
+		case 2:
+			data = b
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "id" || !bytes.Equal(data, binaryPayload) {
+		t.Errorf("unexpected request %q, %v", id, data)
+	}
+}
+
+func TestProtobufCodecErrors(t *testing.T) {
+	var nested []byte
+	nested = appendBytesField(nested, 1, []byte("additional error context"))
+	nested = appendVarintField(nested, 2, 1)
+
+	cases := []struct {
+		name    string
+		code    int
+		resp    []byte
+		wantErr error
+	}{
+		{
+			name:    "handler error",
+			code:    500,
+			resp:    appendBytesField(nil, 4, nested[:len(nested)-2]),
+			wantErr: fmt.Errorf("Status HTTP 500; message: additional error context"),
+		},
+		{
+			name:    "NonRetryable handler error",
+			code:    200,
+			resp:    appendBytesField(nil, 4, nested),
+			wantErr: state.NonRetryableError("Status HTTP 200; message: additional error context"),
+		},
+		{
+			name:    "truncated",
+			code:    200,
+			resp:    appendBytesField(nil, 3, binaryPayload)[:4],
+			wantErr: fmt.Errorf("marshal error: %w, from request with HTTP Status: HTTP 200", errTruncated),
+		},
+		{
+			name:    "gate out of range",
+			code:    200,
+			resp:    appendVarintField(nil, 1, 1<<32+1),
+			wantErr: fmt.Errorf("marshal error: %w, from request with HTTP Status: HTTP 200", state.NonRetryableError("invalid gate 4294967297, out of the range of int32")),
+		},
+		{
+			name:    "500",
+			code:    500,
+			resp:    nil,
+			wantErr: fmt.Errorf("HTTP 500"),
+		},
+	}
+	for _, tc := range cases {
+		p := &Processor{Client: &recordingHTTPClient{code: tc.code, resp: tc.resp}, Codec: ProtobufCodec{}}
+		resp, err := p.Process(tc.name, nil)
+		if resp != nil {
+			t.Errorf("%s: expected no response, got %#v", tc.name, resp)
+		}
+		if err == nil || err.Error() != tc.wantErr.Error() || state.IsRetryable(err) != state.IsRetryable(tc.wantErr) {
+			t.Errorf("%s: wanted error %v, got %v", tc.name, tc.wantErr, err)
+		}
+	}
+}
+
+func TestJSONCodecInvalidGate(t *testing.T) {
+	for _, body := range []string{
+		`{"gate": 1.5}`,
+		`{"gate": 1e9}`,
+		`{"complete": true, "new_items": [{"gate": 2.0}]}`,
+	} {
+		_, err := JSONCodec{}.DecodeResponse([]byte(body))
+		if err == nil || state.IsRetryable(err) || !strings.Contains(err.Error(), "expected an integer") {
+			t.Errorf("%s: expected a non-retryable invalid gate error, got %v", body, err)
+		}
+	}
+	if _, err := (JSONCodec{}).DecodeResponse([]byte(`{"complete": "yes"}`)); err == nil || !state.IsRetryable(err) {
+		t.Errorf("expected other decoding errors to be left as is, got %v", err)
+	}
+}
+
+func TestJSONCodecContentType(t *testing.T) {
+	client := &recordingHTTPClient{code: 200, resp: []byte(`{"complete": true}`)}
+	p := &Processor{Client: client}
+	// The JSON codec forwards the item's data untouched, even if it isn't JSON.
+	if _, err := p.Process("id", binaryPayload); err != nil {
+		t.Fatal(err)
+	}
+	if client.contentType != "application/json" {
+		t.Errorf("expected the JSON content type, got %q", client.contentType)
+	}
+	if !bytes.Equal(client.body, binaryPayload) {
+		t.Errorf("expected the payload to be posted as is, got %v", client.body)
+	}
+}
+
+func TestParseCodec(t *testing.T) {
+	for name, want := range map[string]Codec{"": JSONCodec{}, "json": JSONCodec{}, "json-envelope": JSONCodec{EnvelopeMode: true}, "protobuf": ProtobufCodec{}} {
+		if got, err := ParseCodec(name); err != nil || got != want {
+			t.Errorf("%q: expected %T, got %T, %v", name, want, got, err)
+		}
+	}
+	if _, err := ParseCodec("xml"); err == nil {
+		t.Error("expected an unknown codec to fail")
+	}
+}
+
+func TestMetadataHeader(t *testing.T) {
+	var header http.Header
+	reply := `{"complete": true, "metadata": {"model": "v3"}}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		w.Write([]byte(reply))
+	}))
+	defer server.Close()
+	p := &Processor{Client: server.Client(), Target: server.URL}
+
+	got, err := p.ProcessRequest(context.Background(), &state.ProcessRequest{ID: "id", Data: []byte(`{}`), Metadata: state.ItemMetadata{"model": "v2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get(MetadataHeader) != `{"model":"v2"}` || header.Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected request headers %v", header)
+	}
+	if !reflect.DeepEqual(got.Metadata, state.ItemMetadata{"model": "v3"}) {
+		t.Errorf("expected the response metadata, got %v", got.Metadata)
+	}
+
+	// Items without metadata don't send the header, and responses without it leave it alone.
+	reply = `{"complete": true}`
+	if got, err = p.Process("id", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := header[MetadataHeader]; ok || got.Metadata != nil {
+		t.Errorf("expected no metadata, got header %v and response %v", header, got.Metadata)
+	}
+}
+
+func TestJSONCodecEnvelope(t *testing.T) {
+	client := &recordingHTTPClient{code: 200, resp: []byte(`{"complete": true}`)}
+	p := &Processor{Client: client, Codec: JSONCodec{EnvelopeMode: true}}
+	metadata := state.ItemMetadata{"endpoint": "b"}
+	for _, data := range [][]byte{[]byte(`{"a":1}`), binaryPayload} {
+		req := &state.ProcessRequest{ID: "id", PartitionID: "p", Gate: 2, RetryCount: 1, Data: data, Metadata: metadata}
+		if _, err := p.ProcessRequest(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		var got envelope
+		if err := json.Unmarshal(client.body, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.Metadata, metadata) || !bytes.Equal(append(got.Data, got.DataBase64...), data) {
+			t.Errorf("unexpected envelope %s", client.body)
+		}
+		if got.ID != "id" || got.PartitionID != "p" || got.Gate != 2 || got.RetryCount != 1 {
+			t.Errorf("expected the item's identity in the envelope, got %s", client.body)
+		}
+	}
+}
+
+func TestItemIdentity(t *testing.T) {
+	var header http.Header
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ = io.ReadAll(r.Body)
+		w.Write([]byte(`{"complete": true}`))
+	}))
+	defer server.Close()
+	req := &state.ProcessRequest{ID: "id", PartitionID: "p", Gate: 2, RetryCount: 3, Data: []byte(`{"a":1}`)}
+	want := map[string]string{ItemIDHeader: "id", PartitionIDHeader: "p", GateHeader: "2", RetryCountHeader: "3"}
+
+	// The headers are sent in both modes, while the raw mode posts the data untouched.
+	for _, codec := range []Codec{JSONCodec{}, JSONCodec{EnvelopeMode: true}} {
+		p := &Processor{Client: server.Client(), Target: server.URL, Codec: codec}
+		if _, err := p.ProcessRequest(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range want {
+			if got := header.Get(k); got != v {
+				t.Errorf("expected header %s to be %q, got %q", k, v, got)
+			}
+		}
+		if raw := !codec.(JSONCodec).EnvelopeMode; raw != bytes.Equal(body, req.Data) {
+			t.Errorf("unexpected body %s", body)
+		}
+	}
+
+	b, _ := ProtobufCodec{}.EncodeRequest(req)
+	var partitionID string
+	varints := map[int]uint64{}
+	decodeFields(b, func(num int, varint uint64, v []byte) error {
+		if num == 5 {
+			partitionID = string(v)
+		}
+		varints[num] = varint
+		return nil
+	})
+	if partitionID != "p" || varints[6] != 2 || varints[7] != 3 {
+		t.Errorf("expected the item's identity in fields 5 to 7, got partition %q and %v", partitionID, varints)
+	}
+}
+
+func TestProtobufCodecMetadata(t *testing.T) {
+	entry := appendBytesField(appendBytesField(nil, 1, []byte("model")), 2, []byte("v3"))
+	client := &recordingHTTPClient{code: 200, resp: appendBytesField(appendVarintField(nil, 2, 1), 5, entry)}
+	p := &Processor{Client: client, Codec: ProtobufCodec{}}
+
+	got, err := p.ProcessRequest(context.Background(), &state.ProcessRequest{ID: "id", Metadata: state.ItemMetadata{"b": "2", "a": "1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Metadata, state.ItemMetadata{"model": "v3"}) {
+		t.Errorf("expected the response metadata, got %v", got.Metadata)
+	}
+	var entries []string
+	err = decodeFields(client.body, func(num int, _ uint64, b []byte) error {
+		if num != 3 {
+			return nil
+		}
+		return decodeFields(b, func(_ int, _ uint64, b []byte) error {
+			entries = append(entries, string(b))
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "1", "b", "2"}; !reflect.DeepEqual(entries, want) {
+		t.Errorf("expected metadata entries %v, got %v", want, entries)
+	}
+}
+
+func TestFence(t *testing.T) {
+	var fence string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fence = r.Header.Get(FenceHeader)
+		w.Write([]byte(`{"complete": true}`))
+	}))
+	defer server.Close()
+	req := &state.ProcessRequest{ID: "id", Data: []byte(`{}`), Fence: 7}
+	if _, err := (&Processor{Client: server.Client(), Target: server.URL}).ProcessRequest(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if fence != "7" {
+		t.Errorf("expected the fence header, got %q", fence)
+	}
+
+	b, _ := JSONCodec{EnvelopeMode: true}.EncodeRequest(req)
+	var e envelope
+	if err := json.Unmarshal(b, &e); err != nil || e.Fence != 7 {
+		t.Errorf("expected the fence in the envelope, got %s", b)
+	}
+
+	b, _ = ProtobufCodec{}.EncodeRequest(req)
+	var got uint64
+	decodeFields(b, func(num int, varint uint64, _ []byte) error {
+		if num == 4 {
+			got = varint
+		}
+		return nil
+	})
+	if got != 7 {
+		t.Errorf("expected the fence in field 4, got %d", got)
+	}
+}
@@ -0,0 +1,52 @@
+package httprocessor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+// MetricConnections counts the connections the requests got, labelled reused "true" for the
+// ones kept alive from an earlier request, and "false" for new ones. A high rate of new
+// connections means the client's idle connections don't cover the Concurrency.
+const MetricConnections = "processor_connections"
+
+// checkTransport warns if the client's transport keeps fewer idle connections than the
+// Concurrency, which then churns through connections.
+func (h *Processor) checkTransport() {
+	client, ok := h.Client.(*http.Client)
+	if !ok || h.Concurrency <= 0 {
+		return
+	}
+	rt := client.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	transport, ok := rt.(*http.Transport)
+	if !ok {
+		return
+	}
+	idle := transport.MaxIdleConnsPerHost
+	if idle == 0 {
+		idle = http.DefaultMaxIdleConnsPerHost
+	}
+	if idle < h.Concurrency {
+		glog.Warningf("the HTTP processor's client keeps %d idle connections per host, fewer than its concurrency of %d", idle, h.Concurrency)
+	}
+}
+
+// traceConnections returns the context of a request counting the connection it gets in the
+// Metrics, if set.
+func (h *Processor) traceConnections(ctx context.Context) context.Context {
+	if h.Metrics == nil {
+		return ctx
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			h.Metrics.Counter(MetricConnections, 1, map[string]string{"reused": strconv.FormatBool(info.Reused)})
+		},
+	})
+}
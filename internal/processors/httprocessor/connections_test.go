@@ -0,0 +1,111 @@
+package httprocessor
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+)
+
+type connMetrics struct {
+	nopMetrics
+	mu       sync.Mutex
+	counters map[string]float64
+}
+
+func (m *connMetrics) Counter(name string, delta float64, labels state.Labels) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[name+"/"+labels["reused"]] += delta
+}
+
+// processConcurrently has the processor process n items at once, rounds times over.
+func processConcurrently(tb testing.TB, p *Processor, n, rounds int) {
+	for r := 0; r < rounds; r++ {
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if _, err := p.ProcessRequest(context.Background(), &state.ProcessRequest{ID: fmt.Sprint(i), Data: []byte(`{}`)}); err != nil {
+					tb.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+	}
+}
+
+func newConnectionsServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+		w.Write([]byte(`{"complete": true}`))
+	}))
+}
+
+func TestConnectionReuse(t *testing.T) {
+	server := newConnectionsServer()
+	defer server.Close()
+
+	const concurrency = 20
+	p, err := NewProcessor(server.URL, ForWatcher(&state.Watcher{BatchSize: concurrency}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := p.Client.(*http.Client).Transport.(*http.Transport)
+	if p.Concurrency != concurrency || transport.MaxIdleConnsPerHost != concurrency || transport.MaxConnsPerHost != concurrency {
+		t.Fatalf("expected the transport to be sized for the concurrency, got %d idle and %d max connections", transport.MaxIdleConnsPerHost, transport.MaxConnsPerHost)
+	}
+	m := &connMetrics{counters: map[string]float64{}}
+	p.Metrics = m
+
+	const requests = 2 * concurrency * 5
+	processConcurrently(t, p, 2*concurrency, 5)
+	if opened := m.counters[MetricConnections+"/false"]; opened > concurrency {
+		t.Errorf("expected at most %d new connections, got %v", concurrency, opened)
+	}
+	if reused := m.counters[MetricConnections+"/true"]; reused < requests-concurrency {
+		t.Errorf("expected the remaining requests to reuse connections, got %v", reused)
+	}
+}
+
+func TestForWatcherDefault(t *testing.T) {
+	p, err := NewProcessor("http://svc/process", ForWatcher(&state.Watcher{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Concurrency != state.DefaultBatchSize {
+		t.Errorf("expected the default batch size, got %d", p.Concurrency)
+	}
+	if p, _ = NewProcessor("http://svc/process", WithConcurrency(50), WithMaxIdleConnsPerHost(5)); p.Client.(*http.Client).Transport.(*http.Transport).MaxIdleConnsPerHost != 5 {
+		t.Error("expected WithMaxIdleConnsPerHost to override the concurrency")
+	}
+}
+
+func BenchmarkConnectionReuse(b *testing.B) {
+	server := newConnectionsServer()
+	defer server.Close()
+
+	const concurrency = 50
+	for name, opts := range map[string][]Option{
+		"two idle":    {WithMaxIdleConnsPerHost(http.DefaultMaxIdleConnsPerHost)},
+		"concurrency": {WithConcurrency(concurrency)},
+	} {
+		b.Run(name, func(b *testing.B) {
+			p, err := NewProcessor(server.URL, opts...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			m := &connMetrics{counters: map[string]float64{}}
+			p.Metrics = m
+			b.ResetTimer()
+			processConcurrently(b, p, concurrency, b.N)
+			b.ReportMetric(m.counters[MetricConnections+"/false"]/float64(b.N), "conns/op")
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package httprocessor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+)
+
+// RequestEncoder encodes an item's data, and metadata, into the body of a request, returning
+// the body and its content type.
+type RequestEncoder func(metadata state.ItemMetadata, data []byte) (body io.Reader, contentType string, err error)
+
+// FormEncoder encodes the item's data, a JSON object, as an application/x-www-form-urlencoded
+// form, for targets that don't take JSON. The object is flattened into fields named by the
+// path to each value, with dots, e.g. {"a": {"b": 1}} into a.b=1. The elements of arrays are
+// repeated values of their field, and nulls are empty. Data that isn't a JSON object fails
+// the item.
+func FormEncoder(_ state.ItemMetadata, data []byte) (io.Reader, string, error) {
+	var obj map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	// Numbers are sent as written, rather than as floats.
+	d.UseNumber()
+	if err := d.Decode(&obj); err != nil {
+		return nil, "", state.NonRetryableError(fmt.Sprintf("form encoding expects a JSON object: %s", err))
+	}
+	form := url.Values{}
+	flattenForm(form, "", obj)
+	return strings.NewReader(form.Encode()), "application/x-www-form-urlencoded", nil
+}
+
+// flattenForm adds the value to the form, under the field name.
+func flattenForm(form url.Values, name string, v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if name != "" {
+				flattenForm(form, name+"."+k, v[k])
+			} else {
+				flattenForm(form, k, v[k])
+			}
+		}
+	case []interface{}:
+		for _, e := range v {
+			flattenForm(form, name, e)
+		}
+	case nil:
+		form.Add(name, "")
+	case string:
+		form.Add(name, v)
+	case json.Number:
+		form.Add(name, v.String())
+	case bool:
+		form.Add(name, strconv.FormatBool(v))
+	}
+}
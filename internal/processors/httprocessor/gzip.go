@@ -0,0 +1,90 @@
+package httprocessor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+)
+
+// Names of the metrics reported by the processor, counting the bytes of the requests' and
+// responses' bodies, before compression and as sent over the wire.
+const (
+	MetricRequestBytes      = "processor_request_bytes"
+	MetricRequestWireBytes  = "processor_request_wire_bytes"
+	MetricResponseBytes     = "processor_response_bytes"
+	MetricResponseWireBytes = "processor_response_wire_bytes"
+)
+
+type nopMetrics struct{}
+
+func (nopMetrics) Counter(string, float64, state.Labels)        {}
+func (nopMetrics) Gauge(string, float64, state.Labels)          {}
+func (nopMetrics) Duration(string, time.Duration, state.Labels) {}
+
+func (h *Processor) metrics() state.Metrics {
+	if h.Metrics == nil {
+		return nopMetrics{}
+	}
+	return h.Metrics
+}
+
+// compress returns the body compressed with gzip if it is over the GzipThreshold, along with
+// its Content-Encoding, or the body as is.
+func (h *Processor) compress(body []byte) ([]byte, string, error) {
+	if h.GzipThreshold <= 0 || len(body) < h.GzipThreshold {
+		return body, "", nil
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, "", err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "gzip", nil
+}
+
+func (h *Processor) countRequest(size, wire int) {
+	h.metrics().Counter(MetricRequestBytes, float64(size), nil)
+	h.metrics().Counter(MetricRequestWireBytes, float64(wire), nil)
+}
+
+// readResponse reads the response's body, decompressing it if it is gzipped, up to the
+// MaxResponseBytes.
+func (h *Processor) readResponse(resp *http.Response) ([]byte, error) {
+	wire := &countingReader{r: resp.Body}
+	var body io.Reader = wire
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		zr, err := gzip.NewReader(wire)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		body = zr
+	}
+	b, err := io.ReadAll(h.limit(body))
+	h.metrics().Counter(MetricResponseBytes, float64(len(b)), nil)
+	h.metrics().Counter(MetricResponseWireBytes, float64(wire.n), nil)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
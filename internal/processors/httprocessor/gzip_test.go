@@ -0,0 +1,87 @@
+package httprocessor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+)
+
+type byteMetrics struct {
+	nopMetrics
+	mu       sync.Mutex
+	counters map[string]float64
+}
+
+func (m *byteMetrics) Counter(name string, delta float64, labels state.Labels) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[name] += delta
+}
+
+func TestGzip(t *testing.T) {
+	large := []byte(`{"pixels": "` + strings.Repeat("0123456789", 1000) + `"}`)
+	reply := []byte(`{"complete": true, "response": {"pixels": "` + strings.Repeat("9876543210", 1000) + `"}}`)
+	var encoding string
+	var received []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		var body io.Reader = r.Body
+		if encoding == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			body = zr
+		}
+		received, _ = io.ReadAll(body)
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Write(reply)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		zw.Write(reply)
+		zw.Close()
+	}))
+	defer server.Close()
+
+	m := &byteMetrics{counters: map[string]float64{}}
+	p, err := NewProcessor(server.URL, WithGzipThreshold(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Metrics = m
+	got, err := p.ProcessRequest(context.Background(), &state.ProcessRequest{ID: "i", Data: large})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoding != "gzip" || !bytes.Equal(received, large) {
+		t.Errorf("expected the request to be gzipped, got encoding %q and %d bytes", encoding, len(received))
+	}
+	if !got.Complete || !bytes.Contains(got.Data, []byte("9876543210")) {
+		t.Errorf("expected the gzipped response to be decoded, got %+v", got)
+	}
+	if m.counters[MetricRequestBytes] != float64(len(large)) || m.counters[MetricRequestWireBytes] >= m.counters[MetricRequestBytes]/10 {
+		t.Errorf("expected the request to be counted before and after compression, got %v", m.counters)
+	}
+	if m.counters[MetricResponseBytes] != float64(len(reply)) || m.counters[MetricResponseWireBytes] >= m.counters[MetricResponseBytes]/10 {
+		t.Errorf("expected the response to be counted before and after decompression, got %v", m.counters)
+	}
+
+	// Bodies under the threshold are sent as is.
+	if _, err := p.ProcessRequest(context.Background(), &state.ProcessRequest{ID: "i", Data: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if encoding != "" || string(received) != `{}` {
+		t.Errorf("expected a small request not to be gzipped, got encoding %q and %s", encoding, received)
+	}
+}
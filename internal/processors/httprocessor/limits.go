@@ -0,0 +1,68 @@
+package httprocessor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var (
+	// DefaultMaxResponseBytes bounds the bodies of the responses, decompressed, by default.
+	DefaultMaxResponseBytes int64 = 4 << 20
+	// DefaultMaxErrorMessageBytes bounds the error messages of the responses copied into the
+	// items' errors, by default.
+	DefaultMaxErrorMessageBytes = 1 << 10
+)
+
+// ErrResponseTooLarge is the error of responses over the processor's MaxResponseBytes.
+var ErrResponseTooLarge = errors.New("response body too large")
+
+func (h *Processor) maxResponseBytes() int64 {
+	if h.MaxResponseBytes == 0 {
+		return DefaultMaxResponseBytes
+	}
+	return h.MaxResponseBytes
+}
+
+// limit returns a reader of r failing with ErrResponseTooLarge once it is over the
+// MaxResponseBytes, without reading more than a byte past them.
+func (h *Processor) limit(r io.Reader) io.Reader {
+	max := h.maxResponseBytes()
+	if max < 0 {
+		return r
+	}
+	return &limitedReader{r: r, remaining: max, err: fmt.Errorf("%w: over %d bytes", ErrResponseTooLarge, max)}
+}
+
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+	err       error
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.remaining {
+		n, l.remaining = int(l.remaining), 0
+		return n, l.err
+	}
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// truncateError returns the response's error message cut to the MaxErrorMessageBytes, noting
+// how much was cut.
+func (h *Processor) truncateError(msg string) string {
+	max := h.MaxErrorMessageBytes
+	if max == 0 {
+		max = DefaultMaxErrorMessageBytes
+	}
+	if max < 0 || len(msg) <= max {
+		return msg
+	}
+	return fmt.Sprintf("%s...(%d bytes truncated)", strings.ToValidUTF8(msg[:max], ""), len(msg)-max)
+}
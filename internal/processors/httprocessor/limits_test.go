@@ -0,0 +1,84 @@
+package httprocessor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+)
+
+// endlessBody is a response body that never ends, counting the bytes read from it.
+type endlessBody struct {
+	read int64
+}
+
+func (b *endlessBody) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	b.read += int64(len(p))
+	return len(p), nil
+}
+
+func (b *endlessBody) Close() error { return nil }
+
+type endlessClient struct {
+	body *endlessBody
+}
+
+func (c *endlessClient) response() *http.Response {
+	c.body = &endlessBody{}
+	return &http.Response{StatusCode: http.StatusInternalServerError, Status: "HTTP 500", Body: c.body}
+}
+
+func (c *endlessClient) Post(url, contentType string, body io.Reader) (*http.Response, error) {
+	return c.response(), nil
+}
+
+func (c *endlessClient) Get(url string) (*http.Response, error) {
+	return c.response(), nil
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	client := &endlessClient{}
+	h := &Processor{Client: client, Target: "http://target", HealthEndpoint: "/health", MaxResponseBytes: 1 << 20}
+	req := &state.ProcessRequest{ID: "i", Data: []byte(`{}`)}
+
+	_, err := h.ProcessRequest(context.Background(), req)
+	if err == nil || state.IsRetryable(err) || !strings.Contains(err.Error(), "response body too large: over 1048576 bytes") {
+		t.Errorf("expected a non-retryable error for the endless response, got %v", err)
+	}
+	if client.body.read > h.MaxResponseBytes+1 {
+		t.Errorf("expected at most a byte past the limit to be read, read %d", client.body.read)
+	}
+
+	h.RetryOversizedResponses = true
+	if _, err := h.ProcessRequest(context.Background(), req); err == nil || !state.IsRetryable(err) {
+		t.Errorf("expected a retryable error, got %v", err)
+	}
+
+	if err := h.Healthcheck(context.Background()); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("expected the health check to fail for the endless response, got %v", err)
+	}
+	if client.body.read > h.MaxResponseBytes+1 {
+		t.Errorf("expected at most a byte past the limit to be read by the health check, read %d", client.body.read)
+	}
+}
+
+func TestErrorMessageTruncated(t *testing.T) {
+	msg := strings.Repeat("e", 10000)
+	h := &Processor{
+		Client:               &mockHTTPClient{code: 500, resp: fmt.Sprintf(`{"error": {"message": %q}}`, msg)},
+		Target:               "http://target",
+		MaxErrorMessageBytes: 100,
+	}
+	_, err := h.ProcessRequest(context.Background(), &state.ProcessRequest{ID: "i"})
+	want := fmt.Sprintf("Status HTTP 500; message: %s...(9900 bytes truncated)", msg[:100])
+	if err == nil || err.Error() != want {
+		t.Errorf("expected the error message to be truncated to %q, got %v", want, err)
+	}
+}
@@ -0,0 +1,261 @@
+package httprocessor
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+	"github.com/golang/glog"
+)
+
+var (
+	// DefaultTimeout bounds each request of the processors made by NewProcessor, by default.
+	DefaultTimeout = 10 * time.Second
+	// DefaultMaxIdleConnsPerHost is the number of idle connections to each host the processors
+	// made by NewProcessor keep for reuse, by default. It should cover the watcher's BatchSize,
+	// or its item processors open a new connection, and TLS handshake, for most requests.
+	DefaultMaxIdleConnsPerHost = 64
+)
+
+// Option configures the processor made by NewProcessor.
+type Option func(c *clientConfig)
+
+// clientConfig is what the options configure of the processor's client.
+type clientConfig struct {
+	client              HTTPClient
+	timeout             time.Duration
+	maxIdleConnsPerHost int
+	certFile, keyFile   string
+	rootCAs             *x509.CertPool
+	rootCAFile          string
+	insecureSkipVerify  bool
+	signingKeys         []SigningKey
+	gzipThreshold       int
+	maxResponseBytes    int64
+	concurrency         int
+	gateTargets         map[int]string
+}
+
+// tls returns whether any of the TLS options are set.
+func (c *clientConfig) tls() bool {
+	return c.certFile != "" || c.rootCAs != nil || c.rootCAFile != "" || c.insecureSkipVerify
+}
+
+// WithClient sends the requests with the client, in place of one built from the other
+// options, which then can't be set.
+func WithClient(client HTTPClient) Option {
+	return func(c *clientConfig) { c.client = client }
+}
+
+// WithTimeout bounds each request, including reading its response. Defaults to
+// DefaultTimeout, and zero means no limit.
+func WithTimeout(d time.Duration) Option {
+	return func(c *clientConfig) { c.timeout = d }
+}
+
+// WithMaxIdleConnsPerHost sets the number of idle connections kept to each host, defaulting
+// to the Concurrency if set, or else DefaultMaxIdleConnsPerHost.
+func WithMaxIdleConnsPerHost(n int) Option {
+	return func(c *clientConfig) { c.maxIdleConnsPerHost = n }
+}
+
+// WithClientCert presents the certificate and key, PEM encoded in the files, to targets that
+// require client certificates. The files are read again when they change, so that a rotated
+// certificate is used for new connections without a restart.
+func WithClientCert(certFile, keyFile string) Option {
+	return func(c *clientConfig) { c.certFile, c.keyFile = certFile, keyFile }
+}
+
+// WithRootCAs verifies the target's certificate against the pool, in place of the system's.
+func WithRootCAs(pool *x509.CertPool) Option {
+	return func(c *clientConfig) { c.rootCAs = pool }
+}
+
+// WithRootCAFile verifies the target's certificate against the PEM encoded certificates in
+// the file, e.g. of a private CA, in place of the system's.
+func WithRootCAFile(path string) Option {
+	return func(c *clientConfig) { c.rootCAFile = path }
+}
+
+// WithInsecureSkipVerify skips verifying the target's certificate, leaving the connection
+// open to interception. It is only meant for testing, and is logged as a warning.
+func WithInsecureSkipVerify() Option {
+	return func(c *clientConfig) { c.insecureSkipVerify = true }
+}
+
+// WithSigningKeys signs every request with the keys, see Processor.SigningKeys.
+func WithSigningKeys(keys ...SigningKey) Option {
+	return func(c *clientConfig) { c.signingKeys = keys }
+}
+
+// WithGzipThreshold compresses request bodies from n bytes, see Processor.GzipThreshold.
+func WithGzipThreshold(n int) Option {
+	return func(c *clientConfig) { c.gzipThreshold = n }
+}
+
+// WithMaxResponseBytes bounds the bodies of the responses, see Processor.MaxResponseBytes.
+func WithMaxResponseBytes(n int64) Option {
+	return func(c *clientConfig) { c.maxResponseBytes = n }
+}
+
+// WithConcurrency sets the processor's Concurrency, sizing the connections of the client built
+// for it.
+func WithConcurrency(n int) Option {
+	return func(c *clientConfig) { c.concurrency = n }
+}
+
+// ForWatcher sets the processor's Concurrency to the BatchSize of the watcher it is built for.
+func ForWatcher(w *state.Watcher) Option {
+	n := w.BatchSize
+	if n == 0 {
+		n = state.DefaultBatchSize
+	}
+	return WithConcurrency(n)
+}
+
+// WithGateTargets sets the URLs of the items of the given gates, see Processor.GateTargets.
+func WithGateTargets(targets map[int]string) Option {
+	return func(c *clientConfig) { c.gateTargets = targets }
+}
+
+// NewProcessor returns a processor posting to the target with a client built from the
+// options, failing if the target or any gate's is an invalid template or not an absolute URL,
+// see Target, or the certificates can't be loaded. Processors built otherwise only parse the
+// targets on their first request, and need a Client of their own.
+func NewProcessor(target string, opts ...Option) (*Processor, error) {
+	c := &clientConfig{timeout: DefaultTimeout}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.maxIdleConnsPerHost == 0 {
+		c.maxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+		if c.concurrency > 0 {
+			c.maxIdleConnsPerHost = c.concurrency
+		}
+	}
+	h := &Processor{
+		Client:           c.client,
+		Target:           target,
+		GateTargets:      c.gateTargets,
+		SigningKeys:      c.signingKeys,
+		GzipThreshold:    c.gzipThreshold,
+		MaxResponseBytes: c.maxResponseBytes,
+		Concurrency:      c.concurrency,
+	}
+	if err := h.parseTarget(); err != nil {
+		return nil, err
+	}
+	if err := h.checkTargets(); err != nil {
+		return nil, err
+	}
+	if h.Client != nil {
+		if c.tls() {
+			return nil, errors.New("TLS options don't apply to a client of your own")
+		}
+		h.checkTransport()
+		return h, nil
+	}
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = c.maxIdleConnsPerHost
+	if transport.MaxIdleConns < transport.MaxIdleConnsPerHost {
+		transport.MaxIdleConns = transport.MaxIdleConnsPerHost
+	}
+	// Bounding the connections makes requests past the Concurrency wait for one to be free,
+	// rather than each opening its own, and running out of ports.
+	transport.MaxConnsPerHost = c.concurrency
+	// Targets serving HTTP/2 multiplex the requests over a single connection. Setting the
+	// TLSClientConfig would otherwise disable it.
+	transport.ForceAttemptHTTP2 = true
+	transport.TLSClientConfig = tlsConfig
+	h.Client = &http.Client{Transport: transport, Timeout: c.timeout}
+	return h, nil
+}
+
+func (c *clientConfig) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: c.rootCAs}
+	if c.rootCAFile != "" {
+		pem, err := os.ReadFile(c.rootCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading root CAs: %w", err)
+		}
+		if config.RootCAs == nil {
+			config.RootCAs = x509.NewCertPool()
+		}
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.rootCAFile)
+		}
+	}
+	if c.certFile != "" {
+		certs := &certReloader{certFile: c.certFile, keyFile: c.keyFile}
+		if _, err := certs.load(); err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = certs.GetClientCertificate
+	}
+	if c.insecureSkipVerify {
+		glog.Warning("INSECURE: not verifying the certificates of the HTTP processor's target")
+		config.InsecureSkipVerify = true
+	}
+	return config, nil
+}
+
+// certReloader loads a client certificate, and loads it again when its files change.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (r *certReloader) load() (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var modTime time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return r.stale(fmt.Errorf("error reading client certificate: %w", err))
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if r.cert != nil && modTime.Equal(r.modTime) {
+		return r.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return r.stale(fmt.Errorf("error loading client certificate: %w", err))
+	}
+	if r.cert != nil {
+		glog.Infof("reloaded client certificate %s", r.certFile)
+	}
+	r.cert, r.modTime = &cert, modTime
+	return r.cert, nil
+}
+
+// stale returns the certificate last loaded, if any, when it can't be loaded again, e.g. while
+// its files are half written. Must be called with mu held.
+func (r *certReloader) stale(err error) (*tls.Certificate, error) {
+	if r.cert == nil {
+		return nil, err
+	}
+	glog.Warningf("%s, keeping the previous one", err)
+	return r.cert, nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate.
+func (r *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.load()
+}
@@ -0,0 +1,189 @@
+package httprocessor
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+)
+
+// testCA issues certificates for the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate and key signed by the CA, PEM encoded.
+func (ca *testCA) issue(t *testing.T, usage x509.ExtKeyUsage) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, path string, b []byte, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientCert(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+	serverCert, serverKey := ca.issue(t, x509.ExtKeyUsageServerAuth)
+	pair, err := tls.X509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"complete": true}`))
+	}))
+	// The rejected handshakes are expected.
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{pair}, ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	dir := t.TempDir()
+	caFile, certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeFile(t, caFile, ca.pem, time.Now())
+	clientCert, clientKey := ca.issue(t, x509.ExtKeyUsageClientAuth)
+	writeFile(t, certFile, clientCert, time.Now())
+	writeFile(t, keyFile, clientKey, time.Now())
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	process := func(opts ...Option) error {
+		t.Helper()
+		p, err := NewProcessor(server.URL, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Client.(*http.Client).CloseIdleConnections()
+		_, err = p.ProcessRequest(context.Background(), &state.ProcessRequest{ID: "i", Data: []byte(`{}`)})
+		return err
+	}
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		ok   bool
+	}{
+		{"client cert and root CA file", []Option{WithClientCert(certFile, keyFile), WithRootCAFile(caFile)}, true},
+		{"client cert and root CA pool", []Option{WithClientCert(certFile, keyFile), WithRootCAs(pool), WithTimeout(5 * time.Second)}, true},
+		{"insecure", []Option{WithClientCert(certFile, keyFile), WithInsecureSkipVerify()}, true},
+		{"no client cert", []Option{WithRootCAFile(caFile)}, false},
+		{"unknown server CA", []Option{WithClientCert(certFile, keyFile)}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := process(tc.opts...); (err == nil) != tc.ok {
+				t.Errorf("expected success %v, got %v", tc.ok, err)
+			}
+		})
+	}
+
+	// A rotated client certificate is used for new connections.
+	untrustedCert, untrustedKey := other.issue(t, x509.ExtKeyUsageClientAuth)
+	writeFile(t, certFile, untrustedCert, time.Now().Add(time.Minute))
+	writeFile(t, keyFile, untrustedKey, time.Now().Add(time.Minute))
+	p, err := NewProcessor(server.URL, WithClientCert(certFile, keyFile), WithRootCAFile(caFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &state.ProcessRequest{ID: "i", Data: []byte(`{}`)}
+	if _, err := p.ProcessRequest(context.Background(), req); err == nil {
+		t.Error("expected a certificate of another CA to be rejected")
+	}
+	writeFile(t, certFile, clientCert, time.Now().Add(2*time.Minute))
+	writeFile(t, keyFile, clientKey, time.Now().Add(2*time.Minute))
+	if _, err := p.ProcessRequest(context.Background(), req); err != nil {
+		t.Errorf("expected the rotated certificate to be accepted, got %v", err)
+	}
+}
+
+func TestNewProcessorOptions(t *testing.T) {
+	p, err := NewProcessor("http://svc/process", WithTimeout(time.Second), WithMaxIdleConnsPerHost(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := p.Client.(*http.Client)
+	if transport := client.Transport.(*http.Transport); client.Timeout != time.Second || transport.MaxIdleConnsPerHost != 8 {
+		t.Errorf("unexpected client %+v", client)
+	}
+	if p, _ = NewProcessor("http://svc/process"); p.Client.(*http.Client).Transport.(*http.Transport).MaxIdleConnsPerHost != DefaultMaxIdleConnsPerHost {
+		t.Error("expected the default idle connections per host")
+	}
+
+	for name, opts := range map[string][]Option{
+		"missing certificate": {WithClientCert("missing.pem", "missing.key")},
+		"missing root CAs":    {WithRootCAFile("missing.pem")},
+		"own client with TLS": {WithClient(&mockHTTPClient{}), WithInsecureSkipVerify()},
+	} {
+		if _, err := NewProcessor("http://svc/process", opts...); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -8,9 +8,16 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"path"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
 
 	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+	"go.opentelemetry.io/otel/propagation"
 )
 
 type HTTPClient interface {
@@ -18,11 +25,46 @@ type HTTPClient interface {
 	Get(url string) (resp *http.Response, err error)
 }
 
+// HTTPDoer is optionally implemented by HTTPClients, such as *http.Client, to send requests
+// with headers, and cancel them on shutdown. Other clients can only POST, and can't send the
+// item's identity, MetadataHeader or FenceHeader.
+type HTTPDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+const (
+	// MetadataHeader holds the item's metadata as a JSON object, if it has any.
+	MetadataHeader = "X-Item-Metadata"
+	// FenceHeader holds the fencing token of the watcher's lease on the item's partition, see
+	// state.ProcessRequest.Fence. Handlers with side effects should reject requests with a
+	// lower token than the highest they've seen for the partition.
+	FenceHeader = "X-Fence-Token"
+	// The headers identifying the item, sent with every request, so that the handler can log
+	// which item it is working on, and deduplicate the attempts of an item by its ID.
+	ItemIDHeader      = "X-Item-ID"
+	PartitionIDHeader = "X-Partition-ID"
+	GateHeader        = "X-Gate"
+	// RetryCountHeader holds the number of the item's attempts that failed before this one,
+	// see state.ProcessRequest.RetryCount.
+	RetryCountHeader = "X-Retry-Count"
+)
+
 type response struct {
 	NextGate int                    `json:"gate"`
 	Complete bool                   `json:"complete"`
 	Data     map[string]interface{} `json:"response"`
 	Error    *processorError        `json:"error"`
+	Metadata map[string]string      `json:"metadata"`
+	NewItems []newItem              `json:"new_items"`
+}
+
+// newItem is an item for the watcher to create, with its data as JSON.
+type newItem struct {
+	PartitionID string          `json:"partition_id"`
+	ID          string          `json:"id"`
+	Gate        int             `json:"gate"`
+	Data        json.RawMessage `json:"data"`
+	Priority    int             `json:"priority"`
 }
 
 type processorError struct {
@@ -46,50 +88,372 @@ func (r *response) procResponse() (*state.ProcessorResponse, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error marshaling data into bytes: %w", err)
 	}
-	return &state.ProcessorResponse{
+	resp := &state.ProcessorResponse{
 		NextGate: r.NextGate,
 		Complete: r.Complete,
 		Data:     data,
-	}, nil
+		Metadata: r.Metadata,
+	}
+	for _, n := range r.NewItems {
+		resp.NewItems = append(resp.NewItems, state.NewItem{
+			PartitionID: n.PartitionID,
+			ID:          n.ID,
+			Gate:        n.Gate,
+			Data:        []byte(n.Data),
+			Priority:    n.Priority,
+		})
+	}
+	return resp, nil
 }
 
 type Processor struct {
-	Client         HTTPClient
-	Target         string
+	Client HTTPClient
+	// Target is the URL to post items to. It may be a text/template executed with each
+	// item's state.ProcessRequest, e.g. "https://{{.Labels.region}}.svc/process/{{.PartitionID}}"
+	// to route items by their partition's labels. Items whose URL can't be rendered, e.g. for a
+	// missing label, or doesn't parse, fail without retries. See NewProcessor.
+	Target string
+	// GateTargets, if set, maps gates to the URLs to post their items to in place of the
+	// Target, e.g. a path per gate of the same service, the Target remaining the URL of the
+	// other gates. Each may be a template, like the Target.
+	GateTargets map[int]string
+	// HealthEndpoint is joined to the first plain URL of the Target and GateTargets on each
+	// distinct host, which is checked once.
 	HealthEndpoint string
+	// Codec encodes requests and decodes responses, JSONCodec if nil.
+	Codec Codec
+	// Method is the HTTP method of the requests, POST if empty. Other methods need an
+	// HTTPDoer client.
+	Method string
+	// ContentType, if set, is sent as the requests' Content-Type in place of the one of the
+	// Codec or RequestEncoder.
+	ContentType string
+	// RequestEncoder, if set, encodes the requests' bodies in place of the Codec, which still
+	// decodes the responses, e.g. FormEncoder.
+	RequestEncoder RequestEncoder
+	// SigningKeys, if set, sign every request, including health checks, in the
+	// SignatureHeader. Signing needs an HTTPDoer client.
+	SigningKeys []SigningKey
+	// GzipThreshold, if set, is the size in bytes from which request bodies are compressed
+	// with gzip, for targets accepting a Content-Encoding. Gzipped responses are decompressed
+	// regardless. Compression needs an HTTPDoer client.
+	GzipThreshold int
+	// Metrics receives the sizes of the requests and responses, see MetricRequestBytes.
+	// Defaults to discarding them.
+	Metrics state.Metrics
+	// MaxResponseBytes bounds the bodies of the responses, decompressed, so that a misbehaving
+	// target can't exhaust the memory. Larger responses fail with ErrResponseTooLarge, without
+	// retries unless RetryOversizedResponses. Defaults to DefaultMaxResponseBytes, and a
+	// negative value leaves them unbounded.
+	MaxResponseBytes        int64
+	RetryOversizedResponses bool
+	// MaxErrorMessageBytes bounds the error messages of the responses copied into the items'
+	// errors. Defaults to DefaultMaxErrorMessageBytes, and a negative value leaves them whole.
+	MaxErrorMessageBytes int
+	// Concurrency is the number of requests expected in flight, e.g. the watcher's BatchSize.
+	// NewProcessor keeps as many connections to the target alive, and warns about clients of
+	// your own that keep fewer. See WithConcurrency and ForWatcher.
+	Concurrency int
+
+	parseOnce   sync.Once
+	target      *target
+	gateTargets map[int]*target
+	targetErr   error
+}
+
+// target is a parsed Target or GateTargets URL, either plain or a template.
+type target struct {
+	url  *url.URL
+	tmpl *template.Template
+}
+
+// parseTarget parses the Target and GateTargets, as templates if they have any actions.
+func (h *Processor) parseTarget() error {
+	h.parseOnce.Do(func() {
+		if h.Target != "" || len(h.GateTargets) == 0 {
+			if h.target, h.targetErr = parseTarget(h.Target); h.targetErr != nil {
+				return
+			}
+		}
+		h.gateTargets = map[int]*target{}
+		for gate, raw := range h.GateTargets {
+			t, err := parseTarget(raw)
+			if err != nil {
+				h.targetErr = fmt.Errorf("gate %d: %w", gate, err)
+				return
+			}
+			h.gateTargets[gate] = t
+		}
+	})
+	return h.targetErr
+}
+
+func parseTarget(raw string) (*target, error) {
+	if strings.Contains(raw, "{{") {
+		tmpl, err := template.New("target").Option("missingkey=error").Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target template: %w", err)
+		}
+		return &target{tmpl: tmpl}, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target: %w", err)
+	}
+	return &target{url: u}, nil
+}
+
+// checkTargets checks that the plain Target and GateTargets are absolute URLs, once parsed.
+func (h *Processor) checkTargets() error {
+	if h.target != nil && h.target.url != nil && !absolute(h.target.url) {
+		return fmt.Errorf("invalid target %q, expected an absolute URL", h.Target)
+	}
+	for gate, t := range h.gateTargets {
+		if t.url != nil && !absolute(t.url) {
+			return fmt.Errorf("invalid target %q for gate %d, expected an absolute URL", h.GateTargets[gate], gate)
+		}
+	}
+	return nil
+}
+
+func absolute(u *url.URL) bool {
+	return u.Scheme != "" && u.Host != ""
+}
+
+// targetURL returns the URL to post the item to, that of its gate if it has one.
+func (h *Processor) targetURL(r *state.ProcessRequest) (string, error) {
+	if err := h.parseTarget(); err != nil {
+		return "", state.NonRetryableError(err.Error())
+	}
+	t, ok := h.gateTargets[r.Gate]
+	if !ok {
+		t = h.target
+	}
+	if t == nil {
+		return "", state.NonRetryableError(fmt.Sprintf("no target for gate %d", r.Gate))
+	}
+	if t.tmpl == nil {
+		return t.url.String(), nil
+	}
+	var b strings.Builder
+	if err := t.tmpl.Execute(&b, r); err != nil {
+		return "", state.NonRetryableError(fmt.Sprintf("error rendering target: %s", err))
+	}
+	u, err := url.Parse(b.String())
+	if err != nil {
+		return "", state.NonRetryableError(fmt.Sprintf("invalid target: %s", err))
+	}
+	if !absolute(u) {
+		return "", state.NonRetryableError(fmt.Sprintf("invalid target %q, expected an absolute URL", b.String()))
+	}
+	return u.String(), nil
+}
+
+func (h *Processor) codec() Codec {
+	if h.Codec == nil {
+		return JSONCodec{}
+	}
+	return h.Codec
 }
 
 func (h *Processor) Process(id string, buf []byte) (*state.ProcessorResponse, error) {
-	resp, err := h.Client.Post(h.Target, "application/json", bytes.NewBuffer(buf))
+	return h.ProcessRequest(context.Background(), &state.ProcessRequest{ID: id, Data: buf})
+}
+
+func (h *Processor) method() string {
+	if h.Method == "" {
+		return http.MethodPost
+	}
+	return h.Method
+}
+
+// encode returns the body of the request, and its content type.
+func (h *Processor) encode(r *state.ProcessRequest) ([]byte, string, error) {
+	var body []byte
+	var contentType string
+	if h.RequestEncoder != nil {
+		reader, t, err := h.RequestEncoder(r.Metadata, r.Data)
+		if err != nil {
+			return nil, "", err
+		}
+		if body, err = io.ReadAll(reader); err != nil {
+			return nil, "", err
+		}
+		contentType = t
+	} else {
+		codec := h.codec()
+		b, err := codec.EncodeRequest(r)
+		if err != nil {
+			return nil, "", err
+		}
+		body, contentType = b, codec.ContentType()
+	}
+	if h.ContentType != "" {
+		contentType = h.ContentType
+	}
+	return body, contentType, nil
+}
+
+// send sends the request body, along with the item's identity, metadata and fence if the
+// client supports headers, compressing it if it is over the GzipThreshold.
+func (h *Processor) send(ctx context.Context, contentType string, body []byte, r *state.ProcessRequest) (*http.Response, error) {
+	target, err := h.targetURL(r)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	method := h.method()
+	doer, ok := h.Client.(HTTPDoer)
+	if !ok {
+		if method != http.MethodPost || len(h.SigningKeys) > 0 {
+			return nil, state.NonRetryableError(fmt.Sprintf("the HTTP client can't send signed or %s requests", method))
+		}
+		h.countRequest(len(body), len(body))
+		return h.Client.Post(target, contentType, bytes.NewReader(body))
+	}
+	wire, encoding, err := h.compress(body)
+	if err != nil {
+		return nil, err
+	}
+	h.countRequest(len(body), len(wire))
+	req, err := h.newRequest(ctx, method, target, wire)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	// The transport only decompresses responses itself when it asks for gzip.
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set(ItemIDHeader, r.ID)
+	req.Header.Set(PartitionIDHeader, r.PartitionID)
+	req.Header.Set(GateHeader, strconv.Itoa(r.Gate))
+	req.Header.Set(RetryCountHeader, strconv.Itoa(r.RetryCount))
+	if len(r.Metadata) > 0 {
+		b, err := json.Marshal(r.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(MetadataHeader, string(b))
+	}
+	if r.Fence != 0 {
+		req.Header.Set(FenceHeader, strconv.FormatInt(r.Fence, 10))
+	}
+	// Continue the watcher's span of the attempt, if it traces them.
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return doer.Do(req)
+}
 
-	respObj := &response{}
-	if err := json.NewDecoder(resp.Body).Decode(respObj); err != nil {
-		return nil, fmt.Errorf("marshal error: %w, from request with HTTP Status: %s", err, resp.Status)
+func (h *Processor) ProcessRequest(ctx context.Context, req *state.ProcessRequest) (*state.ProcessorResponse, error) {
+	codec := h.codec()
+	body, contentType, err := h.encode(req)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding request: %w", err)
+	}
+	resp, err := h.send(ctx, contentType, body, req)
+	if err != nil {
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	if respObj.Error != nil {
-		err = fmt.Errorf("Status %s; message: %s", resp.Status, respObj.Error.Message)
-		if respObj.Error.NoRetry {
+	respBody, err := h.readResponse(resp)
+	if errors.Is(err, ErrResponseTooLarge) && !h.RetryOversizedResponses {
+		return nil, state.NonRetryableError(fmt.Sprintf("error reading response: %s, from request with HTTP Status: %s", err, resp.Status))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %w, from request with HTTP Status: %s", err, resp.Status)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, &state.ThrottledError{Message: resp.Status}
+	}
+	procResp, err := codec.DecodeResponse(respBody)
+	var respErr *ResponseError
+	if errors.As(err, &respErr) {
+		err = fmt.Errorf("Status %s; message: %s", resp.Status, h.truncateError(respErr.Message))
+		if respErr.NoRetry {
 			err = state.NonRetryableError(err.Error())
 		}
 		return nil, err
 	}
+	if err != nil {
+		return nil, fmt.Errorf("marshal error: %w, from request with HTTP Status: %s", err, resp.Status)
+	}
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		return nil, errors.New(resp.Status)
 	}
-	return respObj.procResponse()
+	return procResp, nil
 }
 
+// newRequest returns a request with the body, signed with the SigningKeys if set.
+func (h *Processor) newRequest(ctx context.Context, method, target string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(h.traceConnections(ctx), method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(h.SigningKeys) > 0 {
+		req.Header.Set(SignatureHeader, Sign(h.SigningKeys, time.Now(), body))
+	}
+	return req, nil
+}
+
+// Healthcheck gets the HealthEndpoint of each distinct host of the Target and GateTargets.
+// Templated URLs can't be checked, and are skipped.
 func (h *Processor) Healthcheck(ctx context.Context) error {
 	if h.HealthEndpoint == "" {
 		return nil
 	}
-	resp, err := h.Client.Get(path.Join(h.Target, h.HealthEndpoint))
-	resp.Body.Close()
-	return err
+	if err := h.parseTarget(); err != nil {
+		return err
+	}
+	gates := make([]int, 0, len(h.gateTargets))
+	for gate := range h.gateTargets {
+		gates = append(gates, gate)
+	}
+	sort.Ints(gates)
+	checked := map[string]bool{}
+	check := func(t *target, name string) error {
+		if t == nil || t.tmpl != nil || checked[t.url.Host] {
+			return nil
+		}
+		checked[t.url.Host] = true
+		if err := h.checkHealth(ctx, t.url); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		return nil
+	}
+	if err := check(h.target, "target"); err != nil {
+		return err
+	}
+	for _, gate := range gates {
+		if err := check(h.gateTargets[gate], fmt.Sprintf("gate %d target", gate)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkHealth gets the HealthEndpoint joined to the URL.
+func (h *Processor) checkHealth(ctx context.Context, u *url.URL) error {
+	target := strings.TrimSuffix(u.String(), "/") + "/" + strings.TrimPrefix(h.HealthEndpoint, "/")
+	var resp *http.Response
+	var err error
+	if doer, ok := h.Client.(HTTPDoer); ok {
+		var req *http.Request
+		if req, err = h.newRequest(ctx, http.MethodGet, target, nil); err != nil {
+			return err
+		}
+		resp, err = doer.Do(req)
+	} else {
+		resp, err = h.Client.Get(target)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// The body is drained, up to the MaxResponseBytes, for the connection to be reused.
+	if _, err := io.Copy(io.Discard, h.limit(resp.Body)); err != nil {
+		return fmt.Errorf("error reading health check response: %w", err)
+	}
+	return nil
 }
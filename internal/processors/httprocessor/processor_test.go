@@ -1,13 +1,17 @@
 package httprocessor
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 
 	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
@@ -56,12 +60,33 @@ func TestProcess(t *testing.T) {
 			resp: `{"complete": true, "response": {"data": 1, "more":"json"}}`,
 			want: &state.ProcessorResponse{Data: []byte(`{"data":1,"more":"json"}` + "\n"), Complete: true},
 		},
+		{
+			name: "new items",
+			code: 200,
+			resp: `{"complete": true, "new_items": [{"id": "c1", "data": {"page": 1}}, {"partition_id": "p2", "gate": 2, "priority": 5, "data": [1]}]}`,
+			want: &state.ProcessorResponse{Data: []byte("{}\n"), Complete: true, NewItems: []state.NewItem{
+				{ID: "c1", Data: []byte(`{"page": 1}`)},
+				{PartitionID: "p2", Gate: 2, Priority: 5, Data: []byte(`[1]`)},
+			}},
+		},
 		{
 			name:    "marshaling error",
 			code:    200,
 			resp:    `{"":`,
 			wantErr: fmt.Errorf("marshal error: %w, from request with HTTP Status: HTTP 200", errors.New("unexpected EOF")),
 		},
+		{
+			name:    "float gate",
+			code:    200,
+			resp:    `{"gate": 1.5, "complete": false}`,
+			wantErr: fmt.Errorf("marshal error: %w, from request with HTTP Status: HTTP 200", state.NonRetryableError("invalid gate number 1.5, expected an integer")),
+		},
+		{
+			name:    "string gate",
+			code:    200,
+			resp:    `{"gate": "1", "complete": false}`,
+			wantErr: fmt.Errorf("marshal error: %w, from request with HTTP Status: HTTP 200", state.NonRetryableError("invalid gate string, expected an integer")),
+		},
 		{
 			name:    "empty string",
 			code:    200,
@@ -74,6 +99,12 @@ func TestProcess(t *testing.T) {
 			resp:    "{}",
 			wantErr: errors.New("HTTP 400"),
 		},
+		{
+			name:    "429",
+			code:    429,
+			resp:    "",
+			wantErr: &state.ThrottledError{Message: "HTTP 429"},
+		},
 		{
 			name:    "500",
 			code:    500,
@@ -138,3 +169,167 @@ func TestProcess(t *testing.T) {
 // 	Complete bool
 // 	Data     []byte
 // }
+
+// urlRecordingClient records the URL of each post.
+type urlRecordingClient struct {
+	mockHTTPClient
+	url string
+}
+
+func (c *urlRecordingClient) Post(url, contentType string, body io.Reader) (*http.Response, error) {
+	c.url = url
+	return c.mockHTTPClient.Post(url, contentType, body)
+}
+
+func TestTargetTemplate(t *testing.T) {
+	req := &state.ProcessRequest{ID: "i", PartitionID: "p", Gate: 1, Data: []byte(`{}`),
+		Metadata: state.ItemMetadata{"model": "v2"}, Labels: state.PartitionLabels{"region": "eu"}}
+	for _, tc := range []struct {
+		name    string
+		target  string
+		req     *state.ProcessRequest
+		want    string
+		wantErr bool
+	}{
+		{name: "plain", target: "http://svc/process?a=b", req: req, want: "http://svc/process?a=b"},
+		{name: "templated", target: "https://{{.Labels.region}}.svc/process/{{.PartitionID}}?gate={{.Gate}}&model={{.Metadata.model}}",
+			req: req, want: "https://eu.svc/process/p?gate=1&model=v2"},
+		{name: "missing label", target: "https://{{.Labels.hospital}}.svc/process", req: req, wantErr: true},
+		{name: "unlabelled partition", target: "https://{{.Labels.region}}.svc/process", req: &state.ProcessRequest{ID: "i"}, wantErr: true},
+		{name: "invalid URL", target: "{{.ID}}/process", req: req, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &urlRecordingClient{mockHTTPClient: mockHTTPClient{code: 200, resp: `{"complete": true}`}}
+			p, err := NewProcessor(tc.target, WithClient(client))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = p.ProcessRequest(context.Background(), tc.req)
+			if tc.wantErr {
+				if err == nil || state.IsRetryable(err) || client.url != "" {
+					t.Errorf("expected a non-retryable error without a request, got %v and %q", err, client.url)
+				}
+				return
+			}
+			if err != nil || client.url != tc.want {
+				t.Errorf("expected a request to %s, got %q and %v", tc.want, client.url, err)
+			}
+		})
+	}
+
+	if _, err := NewProcessor("https://{{.Labels.region}.svc"); err == nil {
+		t.Error("expected an invalid template to fail the processor's construction")
+	}
+	// Processors built without NewProcessor fail their items instead.
+	p := &Processor{Client: &mockHTTPClient{code: 200}, Target: "https://{{.Labels.region}.svc"}
+	if _, err := p.ProcessRequest(context.Background(), req); err == nil || state.IsRetryable(err) {
+		t.Errorf("expected an invalid template to fail the item, got %v", err)
+	}
+}
+
+func TestFormEncoder(t *testing.T) {
+	var method, contentType string
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, contentType = r.Method, r.Header.Get("Content-Type")
+		r.ParseForm()
+		form = r.PostForm
+		w.Write([]byte(`{"complete": true}`))
+	}))
+	defer server.Close()
+	p := &Processor{Client: server.Client(), Target: server.URL, Method: http.MethodPut, RequestEncoder: FormEncoder}
+
+	data := []byte(`{"name": "scan", "size": 12345678901234, "study": {"id": "s1", "modality": null}, "tags": ["a", "b"], "urgent": true}`)
+	if _, err := p.ProcessRequest(context.Background(), &state.ProcessRequest{ID: "i", Data: data}); err != nil {
+		t.Fatal(err)
+	}
+	if method != http.MethodPut || contentType != "application/x-www-form-urlencoded" {
+		t.Errorf("expected a PUT of a form, got %s of %s", method, contentType)
+	}
+	want := url.Values{"name": {"scan"}, "size": {"12345678901234"}, "study.id": {"s1"}, "study.modality": {""}, "tags": {"a", "b"}, "urgent": {"true"}}
+	if !reflect.DeepEqual(form, want) {
+		t.Errorf("expected the data flattened to %v, got %v", want, form)
+	}
+
+	// The ContentType overrides the encoder's.
+	p.ContentType = "application/x-www-form-urlencoded; charset=utf-8"
+	if _, err := p.ProcessRequest(context.Background(), &state.ProcessRequest{ID: "i", Data: data}); err != nil {
+		t.Fatal(err)
+	}
+	if contentType != p.ContentType {
+		t.Errorf("expected the content type %s, got %s", p.ContentType, contentType)
+	}
+
+	if _, err := p.ProcessRequest(context.Background(), &state.ProcessRequest{ID: "i", Data: []byte(`[1]`)}); err == nil || state.IsRetryable(err) {
+		t.Errorf("expected data other than an object to fail the item, got %v", err)
+	}
+	// Clients that can't Do only POST.
+	p = &Processor{Client: &mockHTTPClient{code: 200}, Method: http.MethodPut}
+	if _, err := p.ProcessRequest(context.Background(), &state.ProcessRequest{ID: "i", Data: data}); err == nil || state.IsRetryable(err) {
+		t.Errorf("expected a PUT without an HTTPDoer to fail the item, got %v", err)
+	}
+}
+
+func TestGateTargets(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		w.Write([]byte(`{"complete": true}`))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	other := httptest.NewServer(handler)
+	defer other.Close()
+
+	p, err := NewProcessor(server.URL+"/process", WithGateTargets(map[int]string{
+		0: server.URL + "/validate",
+		1: server.URL + "/transform",
+		2: server.URL + "/publish",
+		4: other.URL + "/{{.PartitionID}}",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for gate := 0; gate < 5; gate++ {
+		if _, err := p.ProcessRequest(context.Background(), &state.ProcessRequest{ID: "i", PartitionID: "p", Gate: gate, Data: []byte(`{}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []string{"/validate", "/transform", "/publish", "/process", "/p"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("expected requests to %v, got %v", want, paths)
+	}
+
+	// Each host is checked once, joined to its first plain URL.
+	paths = nil
+	p.HealthEndpoint = "/health"
+	if err := p.Healthcheck(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/process/health"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("expected health checks of %v, got %v", want, paths)
+	}
+	p.GateTargets[3] = other.URL + "/archive"
+	p = &Processor{Client: server.Client(), GateTargets: p.GateTargets, HealthEndpoint: "/health"}
+	paths = nil
+	if err := p.Healthcheck(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/validate/health", "/archive/health"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("expected health checks of %v, got %v", want, paths)
+	}
+	if _, err := p.ProcessRequest(context.Background(), &state.ProcessRequest{ID: "i", Gate: 5}); err == nil || state.IsRetryable(err) {
+		t.Errorf("expected an unmapped gate without a Target to fail the item, got %v", err)
+	}
+
+	for name, targets := range map[string]map[int]string{
+		"relative URL":     {1: "/transform"},
+		"invalid template": {1: "{{.Labels.region}.svc"},
+	} {
+		if _, err := NewProcessor(server.URL, WithGateTargets(targets)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
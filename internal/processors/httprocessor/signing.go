@@ -0,0 +1,117 @@
+package httprocessor
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureHeader holds the signatures of a request made with the processor's SigningKeys, of
+// the form t=<unix time>,v1=<hex signature>, with a v1 signature for each key. Each signature
+// is the HMAC-SHA256 of the time, a dot, and the request's body, under the key's secret.
+const SignatureHeader = "X-Signature"
+
+// DefaultSignatureTolerance is how old, or far in the future, a signature may be by default
+// when it is verified, to limit replays.
+var DefaultSignatureTolerance = 5 * time.Minute
+
+var (
+	// ErrInvalidSignature is returned by VerifySignature for a malformed signature header.
+	ErrInvalidSignature = errors.New("invalid signature header")
+	// ErrSignatureExpired is returned by VerifySignature for a signature made outside the
+	// tolerance of now.
+	ErrSignatureExpired = errors.New("signature expired")
+	// ErrSignatureMismatch is returned by VerifySignature when no signature matches any of
+	// the keys, e.g. because the body was tampered with.
+	ErrSignatureMismatch = errors.New("signature mismatch")
+)
+
+// SigningKey is a secret shared with the target to sign requests with. Rotate keys by
+// signing with both the old and new key until the target has moved to the new one.
+type SigningKey struct {
+	// ID names the key, and is returned by VerifySignature for the key that matched.
+	ID     string
+	Secret []byte
+}
+
+func (k SigningKey) sign(t string, body []byte) string {
+	mac := hmac.New(sha256.New, k.Secret)
+	mac.Write([]byte(t))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns the SignatureHeader of the body, signed at t with each of the keys.
+func Sign(keys []SigningKey, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	parts := []string{"t=" + ts}
+	for _, k := range keys {
+		parts = append(parts, "v1="+k.sign(ts, body))
+	}
+	return strings.Join(parts, ",")
+}
+
+// VerifySignature checks the SignatureHeader of the body against the keys, returning the ID
+// of the first key that signed it. Signatures made further than the tolerance from now are
+// rejected, see DefaultSignatureTolerance.
+func VerifySignature(header string, body []byte, keys []SigningKey, tolerance time.Duration, now time.Time) (string, error) {
+	var ts string
+	var signatures [][]byte
+	for _, part := range strings.Split(header, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return "", ErrInvalidSignature
+		}
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sig, err := hex.DecodeString(v)
+			if err != nil {
+				return "", ErrInvalidSignature
+			}
+			signatures = append(signatures, sig)
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return "", ErrInvalidSignature
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+		return "", fmt.Errorf("%w: signed %s ago", ErrSignatureExpired, age.Round(time.Second))
+	}
+	for _, k := range keys {
+		want, _ := hex.DecodeString(k.sign(ts, body))
+		for _, sig := range signatures {
+			if hmac.Equal(sig, want) {
+				return k.ID, nil
+			}
+		}
+	}
+	return "", ErrSignatureMismatch
+}
+
+// VerifyRequest checks the signature of the request received by a handler, see
+// VerifySignature, within the DefaultSignatureTolerance. It reads the request's body, which
+// is then replaced so that the handler can read it again.
+func VerifyRequest(r *http.Request, keys []SigningKey) (string, error) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = io.ReadAll(r.Body); err != nil {
+			return "", err
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	return VerifySignature(r.Header.Get(SignatureHeader), body, keys, DefaultSignatureTolerance, time.Now())
+}
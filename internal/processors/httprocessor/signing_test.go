@@ -0,0 +1,112 @@
+package httprocessor
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+)
+
+var (
+	oldKey = SigningKey{ID: "old", Secret: []byte("old secret")}
+	newKey = SigningKey{ID: "new", Secret: []byte("new secret")}
+)
+
+func TestSign(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"a":1}`)
+	header := Sign([]SigningKey{oldKey, newKey}, now, body)
+	if !regexp.MustCompile(`^t=1700000000,v1=[0-9a-f]{64},v1=[0-9a-f]{64}$`).MatchString(header) {
+		t.Fatalf("unexpected signature header %s", header)
+	}
+	if header != Sign([]SigningKey{oldKey, newKey}, now, body) {
+		t.Error("expected signatures to be deterministic")
+	}
+
+	// While keys rotate, either key verifies the signature.
+	for _, keys := range [][]SigningKey{{oldKey}, {newKey}, {newKey, oldKey}} {
+		id, err := VerifySignature(header, body, keys, time.Minute, now.Add(time.Second))
+		if err != nil || id != keys[0].ID {
+			t.Errorf("expected key %s to verify the signature, got %q and %v", keys[0].ID, id, err)
+		}
+	}
+	if _, err := VerifySignature(header, body, []SigningKey{{ID: "other", Secret: []byte("other")}}, time.Minute, now); !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("expected an unknown key not to verify, got %v", err)
+	}
+}
+
+func TestVerifySignatureTampering(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"a":1}`)
+	header := Sign([]SigningKey{newKey}, now, body)
+	keys := []SigningKey{newKey}
+	// The last digit of the signature, changed.
+	tampered := header[:len(header)-1] + "0"
+	if strings.HasSuffix(header, "0") {
+		tampered = header[:len(header)-1] + "1"
+	}
+	for _, tc := range []struct {
+		name   string
+		header string
+		body   string
+		now    time.Time
+		want   error
+	}{
+		{"body", header, `{"a":2}`, now, ErrSignatureMismatch},
+		{"timestamp", strings.Replace(header, "t=1700000000", "t=1700000001", 1), string(body), now, ErrSignatureMismatch},
+		{"signature", tampered, string(body), now, ErrSignatureMismatch},
+		{"expired", header, string(body), now.Add(time.Hour), ErrSignatureExpired},
+		{"future", header, string(body), now.Add(-time.Hour), ErrSignatureExpired},
+		{"missing", "", string(body), now, ErrInvalidSignature},
+		{"no signatures", "t=1700000000", string(body), now, ErrInvalidSignature},
+		{"malformed", "t=1700000000,v1=zz", string(body), now, ErrInvalidSignature},
+	} {
+		if _, err := VerifySignature(tc.header, []byte(tc.body), keys, time.Minute, tc.now); !errors.Is(err, tc.want) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestSignedRequests(t *testing.T) {
+	var verified []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := VerifyRequest(r, []SigningKey{newKey})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		// The handler can still read the body.
+		body, _ := io.ReadAll(r.Body)
+		verified = append(verified, r.Method+" "+id+" "+string(body))
+		w.Write([]byte(`{"complete": true}`))
+	}))
+	defer server.Close()
+
+	p, err := NewProcessor(server.URL, WithSigningKeys(oldKey, newKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.HealthEndpoint = "/health"
+	if _, err := p.ProcessRequest(context.Background(), &state.ProcessRequest{ID: "i", Data: []byte(`{"a":1}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Healthcheck(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{`POST new {"a":1}`, "GET new "}; strings.Join(verified, "|") != strings.Join(want, "|") {
+		t.Errorf("expected both requests to be verified with the new key, got %q", verified)
+	}
+
+	// Requests signed with retired keys only are rejected.
+	p.SigningKeys = []SigningKey{oldKey}
+	if _, err := p.ProcessRequest(context.Background(), &state.ProcessRequest{ID: "i", Data: []byte(`{}`)}); err == nil {
+		t.Error("expected a request signed with a retired key to be rejected")
+	}
+}
@@ -0,0 +1,69 @@
+//go:build integration
+
+package pubprocessor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state/statetest"
+)
+
+// TestWatcher runs a watcher publishing a partition's items, run with -tags integration.
+func TestWatcher(t *testing.T) {
+	repo := statetest.NewSQLiteRepo(t)
+	ctx := context.Background()
+	const items = 20
+	repo.Save(ctx, &state.Partition{BaseModel: state.BaseModel{ID: "p"}})
+	for n := 0; n < items; n++ {
+		repo.Save(ctx, &state.Item{BaseModel: state.BaseModel{ID: fmt.Sprint(n)}, PartitionID: "p", Data: []byte(fmt.Sprintf(`{"n": %d}`, n))})
+	}
+
+	pub := &MemoryPublisher{Delay: time.Millisecond}
+	w := &state.Watcher{
+		Processor:     &Processor{Publisher: pub},
+		Repo:          repo,
+		BatchSize:     4,
+		PollInterval:  10 * time.Millisecond,
+		LeaseInterval: 10 * time.Millisecond,
+		AutoClose:     true,
+	}
+	events := w.Events()
+	wctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	done := make(chan struct{})
+	go func() {
+		w.Start(wctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	completed := false
+	for e := range events {
+		if e.Type == state.PartitionCompleted && e.PartitionID == "p" {
+			completed = true
+			break
+		}
+	}
+	if !completed {
+		t.Fatal("partition did not complete")
+	}
+
+	published := map[string]string{}
+	for _, m := range pub.Messages() {
+		published[m.Key] = string(m.Value)
+	}
+	for n := 0; n < items; n++ {
+		id := fmt.Sprint(n)
+		if want := fmt.Sprintf(`{"n": %d}`, n); published[id] != want {
+			t.Errorf("expected item %s to be published as %s, got %q", id, want, published[id])
+		}
+		if i, err := repo.GetItem(ctx, id); err != nil || i.Status != state.Complete {
+			t.Errorf("expected item %s to be complete, got %+v and %v", id, i, err)
+		}
+	}
+}
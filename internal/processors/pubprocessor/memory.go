@@ -0,0 +1,53 @@
+package pubprocessor
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Message is a message published to a MemoryPublisher.
+type Message struct {
+	Key   string
+	Value []byte
+}
+
+// MemoryPublisher keeps the messages published in memory, for tests.
+type MemoryPublisher struct {
+	// Err, if set, fails every publish and ping.
+	Err error
+	// Delay, if set, is how long each publish waits before it is acknowledged, failing with
+	// the context's error if it is done first.
+	Delay time.Duration
+
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (m *MemoryPublisher) Publish(ctx context.Context, key string, value []byte) error {
+	if m.Delay > 0 {
+		select {
+		case <-time.After(m.Delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if m.Err != nil {
+		return m.Err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, Message{Key: key, Value: append([]byte(nil), value...)})
+	return nil
+}
+
+func (m *MemoryPublisher) Ping(ctx context.Context) error {
+	return m.Err
+}
+
+// Messages returns the messages published, in order.
+func (m *MemoryPublisher) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
@@ -0,0 +1,139 @@
+// Package pubprocessor processes items by publishing them to a topic of a message broker, e.g.
+// Kafka or NATS, rather than returning their results synchronously. Items are keyed by their
+// ID, and only complete once the broker acknowledged them.
+//
+// The Publisher is kept narrow so that adapters for broker clients are a few lines. With
+// github.com/segmentio/kafka-go, a Writer with RequiredAcks set to kafka.RequireAll, and Async
+// left false, returns once the message is acknowledged:
+//
+//	type kafkaPublisher struct {
+//		w    *kafka.Writer
+//		addr string
+//	}
+//
+//	func (p kafkaPublisher) Publish(ctx context.Context, key string, value []byte) error {
+//		return p.w.WriteMessages(ctx, kafka.Message{Key: []byte(key), Value: value})
+//	}
+//
+//	func (p kafkaPublisher) Ping(ctx context.Context) error {
+//		conn, err := kafka.DialContext(ctx, "tcp", p.addr)
+//		if err != nil {
+//			return err
+//		}
+//		return conn.Close()
+//	}
+//
+// With github.com/nats-io/nats.go, core NATS doesn't acknowledge messages, so publish to a
+// JetStream stream instead, whose Msg-Id header also discards the duplicates of retries:
+//
+//	type natsPublisher struct {
+//		nc      *nats.Conn
+//		js      nats.JetStreamContext
+//		subject string
+//	}
+//
+//	func (p natsPublisher) Publish(ctx context.Context, key string, value []byte) error {
+//		msg := &nats.Msg{Subject: p.subject, Data: value, Header: nats.Header{}}
+//		msg.Header.Set(nats.MsgIdHdr, key)
+//		_, err := p.js.PublishMsg(msg, nats.Context(ctx))
+//		return err
+//	}
+//
+//	func (p natsPublisher) Ping(ctx context.Context) error {
+//		return p.nc.FlushWithContext(ctx)
+//	}
+package pubprocessor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+)
+
+// DefaultTimeout is how long a publish may wait for its acknowledgement, by default.
+var DefaultTimeout = 10 * time.Second
+
+// Publisher publishes messages to a topic.
+type Publisher interface {
+	// Publish returns once the broker acknowledged the message. Messages may be published
+	// again when the item is retried, so consumers must tolerate duplicates of a key.
+	Publish(ctx context.Context, key string, value []byte) error
+}
+
+// Pinger is optionally implemented by Publishers to check that the broker is reachable.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Transform returns the message to publish for the item. Its errors fail the attempt, and
+// may be a state.NonRetryableError to fail the item.
+type Transform func(ctx context.Context, req *state.ProcessRequest) ([]byte, error)
+
+// Processor publishes each item's message, keyed by the item's ID, completing the item once
+// the message is acknowledged.
+type Processor struct {
+	Publisher Publisher
+	// Transform, if set, returns the message to publish in place of the item's data.
+	Transform Transform
+	// Timeout bounds each publish, and each ping of the health check. Publishes timing out
+	// are retried. Defaults to DefaultTimeout.
+	Timeout time.Duration
+}
+
+func (p *Processor) timeout() time.Duration {
+	if p.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return p.Timeout
+}
+
+func (p *Processor) Process(id string, b []byte) (*state.ProcessorResponse, error) {
+	return p.ProcessRequest(context.Background(), &state.ProcessRequest{ID: id, Data: b})
+}
+
+// ProcessRequest publishes the item's message, and completes the item with it as its data.
+func (p *Processor) ProcessRequest(ctx context.Context, req *state.ProcessRequest) (*state.ProcessorResponse, error) {
+	value := req.Data
+	if p.Transform != nil {
+		var err error
+		if value, err = p.Transform(ctx, req); err != nil {
+			return nil, fmt.Errorf("error transforming item: %w", err)
+		}
+	}
+	pctx, cancel := context.WithTimeout(ctx, p.timeout())
+	defer cancel()
+	if err := p.Publisher.Publish(pctx, req.ID, value); err != nil {
+		if timedOut(err) {
+			// The broker may have received the message regardless, which consumers see
+			// again once the item is retried.
+			return nil, fmt.Errorf("publish not acknowledged within %s: %s", p.timeout(), err)
+		}
+		return nil, fmt.Errorf("error publishing item: %w", err)
+	}
+	return &state.ProcessorResponse{Complete: true, Data: value}, nil
+}
+
+// timedOut returns whether the error is that of a publish timing out, which adapters may
+// report with the context's error, or a net.Error of their own.
+func timedOut(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// Healthcheck pings the broker, if the Publisher is a Pinger.
+func (p *Processor) Healthcheck(ctx context.Context) error {
+	pinger, ok := p.Publisher.(Pinger)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.timeout())
+	defer cancel()
+	if err := pinger.Ping(ctx); err != nil {
+		return fmt.Errorf("error pinging the broker: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package pubprocessor
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+)
+
+func TestProcess(t *testing.T) {
+	pub := &MemoryPublisher{}
+	p := &Processor{Publisher: pub}
+	resp, err := p.ProcessRequest(context.Background(), &state.ProcessRequest{ID: "i", Data: []byte(`{"a": 1}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Complete || string(resp.Data) != `{"a": 1}` {
+		t.Errorf("expected the item to complete with its data, got %+v", resp)
+	}
+	if msgs := pub.Messages(); len(msgs) != 1 || msgs[0].Key != "i" || string(msgs[0].Value) != `{"a": 1}` {
+		t.Errorf("expected the item's data to be published keyed by its ID, got %v", msgs)
+	}
+
+	p.Transform = func(ctx context.Context, req *state.ProcessRequest) ([]byte, error) {
+		return []byte(strings.ToUpper(string(req.Data))), nil
+	}
+	if resp, err = p.Process("j", []byte("abc")); err != nil || string(resp.Data) != "ABC" {
+		t.Errorf("expected the transformed message, got %+v and %v", resp, err)
+	}
+	if msgs := pub.Messages(); len(msgs) != 2 || string(msgs[1].Value) != "ABC" {
+		t.Errorf("expected the transformed message to be published, got %v", msgs)
+	}
+	p.Transform = func(ctx context.Context, req *state.ProcessRequest) ([]byte, error) {
+		return nil, state.NonRetryableError("bad item")
+	}
+	if _, err := p.Process("k", nil); err == nil || state.IsRetryable(err) {
+		t.Errorf("expected the transform's error to fail the item, got %v", err)
+	}
+}
+
+func TestPublishErrors(t *testing.T) {
+	pub := &MemoryPublisher{Delay: time.Second}
+	p := &Processor{Publisher: pub, Timeout: 10 * time.Millisecond}
+	_, err := p.Process("i", nil)
+	if err == nil || !state.IsRetryable(err) || !strings.Contains(err.Error(), "not acknowledged") {
+		t.Errorf("expected a retryable timeout, got %v", err)
+	}
+	if len(pub.Messages()) != 0 {
+		t.Error("expected no message to be published")
+	}
+
+	pub.Delay, pub.Err = 0, errors.New("broker down")
+	if _, err := p.Process("i", nil); err == nil || !errors.Is(err, pub.Err) {
+		t.Errorf("expected the publish error, got %v", err)
+	}
+	if err := p.Healthcheck(context.Background()); err == nil || !errors.Is(err, pub.Err) {
+		t.Errorf("expected the ping to fail the health check, got %v", err)
+	}
+	pub.Err = nil
+	if err := p.Healthcheck(context.Background()); err != nil {
+		t.Errorf("expected a healthy broker, got %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package state
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// DefaultAdaptiveWindow is the number of attempts an AdaptiveBatch measures, by default.
+	DefaultAdaptiveWindow = 20
+	// DefaultAdaptiveMaxErrorRate is the fraction of failed attempts over which an
+	// AdaptiveBatch decreases its limit, by default.
+	DefaultAdaptiveMaxErrorRate = 0.05
+	// DefaultAdaptiveDecreaseFactor is the factor an AdaptiveBatch multiplies its limit by as
+	// it decreases it, by default.
+	DefaultAdaptiveDecreaseFactor = 0.5
+)
+
+// AdaptiveBatch adjusts the number of items a watcher processes at once to what its processor's
+// target can take, with additive increase and multiplicative decrease (AIMD). The limit starts
+// at MinBatch, and is measured against the latency and errors of the latest Window attempts,
+// once all of them were made at the current limit: it grows by 1 while their 95th percentile
+// latency is within TargetLatency and their error rate within MaxErrorRate, up to MaxBatch, and
+// is multiplied by DecreaseFactor, down to MinBatch, as soon as either is exceeded.
+type AdaptiveBatch struct {
+	// MinBatch and MaxBatch bound the limit, which is adjusted only if MaxBatch is set.
+	// MinBatch defaults to 1.
+	MinBatch int
+	MaxBatch int
+	// TargetLatency is the 95th percentile latency of the processor's calls past which the
+	// limit decreases. Latency isn't checked if unset.
+	TargetLatency time.Duration
+	// MaxErrorRate is the fraction of failed or throttled attempts past which the limit
+	// decreases. Defaults to DefaultAdaptiveMaxErrorRate.
+	MaxErrorRate float64
+	// Window is the number of the latest attempts measured. Defaults to DefaultAdaptiveWindow.
+	Window int
+	// DecreaseFactor defaults to DefaultAdaptiveDecreaseFactor.
+	DecreaseFactor float64
+}
+
+// enabled returns whether the limit is adjusted.
+func (a AdaptiveBatch) enabled() bool {
+	return a.MaxBatch > 0
+}
+
+// batchSample is the measurement of an attempt.
+type batchSample struct {
+	latency time.Duration
+	failed  bool
+}
+
+// batchController adjusts the limit of an AdaptiveBatch from the attempts observed. It is safe
+// for concurrent use.
+type batchController struct {
+	cfg AdaptiveBatch
+	mu  sync.Mutex
+	// limit is the current limit, and fresh the number of attempts observed since it was set.
+	limit int
+	fresh int
+	// samples is the ring of the latest attempts, next the position of the next one.
+	samples []batchSample
+	next    int
+}
+
+// newBatchController returns the controller of the AdaptiveBatch, with its defaults set.
+func newBatchController(cfg AdaptiveBatch) *batchController {
+	if cfg.MinBatch <= 0 {
+		cfg.MinBatch = 1
+	}
+	if cfg.MaxBatch < cfg.MinBatch {
+		cfg.MaxBatch = cfg.MinBatch
+	}
+	if cfg.MaxErrorRate == 0 {
+		cfg.MaxErrorRate = DefaultAdaptiveMaxErrorRate
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = DefaultAdaptiveWindow
+	}
+	if cfg.DecreaseFactor <= 0 || cfg.DecreaseFactor >= 1 {
+		cfg.DecreaseFactor = DefaultAdaptiveDecreaseFactor
+	}
+	return &batchController{cfg: cfg, limit: cfg.MinBatch}
+}
+
+// current returns the current limit.
+func (c *batchController) current() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.limit
+}
+
+// observe records an attempt, and returns the limit before and after adjusting it.
+func (c *batchController) observe(latency time.Duration, failed bool) (from, to int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sample := batchSample{latency: latency, failed: failed}
+	if len(c.samples) < c.cfg.Window {
+		c.samples = append(c.samples, sample)
+	} else {
+		c.samples[c.next] = sample
+	}
+	c.next = (c.next + 1) % c.cfg.Window
+	c.fresh++
+	from = c.limit
+	if c.fresh < c.cfg.Window {
+		return from, from
+	}
+	to = from
+	if c.breached() {
+		to = int(float64(from) * c.cfg.DecreaseFactor)
+		if to < c.cfg.MinBatch {
+			to = c.cfg.MinBatch
+		}
+	} else if from < c.cfg.MaxBatch {
+		to = from + 1
+	}
+	if to != from {
+		c.limit, c.fresh = to, 0
+	}
+	return from, to
+}
+
+// breached returns whether the attempts in the window exceed the MaxErrorRate or
+// TargetLatency. Must be called with mu held.
+func (c *batchController) breached() bool {
+	failed := 0
+	latencies := make([]time.Duration, len(c.samples))
+	for n, s := range c.samples {
+		latencies[n] = s.latency
+		if s.failed {
+			failed++
+		}
+	}
+	if float64(failed)/float64(len(c.samples)) > c.cfg.MaxErrorRate {
+		return true
+	}
+	if c.cfg.TargetLatency <= 0 {
+		return false
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	p95 := latencies[int(math.Ceil(0.95*float64(len(latencies))))-1]
+	return p95 > c.cfg.TargetLatency
+}
+
+// batchLimit returns the number of items the watcher processes at once: the current limit of
+// its AdaptiveBatch, or its BatchSize.
+func (w *Watcher) batchLimit() int {
+	if w.batch == nil {
+		return w.BatchSize
+	}
+	return w.batch.current()
+}
+
+// observeAttempt feeds an attempt of the processor to the watcher's AdaptiveBatch, if any,
+// applying and reporting the changes of its limit.
+func (w *Watcher) observeAttempt(latency time.Duration, failed bool) {
+	if w.batch == nil {
+		return
+	}
+	from, to := w.batch.observe(latency, failed)
+	if from == to {
+		return
+	}
+	glog.Infof("adjusting the batch limit of watcher %s from %d to %d", w.OwnerID, from, to)
+	w.dispatch.setLimit(to)
+	w.metrics().Gauge(MetricBatchLimit, float64(to), nil)
+	w.emit(Event{Type: BatchLimitChanged, Count: to})
+}
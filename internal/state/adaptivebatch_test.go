@@ -0,0 +1,139 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// step is an attempt fed to a batchController, and the limit expected after it.
+type step struct {
+	latency time.Duration
+	failed  bool
+	want    int
+}
+
+// repeat returns n steps of the attempt, the limit expected after the last one.
+func repeat(n int, latency time.Duration, failed bool, want ...int) []step {
+	steps := make([]step, n)
+	for i := range steps {
+		steps[i] = step{latency: latency, failed: failed, want: -1}
+	}
+	if len(want) > 0 {
+		steps[n-1].want = want[0]
+	}
+	return steps
+}
+
+func TestBatchController(t *testing.T) {
+	cfg := AdaptiveBatch{MinBatch: 2, MaxBatch: 5, TargetLatency: 100 * time.Millisecond, MaxErrorRate: 0.25, Window: 4}
+	fast, slow := 10*time.Millisecond, time.Second
+	tests := []struct {
+		name  string
+		steps [][]step
+	}{{
+		name: "additive increase up to the max",
+		steps: [][]step{
+			repeat(3, fast, false, 2),
+			repeat(1, fast, false, 3),
+			repeat(4, fast, false, 4),
+			repeat(4, fast, false, 5),
+			repeat(8, fast, false, 5),
+		},
+	}, {
+		name: "multiplicative decrease on latency within the window",
+		steps: [][]step{
+			repeat(16, fast, false, 5),
+			// The window slides once at the max: a single slow attempt is its 95th percentile.
+			repeat(1, slow, false, 2),
+			// The next decision waits for a window of attempts at the new limit.
+			repeat(3, fast, false, 2),
+			repeat(1, fast, false, 3),
+		},
+	}, {
+		name: "errors within the max error rate",
+		steps: [][]step{
+			repeat(3, fast, false),
+			repeat(1, fast, true, 3),
+		},
+	}, {
+		name: "multiplicative decrease on errors down to the min",
+		steps: [][]step{
+			repeat(16, fast, false, 5),
+			repeat(1, fast, true, 5),
+			repeat(1, fast, true, 2),
+			repeat(4, fast, true, 2),
+			repeat(4, slow, false, 2),
+		},
+	}, {
+		name: "latency within the target",
+		steps: [][]step{
+			repeat(4, cfg.TargetLatency, false, 3),
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newBatchController(cfg)
+			if got := c.current(); got != cfg.MinBatch {
+				t.Fatalf("expected to start at the min batch %d, got %d", cfg.MinBatch, got)
+			}
+			n := 0
+			for _, steps := range tt.steps {
+				for _, s := range steps {
+					n++
+					from, to := c.observe(s.latency, s.failed)
+					if to != c.current() {
+						t.Fatalf("attempt %d: expected the limit %d to be returned, got %d", n, c.current(), to)
+					}
+					if s.want >= 0 && to != s.want {
+						t.Fatalf("attempt %d: expected the limit to go from %d to %d, got %d", n, from, s.want, to)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestBatchControllerDefaults(t *testing.T) {
+	c := newBatchController(AdaptiveBatch{MaxBatch: 10})
+	if c.current() != 1 || c.cfg.Window != DefaultAdaptiveWindow || c.cfg.MaxErrorRate != DefaultAdaptiveMaxErrorRate ||
+		c.cfg.DecreaseFactor != DefaultAdaptiveDecreaseFactor {
+		t.Errorf("unexpected defaults %+v, starting at %d", c.cfg, c.current())
+	}
+}
+
+func TestWatcherAdaptiveBatch(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	if err := r.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: "p"}}); err != nil {
+		t.Fatal(err)
+	}
+	items := testItems("p", 10)
+	for _, i := range items {
+		i.Data = []byte(`{"times": 1}`)
+	}
+	if err := r.CreateItems(ctx, items...); err != nil {
+		t.Fatal(err)
+	}
+	proc := &concurrencyProcessor{}
+	w := &Watcher{Processor: proc, Repo: r, PollInterval: 5 * time.Millisecond, AutoClose: true,
+		AdaptiveBatch: AdaptiveBatch{MaxBatch: 3, Window: 2}}
+	events := runForEvents(t, r, w)
+
+	var limits []int
+	for _, e := range events {
+		if e.Type == BatchLimitChanged {
+			limits = append(limits, e.Count)
+		}
+	}
+	if fmt.Sprint(limits) != "[2 3]" {
+		t.Errorf("expected the limit to increase to 2, then 3, got %v", limits)
+	}
+	if got := w.Stats().BatchLimit; got != 3 || w.BatchSize != 3 {
+		t.Errorf("expected a batch limit of 3 up to a batch size of 3, got %d up to %d", got, w.BatchSize)
+	}
+	if proc.max["p"] > 3 {
+		t.Errorf("expected up to 3 items in flight at once, got %d", proc.max["p"])
+	}
+}
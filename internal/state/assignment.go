@@ -0,0 +1,132 @@
+package state
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// DefaultHashRingReplicas is the number of points each owner has on a HashRing.
+var DefaultHashRingReplicas = 64
+
+// AssignmentStrategy decides which partitions each watcher leases, so that their leases
+// don't move back and forth between watchers.
+type AssignmentStrategy interface {
+	// Assigned returns whether the partition is assigned to the owner. The live owners are
+	// those registered in the owners table with recent heartbeats, including the owner.
+	Assigned(partitionID, owner string, live []string) bool
+}
+
+// Greedy assigns every partition to every watcher, which lease whichever partitions they
+// find available first. It is the default.
+type Greedy struct{}
+
+// Assigned always returns true.
+func (Greedy) Assigned(string, string, []string) bool { return true }
+
+// HashRing assigns each partition to a single live owner by consistent hashing, so that an
+// owner joining or leaving moves only the partitions of its own range. Every watcher
+// registered in the owners table must lease with the same HashRing settings and Selector,
+// or the partitions assigned to the others are never leased.
+type HashRing struct {
+	// Replicas is the number of points each owner has on the ring, evening out their ranges.
+	// Defaults to DefaultHashRingReplicas.
+	Replicas int
+
+	mu sync.Mutex
+	// owners are those the ring was built for, joined.
+	owners string
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash  uint64
+	owner string
+}
+
+// Assigned returns whether the partition is assigned to the owner.
+func (r *HashRing) Assigned(partitionID, owner string, live []string) bool {
+	points := r.ring(live)
+	if len(points) == 0 {
+		return true
+	}
+	h := ringHash(partitionID)
+	i := sort.Search(len(points), func(i int) bool { return points[i].hash >= h })
+	if i == len(points) {
+		i = 0
+	}
+	return points[i].owner == owner
+}
+
+// ring returns the points of the live owners, sorted by hash.
+func (r *HashRing) ring(live []string) []ringPoint {
+	live = append([]string(nil), live...)
+	sort.Strings(live)
+	key := strings.Join(live, "\x00")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if key == r.owners && r.points != nil {
+		return r.points
+	}
+	replicas := r.Replicas
+	if replicas <= 0 {
+		replicas = DefaultHashRingReplicas
+	}
+	points := make([]ringPoint, 0, len(live)*replicas)
+	for _, owner := range live {
+		for i := 0; i < replicas; i++ {
+			points = append(points, ringPoint{hash: ringHash(owner + "#" + strconv.Itoa(i)), owner: owner})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+	r.owners, r.points = key, points
+	return points
+}
+
+func ringHash(s string) uint64 {
+	h := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint64(h[:8])
+}
+
+// assign returns the partitions assigned to the watcher among those available for lease, and
+// hands over the leased partitions now assigned to other owners, e.g. ones that joined since.
+func (w *Watcher) assign(ctx context.Context, partitions []*Partition) []*Partition {
+	if w.Assignment == nil {
+		return partitions
+	}
+	owners, err := w.Repo.ListOwners(ctx)
+	if err != nil {
+		glog.Errorf("error listing owners to assign partitions: %s", err)
+		return nil
+	}
+	// The watcher counts itself live even before its first heartbeat is saved.
+	live := []string{w.OwnerID}
+	for _, o := range owners {
+		if !o.Dead && o.OwnerID != w.OwnerID {
+			live = append(live, o.OwnerID)
+		}
+	}
+
+	w.mu.Lock()
+	for id, handOver := range w.handOvers {
+		if !w.Assignment.Assigned(id, w.OwnerID, live) {
+			glog.Infof("partition %s is assigned to another owner, handing it over", id)
+			handOver()
+		}
+	}
+	w.mu.Unlock()
+
+	assigned := partitions[:0]
+	for _, p := range partitions {
+		if w.Assignment.Assigned(p.ID, w.OwnerID, live) {
+			assigned = append(assigned, p)
+		}
+	}
+	return assigned
+}
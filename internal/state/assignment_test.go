@@ -0,0 +1,175 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// assignments returns the owner each of n partitions is assigned to, failing unless it is
+// exactly one of the live owners.
+func assignments(t *testing.T, s AssignmentStrategy, n int, live ...string) map[string]string {
+	t.Helper()
+	out := map[string]string{}
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("p%d", i)
+		for _, owner := range live {
+			if s.Assigned(id, owner, live) {
+				if out[id] != "" {
+					t.Fatalf("expected %s to be assigned to a single owner, got %s and %s", id, out[id], owner)
+				}
+				out[id] = owner
+			}
+		}
+		if out[id] == "" {
+			t.Fatalf("expected %s to be assigned", id)
+		}
+	}
+	return out
+}
+
+func TestHashRing(t *testing.T) {
+	const n = 1000
+	ring := &HashRing{}
+	three := assignments(t, ring, n, "a", "b", "c")
+	counts := map[string]int{}
+	for _, owner := range three {
+		counts[owner]++
+	}
+	for _, owner := range []string{"a", "b", "c"} {
+		if counts[owner] < n/5 || counts[owner] > n/2 {
+			t.Errorf("expected the partitions to be spread evenly, got %v", counts)
+		}
+	}
+	if again := assignments(t, &HashRing{}, n, "c", "a", "b"); fmt.Sprint(again) != fmt.Sprint(three) {
+		t.Error("expected the assignment not to depend on the ring or the order of the owners")
+	}
+
+	// Only partitions of the joining owner move.
+	four := assignments(t, ring, n, "a", "b", "c", "d")
+	moved := 0
+	for id, owner := range four {
+		if owner != three[id] {
+			moved++
+			if owner != "d" {
+				t.Errorf("expected %s to stay with %s or move to d, got %s", id, three[id], owner)
+			}
+		}
+	}
+	if moved == 0 || moved > n*2/5 {
+		t.Errorf("expected about a quarter of the partitions to move to d, got %d", moved)
+	}
+
+	// Only partitions of the leaving owner move.
+	for id, owner := range assignments(t, ring, n, "a", "c", "d") {
+		if four[id] != "b" && owner != four[id] {
+			t.Errorf("expected %s to stay with %s, got %s", id, four[id], owner)
+		}
+	}
+}
+
+func TestGreedy(t *testing.T) {
+	if !(Greedy{}).Assigned("p", "a", []string{"a", "b"}) || !(Greedy{}).Assigned("p", "b", []string{"a", "b"}) {
+		t.Error("expected every partition to be assigned to every owner")
+	}
+}
+
+func TestWatcherHashRing(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	ring := &HashRing{}
+	var mine, theirs []string
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("p%d", i)
+		r.Save(ctx, &Partition{BaseModel: BaseModel{ID: id}})
+		r.Save(ctx, &Item{BaseModel: BaseModel{ID: id + "_i"}, PartitionID: id, Status: Available, Data: []byte(`{"times": 1}`)})
+		if ring.Assigned(id, "w1", []string{"w1", "w2"}) {
+			mine = append(mine, id)
+		} else {
+			theirs = append(theirs, id)
+		}
+	}
+	if len(mine) == 0 || len(theirs) == 0 {
+		t.Fatalf("expected the partitions to be split between the owners, got %v and %v", mine, theirs)
+	}
+	if err := r.Heartbeat(ctx, &Owner{OwnerID: "w2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &Watcher{Processor: &testProcessor{}, Repo: r, OwnerID: "w1", Assignment: ring, PollInterval: 10 * time.Millisecond, LeaseInterval: 10 * time.Millisecond, AutoClose: true}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		w.Start(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitForStatus := func(ids []string) {
+		t.Helper()
+		for _, id := range ids {
+			for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+				p, err := r.GetPartition(ctx, id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if p.Status == Complete {
+					break
+				}
+				if time.Since(start) > 10*time.Second {
+					t.Fatalf("expected partition %s to be completed", id)
+				}
+			}
+		}
+	}
+	waitForStatus(mine)
+	// A few more lease scans leave the partitions of the live owner alone.
+	time.Sleep(50 * time.Millisecond)
+	for _, id := range theirs {
+		if p, err := r.GetPartition(ctx, id); err != nil || p.Owner != "" {
+			t.Errorf("expected partition %s not to be leased, got owner %q, %v", id, p.Owner, err)
+		}
+	}
+
+	// w2 stops sending heartbeats, and its range is taken over.
+	if err := r.DB.Model(&Owner{}).Where("owner_id = ?", "w2").Update("last_heartbeat", time.Now().Add(-time.Minute)).Error; err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(theirs)
+}
+
+func TestHashRingHandOver(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	ring := &HashRing{}
+	w := &Watcher{Repo: r, OwnerID: "w1", Assignment: ring, handOvers: map[string]context.CancelFunc{}}
+	handedOver := map[string]bool{}
+	var moving string
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("p%d", i)
+		w.handOvers[id] = func() { handedOver[id] = true }
+		if !ring.Assigned(id, "w1", []string{"w1", "w2"}) {
+			moving = id
+		}
+	}
+	if moving == "" {
+		t.Fatal("expected a partition to move to w2")
+	}
+
+	w.assign(ctx, nil)
+	if len(handedOver) != 0 {
+		t.Errorf("expected the partitions to be kept without other owners, got %v", handedOver)
+	}
+	r.Heartbeat(ctx, &Owner{OwnerID: "w2"})
+	w.assign(ctx, nil)
+	for id := range w.handOvers {
+		if handedOver[id] == ring.Assigned(id, "w1", []string{"w1", "w2"}) {
+			t.Errorf("expected only the partitions assigned to w2 to be handed over, got %v", handedOver)
+			break
+		}
+	}
+}
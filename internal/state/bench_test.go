@@ -0,0 +1,95 @@
+package state_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state/statetest"
+)
+
+const (
+	benchPartitions = 500
+	benchItems      = 1000
+)
+
+// benchRepo returns a sqlite repo seeded with 500k items across 500 partitions, enough for a scan
+// of the items to dominate the fetch.
+func benchRepo(b *testing.B) (*state.GormRepo, []*state.Partition) {
+	b.Helper()
+	r := statetest.NewSQLiteRepo(b)
+	ctx := context.Background()
+	var partitions []*state.Partition
+	for p := 0; p < benchPartitions; p++ {
+		part := &state.Partition{BaseModel: state.BaseModel{ID: fmt.Sprintf("p%d", p)}}
+		if err := r.CreatePartition(ctx, part); err != nil {
+			b.Fatal(err)
+		}
+		partitions = append(partitions, part)
+		var items []*state.Item
+		for i := 0; i < benchItems; i++ {
+			items = append(items, &state.Item{BaseModel: state.BaseModel{ID: fmt.Sprintf("p%d-i%d", p, i)}, PartitionID: part.ID, Data: []byte(`{}`)})
+			if len(items) == 500 {
+				if err := r.CreateItems(ctx, items...); err != nil {
+					b.Fatal(err)
+				}
+				items = nil
+			}
+		}
+	}
+	return r, partitions
+}
+
+func BenchmarkGetAvailableItems(b *testing.B) {
+	r, partitions := benchRepo(b)
+	ctx := context.Background()
+	for _, order := range []state.ItemOrder{state.OrderByUpdatedAt, state.OrderBySequence} {
+		b.Run(order.String(), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				items, err := r.GetAvailableItems(ctx, partitions[n%len(partitions)], 10, order, state.AnyItems)
+				if err != nil || len(items) != 10 {
+					b.Fatalf("unexpected items %d, error %v", len(items), err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSave(b *testing.B) {
+	r, _ := benchRepo(b)
+	ctx := context.Background()
+	var items []*state.Item
+	for i := 0; i < 100; i++ {
+		item, err := r.GetItem(ctx, fmt.Sprintf("p%d-i%d", i, i))
+		if err != nil {
+			b.Fatal(err)
+		}
+		items = append(items, item)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		item := items[n%len(items)]
+		item.RetryCount++
+		if !r.Save(ctx, item) {
+			b.Fatalf("error saving item %s", item.ID)
+		}
+	}
+}
+
+func BenchmarkGetPartitionProgress(b *testing.B) {
+	r, partitions := benchRepo(b)
+	ctx := context.Background()
+	// Half of each partition's items are complete.
+	if err := r.DB.Model(&state.Item{}).Where("id LIKE ?", "%0").Or("id LIKE ?", "%2").Or("id LIKE ?", "%4").Or(
+		"id LIKE ?", "%6").Or("id LIKE ?", "%8").Update("status", state.Complete).Error; err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		progress, err := r.GetPartitionProgress(ctx, partitions[n%len(partitions)].ID)
+		if err != nil || progress.Total != benchItems || progress.Complete != benchItems/2 {
+			b.Fatalf("unexpected progress %+v, error %v", progress, err)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// DefaultBlobThreshold is the size in bytes above which payloads are offloaded to the repo's
+// BlobStore.
+var DefaultBlobThreshold = 256 << 10
+
+// BlobStore holds item payloads too large to keep in the database. Keys are slash separated
+// paths.
+type BlobStore interface {
+	Put(ctx context.Context, key string, b []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Delete removes the blob. Deleting a missing blob is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// BlobLister is optionally implemented by blob stores, so that PurgeItems can also collect
+// blobs orphaned by saves that lost a version conflict.
+type BlobLister interface {
+	// List returns the keys starting with prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// blobEnvelope is stored in place of an offloaded payload.
+type blobEnvelope struct {
+	Key string `json:"$blob"`
+}
+
+var envelopePrefix = []byte(`{"$blob":`)
+
+// parseEnvelope returns the blob key if b is an envelope.
+func parseEnvelope(b []byte) (string, bool) {
+	if len(b) > 1024 || !bytes.HasPrefix(b, envelopePrefix) {
+		return "", false
+	}
+	var e blobEnvelope
+	if err := json.Unmarshal(b, &e); err != nil || e.Key == "" {
+		return "", false
+	}
+	return e.Key, true
+}
+
+// blobPrefix is the prefix of the keys of all of an item's blobs.
+func blobPrefix(id string) string {
+	return "items/" + base64.RawURLEncoding.EncodeToString([]byte(id)) + "/"
+}
+
+// blobKey addresses the payload by content, so that saving the same payload twice, e.g. by
+// two watchers racing on an item, writes the same blob.
+func blobKey(id, field string, b []byte) string {
+	sum := sha256.Sum256(b)
+	return blobPrefix(id) + field + "/" + hex.EncodeToString(sum[:])
+}
+
+func (db *GormRepo) blobThreshold() int {
+	if db.BlobThreshold == 0 {
+		return DefaultBlobThreshold
+	}
+	return db.BlobThreshold
+}
+
+// offload writes the item's large payloads to the blob store, and replaces them with envelopes
+// until the returned restore function is called with whether the item was saved.
+func (db *GormRepo) offload(ctx context.Context, i *Item) (restore func(saved bool), err error) {
+	if db.Blobs == nil {
+		return func(bool) {}, nil
+	}
+	data, result := i.Data, i.Result
+	keys := map[string]string{}
+	for field, b := range map[string]*[]byte{"data": &i.Data, "result": &i.Result} {
+		if len(*b) <= db.blobThreshold() {
+			continue
+		}
+		if _, ok := parseEnvelope(*b); ok {
+			continue
+		}
+		key := blobKey(i.ID, field, *b)
+		if i.blobKeys[field] == key {
+			// Unchanged since it was loaded.
+		} else if err := db.Blobs.Put(ctx, key, *b); err != nil {
+			i.Data, i.Result = data, result
+			return nil, fmt.Errorf("offloading %s of item %s: %w", field, i.ID, err)
+		}
+		keys[field] = key
+		*b, _ = json.Marshal(blobEnvelope{Key: key})
+	}
+	return func(saved bool) {
+		i.Data, i.Result = data, result
+		if !saved {
+			// The blobs may be shared with a concurrent save of the same payload, so they're
+			// left for PurgeItems.
+			return
+		}
+		for field, key := range i.blobKeys {
+			if key != keys["data"] && key != keys["result"] {
+				if err := db.Blobs.Delete(ctx, key); err != nil {
+					glog.Warningf("error deleting replaced %s blob of item %s: %s", field, i.ID, err)
+				}
+			}
+		}
+		i.blobKeys = keys
+	}, nil
+}
+
+// rehydrate replaces envelopes with the offloaded payloads.
+func (db *GormRepo) rehydrate(ctx context.Context, items ...*Item) error {
+	for _, i := range items {
+		for field, b := range map[string]*[]byte{"data": &i.Data, "result": &i.Result} {
+			key, ok := parseEnvelope(*b)
+			if !ok {
+				continue
+			}
+			if db.Blobs == nil {
+				return fmt.Errorf("item %s has an offloaded %s, but the repo has no blob store", i.ID, field)
+			}
+			payload, err := db.Blobs.Get(ctx, key)
+			if err != nil {
+				return fmt.Errorf("loading %s of item %s: %w", field, i.ID, err)
+			}
+			*b = payload
+			if i.blobKeys == nil {
+				i.blobKeys = map[string]string{}
+			}
+			i.blobKeys[field] = key
+		}
+	}
+	return nil
+}
+
+// deleteBlobs removes the blobs of purged items, given their stored payloads.
+func (db *GormRepo) deleteBlobs(ctx context.Context, items []*Item) error {
+	if db.Blobs == nil {
+		return nil
+	}
+	for _, i := range items {
+		var keys []string
+		if l, ok := db.Blobs.(BlobLister); ok {
+			found, err := l.List(ctx, blobPrefix(i.ID))
+			if err != nil {
+				return err
+			}
+			keys = found
+		} else {
+			for _, b := range [][]byte{i.Data, i.Result} {
+				if key, ok := parseEnvelope(b); ok {
+					keys = append(keys, key)
+				}
+			}
+		}
+		for _, key := range keys {
+			if err := db.Blobs.Delete(ctx, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// MemoryBlobStore keeps blobs in memory, for tests.
+type MemoryBlobStore struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func (s *MemoryBlobStore) Put(ctx context.Context, key string, b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.blobs == nil {
+		s.blobs = map[string][]byte{}
+	}
+	s.blobs[key] = append([]byte(nil), b...)
+	return nil
+}
+
+func (s *MemoryBlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.blobs[key]
+	if !ok {
+		return nil, fmt.Errorf("blob %s: %w", key, fs.ErrNotExist)
+	}
+	return append([]byte(nil), b...), nil
+}
+
+func (s *MemoryBlobStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blobs, key)
+	return nil
+}
+
+func (s *MemoryBlobStore) List(ctx context.Context, prefix string) (keys []string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.blobs {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// FileBlobStore keeps blobs as files under Dir.
+type FileBlobStore struct {
+	Dir string
+}
+
+func (s *FileBlobStore) path(key string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(key))
+}
+
+func (s *FileBlobStore) Put(ctx context.Context, key string, b []byte) error {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that readers never see a partial blob.
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (s *FileBlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	return os.ReadFile(s.path(key))
+}
+
+func (s *FileBlobStore) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileBlobStore) List(ctx context.Context, prefix string) (keys []string, err error) {
+	// Only walk the directory containing the prefix.
+	root := s.path(prefix[:strings.LastIndex(prefix, "/")+1])
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Dir, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
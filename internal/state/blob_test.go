@@ -0,0 +1,154 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+// storedData returns the item's data column as written to the database.
+func storedData(t *testing.T, r *GormRepo, id string) []byte {
+	var i Item
+	if err := r.DB.Where("id = ?", id).Take(&i).Error; err != nil {
+		t.Fatal(err)
+	}
+	return i.Data
+}
+
+func largePayload(processed int) []byte {
+	return []byte(fmt.Sprintf(`{"times": 2, "processed": %d, "padding": "%s"}`, processed, bytes.Repeat([]byte("x"), 1024)))
+}
+
+func TestBlobOffload(t *testing.T) {
+	r := openTestRepo(t)
+	blobs := &MemoryBlobStore{}
+	r.Blobs = blobs
+	r.BlobThreshold = 512
+	ctx := context.Background()
+
+	small := &Item{BaseModel: BaseModel{ID: "small"}, PartitionID: "p", Status: Available, Data: []byte(`{}`)}
+	large := &Item{BaseModel: BaseModel{ID: "large"}, PartitionID: "p", Status: Available, Data: largePayload(0)}
+	if !r.Save(ctx, small) || !r.Save(ctx, large) {
+		t.Fatal("failed to save items")
+	}
+	if string(storedData(t, r, "small")) != `{}` {
+		t.Error("expected small payloads to stay in the database")
+	}
+	if _, ok := parseEnvelope(storedData(t, r, "large")); !ok {
+		t.Errorf("expected an envelope in the database, got %.40s", storedData(t, r, "large"))
+	}
+	if !bytes.Equal(large.Data, largePayload(0)) {
+		t.Error("expected the saved item to keep its payload")
+	}
+
+	got, err := r.GetItem(ctx, "large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Data, largePayload(0)) {
+		t.Errorf("expected the payload to be rehydrated, got %.40s", got.Data)
+	}
+
+	// Replacing the payload deletes the old blob.
+	got.Data = largePayload(1)
+	if !r.Save(ctx, got) {
+		t.Fatal("failed to save item")
+	}
+	if keys, _ := blobs.List(ctx, blobPrefix("large")); len(keys) != 1 {
+		t.Errorf("expected only the current blob to remain, got %v", keys)
+	}
+	items, _, err := r.ListItems(ctx, ItemFilter{}, PageRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range items {
+		if _, ok := parseEnvelope(i.Data); ok {
+			t.Errorf("expected listed item %s to be rehydrated", i.ID)
+		}
+	}
+
+	// A stale save leaves the current payload intact.
+	stale := *got
+	stale.Version--
+	stale.Data = largePayload(2)
+	if r.Save(ctx, &stale) {
+		t.Fatal("expected a stale save to fail")
+	}
+	if got, _ := r.GetItem(ctx, "large"); !bytes.Equal(got.Data, largePayload(1)) {
+		t.Error("expected the current payload to be unaffected by a failed save")
+	}
+}
+
+func TestBlobOffloadProcessing(t *testing.T) {
+	r := openTestRepo(t)
+	r.Blobs = &MemoryBlobStore{}
+	r.BlobThreshold = 512
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	if err := r.CreateItems(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Data: largePayload(0)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := parseEnvelope(storedData(t, r, "i")); !ok {
+		t.Error("expected created items to be offloaded")
+	}
+
+	proc := &recordingProcessor{}
+	runForEvents(t, r, &Watcher{Processor: proc, Repo: r, BatchSize: 1, PollInterval: 10 * time.Millisecond, AutoClose: true})
+	if len(proc.inputs) == 0 || proc.inputs[0] != string(largePayload(0)) {
+		t.Errorf("expected the processor to receive the full payload")
+	}
+	i, err := r.GetItem(ctx, "i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := objFromData(i.Result); i.Status != Complete || got.Processed != 2 {
+		t.Errorf("expected the item to complete, got %s with %.40s", i.Status, i.Result)
+	}
+}
+
+func TestPurgeItems(t *testing.T) {
+	r := openTestRepo(t)
+	blobs := &FileBlobStore{Dir: t.TempDir()}
+	r.Blobs = blobs
+	r.BlobThreshold = 512
+	ctx := context.Background()
+	for _, id := range []string{"a1", "a2", "b1"} {
+		r.Save(ctx, &Item{BaseModel: BaseModel{ID: id}, PartitionID: id[:1], Status: Available, Data: largePayload(0)})
+	}
+	// An orphan, as left behind by a save that lost a version conflict.
+	if err := blobs.Put(ctx, blobKey("a1", "result", []byte("orphan")), []byte("orphan")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.PurgeItems(ctx, ItemFilter{}); err == nil {
+		t.Error("expected an empty filter to be refused")
+	}
+	n, err := r.PurgeItems(ctx, ItemFilter{PartitionID: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 items purged, got %d", n)
+	}
+	if _, err := r.GetItem(ctx, "a1"); !IsNotFound(err) {
+		t.Errorf("expected the item to be deleted, got %v", err)
+	}
+	var remaining []string
+	for _, id := range []string{"a1", "a2", "b1"} {
+		keys, err := blobs.List(ctx, blobPrefix(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		remaining = append(remaining, keys...)
+	}
+	sort.Strings(remaining)
+	if len(remaining) != 1 || remaining[0] != blobKey("b1", "data", largePayload(0)) {
+		t.Errorf("expected only the blob of the remaining item, got %v", remaining)
+	}
+	if got, err := r.GetItem(ctx, "b1"); err != nil || !bytes.Equal(got.Data, largePayload(0)) {
+		t.Errorf("expected the remaining item to be intact, got %v", err)
+	}
+}
@@ -0,0 +1,258 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// DefaultBreakerCooldown is how long an open circuit breaker pauses processing by default, see
+// Watcher.BreakerCooldown.
+var DefaultBreakerCooldown = time.Minute
+
+// BreakerState is the state of a circuit breaker, see Watcher.BreakerThreshold.
+type BreakerState int
+
+const (
+	// BreakerClosed lets every item through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen lets no item through until its cooldown has passed.
+	BreakerOpen
+	// BreakerHalfOpen lets a single item through, as a probe of whether the processor has
+	// recovered.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "Open"
+	case BreakerHalfOpen:
+		return "HalfOpen"
+	default:
+		return "Closed"
+	}
+}
+
+// MarshalText encodes the state by name, so that JSON output is human readable.
+func (s BreakerState) MarshalText() ([]byte, error) { return []byte(s.String()), nil }
+
+// UnmarshalText decodes a state name, as returned by String.
+func (s *BreakerState) UnmarshalText(b []byte) error {
+	for _, state := range []BreakerState{BreakerClosed, BreakerOpen, BreakerHalfOpen} {
+		if strings.EqualFold(string(b), state.String()) {
+			*s = state
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown breaker state: %q", b)
+}
+
+// breaker counts consecutive processor errors, and opens after a threshold of them.
+type breaker struct {
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	// probe is the ID of the item probing a half-open breaker.
+	probe string
+}
+
+// admits returns whether the breaker would let an item through at now.
+func (b *breaker) admits(now time.Time, cooldown time.Duration) bool {
+	switch b.state {
+	case BreakerOpen:
+		return now.Sub(b.openedAt) >= cooldown
+	case BreakerHalfOpen:
+		return b.probe == ""
+	default:
+		return true
+	}
+}
+
+// admit lets the item through a breaker which admits it, making it the probe unless the
+// breaker is closed. Returns whether the breaker became half-open.
+func (b *breaker) admit(id string) bool {
+	if b.state == BreakerClosed {
+		return false
+	}
+	halfOpened := b.state == BreakerOpen
+	b.state = BreakerHalfOpen
+	b.probe = id
+	return halfOpened
+}
+
+// record counts the outcome of the item's attempt, and returns the new state of the breaker
+// if it changed. Only the probe closes a half-open breaker, or opens it again.
+func (b *breaker) record(id string, failed bool, now time.Time, threshold int) (BreakerState, bool) {
+	probe := b.state == BreakerHalfOpen && b.probe == id
+	if !failed {
+		b.failures = 0
+		if !probe {
+			return b.state, false
+		}
+		b.state, b.probe = BreakerClosed, ""
+		return b.state, true
+	}
+	b.failures++
+	if probe || (b.state == BreakerClosed && b.failures >= threshold) {
+		b.state, b.probe, b.openedAt = BreakerOpen, "", now
+		return b.state, true
+	}
+	return b.state, false
+}
+
+// release frees the probe of the breaker if the item was it, e.g. when it wasn't processed, so
+// that another item can probe it.
+func (b *breaker) release(id string) {
+	if b.probe == id {
+		b.probe = ""
+	}
+}
+
+// breakers are the watcher's circuit breakers, by partition, and the global one.
+type breakers struct {
+	mu         sync.Mutex
+	partitions map[string]*breaker
+	global     breaker
+}
+
+// partition returns the breaker of the partition. Must be called with mu held.
+func (b *breakers) partition(id string) *breaker {
+	if b.partitions == nil {
+		b.partitions = map[string]*breaker{}
+	}
+	p, ok := b.partitions[id]
+	if !ok {
+		p = &breaker{}
+		b.partitions[id] = p
+	}
+	return p
+}
+
+// breakerPaused returns whether the partition's breaker, or the global one, is open and
+// cooling down, so that its items aren't worth dispatching.
+func (w *Watcher) breakerPaused(partitionID string) bool {
+	if w.BreakerThreshold == 0 {
+		return false
+	}
+	now := w.Clock.Now()
+	w.breakers.mu.Lock()
+	defer w.breakers.mu.Unlock()
+	p := w.breakers.partition(partitionID)
+	paused := p.state == BreakerOpen && !p.admits(now, w.BreakerCooldown)
+	if w.GlobalBreaker {
+		paused = paused || (w.breakers.global.state == BreakerOpen && !w.breakers.global.admits(now, w.BreakerCooldown))
+	}
+	return paused
+}
+
+// admit returns whether the item may be processed, past the breakers of its partition and of
+// the watcher. Items held back are left as they are, without using up a retry.
+func (w *Watcher) admit(i *Item) bool {
+	if w.BreakerThreshold == 0 {
+		return true
+	}
+	now := w.Clock.Now()
+	var events []Event
+	w.breakers.mu.Lock()
+	p := w.breakers.partition(i.PartitionID)
+	admitted := p.admits(now, w.BreakerCooldown) && (!w.GlobalBreaker || w.breakers.global.admits(now, w.BreakerCooldown))
+	if admitted {
+		if p.admit(i.ID) {
+			events = append(events, Event{Type: BreakerHalfOpened, PartitionID: i.PartitionID})
+		}
+		if w.GlobalBreaker && w.breakers.global.admit(i.ID) {
+			events = append(events, Event{Type: BreakerHalfOpened})
+		}
+	}
+	w.breakers.mu.Unlock()
+	w.emitBreakerEvents(events)
+	return admitted
+}
+
+// recordAttempt counts the outcome of a call to the processor for the item against its
+// breakers.
+func (w *Watcher) recordAttempt(i *Item, failed bool) {
+	if w.BreakerThreshold == 0 {
+		return
+	}
+	now := w.Clock.Now()
+	var events []Event
+	w.breakers.mu.Lock()
+	if state, changed := w.breakers.partition(i.PartitionID).record(i.ID, failed, now, w.BreakerThreshold); changed {
+		events = append(events, breakerEvent(state, i.PartitionID))
+	}
+	if w.GlobalBreaker {
+		if state, changed := w.breakers.global.record(i.ID, failed, now, w.BreakerThreshold); changed {
+			events = append(events, breakerEvent(state, ""))
+		}
+	}
+	w.breakers.mu.Unlock()
+	w.emitBreakerEvents(events)
+}
+
+// releaseProbe frees the breakers the item was probing, if its attempt wasn't recorded.
+func (w *Watcher) releaseProbe(i *Item) {
+	if w.BreakerThreshold == 0 {
+		return
+	}
+	w.breakers.mu.Lock()
+	defer w.breakers.mu.Unlock()
+	w.breakers.partition(i.PartitionID).release(i.ID)
+	w.breakers.global.release(i.ID)
+}
+
+// dropBreaker forgets the breaker of a partition which is no longer leased.
+func (w *Watcher) dropBreaker(partitionID string) {
+	w.breakers.mu.Lock()
+	defer w.breakers.mu.Unlock()
+	delete(w.breakers.partitions, partitionID)
+}
+
+// breakerStates returns the states of the partitions' breakers which aren't closed, and of
+// the global breaker.
+func (w *Watcher) breakerStates() (map[string]BreakerState, BreakerState) {
+	w.breakers.mu.Lock()
+	defer w.breakers.mu.Unlock()
+	var states map[string]BreakerState
+	for id, b := range w.breakers.partitions {
+		if b.state == BreakerClosed {
+			continue
+		}
+		if states == nil {
+			states = map[string]BreakerState{}
+		}
+		states[id] = b.state
+	}
+	return states, w.breakers.global.state
+}
+
+func breakerEvent(state BreakerState, partitionID string) Event {
+	if state == BreakerOpen {
+		return Event{Type: BreakerOpened, PartitionID: partitionID}
+	}
+	return Event{Type: BreakerRecovered, PartitionID: partitionID}
+}
+
+// emitBreakerEvents logs and reports the breaker transitions, outside of the breakers' lock.
+func (w *Watcher) emitBreakerEvents(events []Event) {
+	for _, e := range events {
+		name := "global breaker"
+		if e.PartitionID != "" {
+			name = fmt.Sprintf("breaker of partition %s", e.PartitionID)
+		}
+		switch e.Type {
+		case BreakerOpened:
+			glog.Warningf("%s opened after %d consecutive processor errors, pausing for %s", name, w.BreakerThreshold, w.BreakerCooldown)
+			w.metrics().Counter(MetricBreakerOpened, 1, Labels{"partition": e.PartitionID})
+		case BreakerHalfOpened:
+			glog.Infof("%s half open, probing the processor", name)
+		case BreakerRecovered:
+			glog.Infof("%s closed, the processor recovered", name)
+		}
+		w.emit(e)
+	}
+}
@@ -0,0 +1,162 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	b := &breaker{}
+	for n := 1; n <= 2; n++ {
+		if _, changed := b.record("i", true, now, 3); changed {
+			t.Fatalf("expected the breaker to stay closed after %d errors", n)
+		}
+	}
+	b.record("i", false, now, 3)
+	b.record("i", true, now, 3)
+	b.record("i", true, now, 3)
+	if state, changed := b.record("i", true, now, 3); !changed || state != BreakerOpen {
+		t.Fatalf("expected 3 consecutive errors to open the breaker, got %s", state)
+	}
+	if b.admits(now.Add(59*time.Second), time.Minute) {
+		t.Error("expected the open breaker to admit nothing during its cooldown")
+	}
+	if !b.admits(now.Add(time.Minute), time.Minute) || !b.admit("probe") || b.state != BreakerHalfOpen {
+		t.Fatalf("expected the breaker to half open after its cooldown, got %s", b.state)
+	}
+	if b.admits(now.Add(time.Minute), time.Minute) {
+		t.Error("expected the half open breaker to admit a single probe")
+	}
+	if _, changed := b.record("other", false, now, 3); changed {
+		t.Error("expected only the probe to close the breaker")
+	}
+	b.release("probe")
+	if !b.admits(now.Add(time.Minute), time.Minute) || b.admit("probe 2") {
+		t.Fatal("expected a released probe to make way for another, without another event")
+	}
+	if state, changed := b.record("probe 2", true, now.Add(time.Minute), 3); !changed || state != BreakerOpen {
+		t.Fatalf("expected a failed probe to open the breaker again, got %s", state)
+	}
+	b.admit("probe 3")
+	if state, changed := b.record("probe 3", false, now.Add(2*time.Minute), 3); !changed || state != BreakerClosed {
+		t.Errorf("expected a successful probe to close the breaker, got %s", state)
+	}
+}
+
+// outageProcessor fails every item until the clock reaches recoverAt.
+type outageProcessor struct {
+	testProcessor
+	clock     clock.Clock
+	recoverAt time.Time
+}
+
+func (p *outageProcessor) Process(id string, b []byte) (*ProcessorResponse, error) {
+	if p.clock.Now().Before(p.recoverAt) {
+		return nil, errors.New("service unavailable")
+	}
+	return &ProcessorResponse{Complete: true, Data: b}, nil
+}
+
+func TestBreakerOutage(t *testing.T) {
+	for _, global := range []bool{false, true} {
+		t.Run(fmt.Sprintf("global %t", global), func(t *testing.T) {
+			r := openTestRepo(t)
+			ctx := context.Background()
+			partitions := []string{"p1", "p2"}
+			for _, p := range partitions {
+				r.Save(ctx, &Partition{BaseModel: BaseModel{ID: p}})
+				for n := 0; n < 5; n++ {
+					r.Save(ctx, &Item{BaseModel: BaseModel{ID: fmt.Sprintf("%s-%d", p, n)}, PartitionID: p, Data: []byte(`{}`)})
+				}
+			}
+			c := clock.NewFake(time.Now())
+			r.Clock = c
+			w := &Watcher{
+				Processor:        &outageProcessor{clock: c, recoverAt: c.Now().Add(5 * time.Minute)},
+				Repo:             r,
+				BatchSize:        1,
+				PollInterval:     10 * time.Second,
+				LeaseInterval:    10 * time.Second,
+				LeaseDuration:    time.Hour,
+				AutoClose:        true,
+				Clock:            c,
+				EventBuffer:      1000,
+				BreakerThreshold: 3,
+				GlobalBreaker:    global,
+			}
+			var mu sync.Mutex
+			seen := map[EventType]bool{}
+			events := w.Events()
+			go func() {
+				for e := range events {
+					mu.Lock()
+					seen[e.Type] = true
+					mu.Unlock()
+				}
+			}()
+			ctx, cancel := context.WithCancel(ctx)
+			done := make(chan struct{})
+			go func() {
+				w.Start(ctx)
+				close(done)
+			}()
+			defer func() {
+				cancel()
+				<-done
+			}()
+
+			opened := false
+			for start := time.Now(); time.Since(start) < 10*time.Second; {
+				// Wait for the loops to block on the clock, unless the partitions closed as
+				// their last items completed since they were listed.
+				for c.Waiters() < 4 && time.Since(start) < 10*time.Second {
+					time.Sleep(time.Millisecond)
+				}
+				// Give the item processors a moment to catch up with the clock.
+				time.Sleep(5 * time.Millisecond)
+				stats := w.Stats()
+				opened = opened || len(stats.Breakers) > 0 || stats.GlobalBreaker != BreakerClosed
+				items, _, err := r.ListItems(context.Background(), ItemFilter{}, PageRequest{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				complete := 0
+				for _, i := range items {
+					if i.Status == Failed {
+						t.Fatalf("expected no item to exhaust its retries, got %+v", i)
+					}
+					if i.Status == Complete {
+						complete++
+					}
+				}
+				if complete == len(items) {
+					break
+				}
+				c.Advance(10 * time.Second)
+			}
+			if c.Now().Before(w.Processor.(*outageProcessor).recoverAt) {
+				t.Fatal("expected the items to complete once the processor recovered")
+			}
+			if !opened {
+				t.Error("expected the breakers to show in the stats")
+			}
+			if state := w.Stats().GlobalBreaker; state != BreakerClosed {
+				t.Errorf("expected the global breaker to be closed after the outage, got %s", state)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, e := range []EventType{BreakerOpened, BreakerHalfOpened, BreakerRecovered} {
+				if !seen[e] {
+					t.Errorf("expected a %s event, got %v", e, seen)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package state_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state/statetest"
+)
+
+// runToCompletion runs a watcher over the repo until the partition completes.
+func runToCompletion(t *testing.T, r state.WatcherRepo, partitionID string) {
+	t.Helper()
+	w := &state.Watcher{
+		Processor:     &countingProcessor{attempts: map[string]int{}},
+		Repo:          r,
+		BatchSize:     10,
+		PollInterval:  10 * time.Millisecond,
+		LeaseInterval: 10 * time.Millisecond,
+		AutoClose:     true,
+	}
+	events := w.Events()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		w.Start(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	for e := range events {
+		if e.Type == state.PartitionCompleted && e.PartitionID == partitionID {
+			return
+		}
+	}
+	t.Fatalf("partition %s did not complete", partitionID)
+}
+
+func TestQueryBudget(t *testing.T) {
+	repo := statetest.NewSQLiteRepo(t)
+	ctx := context.Background()
+	const items = 10
+	repo.Save(ctx, &state.Partition{BaseModel: state.BaseModel{ID: "p"}})
+	for n := 0; n < items; n++ {
+		repo.Save(ctx, &state.Item{BaseModel: state.BaseModel{ID: fmt.Sprint(n)}, PartitionID: "p", Data: []byte(`{}`)})
+	}
+	r := &statetest.CountingRepo{Repo: repo}
+	runToCompletion(t, r, "p")
+
+	// Processing an item costs a single call, its save, without reading it again.
+	itemSaves, partitionSaves := 0, 0
+	for _, c := range r.Calls("Save", "SaveWithOutbox") {
+		switch c.Args[0].(type) {
+		case *state.Item:
+			itemSaves++
+		case *state.Partition:
+			partitionSaves++
+		}
+	}
+	if itemSaves != items {
+		t.Errorf("expected each item to be saved once, got %d saves of %d items", itemSaves, items)
+	}
+	if n := r.Count("GetItem", "GetItemByIdempotencyKey", "ListItems"); n != 0 {
+		t.Errorf("expected no reads of single items, got %d", n)
+	}
+	// The lag of the partition is measured off the items it fetched.
+	if n := r.Count("GetAvailableLag"); n != 0 {
+		t.Errorf("expected the lag to be measured without queries, got %d", n)
+	}
+	// Each poll of the partition fetches its items, then counts and saves it, or advances it
+	// in a transaction.
+	polls := r.Count("GetAvailableItems")
+	if n := r.Count("GetAvailableItems", "CountDelayedItems", "GetCountByStatus", "CountAvailablePastGate", "Transaction") + partitionSaves; n > 4*polls {
+		t.Errorf("expected at most 4 calls per poll, got %d over %d polls: %v", n, polls, r.Counts())
+	}
+
+	r.Reset()
+	if n := r.Count(); n != 0 || len(r.Calls()) != 0 {
+		t.Errorf("expected no calls after a reset, got %d", n)
+	}
+}
+
+// callMetrics records the repo call counters.
+type callMetrics struct {
+	mu    sync.Mutex
+	calls map[string]float64
+}
+
+func (m *callMetrics) Counter(name string, delta float64, labels state.Labels) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if name == state.MetricRepoCalls {
+		m.calls[labels["method"]] += delta
+	}
+}
+
+func (m *callMetrics) Gauge(string, float64, state.Labels)          {}
+func (m *callMetrics) Duration(string, time.Duration, state.Labels) {}
+
+func TestCountingRepoMetrics(t *testing.T) {
+	m := &callMetrics{calls: map[string]float64{}}
+	r := &statetest.CountingRepo{Repo: statetest.NewSQLiteRepo(t), Metrics: m, CountOnly: true}
+	ctx := context.Background()
+	r.GetPartition(ctx, "p")
+	r.GetPartition(ctx, "p")
+	if m.calls["GetPartition"] != 2 || r.Count("GetPartition") != 2 {
+		t.Errorf("expected 2 calls to be reported, got %v and %v", m.calls, r.Counts())
+	}
+	if calls := r.Calls(); len(calls) != 0 {
+		t.Errorf("expected no calls to be kept, got %v", calls)
+	}
+}
@@ -0,0 +1,14 @@
+package state_test
+
+import (
+	"testing"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state/statetest"
+)
+
+func TestGormRepoConformance(t *testing.T) {
+	statetest.RepoConformance(t, func(t *testing.T) state.Repo {
+		return statetest.NewSQLiteRepo(t)
+	})
+}
@@ -0,0 +1,89 @@
+package state
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+	"github.com/golang/glog"
+)
+
+// ErrDeadlineExceeded fails the items that were still Available past their Deadline. It is
+// not retryable.
+var ErrDeadlineExceeded = NonRetryableError("deadline exceeded")
+
+// expired returns whether the item's deadline has passed.
+func (i *Item) expired(now time.Time) bool {
+	return i.Deadline != nil && !now.Before(*i.Deadline)
+}
+
+// FailExpiredItems fails the Available items of every partition whose Deadline has passed
+// with ErrDeadlineExceeded, including the items of partitions nobody is watching, and returns
+// the number of items failed. Items saved concurrently, e.g. by a watcher, are skipped.
+func (db *GormRepo) FailExpiredItems(ctx context.Context) (int, error) {
+	failed := 0
+	after := ""
+	now := clock.Or(db.Clock).Now()
+	for {
+		items, err := db.expiredItems(ctx, now, after)
+		if err != nil || len(items) == 0 {
+			return failed, err
+		}
+		for _, i := range items {
+			// The error isn't retryable, regardless of the item's retries.
+			i.error(ErrDeadlineExceeded, Fail, now)
+			if db.SaveWithOutbox(ctx, i, itemOutboxEvents(i, ErrDeadlineExceeded)...) {
+				failed++
+			}
+		}
+		after = items[len(items)-1].ID
+	}
+}
+
+// expiredItems returns a page of the Available items whose deadline is before now, ordered by
+// ID from after.
+func (db *GormRepo) expiredItems(ctx context.Context, now time.Time, after string) (items []*Item, err error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	if err := db.scoped(db.WithContext(ctx)).Where("status = ? AND deadline < ? AND id > ?", Available, now, after).Order(
+		"id").Limit(DefaultPageSize).Find(&items).Error; err != nil {
+		return nil, err
+	}
+	return items, db.load(ctx, items...)
+}
+
+// CountDeadlineMisses returns the number of items in the partition that failed after their
+// Deadline had passed.
+func (db *GormRepo) CountDeadlineMisses(ctx context.Context, partitionID string) (int, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	var count int64
+	err := db.scoped(db.WithContext(ctx)).Model(&Item{}).Where(
+		"partition_id = ? AND status = ? AND deadline <= updated_at", partitionID, Failed).Count(&count).Error
+	return int(count), err
+}
+
+// missDeadline records an item failed by its deadline.
+func (w *Watcher) missDeadline(i *Item) {
+	atomic.AddInt64(&w.counters.deadlineMisses, 1)
+	w.metrics().Counter(MetricDeadlineMisses, 1, Labels{"partition": i.PartitionID, "gate": i.partition.plan.Name(i.Gate)})
+}
+
+// sweepExpiredItems fails the expired items of every partition, if DeadlineSweepInterval has
+// passed since the last sweep, returning the time of the last sweep.
+func (w *Watcher) sweepExpiredItems(ctx context.Context, last time.Time) time.Time {
+	if w.DeadlineSweepInterval <= 0 || w.Clock.Since(last) < w.DeadlineSweepInterval {
+		return last
+	}
+	n, err := w.Repo.FailExpiredItems(ctx)
+	if err != nil && ctx.Err() == nil {
+		glog.Errorf("error failing expired items: %s", err)
+	}
+	if n > 0 {
+		glog.Warningf("failed %d items past their deadline", n)
+		atomic.AddInt64(&w.counters.deadlineMisses, int64(n))
+		w.metrics().Counter(MetricDeadlineMisses, float64(n), nil)
+	}
+	return w.Clock.Now()
+}
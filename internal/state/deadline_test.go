@@ -0,0 +1,165 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyProcessor fails the first attempt at each item with a retryable error, then completes
+// it.
+type flakyProcessor struct {
+	testProcessor
+	mu       sync.Mutex
+	attempts map[string]int
+}
+
+func (p *flakyProcessor) Process(id string, b []byte) (*ProcessorResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.attempts[id]++
+	if p.attempts[id] == 1 {
+		return nil, errors.New("try again later")
+	}
+	return &ProcessorResponse{Complete: true, Data: b}, nil
+}
+
+type counterMetrics struct {
+	nopMetrics
+	mu       sync.Mutex
+	counters map[string]float64
+}
+
+func (m *counterMetrics) Counter(name string, delta float64, labels Labels) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[name] += delta
+}
+
+func TestDeadlineExceeded(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "on-time"}, PartitionID: "p", Data: []byte(`{}`), Deadline: &future})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "expired"}, PartitionID: "p", Data: []byte(`{}`), Deadline: &past})
+
+	proc := &recordingProcessor{}
+	m := &counterMetrics{counters: map[string]float64{}}
+	// The item on time is processed first, as the expired item fails the partition, whose
+	// other items are then left alone, see TestFailedPartitionRecovers.
+	w := &Watcher{Processor: proc, Repo: r, BatchSize: 1, PollInterval: 10 * time.Millisecond, AutoClose: true, Metrics: m,
+		FetchOrder: OrderBySequence}
+	events := runForEvents(t, r, w)
+
+	if len(proc.inputs) != 1 {
+		t.Errorf("expected only the item on time to be processed, got %v", proc.inputs)
+	}
+	var failed *Event
+	for n, e := range events {
+		if e.Type == ItemFailed {
+			failed = &events[n]
+		}
+	}
+	if failed == nil || failed.ItemID != "expired" || !errors.Is(failed.Err, ErrDeadlineExceeded) || IsRetryable(failed.Err) {
+		t.Errorf("expected the expired item to fail with a non-retryable deadline error, got %v", events)
+	}
+	i, err := r.GetItem(ctx, "expired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Status != Failed || i.ErrorMessages != "deadline exceeded" {
+		t.Errorf("unexpected expired item %+v", i)
+	}
+	if got := w.Stats().DeadlineMisses; got != 1 {
+		t.Errorf("expected 1 deadline miss, got %d", got)
+	}
+	if got := m.counters[MetricDeadlineMisses]; got != 1 {
+		t.Errorf("expected the deadline miss metric to be 1, got %v", got)
+	}
+	if n, err := r.CountDeadlineMisses(ctx, "p"); err != nil || n != 1 {
+		t.Errorf("expected 1 deadline miss in the partition, got %d, %v", n, err)
+	}
+}
+
+// An item retried after its deadline fails, rather than being attempted again.
+func TestDeadlinePassesBeforeRetry(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	deadline := time.Now().Add(200 * time.Millisecond)
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Data: []byte(`{}`), Deadline: &deadline})
+
+	proc := &flakyProcessor{attempts: map[string]int{}}
+	// The item waits out the poll interval before it is retried, by which time its deadline
+	// has passed.
+	runForEvents(t, r, &Watcher{Processor: proc, Repo: r, BatchSize: 1, PollInterval: 400 * time.Millisecond, AutoClose: true})
+
+	if proc.attempts["i"] != 1 {
+		t.Errorf("expected a single attempt, got %d", proc.attempts["i"])
+	}
+	i, err := r.GetItem(ctx, "i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Status != Failed || i.RetryCount != 2 || i.ErrorMessages != "try again later\ndeadline exceeded" {
+		t.Errorf("expected the item to fail on its deadline, got %+v", i)
+	}
+}
+
+func TestFailExpiredItems(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "expired"}, PartitionID: "p", Data: []byte(`{}`), Deadline: &past})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "done"}, PartitionID: "p", Status: Complete, Data: []byte(`{}`), Deadline: &past})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "later"}, PartitionID: "p", Data: []byte(`{}`), Deadline: &future})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "none"}, PartitionID: "p", Data: []byte(`{}`)})
+
+	// The watcher only leases labelled partitions, so the expired item is left to its sweep.
+	w := &Watcher{Processor: &testProcessor{}, Repo: r, BatchSize: 1, PollInterval: 10 * time.Millisecond,
+		Selector: map[string]string{"gpu": "true"}, DeadlineSweepInterval: 10 * time.Millisecond}
+	wctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		w.Start(wctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	timeout := time.After(10 * time.Second)
+	for {
+		i, err := r.GetItem(ctx, "expired")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i.Status == Failed {
+			if i.ErrorMessages != "deadline exceeded" {
+				t.Errorf("unexpected error messages %q", i.ErrorMessages)
+			}
+			break
+		}
+		select {
+		case <-timeout:
+			t.Fatal("expired item was not failed by the sweep")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if got := w.Stats().DeadlineMisses; got != 1 {
+		t.Errorf("expected 1 deadline miss, got %d", got)
+	}
+	for _, id := range []string{"done", "later", "none"} {
+		if i, err := r.GetItem(ctx, id); err != nil || i.Status == Failed {
+			t.Errorf("expected item %s not to be failed, got %+v, %v", id, i, err)
+		}
+	}
+	if n, err := r.FailExpiredItems(ctx); err != nil || n != 0 {
+		t.Errorf("expected nothing left to fail, got %d, %v", n, err)
+	}
+}
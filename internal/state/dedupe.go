@@ -0,0 +1,68 @@
+package state
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+	"gorm.io/gorm"
+)
+
+// HashData returns the DataHash of a payload.
+func HashData(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashData sets the item's DataHash, unless the repo encrypts its payload or offloads it to
+// the blob store, in which case the hash given by the producer, if any, is kept.
+func (db *GormRepo) hashData(i *Item) {
+	if db.Encryptor != nil || (db.Blobs != nil && len(i.Data) > db.blobThreshold()) {
+		return
+	}
+	i.DataHash = HashData(i.Data)
+}
+
+// FindCompletedByHash returns an item of the partition with the data hash that completed at
+// the gate.
+func (db *GormRepo) FindCompletedByHash(ctx context.Context, partitionID string, gate int, hash string) (*Item, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	i := &Item{}
+	if err := db.scoped(db.WithContext(ctx)).Where("partition_id = ? AND data_hash = ? AND gate = ? AND status = ?", partitionID, hash, gate, Complete).Take(i).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &ErrNotFound{Kind: "item", ID: fmt.Sprintf("with data hash %s completed at gate %d in partition %s", hash, gate, partitionID)}
+		}
+		return nil, err
+	}
+	return i, db.load(ctx, i)
+}
+
+// deduplicate completes the item with the Result of an earlier item of its partition that
+// completed at its gate with the same payload, if the watcher has DedupeByHash set, and
+// returns whether it did. The earlier item is recorded in the item's ErrorMessages.
+func (w *Watcher) deduplicate(ctx context.Context, i *Item) bool {
+	if !w.DedupeByHash || i.DataHash == "" {
+		return false
+	}
+	prior, err := w.Repo.FindCompletedByHash(ctx, i.PartitionID, i.Gate, i.DataHash)
+	if err != nil {
+		if !IsNotFound(err) {
+			glog.Warningf("error looking up the duplicates of item %s in partition %s: %s", i.ID, i.PartitionID, err)
+		}
+		return false
+	}
+	glog.Infof("%s is completing item %s in partition %s as a duplicate of item %s", w.OwnerID, i.ID, i.PartitionID, prior.ID)
+	atomic.AddInt64(&w.counters.itemsDeduplicated, 1)
+	atomic.AddInt64(&w.counters.itemsCompleted, 1)
+	i.Status = Complete
+	i.Result = prior.Result
+	i.RetryAt = nil
+	i.ProcessingStartedAt = nil
+	i.ErrorMessages = appendError(i.ErrorMessages, "deduplicated from item "+prior.ID, MaxErrorMessagesSize)
+	return true
+}
@@ -0,0 +1,83 @@
+package state
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupeByHash(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	for _, i := range []*Item{
+		{BaseModel: BaseModel{ID: "done"}, PartitionID: "p", Status: Complete, Data: []byte(`{"q":1}`), Result: []byte(`{"answer":42}`)},
+		{BaseModel: BaseModel{ID: "done-later"}, PartitionID: "p", Status: Complete, Gate: 1, Data: []byte(`{"q":3}`), Result: []byte(`{"answer":3}`)},
+		{BaseModel: BaseModel{ID: "duplicate"}, PartitionID: "p", Status: Available, Data: []byte(`{"q":1}`)},
+		{BaseModel: BaseModel{ID: "new"}, PartitionID: "p", Status: Available, Data: []byte(`{"q":2}`)},
+		{BaseModel: BaseModel{ID: "earlier-gate"}, PartitionID: "p", Status: Available, Data: []byte(`{"q":3}`)},
+	} {
+		if !r.Save(ctx, i) {
+			t.Fatalf("error saving item %s", i.ID)
+		}
+	}
+	if i, err := r.GetItem(ctx, "done"); err != nil || i.DataHash != HashData([]byte(`{"q":1}`)) {
+		t.Fatalf("expected the data to be hashed on save, got %+v %v", i, err)
+	}
+
+	proc := &payloadProcessor{inputs: map[string]string{}}
+	w := &Watcher{Processor: proc, Repo: r, BatchSize: 1, PollInterval: 10 * time.Millisecond, AutoClose: true, DedupeByHash: true}
+	runForEvents(t, r, w)
+
+	if _, ok := proc.inputs["duplicate"]; ok {
+		t.Error("expected the duplicate not to be processed")
+	}
+	for _, id := range []string{"new", "earlier-gate"} {
+		if _, ok := proc.inputs[id]; !ok {
+			t.Errorf("expected %s, without a duplicate completed at its gate, to be processed", id)
+		}
+	}
+	i, err := r.GetItem(ctx, "duplicate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Status != Complete || string(i.Result) != `{"answer":42}` || !strings.Contains(i.ErrorMessages, "deduplicated from item done") {
+		t.Errorf("expected the duplicate to be completed with the earlier result, got %s with %s: %s", i.Status, i.Result, i.ErrorMessages)
+	}
+	if s := w.Stats(); s.ItemsDeduplicated != 1 || s.ItemsCompleted != 3 {
+		t.Errorf("expected 1 of 3 completions to be deduplicated, got %d of %d", s.ItemsDeduplicated, s.ItemsCompleted)
+	}
+}
+
+func TestDataHashOfEncryptedItems(t *testing.T) {
+	r := openTestRepo(t)
+	r.Encryptor = testEncryptor()
+	r.EncryptionKeyID = "k1"
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	given := HashData([]byte(`{"patient":"jane"}`))
+	if err := r.CreateItems(ctx,
+		&Item{BaseModel: BaseModel{ID: "unhashed"}, PartitionID: "p", Data: []byte(`{"patient":"john"}`)},
+		&Item{BaseModel: BaseModel{ID: "hashed"}, PartitionID: "p", Data: []byte(`{"patient":"jane"}`), DataHash: given},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if i, err := r.GetItem(ctx, "unhashed"); err != nil || i.DataHash != "" {
+		t.Errorf("expected an encrypted payload not to be hashed, got %+v %v", i, err)
+	}
+	i, err := r.GetItem(ctx, "hashed")
+	if err != nil || i.DataHash != given {
+		t.Fatalf("expected the given hash to be kept, got %+v %v", i, err)
+	}
+	i.Status = Complete
+	if !r.Save(ctx, i) {
+		t.Fatal("error saving item")
+	}
+	if found, err := r.FindCompletedByHash(ctx, "p", 0, given); err != nil || found.ID != "hashed" || string(found.Data) != `{"patient":"jane"}` {
+		t.Errorf("expected to find the item by its given hash, got %+v %v", found, err)
+	}
+	if _, err := r.FindCompletedByHash(ctx, "p", 1, given); !IsNotFound(err) {
+		t.Errorf("expected no item completed at another gate, got %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	"gorm.io/gorm"
+)
+
+// ErrDependencyCycle is wrapped by the ErrValidation returned when a new partition would
+// depend, directly or not, on itself.
+var ErrDependencyCycle = errors.New("dependency cycle")
+
+// checkDependencies rejects a new partition whose chain of dependencies leads back to it.
+// Dependencies may be created after their dependents, which can close a cycle.
+func (db *GormRepo) checkDependencies(ctx context.Context, p *Partition) error {
+	chain := []string{p.ID}
+	for id := p.DependsOn; id != ""; {
+		chain = append(chain, id)
+		if id == p.ID {
+			reason := fmt.Sprintf("partition %s would depend on itself through %s", p.ID, strings.Join(chain, " -> "))
+			return &ErrValidation{Field: "depends_on", Reason: reason, Err: ErrDependencyCycle}
+		}
+		dep := &Partition{}
+		err := db.WithContext(ctx).Select("id", "depends_on").Where("id = ?", id).Take(dep).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		id = dep.DependsOn
+	}
+	return nil
+}
+
+// unblockDependents wakes the watcher once the partition completes, so that the partitions
+// depending on it are leased on the next scan rather than after an idle backoff.
+func (w *Watcher) unblockDependents(ctx context.Context, p *Partition) {
+	dependents, _, err := w.Repo.ListPartitions(ctx, PartitionFilter{DependsOn: p.ID}, PageRequest{})
+	if err != nil {
+		glog.Warningf("error listing the dependents of partition %s: %s", p.ID, err)
+		return
+	}
+	if len(dependents) == 0 {
+		return
+	}
+	for _, d := range dependents {
+		glog.Infof("partition %s completed, unblocking partition %s", p.ID, d.ID)
+	}
+	w.noteWork()
+}
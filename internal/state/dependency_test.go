@@ -0,0 +1,99 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dependencyProcessor records whether the dependency of the items' partition was complete
+// when they were processed.
+type dependencyProcessor struct {
+	testProcessor
+	r *GormRepo
+
+	mu      sync.Mutex
+	blocked []string
+}
+
+func (p *dependencyProcessor) Process(id string, b []byte) (*ProcessorResponse, error) {
+	i, err := p.r.GetItem(context.Background(), id)
+	if err != nil {
+		return nil, err
+	}
+	partition, err := p.r.GetPartition(context.Background(), i.PartitionID)
+	if err != nil {
+		return nil, err
+	}
+	if partition.DependsOn != "" {
+		dep, err := p.r.GetPartition(context.Background(), partition.DependsOn)
+		if err != nil || dep.Status != Complete {
+			p.mu.Lock()
+			p.blocked = append(p.blocked, id)
+			p.mu.Unlock()
+		}
+	}
+	return &ProcessorResponse{Complete: true, Data: b}, nil
+}
+
+func TestPartitionDependency(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	for _, p := range []*Partition{
+		{BaseModel: BaseModel{ID: "b"}, DependsOn: "a"},
+		{BaseModel: BaseModel{ID: "a"}},
+	} {
+		if err := r.CreatePartition(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var items []*Item
+	for n := 0; n < 5; n++ {
+		for _, p := range []string{"a", "b"} {
+			items = append(items, &Item{BaseModel: BaseModel{ID: fmt.Sprintf("%s%d", p, n)}, PartitionID: p, Data: []byte(`{}`)})
+		}
+	}
+	if err := r.CreateItems(ctx, items...); err != nil {
+		t.Fatal(err)
+	}
+
+	proc := &dependencyProcessor{r: r}
+	w := &Watcher{Processor: proc, Repo: r, BatchSize: 2, PollInterval: 10 * time.Millisecond, AutoClose: true}
+	events := w.Events()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		w.Start(ctx)
+		close(done)
+	}()
+
+	var completed []string
+	timeout := time.After(10 * time.Second)
+	for len(completed) < 2 {
+		select {
+		case e := <-events:
+			if e.Type == PartitionCompleted {
+				completed = append(completed, e.PartitionID)
+			}
+		case <-timeout:
+			t.Fatalf("partitions did not complete, got %v", completed)
+		}
+	}
+	cancel()
+	<-done
+
+	if completed[0] != "a" || completed[1] != "b" {
+		t.Errorf("expected a to complete before b, got %v", completed)
+	}
+	if len(proc.blocked) > 0 {
+		t.Errorf("expected b's items to wait for a to complete, got %v processed early", proc.blocked)
+	}
+	for _, i := range items {
+		if i, err := r.GetItem(context.Background(), i.ID); err != nil || i.Status != Complete {
+			t.Errorf("expected item %v to be processed, got %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package state
+
+import "sync"
+
+// DispatchPolicy shares the watcher's item processors between groups of partitions, e.g. the
+// partitions of each tenant, so that a burst of one group can't monopolize them.
+type DispatchPolicy struct {
+	// FairShare interleaves the items of the groups proportionally to their Weights, with
+	// deficit round robin: each round, every group with items to process gets as many of its
+	// items dispatched as its weight, its partitions taking turns. As every weight is at least
+	// 1, the group with the lowest weight still gets an item every round, however large the
+	// backlog of the others. Without it, all partitions take turns as a single group.
+	FairShare bool
+	// GroupLabel, if set, groups partitions by their value of the label, rather than by tenant.
+	// Partitions without the label make up a group of their own.
+	GroupLabel string
+	// Weights are the shares of the groups, keyed by tenant or label value. Groups without a
+	// weight, or with a weight below 1, have a weight of 1, for equal shares by default.
+	Weights map[string]int
+}
+
+// group returns the group of the item's partition.
+func (p DispatchPolicy) group(i *Item) string {
+	switch {
+	case !p.FairShare:
+		return ""
+	case p.GroupLabel != "":
+		return i.partition.labels[p.GroupLabel]
+	}
+	return i.Tenant
+}
+
+// weight returns the weight of the group.
+func (p DispatchPolicy) weight(group string) int {
+	if w := p.Weights[group]; w > 1 {
+		return w
+	}
+	return 1
+}
+
+// dispatcher hands the items of each leased partition to the item processors round-robin, so
+// that a partition with a large backlog can't starve the others, and across the groups of
+// partitions of its policy, so that neither can a group. Each partition has its own budget of
+// items queued or in flight, within its MaxConcurrency if set.
+type dispatcher struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	policy DispatchPolicy
+	queues map[string]*partitionQueue
+	groups map[string]*dispatchGroup
+	// order is the round-robin ring of groups, and next the group to take from next.
+	order  []string
+	next   int
+	closed bool
+	// limit, if set, is the most items in flight at once, across partitions, and running the
+	// number of items in flight.
+	limit   int
+	running int
+	// seq counts the items finished, and finished holds the seq at which each partition's
+	// items finished, until a fetch started after it is offered.
+	seq      uint64
+	finished map[string]map[string]uint64
+}
+
+type partitionQueue struct {
+	items []*Item
+	// pending are the IDs of the items queued or in flight.
+	pending  map[string]bool
+	inFlight int
+	// maxConcurrency is the partition's MaxConcurrency, as of its items last offered.
+	maxConcurrency int
+	// group is the partition's group, as of its items first offered.
+	group string
+}
+
+// dispatchGroup is a group of partitions of the dispatcher's policy.
+type dispatchGroup struct {
+	// order is the round-robin ring of the group's partitions, and next the partition to take
+	// from next.
+	order []string
+	next  int
+	// deficit is the number of items the group may still take in the current round.
+	deficit int
+}
+
+// init must be called with mu held.
+func (d *dispatcher) init() {
+	if d.cond == nil {
+		d.cond = sync.NewCond(&d.mu)
+		d.queues = map[string]*partitionQueue{}
+		d.groups = map[string]*dispatchGroup{}
+		d.finished = map[string]map[string]uint64{}
+	}
+}
+
+// budget returns how many more items the partition may have queued or in flight.
+func (d *dispatcher) budget(partitionID string, max int) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.init()
+	if q, ok := d.queues[partitionID]; ok {
+		return max - len(q.pending)
+	}
+	return max
+}
+
+// mark returns the point to offer the items fetched from now on since.
+func (d *dispatcher) mark() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.seq
+}
+
+// offer queues those of the items which aren't already queued or in flight, up to the
+// partition's budget. Items which finished since the mark taken before fetching them are
+// stale copies, and are skipped too. Returns the number of items queued.
+func (d *dispatcher) offer(partitionID string, items []*Item, max int, since uint64) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.init()
+	finished := d.finished[partitionID]
+	for id, seq := range finished {
+		if seq <= since {
+			delete(finished, id)
+		}
+	}
+	if len(items) == 0 {
+		return 0
+	}
+	q, ok := d.queues[partitionID]
+	if !ok {
+		q = &partitionQueue{pending: map[string]bool{}, group: d.policy.group(items[0])}
+		d.queues[partitionID] = q
+		g, ok := d.groups[q.group]
+		if !ok {
+			g = &dispatchGroup{}
+			d.groups[q.group] = g
+			d.order = append(d.order, q.group)
+		}
+		g.order = append(g.order, partitionID)
+	}
+	q.maxConcurrency = items[0].partition.maxConcurrency
+	added := 0
+	for _, i := range items {
+		if len(q.pending) >= max {
+			break
+		}
+		if q.pending[i.ID] || finished[i.ID] > since {
+			continue
+		}
+		q.pending[i.ID] = true
+		q.items = append(q.items, i)
+		added++
+	}
+	if added > 0 {
+		d.cond.Broadcast()
+	}
+	return added
+}
+
+// take blocks until an item is available, taking from each group and each of its partitions
+// in turn, skipping the partitions with as many items in flight as their MaxConcurrency,
+// whatever the number of item processors, and waiting while the limit is reached. Returns
+// false once the dispatcher is closed.
+func (d *dispatcher) take() (*Item, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.init()
+	for !d.closed {
+		if d.limit <= 0 || d.running < d.limit {
+			if i := d.takeNext(); i != nil {
+				d.running++
+				return i, true
+			}
+		}
+		d.cond.Wait()
+	}
+	return nil, false
+}
+
+// takeNext takes the next item of the current round, starting the next round once every
+// group with items to take spent its share of the current one, or returns nil if there are
+// none to take. Must be called with mu held.
+func (d *dispatcher) takeNext() *Item {
+	for round := 0; round < 2; round++ {
+		for n := 0; n < len(d.order); n++ {
+			k := (d.next + n) % len(d.order)
+			g := d.groups[d.order[k]]
+			if g.deficit <= 0 {
+				continue
+			}
+			i := d.takeFrom(g)
+			if i == nil {
+				// A group without items to take forfeits the rest of its share.
+				g.deficit = 0
+				continue
+			}
+			g.deficit--
+			d.next = k
+			if g.deficit == 0 {
+				d.next = (k + 1) % len(d.order)
+			}
+			return i
+		}
+		for id, g := range d.groups {
+			g.deficit = d.policy.weight(id)
+		}
+	}
+	return nil
+}
+
+// takeFrom takes the next item of the group's partitions in turn, or returns nil if there are
+// none to take. Must be called with mu held.
+func (d *dispatcher) takeFrom(g *dispatchGroup) *Item {
+	for n := 0; n < len(g.order); n++ {
+		id := g.order[(g.next+n)%len(g.order)]
+		q := d.queues[id]
+		if len(q.items) == 0 || (q.maxConcurrency > 0 && q.inFlight >= q.maxConcurrency) {
+			continue
+		}
+		g.next = (g.next + n + 1) % len(g.order)
+		i := q.items[0]
+		q.items = q.items[1:]
+		q.inFlight++
+		return i
+	}
+	return nil
+}
+
+// done releases the budget used by an item returned by take.
+func (d *dispatcher) done(i *Item) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.init()
+	if q, ok := d.queues[i.PartitionID]; ok && q.pending[i.ID] {
+		d.seq++
+		if d.finished[i.PartitionID] == nil {
+			d.finished[i.PartitionID] = map[string]uint64{}
+		}
+		d.finished[i.PartitionID][i.ID] = d.seq
+		delete(q.pending, i.ID)
+		q.inFlight--
+		d.running--
+		if d.limit > 0 || (q.maxConcurrency > 0 && len(q.items) > 0) {
+			// Queued items may be waiting for the room.
+			d.cond.Broadcast()
+		}
+		d.removeIfIdle(i.PartitionID)
+	}
+}
+
+// drop discards the queued items of a partition which is no longer leased. Items already in
+// flight still complete.
+func (d *dispatcher) drop(partitionID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.finished, partitionID)
+	if q, ok := d.queues[partitionID]; ok {
+		for _, i := range q.items {
+			delete(q.pending, i.ID)
+		}
+		q.items = nil
+		d.removeIfIdle(partitionID)
+	}
+}
+
+// removeIfIdle removes the partition from its group once nothing is queued or in flight, and
+// the group from the ring once it has no partitions left. Must be called with mu held.
+func (d *dispatcher) removeIfIdle(partitionID string) {
+	q := d.queues[partitionID]
+	if len(q.pending) > 0 {
+		return
+	}
+	delete(d.queues, partitionID)
+	g := d.groups[q.group]
+	g.order, g.next = removeFromRing(g.order, g.next, partitionID)
+	if len(g.order) == 0 {
+		delete(d.groups, q.group)
+		d.order, d.next = removeFromRing(d.order, d.next, q.group)
+	}
+}
+
+// removeFromRing removes the ID from the ring, returning the ring and the position of its next
+// ID to take from.
+func removeFromRing(ring []string, next int, id string) ([]string, int) {
+	for n, other := range ring {
+		if other == id {
+			ring = append(ring[:n], ring[n+1:]...)
+			if next > n {
+				next--
+			}
+			break
+		}
+	}
+	if next >= len(ring) {
+		next = 0
+	}
+	return ring, next
+}
+
+// setLimit sets the most items in flight at once, across partitions, none if not positive.
+func (d *dispatcher) setLimit(limit int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.init()
+	d.limit = limit
+	d.cond.Broadcast()
+}
+
+// close wakes every blocked take, which then return false.
+func (d *dispatcher) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.init()
+	d.closed = true
+	d.cond.Broadcast()
+}
+
+// queued returns the number of items waiting for an item processor.
+func (d *dispatcher) queued() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for _, q := range d.queues {
+		n += len(q.items)
+	}
+	return n
+}
+
+// inFlight returns the number of items being processed for each partition.
+func (d *dispatcher) inFlight() map[string]int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	counts := map[string]int{}
+	for id, q := range d.queues {
+		if q.inFlight > 0 {
+			counts[id] = q.inFlight
+		}
+	}
+	return counts
+}
+
+// maxConcurrency returns the MaxConcurrency of each partition with items queued or in flight
+// which sets one.
+func (d *dispatcher) maxConcurrency() map[string]int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	caps := map[string]int{}
+	for id, q := range d.queues {
+		if q.maxConcurrency > 0 {
+			caps[id] = q.maxConcurrency
+		}
+	}
+	return caps
+}
@@ -0,0 +1,421 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testItems(partitionID string, n int) (items []*Item) {
+	for i := 0; i < n; i++ {
+		items = append(items, &Item{BaseModel: BaseModel{ID: fmt.Sprintf("%s_%d", partitionID, i)}, PartitionID: partitionID})
+	}
+	return items
+}
+
+func TestDispatcher(t *testing.T) {
+	var d dispatcher
+	if n := d.offer("big", testItems("big", 5), 3, 0); n != 3 {
+		t.Errorf("expected the partition budget to limit queued items, got %d", n)
+	}
+	if n := d.offer("big", testItems("big", 5), 3, 0); n != 0 {
+		t.Errorf("expected pending items not to be queued twice, got %d", n)
+	}
+	d.offer("small", testItems("small", 1), 3, 0)
+
+	var order []string
+	for n := 0; n < 3; n++ {
+		i, ok := d.take()
+		if !ok {
+			t.Fatal("expected an item")
+		}
+		order = append(order, i.ID)
+	}
+	if want := []string{"big_0", "small_0", "big_1"}; fmt.Sprint(order) != fmt.Sprint(want) {
+		t.Errorf("expected partitions to take turns %v, got %v", want, order)
+	}
+	if got := d.inFlight(); got["big"] != 2 || got["small"] != 1 {
+		t.Errorf("unexpected in flight counts %v", got)
+	}
+	if n := d.budget("big", 3); n != 0 {
+		t.Errorf("expected in flight items to use the budget, got %d", n)
+	}
+
+	since := d.mark()
+	d.done(&Item{BaseModel: BaseModel{ID: "big_0"}, PartitionID: "big"})
+	if n := d.budget("big", 3); n != 1 {
+		t.Errorf("expected a finished item to free the budget, got %d", n)
+	}
+	if n := d.offer("big", testItems("big", 1), 3, since); n != 0 {
+		t.Errorf("expected an item fetched before it finished not to be queued again, got %d", n)
+	}
+	if n := d.offer("big", testItems("big", 1), 3, d.mark()); n != 1 {
+		t.Errorf("expected an item fetched after it finished to be queued, got %d", n)
+	}
+	d.drop("big")
+	if n := d.queued(); n != 0 {
+		t.Errorf("expected dropped items to be discarded, got %d queued", n)
+	}
+
+	capped := testItems("capped", 3)
+	for _, i := range capped {
+		i.partition.maxConcurrency = 2
+	}
+	d.offer("capped", capped, 3, d.mark())
+	for n := 0; n < 2; n++ {
+		if i, _ := d.take(); i.PartitionID != "capped" {
+			t.Errorf("expected an item of the capped partition, got %s", i.ID)
+		}
+	}
+	if got := d.maxConcurrency(); got["capped"] != 2 || len(got) != 1 {
+		t.Errorf("unexpected MaxConcurrency %v", got)
+	}
+	// The third item waits for one of the others to finish.
+	third := make(chan *Item)
+	go func() {
+		i, _ := d.take()
+		third <- i
+	}()
+	select {
+	case i := <-third:
+		t.Fatalf("expected the partition's MaxConcurrency to hold %s back", i.ID)
+	case <-time.After(10 * time.Millisecond):
+	}
+	d.done(capped[0])
+	if i := <-third; i.ID != capped[2].ID {
+		t.Errorf("expected the third item once the first finished, got %s", i.ID)
+	}
+	d.done(capped[1])
+	d.done(capped[2])
+
+	taken := make(chan bool)
+	go func() {
+		_, ok := d.take()
+		taken <- ok
+	}()
+	d.close()
+	if <-taken {
+		t.Error("expected take to return false once closed")
+	}
+}
+
+// tenantItems returns n items of each of the tenant's partitions.
+func tenantItems(tenant string, partitions, n int) (items []*Item) {
+	for p := 0; p < partitions; p++ {
+		for _, i := range testItems(fmt.Sprintf("%s%d", tenant, p), n) {
+			i.Tenant = tenant
+			items = append(items, i)
+		}
+	}
+	return items
+}
+
+// offerAll offers the items by partition, without a budget.
+func offerAll(d *dispatcher, items []*Item) {
+	byPartition := map[string][]*Item{}
+	var ids []string
+	for _, i := range items {
+		if byPartition[i.PartitionID] == nil {
+			ids = append(ids, i.PartitionID)
+		}
+		byPartition[i.PartitionID] = append(byPartition[i.PartitionID], i)
+	}
+	for _, id := range ids {
+		d.offer(id, byPartition[id], len(byPartition[id]), d.mark())
+	}
+}
+
+// takeByTenant takes n items, and counts them by tenant.
+func takeByTenant(t *testing.T, d *dispatcher, n int) map[string]int {
+	t.Helper()
+	counts := map[string]int{}
+	for ; n > 0; n-- {
+		i, ok := d.take()
+		if !ok {
+			t.Fatal("expected an item")
+		}
+		counts[i.Tenant]++
+	}
+	return counts
+}
+
+func TestDispatcherFairShare(t *testing.T) {
+	// Tenant a has 10k items over 100 partitions, and b 10 items.
+	d := dispatcher{policy: DispatchPolicy{FairShare: true}}
+	offerAll(&d, append(tenantItems("a", 100, 100), tenantItems("b", 1, 10)...))
+	if got := takeByTenant(t, &d, 20); got["b"] != 10 {
+		t.Errorf("expected every item of b within the first 10 rounds, got %v", got)
+	}
+
+	// Without a policy, b is a partition among a's.
+	d = dispatcher{}
+	offerAll(&d, append(tenantItems("a", 100, 100), tenantItems("b", 1, 10)...))
+	if got := takeByTenant(t, &d, 20); got["b"] > 1 {
+		t.Errorf("expected b's partition to take its turn among a's, got %v", got)
+	}
+}
+
+func TestDispatcherWeights(t *testing.T) {
+	d := dispatcher{policy: DispatchPolicy{FairShare: true, Weights: map[string]int{"a": 3, "c": 100}}}
+	offerAll(&d, append(tenantItems("a", 2, 100), tenantItems("b", 3, 100)...))
+	if got := takeByTenant(t, &d, 40); got["a"] != 30 || got["b"] != 10 {
+		t.Errorf("expected 3 items of a for each of b, got %v", got)
+	}
+
+	// The group with the lowest weight still gets an item each round.
+	offerAll(&d, tenantItems("c", 1, 200))
+	if got := takeByTenant(t, &d, 104); got["b"] != 1 || got["c"] != 100 {
+		t.Errorf("expected an item of b every round, got %v", got)
+	}
+}
+
+func TestDispatcherGroupLabel(t *testing.T) {
+	d := dispatcher{policy: DispatchPolicy{FairShare: true, GroupLabel: "team"}}
+	// The partitions of teams x and y, and those without a team, are all of the same tenant.
+	var items []*Item
+	for _, team := range []string{"x", "y", ""} {
+		for _, i := range tenantItems(team, 25, 10) {
+			i.Tenant = "t"
+			if team != "" {
+				i.partition.labels = PartitionLabels{"team": team}
+			}
+			items = append(items, i)
+		}
+	}
+	offerAll(&d, items)
+	counts := map[string]int{}
+	for n := 0; n < 30; n++ {
+		i, _ := d.take()
+		counts[i.partition.labels["team"]]++
+	}
+	if counts["x"] != 10 || counts["y"] != 10 || counts[""] != 10 {
+		t.Errorf("expected each team and the partitions without one to get a third of the items, got %v", counts)
+	}
+}
+
+func TestDispatcherLimit(t *testing.T) {
+	var d dispatcher
+	d.setLimit(1)
+	d.offer("p", testItems("p", 2), 2, 0)
+	first, _ := d.take()
+	second := make(chan *Item)
+	go func() {
+		i, _ := d.take()
+		second <- i
+	}()
+	select {
+	case i := <-second:
+		t.Fatalf("expected the limit to hold %s back", i.ID)
+	case <-time.After(10 * time.Millisecond):
+	}
+	d.done(first)
+	if i := <-second; i.ID != "p_1" {
+		t.Errorf("expected the second item once the first finished, got %s", i.ID)
+	}
+}
+
+type slowProcessor struct {
+	testProcessor
+	delay time.Duration
+}
+
+func (p *slowProcessor) Process(id string, buf []byte) (*ProcessorResponse, error) {
+	time.Sleep(p.delay)
+	return p.testProcessor.Process(id, buf)
+}
+
+func TestSmallPartitionNotStarved(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "huge"}})
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "tiny"}})
+	var items []*Item
+	for _, i := range append(testItems("huge", 200), testItems("tiny", 2)...) {
+		i.Data = []byte(`{"times": 1}`)
+		items = append(items, i)
+	}
+	if err := r.CreateItems(ctx, items...); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &Watcher{
+		Processor:    &slowProcessor{delay: 5 * time.Millisecond},
+		Repo:         r,
+		BatchSize:    4,
+		PollInterval: 10 * time.Millisecond,
+	}
+	events := w.Events()
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		w.Start(wctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		for range events {
+		}
+		<-done
+	}()
+
+	completed, tiny := 0, 0
+	timeout := time.After(10 * time.Second)
+	for tiny < 2 {
+		select {
+		case e := <-events:
+			if e.Type != ItemCompleted {
+				continue
+			}
+			completed++
+			if e.PartitionID == "tiny" {
+				tiny++
+			}
+		case <-timeout:
+			t.Fatalf("tiny partition did not complete, %d items completed", completed)
+		}
+	}
+	// Allow a poll or two of the huge partition before the tiny one was leased.
+	if completed > 20 {
+		t.Errorf("expected the tiny partition to complete promptly, %d items completed first", completed-tiny)
+	}
+}
+
+// concurrencyProcessor is a slowProcessor recording the most items of each partition processed
+// at once, the items' IDs being those of testItems.
+type concurrencyProcessor struct {
+	slowProcessor
+	mu      sync.Mutex
+	current map[string]int
+	max     map[string]int
+}
+
+func (p *concurrencyProcessor) Process(id string, buf []byte) (*ProcessorResponse, error) {
+	partitionID := id[:strings.LastIndex(id, "_")]
+	p.mu.Lock()
+	if p.current == nil {
+		p.current, p.max = map[string]int{}, map[string]int{}
+	}
+	p.current[partitionID]++
+	if p.current[partitionID] > p.max[partitionID] {
+		p.max[partitionID] = p.current[partitionID]
+	}
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.current[partitionID]--
+		p.mu.Unlock()
+	}()
+	return p.slowProcessor.Process(id, buf)
+}
+
+// createCappedPartitions creates a partition "capped" with a MaxConcurrency of 2 and one
+// "free" without, each with 10 items.
+func createCappedPartitions(t *testing.T, r *GormRepo) {
+	t.Helper()
+	ctx := context.Background()
+	for id, max := range map[string]int{"capped": 2, "free": 0} {
+		if err := r.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: id}, MaxConcurrency: max}); err != nil {
+			t.Fatal(err)
+		}
+		items := testItems(id, 10)
+		for _, i := range items {
+			i.Data = []byte(`{"times": 1}`)
+		}
+		if err := r.CreateItems(ctx, items...); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// runUntilComplete runs the watchers until the partitions complete.
+func runUntilComplete(t *testing.T, r *GormRepo, ids []string, watchers ...*Watcher) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for _, w := range watchers {
+		wg.Add(1)
+		go func(w *Watcher) {
+			w.Start(ctx)
+			wg.Done()
+		}(w)
+	}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	for start := time.Now(); ; time.Sleep(5 * time.Millisecond) {
+		done := true
+		for _, id := range ids {
+			if p, err := r.GetPartition(ctx, id); err != nil || p.Status != Complete {
+				done = false
+			}
+		}
+		if done {
+			return
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("partitions %v never completed", ids)
+		}
+	}
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	r := openTestRepo(t)
+	createCappedPartitions(t, r)
+	proc := &concurrencyProcessor{slowProcessor: slowProcessor{delay: 20 * time.Millisecond}}
+	w := &Watcher{Processor: proc, Repo: r, BatchSize: 8, PollInterval: 5 * time.Millisecond, AutoClose: true}
+	runUntilComplete(t, r, []string{"capped", "free"}, w)
+	if proc.max["capped"] != 2 {
+		t.Errorf("expected up to 2 items of the capped partition in flight at once, got %d", proc.max["capped"])
+	}
+	if proc.max["free"] <= 2 {
+		t.Errorf("expected the other partition's items to use the rest of the batch, got %d in flight", proc.max["free"])
+	}
+}
+
+// groupMetrics counts the items processed by group.
+type groupMetrics struct {
+	nopMetrics
+	mu     sync.Mutex
+	groups map[string]float64
+}
+
+func (m *groupMetrics) Counter(name string, delta float64, labels Labels) {
+	if name != MetricGroupItemsProcessed {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.groups[labels["group"]] += delta
+}
+
+func TestWatcherFairShareMetrics(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	for team, n := range map[string]int{"x": 3, "y": 5} {
+		id := "p" + team
+		if err := r.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: id}, Labels: PartitionLabels{"team": team}}); err != nil {
+			t.Fatal(err)
+		}
+		items := testItems(id, n)
+		for _, i := range items {
+			i.Data = []byte(`{"times": 1}`)
+		}
+		if err := r.CreateItems(ctx, items...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := &groupMetrics{groups: map[string]float64{}}
+	w := &Watcher{Processor: &testProcessor{}, Repo: r, BatchSize: 2, PollInterval: 5 * time.Millisecond, AutoClose: true,
+		Metrics: m, Dispatch: DispatchPolicy{FairShare: true, GroupLabel: "team"}}
+	runUntilComplete(t, r, []string{"px", "py"}, w)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.groups["x"] != 3 || m.groups["y"] != 5 {
+		t.Errorf("expected the items processed to be counted by team, got %v", m.groups)
+	}
+}
@@ -0,0 +1,78 @@
+package state
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/glog"
+	"gorm.io/gorm"
+)
+
+// DefaultAbandonBackoff is how long a partition a watcher found nothing to do in isn't leased
+// again for, see Watcher.AbandonBackoff.
+var DefaultAbandonBackoff = 5 * time.Minute
+
+// leaseableStatuses are the statuses of partitions a watcher may make progress on, listed so
+// that the partitions' lease index can be used.
+var leaseableStatuses = []Status{Unknown, Available, Failed}
+
+// eligibleForLease narrows a query of partitions to those a watcher may make progress on as of
+// now: Available ones, and Failed ones without failed items, which the watcher recovers, or
+// every Failed one with LeaseFailedPartitions. Their ActivateAt and LeaseableAfter, if any,
+// must have passed. Complete and Cancelled partitions are never leased.
+func (db *GormRepo) eligibleForLease(ctx context.Context, tx *gorm.DB, now time.Time) *gorm.DB {
+	tx = tx.Where("status IN (?)", leaseableStatuses)
+	if !db.LeaseFailedPartitions {
+		failed := db.reader(ctx).WithContext(ctx).Model(&Item{}).Select("partition_id").Where("status = ?", Failed)
+		tx = tx.Where("status <> ? OR id NOT IN (?)", Failed, failed)
+	}
+	tx = tx.Where("activate_at IS NULL OR activate_at <= ?", now)
+	return tx.Where("leaseable_after IS NULL OR leaseable_after <= ?", now)
+}
+
+// makeLeaseable clears the LeaseableAfter of the partitions matching the query, as they may
+// have work to do again.
+func (db *GormRepo) makeLeaseable(ctx context.Context, query interface{}, args ...interface{}) error {
+	return db.WithContext(ctx).Model(&Partition{}).Where("leaseable_after IS NOT NULL").Where(
+		query, args...).UpdateColumn("leaseable_after", nil).Error
+}
+
+// itemPartitionIDs returns the IDs of the items' partitions, once each.
+func itemPartitionIDs(items []*Item) []string {
+	var ids []string
+	seen := map[string]bool{}
+	for _, i := range items {
+		if !seen[i.PartitionID] {
+			seen[i.PartitionID] = true
+			ids = append(ids, i.PartitionID)
+		}
+	}
+	return ids
+}
+
+// idle returns whether the poll of a partition found nothing for the watcher to do: its
+// status and gate are left as they were, and none of its items are Available. Partitions
+// without items yet aren't idle, as their items are likely about to be created.
+func (poll *partitionPoll) idle(p *Partition) bool {
+	total := 0
+	for _, n := range poll.counts {
+		total += n
+	}
+	return p.Status == poll.status && p.Gate == poll.gate && len(poll.items) == 0 && poll.counts[Available] == 0 && total > 0
+}
+
+// abandon leaves a partition the watcher found nothing to do in unleased, and keeps it from
+// being leased again for the AbandonBackoff, rather than polling it until something changes.
+func (w *Watcher) abandon(ctx context.Context, p *Partition) {
+	ctx, cancel := w.saveContext(ctx)
+	defer cancel()
+	after := w.Clock.Now().Add(w.AbandonBackoff)
+	p.LeaseableAfter = &after
+	if !w.Repo.Save(ctx, p) {
+		glog.Warningf("error backing off partition %s", p.ID)
+		return
+	}
+	glog.Infof("nothing to do in partition %s, not leasing it until %s", p.ID, after)
+	// The lease claimed when the partition was scanned is released along with it.
+	w.releaseLease(p)
+}
@@ -0,0 +1,127 @@
+package state_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state/statetest"
+)
+
+// seedTerminal creates n partitions of each terminal kind: Complete, Cancelled, and Failed
+// with a failed item.
+func seedTerminal(t *testing.T, r *state.GormRepo, n int) {
+	t.Helper()
+	var partitions []*state.Partition
+	var items []*state.Item
+	for k := 0; k < n; k++ {
+		partitions = append(partitions,
+			&state.Partition{BaseModel: state.BaseModel{ID: fmt.Sprintf("complete-%d", k)}, Status: state.Complete},
+			&state.Partition{BaseModel: state.BaseModel{ID: fmt.Sprintf("cancelled-%d", k)}, Status: state.Cancelled},
+			&state.Partition{BaseModel: state.BaseModel{ID: fmt.Sprintf("failed-%d", k)}, Status: state.Failed})
+		items = append(items, &state.Item{BaseModel: state.BaseModel{ID: fmt.Sprintf("failed-%d", k)}, PartitionID: fmt.Sprintf("failed-%d", k),
+			Status: state.Failed, Data: []byte(`{}`), Metadata: state.ItemMetadata{}})
+	}
+	if err := r.DB.CreateInBatches(partitions, 200).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := r.DB.CreateInBatches(items, 200).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func leaseIDs(t *testing.T, r *state.GormRepo) []string {
+	t.Helper()
+	partitions, err := r.GetPotentialLeases(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, p := range partitions {
+		ids = append(ids, p.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestLeaseEligibility(t *testing.T) {
+	r := statetest.NewSQLiteRepo(t)
+	ctx := context.Background()
+	seedTerminal(t, r, 1000)
+	later, earlier := time.Now().Add(time.Hour), time.Now().Add(-time.Hour)
+	for _, p := range []*state.Partition{
+		{BaseModel: state.BaseModel{ID: "available"}},
+		{BaseModel: state.BaseModel{ID: "recoverable"}, Status: state.Failed},
+		{BaseModel: state.BaseModel{ID: "backing-off"}, LeaseableAfter: &later},
+		{BaseModel: state.BaseModel{ID: "backed-off"}, LeaseableAfter: &earlier},
+	} {
+		if err := r.CreatePartition(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the partitions a watcher can make progress on are returned, however many others.
+	if got, want := leaseIDs(t, r), []string{"available", "backed-off", "recoverable"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the eligible partitions %v, got %v", want, got)
+	}
+	withFailed := *r
+	withFailed.LeaseFailedPartitions = true
+	if got := leaseIDs(t, &withFailed); len(got) != 1003 {
+		t.Errorf("expected the failed partitions to be eligible with LeaseFailedPartitions, got %d", len(got))
+	}
+
+	// Creating items ends the backoff.
+	if err := r.CreateItems(ctx, &state.Item{BaseModel: state.BaseModel{ID: "new"}, PartitionID: "backing-off", Data: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := leaseIDs(t, r), []string{"available", "backed-off", "backing-off", "recoverable"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the partition to be eligible once it has new items, got %v", got)
+	}
+}
+
+func TestWatcherBacksOffIdlePartitions(t *testing.T) {
+	ctx := context.Background()
+	sim := statetest.NewSimulator(1, simStart)
+	r := statetest.NewSQLiteRepo(t)
+	r.Clock = sim.Clock
+	r.LeaseFailedPartitions = true
+	seedTerminal(t, r, 50)
+	w := simWatcher(r, "w")
+	w.AbandonBackoff = 10 * time.Minute
+	sim.Add(w)
+	sim.Run(ctx, 5*time.Minute)
+
+	// Each failed partition is polled once, rather than on every lease scan.
+	polls, scans := 0, 0
+	for _, s := range sim.History {
+		switch s.Kind {
+		case statetest.FetchStep:
+			polls++
+		case statetest.ScanStep:
+			scans++
+		}
+	}
+	if polls != 50 || scans < 100 {
+		t.Errorf("expected each of the 50 failed partitions to be polled once over %d scans, got %d polls", scans, polls)
+	}
+	p, err := r.GetPartition(ctx, "failed-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Owner != "" || p.LeaseableAfter == nil || !p.LeaseableAfter.Equal(simStart.Add(10*time.Minute)) {
+		t.Errorf("expected the partition to be left unleased until the backoff ends, got %+v", p)
+	}
+
+	// Retrying the items ends the backoff, and the partitions recover.
+	if _, err := r.RetryFailedItems(ctx, "failed-0"); err != nil {
+		t.Fatal(err)
+	}
+	sim.Run(ctx, 5*time.Second)
+	if p, err = r.GetPartition(ctx, "failed-0"); err != nil || p.Status != state.Complete {
+		t.Errorf("expected the retried partition to complete, got %+v %v", p, err)
+	}
+}
@@ -0,0 +1,234 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Encryptor encrypts item payloads at rest. Implementations must support decrypting with
+// every key that may still be in use, so that keys can be rotated.
+type Encryptor interface {
+	Encrypt(keyID string, plaintext []byte) ([]byte, error)
+	Decrypt(keyID string, ciphertext []byte) ([]byte, error)
+}
+
+// encryptedPrefix starts every encrypted value, which is stored as
+// enc:<key ID>:<base64 ciphertext>. Values without it are read as plaintext, so encryption
+// can be enabled on an existing database.
+const encryptedPrefix = "enc:"
+
+// seal encrypts b with the key, or returns it as is if empty.
+func (db *GormRepo) seal(keyID string, b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return b, nil
+	}
+	ct, err := db.Encryptor.Encrypt(keyID, b)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(encryptedPrefix + keyID + ":" + base64.StdEncoding.EncodeToString(ct)), nil
+}
+
+// open decrypts b if it was sealed.
+func (db *GormRepo) open(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, []byte(encryptedPrefix)) {
+		return b, nil
+	}
+	if db.Encryptor == nil {
+		return nil, errors.New("value is encrypted, but the repo has no encryptor")
+	}
+	header := string(b[len(encryptedPrefix):])
+	sep := strings.IndexByte(header, ':')
+	if sep < 0 {
+		return nil, errors.New("malformed encrypted value")
+	}
+	ct, err := base64.StdEncoding.DecodeString(header[sep+1:])
+	if err != nil {
+		return nil, fmt.Errorf("malformed encrypted value: %w", err)
+	}
+	return db.Encryptor.Decrypt(header[:sep], ct)
+}
+
+// encrypt replaces the item's sensitive fields with ciphertext until the returned restore
+// function is called.
+func (db *GormRepo) encrypt(i *Item, keyID string) (restore func(), err error) {
+	if db.Encryptor == nil {
+		return func() {}, nil
+	}
+	data, result, errs := i.Data, i.Result, i.ErrorMessages
+	restore = func() { i.Data, i.Result, i.ErrorMessages = data, result, errs }
+	if i.Data, err = db.seal(keyID, data); err != nil {
+		restore()
+		return nil, fmt.Errorf("encrypting data of item %s: %w", i.ID, err)
+	}
+	if i.Result, err = db.seal(keyID, result); err != nil {
+		restore()
+		return nil, fmt.Errorf("encrypting result of item %s: %w", i.ID, err)
+	}
+	sealed, err := db.seal(keyID, []byte(errs))
+	if err != nil {
+		restore()
+		return nil, fmt.Errorf("encrypting error messages of item %s: %w", i.ID, err)
+	}
+	i.ErrorMessages = string(sealed)
+	return restore, nil
+}
+
+// decrypt replaces the item's encrypted fields with their plaintext.
+func (db *GormRepo) decrypt(i *Item) (err error) {
+	if i.Data, err = db.open(i.Data); err != nil {
+		return fmt.Errorf("decrypting data of item %s: %w", i.ID, err)
+	}
+	if i.Result, err = db.open(i.Result); err != nil {
+		return fmt.Errorf("decrypting result of item %s: %w", i.ID, err)
+	}
+	errs, err := db.open([]byte(i.ErrorMessages))
+	if err != nil {
+		return fmt.Errorf("decrypting error messages of item %s: %w", i.ID, err)
+	}
+	i.ErrorMessages = string(errs)
+	return nil
+}
+
+// prepare encrypts and offloads the item's payloads for writing, until the returned restore
+// function is called with whether the item was written.
+func (db *GormRepo) prepare(ctx context.Context, i *Item, keyID string) (restore func(saved bool), err error) {
+	db.hashData(i)
+	restoreEncrypt, err := db.encrypt(i, keyID)
+	if err != nil {
+		return nil, err
+	}
+	restoreOffload, err := db.offload(ctx, i)
+	if err != nil {
+		restoreEncrypt()
+		return nil, err
+	}
+	return func(saved bool) {
+		restoreOffload(saved)
+		restoreEncrypt()
+	}, nil
+}
+
+// load rehydrates and decrypts items read from the database.
+func (db *GormRepo) load(ctx context.Context, items ...*Item) error {
+	if err := db.rehydrate(ctx, items...); err != nil {
+		return err
+	}
+	for _, i := range items {
+		if err := db.decrypt(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReencryptPartition rewrites the payloads of every item in the partition with the given key,
+// and returns the number of items rewritten. Items saved concurrently keep the key they were
+// saved with, so rotation should be completed by running it again once EncryptionKeyID has
+// been updated everywhere.
+func (db *GormRepo) ReencryptPartition(ctx context.Context, id string, keyID string) (int, error) {
+	if db.Encryptor == nil {
+		return 0, errors.New("the repo has no encryptor")
+	}
+	rewritten := 0
+	after := ""
+	for {
+		n, last, err := db.reencryptPage(ctx, id, after, keyID)
+		rewritten += n
+		if err != nil || last == "" {
+			return rewritten, err
+		}
+		after = last
+	}
+}
+
+// reencryptPage rewrites a page of the partition's items with IDs after the given one,
+// returning the number rewritten and the last ID, or an empty ID if there were none.
+func (db *GormRepo) reencryptPage(ctx context.Context, id, after, keyID string) (int, string, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	var items []*Item
+	if err := db.scoped(db.WithContext(ctx)).Where("partition_id = ? AND id > ?", id, after).Order(
+		"id").Limit(DefaultPageSize).Find(&items).Error; err != nil {
+		return 0, "", err
+	}
+	if len(items) == 0 {
+		return 0, "", nil
+	}
+	if err := db.load(ctx, items...); err != nil {
+		return 0, "", err
+	}
+	rewritten := 0
+	for _, i := range items {
+		restore, err := db.prepare(ctx, i, keyID)
+		if err != nil {
+			return rewritten, "", err
+		}
+		// The version is left alone, the item's contents are unchanged.
+		res := db.WithContext(ctx).Model(&Item{}).Where("id = ? AND version = ?", i.ID, i.Version).UpdateColumns(
+			map[string]interface{}{"data": i.Data, "result": i.Result, "error_messages": i.ErrorMessages})
+		restore(res.Error == nil && res.RowsAffected == 1)
+		if res.Error != nil {
+			return rewritten, "", res.Error
+		}
+		rewritten += int(res.RowsAffected)
+	}
+	return rewritten, items[len(items)-1].ID, nil
+}
+
+// AESGCMEncryptor encrypts with AES-256-GCM, using one of several keys by ID.
+type AESGCMEncryptor struct {
+	// Keys are 32 byte AES-256 keys by ID. IDs must not contain ':'.
+	Keys map[string][]byte
+}
+
+func (e *AESGCMEncryptor) aead(keyID string) (cipher.AEAD, error) {
+	key, ok := e.Keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %q", keyID)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key %q must be 32 bytes, got %d", keyID, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt returns the random nonce followed by the sealed plaintext.
+func (e *AESGCMEncryptor) Encrypt(keyID string, plaintext []byte) ([]byte, error) {
+	if strings.ContainsRune(keyID, ':') {
+		return nil, fmt.Errorf("invalid encryption key ID %q", keyID)
+	}
+	aead, err := e.aead(keyID)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (e *AESGCMEncryptor) Decrypt(keyID string, ciphertext []byte) ([]byte, error) {
+	aead, err := e.aead(keyID)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, nil)
+}
@@ -0,0 +1,140 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rawItem returns the item's row as stored in the database.
+func rawItem(t *testing.T, r *GormRepo, id string) *Item {
+	var i Item
+	if err := r.DB.Where("id = ?", id).Take(&i).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &i
+}
+
+func testEncryptor() *AESGCMEncryptor {
+	return &AESGCMEncryptor{Keys: map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 32),
+		"k2": bytes.Repeat([]byte{2}, 32),
+	}}
+}
+
+func TestEncryption(t *testing.T) {
+	defer func(n int) { MaxRetries = n }(MaxRetries)
+	MaxRetries = 0
+	r := openTestRepo(t)
+	r.Encryptor = testEncryptor()
+	r.EncryptionKeyID = "k1"
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "ok"}, PartitionID: "p", Status: Available, Data: []byte(`{"times":1,"patient":"jane"}`)})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "fail"}, PartitionID: "p", Status: Available, Data: []byte(`{"times":1,"fail":true}`)})
+
+	runForEvents(t, r, &Watcher{Processor: &testProcessor{}, Repo: r, BatchSize: 1, PollInterval: 10 * time.Millisecond})
+
+	raw := rawItem(t, r, "ok")
+	for _, b := range [][]byte{raw.Data, raw.Result} {
+		if !bytes.HasPrefix(b, []byte("enc:k1:")) || bytes.Contains(b, []byte("jane")) {
+			t.Errorf("expected ciphertext in the database, got %s", b)
+		}
+	}
+	if raw := rawItem(t, r, "fail"); !strings.HasPrefix(raw.ErrorMessages, "enc:k1:") {
+		t.Errorf("expected encrypted error messages in the database, got %s", raw.ErrorMessages)
+	}
+
+	i, err := r.GetItem(ctx, "ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(i.Data) != `{"times":1,"patient":"jane"}` || i.Status != Complete {
+		t.Errorf("expected the item to round trip, got %s", i.Data)
+	}
+	if got, _ := objFromData(i.Result); got.Processed != 1 {
+		t.Errorf("unexpected result %s", i.Result)
+	}
+	failed, err := r.GetItem(ctx, "fail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed.ErrorMessages != "moving to failed item" {
+		t.Errorf("expected the error messages to round trip, got %q", failed.ErrorMessages)
+	}
+}
+
+func TestReencryptPartition(t *testing.T) {
+	r := openTestRepo(t)
+	enc := testEncryptor()
+	r.Encryptor = enc
+	r.EncryptionKeyID = "k1"
+	r.Blobs = &MemoryBlobStore{}
+	r.BlobThreshold = 512
+	ctx := context.Background()
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "small"}, PartitionID: "p", Status: Available, Data: []byte(`{}`)})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "large"}, PartitionID: "p", Status: Available, Data: largePayload(0)})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "other"}, PartitionID: "q", Status: Available, Data: []byte(`{}`)})
+	// Rows written before encryption was enabled are read as plaintext, and rotated too.
+	r.Encryptor = nil
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "plain"}, PartitionID: "p", Status: Available, Data: []byte(`{}`)})
+	r.Encryptor = enc
+
+	n, err := r.ReencryptPartition(ctx, "p", "k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 items re-encrypted, got %d", n)
+	}
+	if raw := rawItem(t, r, "small"); !bytes.HasPrefix(raw.Data, []byte("enc:k2:")) {
+		t.Errorf("expected the item to use the new key, got %s", raw.Data)
+	}
+	if raw := rawItem(t, r, "plain"); !bytes.HasPrefix(raw.Data, []byte("enc:k2:")) {
+		t.Errorf("expected the plaintext item to be encrypted, got %s", raw.Data)
+	}
+	if raw := rawItem(t, r, "other"); !bytes.HasPrefix(raw.Data, []byte("enc:k1:")) {
+		t.Errorf("expected other partitions to be untouched, got %s", raw.Data)
+	}
+
+	// Retire the old key, the partition must still be readable.
+	delete(enc.Keys, "k1")
+	for id, want := range map[string][]byte{"small": []byte(`{}`), "large": largePayload(0), "plain": []byte(`{}`)} {
+		i, err := r.GetItem(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(i.Data, want) {
+			t.Errorf("unexpected data for %s after rotation: %.40s", id, i.Data)
+		}
+	}
+	if _, err := r.GetItem(ctx, "other"); err == nil {
+		t.Error("expected an error reading an item encrypted with a retired key")
+	}
+}
+
+func TestAESGCMEncryptor(t *testing.T) {
+	enc := testEncryptor()
+	ct, err := enc.Encrypt("k1", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(ct, []byte("secret")) {
+		t.Error("expected ciphertext")
+	}
+	if pt, err := enc.Decrypt("k1", ct); err != nil || string(pt) != "secret" {
+		t.Errorf("expected a round trip, got %q, %v", pt, err)
+	}
+	if _, err := enc.Decrypt("k2", ct); err == nil {
+		t.Error("expected decrypting with the wrong key to fail")
+	}
+	ct[len(ct)-1] ^= 1
+	if _, err := enc.Decrypt("k1", ct); err == nil {
+		t.Error("expected tampered ciphertext to fail")
+	}
+	if _, err := enc.Encrypt("missing", []byte("secret")); err == nil {
+		t.Error("expected an unknown key to fail")
+	}
+}
@@ -0,0 +1,116 @@
+package state
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MaxErrorMessagesSize is the most bytes of an item's ErrorMessages. Past it, the oldest errors
+// are dropped and counted in a first line of "...N earlier errors omitted", so that an item
+// retried indefinitely doesn't outgrow its row. 0 or less leaves them unbounded.
+var MaxErrorMessagesSize = 4 << 10
+
+const omittedErrorsFormat = "...%d earlier errors omitted"
+
+var (
+	timestampPattern = regexp.MustCompile(`\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:?\d{2})?|\b\d{10,}\b`)
+	attemptPattern   = regexp.MustCompile(`(?i)\b(attempt|try|retry)\s*#?\d+\W*$`)
+)
+
+// errorKey returns the message without its timestamps and trailing attempt number, so that
+// repeats of the same error compare equal. The patterns are only matched against messages
+// which may contain them, as every stored error is keyed on each append.
+func errorKey(msg string) string {
+	if strings.ContainsRune(msg, ':') || digitRun(msg) >= 10 {
+		msg = timestampPattern.ReplaceAllString(msg, "")
+	}
+	if lower := strings.ToLower(msg); strings.Contains(lower, "attempt") || strings.Contains(lower, "try") {
+		msg = attemptPattern.ReplaceAllString(msg, "")
+	}
+	return strings.TrimSpace(msg)
+}
+
+// digitRun returns the length of the longest run of digits in s.
+func digitRun(s string) int {
+	longest, run := 0, 0
+	for n := 0; n < len(s); n++ {
+		if s[n] >= '0' && s[n] <= '9' {
+			run++
+			if run > longest {
+				longest = run
+			}
+		} else {
+			run = 0
+		}
+	}
+	return longest
+}
+
+// appendError adds the message to the item's error messages, one per line with the most
+// recent last, up to max bytes. A repeat of an earlier error replaces it.
+func appendError(messages, msg string, max int) string {
+	msg = strings.ReplaceAll(msg, "\n", " ")
+	var lines []string
+	if messages != "" {
+		lines = strings.Split(messages, "\n")
+	}
+	omitted := 0
+	if len(lines) > 0 {
+		if n, ok := parseOmittedErrors(lines[0]); ok {
+			omitted, lines = n, lines[1:]
+		}
+	}
+	key := errorKey(msg)
+	kept := lines[:0]
+	for _, l := range lines {
+		if errorKey(l) != key {
+			kept = append(kept, l)
+		}
+	}
+	lines = append(kept, msg)
+	if max <= 0 {
+		return joinErrors(omitted, lines)
+	}
+
+	size := len(lines) - 1
+	for _, l := range lines {
+		size += len(l)
+	}
+	markerSize := func() int {
+		if omitted == 0 {
+			return 0
+		}
+		return len(fmt.Sprintf(omittedErrorsFormat, omitted)) + 1
+	}
+	for len(lines) > 1 && size+markerSize() > max {
+		size -= len(lines[0]) + 1
+		lines = lines[1:]
+		omitted++
+	}
+	// The most recent error alone may be too long.
+	if over := size + markerSize() - max; over > 0 {
+		cut := len(lines[0]) - over
+		if cut < 0 {
+			cut = 0
+		}
+		lines[0] = strings.ToValidUTF8(lines[0][:cut], "")
+	}
+	return joinErrors(omitted, lines)
+}
+
+func joinErrors(omitted int, lines []string) string {
+	if omitted > 0 {
+		lines = append([]string{fmt.Sprintf(omittedErrorsFormat, omitted)}, lines...)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseOmittedErrors returns the count of a line written by joinErrors for omitted errors.
+func parseOmittedErrors(line string) (int, bool) {
+	var n int
+	if _, err := fmt.Sscanf(line, omittedErrorsFormat, &n); err != nil || fmt.Sprintf(omittedErrorsFormat, n) != line {
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,81 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorMessagesBounded(t *testing.T) {
+	i := &Item{Status: Available}
+	now := time.Now()
+	var last string
+	for n := 0; n < 10000; n++ {
+		last = fmt.Sprintf("error %d from the downstream", n)
+		i.error(errors.New(last), Retry, now)
+	}
+	if len(i.ErrorMessages) > MaxErrorMessagesSize {
+		t.Errorf("expected at most %d bytes of errors, got %d", MaxErrorMessagesSize, len(i.ErrorMessages))
+	}
+	lines := strings.Split(i.ErrorMessages, "\n")
+	if lines[len(lines)-1] != last {
+		t.Errorf("expected the most recent error to be intact, got %q", lines[len(lines)-1])
+	}
+	omitted, ok := parseOmittedErrors(lines[0])
+	if !ok || omitted+len(lines)-1 != 10000 {
+		t.Errorf("expected the omitted errors to be counted, got %q with %d errors kept", lines[0], len(lines)-1)
+	}
+}
+
+func TestAppendError(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		messages string
+		msg      string
+		max      int
+		want     string
+	}{
+		{name: "first", msg: "timeout", max: 100, want: "timeout"},
+		{name: "distinct", messages: "timeout", msg: "refused", max: 100, want: "timeout\nrefused"},
+		{name: "repeat", messages: "timeout\nrefused", msg: "timeout", max: 100, want: "refused\ntimeout"},
+		{
+			name:     "timestamps",
+			messages: "at 2024-01-02T03:04:05.123Z: timeout\nrefused",
+			msg:      "at 2024-01-02T03:04:06.456Z: timeout",
+			max:      100,
+			want:     "refused\nat 2024-01-02T03:04:06.456Z: timeout",
+		},
+		{name: "unix timestamps", messages: "timeout at 1700000000", msg: "timeout at 1700000042", max: 100, want: "timeout at 1700000042"},
+		{name: "attempts", messages: "timeout, attempt 1", msg: "timeout, attempt #2.", max: 100, want: "timeout, attempt #2."},
+		{name: "status codes", messages: "HTTP 500", msg: "HTTP 503", max: 100, want: "HTTP 500\nHTTP 503"},
+		{name: "multiline", messages: "timeout", msg: "bad\nrequest", max: 100, want: "timeout\nbad request"},
+		{
+			name:     "omit oldest",
+			messages: strings.Repeat("a", 15) + "\n" + strings.Repeat("b", 15) + "\n" + strings.Repeat("c", 15),
+			msg:      strings.Repeat("d", 15),
+			max:      60,
+			want:     "...2 earlier errors omitted\n" + strings.Repeat("c", 15) + "\n" + strings.Repeat("d", 15),
+		},
+		{
+			name:     "count omitted",
+			messages: "...2 earlier errors omitted\n" + strings.Repeat("c", 15) + "\n" + strings.Repeat("d", 15),
+			msg:      strings.Repeat("e", 15),
+			max:      60,
+			want:     "...3 earlier errors omitted\n" + strings.Repeat("d", 15) + "\n" + strings.Repeat("e", 15),
+		},
+		{name: "truncate", messages: "aaaa", msg: strings.Repeat("é", 20), max: 36, want: "...1 earlier errors omitted\néééé"},
+		{name: "unbounded", messages: "aaaa\nbbbb", msg: "cccc", want: "aaaa\nbbbb\ncccc"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := appendError(tc.messages, tc.msg, tc.max)
+			if got != tc.want {
+				t.Errorf("expected %q, got %q", tc.want, got)
+			}
+			if tc.max > 0 && len(got) > tc.max {
+				t.Errorf("expected at most %d bytes, got %d", tc.max, len(got))
+			}
+		})
+	}
+}
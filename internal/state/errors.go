@@ -0,0 +1,63 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotFound is returned by the Repo when the requested object does not exist.
+type ErrNotFound struct {
+	Kind string
+	ID   string
+}
+
+func (e *ErrNotFound) Error() string {
+	return fmt.Sprintf("%s %s not found", e.Kind, e.ID)
+}
+
+// IsNotFound returns true if err, or any error it wraps, is an ErrNotFound.
+func IsNotFound(err error) bool {
+	var t *ErrNotFound
+	return errors.As(err, &t)
+}
+
+// ErrValidation is returned by the Repo when an argument or an object to be written is
+// invalid. Retrying the same call fails the same way.
+type ErrValidation struct {
+	// Field is the argument or field found invalid, e.g. "gate_plan".
+	Field  string
+	Reason string
+	// Err is the sentinel error the validation failed with, if any, e.g. ErrDependencyCycle.
+	Err error
+}
+
+func (e *ErrValidation) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Reason)
+}
+
+func (e *ErrValidation) Unwrap() error {
+	return e.Err
+}
+
+// IsValidation returns true if err, or any error it wraps, is an ErrValidation.
+func IsValidation(err error) bool {
+	var t *ErrValidation
+	return errors.As(err, &t)
+}
+
+// ErrVersionConflict is returned by the Repo when an object was changed since it was read,
+// or, when it is created, already exists. The caller may read the object again and retry.
+type ErrVersionConflict struct {
+	Kind string
+	ID   string
+}
+
+func (e *ErrVersionConflict) Error() string {
+	return fmt.Sprintf("%s %s was changed concurrently or already exists", e.Kind, e.ID)
+}
+
+// IsVersionConflict returns true if err, or any error it wraps, is an ErrVersionConflict.
+func IsVersionConflict(err error) bool {
+	var t *ErrVersionConflict
+	return errors.As(err, &t)
+}
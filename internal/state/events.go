@@ -0,0 +1,211 @@
+package state
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// DefaultEventBuffer is the number of events buffered for a slow consumer before they are dropped.
+var DefaultEventBuffer = 100
+
+// EventType identifies a state transition observed by the watcher.
+type EventType int
+
+const (
+	ItemCompleted EventType = iota + 1
+	// ItemFailed events carry the error that moved the item to Failed.
+	ItemFailed
+	// ItemRetried events carry the error of an attempt that will be retried.
+	ItemRetried
+	// GateAdvanced events carry the partition's previous and new gate.
+	GateAdvanced
+	PartitionLeased
+	PartitionReleased
+	PartitionCompleted
+	PartitionFailed
+	// LeadershipAcquired and LeadershipLost are sent when the watcher becomes, or stops being,
+	// the leader of its LeaderElection.
+	LeadershipAcquired
+	LeadershipLost
+	// BreakerOpened, BreakerHalfOpened and BreakerRecovered, once closed again, are sent when
+	// the circuit breaker of a partition changes state, or that of the watcher, without a
+	// PartitionID. See Watcher.BreakerThreshold.
+	BreakerOpened
+	BreakerHalfOpened
+	BreakerRecovered
+	// SLABreached and SLARecovered events carry the SLA of the watcher's SLAConfig a
+	// partition breached, or recovered, with the measurement and threshold.
+	SLABreached
+	SLARecovered
+	// LeaseOrphaned events are sent by a Monitor for the unexpired lease of a partition whose
+	// Owner is dead, and ItemsStuck for the Count items of a partition stuck in processing.
+	LeaseOrphaned
+	ItemsStuck
+	// PartitionRetried events are sent when a sweep retries a failed partition, and
+	// PartitionRetriesExhausted, along with PartitionFailed, when a partition fails once out
+	// of retries, see MaxPartitionRetries. Both carry the partition's PartitionRetryCount in
+	// Count.
+	PartitionRetried
+	PartitionRetriesExhausted
+	// PartitionCompletedWithFailures is sent along with PartitionCompleted when a partition
+	// completes with the Count failed items its FailureTolerance allowed.
+	PartitionCompletedWithFailures
+	// BatchLimitChanged is sent when the watcher's AdaptiveBatch adjusts the number of items
+	// it processes at once, to the Count.
+	BatchLimitChanged
+)
+
+func (e EventType) String() string {
+	switch e {
+	case ItemCompleted:
+		return "ItemCompleted"
+	case ItemFailed:
+		return "ItemFailed"
+	case ItemRetried:
+		return "ItemRetried"
+	case GateAdvanced:
+		return "GateAdvanced"
+	case PartitionLeased:
+		return "PartitionLeased"
+	case PartitionReleased:
+		return "PartitionReleased"
+	case PartitionCompleted:
+		return "PartitionCompleted"
+	case PartitionFailed:
+		return "PartitionFailed"
+	case LeadershipAcquired:
+		return "LeadershipAcquired"
+	case LeadershipLost:
+		return "LeadershipLost"
+	case BreakerOpened:
+		return "BreakerOpened"
+	case BreakerHalfOpened:
+		return "BreakerHalfOpened"
+	case BreakerRecovered:
+		return "BreakerRecovered"
+	case SLABreached:
+		return "SLABreached"
+	case SLARecovered:
+		return "SLARecovered"
+	case LeaseOrphaned:
+		return "LeaseOrphaned"
+	case ItemsStuck:
+		return "ItemsStuck"
+	case PartitionRetried:
+		return "PartitionRetried"
+	case PartitionRetriesExhausted:
+		return "PartitionRetriesExhausted"
+	case PartitionCompletedWithFailures:
+		return "PartitionCompletedWithFailures"
+	case BatchLimitChanged:
+		return "BatchLimitChanged"
+	default:
+		return "Unknown"
+	}
+}
+
+// Event is a state transition of an item, a partition, or the watcher's leadership, or an
+// observation of a Monitor. Which
+// fields are set depends on Type.
+type Event struct {
+	Type        EventType
+	PartitionID string
+	// ItemID is set for item events.
+	ItemID string
+	Time   time.Time
+	// Err is set for ItemFailed and ItemRetried.
+	Err error
+	// FromGate and ToGate are set for GateAdvanced, along with their names in the partition's
+	// GatePlan, or their numbers without one.
+	FromGate     int
+	ToGate       int
+	FromGateName string
+	ToGateName   string
+	// SLA, SLAValue and SLAThreshold are set for SLABreached and SLARecovered. Durations are
+	// in seconds.
+	SLA          SLA
+	SLAValue     float64
+	SLAThreshold float64
+	// Owner is set for LeaseOrphaned, and for item events to the watcher's OwnerID. Count is
+	// set for ItemsStuck, PartitionRetried, PartitionRetriesExhausted,
+	// PartitionCompletedWithFailures and BatchLimitChanged.
+	Owner string
+	Count int
+	// Reason is set for PartitionCompleted and PartitionFailed to the partition's StatusReason.
+	Reason string
+}
+
+// Events returns the watcher's state transitions, each sent once the corresponding save has
+// succeeded. The channel is closed when the watcher stops. Events must be called before
+// Start, otherwise no events are recorded. The watcher never blocks on the consumer, events
+// that do not fit in the buffer of EventBuffer are dropped and counted in Stats.
+func (w *Watcher) Events() <-chan Event {
+	if w.events == nil {
+		if w.EventBuffer == 0 {
+			w.EventBuffer = DefaultEventBuffer
+		}
+		w.events = make(chan Event, w.EventBuffer)
+	}
+	return w.events
+}
+
+// emit sends the event if anyone is consuming events.
+func (w *Watcher) emit(e Event) {
+	if w.events == nil {
+		return
+	}
+	e.Time = w.Clock.Now()
+	select {
+	case w.events <- e:
+	default:
+		atomic.AddInt64(&w.counters.droppedEvents, 1)
+	}
+}
+
+// emitPartitionEvents reports the transitions made by a successful save of a leased partition,
+// which previously had the given gate and status, with its items counted by status.
+func (w *Watcher) emitPartitionEvents(p *Partition, gate int, status Status, counts map[Status]int, leased bool) {
+	if leased {
+		w.emit(Event{Type: PartitionLeased, PartitionID: p.ID})
+	}
+	if p.Gate != gate {
+		w.emit(Event{Type: GateAdvanced, PartitionID: p.ID, FromGate: gate, ToGate: p.Gate,
+			FromGateName: p.GatePlan.Name(gate), ToGateName: p.GateName()})
+		w.metrics().Counter(MetricGateAdvanced, 1, Labels{"partition": p.ID, "gate": p.GateName()})
+	}
+	if p.Status == status {
+		return
+	}
+	switch p.Status {
+	case Complete:
+		w.emit(Event{Type: PartitionCompleted, PartitionID: p.ID, Reason: p.StatusReason})
+		if counts[Failed] > 0 {
+			w.emit(Event{Type: PartitionCompletedWithFailures, PartitionID: p.ID, Count: counts[Failed], Reason: p.StatusReason})
+		}
+	case Failed:
+		w.emit(Event{Type: PartitionFailed, PartitionID: p.ID, Reason: p.StatusReason})
+		if p.retriesExhausted() {
+			glog.Warningf("partition %s failed after %d retries, leaving it failed", p.ID, p.PartitionRetryCount)
+			w.metrics().Counter(MetricPartitionRetriesExhausted, 1, Labels{"partition": p.ID})
+			w.emit(Event{Type: PartitionRetriesExhausted, PartitionID: p.ID, Count: p.PartitionRetryCount, Reason: p.StatusReason})
+		}
+	}
+}
+
+// emitItemEvent reports the outcome of a successfully saved item, processed with the given error.
+func (w *Watcher) emitItemEvent(i *Item, err error) {
+	e := Event{PartitionID: i.PartitionID, ItemID: i.ID, Err: err, Owner: i.LastOwner}
+	switch {
+	case i.Status == Complete:
+		e.Type = ItemCompleted
+	case i.Status == Failed:
+		e.Type = ItemFailed
+	case err != nil:
+		e.Type = ItemRetried
+	default:
+		return
+	}
+	w.emit(e)
+}
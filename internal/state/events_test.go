@@ -0,0 +1,170 @@
+package state
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+)
+
+// runForEvents runs a watcher over the repo until the partition is done, returning its events.
+func runForEvents(t *testing.T, r *GormRepo, w *Watcher) []Event {
+	events := w.Events()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		w.Start(ctx)
+		close(done)
+	}()
+
+	var got []Event
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				<-done
+				return got
+			}
+			got = append(got, e)
+			if e.Type == PartitionCompleted || e.Type == PartitionFailed {
+				cancel()
+			}
+		case <-timeout:
+			t.Fatalf("partition did not finish, got events %v", got)
+		}
+	}
+}
+
+func eventTypes(events []Event) (out []EventType) {
+	for _, e := range events {
+		out = append(out, e.Type)
+	}
+	return out
+}
+
+func TestEvents(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Status: Available, Data: []byte(`{"times": 2, "gate": 1}`)})
+
+	events := runForEvents(t, r, &Watcher{
+		Processor:    &testProcessor{},
+		Repo:         r,
+		BatchSize:    1,
+		PollInterval: 50 * time.Millisecond,
+		AutoClose:    true,
+	})
+	want := []EventType{PartitionLeased, GateAdvanced, ItemCompleted, PartitionCompleted}
+	if got := eventTypes(events); !reflect.DeepEqual(got, want) {
+		t.Fatalf("wanted events %v, got %v", want, got)
+	}
+	for _, e := range events {
+		if e.PartitionID != "p" || e.Time.IsZero() {
+			t.Errorf("unexpected event %+v", e)
+		}
+	}
+	if e := events[1]; e.FromGate != 0 || e.ToGate != 1 {
+		t.Errorf("expected the gate to advance from 0 to 1, got %+v", e)
+	}
+	if e := events[2]; e.ItemID != "i" {
+		t.Errorf("expected item i to complete, got %+v", e)
+	}
+}
+
+func TestEventsFailure(t *testing.T) {
+	defer func(n int) { MaxRetries = n }(MaxRetries)
+	MaxRetries = 1
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Status: Available, Data: []byte(`{"times": 1, "fail": true}`)})
+
+	events := runForEvents(t, r, &Watcher{
+		Processor:    &testProcessor{},
+		Repo:         r,
+		BatchSize:    1,
+		PollInterval: 50 * time.Millisecond,
+	})
+	// Stopping the watcher releases the failed partition's lease.
+	want := []EventType{PartitionLeased, ItemRetried, ItemFailed, PartitionFailed, PartitionReleased}
+	if got := eventTypes(events); !reflect.DeepEqual(got, want) {
+		t.Fatalf("wanted events %v, got %v", want, got)
+	}
+	if events[1].Err == nil || events[2].Err == nil {
+		t.Errorf("expected item events to carry the processing error, got %+v", events)
+	}
+}
+
+func TestEventsDropped(t *testing.T) {
+	w := &Watcher{EventBuffer: 1, Clock: clock.Real{}}
+	w.Events()
+	w.emit(Event{Type: PartitionLeased})
+	w.emit(Event{Type: PartitionReleased})
+	if got := w.Stats().DroppedEvents; got != 1 {
+		t.Errorf("expected one dropped event, got %d", got)
+	}
+}
+
+func TestPartitionRetriedEvents(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	due := time.Now().Add(-time.Second)
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}, Status: Failed, MaxPartitionRetries: 1, RetryAt: &due})
+
+	w := &Watcher{Repo: r, PartitionRetrySweepInterval: time.Minute}
+	events := w.Events()
+	w.Init()
+	last := w.sweepFailedPartitions(ctx, time.Time{})
+	if e := <-events; e.Type != PartitionRetried || e.PartitionID != "p" || e.Count != 1 {
+		t.Errorf("expected the partition's first retry, got %+v", e)
+	}
+	if retries := w.Stats().PartitionRetries; retries != 1 {
+		t.Errorf("expected a partition retry to be counted, got %d", retries)
+	}
+	// The next sweep waits for the interval.
+	if next := w.sweepFailedPartitions(ctx, last); !next.Equal(last) {
+		t.Errorf("expected the sweep to be skipped within its interval")
+	}
+}
+
+func TestPartitionRetrySweepClock(t *testing.T) {
+	r := openTestRepo(t)
+	c := clock.NewFake(time.Now())
+	r.Clock = c
+	ctx := context.Background()
+	cooldown := 30 * time.Minute
+	due := c.Now().Add(cooldown)
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}, Status: Failed, MaxPartitionRetries: 1, PartitionRetryCooldown: cooldown, RetryAt: &due})
+	status := func() Status {
+		p, err := r.GetPartition(ctx, "p")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p.Status
+	}
+
+	w := &Watcher{Repo: r, PartitionRetrySweepInterval: time.Minute, Clock: c}
+	w.Init()
+	last := w.sweepFailedPartitions(ctx, time.Time{})
+	if !last.Equal(c.Now()) || status() != Failed {
+		t.Fatalf("expected a sweep at %s leaving the partition failed within its cooldown, got a sweep at %s and %s", c.Now(), last, status())
+	}
+	// Neither the sweep interval nor the cooldown passes on the wall clock.
+	c.Advance(cooldown - time.Second)
+	if last = w.sweepFailedPartitions(ctx, last); status() != Failed {
+		t.Fatal("expected the partition to stay failed within its cooldown")
+	}
+	c.Advance(time.Second)
+	if next := w.sweepFailedPartitions(ctx, last); !next.Equal(last) || status() != Failed {
+		t.Fatal("expected the sweep to be skipped within its interval")
+	}
+	c.Advance(time.Minute)
+	if last = w.sweepFailedPartitions(ctx, last); !last.Equal(c.Now()) || status() != Available {
+		t.Errorf("expected the partition to be retried once its cooldown passed, got %s", status())
+	}
+}
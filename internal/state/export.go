@@ -0,0 +1,143 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ExportVersion is the version of the format written by ExportPartition. ImportPartition
+// reads exports of this version or earlier.
+const ExportVersion = 1
+
+// exportRecord is a line of an export: the first holds the version and the partition, and
+// each of the others an item. Payloads are base64 encoded.
+type exportRecord struct {
+	Version   int        `json:"version,omitempty"`
+	Partition *Partition `json:"partition,omitempty"`
+	Item      *Item      `json:"item,omitempty"`
+}
+
+// ImportOptions change the partition and items read by ImportPartition.
+type ImportOptions struct {
+	// PartitionID, if set, replaces the ID of the exported partition, e.g. to import it next
+	// to the original.
+	PartitionID string
+	// ItemIDPrefix, if set, is prepended to the IDs of the items, which are unique across
+	// partitions.
+	ItemIDPrefix string
+	// ResetStatuses makes the partition and its items Available, to process them again.
+	ResetStatuses bool
+	// ResetRetries zeroes the RetryCount of the items and clears their RetryAt.
+	ResetRetries bool
+}
+
+// ExportPartition writes the partition and its items to w as newline delimited JSON, for
+// ImportPartition to recreate them, e.g. to replay a partition locally. The items are read a
+// page at a time, so items saved during the export may be written before or after the save.
+func (db *GormRepo) ExportPartition(ctx context.Context, id string, w io.Writer) error {
+	p, err := db.GetPartition(ctx, id)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(exportRecord{Version: ExportVersion, Partition: p}); err != nil {
+		return err
+	}
+	after := ""
+	for {
+		items, err := db.exportPage(ctx, id, after)
+		if err != nil || len(items) == 0 {
+			return err
+		}
+		for _, i := range items {
+			if err := enc.Encode(exportRecord{Item: i}); err != nil {
+				return err
+			}
+		}
+		after = items[len(items)-1].ID
+	}
+}
+
+// exportPage returns a page of the partition's items with IDs after the given one, with
+// their payloads decrypted and rehydrated.
+func (db *GormRepo) exportPage(ctx context.Context, id, after string) ([]*Item, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	var items []*Item
+	if err := db.scoped(db.WithContext(ctx)).Where("partition_id = ? AND id > ?", id, after).Order(
+		"id").Limit(DefaultPageSize).Find(&items).Error; err != nil {
+		return nil, err
+	}
+	return items, db.load(ctx, items...)
+}
+
+// ImportPartition recreates a partition and its items written by ExportPartition, changed by
+// opts, in a single transaction: if any of them can't be created, e.g. as their IDs are
+// taken, none are. The partition isn't leased, and none of its items are being processed.
+func (db *GormRepo) ImportPartition(ctx context.Context, r io.Reader, opts ImportOptions) (*Partition, error) {
+	dec := json.NewDecoder(r)
+	header := exportRecord{}
+	if err := dec.Decode(&header); err != nil {
+		return nil, fmt.Errorf("error reading the export's header: %w", err)
+	}
+	if header.Partition == nil {
+		return nil, &ErrValidation{Field: "export", Reason: "the export doesn't start with a partition"}
+	}
+	if header.Version < 1 || header.Version > ExportVersion {
+		return nil, &ErrValidation{Field: "export", Reason: fmt.Sprintf("unsupported export version %d, expected at most %d", header.Version, ExportVersion)}
+	}
+	p := header.Partition
+	exportedID := p.ID
+	if opts.PartitionID != "" {
+		p.ID = opts.PartitionID
+	}
+	p.Version, p.Owner, p.Until, p.Fence, p.LeasedAt = 0, "", time.Time{}, 0, nil
+	if opts.ResetStatuses {
+		p.Status = Available
+	}
+
+	err := db.Transaction(ctx, func(tx *GormRepo) error {
+		if err := tx.CreatePartition(ctx, p); err != nil {
+			return err
+		}
+		var batch []*Item
+		for line := 2; ; line++ {
+			rec := exportRecord{}
+			err := dec.Decode(&rec)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("error reading line %d of the export: %w", line, err)
+			}
+			i := rec.Item
+			if i == nil || i.PartitionID != exportedID {
+				return &ErrValidation{Field: "export", Reason: fmt.Sprintf("line %d of the export isn't an item of partition %s", line, exportedID)}
+			}
+			i.ID = opts.ItemIDPrefix + i.ID
+			i.PartitionID = p.ID
+			i.Fence, i.ProcessingStartedAt = 0, nil
+			if opts.ResetStatuses {
+				i.Status = Available
+			}
+			if opts.ResetRetries {
+				i.RetryCount, i.RetryAt = 0, nil
+			}
+			if batch = append(batch, i); len(batch) == DefaultPageSize {
+				if err := tx.CreateItems(ctx, batch...); err != nil {
+					return err
+				}
+				batch = nil
+			}
+		}
+		return tx.CreateItems(ctx, batch...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,146 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func partitionItems(t *testing.T, r *GormRepo, id string) map[string]*Item {
+	t.Helper()
+	var items []*Item
+	if err := r.DB.Where("partition_id = ?", id).Find(&items).Error; err != nil {
+		t.Fatal(err)
+	}
+	byID := map[string]*Item{}
+	for _, i := range items {
+		byID[i.ID] = i
+	}
+	return byID
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	src := getTestRepo(t)
+	ctx := context.Background()
+	// A payload that isn't valid UTF-8 must survive too.
+	src.Save(ctx, &Item{BaseModel: BaseModel{ID: "s_binary"}, PartitionID: "p2_swap", Status: Failed, RetryCount: 4,
+		Data: []byte{0x00, 0xff, 0xfe, '\n', '"'}, Result: []byte(`{"partial":true}`), Metadata: ItemMetadata{"source": "prod"}})
+
+	dst := openTestRepo(t)
+	partitions, _, err := src.ListPartitions(ctx, PartitionFilter{}, PageRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range partitions {
+		var buf bytes.Buffer
+		if err := src.ExportPartition(ctx, p.ID, &buf); err != nil {
+			t.Fatalf("error exporting %s: %s", p.ID, err)
+		}
+		exported := buf.String()
+		imported, err := dst.ImportPartition(ctx, &buf, ImportOptions{})
+		if err != nil {
+			t.Fatalf("error importing %s: %s", p.ID, err)
+		}
+		if imported.ID != p.ID || imported.Status != p.Status || imported.Gate != p.Gate || imported.Owner != "" {
+			t.Errorf("expected partition %+v to be imported unleased, got %+v", p, imported)
+		}
+
+		want, got := partitionItems(t, src, p.ID), partitionItems(t, dst, p.ID)
+		if len(got) != len(want) {
+			t.Errorf("expected %d items in %s, got %d", len(want), p.ID, len(got))
+		}
+		for id, w := range want {
+			g, ok := got[id]
+			if !ok {
+				t.Errorf("expected item %s to be imported", id)
+				continue
+			}
+			if !bytes.Equal(g.Data, w.Data) || !bytes.Equal(g.Result, w.Result) {
+				t.Errorf("expected the payloads of %s to be identical, got %q and %q, want %q and %q", id, g.Data, g.Result, w.Data, w.Result)
+			}
+			if g.Status != w.Status || g.RetryCount != w.RetryCount || g.Sequence != w.Sequence || g.DataHash != w.DataHash || g.Metadata["source"] != w.Metadata["source"] {
+				t.Errorf("expected item %+v, got %+v", w, g)
+			}
+		}
+
+		// Exporting the import gives the same items.
+		var again bytes.Buffer
+		if err := dst.ExportPartition(ctx, p.ID, &again); err != nil {
+			t.Fatal(err)
+		}
+		if a, b := strings.SplitN(exported, "\n", 2), strings.SplitN(again.String(), "\n", 2); a[1] != b[1] {
+			t.Errorf("expected the items of %s to export identically, got\n%s\nand\n%s", p.ID, a[1], b[1])
+		}
+	}
+}
+
+func TestImportOptions(t *testing.T) {
+	src := getTestRepo(t)
+	ctx := context.Background()
+	src.Save(ctx, &Item{BaseModel: BaseModel{ID: "s_failed"}, PartitionID: "p2_swap", Status: Failed, RetryCount: 5, Data: []byte(`{}`)})
+	var buf bytes.Buffer
+	if err := src.ExportPartition(ctx, "p2_swap", &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Importing next to the original needs new IDs.
+	p, err := src.ImportPartition(ctx, &buf, ImportOptions{PartitionID: "replay", ItemIDPrefix: "replay-", ResetStatuses: true, ResetRetries: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ID != "replay" || p.Owner != "" {
+		t.Errorf("unexpected partition %+v", p)
+	}
+	items := partitionItems(t, src, "replay")
+	if len(items) != 3 {
+		t.Fatalf("expected 3 items, got %d", len(items))
+	}
+	i := items["replay-s_failed"]
+	if i == nil || i.Status != Available || i.RetryCount != 0 {
+		t.Errorf("expected the failed item to be reset, got %+v", i)
+	}
+	if len(partitionItems(t, src, "p2_swap")) != 3 {
+		t.Error("expected the original items to be left alone")
+	}
+}
+
+func TestImportIsAtomic(t *testing.T) {
+	src := getTestRepo(t)
+	ctx := context.Background()
+	for n := 0; n < DefaultPageSize+5; n++ {
+		src.Save(ctx, &Item{BaseModel: BaseModel{ID: fmt.Sprintf("bulk-%03d", n)}, PartitionID: "p1_unowned", Data: []byte(`{}`)})
+	}
+	var buf bytes.Buffer
+	if err := src.ExportPartition(ctx, "p1_unowned", &buf); err != nil {
+		t.Fatal(err)
+	}
+	export := buf.String()
+
+	dst := openTestRepo(t)
+	// An item taken in the destination fails the import after the first batch was created.
+	dst.Save(ctx, &Item{BaseModel: BaseModel{ID: "s1_ready"}, PartitionID: "elsewhere", Data: []byte(`{}`)})
+	if _, err := dst.ImportPartition(ctx, strings.NewReader(export), ImportOptions{}); err == nil {
+		t.Fatal("expected the import to fail")
+	}
+	if _, err := dst.GetPartition(ctx, "p1_unowned"); !IsNotFound(err) {
+		t.Errorf("expected the partition not to be created, got %v", err)
+	}
+	if n := len(partitionItems(t, dst, "p1_unowned")); n != 0 {
+		t.Errorf("expected no items to be created, got %d", n)
+	}
+
+	// So does a truncated export.
+	truncated := export[:strings.LastIndex(strings.TrimSuffix(export, "\n"), "\n")+20]
+	if _, err := dst.ImportPartition(ctx, strings.NewReader(truncated), ImportOptions{PartitionID: "truncated"}); err == nil {
+		t.Error("expected the truncated import to fail")
+	}
+	if _, err := dst.GetPartition(ctx, "truncated"); !IsNotFound(err) {
+		t.Errorf("expected the partition not to be created, got %v", err)
+	}
+
+	if _, err := dst.ImportPartition(ctx, strings.NewReader(`{"version":99,"partition":{"ID":"p"}}`), ImportOptions{}); err == nil {
+		t.Error("expected a later version to be refused")
+	}
+}
@@ -0,0 +1,74 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+)
+
+// DefaultMaxNewItems is the default number of new items a single processor response may
+// create, see Watcher.MaxNewItems.
+var DefaultMaxNewItems = 100
+
+// newItems returns the items to create for the processor's response to the parent item. A
+// response over the watcher's MaxNewItems fails the parent, as it would every time.
+func (w *Watcher) newItems(parent *Item, newItems []NewItem) ([]*Item, error) {
+	if len(newItems) > w.MaxNewItems {
+		return nil, NonRetryableError(fmt.Sprintf("processor returned %d new items, more than the maximum of %d", len(newItems), w.MaxNewItems))
+	}
+	items := make([]*Item, 0, len(newItems))
+	for _, n := range newItems {
+		i := &Item{
+			BaseModel:   BaseModel{ID: n.ID},
+			PartitionID: n.PartitionID,
+			Gate:        n.Gate,
+			Data:        n.Data,
+			Priority:    n.Priority,
+		}
+		if i.ID == "" {
+			i.ID = uuid.New().String()
+		}
+		if i.PartitionID == "" {
+			i.PartitionID = parent.PartitionID
+		}
+		if i.Data == nil {
+			i.Data = []byte{}
+		}
+		items = append(items, i)
+	}
+	return items, nil
+}
+
+// saveItem saves the processed item with its outbox events, and creates the new items it
+// produced in the same transaction, so that neither exists without the other.
+func (w *Watcher) saveItem(ctx context.Context, i *Item, err error, newItems []*Item) bool {
+	ctx, cancel := w.saveContext(ctx)
+	defer cancel()
+	if len(newItems) == 0 {
+		return w.Repo.SaveWithOutbox(ctx, i, itemOutboxEvents(i, err)...)
+	}
+	saved := false
+	txErr := w.Repo.Transaction(ctx, func(tx *GormRepo) error {
+		if cerr := tx.CreateItems(ctx, newItems...); cerr != nil {
+			return cerr
+		}
+		if saved = tx.SaveWithOutbox(ctx, i, itemOutboxEvents(i, err)...); !saved {
+			return errSaveConflict
+		}
+		return nil
+	})
+	if txErr != nil {
+		if saved {
+			// The commit failed, taking the save with it.
+			i.DecrementVersion()
+		}
+		if !errors.Is(txErr, errSaveConflict) {
+			glog.Errorf("error creating %d new items for item %s: %s", len(newItems), i.ID, txErr)
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,132 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fanoutProcessor fans the "parent" item out to children, completing every other item. With
+// conflict set, it modifies the parent concurrently on the first attempt so that its save fails.
+type fanoutProcessor struct {
+	testProcessor
+	r        *GormRepo
+	children []NewItem
+	conflict bool
+
+	mu       sync.Mutex
+	attempts int
+}
+
+func (p *fanoutProcessor) Process(id string, b []byte) (*ProcessorResponse, error) {
+	if id != "parent" {
+		return &ProcessorResponse{Complete: true, Data: b}, nil
+	}
+	p.mu.Lock()
+	p.attempts++
+	attempt := p.attempts
+	p.mu.Unlock()
+	if attempt == 1 && p.conflict {
+		i, err := p.r.GetItem(context.Background(), id)
+		if err != nil || !p.r.Save(context.Background(), i) {
+			return nil, fmt.Errorf("error modifying the parent: %v", err)
+		}
+	}
+	resp := &ProcessorResponse{Complete: true, Data: b}
+	for _, c := range p.children {
+		if c.ID != "" {
+			c.ID = fmt.Sprintf("%s-%d", c.ID, attempt)
+		}
+		resp.NewItems = append(resp.NewItems, c)
+	}
+	return resp, nil
+}
+
+func TestNewItems(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "parent"}, PartitionID: "p", Data: []byte(`{}`)})
+
+	proc := &fanoutProcessor{r: r, children: []NewItem{
+		{ID: "child", Data: []byte(`{"page":1}`)},
+		{Data: []byte(`{"page":2}`)},
+		{PartitionID: "q", ID: "elsewhere", Gate: 1, Priority: 5, Data: []byte(`{}`)},
+	}}
+	runForEvents(t, r, &Watcher{Processor: proc, Repo: r, BatchSize: 1, PollInterval: 10 * time.Millisecond, AutoClose: true})
+
+	items, _, err := r.ListItems(ctx, ItemFilter{PartitionID: "p"}, PageRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 {
+		t.Fatalf("expected the parent and 2 children in the partition, got %v", items)
+	}
+	for _, i := range items {
+		if i.Status != Complete {
+			t.Errorf("expected item %s to be processed, got %s", i.ID, i.Status)
+		}
+	}
+	i, err := r.GetItem(ctx, "elsewhere-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.PartitionID != "q" || i.Gate != 1 || i.Priority != 5 || i.Status != Available {
+		t.Errorf("unexpected child in another partition %+v", i)
+	}
+}
+
+func TestNewItemsRolledBackWithParent(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "parent"}, PartitionID: "p", Data: []byte(`{}`)})
+
+	proc := &fanoutProcessor{r: r, conflict: true, children: []NewItem{{ID: "a"}, {ID: "b"}}}
+	w := &Watcher{Processor: proc, Repo: r, BatchSize: 1, PollInterval: 10 * time.Millisecond, AutoClose: true}
+	runForEvents(t, r, w)
+
+	if proc.attempts != 2 || w.Stats().SaveConflicts != 1 {
+		t.Fatalf("expected the first save to conflict, got %d attempts and %d conflicts", proc.attempts, w.Stats().SaveConflicts)
+	}
+	for _, id := range []string{"a-1", "b-1"} {
+		if _, err := r.GetItem(ctx, id); !IsNotFound(err) {
+			t.Errorf("expected child %s of the conflicting save to be rolled back, got %v", id, err)
+		}
+	}
+	for _, id := range []string{"a-2", "b-2"} {
+		if i, err := r.GetItem(ctx, id); err != nil || i.Status != Complete {
+			t.Errorf("expected child %s to be created and processed, got %v, %v", id, i, err)
+		}
+	}
+}
+
+func TestMaxNewItems(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "parent"}, PartitionID: "p", Data: []byte(`{}`)})
+
+	proc := &fanoutProcessor{r: r, children: []NewItem{{}, {}, {}}}
+	events := runForEvents(t, r, &Watcher{Processor: proc, Repo: r, BatchSize: 1, PollInterval: 10 * time.Millisecond, AutoClose: true, MaxNewItems: 2})
+
+	if proc.attempts != 1 {
+		t.Errorf("expected a single attempt, got %d", proc.attempts)
+	}
+	var failed bool
+	for _, e := range events {
+		failed = failed || (e.Type == ItemFailed && e.ItemID == "parent" && !IsRetryable(e.Err))
+	}
+	if !failed {
+		t.Errorf("expected the parent to fail, got events %v", events)
+	}
+	items, _, err := r.ListItems(ctx, ItemFilter{}, PageRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Errorf("expected no new items, got %v", items)
+	}
+}
@@ -0,0 +1,100 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// zombieRepo stops saving and leasing partitions once frozen, like a watcher that has lost touch with
+// the database while its item processors carry on.
+type zombieRepo struct {
+	*GormRepo
+	frozen int32
+}
+
+func (r *zombieRepo) Save(ctx context.Context, m Model) bool {
+	if _, ok := m.(*Partition); ok && atomic.LoadInt32(&r.frozen) == 1 {
+		return false
+	}
+	return r.GormRepo.Save(ctx, m)
+}
+
+func (r *zombieRepo) AcquireLeases(ctx context.Context, candidates []string, owner string, until time.Time, limit int, fence bool) ([]*Partition, error) {
+	if atomic.LoadInt32(&r.frozen) == 1 {
+		return nil, nil
+	}
+	return r.GormRepo.AcquireLeases(ctx, candidates, owner, until, limit, fence)
+}
+
+func (r *zombieRepo) SaveWithOutbox(ctx context.Context, m Model, events ...*OutboxEvent) bool {
+	return r.Save(ctx, m)
+}
+
+// fencedProcessor reports the fence of each request, and waits to be released.
+type fencedProcessor struct {
+	testProcessor
+	fences  chan int64
+	release chan struct{}
+}
+
+func newFencedProcessor() *fencedProcessor {
+	return &fencedProcessor{fences: make(chan int64, 10), release: make(chan struct{})}
+}
+
+func (p *fencedProcessor) ProcessRequest(ctx context.Context, req *ProcessRequest) (*ProcessorResponse, error) {
+	p.fences <- req.Fence
+	<-p.release
+	return &ProcessorResponse{Complete: true, Data: []byte(fmt.Sprintf(`{"fence": %d}`, req.Fence))}, nil
+}
+
+func TestFenceTakeover(t *testing.T) {
+	defer func(b bool) { OverrideMinLeaseDuration = b }(OverrideMinLeaseDuration)
+	OverrideMinLeaseDuration = true
+	r := openTestRepo(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Status: Available, Data: []byte(`{}`)})
+
+	zombie := &zombieRepo{GormRepo: r}
+	procA := newFencedProcessor()
+	a := &Watcher{Processor: procA, Repo: zombie, OwnerID: "a", BatchSize: 1, PollInterval: 10 * time.Millisecond, LeaseDuration: 200 * time.Millisecond}
+	go a.Start(ctx)
+	if fence := <-procA.fences; fence != 1 {
+		t.Errorf("expected the first lease to have fence 1, got %d", fence)
+	}
+
+	// a can no longer renew its lease, and b takes over once it expires.
+	atomic.StoreInt32(&zombie.frozen, 1)
+	procB := newFencedProcessor()
+	b := &Watcher{Processor: procB, Repo: r, OwnerID: "b", BatchSize: 1, PollInterval: 10 * time.Millisecond, LeaseDuration: time.Minute}
+	go b.Start(ctx)
+	if fence := <-procB.fences; fence != 2 {
+		t.Errorf("expected the takeover to have fence 2, got %d", fence)
+	}
+
+	// a's result arrives late, and must be discarded.
+	close(procA.release)
+	for start := time.Now(); a.Stats().SaveConflicts == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the zombie watcher never tried to save its item")
+		}
+	}
+	if i, err := r.GetItem(ctx, "i"); err != nil || i.Status != Available || len(i.Result) != 0 {
+		t.Fatalf("expected the stale save to be rejected, got %+v, %v", i, err)
+	}
+
+	close(procB.release)
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if i, err := r.GetItem(ctx, "i"); err == nil && i.Status == Complete {
+			if string(i.Result) != `{"fence": 2}` {
+				t.Errorf("expected the result of the current owner, got %s", i.Result)
+			}
+			return
+		}
+	}
+	t.Error("the item was never completed by the new owner")
+}
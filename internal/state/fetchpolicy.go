@@ -0,0 +1,135 @@
+package state
+
+import (
+	"context"
+	"fmt"
+)
+
+// FetchMode is how a FetchPolicy splits the fetch of a partition's available items between
+// fresh items and those being retried.
+type FetchMode int
+
+const (
+	// FetchAll fetches fresh and retried items together, in the watcher's FetchOrder.
+	FetchAll FetchMode = iota
+	// FreshFirst fetches retried items only once no fresh items are left.
+	FreshFirst
+	// RetriesFirst fetches fresh items only once no retried items are left.
+	RetriesFirst
+	// Interleaved fetches Ratio fresh items for each retried item.
+	Interleaved
+)
+
+func (m FetchMode) String() string {
+	switch m {
+	case FreshFirst:
+		return "fresh_first"
+	case RetriesFirst:
+		return "retries_first"
+	case Interleaved:
+		return "interleaved"
+	default:
+		return "all"
+	}
+}
+
+// FetchPolicy decides whether the retries of a partition's failing items or its fresh items
+// get the room of each fetch, up to the MaxInFlightPerPartition, so that a burst of failing
+// items can neither starve fresh work nor be starved by it. Either kind takes the room the
+// other leaves, and within each, items are fetched in the watcher's FetchOrder. The zero
+// value fetches both together, in which case retried items go to the back when ordered by
+// update.
+type FetchPolicy struct {
+	Mode FetchMode
+	// Ratio is the number of fresh items fetched for each retried item when Interleaved.
+	// Defaults to 1. Retried items get at least one item of each fetch, so the ratio holds
+	// only with a MaxInFlightPerPartition above it.
+	Ratio int
+}
+
+// InterleavedFetch returns the policy fetching ratio fresh items for each retried item.
+func InterleavedFetch(ratio int) FetchPolicy {
+	return FetchPolicy{Mode: Interleaved, Ratio: ratio}
+}
+
+func (p FetchPolicy) String() string {
+	if p.Mode == Interleaved {
+		return fmt.Sprintf("%s(%d)", p.Mode, p.ratio())
+	}
+	return p.Mode.String()
+}
+
+// ratio returns the Ratio, defaulted.
+func (p FetchPolicy) ratio() int {
+	if p.Ratio < 1 {
+		return 1
+	}
+	return p.Ratio
+}
+
+// fetchAvailableItems fetches up to limit available items of the partition, split between
+// fresh and retried items as the watcher's FetchPolicy decides.
+func (w *Watcher) fetchAvailableItems(ctx context.Context, p *Partition, limit int) ([]*Item, error) {
+	switch w.FetchPolicy.Mode {
+	case FreshFirst:
+		fresh, retried, err := w.fetchSplit(ctx, p, FreshItems, RetriedItems, limit, limit)
+		return append(fresh, retried...), err
+	case RetriesFirst:
+		retried, fresh, err := w.fetchSplit(ctx, p, RetriedItems, FreshItems, limit, limit)
+		return append(retried, fresh...), err
+	case Interleaved:
+		share := limit / (w.FetchPolicy.ratio() + 1)
+		if share < 1 {
+			share = 1
+		}
+		fresh, retried, err := w.fetchSplit(ctx, p, FreshItems, RetriedItems, limit-share, limit)
+		return interleave(fresh, retried, w.FetchPolicy.ratio()), err
+	default:
+		return w.Repo.GetAvailableItems(ctx, p, limit, w.FetchOrder, AnyItems)
+	}
+}
+
+// fetchSplit fetches up to share items of the first kind, and the rest of the limit with items
+// of the second. When the second leaves room, the first takes it.
+func (w *Watcher) fetchSplit(ctx context.Context, p *Partition, first, second RetryFilter, share, limit int) ([]*Item, []*Item, error) {
+	var a []*Item
+	var err error
+	// A limit of 0 is no limit at all.
+	if share > 0 {
+		if a, err = w.Repo.GetAvailableItems(ctx, p, share, w.FetchOrder, first); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(a) == limit {
+		return a, nil, nil
+	}
+	b, err := w.Repo.GetAvailableItems(ctx, p, limit-len(a), w.FetchOrder, second)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(a) == share && len(a)+len(b) < limit {
+		if a, err = w.Repo.GetAvailableItems(ctx, p, limit-len(b), w.FetchOrder, first); err != nil {
+			return nil, nil, err
+		}
+	}
+	return a, b, nil
+}
+
+// interleave returns the fresh items, ratio at a time, followed each time by a retried item,
+// so that the dispatcher processes them in that proportion.
+func interleave(fresh, retried []*Item, ratio int) []*Item {
+	items := make([]*Item, 0, len(fresh)+len(retried))
+	for len(fresh) > 0 || len(retried) > 0 {
+		n := ratio
+		if n > len(fresh) {
+			n = len(fresh)
+		}
+		items = append(items, fresh[:n]...)
+		fresh = fresh[n:]
+		if len(retried) > 0 {
+			items = append(items, retried[0])
+			retried = retried[1:]
+		}
+	}
+	return items
+}
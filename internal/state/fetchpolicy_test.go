@@ -0,0 +1,150 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// kindProcessor records the items processed in order, failing those prefixed by bad.
+type kindProcessor struct {
+	testProcessor
+	mu  sync.Mutex
+	ids []string
+}
+
+func (p *kindProcessor) Process(id string, buf []byte) (*ProcessorResponse, error) {
+	p.mu.Lock()
+	p.ids = append(p.ids, id)
+	p.mu.Unlock()
+	if strings.HasPrefix(id, "bad") {
+		return nil, errors.New("always failing")
+	}
+	return &ProcessorResponse{Complete: true}, nil
+}
+
+// kindMetrics counts the items processed by kind.
+type kindMetrics struct {
+	nopMetrics
+	mu    sync.Mutex
+	kinds map[string]float64
+}
+
+func (m *kindMetrics) Counter(name string, delta float64, labels Labels) {
+	if name != MetricKindItemsProcessed {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.kinds[labels["kind"]] += delta
+}
+
+func TestFetchPolicy(t *testing.T) {
+	// The position of the first and last time each kind of item was processed, fresh items
+	// prefixed by f and those already retried by r.
+	type span struct{ first, last int }
+	spans := func(ids []string) map[byte]*span {
+		out := map[byte]*span{}
+		for n, id := range ids {
+			s, ok := out[id[0]]
+			if !ok {
+				s = &span{first: n}
+				out[id[0]] = s
+			}
+			s.last = n
+		}
+		return out
+	}
+	tests := []struct {
+		policy FetchPolicy
+		check  func(ids []string) error
+	}{{
+		policy: FetchPolicy{Mode: FreshFirst},
+		check: func(ids []string) error {
+			if s := spans(ids); s['f'].last > s['r'].first {
+				return errors.New("expected every fresh item before the retried ones")
+			}
+			return nil
+		},
+	}, {
+		policy: FetchPolicy{Mode: RetriesFirst},
+		check: func(ids []string) error {
+			if s := spans(ids); s['r'].last > s['f'].first {
+				return errors.New("expected every retried item before the fresh ones")
+			}
+			return nil
+		},
+	}, {
+		policy: InterleavedFetch(1),
+		check: func(ids []string) error {
+			var kinds []byte
+			for _, id := range ids[:4] {
+				kinds = append(kinds, id[0])
+			}
+			// The first fetch alternates, a failing item being fresh until it fails.
+			if string(kinds) != "brfr" {
+				return errors.New("expected fresh and retried items to take turns")
+			}
+			if s := spans(ids); s['r'].last < s['f'].first || s['f'].last < s['r'].first {
+				return errors.New("expected fresh and retried items to be processed together")
+			}
+			return nil
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			r := openTestRepo(t)
+			ctx := context.Background()
+			if err := r.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: "p"}}); err != nil {
+				t.Fatal(err)
+			}
+			// Half the items are being retried already, and a subset of the fresh ones always
+			// fails, joining them.
+			maxRetries := 2
+			var items []*Item
+			for n := 0; n < 10; n++ {
+				items = append(items, &Item{BaseModel: BaseModel{ID: fmt.Sprintf("r_%d", n)}, PartitionID: "p", Data: []byte(`{}`), RetryCount: 1})
+				id := fmt.Sprintf("f_%d", n)
+				if n%5 == 0 {
+					id = fmt.Sprintf("bad_%d", n)
+				}
+				items = append(items, &Item{BaseModel: BaseModel{ID: id}, PartitionID: "p", Data: []byte(`{}`), MaxRetries: &maxRetries})
+			}
+			if err := r.CreateItems(ctx, items...); err != nil {
+				t.Fatal(err)
+			}
+			proc := &kindProcessor{}
+			m := &kindMetrics{kinds: map[string]float64{}}
+			w := &Watcher{Processor: proc, Repo: r, BatchSize: 1, MaxInFlightPerPartition: 4, PollInterval: 5 * time.Millisecond,
+				AutoClose: true, FailureTolerance: 0.1, Metrics: m, FetchPolicy: tt.policy}
+			runForEvents(t, r, w)
+
+			proc.mu.Lock()
+			defer proc.mu.Unlock()
+			if err := tt.check(proc.ids); err != nil {
+				t.Errorf("%s, got %v", err, proc.ids)
+			}
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			// The failing items are processed fresh once, then retried up to their MaxRetries.
+			if m.kinds["fresh"] != 10 || m.kinds["retry"] != 10+2*2 {
+				t.Errorf("expected 10 fresh and 14 retried items processed, got %v", m.kinds)
+			}
+		})
+	}
+}
+
+func TestInterleave(t *testing.T) {
+	fresh, retried := testItems("f", 5), testItems("r", 2)
+	var got []string
+	for _, i := range interleave(fresh, retried, 2) {
+		got = append(got, i.ID)
+	}
+	if want := "[f_0 f_1 r_0 f_2 f_3 r_1 f_4]"; fmt.Sprint(got) != want {
+		t.Errorf("wanted %s, got %v", want, got)
+	}
+}
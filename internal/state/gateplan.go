@@ -0,0 +1,105 @@
+package state
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// GatePlan names the gates of a partition in order, so that gate n is named GatePlan[n]. It
+// is stored as a JSON array, items keep their integer gates.
+type GatePlan []string
+
+// ParseGatePlan parses a plan of the form validate,anonymize,upload.
+func ParseGatePlan(s string) (GatePlan, error) {
+	if s == "" {
+		return nil, nil
+	}
+	plan := GatePlan(strings.Split(s, ","))
+	return plan, plan.validate()
+}
+
+// validate checks that the plan's names are neither empty nor repeated.
+func (g GatePlan) validate() error {
+	seen := map[string]bool{}
+	for n, name := range g {
+		if name == "" {
+			return fmt.Errorf("gate %d of the plan has no name", n)
+		}
+		if seen[name] {
+			return fmt.Errorf("gate %q appears more than once in the plan", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+func (g GatePlan) String() string {
+	return strings.Join(g, ",")
+}
+
+// Set parses a plan, so that it can be used as a flag.Value.
+func (g *GatePlan) Set(s string) (err error) {
+	*g, err = ParseGatePlan(s)
+	return err
+}
+
+// Name returns the name of the gate, or its number if it isn't in the plan.
+func (g GatePlan) Name(gate int) string {
+	if gate >= 0 && gate < len(g) {
+		return g[gate]
+	}
+	return strconv.Itoa(gate)
+}
+
+func (GatePlan) GormDataType() string {
+	return "string"
+}
+
+func (g GatePlan) Value() (driver.Value, error) {
+	if g == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal([]string(g))
+	return string(b), err
+}
+
+func (g *GatePlan) Scan(value interface{}) error {
+	var b []byte
+	switch v := value.(type) {
+	case nil:
+		*g = nil
+		return nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return fmt.Errorf("unsupported gate plan type %T", value)
+	}
+	if len(b) == 0 {
+		*g = nil
+		return nil
+	}
+	if err := json.Unmarshal(b, (*[]string)(g)); err != nil {
+		return err
+	}
+	if len(*g) == 0 {
+		*g = nil
+	}
+	return nil
+}
+
+// GateName returns the name of the partition's gate in its plan, or its number without one.
+func (p *Partition) GateName() string {
+	return p.GatePlan.Name(p.Gate)
+}
+
+// NextGate returns the gate after the partition's current one, and whether it is in the
+// partition's plan. Without a plan, every gate is.
+func (p *Partition) NextGate() (int, bool) {
+	next := p.Gate + 1
+	return next, len(p.GatePlan) == 0 || next < len(p.GatePlan)
+}
@@ -0,0 +1,96 @@
+package state
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGatePlan(t *testing.T) {
+	for _, s := range []string{"validate,,upload", "validate,validate"} {
+		if _, err := ParseGatePlan(s); err == nil {
+			t.Errorf("expected plan %q to be invalid", s)
+		}
+	}
+	plan, err := ParseGatePlan("validate,anonymize,upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Partition{BaseModel: BaseModel{ID: "p"}, Gate: 1, GatePlan: plan}
+	if p.GateName() != "anonymize" || plan.Name(3) != "3" {
+		t.Errorf("unexpected gate names %s and %s", p.GateName(), plan.Name(3))
+	}
+	if next, ok := p.NextGate(); next != 2 || !ok {
+		t.Errorf("expected the next gate to be upload, got %d, %v", next, ok)
+	}
+	p.Gate = 2
+	if _, ok := p.NextGate(); ok {
+		t.Error("expected no gate after the last gate of the plan")
+	}
+	if _, ok := (&Partition{Gate: 2}).NextGate(); !ok {
+		t.Error("expected every gate to follow without a plan")
+	}
+
+	r := openTestRepo(t)
+	ctx := context.Background()
+	if err := r.CreatePartition(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: "q"}, GatePlan: GatePlan{"a", "a"}}); err == nil {
+		t.Error("expected creating a partition with an invalid plan to fail")
+	}
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "unplanned"}})
+	if got, err := r.GetPartition(ctx, "p"); err != nil || got.GatePlan.String() != "validate,anonymize,upload" {
+		t.Errorf("expected the plan to round trip, got %v, %v", got, err)
+	}
+	if got, err := r.GetPartition(ctx, "unplanned"); err != nil || got.GatePlan != nil || got.GateName() != "0" {
+		t.Errorf("expected no plan, got %v, %v", got, err)
+	}
+}
+
+func TestGatePlanNextGate(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		gate    int
+		data    string
+		maxSkip int
+		want    Status
+		wantErr string
+	}{
+		{name: "next gate", data: `{"times":2,"gate":1}`, want: Complete},
+		{name: "same gate", gate: 2, data: `{"times":1,"gate":2}`, want: Complete},
+		{name: "skip", data: `{"times":1,"gate":2}`, want: Failed, wantErr: "past the maximum skip of 1"},
+		{name: "allowed skip", data: `{"times":1,"gate":2}`, maxSkip: 2, want: Complete},
+		{name: "past the plan", data: `{"times":1,"gate":3}`, maxSkip: 3, want: Failed, wantErr: "past the end of the plan"},
+		{name: "back", gate: 1, data: `{"times":1,"gate":0}`, want: Failed, wantErr: "back from gate anonymize to validate"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := openTestRepo(t)
+			ctx := context.Background()
+			r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}, Gate: tc.gate, GatePlan: GatePlan{"validate", "anonymize", "upload"}})
+			r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Gate: tc.gate, Data: []byte(tc.data)})
+			m := &counterMetrics{counters: map[string]float64{}}
+			events := runForEvents(t, r, &Watcher{Processor: &testProcessor{}, Repo: r, BatchSize: 1, PollInterval: 10 * time.Millisecond,
+				AutoClose: true, MaxGateSkip: tc.maxSkip, Metrics: m})
+
+			i, err := r.GetItem(ctx, "i")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i.Status != tc.want || !strings.Contains(i.ErrorMessages, tc.wantErr) {
+				t.Errorf("expected item to be %s with error %q, got %s with %q", tc.want, tc.wantErr, i.Status, i.ErrorMessages)
+			}
+			if tc.name != "next gate" {
+				return
+			}
+			var advanced bool
+			for _, e := range events {
+				advanced = advanced || (e.Type == GateAdvanced && e.FromGateName == "validate" && e.ToGateName == "anonymize")
+			}
+			if !advanced || m.counters[MetricGateAdvanced] != 1 {
+				t.Errorf("expected the partition to advance to anonymize, got events %v", events)
+			}
+		})
+	}
+}
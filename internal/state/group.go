@@ -0,0 +1,164 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// WatcherGroup runs several watchers in one process, e.g. the pipelines of different
+// processors, usually sharing one repo and its connection pool. Their health checks are
+// named after the watchers' OwnerIDs.
+type WatcherGroup struct {
+	Watchers []*Watcher
+
+	// stop is closed by Stop, and done once Start returns.
+	once     sync.Once
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func (g *WatcherGroup) init() {
+	g.once.Do(func() {
+		g.stop = make(chan struct{})
+		g.done = make(chan struct{})
+	})
+}
+
+// Start starts every watcher, and blocks until they have all stopped, once ctx is done or
+// Stop is called. Watchers without an OwnerID are given a random one. Like a Watcher, a
+// group may only be started once.
+func (g *WatcherGroup) Start(ctx context.Context) {
+	g.init()
+	defer close(g.done)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-g.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, w := range g.Watchers {
+		if w.OwnerID == "" {
+			w.OwnerID = uuid.New().String()
+		}
+		wg.Add(1)
+		go func(w *Watcher) {
+			defer wg.Done()
+			w.Start(ctx)
+		}(w)
+	}
+	wg.Wait()
+}
+
+// RunAll runs the watchers until ctx is done, returning nil, or until one of them stops with a
+// fatal error, see Watcher.Run. The others are then stopped too, and RunAll returns the first
+// error, naming its watcher, once they have all stopped. Watchers without an OwnerID are given
+// a random one.
+func RunAll(ctx context.Context, watchers ...*Watcher) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg    sync.WaitGroup
+		once  sync.Once
+		first error
+	)
+	for _, w := range watchers {
+		if w.OwnerID == "" {
+			w.OwnerID = uuid.New().String()
+		}
+		wg.Add(1)
+		go func(w *Watcher) {
+			defer wg.Done()
+			if err := w.Run(ctx); err != nil {
+				once.Do(func() {
+					first = fmt.Errorf("watcher %s: %w", w.OwnerID, err)
+					cancel()
+				})
+			}
+		}(w)
+	}
+	wg.Wait()
+	return first
+}
+
+// Stop stops the watchers, and waits until they have released their leases and Start has
+// returned, or ctx is done.
+func (g *WatcherGroup) Stop(ctx context.Context) error {
+	g.init()
+	g.stopOnce.Do(func() { close(g.stop) })
+	select {
+	case <-g.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// HealthReport runs the health checks of every watcher concurrently, naming each check after
+// its watcher, as owner/check. The group is down if any watcher is, and degraded if any is.
+func (g *WatcherGroup) HealthReport(ctx context.Context) HealthReport {
+	reports := make([]HealthReport, len(g.Watchers))
+	var wg sync.WaitGroup
+	for n, w := range g.Watchers {
+		wg.Add(1)
+		go func(n int, w *Watcher) {
+			defer wg.Done()
+			reports[n] = w.HealthReport(ctx)
+		}(n, w)
+	}
+	wg.Wait()
+
+	group := HealthReport{Status: HealthOK}
+	for n, r := range reports {
+		switch {
+		case r.Status == HealthDown:
+			group.Status = HealthDown
+		case r.Status == HealthDegraded && group.Status == HealthOK:
+			group.Status = HealthDegraded
+		}
+		for _, c := range r.Checks {
+			c.Name = g.Watchers[n].OwnerID + "/" + c.Name
+			group.Checks = append(group.Checks, c)
+		}
+	}
+	return group
+}
+
+// Healthcheck reports whether every watcher is ready, see Readiness.
+func (g *WatcherGroup) Healthcheck(ctx context.Context) error {
+	return g.Readiness(ctx)
+}
+
+// Readiness returns the errors of the failed checks of every watcher, critical or not.
+func (g *WatcherGroup) Readiness(ctx context.Context) error {
+	return g.HealthReport(ctx).Err()
+}
+
+// Liveness returns the liveness errors of every watcher, see Watcher.Liveness.
+func (g *WatcherGroup) Liveness(ctx context.Context) error {
+	var errs []error
+	for _, w := range g.Watchers {
+		if err := w.Liveness(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", w.OwnerID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Stats returns the stats of every watcher.
+func (g *WatcherGroup) Stats() []Stats {
+	stats := make([]Stats, len(g.Watchers))
+	for n, w := range g.Watchers {
+		stats[n] = w.Stats()
+	}
+	return stats
+}
@@ -0,0 +1,123 @@
+package state
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWatcherGroupLifecycle(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	var items []*Item
+	for _, pipeline := range []string{"ingest", "export"} {
+		r.Save(ctx, &Partition{BaseModel: BaseModel{ID: pipeline}, Labels: PartitionLabels{"pipeline": pipeline}})
+		for _, i := range testItems(pipeline, 2) {
+			i.Data = []byte(`{"times": 1}`)
+			items = append(items, i)
+		}
+	}
+	if err := r.CreateItems(ctx, items...); err != nil {
+		t.Fatal(err)
+	}
+
+	g := &WatcherGroup{}
+	for _, pipeline := range []string{"ingest", "export"} {
+		g.Watchers = append(g.Watchers, &Watcher{
+			Processor:    &testProcessor{},
+			Repo:         r,
+			OwnerID:      "host-" + pipeline,
+			Selector:     map[string]string{"pipeline": pipeline},
+			BatchSize:    2,
+			PollInterval: 10 * time.Millisecond,
+		})
+	}
+	stopped := make(chan struct{})
+	go func() {
+		g.Start(ctx)
+		close(stopped)
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		completed := 0
+		for _, id := range []string{"ingest", "export"} {
+			counts, err := r.GetCountByStatus(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			completed += counts[Complete]
+		}
+		if completed == len(items) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d items completed by the group", completed, len(items))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, s := range g.Stats() {
+		if s.ItemsCompleted != 2 {
+			t.Errorf("expected each watcher to complete the items of its pipeline, %s completed %d", s.OwnerID, s.ItemsCompleted)
+		}
+	}
+	if err := g.Liveness(ctx); err != nil {
+		t.Errorf("expected the group to be live, got %v", err)
+	}
+
+	stopCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := g.Stop(stopCtx); err != nil {
+		t.Fatalf("expected the group to stop, got %v", err)
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Error("expected Start to have returned once stopped")
+	}
+	for _, id := range []string{"ingest", "export"} {
+		p := &Partition{}
+		if err := r.DB.First(p, "id = ?", id).Error; err != nil {
+			t.Fatal(err)
+		}
+		if l := p.LeaseState(); l.Status != Unleased || l.LeasedAt == nil || !p.Expired(time.Now()) {
+			t.Errorf("expected the lease on partition %s to be released, got %+v", id, l)
+		}
+		if p.Fence != 1 {
+			t.Errorf("expected partition %s to have been leased once, by its pipeline's watcher, got fence %d", id, p.Fence)
+		}
+	}
+}
+
+func TestWatcherGroupHealth(t *testing.T) {
+	proc := &healthcheckProc{}
+	repo := &healthcheckRepo{}
+	g := &WatcherGroup{Watchers: []*Watcher{
+		{OwnerID: "ingest", Processor: &healthcheckProc{}, Repo: repo},
+		{OwnerID: "export", Processor: proc, Repo: repo},
+	}}
+	report := g.HealthReport(context.Background())
+	if report.Status != HealthOK || len(report.Checks) != 4 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	proc.shouldFail = true
+	report = g.HealthReport(context.Background())
+	if report.Status != HealthDegraded {
+		t.Errorf("expected one watcher's failed processor to degrade the group, got %s", report.Status)
+	}
+	if c := report.Checks[3]; c.Name != "export/processor" || c.OK {
+		t.Errorf("unexpected check %+v", c)
+	}
+	if err := g.Healthcheck(context.Background()); err == nil {
+		t.Error("expected the failed processor to fail the healthcheck")
+	}
+
+	repo.shouldFail = true
+	if report = g.HealthReport(context.Background()); report.Status != HealthDown {
+		t.Errorf("expected the failed repo to take the group down, got %s", report.Status)
+	}
+	if err := g.Liveness(context.Background()); err == nil {
+		t.Error("expected watchers that weren't started not to be live")
+	}
+}
@@ -0,0 +1,127 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Names of the watcher's health checks.
+const (
+	HealthCheckRepo      = "repo"
+	HealthCheckProcessor = "processor"
+)
+
+// DefaultCriticalHealthChecks are the checks whose failure makes the watcher unhealthy, by
+// default. The others only degrade it.
+var DefaultCriticalHealthChecks = []string{HealthCheckRepo}
+
+// HealthStatus is the overall status of a HealthReport.
+type HealthStatus string
+
+const (
+	HealthOK HealthStatus = "ok"
+	// HealthDegraded reports that only checks which aren't critical failed.
+	HealthDegraded HealthStatus = "degraded"
+	// HealthDown reports that a critical check failed.
+	HealthDown HealthStatus = "down"
+)
+
+// HealthCheckResult is the outcome of one of the watcher's health checks.
+type HealthCheckResult struct {
+	Name     string        `json:"name"`
+	Critical bool          `json:"critical"`
+	OK       bool          `json:"ok"`
+	Latency  time.Duration `json:"latency"`
+	Error    string        `json:"error,omitempty"`
+
+	err error
+}
+
+// HealthReport details the watcher's health checks, see Watcher.HealthReport.
+type HealthReport struct {
+	Status HealthStatus        `json:"status"`
+	Checks []HealthCheckResult `json:"checks"`
+}
+
+// Err returns the errors of all the failed checks, critical or not.
+func (r HealthReport) Err() error {
+	var errs []error
+	for _, c := range r.Checks {
+		if c.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.Name, c.err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (w *Watcher) criticalHealthCheck(name string) bool {
+	checks := w.CriticalHealthChecks
+	if checks == nil {
+		checks = DefaultCriticalHealthChecks
+	}
+	for _, c := range checks {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// HealthReport runs the repo and processor health checks concurrently, reporting the
+// outcome and latency of each. Checks still running once ctx is done fail with its error.
+// The watcher is down if any of its CriticalHealthChecks failed, and degraded if others did.
+func (w *Watcher) HealthReport(ctx context.Context) HealthReport {
+	checks := []struct {
+		name  string
+		check func(context.Context) error
+	}{
+		{HealthCheckRepo, w.Repo.Healthcheck},
+		{HealthCheckProcessor, w.Processor.Healthcheck},
+	}
+	type outcome struct {
+		n       int
+		err     error
+		latency time.Duration
+	}
+	start := time.Now()
+	outcomes := make(chan outcome, len(checks))
+	for n, c := range checks {
+		n, check := n, c.check
+		go func() {
+			err := check(ctx)
+			outcomes <- outcome{n: n, err: err, latency: time.Since(start)}
+		}()
+	}
+	results := make([]*outcome, len(checks))
+	for remaining := len(checks); remaining > 0; remaining-- {
+		select {
+		case o := <-outcomes:
+			results[o.n] = &o
+		case <-ctx.Done():
+			remaining = 0
+		}
+	}
+
+	report := HealthReport{Status: HealthOK}
+	for n, c := range checks {
+		r := HealthCheckResult{Name: c.name, Critical: w.criticalHealthCheck(c.name)}
+		if o := results[n]; o != nil {
+			r.err, r.Latency = o.err, o.latency
+		} else {
+			r.err, r.Latency = ctx.Err(), time.Since(start)
+		}
+		r.OK = r.err == nil
+		if !r.OK {
+			r.Error = r.err.Error()
+			if r.Critical {
+				report.Status = HealthDown
+			} else if report.Status == HealthOK {
+				report.Status = HealthDegraded
+			}
+		}
+		report.Checks = append(report.Checks, r)
+	}
+	return report
+}
@@ -0,0 +1,118 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// DuplicateItemPolicy is what CreateItems does with an item whose IdempotencyKey is already
+// taken in its partition.
+type DuplicateItemPolicy int
+
+const (
+	// DuplicateReturnExisting skips the duplicate, setting its ID to the existing item's.
+	DuplicateReturnExisting DuplicateItemPolicy = iota
+	// DuplicateError fails CreateItems with an *ErrDuplicateItem.
+	DuplicateError
+	// DuplicateUpsertData replaces the existing item's Data with the duplicate's, and sets the
+	// duplicate's ID to the existing item's.
+	DuplicateUpsertData
+)
+
+// createAttempts is the number of times CreateItems tries to insert items with idempotency
+// keys, as a concurrent insert of the same key fails the first attempt.
+const createAttempts = 3
+
+// ErrDuplicateItem is returned by CreateItems, with DuplicateError, for an item whose
+// idempotency key is already taken in its partition.
+type ErrDuplicateItem struct {
+	PartitionID    string
+	IdempotencyKey string
+	// ExistingID is the ID of the item that has the key.
+	ExistingID string
+}
+
+func (e *ErrDuplicateItem) Error() string {
+	return fmt.Sprintf("item %s already has idempotency key %q in partition %s", e.ExistingID, e.IdempotencyKey, e.PartitionID)
+}
+
+// GetItemByIdempotencyKey returns the item of the partition with the idempotency key.
+func (db *GormRepo) GetItemByIdempotencyKey(ctx context.Context, partitionID, key string) (*Item, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	i := &Item{}
+	if err := db.scoped(db.WithContext(ctx)).Where("partition_id = ? AND idempotency_key = ?", partitionID, key).Take(i).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &ErrNotFound{Kind: "item", ID: fmt.Sprintf("with idempotency key %q in partition %s", key, partitionID)}
+		}
+		return nil, err
+	}
+	return i, db.load(ctx, i)
+}
+
+// dedupe applies the repo's DuplicateItemPolicy to the items whose idempotency keys are taken,
+// by existing items or earlier items of the batch, and returns the items left to insert.
+func (db *GormRepo) dedupe(ctx context.Context, items []*Item) ([]*Item, error) {
+	type key struct{ partition, key string }
+	type keyed struct {
+		item *Item
+		// stored is set for items already in the database, rather than earlier in the batch.
+		stored bool
+	}
+	first := map[key]keyed{}
+	var insert []*Item
+	for _, i := range items {
+		if i.IdempotencyKey == nil {
+			insert = append(insert, i)
+			continue
+		}
+		k := key{i.PartitionID, *i.IdempotencyKey}
+		existing, ok := first[k]
+		if !ok {
+			stored, err := db.GetItemByIdempotencyKey(ctx, i.PartitionID, *i.IdempotencyKey)
+			if IsNotFound(err) {
+				first[k] = keyed{item: i}
+				insert = append(insert, i)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			existing = keyed{item: stored, stored: true}
+			first[k] = existing
+		}
+		switch db.DuplicateItems {
+		case DuplicateError:
+			return nil, &ErrDuplicateItem{PartitionID: i.PartitionID, IdempotencyKey: *i.IdempotencyKey, ExistingID: existing.item.ID}
+		case DuplicateUpsertData:
+			existing.item.Data = i.Data
+			// Items yet to be inserted take the new data with them.
+			if existing.stored && !db.Save(ctx, existing.item) {
+				return nil, &ErrVersionConflict{Kind: "item", ID: existing.item.ID}
+			}
+		}
+		i.ID = existing.item.ID
+	}
+	return insert, nil
+}
+
+// isUniqueViolation returns whether err is a unique constraint violation, in sqlite or SQL
+// Server.
+func isUniqueViolation(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "UNIQUE constraint failed") || strings.Contains(msg, "duplicate key")
+}
+
+// hasIdempotencyKeys returns whether any of the items has an idempotency key.
+func hasIdempotencyKeys(items []*Item) bool {
+	for _, i := range items {
+		if i.IdempotencyKey != nil {
+			return true
+		}
+	}
+	return false
+}
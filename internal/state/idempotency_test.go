@@ -0,0 +1,51 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func idempotencyKey(k string) *string {
+	return &k
+}
+
+func TestDuplicateItemPolicies(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	if err := r.CreateItems(ctx, &Item{BaseModel: BaseModel{ID: "i1"}, PartitionID: "p", Data: []byte(`{"v":1}`), IdempotencyKey: idempotencyKey("k")}); err != nil {
+		t.Fatal(err)
+	}
+
+	r.DuplicateItems = DuplicateError
+	err := r.CreateItems(ctx,
+		&Item{BaseModel: BaseModel{ID: "i2"}, PartitionID: "p", Data: []byte(`{}`)},
+		&Item{BaseModel: BaseModel{ID: "i3"}, PartitionID: "p", Data: []byte(`{"v":2}`), IdempotencyKey: idempotencyKey("k")},
+	)
+	var dup *ErrDuplicateItem
+	if !errors.As(err, &dup) || dup.ExistingID != "i1" || dup.IdempotencyKey != "k" {
+		t.Errorf("expected a duplicate item error for i1, got %v", err)
+	}
+	if _, err := r.GetItem(ctx, "i2"); !IsNotFound(err) {
+		t.Errorf("expected the whole batch to be rejected, got %v", err)
+	}
+
+	r.DuplicateItems = DuplicateUpsertData
+	upsert := &Item{BaseModel: BaseModel{ID: "i4"}, PartitionID: "p", Data: []byte(`{"v":3}`), IdempotencyKey: idempotencyKey("k")}
+	if err := r.CreateItems(ctx, upsert); err != nil {
+		t.Fatal(err)
+	}
+	i, err := r.GetItemByIdempotencyKey(ctx, "p", "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upsert.ID != "i1" || i.ID != "i1" || string(i.Data) != `{"v":3}` {
+		t.Errorf("expected i1 to take the new data, got %s with %s", i.ID, i.Data)
+	}
+
+	// The unique index backs the check, for items saved rather than created.
+	if r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i5"}, PartitionID: "p", Data: []byte(`{}`), IdempotencyKey: idempotencyKey("k")}) {
+		t.Error("expected saving a duplicate key to fail")
+	}
+}
@@ -0,0 +1,57 @@
+package state
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// DefaultIdleThreshold is the number of consecutive idle lease scans before polling backs off.
+var DefaultIdleThreshold = 3
+
+// noteWork records that a partition found available items, which resets the idle backoff
+// immediately.
+func (w *Watcher) noteWork() {
+	atomic.StoreInt32(&w.counters.workSeen, 1)
+	atomic.StoreInt64(&w.counters.idleScans, 0)
+}
+
+// noteLeaseScan updates the idle backoff after a successful lease scan which found the given
+// number of potential leases.
+func (w *Watcher) noteLeaseScan(found int) {
+	if atomic.SwapInt32(&w.counters.workSeen, 0) == 1 || found > 0 {
+		atomic.StoreInt64(&w.counters.idleScans, 0)
+		return
+	}
+	atomic.AddInt64(&w.counters.idleScans, 1)
+}
+
+// idleInterval returns base, doubled for each consecutive idle scan beyond the threshold, up
+// to IdleMaxInterval.
+func (w *Watcher) idleInterval(base time.Duration) time.Duration {
+	if w.IdleMaxInterval <= base {
+		return base
+	}
+	d := base
+	for n := atomic.LoadInt64(&w.counters.idleScans) - int64(w.IdleThreshold); n >= 0 && d < w.IdleMaxInterval; n-- {
+		d *= 2
+	}
+	if d > w.IdleMaxInterval {
+		return w.IdleMaxInterval
+	}
+	return d
+}
+
+// partitionPollInterval is the idle interval for polling a leased partition, capped so that
+// the lease is still renewed well before it expires.
+func (w *Watcher) partitionPollInterval() time.Duration {
+	return w.capPollInterval(w.idleInterval(w.PollInterval))
+}
+
+// capPollInterval caps the interval for polling a leased partition, so that the lease is
+// still renewed well before it expires.
+func (w *Watcher) capPollInterval(d time.Duration) time.Duration {
+	if max := w.LeaseDuration / 2; d > max && max > w.PollInterval {
+		return max
+	}
+	return d
+}
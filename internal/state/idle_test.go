@@ -0,0 +1,123 @@
+package state
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+)
+
+type fetchCountingRepo struct {
+	WatcherRepo
+	fetches int64
+}
+
+func (r *fetchCountingRepo) GetAvailableItems(ctx context.Context, p *Partition, limit int, order ItemOrder, retries RetryFilter) ([]*Item, error) {
+	atomic.AddInt64(&r.fetches, 1)
+	return r.WatcherRepo.GetAvailableItems(ctx, p, limit, order, retries)
+}
+
+func TestIdleInterval(t *testing.T) {
+	w := &Watcher{IdleMaxInterval: 10 * time.Second, IdleThreshold: 2, PollInterval: time.Second, LeaseDuration: time.Minute}
+	for _, tc := range []struct {
+		idleScans int64
+		want      time.Duration
+	}{
+		{0, time.Second},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{50, 10 * time.Second},
+	} {
+		w.counters.idleScans = tc.idleScans
+		if got := w.idleInterval(time.Second); got != tc.want {
+			t.Errorf("after %d idle scans wanted %s, got %s", tc.idleScans, tc.want, got)
+		}
+	}
+
+	// The partition poll must still renew the lease in time.
+	w.LeaseDuration = 6 * time.Second
+	if got := w.partitionPollInterval(); got != 3*time.Second {
+		t.Errorf("expected poll interval capped at half the lease duration, got %s", got)
+	}
+
+	w.IdleMaxInterval = 0
+	if got := w.idleInterval(time.Second); got != time.Second {
+		t.Errorf("expected no backoff when disabled, got %s", got)
+	}
+}
+
+func TestIdleBackoff(t *testing.T) {
+	r := openTestRepo(t)
+	r.Save(context.Background(), &Partition{BaseModel: BaseModel{ID: "p"}})
+	repo := &fetchCountingRepo{WatcherRepo: r}
+	c := clock.NewFake(time.Now())
+	w := &Watcher{
+		Processor:       &testProcessor{},
+		Repo:            repo,
+		BatchSize:       1,
+		PollInterval:    time.Second,
+		LeaseInterval:   time.Second,
+		LeaseDuration:   time.Minute,
+		IdleMaxInterval: 8 * time.Second,
+		IdleThreshold:   2,
+		Clock:           c,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.Start(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// The lease loop, the heartbeat, the watchdog and the partition loop wait on the clock between
+	// iterations.
+	c.BlockUntil(4)
+	advance := func(d time.Duration) int64 {
+		before := atomic.LoadInt64(&repo.fetches)
+		for n := time.Duration(0); n < d; n += time.Second {
+			c.Advance(time.Second)
+			c.BlockUntil(4)
+		}
+		return atomic.LoadInt64(&repo.fetches) - before
+	}
+
+	advance(30 * time.Second)
+	if fetches := advance(16 * time.Second); fetches > 3 {
+		t.Errorf("expected polling to back off while idle, got %d fetches in 16s", fetches)
+	}
+	if got := w.Stats().PollInterval; got != 8*time.Second {
+		t.Errorf("expected the poll interval to reach the idle maximum, got %s", got)
+	}
+
+	if err := r.CreateItems(context.Background(), &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Data: []byte(`{"times": 1}`)}); err != nil {
+		t.Fatal(err)
+	}
+	// The partition polls within its 8s interval, and the lease scans then back off again, so
+	// the reset is seen right after the poll finds the item.
+	for n := 0; n < 8 && w.Stats().PollInterval != time.Second; n++ {
+		advance(time.Second)
+	}
+	if got := w.Stats().PollInterval; got != time.Second {
+		t.Errorf("expected the poll interval to reset once work was found, got %s", got)
+	}
+	// Lease scans racing the poll which found the item may start backing off again a scan
+	// early, so the last of the 3 polls may already wait 2s.
+	if fetches := advance(3 * time.Second); fetches < 2 {
+		t.Errorf("expected polling to recover immediately, got %d fetches in 3s", fetches)
+	}
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if i, err := r.GetItem(context.Background(), "i"); err == nil && i.Status == Complete {
+			return
+		}
+	}
+	t.Error("item was never processed")
+}
@@ -0,0 +1,104 @@
+package state
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// MaxIDLength is the length, in characters, of the columns holding the IDs of partitions and
+// items, see the migration pinning them.
+const MaxIDLength = 256
+
+// IDGenerator generates the IDs of the partitions and items created without one.
+type IDGenerator interface {
+	NewID() string
+}
+
+// IDGeneratorFunc makes a function an IDGenerator.
+type IDGeneratorFunc func() string
+
+func (f IDGeneratorFunc) NewID() string {
+	return f()
+}
+
+// UUIDv7 generates version 7 UUIDs, which sort by their creation time to the millisecond, so
+// that rows created together stay together in the primary key's index.
+var UUIDv7 IDGenerator = IDGeneratorFunc(func() string {
+	return newUUIDv7(time.Now()).String()
+})
+
+// newUUIDv7 returns a version 7 UUID for the time: its first 48 bits are the milliseconds
+// since the epoch, and the rest, but for the version and variant, are random.
+func newUUIDv7(t time.Time) uuid.UUID {
+	u := uuid.New()
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(t.UnixMilli()))
+	copy(u[:6], ms[2:])
+	u[6] = 0x70 | u[6]&0x0f
+	return u
+}
+
+// newID returns a new ID from the repo's IDGenerator, UUIDv7 by default.
+func (db *GormRepo) newID() string {
+	if db.IDGenerator != nil {
+		return db.IDGenerator.NewID()
+	}
+	return UUIDv7.NewID()
+}
+
+// assignID generates the ID of a model about to be created without one, and validates it.
+func (db *GormRepo) assignID(kind string, m Model) error {
+	if b, ok := m.(interface{ SetID(string) }); ok && m.GetID() == "" {
+		b.SetID(db.newID())
+	}
+	return validateID(kind, m.GetID())
+}
+
+// validateID rejects IDs which are empty, longer than MaxIDLength, or contain invalid UTF-8
+// or control characters, which would be lost or mangled by the database or in logs.
+func validateID(kind, id string) error {
+	reason := ""
+	switch {
+	case id == "":
+		reason = "is empty"
+	case !utf8.ValidString(id):
+		reason = "is not valid UTF-8"
+	case utf8.RuneCountInString(id) > MaxIDLength:
+		reason = fmt.Sprintf("is longer than %d characters", MaxIDLength)
+	default:
+		for _, r := range id {
+			if unicode.IsControl(r) {
+				reason = fmt.Sprintf("contains the control character %U", r)
+				break
+			}
+		}
+	}
+	if reason == "" {
+		return nil
+	}
+	return &ErrValidation{Field: "id", Reason: fmt.Sprintf("%s ID %q %s", kind, truncateID(id), reason)}
+}
+
+// truncateID shortens the ID quoted by a validation error.
+func truncateID(id string) string {
+	if len(id) <= 64 {
+		return id
+	}
+	return id[:64] + "..."
+}
+
+// modelKind names the kind of the model in errors.
+func modelKind(m Model) string {
+	switch m.(type) {
+	case *Partition:
+		return "partition"
+	case *Item:
+		return "item"
+	}
+	return "model"
+}
@@ -0,0 +1,173 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestNewUUIDv7(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	a, b := newUUIDv7(now), newUUIDv7(now.Add(time.Millisecond))
+	for _, u := range []uuid.UUID{a, b} {
+		if u.Version() != 7 || u.Variant() != uuid.RFC4122 {
+			t.Errorf("expected a version 7 RFC 4122 UUID, got %s of version %d and variant %s", u, u.Version(), u.Variant())
+		}
+	}
+	if a.String() >= b.String() {
+		t.Errorf("expected UUIDs to sort by time, got %s before %s", a, b)
+	}
+	if got := newUUIDv7(now); got == a {
+		t.Errorf("expected UUIDs of the same millisecond to differ, got %s twice", a)
+	}
+}
+
+func TestGeneratedIDs(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	p := &Partition{}
+	if err := r.CreatePartition(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := uuid.Parse(p.ID); err != nil || u.Version() != 7 {
+		t.Errorf("expected a UUIDv7 to be generated, got %q", p.ID)
+	}
+
+	n := 0
+	r.IDGenerator = IDGeneratorFunc(func() string {
+		n++
+		return fmt.Sprintf("gen-%d", n)
+	})
+	items := []*Item{{PartitionID: p.ID, Data: []byte(`{}`)}, {BaseModel: BaseModel{ID: "given"}, PartitionID: p.ID, Data: []byte(`{}`)}}
+	if err := r.CreateItems(ctx, items...); err != nil {
+		t.Fatal(err)
+	}
+	saved := &Item{PartitionID: p.ID, Data: []byte(`{}`)}
+	if !r.Save(ctx, saved) {
+		t.Fatal("error saving item")
+	}
+	got, _, err := r.GetOrCreateItem(ctx, &Item{PartitionID: p.ID, Data: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items[0].ID != "gen-1" || items[1].ID != "given" || saved.ID != "gen-2" || got.ID != "gen-3" {
+		t.Errorf("expected IDs to be generated for items without one, got %s, %s, %s and %s", items[0].ID, items[1].ID, saved.ID, got.ID)
+	}
+	for _, id := range []string{"gen-1", "given", "gen-2", "gen-3"} {
+		if _, err := r.GetItem(ctx, id); err != nil {
+			t.Errorf("expected item %s to be created, got %v", id, err)
+		}
+	}
+}
+
+func TestCreatedItemsSave(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	items := []*Item{{PartitionID: "p", Data: []byte(`{}`)}, {PartitionID: "p", Data: []byte(`{}`)}}
+	if err := r.CreateItems(ctx, items...); err != nil {
+		t.Fatal(err)
+	}
+	created, _, err := r.GetOrCreateItem(ctx, &Item{PartitionID: "p", Data: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first save of a created item updates it, rather than numbering it again.
+	for _, i := range append(items, created) {
+		seq := i.Sequence
+		if !r.Save(ctx, i) {
+			t.Fatalf("error saving item %s", i.ID)
+		}
+		stored, err := r.GetItem(ctx, i.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Version != 2 || stored.Sequence != seq {
+			t.Errorf("expected item %s to keep sequence %d at version 2, got %d at version %d", i.ID, seq, stored.Sequence, stored.Version)
+		}
+	}
+}
+
+func TestInvalidIDs(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	if err := r.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: "p"}}); err != nil {
+		t.Fatal(err)
+	}
+	for name, id := range map[string]string{
+		"too long":          strings.Repeat("a", MaxIDLength+1),
+		"newline":           "a\nb",
+		"null":              "a\x00b",
+		"invalid utf-8":     "a\xffb",
+		"control character": "a\u0085b",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := r.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: id}}); !IsValidation(err) {
+				t.Errorf("expected the partition to be rejected, got %v", err)
+			}
+			if err := r.CreateItems(ctx, &Item{BaseModel: BaseModel{ID: id}, PartitionID: "p", Data: []byte(`{}`)}); !IsValidation(err) {
+				t.Errorf("expected the item to be rejected, got %v", err)
+			}
+			if r.Save(ctx, &Item{BaseModel: BaseModel{ID: id}, PartitionID: "p", Data: []byte(`{}`)}) {
+				t.Error("expected the item not to be saved")
+			}
+		})
+	}
+	if _, err := r.GetItem(ctx, "a\nb"); !IsNotFound(err) {
+		t.Errorf("expected no item to be created, got %v", err)
+	}
+
+	// IDs of the maximum length, in characters rather than bytes, are valid.
+	id := strings.Repeat("é", MaxIDLength)
+	if err := r.CreateItems(ctx, &Item{BaseModel: BaseModel{ID: id}, PartitionID: "p", Data: []byte(`{}`)}); err != nil {
+		t.Errorf("expected an ID of %d characters to be valid, got %v", MaxIDLength, err)
+	}
+	// A generator returning empty IDs fails creations rather than making IDs collide.
+	r.IDGenerator = IDGeneratorFunc(func() string { return "" })
+	if err := r.CreatePartition(ctx, &Partition{}); !IsValidation(err) {
+		t.Errorf("expected an empty ID to be rejected, got %v", err)
+	}
+}
+
+func TestGeneratedIDCollisions(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.IDGenerator = IDGeneratorFunc(func() string { return "same" })
+	if err := r.CreatePartition(ctx, &Partition{}); err != nil {
+		t.Fatal(err)
+	}
+	p := &Partition{}
+	if err := r.CreatePartition(ctx, p); !IsVersionConflict(err) {
+		t.Errorf("expected a generated ID colliding with an existing one to conflict, got %v", err)
+	}
+	if p.ID != "same" || p.Version != 0 {
+		t.Errorf("expected the generated ID to be kept and the version restored, got %+v", p.BaseModel)
+	}
+	if err := r.CreateItems(ctx, &Item{PartitionID: "same", Data: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.CreateItems(ctx, &Item{PartitionID: "same", Data: []byte(`{}`)}); !IsVersionConflict(err) {
+		t.Errorf("expected a generated item ID colliding with an existing one to conflict, got %v", err)
+	}
+
+	// The default generator doesn't collide within a batch.
+	r.IDGenerator = nil
+	items := make([]*Item, 100)
+	for n := range items {
+		items[n] = &Item{PartitionID: "same", Data: []byte(`{}`)}
+	}
+	if err := r.CreateItems(ctx, items...); err != nil {
+		t.Fatal(err)
+	}
+	counts, err := r.GetCountByStatus(ctx, "same")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[Available] != 101 {
+		t.Errorf("expected 101 items, got %v", counts)
+	}
+}
@@ -0,0 +1,101 @@
+package state
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state/migrations"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// queryRecorder records the SQL of the queries run.
+type queryRecorder struct {
+	logger.Interface
+	queries []string
+}
+
+func (r *queryRecorder) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	sql, _ := fc()
+	r.queries = append(r.queries, sql)
+}
+
+// queryPlan returns the details of sqlite's plan for the query.
+func queryPlan(t *testing.T, db *gorm.DB, query string) string {
+	t.Helper()
+	rows, err := db.Raw("EXPLAIN QUERY PLAN " + query).Rows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var details []string
+	for rows.Next() {
+		var id, parent, notUsed int
+		var detail string
+		if err := rows.Scan(&id, &parent, &notUsed, &detail); err != nil {
+			t.Fatal(err)
+		}
+		details = append(details, detail)
+	}
+	return strings.Join(details, "\n")
+}
+
+func TestQueriesUseIndexes(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	rec := &queryRecorder{Interface: logger.Default.LogMode(logger.Silent)}
+	recorded := &GormRepo{DB: r.Session(&gorm.Session{Logger: rec})}
+	table := func(model interface{}) string {
+		stmt := &gorm.Statement{DB: r.DB}
+		if err := stmt.Parse(model); err != nil {
+			t.Fatal(err)
+		}
+		return stmt.Table
+	}
+	lastPlan := func() string {
+		return queryPlan(t, r.DB, rec.queries[len(rec.queries)-1])
+	}
+
+	for order, index := range map[ItemOrder]string{OrderByUpdatedAt: "feed_idx", OrderBySequence: "seq_idx"} {
+		if _, err := recorded.GetAvailableItems(ctx, &Partition{BaseModel: BaseModel{ID: "p"}}, 10, order, AnyItems); err != nil {
+			t.Fatal(err)
+		}
+		plan := lastPlan()
+		name := migrations.IndexName(table(&Item{}), index)
+		if !strings.Contains(plan, "USING INDEX "+name+" (partition_id=? AND status=? AND gate=?)") || strings.Contains(plan, "TEMP B-TREE") {
+			t.Errorf("expected the items ordered by %s to be fetched with %s, got the plan:\n%s", order, name, plan)
+		}
+	}
+
+	if _, err := recorded.GetPotentialLeases(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	plan := lastPlan()
+	name := migrations.IndexName(table(&Partition{}), "lease_idx")
+	if !strings.Contains(plan, "USING INDEX "+name+" (status=? AND until<?)") {
+		t.Errorf("expected the potential leases to be fetched with %s, got the plan:\n%s", name, plan)
+	}
+
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "available"}, PartitionID: "p", Status: Available, Data: []byte(`{}`)})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "complete"}, PartitionID: "p", Status: Complete, Data: []byte(`{}`)})
+	if _, err := recorded.GetPartitionProgress(ctx, "p"); err != nil {
+		t.Fatal(err)
+	}
+	name = migrations.IndexName(table(&Item{}), "progress_idx")
+	for _, query := range rec.queries[len(rec.queries)-2:] {
+		if plan := queryPlan(t, r.DB, query); !strings.Contains(plan, "USING COVERING INDEX "+name+" (partition_id=? AND status=?") || strings.Contains(plan, "TEMP B-TREE") {
+			t.Errorf("expected the progress of the partition to be read with %s, got the plan:\n%s", name, plan)
+		}
+	}
+
+	if _, err := recorded.FindCompletedByHash(ctx, "p", 0, HashData([]byte(`{}`))); err != nil {
+		t.Fatal(err)
+	}
+	name = migrations.IndexName(table(&Item{}), "hash_idx")
+	if plan := lastPlan(); !strings.Contains(plan, "USING INDEX "+name+" (partition_id=? AND data_hash=? AND gate=? AND status=?)") {
+		t.Errorf("expected duplicates to be found with %s, got the plan:\n%s", name, plan)
+	}
+}
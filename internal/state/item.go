@@ -7,32 +7,197 @@ import (
 	"github.com/golang/glog"
 )
 
-// MaxRetries before moving an item to "failed". Set to -1 to retry indefinitely.
+// MaxRetries before moving an item to "failed", with the default RetryPolicy. Set to -1 to
+// retry indefinitely.
 var MaxRetries = 5
 
-// Item represents a work item, with info required for processing.
+// Item represents a work item, with info required for processing. Its composite indexes are
+// defined by the migrations package, with names derived from the table's, see
+// migrations.IndexName.
 type Item struct {
 	BaseModel
 	RetryCount    int       `gorm:"default:0;not null"`
-	PartitionID   string    `gorm:"not null;index:feed_idx;"`
-	Gate          int       `gorm:"not null;default:0;index:feed_idx"`
-	Status        Status    `gorm:"not null;default:1;index:feed_idx"` // One of leased, failed, completed
+	PartitionID   string    `gorm:"not null;size:256"`
+	Gate          int       `gorm:"not null;default:0"`
+	Status        Status    `gorm:"not null;default:1"` // One of leased, failed, completed
 	ErrorMessages string    `gorm:"default:'';not null"`
-	UpdatedAt     time.Time `gorm:"not null;index:feed_idx"`
+	UpdatedAt     time.Time `gorm:"not null"`
 	Data          []byte    `gorm:"not null"`
+	// Result is the latest output of the processor, and its input on the next attempt. Data
+	// keeps the original payload, unless the watcher promotes results, see PromoteResultOnGate.
+	Result []byte
+	// Sequence orders the items of a partition by creation, and is assigned when the item is
+	// first saved or created. Items created concurrently may share a sequence number.
+	Sequence int64 `gorm:"not null;default:0"`
+	// Priority orders items with OrderByPriority, higher first.
+	Priority int `gorm:"not null;default:0"`
+	// Tenant is the tenant of the item's partition.
+	Tenant string `gorm:"not null;default:'';index"`
+	// Metadata are passed to processors implementing RequestProcessor, up to
+	// MaxItemMetadataSize.
+	Metadata ItemMetadata `gorm:"not null;default:'{}'"`
+	// Fence is the fence of the partition's lease the item was fetched under, set by the
+	// watcher. Once the partition changes owner, saves of the item with the old fence fail.
+	Fence int64 `gorm:"-"`
+	// Deadline, if set, is when the item must have completed by. The watcher fails items that
+	// are still Available past it with ErrDeadlineExceeded, without processing them, see also
+	// FailExpiredItems.
+	Deadline *time.Time `gorm:"index"`
+	// IdempotencyKey, if set, is unique among the items of the partition, so that a producer
+	// retrying an enqueue doesn't create the same work twice, see CreateItems.
+	IdempotencyKey *string `gorm:"size:256"`
+
+	// MaxRetries, if set, overrides the MaxRetries of the item's partition and the package.
+	// -1 retries indefinitely.
+	MaxRetries *int
+	// RetryAt, if set, is when the item may be retried, after a RetryClassifier returned
+	// RetryAfter. Until then it isn't fetched, see GetAvailableItems.
+	RetryAt *time.Time
+	// ProcessingStartedAt, if set, is when a watcher with a ProcessingTimeout or a
+	// MaxProcessingTime started the attempt in progress, cleared when the attempt is saved. See ReclaimStuckItems.
+	ProcessingStartedAt *time.Time `gorm:"index"`
+	// SchemaVersion is the version of the format of Data, set by the producer, and upgraded
+	// by watchers with a CurrentSchemaVersion.
+	SchemaVersion int `gorm:"not null;default:0"`
+	// DataHash is the hex encoded SHA-256 of Data, see HashData, computed by the repo as the
+	// item is saved, for watchers with DedupeByHash. Payloads the repo encrypts or offloads
+	// aren't hashed, but keep the hash of their plaintext given by the producer, if any.
+	DataHash string `gorm:"size:64;not null;default:''"`
+	// LastOwner is the OwnerID of the watcher that last attempted the item, at
+	// LastProcessedAt. Both are saved along with the attempt, so they always match its outcome.
+	LastOwner       string `gorm:"size:256;not null;default:''"`
+	LastProcessedAt *time.Time
+	// TraceContext is the W3C trace context of the span that enqueued the item, see
+	// TraceContextFromContext, which watchers with a TracerProvider continue as they process it.
+	TraceContext string `gorm:"size:512;not null;default:''"`
+	// Owner is the OwnerID of the watcher in ItemLeaseMode which claimed the item, hiding it
+	// from other claims until VisibleAfter, see ClaimItems. Both are cleared as the attempt is
+	// saved, which fails once the item was claimed again.
+	Owner        string `gorm:"size:256;not null;default:''"`
+	VisibleAfter *time.Time
+
+	// partition is the configuration of the item's partition, set by the watcher along with
+	// Fence.
+	partition partitionConfig
+	// blobKeys are the keys of the offloaded payloads the item was loaded with, by field.
+	blobKeys map[string]string
 }
 
-// Error logs the error to the sql table, and potentially changes the status to failed based on
-// the retryabliity of the error itself, and the number of retries.
-func (i *Item) error(err error) {
-	glog.Errorf("item %s in partition %s failed with: %s", i.ID, i.PartitionID, err)
-	i.RetryCount++
-	if i.ErrorMessages == "" {
-		i.ErrorMessages = err.Error()
-	} else if i.ErrorMessages != err.Error() {
-		i.ErrorMessages = fmt.Sprintf("%s\n%s", i.ErrorMessages, err.Error())
+// ItemOrder is the order in which available items are fetched.
+type ItemOrder int
+
+const (
+	// OrderByUpdatedAt fetches the least recently updated items first, so retried items move
+	// to the back.
+	OrderByUpdatedAt ItemOrder = iota
+	// OrderBySequence fetches items in the order they were created, regardless of retries.
+	OrderBySequence
+	// OrderByCreatedAt fetches items in the order they were created, regardless of retries,
+	// by their creation time rather than their Sequence, which may be given by the caller.
+	// Items created at the same time are fetched by sequence.
+	OrderByCreatedAt
+	// OrderByPriority fetches the highest priority items first, then by sequence.
+	OrderByPriority
+)
+
+func (o ItemOrder) String() string {
+	switch o {
+	case OrderBySequence:
+		return "sequence"
+	case OrderByCreatedAt:
+		return "created_at"
+	case OrderByPriority:
+		return "priority"
+	default:
+		return "updated_at"
+	}
+}
+
+// RetryFilter selects the available items fetched by whether they were retried at their gate.
+type RetryFilter int
+
+const (
+	// AnyItems fetches both fresh and retried items.
+	AnyItems RetryFilter = iota
+	// FreshItems fetches only the items yet to be retried at their gate.
+	FreshItems
+	// RetriedItems fetches only the items retried at least once at their gate.
+	RetriedItems
+)
+
+// where returns the condition of the filter, if any.
+func (f RetryFilter) where() string {
+	switch f {
+	case FreshItems:
+		return "retry_count = 0"
+	case RetriedItems:
+		return "retry_count > 0"
+	default:
+		return ""
+	}
+}
+
+// ParseItemOrder returns the ItemOrder with the given name, as returned by String.
+func ParseItemOrder(s string) (ItemOrder, error) {
+	for _, o := range []ItemOrder{OrderByUpdatedAt, OrderBySequence, OrderByCreatedAt, OrderByPriority} {
+		if s == o.String() {
+			return o, nil
+		}
 	}
-	if !IsRetryable(err) || (i.RetryCount > MaxRetries && MaxRetries >= 0) {
+	return OrderByUpdatedAt, fmt.Errorf("unknown item order: %q", s)
+}
+
+// Set parses the order, so that it can be used as a flag.Value.
+func (o *ItemOrder) Set(s string) (err error) {
+	*o, err = ParseItemOrder(s)
+	return err
+}
+
+// orderBy returns the ORDER BY clause. Ties are broken by ID so that the order is deterministic.
+func (o ItemOrder) orderBy() string {
+	switch o {
+	case OrderBySequence:
+		return "sequence, id"
+	case OrderByCreatedAt:
+		return "created_at, sequence, id"
+	case OrderByPriority:
+		return "priority DESC, sequence, id"
+	default:
+		return "updated_at"
+	}
+}
+
+// input returns the payload to hand to the processor.
+func (i *Item) input() []byte {
+	if i.Result != nil {
+		return i.Result
+	}
+	return i.Data
+}
+
+// Error logs the error to the sql table, and either changes the status to failed or, after a
+// delay from now, makes the item available for a retry, as decided by the watcher.
+func (i *Item) error(err error, d RetryDecision, now time.Time) {
+	glog.Errorf("item %s in partition %s failed on %s with: %s", i.ID, i.PartitionID, i.LastOwner, err)
+	i.RetryCount++
+	i.ErrorMessages = appendError(i.ErrorMessages, err.Error(), MaxErrorMessagesSize)
+	i.RetryAt = nil
+	i.ProcessingStartedAt = nil
+	if d.fail {
 		i.Status = Failed
+	} else if d.after > 0 {
+		retryAt := now.Add(d.after)
+		i.RetryAt = &retryAt
+	}
+}
+
+// resetRetries gives the item its full MaxRetries at a new gate. The errors of the previous
+// gate are logged rather than carried over.
+func (i *Item) resetRetries() {
+	if i.RetryCount == 0 && i.ErrorMessages == "" {
+		return
 	}
+	glog.Infof("item %s in partition %s left gate %s after %d retries, with errors: %s", i.ID, i.PartitionID, i.partition.plan.Name(i.Gate), i.RetryCount, i.ErrorMessages)
+	i.RetryCount = 0
+	i.ErrorMessages = ""
 }
@@ -1,14 +1,26 @@
 package state
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"sync"
 	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
 )
 
 func TestError(t *testing.T) {
+	defer func(max int) { MaxRetries = max }(MaxRetries)
 	MaxRetries = 3
+	now := time.Now()
+	w := &Watcher{}
+	fail := func(i *Item, err error) {
+		i.error(err, w.retryDecision(i, err, DefaultRetryClassifier(err)), now)
+	}
 	i := &Item{Status: Available}
-	i.error(errors.New("test error"))
+	fail(i, errors.New("test error"))
 
 	if i.RetryCount != 1 {
 		t.Error("retry count did not increment")
@@ -20,7 +32,7 @@ func TestError(t *testing.T) {
 		t.Error("expected status unchanged")
 	}
 
-	i.error(errors.New("test error"))
+	fail(i, errors.New("test error"))
 
 	if i.RetryCount != 2 {
 		t.Error("retry count did not increment")
@@ -32,7 +44,7 @@ func TestError(t *testing.T) {
 		t.Error("expected status unchanged")
 	}
 
-	i.error(errors.New("test error 2"))
+	fail(i, errors.New("test error 2"))
 
 	if i.RetryCount != 3 {
 		t.Error("retry count did not increment")
@@ -44,7 +56,7 @@ func TestError(t *testing.T) {
 		t.Error("expected status unchanged")
 	}
 
-	i.error(errors.New("last err"))
+	fail(i, errors.New("last err"))
 
 	if i.RetryCount != 4 {
 		t.Error("retry count did not increment")
@@ -55,8 +67,209 @@ func TestError(t *testing.T) {
 
 	i = &Item{Status: Available}
 
-	i.error(NonRetryableError("test error"))
+	fail(i, NonRetryableError("test error"))
 	if i.Status != Failed {
 		t.Error("expected non retryable error to move to failed state immediately")
 	}
+
+	i = &Item{Status: Available}
+
+	i.error(errors.New("throttled"), RetryAfter(time.Minute), now)
+	if i.Status != Available || i.RetryAt == nil || !i.RetryAt.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected the item to be retried in a minute, got %s at %v", i.Status, i.RetryAt)
+	}
+	i.error(errors.New("test error"), Retry, now)
+	if i.RetryAt != nil {
+		t.Errorf("expected an immediate retry, got %v", i.RetryAt)
+	}
+}
+
+type recordingProcessor struct {
+	testProcessor
+	mu     sync.Mutex
+	inputs []string
+}
+
+func (p *recordingProcessor) Process(id string, buf []byte) (*ProcessorResponse, error) {
+	p.mu.Lock()
+	p.inputs = append(p.inputs, string(buf))
+	p.mu.Unlock()
+	return p.testProcessor.Process(id, buf)
+}
+
+func TestRedriveItem(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Status: Available, Data: []byte(`{"times":2}`)})
+	proc := &recordingProcessor{}
+	run := func() {
+		runForEvents(t, r, &Watcher{Processor: proc, Repo: r, BatchSize: 1, PollInterval: 10 * time.Millisecond, AutoClose: true})
+	}
+
+	run()
+	i, err := r.GetItem(ctx, "i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(i.Data) != `{"times":2}` {
+		t.Errorf("expected the original data to be kept, got %s", i.Data)
+	}
+	if got, _ := objFromData(i.Result); got.Processed != 2 {
+		t.Errorf("expected the result to record both attempts, got %s", i.Result)
+	}
+
+	if err := r.RedriveItem(ctx, "missing", nil); !IsNotFound(err) {
+		t.Errorf("expected not found, got %v", err)
+	}
+	if err := r.RedriveItem(ctx, "i", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ReopenPartition(ctx, "p", nil); err != nil {
+		t.Fatal(err)
+	}
+	proc.inputs = nil
+	run()
+	if len(proc.inputs) == 0 || proc.inputs[0] != `{"times":2}` {
+		t.Errorf("expected the redriven item to be processed from its original data, got inputs %v", proc.inputs)
+	}
+	i, _ = r.GetItem(ctx, "i")
+	if got, _ := objFromData(i.Result); i.Status != Complete || got.Processed != 2 {
+		t.Errorf("expected the redriven item to complete from scratch, got %s with %s", i.Status, i.Result)
+	}
+}
+
+func TestReopenPartitionClock(t *testing.T) {
+	r := openTestRepo(t)
+	c := clock.NewFake(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC))
+	r.Clock = c
+	ctx := context.Background()
+	if err := r.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: "p"}, Status: Complete, Owner: "w", Until: c.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ReopenPartition(ctx, "p", nil); err != nil {
+		t.Fatal(err)
+	}
+	// The lease is released as of the repo's clock, rather than the wall clock.
+	c.Advance(time.Second)
+	if partitions, err := r.GetPotentialLeases(ctx, nil); err != nil || len(partitions) != 1 {
+		t.Errorf("expected the reopened partition to be leased, got %v, %v", partitions, err)
+	}
+}
+
+func TestPromoteResultOnGate(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Status: Available, Data: []byte(`{"times":2,"gate":1}`)})
+
+	runForEvents(t, r, &Watcher{Processor: &testProcessor{}, Repo: r, BatchSize: 1, PollInterval: 10 * time.Millisecond, AutoClose: true, PromoteResultOnGate: true})
+	i, err := r.GetItem(ctx, "i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first attempt moved the item to gate 1, the second completed it at the same gate.
+	if got, _ := objFromData(i.Data); got.Processed != 1 {
+		t.Errorf("expected the data to be the input to gate 1, got %s", i.Data)
+	}
+	if got, _ := objFromData(i.Result); got.Processed != 2 {
+		t.Errorf("expected the result of the last attempt, got %s", i.Result)
+	}
+}
+
+func TestResultBackfill(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Status: Available, Data: []byte(`{"processed":1}`)})
+	// Result was added by the 4th migration.
+	if err := r.MigrateTo(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+	i, err := r.GetItem(ctx, "i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(i.Result) != `{"processed":1}` {
+		t.Errorf("expected the result to be backfilled from the data, got %q", i.Result)
+	}
+}
+
+// binaryProcessor completes items, returning their input reversed.
+type binaryProcessor struct {
+	testProcessor
+}
+
+func (p *binaryProcessor) Process(id string, buf []byte) (*ProcessorResponse, error) {
+	out := make([]byte, len(buf))
+	for i, b := range buf {
+		out[len(buf)-1-i] = b
+	}
+	return &ProcessorResponse{Complete: true, Data: out}, nil
+}
+
+func TestBinaryPayload(t *testing.T) {
+	// Neither valid UTF-8 nor JSON, and large enough to be offloaded.
+	payload := bytes.Repeat([]byte{0x00, 0xff, 0xfe, 0xc3, 0x28, 0x80, '\n', 0xf8}, 128)
+	reversed := make([]byte, len(payload))
+	for i, b := range payload {
+		reversed[len(payload)-1-i] = b
+	}
+	for name, configure := range map[string]func(r *GormRepo){
+		"plain":     func(r *GormRepo) {},
+		"encrypted": func(r *GormRepo) { r.Encryptor, r.EncryptionKeyID = testEncryptor(), "k1" },
+		"offloaded": func(r *GormRepo) { r.Blobs, r.BlobThreshold = &MemoryBlobStore{}, 512 },
+	} {
+		r := openTestRepo(t)
+		configure(r)
+		ctx := context.Background()
+		r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+		r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Status: Available, Data: payload})
+
+		runForEvents(t, r, &Watcher{Processor: &binaryProcessor{}, Repo: r, BatchSize: 1, PollInterval: 10 * time.Millisecond, AutoClose: true})
+		i, err := r.GetItem(ctx, "i")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i.Status != Complete || !bytes.Equal(i.Data, payload) || !bytes.Equal(i.Result, reversed) {
+			t.Errorf("%s: expected the binary payloads to round trip, got %s with %.8x and %.8x", name, i.Status, i.Data, i.Result)
+		}
+	}
+}
+
+func TestResetRetriesPerGate(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		data      string
+		keep      bool
+		wantReset bool
+	}{
+		{name: "next gate", data: `{"times":2,"gate":1}`, wantReset: true},
+		{name: "same gate", data: `{"times":2}`},
+		{name: "completed at the next gate", data: `{"times":1,"gate":1}`},
+		{name: "kept across gates", data: `{"times":2,"gate":1}`, keep: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := openTestRepo(t)
+			ctx := context.Background()
+			r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+			i := &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", RetryCount: 4, ErrorMessages: "gate 0 error", Data: []byte(tc.data)}
+			r.Save(ctx, i)
+
+			w := &Watcher{Processor: &testProcessor{}, Repo: r, MaxGateSkip: 1, KeepRetriesAcrossGates: tc.keep}
+			w.init()
+			w.processItem(ctx, i)
+
+			got, err := r.GetItem(ctx, "i")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reset := got.RetryCount == 0 && got.ErrorMessages == ""; reset != tc.wantReset {
+				t.Errorf("expected reset %v, got %d retries with %q", tc.wantReset, got.RetryCount, got.ErrorMessages)
+			}
+		})
+	}
 }
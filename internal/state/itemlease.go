@@ -0,0 +1,343 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+	"github.com/golang/glog"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxSettleAttempts is the number of times a watcher in ItemLeaseMode reads a partition again
+// to settle it, when other watchers save it concurrently.
+const maxSettleAttempts = 3
+
+// ClaimItems claims up to limit Available items for owner, whatever their partition, hiding
+// them from other claims until the visibility timeout passes, and returns the items claimed.
+// Items are claimable once their previous claim and RetryAt, if any, have passed, and only at
+// the gate of a partition a watcher may make progress on, see GetPotentialLeases. The items
+// of the partitions with a MaxConcurrency are claimed first, up to its room left, and those
+// of the other partitions with the rest of the limit, each highest Priority first. The items
+// are claimed in a single transaction, so concurrent claims never return the same item. Each
+// claim increments the Version of its items, so that an attempt whose claim expired, and was
+// taken by another claim, fails to save.
+func (db *GormRepo) ClaimItems(ctx context.Context, owner string, limit int, visibility time.Duration) ([]*Item, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	// The items claimed are read back by their VisibleAfter, which must compare equal once
+	// stored, whatever the precision of the column.
+	now := clock.Or(db.Clock).Now().Truncate(TimestampPrecision)
+	until := now.Add(visibility)
+	claimed := 0
+	err := db.Transaction(ctx, func(tx *GormRepo) error {
+		n, err := tx.claimCappedItems(ctx, owner, limit, now, until)
+		if err != nil || n >= limit {
+			claimed = n
+			return err
+		}
+		uncapped := tx.claimablePartitions(ctx, now).Where("max_concurrency = 0")
+		m, err := tx.claimItemsOf(ctx, uncapped, owner, limit-n, now, until)
+		claimed = n + m
+		return err
+	})
+	if err != nil || claimed == 0 {
+		return nil, err
+	}
+	var items []*Item
+	if err := db.scoped(db.WithContext(ctx)).Where("owner = ? AND visible_after = ? AND status = ?", owner, until, Available).
+		Order(OrderByPriority.orderBy()).Find(&items).Error; err != nil {
+		return nil, err
+	}
+	return items, db.load(ctx, items...)
+}
+
+// claimablePartitions returns the query of the partitions whose items may be claimed at now.
+func (db *GormRepo) claimablePartitions(ctx context.Context, now time.Time) *gorm.DB {
+	complete := db.WithContext(ctx).Model(&Partition{}).Select("id").Where("status = ?", Complete)
+	return db.eligibleForLease(ctx, db.scoped(db.WithContext(ctx)).Model(&Partition{}), now).
+		Where("depends_on = '' OR depends_on IN (?)", complete)
+}
+
+// claimCappedItems claims up to limit items of the claimable partitions with a MaxConcurrency,
+// each up to its room left, and returns the number of items claimed. The partitions are locked,
+// and their ClaimedCount recounted from the claims which haven't expired, before their room is
+// read, so that concurrent claims can't take them past their MaxConcurrency. It must be called
+// within the claim's transaction.
+func (db *GormRepo) claimCappedItems(ctx context.Context, owner string, limit int, now, until time.Time) (int, error) {
+	capped := func() *gorm.DB {
+		return db.claimablePartitions(ctx, now).Where("max_concurrency > 0")
+	}
+	if err := lockLeases(capped()); err != nil {
+		return 0, err
+	}
+	table, err := db.tableName(&Partition{})
+	if err != nil {
+		return 0, err
+	}
+	claims := db.WithContext(ctx).Model(&Item{}).Select("COUNT(*)").
+		Where("partition_id = ?", clause.Column{Table: table, Name: "id"}).
+		Where("status = ? AND owner <> '' AND visible_after > ?", Available, now)
+	if err := capped().UpdateColumn("claimed_count", claims).Error; err != nil {
+		return 0, err
+	}
+	var partitions []*Partition
+	if err := capped().Select("id", "max_concurrency", "claimed_count").Where("claimed_count < max_concurrency").
+		Order("claimed_count, id").Find(&partitions).Error; err != nil {
+		return 0, err
+	}
+	claimed := 0
+	for _, p := range partitions {
+		room := p.MaxConcurrency - p.ClaimedCount
+		if room > limit-claimed {
+			room = limit - claimed
+		}
+		if room <= 0 {
+			break
+		}
+		n, err := db.claimItemsOf(ctx, db.WithContext(ctx).Model(&Partition{}).Where("id = ?", p.ID), owner, room, now, until)
+		if err != nil {
+			return 0, err
+		}
+		if n > 0 {
+			err := db.WithContext(ctx).Model(&Partition{}).Where("id = ?", p.ID).
+				UpdateColumn("claimed_count", gorm.Expr("claimed_count + ?", n)).Error
+			if err != nil {
+				return 0, err
+			}
+		}
+		claimed += n
+	}
+	return claimed, nil
+}
+
+// claimItemsOf claims up to limit items for owner at the gate of the partitions, highest
+// Priority first, and returns the number of items claimed.
+func (db *GormRepo) claimItemsOf(ctx context.Context, partitions *gorm.DB, owner string, limit int, now, until time.Time) (int, error) {
+	table, err := db.tableName(&Item{})
+	if err != nil {
+		return 0, err
+	}
+	partitions = partitions.Select("id").Where("gate = ?", clause.Column{Table: table, Name: "gate"})
+	claimable := visibleItems(db.scoped(db.WithContext(ctx)).Model(&Item{}).Select("id"), now).
+		Where("partition_id IN (?)", partitions).Order(OrderByPriority.orderBy()).Limit(limit)
+	// The item's visibility is checked again, for the databases which don't run the
+	// statement against a single snapshot.
+	res := visibleItems(db.scoped(db.WithContext(ctx)).Model(&Item{}).Where("id IN (?)", claimable), now).
+		UpdateColumns(map[string]interface{}{"owner": owner, "visible_after": until, "version": gorm.Expr("version + 1")})
+	return int(res.RowsAffected), res.Error
+}
+
+// visibleItems restricts the query to the items which may be claimed at now.
+func visibleItems(tx *gorm.DB, now time.Time) *gorm.DB {
+	return tx.Where("status = ?", Available).
+		Where("visible_after IS NULL OR visible_after <= ?", now).
+		Where("retry_at IS NULL OR retry_at <= ?", now)
+}
+
+// ExtendItem hides the item claimed by owner from other claims for d from now, e.g. while it
+// is still being processed. It returns false if the item is no longer claimed by owner, or no
+// longer Available. With a MaxProcessingTime, the claim of an item being processed is extended
+// up to MaxProcessingTime from its ProcessingStartedAt only, and false is returned once that
+// has passed: the claim then expires, for the item to be reclaimed.
+func (db *GormRepo) ExtendItem(ctx context.Context, itemID, owner string, d time.Duration) (bool, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	now := clock.Or(db.Clock).Now()
+	until := now.Add(d)
+	claimed := func() *gorm.DB {
+		return db.scoped(db.WithContext(ctx)).Model(&Item{}).Where("id = ? AND owner = ? AND status = ?", itemID, owner, Available)
+	}
+	tx := claimed()
+	if db.MaxProcessingTime > 0 {
+		var i Item
+		err := claimed().Select("version", "processing_started_at").Take(&i).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		if i.ProcessingStartedAt != nil {
+			if bound := i.ProcessingStartedAt.Add(db.MaxProcessingTime); bound.Before(until) {
+				until = bound
+			}
+			if !until.After(now) {
+				return false, nil
+			}
+		}
+		// The bound holds for the attempt read, not one started since.
+		tx = tx.Where("version = ?", i.Version)
+	}
+	res := tx.UpdateColumn("visible_after", until)
+	return res.RowsAffected > 0, res.Error
+}
+
+// tableName returns the name of the model's table, prefixed as configured.
+func (db *GormRepo) tableName(model interface{}) (string, error) {
+	stmt := &gorm.Statement{DB: db.DB}
+	if err := stmt.Parse(model); err != nil {
+		return "", err
+	}
+	return stmt.Table, nil
+}
+
+// claimItems continuously claims items in ItemLeaseMode, as many as the item processors have
+// room for, and queues them by partition. Partitions aren't leased: the items' claims expire
+// on their own should the watcher stop, and their partitions are settled as items are saved,
+// and by a sweep every SettleInterval.
+func (w *Watcher) claimItems(ctx context.Context) {
+	var lastSweep, lastStuckSweep, lastRetrySweep, lastSettleSweep time.Time
+	for ctx.Err() == nil {
+		lastSweep = w.sweepExpiredItems(ctx, lastSweep)
+		lastStuckSweep = w.sweepStuckItems(ctx, lastStuckSweep)
+		lastRetrySweep = w.sweepFailedPartitions(ctx, lastRetrySweep)
+		lastSettleSweep = w.sweepUnsettledPartitions(ctx, lastSettleSweep)
+		w.claimBatch(ctx)
+		select {
+		case <-w.Clock.After(w.idleInterval(w.PollInterval)):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// claimBatch claims items once, up to the room left in the item processors, and offers them
+// to the item processors along with the configuration of their partitions.
+func (w *Watcher) claimBatch(ctx context.Context) {
+	room := w.batchLimit() - w.dispatch.queued()
+	for _, n := range w.dispatch.inFlight() {
+		room -= n
+	}
+	if room <= 0 {
+		return
+	}
+	since := w.dispatch.mark()
+	saveCtx, cancel := w.saveContext(ctx)
+	items, err := w.Repo.ClaimItems(saveCtx, w.OwnerID, room, w.VisibilityTimeout)
+	cancel()
+	if err != nil {
+		glog.Errorf("error claiming items: %s", err)
+		w.repoFailed(ctx, err)
+		return
+	}
+	w.repoReached()
+	atomic.StoreInt64(&w.counters.lastLeaseScan, w.Clock.Now().UnixNano())
+	w.noteLeaseScan(len(items))
+	w.reportPoolStats()
+
+	byPartition := map[string][]*Item{}
+	for _, i := range items {
+		byPartition[i.PartitionID] = append(byPartition[i.PartitionID], i)
+	}
+	for _, id := range itemPartitionIDs(items) {
+		claimed := byPartition[id]
+		fetchCtx, cancel := w.fetchContext(ctx)
+		p, err := w.Repo.GetPartition(fetchCtx, id)
+		cancel()
+		if err != nil {
+			// The items are claimed again once their claim expires.
+			glog.Errorf("error reading partition %s of %d claimed items: %s", id, len(claimed), err)
+			continue
+		}
+		for _, i := range claimed {
+			i.partition = p.config()
+		}
+		w.dispatch.offer(id, claimed, w.BatchSize, since)
+	}
+}
+
+// keepClaimed extends the claim of the item being processed in ItemLeaseMode every half
+// VisibilityTimeout, until the returned func is called or the claim can't be extended, e.g.
+// past the MaxProcessingTime.
+func (w *Watcher) keepClaimed(ctx context.Context, i *Item) func() {
+	if !w.ItemLeaseMode {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	ticker := w.Clock.NewTicker(w.VisibilityTimeout / 2)
+	go func() {
+		defer close(done)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C():
+			case <-ctx.Done():
+				return
+			}
+			ok, err := w.Repo.ExtendItem(ctx, i.ID, w.OwnerID, w.VisibilityTimeout)
+			if err != nil && ctx.Err() == nil {
+				glog.Warningf("error extending the claim of item %s: %s", i.ID, err)
+			} else if err == nil && !ok {
+				glog.Warningf("the claim of item %s by %s can't be extended, its attempt will not be saved if claimed again", i.ID, w.OwnerID)
+				return
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// sweepUnsettledPartitions settles every partition whose items may be claimed, if the
+// SettleInterval has passed since the last sweep, returning the time of the last sweep. Saving
+// an item settles its partition, but a partition without claimable items at its gate, e.g. as
+// its items were all created at a later gate, or as it is empty and to be closed, has no item
+// to save.
+func (w *Watcher) sweepUnsettledPartitions(ctx context.Context, last time.Time) time.Time {
+	if w.Clock.Since(last) < w.SettleInterval {
+		return last
+	}
+	partitions, err := w.Repo.GetPotentialLeases(ctx, nil)
+	if err != nil && ctx.Err() == nil {
+		glog.Errorf("error reading the partitions to settle: %s", err)
+	}
+	for _, p := range partitions {
+		if ctx.Err() != nil {
+			break
+		}
+		w.settlePartition(ctx, p.ID)
+	}
+	return w.Clock.Now()
+}
+
+// settlePartition decides whether the partition of an item saved in ItemLeaseMode fails,
+// advances its gate, or completes, as a poll of a leased partition does, and saves the
+// decision. The decision is made afresh if another watcher saved the partition meanwhile.
+func (w *Watcher) settlePartition(ctx context.Context, id string) {
+	for attempt := 0; attempt < maxSettleAttempts; attempt++ {
+		fetchCtx, cancel := w.fetchContext(ctx)
+		p, err := w.Repo.GetPartition(fetchCtx, id)
+		cancel()
+		if err != nil {
+			glog.Errorf("error reading partition %s to settle it: %s", id, err)
+			return
+		}
+		if p.Status == Complete || p.Status == Cancelled {
+			return
+		}
+		poll, err := w.decide(ctx, p)
+		if err != nil {
+			glog.Errorf("error settling partition %s: %s", id, err)
+			return
+		}
+		if p.Gate == poll.gate && p.Status == poll.status {
+			return
+		}
+		if w.savePartition(ctx, p, poll.gate, poll.status, poll.counts) {
+			w.emitPartitionEvents(p, poll.gate, poll.status, poll.counts, false)
+			if p.Status == Complete {
+				w.unblockDependents(ctx, p)
+			}
+			return
+		}
+		atomic.AddInt64(&w.counters.saveConflicts, 1)
+	}
+	glog.Warningf("partition %s kept changing while settling it, leaving it for the next item", id)
+}
@@ -0,0 +1,603 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+)
+
+func TestWatcherItemLeaseMode(t *testing.T) {
+	MaxRetries = 3
+	r := getTestRepo(t)
+	// In ItemLeaseMode, the items of a partition failed by another of its items are only claimed
+	// with LeaseFailedPartitions, rather than for as long as the partition stays leased, so
+	// that the outcome doesn't depend on which item fails first.
+	r.LeaseFailedPartitions = true
+
+	watchers := []*Watcher{}
+	for _, owner := range []string{"p1", "p2"} {
+		watchers = append(watchers, &Watcher{
+			Processor:     &testProcessor{},
+			Repo:          r,
+			OwnerID:       owner,
+			BatchSize:     1,
+			PollInterval:  time.Millisecond,
+			LeaseInterval: time.Second,
+			AutoClose:     true,
+			ItemLeaseMode: true,
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, w := range watchers {
+		wg.Add(1)
+		go func(w *Watcher) {
+			w.Start(ctx)
+			wg.Done()
+		}(w)
+	}
+
+	testCases := []struct {
+		itemID     string
+		wantStatus Status
+		wantData   []byte
+	}{
+		{"s1_ready", Complete, []byte(`{"times":3,"processed":3}`)},
+		{"s2_fail", Failed, []byte(`{"times":3}`)},
+		{"s3_done", Complete, []byte(`{"times":3}`)},
+		{"s4_owned", Complete, []byte(`{"times":3,"processed":3}`)},
+		{"s5_owned", Complete, []byte(`{"times":3,"processed":3}`)},
+		{"s6_owned_should_fail", Failed, []byte(`{"times":3,"fail":true}`)},
+		{"s7_owned", Complete, []byte(`{"times":3,"processed":3}`)},
+		{"s8_disabled", Available, []byte(`{"times":3}`)},
+		{"s9_ready", Complete, []byte(`{"times":3,"processed": 3}`)},
+		{"s10_ready_should_fail", Failed, []byte(`{"times":3,"fail":true}`)},
+		{"s11_ready", Complete, []byte(`{"times":3,"processed":3}`)},
+		// The partition fails at gate 0, so its item moved to gate 1 is never claimed again.
+		{"s12_gate", Available, []byte(`{"times":3,"processed":1,"gate":1}`)},
+		{"s13_gate_fail", Failed, []byte(`{"times": 3,"gate":1,"fail":true}`)},
+		{"s14_gate", Complete, []byte(`{"times":3,"processed":3,"gate":1}`)},
+		{"s15_gate", Complete, []byte(`{"times":3,"processed":3,"gate":1}`)},
+	}
+	wg.Wait()
+
+	items := []*Item{}
+	partitions := []*Partition{}
+	r.DB.Model(&Partition{}).Find(&partitions)
+	r.DB.Model(&Item{}).Find(&items)
+	itemMap := map[string]*Item{}
+	for _, s := range items {
+		itemMap[s.ID] = s
+	}
+	for _, tc := range testCases {
+		s := itemMap[tc.itemID]
+		got, err := objFromData(s.input())
+		if err != nil {
+			t.Errorf("error marshaling data: %s", s.input())
+		}
+		want, err := objFromData(tc.wantData)
+		if err != nil {
+			t.Errorf("error marshaling data: %s", string(tc.wantData))
+		}
+		if got != want {
+			t.Errorf("failed test case %s, wanted data: %s, got %s. error messages: %s", tc.itemID, tc.wantData, s.input(), s.ErrorMessages)
+		}
+		if tc.wantStatus != s.Status {
+			t.Errorf("failed test case %s, wanted status: %v, got %v", tc.itemID, tc.wantStatus, s.Status)
+		}
+		if s.Owner != "" || s.VisibleAfter != nil {
+			t.Errorf("expected the claim of %s to be cleared, got %q until %v", tc.itemID, s.Owner, s.VisibleAfter)
+		}
+	}
+
+	wantStatus := map[string]Status{
+		"p1_unowned":  Complete,
+		"p1_owned":    Complete,
+		"p1_disabled": Complete,
+		"p1_swap":     Complete,
+		"p1_gate":     Complete,
+		// Its only item failed before the watchers started, so it is settled by the sweep.
+		"p2_unowned": Failed,
+		"p2_owned":   Failed,
+		"p2_swap":    Failed,
+		"p2_gate":    Failed,
+	}
+	for _, p := range partitions {
+		if p.Status != wantStatus[p.ID] {
+			t.Errorf("expected partition %s to be %s, got %s", p.ID, wantStatus[p.ID], p.Status)
+		}
+		if p.Fence != 0 {
+			t.Errorf("expected partition %s not to be leased, got fence %d", p.ID, p.Fence)
+		}
+	}
+}
+
+func TestItemLeaseModeReclaimsExpiredClaims(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	if err := r.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: "p"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.CreateItems(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Data: []byte(`{"times": 1}`)}); err != nil {
+		t.Fatal(err)
+	}
+	// The item is claimed by a watcher which stops before processing it.
+	expires := time.Now().Add(100 * time.Millisecond)
+	if claimed, err := r.ClaimItems(ctx, "gone", 1, 100*time.Millisecond); err != nil || len(claimed) != 1 {
+		t.Fatalf("expected the item to be claimed, got %d, %v", len(claimed), err)
+	}
+	w := &Watcher{Processor: &testProcessor{}, Repo: r, OwnerID: "w", PollInterval: 10 * time.Millisecond, AutoClose: true, ItemLeaseMode: true}
+	wctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		w.Start(wctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	start := time.Now()
+	for ; ; time.Sleep(time.Millisecond) {
+		if p, err := r.GetPartition(ctx, "p"); err == nil && p.Status == Complete {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("partition was never completed")
+		}
+	}
+	i, err := r.GetItem(ctx, "i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Status != Complete || i.LastOwner != "w" || i.RetryCount != 0 {
+		t.Errorf("expected the item to be processed once by w, got %s by %q after %d retries", i.Status, i.LastOwner, i.RetryCount)
+	}
+	if i.LastProcessedAt == nil || beforeAtPrecision(*i.LastProcessedAt, expires.Add(-TimestampPrecision)) {
+		t.Errorf("expected the item to be processed once its claim expired at %s, got %v", expires, i.LastProcessedAt)
+	}
+}
+
+// attemptProcessor holds each of its calls until its attempt is released, and completes the
+// item with the number of the attempt, counted from 0.
+type attemptProcessor struct {
+	testProcessor
+	mu       sync.Mutex
+	attempts int
+	started  chan int
+	release  []chan struct{}
+}
+
+func newAttemptProcessor(attempts int) *attemptProcessor {
+	p := &attemptProcessor{started: make(chan int, attempts)}
+	for n := 0; n < attempts; n++ {
+		p.release = append(p.release, make(chan struct{}))
+	}
+	return p
+}
+
+func (p *attemptProcessor) Process(id string, b []byte) (*ProcessorResponse, error) {
+	p.mu.Lock()
+	n := p.attempts
+	p.attempts++
+	p.mu.Unlock()
+	p.started <- n
+	<-p.release[n]
+	return &ProcessorResponse{Complete: true, Data: []byte(fmt.Sprintf(`{"attempt": %d}`, n))}, nil
+}
+
+// releaseAll releases the attempts not released yet, for the watchers to stop, and must be
+// deferred rather than cleaned up, as the watchers are stopped first otherwise.
+func (p *attemptProcessor) releaseAll() {
+	for _, ch := range p.release {
+		select {
+		case <-ch:
+		default:
+			close(ch)
+		}
+	}
+}
+
+// waitForAttempt waits for the attempt of the processor to start.
+func waitForAttempt(t *testing.T, p *attemptProcessor, want int) {
+	t.Helper()
+	select {
+	case n := <-p.started:
+		if n != want {
+			t.Fatalf("expected attempt %d to start, got %d", want, n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for attempt %d to start", want)
+	}
+}
+
+// startWatchers starts the watchers until the test ends.
+func startWatchers(t *testing.T, watchers ...*Watcher) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for _, w := range watchers {
+		wg.Add(1)
+		go func(w *Watcher) {
+			w.Start(ctx)
+			wg.Done()
+		}(w)
+	}
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+}
+
+func TestItemLeaseModeFencesExpiredClaims(t *testing.T) {
+	r := openTestRepo(t)
+	c := clock.NewFake(time.Now())
+	r.Clock = c
+	ctx := context.Background()
+	if err := r.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: "p"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.CreateItems(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Data: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	proc := newAttemptProcessor(2)
+	defer proc.releaseAll()
+	visibility := time.Minute
+	// The first watcher's clock stands still, so that its claim is never extended, and expires
+	// once the repo's clock moves past it.
+	a := &Watcher{Processor: proc, Repo: r, OwnerID: "a", Clock: clock.NewFake(time.Now()), PollInterval: time.Second,
+		ItemLeaseMode: true, VisibilityTimeout: visibility}
+	startWatchers(t, a)
+	waitForAttempt(t, proc, 0)
+	c.Advance(2 * visibility)
+
+	b := &Watcher{Processor: proc, Repo: r, OwnerID: "b", PollInterval: 5 * time.Millisecond, ItemLeaseMode: true, VisibilityTimeout: visibility}
+	startWatchers(t, b)
+	waitForAttempt(t, proc, 1)
+
+	// The attempt whose claim expired finishes first, and must neither overwrite the item nor
+	// release the claim of the other watcher.
+	close(proc.release[0])
+	for start := time.Now(); a.Stats().SaveConflicts == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("expected the attempt of the expired claim not to be saved")
+		}
+	}
+	i, err := r.GetItem(ctx, "i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Status != Available || i.Owner != "b" {
+		t.Fatalf("expected the item to stay claimed by b, got %s claimed by %q", i.Status, i.Owner)
+	}
+
+	close(proc.release[1])
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		if i, err = r.GetItem(ctx, "i"); err == nil && i.Status == Complete {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("item was never completed")
+		}
+	}
+	if string(i.input()) != `{"attempt": 1}` || i.LastOwner != "b" || i.RetryCount != 0 {
+		t.Errorf("expected the attempt of b to be saved, got %s by %q after %d retries", i.input(), i.LastOwner, i.RetryCount)
+	}
+}
+
+func TestItemLeaseModeSettlesPartitionsWithoutClaimableItems(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	// The item of the first partition was created at a later gate, so none is claimable at its
+	// gate, and the second partition is empty.
+	for _, id := range []string{"later", "empty"} {
+		if err := r.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: id}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.CreateItems(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "later", Gate: 1, Data: []byte(`{"times": 1, "gate": 1}`)}); err != nil {
+		t.Fatal(err)
+	}
+	w := &Watcher{Processor: &testProcessor{}, Repo: r, OwnerID: "w", PollInterval: 10 * time.Millisecond,
+		LeaseInterval: 50 * time.Millisecond, AutoClose: true, ItemLeaseMode: true}
+	wctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		w.Start(wctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		later, lerr := r.GetPartition(ctx, "later")
+		empty, eerr := r.GetPartition(ctx, "empty")
+		if lerr == nil && eerr == nil && later.Status == Complete && empty.Status == Complete {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("expected both partitions to be settled, got %+v and %+v", later, empty)
+		}
+	}
+	i, err := r.GetItem(ctx, "i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Status != Complete || i.Gate != 1 {
+		t.Errorf("expected the item to be processed at its gate once the partition advanced, got %s at gate %d", i.Status, i.Gate)
+	}
+}
+
+func TestItemLeaseModeExtendsLongAttempts(t *testing.T) {
+	r := openTestRepo(t)
+	c := clock.NewFake(time.Now())
+	r.Clock = c
+	ctx := context.Background()
+	if err := r.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: "p"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.CreateItems(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Data: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	visibility := time.Minute
+	proc := &hangingProcessor{repo: r, release: make(chan struct{})}
+	wctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for _, owner := range []string{"a", "b"} {
+		w := &Watcher{Processor: proc, Repo: r, OwnerID: owner, Clock: c, PollInterval: time.Second, AutoClose: true, ItemLeaseMode: true, VisibilityTimeout: visibility}
+		wg.Add(1)
+		go func() {
+			w.Start(wctx)
+			wg.Done()
+		}()
+	}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	waitFor := func(what string, done func() bool) {
+		t.Helper()
+		for start := time.Now(); !done(); time.Sleep(time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+	waitFor("the item to be processed", func() bool {
+		proc.mu.Lock()
+		defer proc.mu.Unlock()
+		return proc.calls == 1
+	})
+
+	// The attempt outlives several visibility timeouts, its claim being extended every half
+	// of one, while the other watcher keeps claiming items.
+	for n := 0; n < 8; n++ {
+		c.Advance(visibility / 2)
+		waitFor("the claim to be extended", func() bool {
+			i, err := r.GetItem(ctx, "i")
+			return err == nil && i.VisibleAfter != nil && i.VisibleAfter.After(c.Now().Add(visibility/2))
+		})
+	}
+	close(proc.release)
+	waitFor("the partition to complete", func() bool {
+		p, err := r.GetPartition(ctx, "p")
+		return err == nil && p.Status == Complete
+	})
+
+	proc.mu.Lock()
+	if proc.calls != 1 {
+		t.Errorf("expected the item to be processed once, got %d calls", proc.calls)
+	}
+	proc.mu.Unlock()
+	i, err := r.GetItem(ctx, "i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Status != Complete || i.RetryCount != 0 || i.Owner != "" {
+		t.Errorf("expected the item to complete at its first attempt, got %s after %d retries claimed by %q", i.Status, i.RetryCount, i.Owner)
+	}
+}
+
+// unextendableRepo fails to extend every claim, as when the item was claimed again.
+type unextendableRepo struct {
+	WatcherRepo
+	extends int64
+}
+
+func (r *unextendableRepo) ExtendItem(ctx context.Context, itemID, owner string, d time.Duration) (bool, error) {
+	atomic.AddInt64(&r.extends, 1)
+	return false, nil
+}
+
+func TestItemLeaseModeUnextendedClaims(t *testing.T) {
+	r := openTestRepo(t)
+	c := clock.NewFake(time.Now())
+	r.Clock = c
+	ctx := context.Background()
+	if err := r.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: "p"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.CreateItems(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Data: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	created, err := r.GetItem(ctx, "i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc := newAttemptProcessor(2)
+	defer proc.releaseAll()
+	visibility := time.Minute
+	repo := &unextendableRepo{WatcherRepo: r}
+	a := &Watcher{Processor: proc, Repo: repo, OwnerID: "a", Clock: c, BatchSize: 1, PollInterval: time.Hour,
+		ItemLeaseMode: true, VisibilityTimeout: visibility}
+	startWatchers(t, a)
+	waitForAttempt(t, proc, 0)
+
+	// The claim can't be extended, and expires while the attempt goes on.
+	c.Advance(visibility / 2)
+	for start := time.Now(); atomic.LoadInt64(&repo.extends) == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("expected the claim to be extended")
+		}
+	}
+	c.Advance(visibility)
+	b := &Watcher{Processor: proc, Repo: r, OwnerID: "b", PollInterval: 5 * time.Millisecond, ItemLeaseMode: true, VisibilityTimeout: visibility}
+	startWatchers(t, b)
+	waitForAttempt(t, proc, 1)
+
+	close(proc.release[0])
+	close(proc.release[1])
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		i, err := r.GetItem(ctx, "i")
+		if err == nil && i.Status == Complete && a.Stats().SaveConflicts > 0 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("expected the item to be completed, and the attempt of the unextended claim not to be saved")
+		}
+	}
+	i, err := r.GetItem(ctx, "i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The item was claimed twice and saved once.
+	if string(i.input()) != `{"attempt": 1}` || i.LastOwner != "b" || i.Version != created.Version+3 {
+		t.Errorf("expected only the attempt of b to be saved, got %s by %q at version %d", i.input(), i.LastOwner, i.Version)
+	}
+	if a.Stats().SaveConflicts != 1 || b.Stats().SaveConflicts != 0 {
+		t.Errorf("expected only the attempt of a to fail to save, got %d save conflicts for a and %d for b", a.Stats().SaveConflicts, b.Stats().SaveConflicts)
+	}
+}
+
+func TestExtendItemMaxProcessingTime(t *testing.T) {
+	r := openTestRepo(t)
+	c := clock.NewFake(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC))
+	r.Clock = c
+	r.MaxProcessingTime = time.Minute
+	ctx := context.Background()
+	if err := r.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: "p"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.CreateItems(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Data: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := r.ClaimItems(ctx, "a", 1, 30*time.Second); err != nil || len(claimed) != 1 {
+		t.Fatalf("expected the item to be claimed, got %d, %v", len(claimed), err)
+	}
+	visibleAfter := func() time.Time {
+		t.Helper()
+		i, err := r.GetItem(ctx, "i")
+		if err != nil || i.VisibleAfter == nil {
+			t.Fatalf("expected the item to be claimed, got %v", err)
+		}
+		return *i.VisibleAfter
+	}
+
+	// Claims are extended without bound until the item's processing starts.
+	c.Advance(time.Hour)
+	if ok, err := r.ExtendItem(ctx, "i", "a", 45*time.Second); err != nil || !ok {
+		t.Fatalf("expected the claim to be extended, got %t, %v", ok, err)
+	}
+	started := c.Now()
+	if err := r.Model(&Item{}).Where("id = ?", "i").UpdateColumn("processing_started_at", started).Error; err != nil {
+		t.Fatal(err)
+	}
+	c.Advance(30 * time.Second)
+	if ok, err := r.ExtendItem(ctx, "i", "a", 45*time.Second); err != nil || !ok {
+		t.Fatalf("expected the claim to be extended, got %t, %v", ok, err)
+	}
+	if got, want := visibleAfter(), started.Add(time.Minute); !got.Equal(want) {
+		t.Errorf("expected the claim to be extended up to the MaxProcessingTime at %s, got %s", want, got)
+	}
+	c.Advance(30 * time.Second)
+	if ok, err := r.ExtendItem(ctx, "i", "a", 45*time.Second); err != nil || ok {
+		t.Fatalf("expected the claim not to be extended past the MaxProcessingTime, got %t, %v", ok, err)
+	}
+	if ok, err := r.ExtendItem(ctx, "i", "b", 45*time.Second); err != nil || ok {
+		t.Fatalf("expected the claim of another owner not to be extended, got %t, %v", ok, err)
+	}
+}
+
+func TestClaimItemsMaxConcurrency(t *testing.T) {
+	r := openTestRepo(t)
+	c := clock.NewFake(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC))
+	r.Clock = c
+	ctx := context.Background()
+	createCappedPartitions(t, r)
+	countByPartition := func(items []*Item) map[string]int {
+		counts := map[string]int{}
+		for _, i := range items {
+			counts[i.PartitionID]++
+		}
+		return counts
+	}
+
+	claimed, err := r.ClaimItems(ctx, "a", 5, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := countByPartition(claimed); got["capped"] != 2 || got["free"] != 3 {
+		t.Errorf("expected 2 items of the capped partition and the rest of the other, got %v", got)
+	}
+	var release *Item
+	for _, i := range claimed {
+		if i.PartitionID == "capped" {
+			release = i
+		}
+	}
+	// Another watcher can't claim past the partition's MaxConcurrency.
+	if claimed, err = r.ClaimItems(ctx, "b", 5, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got := countByPartition(claimed); got["capped"] != 0 || got["free"] != 5 {
+		t.Errorf("expected only items of the other partition, got %v", got)
+	}
+	if p, err := r.GetPartition(ctx, "capped"); err != nil || p.ClaimedCount != 2 {
+		t.Errorf("expected 2 claimed items to be counted, got %d, %v", p.ClaimedCount, err)
+	}
+
+	// Saving an item releases its claim, and claims expire.
+	if release == nil {
+		t.Fatal("expected an item of the capped partition to be claimed")
+	}
+	release.Status, release.Owner, release.VisibleAfter = Complete, "", nil
+	if !r.Save(ctx, release) {
+		t.Fatal("expected the item to be saved")
+	}
+	if claimed, err = r.ClaimItems(ctx, "b", 5, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got := countByPartition(claimed); got["capped"] != 1 {
+		t.Errorf("expected the released claim to make room for another item, got %v", got)
+	}
+	c.Advance(2 * time.Minute)
+	if claimed, err = r.ClaimItems(ctx, "c", 10, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got := countByPartition(claimed); got["capped"] != 2 {
+		t.Errorf("expected expired claims to make room for 2 items, got %v", got)
+	}
+}
+
+func TestItemLeaseModeMaxConcurrency(t *testing.T) {
+	r := openTestRepo(t)
+	createCappedPartitions(t, r)
+	proc := &concurrencyProcessor{slowProcessor: slowProcessor{delay: 20 * time.Millisecond}}
+	var watchers []*Watcher
+	for _, owner := range []string{"a", "b", "c"} {
+		watchers = append(watchers, &Watcher{Processor: proc, Repo: r, OwnerID: owner, BatchSize: 4, PollInterval: 5 * time.Millisecond,
+			AutoClose: true, ItemLeaseMode: true, VisibilityTimeout: time.Minute})
+	}
+	runUntilComplete(t, r, []string{"capped", "free"}, watchers...)
+	if proc.max["capped"] != 2 {
+		t.Errorf("expected up to 2 items of the capped partition in flight at once across watchers, got %d", proc.max["capped"])
+	}
+}
@@ -0,0 +1,111 @@
+package state
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// Partition labels and item metadata are string maps stored as JSON objects.
+
+func jsonMapValue(m map[string]string) (driver.Value, error) {
+	if m == nil {
+		return "{}", nil
+	}
+	b, err := json.Marshal(m)
+	return string(b), err
+}
+
+func scanJSONMap(value interface{}, m *map[string]string) error {
+	var b []byte
+	switch v := value.(type) {
+	case nil:
+		*m = nil
+		return nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return fmt.Errorf("unsupported JSON map type %T", value)
+	}
+	if len(b) == 0 {
+		*m = nil
+		return nil
+	}
+	return json.Unmarshal(b, m)
+}
+
+// matchesJSONMap returns true if m has every key and value of the selector.
+func matchesJSONMap(m, selector map[string]string) bool {
+	for k, v := range selector {
+		if got, ok := m[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// selectJSON restricts the query to rows whose JSON column has the selector's keys and values,
+// if the dialect can query JSON. The results must still be checked with matchesJSONMap.
+func (db *GormRepo) selectJSON(tx *gorm.DB, column string, selector map[string]string) *gorm.DB {
+	keys := make([]string, 0, len(selector))
+	for k := range selector {
+		// Keys that would need escaping in a JSON path are only matched by the caller.
+		if !strings.ContainsAny(k, `"\`) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) == 0 || !db.supportsJSON() {
+		return tx
+	}
+	for _, k := range keys {
+		switch db.Dialector.Name() {
+		case "sqlite":
+			tx = tx.Where("json_extract("+column+", ?) = ?", `$."`+k+`"`, selector[k])
+		case "sqlserver":
+			tx = tx.Where("JSON_VALUE("+column+", ?) = ?", `$."`+k+`"`, selector[k])
+		case "postgres":
+			tx = tx.Where("CAST("+column+" AS jsonb) ->> ? = ?", k, selector[k])
+		}
+	}
+	return tx
+}
+
+// canSelectJSON returns true if selectJSON matches every key of the selector in the database.
+func (db *GormRepo) canSelectJSON(selector map[string]string) bool {
+	for k := range selector {
+		if strings.ContainsAny(k, `"\`) {
+			return false
+		}
+	}
+	return db.supportsJSON()
+}
+
+// jsonSupport caches whether each database can query JSON, by its gorm config.
+var jsonSupport sync.Map
+
+// supportsJSON returns true if the database can query JSON. SQLite only can if built with the
+// JSON1 extension.
+func (db *GormRepo) supportsJSON() bool {
+	switch db.Dialector.Name() {
+	case "sqlserver", "postgres":
+		return true
+	case "sqlite":
+	default:
+		return false
+	}
+	if ok, found := jsonSupport.Load(db.Config); found {
+		return ok.(bool)
+	}
+	var v string
+	ok := db.Raw(`SELECT json_extract('{"a":"b"}', '$."a"')`).Scan(&v).Error == nil && v == "b"
+	jsonSupport.Store(db.Config, ok)
+	return ok
+}
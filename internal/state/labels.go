@@ -0,0 +1,114 @@
+package state
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// PartitionLabels are key/value metadata on a partition, which watchers can select on. They
+// are stored as a JSON object.
+type PartitionLabels map[string]string
+
+// ParseLabels parses labels of the form key=value,key2=value2.
+func ParseLabels(s string) (PartitionLabels, error) {
+	l := PartitionLabels{}
+	if s == "" {
+		return l, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid label %q, expected key=value", kv)
+		}
+		l[k] = v
+	}
+	return l, nil
+}
+
+func (l PartitionLabels) String() string {
+	kvs := make([]string, 0, len(l))
+	for k, v := range l {
+		kvs = append(kvs, k+"="+v)
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
+
+// Set parses labels, so that they can be used as a flag.Value.
+func (l *PartitionLabels) Set(s string) (err error) {
+	*l, err = ParseLabels(s)
+	return err
+}
+
+// Matches returns true if the labels have every key and value of the selector.
+func (l PartitionLabels) Matches(selector map[string]string) bool {
+	return matchesJSONMap(l, selector)
+}
+
+func (PartitionLabels) GormDataType() string {
+	return "string"
+}
+
+func (l PartitionLabels) Value() (driver.Value, error) {
+	return jsonMapValue(l)
+}
+
+func (l *PartitionLabels) Scan(value interface{}) error {
+	return scanJSONMap(value, (*map[string]string)(l))
+}
+
+// matchingPartitions returns the partitions matching the selector.
+func matchingPartitions(partitions []*Partition, selector map[string]string) []*Partition {
+	if len(selector) == 0 {
+		return partitions
+	}
+	matching := partitions[:0]
+	for _, p := range partitions {
+		if p.Labels.Matches(selector) {
+			matching = append(matching, p)
+		}
+	}
+	return matching
+}
+
+// CreatePartition inserts a new partition, failing with an ErrVersionConflict if it already
+// exists, or an ErrValidation if it would depend on itself, see ErrDependencyCycle.
+func (db *GormRepo) CreatePartition(ctx context.Context, p *Partition) error {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	if err := db.prepareNewPartition(ctx, p); err != nil {
+		return err
+	}
+	p.IncrementVersion()
+	if err := db.WithContext(ctx).Create(p).Error; err != nil {
+		p.DecrementVersion()
+		if isUniqueViolation(err) {
+			return &ErrVersionConflict{Kind: "partition", ID: p.ID}
+		}
+		return err
+	}
+	return nil
+}
+
+// prepareNewPartition validates a partition about to be created, and sets its defaults.
+func (db *GormRepo) prepareNewPartition(ctx context.Context, p *Partition) error {
+	if err := db.assignID("partition", p); err != nil {
+		return err
+	}
+	if err := db.claimTenant(p); err != nil {
+		return err
+	}
+	if err := db.checkDependencies(ctx, p); err != nil {
+		return err
+	}
+	if err := p.GatePlan.validate(); err != nil {
+		return &ErrValidation{Field: "gate_plan", Reason: err.Error()}
+	}
+	if p.Status == Unknown {
+		p.Status = Available
+	}
+	return nil
+}
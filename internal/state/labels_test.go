@@ -0,0 +1,86 @@
+package state
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseLabels(t *testing.T) {
+	l, err := ParseLabels("gpu=true,zone=a=b,empty=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l["gpu"] != "true" || l["zone"] != "a=b" || l["empty"] != "" || len(l) != 3 {
+		t.Errorf("unexpected labels %v", l)
+	}
+	if l.String() != "empty=,gpu=true,zone=a=b" {
+		t.Errorf("unexpected string %s", l)
+	}
+	for _, s := range []string{"gpu", "=true", "gpu=true,"} {
+		if _, err := ParseLabels(s); err == nil {
+			t.Errorf("expected %q to be invalid", s)
+		}
+	}
+}
+
+func TestSelectorAffinity(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	for id, labels := range map[string]PartitionLabels{
+		"gpu1": {"gpu": "true"},
+		"gpu2": {"gpu": "true"},
+		"cpu1": {"gpu": "false"},
+		"cpu2": nil,
+	} {
+		if err := r.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: id}, Labels: labels}); err != nil {
+			t.Fatal(err)
+		}
+		r.Save(ctx, &Item{BaseModel: BaseModel{ID: id + "-i"}, PartitionID: id, Status: Available, Data: []byte(`{"times":1}`)})
+	}
+
+	gpu := &Watcher{OwnerID: "gpu", Selector: map[string]string{"gpu": "true"}}
+	// General workers leave labeled GPU partitions alone by selecting the others explicitly.
+	general := &Watcher{OwnerID: "general", Selector: map[string]string{"gpu": "false"}}
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan struct{}, 2)
+	for _, w := range []*Watcher{gpu, general} {
+		w.Processor, w.Repo, w.BatchSize, w.PollInterval = &testProcessor{}, r, 1, 10*time.Millisecond
+		w.AutoClose = true
+		go func(w *Watcher) {
+			w.Start(cctx)
+			done <- struct{}{}
+		}(w)
+	}
+	owners := map[string]string{"gpu1": "gpu", "gpu2": "gpu", "cpu1": "general"}
+	deadline := time.After(10 * time.Second)
+	for {
+		finished := 0
+		for id := range owners {
+			if p, err := r.GetPartition(ctx, id); err == nil && p.Status == Complete {
+				finished++
+			}
+		}
+		if finished == len(owners) {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("partitions did not complete")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	cancel()
+	<-done
+	<-done
+
+	for id, owner := range owners {
+		if p, _ := r.GetPartition(ctx, id); p.Owner != owner {
+			t.Errorf("expected %s to be leased by %s, got %s", id, owner, p.Owner)
+		}
+	}
+	if p, _ := r.GetPartition(ctx, "cpu2"); p.Owner != "" || p.Status != Available {
+		t.Errorf("expected the unlabeled partition to match neither selector, got owner %q", p.Owner)
+	}
+}
@@ -0,0 +1,87 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+	"github.com/golang/glog"
+	"gorm.io/gorm"
+)
+
+// GetAvailableLag returns how long the partition's oldest item available at its gate has
+// waited, or zero if there is none. Items waiting for their RetryAt are skipped, like by
+// GetAvailableItems, and the oldest item is the least recently saved, whose wait started when
+// it was saved or at its RetryAt, whichever is later.
+func (db *GormRepo) GetAvailableLag(ctx context.Context, p *Partition) (time.Duration, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	oldest := &Item{}
+	err := db.scoped(db.reader(ctx).WithContext(ctx)).Select("updated_at", "retry_at").Where(
+		"partition_id = ? AND status = ? AND gate = ?", p.ID, Available, p.Gate).Where(
+		"retry_at IS NULL OR retry_at <= ?", clock.Or(db.Clock).Now()).Order("updated_at").Take(oldest).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return oldest.lag(clock.Or(db.Clock).Now()), nil
+}
+
+// lag returns how long the available item has waited, since it was saved or its RetryAt.
+func (i *Item) lag(now time.Time) time.Duration {
+	since := i.UpdatedAt
+	if i.RetryAt != nil && i.RetryAt.After(since) {
+		since = *i.RetryAt
+	}
+	if lag := now.Sub(since); lag > 0 {
+		return lag
+	}
+	return 0
+}
+
+// noteLag records and returns the lag of the partition, measured during its poll. Items
+// fetched least recently saved first, and together, lead with the oldest, which saves a query
+// for the other orders and fetch policies.
+func (w *Watcher) noteLag(ctx context.Context, p *Partition, items []*Item) time.Duration {
+	var lag time.Duration
+	switch {
+	case len(items) == 0:
+	case w.FetchOrder == OrderByUpdatedAt && w.FetchPolicy.Mode == FetchAll:
+		lag = items[0].lag(w.Clock.Now())
+	default:
+		var err error
+		if lag, err = w.Repo.GetAvailableLag(ctx, p); err != nil {
+			glog.Warningf("error measuring the lag of partition %s: %s", p.ID, err)
+			return 0
+		}
+	}
+	w.mu.Lock()
+	if w.lags == nil {
+		w.lags = map[string]time.Duration{}
+	}
+	w.lags[p.ID] = lag
+	w.mu.Unlock()
+	w.metrics().Gauge(MetricAvailableLag, lag.Seconds(), Labels{"partition": p.ID})
+	return lag
+}
+
+// availableLags returns the lags of the leased partitions, and the greatest of them.
+func (w *Watcher) availableLags() (map[string]time.Duration, time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.lags) == 0 {
+		return nil, 0
+	}
+	lags := make(map[string]time.Duration, len(w.lags))
+	var max time.Duration
+	for id, lag := range w.lags {
+		lags[id] = lag
+		if lag > max {
+			max = lag
+		}
+	}
+	return lags, max
+}
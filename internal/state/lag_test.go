@@ -0,0 +1,111 @@
+package state
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+)
+
+// lagMetrics records the greatest lag reported for each partition.
+type lagMetrics struct {
+	nopMetrics
+	mu   sync.Mutex
+	lags map[string]float64
+}
+
+func (m *lagMetrics) Gauge(name string, value float64, labels Labels) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if name == MetricAvailableLag && value > m.lags[labels["partition"]] {
+		m.lags[labels["partition"]] = value
+	}
+}
+
+// age sets the time the item was last saved.
+func age(t *testing.T, r *GormRepo, id string, d time.Duration) {
+	t.Helper()
+	if err := r.DB.Model(&Item{}).Where("id = ?", id).UpdateColumn("updated_at", time.Now().Add(-d)).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetAvailableLag(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	p := &Partition{BaseModel: BaseModel{ID: "p"}, Gate: 1}
+	r.Save(ctx, p)
+	if lag, err := r.GetAvailableLag(ctx, p); err != nil || lag != 0 {
+		t.Errorf("expected no lag without items, got %s, %v", lag, err)
+	}
+
+	retryAt := time.Now().Add(time.Hour)
+	for _, i := range []*Item{
+		{BaseModel: BaseModel{ID: "waiting"}, Gate: 1},
+		{BaseModel: BaseModel{ID: "recent"}, Gate: 1},
+		{BaseModel: BaseModel{ID: "earlier_gate"}},
+		{BaseModel: BaseModel{ID: "failed"}, Gate: 1, Status: Failed},
+		{BaseModel: BaseModel{ID: "backing_off"}, Gate: 1, RetryAt: &retryAt},
+	} {
+		if i.Status == Unknown {
+			i.Status = Available
+		}
+		i.PartitionID, i.Data = "p", []byte(`{}`)
+		r.Save(ctx, i)
+	}
+	age(t, r, "waiting", 20*time.Minute)
+	for _, id := range []string{"earlier_gate", "failed", "backing_off"} {
+		age(t, r, id, time.Hour)
+	}
+
+	lag, err := r.GetAvailableLag(ctx, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lag < 20*time.Minute || lag > 21*time.Minute {
+		t.Errorf("expected a lag of 20m, got %s", lag)
+	}
+}
+
+func TestWatcherAvailableLag(t *testing.T) {
+	for _, order := range []ItemOrder{OrderByUpdatedAt, OrderBySequence} {
+		t.Run(order.String(), func(t *testing.T) {
+			r := openTestRepo(t)
+			ctx := context.Background()
+			r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+			for _, id := range []string{"old", "new"} {
+				r.Save(ctx, &Item{BaseModel: BaseModel{ID: id}, PartitionID: "p", Status: Available, Data: []byte(`{"times": 1}`)})
+			}
+			age(t, r, "old", 20*time.Minute)
+
+			m := &lagMetrics{lags: map[string]float64{}}
+			w := &Watcher{Processor: &testProcessor{}, Repo: r, FetchOrder: order, Metrics: m, PollInterval: 10 * time.Millisecond, AutoClose: true}
+			runForEvents(t, r, w)
+			if lag := m.lags["p"]; lag < (20*time.Minute).Seconds() || lag > (21*time.Minute).Seconds() {
+				t.Errorf("expected a lag of 20m to be reported, got %vs", lag)
+			}
+			if stats := w.Stats(); len(stats.AvailableLags) != 0 {
+				t.Errorf("expected the lag to be dropped with the lease, got %v", stats.AvailableLags)
+			}
+		})
+	}
+}
+
+func TestStatsAvailableLag(t *testing.T) {
+	c := clock.NewFake(time.Now())
+	w := &Watcher{Clock: c}
+	now := c.Now()
+	w.noteLag(context.Background(), &Partition{BaseModel: BaseModel{ID: "p1"}}, []*Item{{UpdatedAt: now.Add(-time.Minute)}})
+	w.noteLag(context.Background(), &Partition{BaseModel: BaseModel{ID: "p2"}}, []*Item{{UpdatedAt: now.Add(-time.Hour)}})
+	w.noteLag(context.Background(), &Partition{BaseModel: BaseModel{ID: "p3"}}, nil)
+
+	stats := w.Stats()
+	if len(stats.AvailableLags) != 3 || stats.AvailableLags["p3"] != 0 || stats.AvailableLags["p1"] < time.Minute {
+		t.Errorf("unexpected lags %v", stats.AvailableLags)
+	}
+	if stats.MaxAvailableLag < time.Hour || stats.MaxAvailableLag > time.Hour+time.Minute {
+		t.Errorf("expected the greatest lag to be an hour, got %s", stats.MaxAvailableLag)
+	}
+}
@@ -0,0 +1,139 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+	"github.com/golang/glog"
+	"gorm.io/gorm"
+)
+
+// Leadership is the lease of an election's leader, see Watcher.LeaderElection. Its ID is the
+// name of the election.
+type Leadership struct {
+	BaseModel
+	Owner string    `gorm:"not null;default:''"`
+	Until time.Time `gorm:"not null"`
+}
+
+// AcquireLeadership makes owner the leader of the election until the given time, if the
+// election has no leader, the leader's lease has expired, or owner is already the leader.
+// Returns whether owner is the leader. Elections aren't scoped by tenant.
+func (db *GormRepo) AcquireLeadership(ctx context.Context, election, owner string, until time.Time) (bool, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	var l Leadership
+	err := db.WithContext(ctx).Where("id = ?", election).Take(&l).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		l = Leadership{BaseModel: BaseModel{ID: election, Version: 1}, Owner: owner, Until: until}
+		if err := db.WithContext(ctx).Create(&l).Error; err != nil {
+			// Most likely another owner created it first, it will be read on the next attempt.
+			glog.Infof("error creating leadership of election %s: %s", election, err)
+			return false, nil
+		}
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	now := clock.Or(db.Clock).Now()
+	if l.Owner != owner && beforeAtPrecision(now, l.Until) {
+		return false, nil
+	}
+	res := db.WithContext(ctx).Model(&Leadership{}).Where("id = ? AND version = ?", election, l.Version).Updates(
+		map[string]interface{}{"owner": owner, "until": until, "version": l.Version + 1, "updated_at": now})
+	return res.RowsAffected == 1, res.Error
+}
+
+// ReleaseLeadership expires the owner's leadership of the election, if it has it, so that
+// another owner can take over right away.
+func (db *GormRepo) ReleaseLeadership(ctx context.Context, election, owner string) error {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	now := clock.Or(db.Clock).Now()
+	return db.WithContext(ctx).Model(&Leadership{}).Where("id = ? AND owner = ?", election, owner).Updates(
+		map[string]interface{}{"until": now, "version": gorm.Expr("version + 1"), "updated_at": now}).Error
+}
+
+// IsLeader returns whether the watcher currently leads its LeaderElection. Watchers without
+// an election are never leaders.
+func (w *Watcher) IsLeader() bool {
+	return atomic.LoadInt32(&w.leader) == 1
+}
+
+// lead competes for the leadership of the watcher's election every LeaseInterval, acquiring
+// leases only while it is the leader, until ctx is done.
+func (w *Watcher) lead(ctx context.Context) {
+	var stop context.CancelFunc
+	var stopped chan struct{}
+	var until time.Time
+	for {
+		next := w.Clock.Now().Add(w.LeaseDuration)
+		leader, err := w.Repo.AcquireLeadership(ctx, w.LeaderElection, w.OwnerID, next)
+		switch {
+		case err != nil:
+			if ctx.Err() == nil {
+				glog.Errorf("error acquiring leadership of %s: %s", w.LeaderElection, err)
+			}
+			// Keep the leadership for as long as it was last renewed.
+			leader = stop != nil && w.Clock.Now().Before(until)
+		case leader:
+			until = next
+		}
+		if err == nil {
+			// Standing by counts as progress for Liveness.
+			atomic.StoreInt64(&w.counters.lastLeaseScan, w.Clock.Now().UnixNano())
+		}
+
+		if leader && stop == nil {
+			glog.Infof("%s is the leader of %s", w.OwnerID, w.LeaderElection)
+			leaseCtx, cancel := context.WithCancel(ctx)
+			stop, stopped = cancel, make(chan struct{})
+			atomic.StoreInt32(&w.leader, 1)
+			w.emit(Event{Type: LeadershipAcquired})
+			go func() {
+				w.acquireLeases(leaseCtx)
+				close(stopped)
+			}()
+		} else if !leader && stop != nil {
+			glog.Warningf("%s lost the leadership of %s", w.OwnerID, w.LeaderElection)
+			w.stopLeading(stop, stopped)
+			stop = nil
+		}
+
+		select {
+		case <-w.Clock.After(w.LeaseInterval):
+		case <-ctx.Done():
+			if stop != nil {
+				// The leadership is released once in flight items are saved, see watch.
+				stop()
+				<-stopped
+			}
+			return
+		}
+	}
+}
+
+// stopLeading stops acquiring leases, releasing those held.
+func (w *Watcher) stopLeading(stop context.CancelFunc, stopped chan struct{}) {
+	stop()
+	<-stopped
+	atomic.StoreInt32(&w.leader, 0)
+	w.emit(Event{Type: LeadershipLost})
+}
+
+// resign releases the watcher's leadership on shutdown.
+func (w *Watcher) resign() {
+	if !w.IsLeader() {
+		return
+	}
+	// The watcher's context is already cancelled, the repo applies its own timeout.
+	if err := w.Repo.ReleaseLeadership(context.Background(), w.LeaderElection, w.OwnerID); err != nil {
+		glog.Warningf("error releasing leadership of %s: %s", w.LeaderElection, err)
+	}
+	atomic.StoreInt32(&w.leader, 0)
+	w.emit(Event{Type: LeadershipLost})
+}
@@ -0,0 +1,187 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// exclusiveTracker records which watchers process items, and whether two ever do so at once.
+type exclusiveTracker struct {
+	mu         sync.Mutex
+	active     map[string]int
+	processed  map[string]int
+	violations int
+}
+
+// exclusiveProcessor processes items for one watcher of the tracker.
+type exclusiveProcessor struct {
+	testProcessor
+	owner   string
+	tracker *exclusiveTracker
+}
+
+func (p *exclusiveProcessor) Process(id string, buf []byte) (*ProcessorResponse, error) {
+	t := p.tracker
+	t.mu.Lock()
+	for owner, n := range t.active {
+		if owner != p.owner && n > 0 {
+			t.violations++
+		}
+	}
+	t.active[p.owner]++
+	t.processed[p.owner]++
+	t.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	t.mu.Lock()
+	t.active[p.owner]--
+	t.mu.Unlock()
+	return &ProcessorResponse{Complete: true, Data: []byte(`{}`)}, nil
+}
+
+func TestLeaderElection(t *testing.T) {
+	defer func(b bool) { OverrideMinLeaseDuration = b }(OverrideMinLeaseDuration)
+	OverrideMinLeaseDuration = true
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	var items []*Item
+	for n := 0; n < 60; n++ {
+		items = append(items, &Item{BaseModel: BaseModel{ID: fmt.Sprint("i", n)}, PartitionID: "p", Data: []byte(`{}`)})
+	}
+	if err := r.CreateItems(ctx, items...); err != nil {
+		t.Fatal(err)
+	}
+
+	tracker := &exclusiveTracker{active: map[string]int{}, processed: map[string]int{}}
+	watchers := map[string]*Watcher{}
+	cancels := map[string]context.CancelFunc{}
+	stopped := map[string]chan struct{}{}
+	events := map[string]<-chan Event{}
+	for _, owner := range []string{"a", "b", "c"} {
+		w := &Watcher{
+			Processor:      &exclusiveProcessor{owner: owner, tracker: tracker},
+			Repo:           r,
+			OwnerID:        owner,
+			BatchSize:      2,
+			PollInterval:   10 * time.Millisecond,
+			LeaseDuration:  300 * time.Millisecond,
+			LeaderElection: "test",
+			AutoClose:      true,
+			EventBuffer:    1000,
+		}
+		events[owner] = w.Events()
+		wctx, cancel := context.WithCancel(ctx)
+		watchers[owner], cancels[owner], stopped[owner] = w, cancel, make(chan struct{})
+		go func(owner string) {
+			w.Start(wctx)
+			close(stopped[owner])
+		}(owner)
+	}
+	defer func() {
+		for owner, cancel := range cancels {
+			cancel()
+			<-stopped[owner]
+		}
+	}()
+
+	leaders := func() (out []string) {
+		for owner, w := range watchers {
+			if w.IsLeader() {
+				out = append(out, owner)
+			}
+		}
+		return out
+	}
+	processed := func() int {
+		tracker.mu.Lock()
+		defer tracker.mu.Unlock()
+		n := 0
+		for _, c := range tracker.processed {
+			n += c
+		}
+		return n
+	}
+	waitFor := func(what string, f func() bool) {
+		t.Helper()
+		for start := time.Now(); !f(); time.Sleep(5 * time.Millisecond) {
+			if time.Since(start) > 10*time.Second {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+
+	waitFor("items to be processed", func() bool { return processed() >= 10 })
+	first := leaders()
+	if len(first) != 1 {
+		t.Fatalf("expected a single leader, got %v", first)
+	}
+	cancels[first[0]]()
+	<-stopped[first[0]]
+	delete(watchers, first[0])
+
+	waitFor("the partition to complete", func() bool {
+		p, err := r.GetPartition(ctx, "p")
+		return err == nil && p.Status == Complete
+	})
+	second := leaders()
+	if len(second) != 1 {
+		t.Fatalf("expected a new leader, got %v", second)
+	}
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if tracker.violations != 0 {
+		t.Errorf("expected a single watcher to process items at a time, got %d overlaps", tracker.violations)
+	}
+	if tracker.processed[first[0]] == 0 || tracker.processed[second[0]] == 0 || len(tracker.processed) != 2 {
+		t.Errorf("expected only the leaders to process items, got %v", tracker.processed)
+	}
+	var got []EventType
+	for e := range events[first[0]] {
+		if e.Type == LeadershipAcquired || e.Type == LeadershipLost {
+			got = append(got, e.Type)
+		}
+	}
+	if len(got) != 2 || got[0] != LeadershipAcquired || got[1] != LeadershipLost {
+		t.Errorf("expected the first leader to acquire then lose the leadership, got %v", got)
+	}
+}
+
+func TestAcquireLeadership(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	acquire := func(owner string, d time.Duration) bool {
+		t.Helper()
+		ok, err := r.AcquireLeadership(ctx, "test", owner, time.Now().Add(d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	if !acquire("a", 50*time.Millisecond) || !acquire("a", 50*time.Millisecond) {
+		t.Fatal("expected a to acquire and renew the leadership")
+	}
+	if acquire("b", time.Minute) {
+		t.Fatal("expected b to wait for a's leadership to expire")
+	}
+	// a dies without releasing the leadership.
+	time.Sleep(60 * time.Millisecond)
+	if !acquire("b", time.Minute) {
+		t.Fatal("expected b to take over once a's leadership expired")
+	}
+	if acquire("a", time.Minute) {
+		t.Error("expected a to have lost the leadership")
+	}
+	if ok, err := r.AcquireLeadership(ctx, "other", "a", time.Now().Add(time.Minute)); err != nil || !ok {
+		t.Errorf("expected elections to be independent, got %v, %v", ok, err)
+	}
+
+	if err := r.ReleaseLeadership(ctx, "test", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if !acquire("c", time.Minute) {
+		t.Error("expected c to take over a released leadership right away")
+	}
+}
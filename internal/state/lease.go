@@ -0,0 +1,325 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+	"github.com/golang/glog"
+	"gorm.io/gorm"
+)
+
+// LeaseStatus is the status of a partition's lease, see Partition.LeaseState.
+type LeaseStatus int
+
+const (
+	// Unleased partitions have no owner: they were never leased, or their lease was released
+	// or cleared once expired.
+	Unleased LeaseStatus = iota
+	// LeaseActive partitions are leased by their owner until their Until.
+	LeaseActive
+	// LeaseExpired partitions have an owner whose lease has run out, and may be leased by any
+	// watcher.
+	LeaseExpired
+)
+
+func (s LeaseStatus) String() string {
+	switch s {
+	case LeaseActive:
+		return "Active"
+	case LeaseExpired:
+		return "Expired"
+	default:
+		return "Unleased"
+	}
+}
+
+// MarshalText encodes the status by name, so that JSON output is human readable.
+func (s LeaseStatus) MarshalText() ([]byte, error) { return []byte(s.String()), nil }
+
+// UnmarshalText decodes a status name, as returned by String.
+func (s *LeaseStatus) UnmarshalText(b []byte) error {
+	for _, status := range []LeaseStatus{Unleased, LeaseActive, LeaseExpired} {
+		if strings.EqualFold(string(b), status.String()) {
+			*s = status
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown lease status: %q", b)
+}
+
+// LeaseState is the lease of a partition, as of a point in time.
+type LeaseState struct {
+	Status LeaseStatus
+	// Owner is the owner of an active or expired lease.
+	Owner string
+	// LeasedAt is when the partition was last leased, nil if it never was.
+	LeasedAt *time.Time
+	Until    time.Time
+}
+
+// LeaseState returns the state of the partition's lease.
+func (p *Partition) LeaseState() LeaseState {
+	return p.leaseStateAt(time.Now())
+}
+
+// leaseStateAt is LeaseState as of now, e.g. the time of the watcher's Clock.
+func (p *Partition) leaseStateAt(now time.Time) LeaseState {
+	s := LeaseState{Owner: p.Owner, LeasedAt: p.LeasedAt, Until: p.Until}
+	switch {
+	case p.Owner == "":
+		s.Status = Unleased
+	case p.Expired(now):
+		s.Status = LeaseExpired
+	default:
+		s.Status = LeaseActive
+	}
+	return s
+}
+
+// AcquireLease leases the partition to owner until the given time, with a single conditional
+// update of its lease, as long as the lease is as it was read, and is unleased, expired or
+// already owner's, or, with StealFromDeadOwners, held by a dead owner. On success p's lease is updated, its Fence incremented if it changes
+// owner, and true is returned. The lease isn't versioned: the partition's Version is left as
+// is, so that leasing it doesn't conflict with its other changes, and saves of the partition
+// are rejected once its Fence has moved on, see Save.
+func (db *GormRepo) AcquireLease(ctx context.Context, p *Partition, owner string, until time.Time) (bool, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	now := clock.Or(db.Clock).Now()
+	fence := p.Fence
+	if p.Owner != owner {
+		fence++
+	}
+	acquired := false
+	err := db.Transaction(ctx, func(tx *GormRepo) error {
+		q := tx.scoped(tx.WithContext(ctx)).Model(&Partition{}).
+			Where("id = ? AND owner = ? AND fence = ? AND status <> ?", p.ID, p.Owner, p.Fence, Complete)
+		if tx.StealFromDeadOwners {
+			dead := tx.WithContext(ctx).Model(&Owner{}).Select("owner_id").Where(
+				"last_heartbeat < ?", now.Add(-tx.deadOwnerThreshold()))
+			q = q.Where("owner = '' OR owner = ? OR until < ? OR owner IN (?)", owner, now, dead)
+		} else {
+			q = q.Where("owner = '' OR owner = ? OR until < ?", owner, now)
+		}
+		res := q.UpdateColumns(map[string]interface{}{
+			"owner":      owner,
+			"until":      until,
+			"leased_at":  now,
+			"fence":      fence,
+			"updated_at": now,
+		})
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		acquired = true
+		return tx.recordLeaseEvents(ctx, newLeaseEvent(p, owner, until, now, fence))
+	})
+	if err != nil || !acquired {
+		return false, err
+	}
+	p.Owner, p.Until, p.LeasedAt, p.Fence = owner, until, &now, fence
+	return true, nil
+}
+
+// TryAcquireLease leases the partition to owner until the given time, with a single
+// conditional update, whatever the lease was when it was read: it succeeds if the lease has
+// expired or is already owner's, or, with StealFromDeadOwners, is held by a dead owner, and
+// the partition isn't Complete. Re-acquiring one's own lease extends it. With fence, the
+// partition's Fence is incremented if it changes owner, rejecting the saves of the previous
+// owner, see Save. As with AcquireLease, the Version is left as is.
+func (db *GormRepo) TryAcquireLease(ctx context.Context, partitionID, owner string, until time.Time, fence bool) (bool, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	now := clock.Or(db.Clock).Now()
+	acquired := false
+	err := db.Transaction(ctx, func(tx *GormRepo) error {
+		before, err := tx.leasesBefore(ctx, []string{partitionID}, owner, now)
+		if err != nil || len(before) == 0 {
+			return err
+		}
+		q := tx.scoped(tx.WithContext(ctx)).Model(&Partition{}).Where("id = ?", partitionID)
+		res := tx.claimable(ctx, q, owner, now).UpdateColumns(leaseColumns(owner, until, now, fence))
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		acquired = true
+		prev := before[partitionID]
+		newFence := prev.Fence
+		if fence && prev.Owner != owner {
+			newFence++
+		}
+		return tx.recordLeaseEvents(ctx, newLeaseEvent(prev, owner, until, now, newFence))
+	})
+	return err == nil && acquired, err
+}
+
+// AcquireLeases is TryAcquireLease for up to limit of the candidate partitions, claimed in a
+// single statement, and returns the partitions claimed, as updated.
+func (db *GormRepo) AcquireLeases(ctx context.Context, candidates []string, owner string, until time.Time, limit int, fence bool) ([]*Partition, error) {
+	if len(candidates) == 0 || limit <= 0 {
+		return nil, nil
+	}
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	// The partitions claimed are read back by their LeasedAt, which must compare equal once
+	// stored, whatever the precision of the column.
+	now := clock.Or(db.Clock).Now().Truncate(TimestampPrecision)
+	var claimed []*Partition
+	err := db.Transaction(ctx, func(tx *GormRepo) error {
+		before, err := tx.leasesBefore(ctx, candidates, owner, now)
+		if err != nil || len(before) == 0 {
+			return err
+		}
+		claimable := tx.claimable(ctx, tx.scoped(tx.WithContext(ctx)).Model(&Partition{}).Select("id").Where(
+			"id IN ?", candidates), owner, now).Limit(limit)
+		res := tx.scoped(tx.WithContext(ctx)).Model(&Partition{}).Where("id IN (?)", claimable).
+			UpdateColumns(leaseColumns(owner, until, now, fence))
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		if err := tx.scoped(tx.WithContext(ctx)).Where("id IN ? AND owner = ? AND leased_at = ?", candidates, owner, now).
+			Find(&claimed).Error; err != nil {
+			return err
+		}
+		var events []*LeaseEvent
+		for _, p := range claimed {
+			if prev, ok := before[p.ID]; ok {
+				events = append(events, newLeaseEvent(prev, owner, p.Until, now, p.Fence))
+			}
+		}
+		return tx.recordLeaseEvents(ctx, events...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+// claimable restricts the query to the partitions owner may lease at now, see
+// TryAcquireLease.
+func (db *GormRepo) claimable(ctx context.Context, tx *gorm.DB, owner string, now time.Time) *gorm.DB {
+	tx = tx.Where("status <> ?", Complete)
+	if db.StealFromDeadOwners {
+		dead := db.WithContext(ctx).Model(&Owner{}).Select("owner_id").Where(
+			"last_heartbeat < ?", now.Add(-db.deadOwnerThreshold()))
+		return tx.Where("until < ? OR owner = ? OR owner IN (?)", now, owner, dead)
+	}
+	return tx.Where("until < ? OR owner = ?", now, owner)
+}
+
+// leaseColumns are the columns updated by leasing a partition to owner at now, incrementing
+// its Fence with fence if it changes owner.
+func leaseColumns(owner string, until, now time.Time, fence bool) map[string]interface{} {
+	columns := map[string]interface{}{
+		"owner":      owner,
+		"until":      until,
+		"leased_at":  now,
+		"updated_at": now,
+	}
+	if fence {
+		columns["fence"] = gorm.Expr("CASE WHEN owner = ? THEN fence ELSE fence + 1 END", owner)
+	}
+	return columns
+}
+
+// acquireLease leases the partition polled for the first time until the given time. It
+// returns false if another watcher leased the partition since it was read, e.g. from a lagging
+// replica.
+func (w *Watcher) acquireLease(ctx context.Context, p *Partition, until time.Time) bool {
+	ctx, cancel := w.saveContext(ctx)
+	defer cancel()
+	ok, err := w.Repo.AcquireLease(ctx, p, w.OwnerID, until)
+	if err != nil {
+		glog.Errorf("error leasing partition %s: %s", p.ID, err)
+		return false
+	}
+	if !ok {
+		atomic.AddInt64(&w.counters.saveConflicts, 1)
+		glog.Infof("partition %s was leased since it was read, not leasing it", p.ID)
+	}
+	return ok
+}
+
+// ReleaseLease releases the partition's lease, as long as it is as it was read, clearing its
+// owner and expiring it so that any watcher may lease it right away. On success p's lease is
+// updated.
+func (db *GormRepo) ReleaseLease(ctx context.Context, p *Partition) error {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	now := clock.Or(db.Clock).Now()
+	err := db.Transaction(ctx, func(tx *GormRepo) error {
+		res := tx.scoped(tx.WithContext(ctx)).Model(&Partition{}).
+			Where("id = ? AND owner = ? AND fence = ?", p.ID, p.Owner, p.Fence).
+			UpdateColumns(map[string]interface{}{"owner": "", "until": now, "updated_at": now})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return &ErrVersionConflict{Kind: "partition", ID: p.ID}
+		}
+		return tx.recordLeaseEvents(ctx, newLeaseEvent(p, "", now, now, p.Fence))
+	})
+	if err != nil {
+		return err
+	}
+	p.Owner, p.Until = "", now
+	return nil
+}
+
+// ReleaseExpiredLeases clears the owner of the partitions whose lease has expired, so that
+// they show as Unleased rather than held by long-gone owners, and returns their number. Their
+// Fence is left as is, and moves on when they are next leased.
+func (db *GormRepo) ReleaseExpiredLeases(ctx context.Context) (int, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	now := clock.Or(db.Clock).Now()
+	released := 0
+	err := db.Transaction(ctx, func(tx *GormRepo) error {
+		if err := lockLeases(tx.scoped(tx.WithContext(ctx)).Where("owner <> '' AND until < ?", now)); err != nil {
+			return err
+		}
+		var expired []*Partition
+		if err := tx.scoped(tx.WithContext(ctx)).Select("id", "owner", "until", "fence").
+			Where("owner <> '' AND until < ?", now).Find(&expired).Error; err != nil || len(expired) == 0 {
+			return err
+		}
+		ids := make([]string, len(expired))
+		events := make([]*LeaseEvent, len(expired))
+		for n, p := range expired {
+			ids[n] = p.ID
+			events[n] = newLeaseEvent(p, "", p.Until, now, p.Fence)
+		}
+		res := tx.scoped(tx.WithContext(ctx)).Model(&Partition{}).
+			Where("id IN ? AND owner <> '' AND until < ?", ids, now).
+			UpdateColumn("owner", "")
+		if res.Error != nil {
+			return res.Error
+		}
+		released = int(res.RowsAffected)
+		return tx.recordLeaseEvents(ctx, events...)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return released, nil
+}
+
+// sweepExpiredLeases clears the owner of expired leases, if LeaseSweepInterval has passed
+// since the last sweep, returning the time of the last sweep.
+func (w *Watcher) sweepExpiredLeases(ctx context.Context, last time.Time) time.Time {
+	if w.LeaseSweepInterval <= 0 || w.Clock.Since(last) < w.LeaseSweepInterval {
+		return last
+	}
+	n, err := w.Repo.ReleaseExpiredLeases(ctx)
+	if err != nil && ctx.Err() == nil {
+		glog.Errorf("error releasing expired leases: %s", err)
+	}
+	if n > 0 {
+		glog.Infof("released %d expired leases", n)
+	}
+	return w.Clock.Now()
+}
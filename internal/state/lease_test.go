@@ -0,0 +1,159 @@
+package state
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+)
+
+func TestLeaseStates(t *testing.T) {
+	r := openTestRepo(t)
+	c := clock.NewFake(time.Now())
+	r.Clock = c
+	ctx := context.Background()
+	if err := r.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: "p"}}); err != nil {
+		t.Fatal(err)
+	}
+	check := func(status LeaseStatus, owner string, leased bool) *Partition {
+		t.Helper()
+		p, err := r.GetPartition(ctx, "p")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l := p.leaseStateAt(c.Now()); l.Status != status || l.Owner != owner || (l.LeasedAt != nil) != leased {
+			t.Errorf("expected a lease %s by %q, leased before: %t, got %+v", status, owner, leased, l)
+		}
+		return p
+	}
+	p := check(Unleased, "", false)
+
+	if ok, err := r.AcquireLease(ctx, p, "a", c.Now().Add(30*time.Second)); err != nil || !ok {
+		t.Fatalf("expected the partition to be leased, got %t, %v", ok, err)
+	}
+	check(LeaseActive, "a", true)
+	c.Advance(time.Minute)
+	p = check(LeaseExpired, "a", true)
+
+	if n, err := r.ReleaseExpiredLeases(ctx); err != nil || n != 1 {
+		t.Fatalf("expected the expired lease to be released, got %d, %v", n, err)
+	}
+	p = check(Unleased, "", true)
+	if n, err := r.ReleaseExpiredLeases(ctx); err != nil || n != 0 {
+		t.Errorf("expected no expired lease left, got %d, %v", n, err)
+	}
+
+	if ok, err := r.AcquireLease(ctx, p, "b", c.Now().Add(30*time.Second)); err != nil || !ok {
+		t.Fatalf("expected the partition to be leased again, got %t, %v", ok, err)
+	}
+	if err := r.ReleaseLease(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	p = check(Unleased, "", true)
+	if p.Fence != 2 || p.Version != 1 {
+		t.Errorf("expected two leases at fence 2, leaving the version as is, got fence %d at version %d", p.Fence, p.Version)
+	}
+}
+
+func TestAcquireLease(t *testing.T) {
+	r := openTestRepo(t)
+	c := clock.NewFake(time.Now())
+	r.Clock = c
+	ctx := context.Background()
+	if err := r.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: "p"}}); err != nil {
+		t.Fatal(err)
+	}
+	read := func() *Partition {
+		t.Helper()
+		p, err := r.GetPartition(ctx, "p")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	a, b := read(), read()
+	if ok, err := r.AcquireLease(ctx, a, "a", c.Now().Add(30*time.Second)); err != nil || !ok {
+		t.Fatalf("expected a to lease the partition, got %t, %v", ok, err)
+	}
+	if a.Owner != "a" || a.Fence != 1 || a.LeasedAt == nil || !a.LeasedAt.Equal(c.Now()) {
+		t.Errorf("expected the lease to be set on the partition, got %+v", a)
+	}
+	// b read the partition before a leased it.
+	if ok, err := r.AcquireLease(ctx, b, "b", c.Now().Add(30*time.Second)); err != nil || ok {
+		t.Errorf("expected b's stale read not to lease the partition, got %t, %v", ok, err)
+	}
+	// The active lease is kept from b, but renewed by a without changing its fence.
+	b = read()
+	if ok, err := r.AcquireLease(ctx, b, "b", c.Now().Add(30*time.Second)); err != nil || ok {
+		t.Errorf("expected b not to lease the partition leased by a, got %t, %v", ok, err)
+	}
+	if ok, err := r.AcquireLease(ctx, a, "a", c.Now().Add(time.Minute)); err != nil || !ok || a.Fence != 1 {
+		t.Errorf("expected a to renew its lease at the same fence, got %t, %v at fence %d", ok, err, a.Fence)
+	}
+
+	// Once expired, b takes the lease over, and a's saves are rejected.
+	c.Advance(2 * time.Minute)
+	b = read()
+	if ok, err := r.AcquireLease(ctx, b, "b", c.Now().Add(30*time.Second)); err != nil || !ok || b.Fence != 2 {
+		t.Fatalf("expected b to take the expired lease over, got %t, %v at fence %d", ok, err, b.Fence)
+	}
+	a.Gate = 3
+	if r.Save(ctx, a) {
+		t.Error("expected a's save to be rejected once it lost the lease")
+	}
+	if !r.Save(ctx, b) {
+		t.Error("expected b's save to succeed")
+	}
+	if err := r.ReleaseLease(ctx, a); !IsVersionConflict(err) {
+		t.Errorf("expected a not to release b's lease, got %v", err)
+	}
+
+	// Complete partitions aren't leased.
+	b.Status = Complete
+	if !r.Save(ctx, b) {
+		t.Fatal("error completing the partition")
+	}
+	c.Advance(time.Minute)
+	if ok, err := r.AcquireLease(ctx, read(), "c", c.Now().Add(30*time.Second)); err != nil || ok {
+		t.Errorf("expected the complete partition not to be leased, got %t, %v", ok, err)
+	}
+}
+
+func TestWatcherReleasesLeases(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	if err := r.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: "p"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.CreateItems(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Data: []byte(`{"times": 1}`)}); err != nil {
+		t.Fatal(err)
+	}
+	w := &Watcher{Processor: &testProcessor{}, Repo: r, OwnerID: "w", PollInterval: 10 * time.Millisecond}
+	wctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		w.Start(wctx)
+		close(done)
+	}()
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		if i, err := r.GetItem(ctx, "i"); err == nil && i.Status == Complete {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("item was never processed")
+		}
+	}
+	if p, err := r.GetPartition(ctx, "p"); err != nil || p.LeaseState().Status != LeaseActive || p.Owner != "w" {
+		t.Fatalf("expected the partition to be leased by w, got %+v, %v", p, err)
+	}
+	cancel()
+	<-done
+	p, err := r.GetPartition(ctx, "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := p.LeaseState(); l.Status != Unleased || l.LeasedAt == nil || p.Fence != 1 {
+		t.Errorf("expected the lease to be released on shutdown, got %+v at fence %d", l, p.Fence)
+	}
+}
@@ -0,0 +1,136 @@
+package state
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// LeaseEventReason is why a partition's lease changed hands, see LeaseEvent.
+type LeaseEventReason string
+
+const (
+	// LeaseAcquired is an unleased partition being leased.
+	LeaseAcquired LeaseEventReason = "acquired"
+	// LeaseExpiredSteal is a partition being leased once the lease of its previous owner
+	// expired.
+	LeaseExpiredSteal LeaseEventReason = "expired_steal"
+	// LeaseHeartbeatSteal is a partition being leased before the lease of its previous owner
+	// expired, as the owner stopped sending heartbeats, see StealFromDeadOwners.
+	LeaseHeartbeatSteal LeaseEventReason = "heartbeat_steal"
+	// LeaseReleased is a lease being released by its owner, or cleared once expired.
+	LeaseReleased LeaseEventReason = "released"
+)
+
+// LeaseEvent records a partition's lease changing hands, in the same transaction as the
+// change. Renewals of a lease by its owner aren't recorded, as every poll renews it.
+type LeaseEvent struct {
+	ID          string `gorm:"primaryKey;size:256"`
+	PartitionID string `gorm:"size:256;not null;index:lease_history_idx,priority:1"`
+	// OldOwner is the owner before the change, and NewOwner after it, empty if the partition
+	// was or is left unleased.
+	OldOwner string           `gorm:"size:256;not null;default:''"`
+	NewOwner string           `gorm:"size:256;not null;default:''"`
+	Reason   LeaseEventReason `gorm:"size:32;not null"`
+	// AcquiredAt is when the lease changed hands, and Until when the new lease ends, or, once
+	// released, when the released lease ended.
+	AcquiredAt time.Time `gorm:"not null;index:lease_history_idx,priority:2"`
+	Until      time.Time `gorm:"not null"`
+	// Fence is the partition's Fence after the change.
+	Fence int64 `gorm:"not null;default:0"`
+}
+
+// newLeaseEvent returns the event of the partition's lease, as it was read, changing hands to
+// owner at now, or nil if owner already held it.
+func newLeaseEvent(prev *Partition, owner string, until, now time.Time, fence int64) *LeaseEvent {
+	if prev.Owner == owner {
+		return nil
+	}
+	e := &LeaseEvent{PartitionID: prev.ID, OldOwner: prev.Owner, NewOwner: owner, AcquiredAt: now, Until: until, Fence: fence}
+	switch {
+	case owner == "":
+		e.Reason = LeaseReleased
+	case prev.Owner == "":
+		e.Reason = LeaseAcquired
+	case prev.Expired(now):
+		e.Reason = LeaseExpiredSteal
+	default:
+		e.Reason = LeaseHeartbeatSteal
+	}
+	return e
+}
+
+// leasesBefore reads the leases of the candidates owner may claim at now, by partition ID,
+// for the events of their claim. It must be called within the claim's transaction.
+func (db *GormRepo) leasesBefore(ctx context.Context, candidates []string, owner string, now time.Time) (map[string]*Partition, error) {
+	if err := lockLeases(db.scoped(db.WithContext(ctx)).Where("id IN ?", candidates)); err != nil {
+		return nil, err
+	}
+	var partitions []*Partition
+	tx := db.scoped(db.WithContext(ctx)).Select("id", "owner", "until", "fence").Where("id IN ?", candidates)
+	if err := db.claimable(ctx, tx, owner, now).Find(&partitions).Error; err != nil {
+		return nil, err
+	}
+	before := make(map[string]*Partition, len(partitions))
+	for _, p := range partitions {
+		before[p.ID] = p
+	}
+	return before, nil
+}
+
+// lockLeases takes the write lock on the partitions matching the query, with an update
+// leaving them as they are, before they are read within the transaction, e.g. their leases for
+// the events of their change. SQLite
+// would otherwise upgrade the transaction's read lock as the leases are changed, which fails
+// while other writers hold it.
+func lockLeases(tx *gorm.DB) error {
+	return tx.Model(&Partition{}).UpdateColumn("fence", gorm.Expr("fence")).Error
+}
+
+// recordLeaseEvents inserts the events, skipping nil ones.
+func (db *GormRepo) recordLeaseEvents(ctx context.Context, events ...*LeaseEvent) error {
+	var recorded []*LeaseEvent
+	for _, e := range events {
+		if e != nil {
+			e.ID = db.newID()
+			recorded = append(recorded, e)
+		}
+	}
+	if len(recorded) == 0 {
+		return nil
+	}
+	return db.WithContext(ctx).Create(&recorded).Error
+}
+
+// GetLeaseHistory returns up to limit of the latest lease events of the partition, latest
+// first, or every one of them if limit isn't positive.
+func (db *GormRepo) GetLeaseHistory(ctx context.Context, partitionID string, limit int) ([]*LeaseEvent, error) {
+	if _, err := db.GetPartition(ctx, partitionID); err != nil {
+		return nil, err
+	}
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	tx := db.WithContext(ctx).Where("partition_id = ?", partitionID).Order("acquired_at DESC, id DESC")
+	if limit > 0 {
+		tx = tx.Limit(limit)
+	}
+	var events []*LeaseEvent
+	if err := tx.Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// PurgeLeaseEvents deletes the lease events recorded before the given time, those of the
+// repo's Tenant if set, and returns their number.
+func (db *GormRepo) PurgeLeaseEvents(ctx context.Context, before time.Time) (int, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	tx := db.WithContext(ctx).Where("acquired_at < ?", before)
+	if db.Tenant != "" {
+		tx = tx.Where("partition_id IN (?)", db.scoped(db.WithContext(ctx)).Model(&Partition{}).Select("id"))
+	}
+	res := tx.Delete(&LeaseEvent{})
+	return int(res.RowsAffected), res.Error
+}
@@ -0,0 +1,180 @@
+package state
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+)
+
+// leaseEventsOf returns the partition's lease events, oldest first.
+func leaseEventsOf(t *testing.T, r *GormRepo, id string) []*LeaseEvent {
+	t.Helper()
+	events, err := r.GetLeaseHistory(context.Background(), id, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events
+}
+
+func checkLeaseEvents(t *testing.T, events []*LeaseEvent, expected ...LeaseEvent) {
+	t.Helper()
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d lease events, got %d", len(expected), len(events))
+	}
+	for n, e := range events {
+		want := expected[n]
+		if e.Reason != want.Reason || e.OldOwner != want.OldOwner || e.NewOwner != want.NewOwner || e.Fence != want.Fence {
+			t.Errorf("expected event %d to be %s from %q to %q at fence %d, got %s from %q to %q at fence %d",
+				n, want.Reason, want.OldOwner, want.NewOwner, want.Fence, e.Reason, e.OldOwner, e.NewOwner, e.Fence)
+		}
+		if !want.AcquiredAt.IsZero() && !e.AcquiredAt.Equal(want.AcquiredAt) {
+			t.Errorf("expected event %d at %s, got %s", n, want.AcquiredAt, e.AcquiredAt)
+		}
+	}
+}
+
+func TestLeaseHistory(t *testing.T) {
+	r := openTestRepo(t)
+	c := clock.NewFake(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC))
+	r.Clock = c
+	ctx := context.Background()
+	if err := r.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: "p"}}); err != nil {
+		t.Fatal(err)
+	}
+	start := c.Now()
+
+	// a leases the partition, and renews its lease without recording it.
+	if ok, err := r.TryAcquireLease(ctx, "p", "a", c.Now().Add(30*time.Second), true); err != nil || !ok {
+		t.Fatalf("expected a to lease the partition, got %t, %v", ok, err)
+	}
+	c.Advance(10 * time.Second)
+	if ok, err := r.TryAcquireLease(ctx, "p", "a", c.Now().Add(30*time.Second), true); err != nil || !ok {
+		t.Fatalf("expected a to renew its lease, got %t, %v", ok, err)
+	}
+	// b steals the lease once expired, and releases it.
+	c.Advance(time.Minute)
+	stolen := c.Now()
+	claimed, err := r.AcquireLeases(ctx, []string{"p"}, "b", c.Now().Add(30*time.Second), 1, true)
+	if err != nil || len(claimed) != 1 {
+		t.Fatalf("expected b to take the lease over, got %d, %v", len(claimed), err)
+	}
+	// Events recorded at the same time have no defined order.
+	c.Advance(time.Second)
+	if err := r.ReleaseLease(ctx, claimed[0]); err != nil {
+		t.Fatal(err)
+	}
+	// c leases the released partition, and its lease is cleared once expired.
+	c.Advance(time.Second)
+	p, err := r.GetPartition(ctx, "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := r.AcquireLease(ctx, p, "c", c.Now().Add(30*time.Second)); err != nil || !ok {
+		t.Fatalf("expected c to lease the partition, got %t, %v", ok, err)
+	}
+	c.Advance(time.Minute)
+	if n, err := r.ReleaseExpiredLeases(ctx); err != nil || n != 1 {
+		t.Fatalf("expected the expired lease to be released, got %d, %v", n, err)
+	}
+
+	checkLeaseEvents(t, leaseEventsOf(t, r, "p"),
+		LeaseEvent{Reason: LeaseAcquired, NewOwner: "a", Fence: 1, AcquiredAt: start},
+		LeaseEvent{Reason: LeaseExpiredSteal, OldOwner: "a", NewOwner: "b", Fence: 2, AcquiredAt: stolen},
+		LeaseEvent{Reason: LeaseReleased, OldOwner: "b", Fence: 2, AcquiredAt: stolen.Add(time.Second)},
+		LeaseEvent{Reason: LeaseAcquired, NewOwner: "c", Fence: 3},
+		LeaseEvent{Reason: LeaseReleased, OldOwner: "c", Fence: 3},
+	)
+
+	// A failed acquisition records nothing.
+	if ok, err := r.AcquireLease(ctx, p, "d", c.Now().Add(30*time.Second)); err != nil || ok {
+		t.Fatalf("expected d's stale read not to lease the partition, got %t, %v", ok, err)
+	}
+	if events := leaseEventsOf(t, r, "p"); len(events) != 5 {
+		t.Errorf("expected no event for the failed acquisition, got %d events", len(events))
+	}
+
+	latest, err := r.GetLeaseHistory(ctx, "p", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLeaseEvents(t, latest, LeaseEvent{Reason: LeaseReleased, OldOwner: "c", Fence: 3}, LeaseEvent{Reason: LeaseAcquired, NewOwner: "c", Fence: 3})
+	if _, err := r.GetLeaseHistory(ctx, "missing", 0); !IsNotFound(err) {
+		t.Errorf("expected the history of a missing partition not to be found, got %v", err)
+	}
+
+	// Purging drops the events recorded before the given time.
+	if n, err := r.PurgeLeaseEvents(ctx, stolen); err != nil || n != 1 {
+		t.Fatalf("expected the first event to be purged, got %d, %v", n, err)
+	}
+	if events := leaseEventsOf(t, r, "p"); len(events) != 4 || events[0].Reason != LeaseExpiredSteal {
+		t.Errorf("expected the events from the steal on to be kept, got %d events", len(events))
+	}
+}
+
+func TestLeaseHistoryHeartbeatSteal(t *testing.T) {
+	r := openTestRepo(t)
+	r.StealFromDeadOwners = true
+	r.DeadOwnerThreshold = time.Second
+	ctx := context.Background()
+	if err := r.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: "p"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Heartbeat(ctx, &Owner{OwnerID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := r.TryAcquireLease(ctx, "p", "a", time.Now().Add(time.Hour), true); err != nil || !ok {
+		t.Fatalf("expected a to lease the partition, got %t, %v", ok, err)
+	}
+	if ok, err := r.TryAcquireLease(ctx, "p", "b", time.Now().Add(time.Hour), true); err != nil || ok {
+		t.Fatalf("expected b not to steal the lease of a live owner, got %t, %v", ok, err)
+	}
+	// a stops sending heartbeats, and b takes its lease over before it expires.
+	if err := r.Model(&Owner{}).Where("owner_id = ?", "a").Update("last_heartbeat", time.Now().Add(-time.Minute)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := r.TryAcquireLease(ctx, "p", "b", time.Now().Add(time.Hour), true); err != nil || !ok {
+		t.Fatalf("expected b to steal the lease of the dead owner, got %t, %v", ok, err)
+	}
+	checkLeaseEvents(t, leaseEventsOf(t, r, "p"),
+		LeaseEvent{Reason: LeaseAcquired, NewOwner: "a", Fence: 1},
+		LeaseEvent{Reason: LeaseHeartbeatSteal, OldOwner: "a", NewOwner: "b", Fence: 2},
+	)
+}
+
+func TestWatcherRecordsLeaseHistory(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	if err := r.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: "p"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.CreateItems(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Data: []byte(`{"times": 1}`)}); err != nil {
+		t.Fatal(err)
+	}
+	w := &Watcher{Processor: &testProcessor{}, Repo: r, OwnerID: "w", PollInterval: 10 * time.Millisecond}
+	wctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		w.Start(wctx)
+		close(done)
+	}()
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		if i, err := r.GetItem(ctx, "i"); err == nil && i.Status == Complete {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("item was never processed")
+		}
+	}
+	cancel()
+	<-done
+	// Each poll renews the lease, without recording it.
+	checkLeaseEvents(t, leaseEventsOf(t, r, "p"),
+		LeaseEvent{Reason: LeaseAcquired, NewOwner: "w", Fence: 1},
+		LeaseEvent{Reason: LeaseReleased, OldOwner: "w", Fence: 1},
+	)
+}
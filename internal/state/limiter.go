@@ -0,0 +1,49 @@
+package state
+
+import (
+	"context"
+	"fmt"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+	"golang.org/x/time/rate"
+)
+
+// Limiter paces item processing. A single Limiter may be shared by several watchers in one
+// process so that they share a budget.
+type Limiter interface {
+	// Wait blocks until the next item may be processed, or ctx is done.
+	Wait(ctx context.Context) error
+}
+
+// NewRateLimiter returns a Limiter allowing limit items per second, with bursts of up to burst
+// items. A nil clock uses the real time.
+func NewRateLimiter(limit float64, burst int, c clock.Clock) Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{lim: rate.NewLimiter(rate.Limit(limit), burst), clock: clock.Or(c)}
+}
+
+type rateLimiter struct {
+	lim   *rate.Limiter
+	clock clock.Clock
+}
+
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	now := l.clock.Now()
+	r := l.lim.ReserveN(now, 1)
+	if !r.OK() {
+		return fmt.Errorf("rate limit burst of %d does not allow any events", l.lim.Burst())
+	}
+	delay := r.DelayFrom(now)
+	if delay == 0 {
+		return nil
+	}
+	select {
+	case <-l.clock.After(delay):
+		return nil
+	case <-ctx.Done():
+		r.CancelAt(l.clock.Now())
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,96 @@
+package state
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+)
+
+func TestRateLimiterPacing(t *testing.T) {
+	c := clock.NewFake(time.Now())
+	lim := NewRateLimiter(10, 2, c)
+
+	var done int32
+	go func() {
+		for n := 0; n < 5; n++ {
+			if err := lim.Wait(context.Background()); err != nil {
+				t.Error(err)
+				return
+			}
+			atomic.AddInt32(&done, 1)
+		}
+	}()
+
+	// The burst is allowed immediately, then one item every 100ms.
+	c.BlockUntil(1)
+	if got := atomic.LoadInt32(&done); got != 2 {
+		t.Fatalf("expected the burst of 2 to be allowed immediately, got %d", got)
+	}
+	for want := int32(3); want <= 5; want++ {
+		c.Advance(99 * time.Millisecond)
+		time.Sleep(10 * time.Millisecond)
+		if got := atomic.LoadInt32(&done); got != want-1 {
+			t.Fatalf("expected %d items before the interval elapsed, got %d", want-1, got)
+		}
+		c.Advance(time.Millisecond)
+		if want < 5 {
+			c.BlockUntil(1)
+		} else {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := atomic.LoadInt32(&done); got != want {
+			t.Fatalf("expected %d items after the interval elapsed, got %d", want, got)
+		}
+	}
+}
+
+func TestRateLimiterHonorsContext(t *testing.T) {
+	c := clock.NewFake(time.Now())
+	lim := NewRateLimiter(1, 1, c)
+	if err := lim.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() { errs <- lim.Wait(ctx) }()
+	c.BlockUntil(1)
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("expected context cancelled, got %v", err)
+	}
+}
+
+type recordingMetrics struct {
+	nopMetrics
+	durations map[string]time.Duration
+}
+
+func (m *recordingMetrics) Duration(name string, d time.Duration, labels Labels) {
+	m.durations[name] += d
+}
+
+func TestWatcherLimiterWait(t *testing.T) {
+	c := clock.NewFake(time.Now())
+	m := &recordingMetrics{durations: map[string]time.Duration{}}
+	w := &Watcher{Clock: c, Limiter: NewRateLimiter(2, 1, c), Metrics: m}
+
+	if !w.waitForLimiter(context.Background()) {
+		t.Fatal("expected the first item to be allowed")
+	}
+	allowed := make(chan bool)
+	go func() { allowed <- w.waitForLimiter(context.Background()) }()
+	c.BlockUntil(1)
+	c.Advance(500 * time.Millisecond)
+	if !<-allowed {
+		t.Fatal("expected the second item to be allowed")
+	}
+	if got := w.Stats().LimiterWait; got != 500*time.Millisecond {
+		t.Errorf("expected 500ms waiting on the limiter in stats, got %s", got)
+	}
+	if got := m.durations[MetricLimiterWait]; got != 500*time.Millisecond {
+		t.Errorf("expected 500ms waiting on the limiter in metrics, got %s", got)
+	}
+}
@@ -0,0 +1,237 @@
+package state
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DefaultPageSize is the number of results returned by the list APIs when no size is requested.
+var DefaultPageSize = 100
+
+// PageToken is an opaque cursor returned by the list APIs. An empty token means
+// there are no further results.
+type PageToken string
+
+// PageRequest controls pagination for the list APIs. Results are ordered by
+// (updated_at, id), so paging is stable while rows are being written: an object
+// updated mid-scan moves to the end rather than shifting unseen objects.
+type PageRequest struct {
+	// Size is the maximum number of results. Defaults to DefaultPageSize.
+	Size int
+	// Token is the token returned by the previous page, or empty for the first page.
+	Token PageToken
+}
+
+// PartitionFilter restricts the results of ListPartitions. Zero values are ignored.
+type PartitionFilter struct {
+	Status       Status
+	Owner        string
+	IDPrefix     string
+	UpdatedSince time.Time
+	// Labels restricts the results to partitions with all of these labels.
+	Labels map[string]string
+	// DependsOn restricts the results to the partitions depending on this partition.
+	DependsOn string
+}
+
+// ItemFilter restricts the results of ListItems. Zero values are ignored.
+type ItemFilter struct {
+	Status                Status
+	PartitionID           string
+	PartitionIDPrefix     string
+	UpdatedSince          time.Time
+	RetryCountGreaterThan *int
+	// Metadata restricts the results to items with all of these metadata keys and values.
+	Metadata map[string]string
+	// LastOwner and ProcessedSince restrict the results to the items last attempted by the
+	// owner, and since the time.
+	LastOwner      string
+	ProcessedSince time.Time
+}
+
+func (f ItemFilter) empty() bool {
+	return f.Status == Unknown && f.PartitionID == "" && f.PartitionIDPrefix == "" &&
+		f.UpdatedSince.IsZero() && f.RetryCountGreaterThan == nil && len(f.Metadata) == 0 &&
+		f.LastOwner == "" && f.ProcessedSince.IsZero()
+}
+
+type pageCursor struct {
+	UpdatedAt time.Time `json:"u"`
+	ID        string    `json:"i"`
+}
+
+func (c pageCursor) token() PageToken {
+	buf, _ := json.Marshal(c)
+	return PageToken(base64.RawURLEncoding.EncodeToString(buf))
+}
+
+func parsePageToken(t PageToken) (c pageCursor, err error) {
+	buf, err := base64.RawURLEncoding.DecodeString(string(t))
+	if err != nil {
+		return c, fmt.Errorf("invalid page token: %w", err)
+	}
+	if err := json.Unmarshal(buf, &c); err != nil {
+		return c, fmt.Errorf("invalid page token: %w", err)
+	}
+	return c, nil
+}
+
+// paginate applies the cursor and ordering of the page to the query. One extra row is
+// fetched so the caller can tell whether another page exists.
+func paginate(tx *gorm.DB, page PageRequest) (*gorm.DB, int, error) {
+	size := page.Size
+	if size <= 0 {
+		size = DefaultPageSize
+	}
+	if page.Token != "" {
+		c, err := parsePageToken(page.Token)
+		if err != nil {
+			return nil, 0, err
+		}
+		tx = tx.Where("(updated_at > ? OR (updated_at = ? AND id > ?))", c.UpdatedAt, c.UpdatedAt, c.ID)
+	}
+	return tx.Order("updated_at").Order("id").Limit(size + 1), size, nil
+}
+
+// likeEscaper escapes LIKE patterns with '!', rather than a backslash, whose meaning in a
+// string literal depends on the standard_conforming_strings setting of Postgres.
+var likeEscaper = strings.NewReplacer(`!`, `!!`, `%`, `!%`, `_`, `!_`)
+
+func prefixPattern(prefix string) string {
+	return likeEscaper.Replace(prefix) + "%"
+}
+
+// ListPartitions returns a page of partitions matching the filter.
+func (db *GormRepo) ListPartitions(ctx context.Context, filter PartitionFilter, page PageRequest) ([]*Partition, PageToken, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	tx := db.scoped(db.reader(ctx).WithContext(ctx)).Model(&Partition{})
+	if filter.Status != Unknown {
+		tx = tx.Where("status = ?", filter.Status)
+	}
+	if filter.Owner != "" {
+		tx = tx.Where("owner = ?", filter.Owner)
+	}
+	if filter.IDPrefix != "" {
+		tx = tx.Where(`id LIKE ? ESCAPE '!'`, prefixPattern(filter.IDPrefix))
+	}
+	if !filter.UpdatedSince.IsZero() {
+		tx = tx.Where("updated_at >= ?", filter.UpdatedSince)
+	}
+	if filter.DependsOn != "" {
+		tx = tx.Where("depends_on = ?", filter.DependsOn)
+	}
+	tx, size, err := paginate(db.selectJSON(tx, "labels", filter.Labels), page)
+	if err != nil {
+		return nil, "", err
+	}
+	var partitions []*Partition
+	if err := tx.Find(&partitions).Error; err != nil {
+		return nil, "", err
+	}
+	if len(partitions) <= size {
+		return matchingPartitions(partitions, filter.Labels), "", nil
+	}
+	partitions = partitions[:size]
+	last := partitions[size-1]
+	// Without JSON support in the database, a page may hold fewer than size matches.
+	return matchingPartitions(partitions, filter.Labels), pageCursor{UpdatedAt: last.UpdatedAt, ID: last.ID}.token(), nil
+}
+
+// ListItems returns a page of items matching the filter.
+func (db *GormRepo) ListItems(ctx context.Context, filter ItemFilter, page PageRequest) ([]*Item, PageToken, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	tx, size, err := paginate(db.filterItems(db.scoped(db.reader(ctx).WithContext(ctx)).Model(&Item{}), filter), page)
+	if err != nil {
+		return nil, "", err
+	}
+	var items []*Item
+	if err := tx.Find(&items).Error; err != nil {
+		return nil, "", err
+	}
+	if len(items) <= size {
+		items = matchingItems(items, filter.Metadata)
+		return items, "", db.load(ctx, items...)
+	}
+	last := items[size-1]
+	// Without JSON support in the database, a page may hold fewer than size matches.
+	items = matchingItems(items[:size], filter.Metadata)
+	return items, pageCursor{UpdatedAt: last.UpdatedAt, ID: last.ID}.token(), db.load(ctx, items...)
+}
+
+// matchingItems returns the items with the selected metadata.
+func matchingItems(items []*Item, selector map[string]string) []*Item {
+	if len(selector) == 0 {
+		return items
+	}
+	matching := items[:0]
+	for _, i := range items {
+		if matchesJSONMap(i.Metadata, selector) {
+			matching = append(matching, i)
+		}
+	}
+	return matching
+}
+
+// filterItems restricts the query to the items matching the filter. Metadata is only matched
+// if the database can query JSON, see matchingItems.
+func (db *GormRepo) filterItems(tx *gorm.DB, filter ItemFilter) *gorm.DB {
+	if filter.Status != Unknown {
+		tx = tx.Where("status = ?", filter.Status)
+	}
+	if filter.PartitionID != "" {
+		tx = tx.Where("partition_id = ?", filter.PartitionID)
+	}
+	if filter.PartitionIDPrefix != "" {
+		tx = tx.Where(`partition_id LIKE ? ESCAPE '!'`, prefixPattern(filter.PartitionIDPrefix))
+	}
+	if !filter.UpdatedSince.IsZero() {
+		tx = tx.Where("updated_at >= ?", filter.UpdatedSince)
+	}
+	if filter.RetryCountGreaterThan != nil {
+		tx = tx.Where("retry_count > ?", *filter.RetryCountGreaterThan)
+	}
+	if filter.LastOwner != "" {
+		tx = tx.Where("last_owner = ?", filter.LastOwner)
+	}
+	if !filter.ProcessedSince.IsZero() {
+		tx = tx.Where("last_processed_at >= ?", filter.ProcessedSince)
+	}
+	return db.selectJSON(tx, "metadata", filter.Metadata)
+}
+
+// GetPartition returns the partition with the given ID, or an ErrNotFound.
+func (db *GormRepo) GetPartition(ctx context.Context, id string) (*Partition, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	p := &Partition{}
+	if err := db.scoped(db.WithContext(ctx)).Where("id = ?", id).Take(p).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &ErrNotFound{Kind: "partition", ID: id}
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+// GetItem returns the item with the given ID, or an ErrNotFound.
+func (db *GormRepo) GetItem(ctx context.Context, id string) (*Item, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	i := &Item{}
+	if err := db.scoped(db.WithContext(ctx)).Where("id = ?", id).Take(i).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &ErrNotFound{Kind: "item", ID: id}
+		}
+		return nil, err
+	}
+	return i, db.load(ctx, i)
+}
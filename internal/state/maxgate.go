@@ -0,0 +1,37 @@
+package state
+
+import (
+	"context"
+)
+
+// CountAvailablePastGate returns the number of Available items of the partition at a later
+// gate than the given one.
+func (db *GormRepo) CountAvailablePastGate(ctx context.Context, partitionID string, gate int) (int, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	var count int64
+	err := db.scoped(db.WithContext(ctx)).Model(&Item{}).Where(
+		"partition_id = ? AND status = ? AND gate > ?", partitionID, Available, gate).Count(&count).Error
+	return int(count), err
+}
+
+// countAvailableAtGate returns the number of Available items of the partition at the gate,
+// including those waiting to be retried.
+func (db *GormRepo) countAvailableAtGate(ctx context.Context, partitionID string, gate int) (int, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	var count int64
+	err := db.scoped(db.WithContext(ctx)).Model(&Item{}).Where(
+		"partition_id = ? AND status = ? AND gate = ?", partitionID, Available, gate).Count(&count).Error
+	return int(count), err
+}
+
+// remainingItems returns the number of Available items the partition has left to process,
+// leaving out those past its MaxGate, which are never processed.
+func remainingItems(ctx context.Context, r ItemReader, p *Partition, counts map[Status]int) (int, error) {
+	if p.MaxGate == 0 || counts[Available] == 0 {
+		return counts[Available], nil
+	}
+	past, err := r.CountAvailablePastGate(ctx, p.ID, p.MaxGate)
+	return counts[Available] - past, err
+}
@@ -0,0 +1,69 @@
+package state
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaxGate(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		maxGate   int
+		autoClose bool
+		wantGate  int
+		wantLate  Status
+	}{
+		{name: "without auto close", maxGate: 1, wantGate: 1, wantLate: Available},
+		{name: "with auto close", maxGate: 1, autoClose: true, wantGate: 1, wantLate: Available},
+		{name: "auto close without max gate", autoClose: true, wantGate: 2, wantLate: Complete},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := openTestRepo(t)
+			ctx := context.Background()
+			r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}, MaxGate: tc.maxGate})
+			r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Data: []byte(`{"times":2,"gate":1}`)})
+			r.Save(ctx, &Item{BaseModel: BaseModel{ID: "late"}, PartitionID: "p", Gate: 2, Data: []byte(`{"times":1,"gate":2}`)})
+
+			events := runForEvents(t, r, &Watcher{Processor: &testProcessor{}, Repo: r, BatchSize: 1, PollInterval: 10 * time.Millisecond, AutoClose: tc.autoClose})
+
+			if got := eventTypes(events); got[len(got)-1] != PartitionCompleted {
+				t.Errorf("expected the partition to complete, got %v", got)
+			}
+			p, err := r.GetPartition(ctx, "p")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Gate != tc.wantGate {
+				t.Errorf("expected the partition to stop at gate %d, got %d", tc.wantGate, p.Gate)
+			}
+			for id, want := range map[string]Status{"i": Complete, "late": tc.wantLate} {
+				if i, err := r.GetItem(ctx, id); err != nil || i.Status != want {
+					t.Errorf("expected item %s to be %s, got %v, %v", id, want, i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxGateRejectsNextGate(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}, Gate: 1, MaxGate: 1})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Gate: 1, Data: []byte(`{"times":2,"gate":2}`)})
+
+	events := runForEvents(t, r, &Watcher{Processor: &testProcessor{}, Repo: r, BatchSize: 1, PollInterval: 10 * time.Millisecond, AutoClose: true})
+
+	var failed bool
+	for _, e := range events {
+		failed = failed || (e.Type == ItemFailed && !IsRetryable(e.Err))
+	}
+	i, err := r.GetItem(ctx, "i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !failed || i.Status != Failed || i.Gate != 1 || !strings.Contains(i.ErrorMessages, "max gate 1") {
+		t.Errorf("expected the item to fail at gate 1, got %s at gate %d with %q", i.Status, i.Gate, i.ErrorMessages)
+	}
+}
@@ -0,0 +1,81 @@
+package state
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+)
+
+// MaxItemMetadataSize is the largest an item's metadata may be, encoded as JSON.
+var MaxItemMetadataSize = 4 << 10
+
+// ItemMetadata are small key/value hints for the processor about how to process an item, e.g.
+// which downstream endpoint or model version to use. They are stored as a JSON object.
+type ItemMetadata map[string]string
+
+func (ItemMetadata) GormDataType() string {
+	return "string"
+}
+
+func (m ItemMetadata) Value() (driver.Value, error) {
+	v, err := jsonMapValue(m)
+	if err != nil {
+		return nil, err
+	}
+	if n := len(v.(string)); n > MaxItemMetadataSize {
+		return nil, fmt.Errorf("item metadata is %d bytes, more than the maximum of %d", n, MaxItemMetadataSize)
+	}
+	return v, nil
+}
+
+func (m *ItemMetadata) Scan(value interface{}) error {
+	return scanJSONMap(value, (*map[string]string)(m))
+}
+
+// ProcessRequest describes an item to a RequestProcessor.
+type ProcessRequest struct {
+	ID          string
+	PartitionID string
+	Gate        int
+	Data        []byte
+	Metadata    ItemMetadata
+	// Fence increases each time the item's partition changes owner. Services with side
+	// effects should remember the highest fence seen for each partition, and reject requests
+	// with a lower one: they come from a watcher that has lost its lease, and whose result
+	// will be discarded.
+	Fence int64
+	// RetryCount is the number of the item's attempts that failed before this one, since it
+	// reached its gate unless the watcher KeepRetriesAcrossGates.
+	RetryCount int
+	// Labels are the labels of the item's partition, e.g. to route it by.
+	Labels PartitionLabels
+}
+
+// RequestProcessor is optionally implemented by processors that want more than an item's
+// payload. The watcher then calls ProcessRequest instead of Process or ProcessContext.
+type RequestProcessor interface {
+	ProcessRequest(ctx context.Context, req *ProcessRequest) (*ProcessorResponse, error)
+}
+
+// process sends the item to whichever method the processor implements. A panic of the
+// processor is returned as a PanicError.
+func (w *Watcher) process(ctx context.Context, i *Item) (resp *ProcessorResponse, err error) {
+	defer recoverProcessor(i, &err)
+	switch p := w.Processor.(type) {
+	case RequestProcessor:
+		return p.ProcessRequest(ctx, &ProcessRequest{
+			ID:          i.ID,
+			PartitionID: i.PartitionID,
+			Gate:        i.Gate,
+			Data:        i.input(),
+			Metadata:    i.Metadata,
+			Fence:       i.Fence,
+			RetryCount:  i.RetryCount,
+			Labels:      i.partition.labels,
+		})
+	case ContextProcessor:
+		return p.ProcessContext(ctx, i.ID, i.input())
+	default:
+		return w.Process(i.ID, i.input())
+	}
+}
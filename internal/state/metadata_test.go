@@ -0,0 +1,90 @@
+package state
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// metadataProcessor records the requests it receives, and tags each item with the gate it
+// completed at.
+type metadataProcessor struct {
+	testProcessor
+	mu       sync.Mutex
+	requests []ProcessRequest
+	metadata ItemMetadata
+}
+
+func (p *metadataProcessor) ProcessRequest(ctx context.Context, req *ProcessRequest) (*ProcessorResponse, error) {
+	p.mu.Lock()
+	p.requests = append(p.requests, *req)
+	p.mu.Unlock()
+	return &ProcessorResponse{Complete: true, Data: []byte(`{}`), Metadata: p.metadata}, nil
+}
+
+func TestItemMetadata(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}, Labels: PartitionLabels{"region": "eu"}})
+	if err := r.CreateItems(ctx,
+		&Item{BaseModel: BaseModel{ID: "v1"}, PartitionID: "p", Data: []byte(`{}`), Metadata: ItemMetadata{"model": "v1"}, RetryCount: 2},
+		&Item{BaseModel: BaseModel{ID: "v2"}, PartitionID: "p", Data: []byte(`{}`), Metadata: ItemMetadata{"model": "v2", "endpoint": "b"}},
+		&Item{BaseModel: BaseModel{ID: "none"}, PartitionID: "p", Data: []byte(`{}`)},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	items, _, err := r.ListItems(ctx, ItemFilter{Metadata: map[string]string{"model": "v2"}}, PageRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].ID != "v2" || items[0].Metadata["endpoint"] != "b" {
+		t.Errorf("expected only the v2 item, got %v", items)
+	}
+
+	proc := &metadataProcessor{metadata: ItemMetadata{"model": "v3"}}
+	runForEvents(t, r, &Watcher{Processor: proc, Repo: r, BatchSize: 1, PollInterval: 10 * time.Millisecond, AutoClose: true})
+	got := map[string]ItemMetadata{}
+	for _, req := range proc.requests {
+		got[req.ID] = req.Metadata
+		if req.PartitionID != "p" || string(req.Data) != `{}` || (req.ID == "v1") != (req.RetryCount == 2) || req.Labels["region"] != "eu" {
+			t.Errorf("unexpected request %+v", req)
+		}
+	}
+	if got["v1"]["model"] != "v1" || got["v2"]["endpoint"] != "b" || len(got["none"]) != 0 {
+		t.Errorf("expected the processor to receive each item's metadata, got %v", got)
+	}
+	i, err := r.GetItem(ctx, "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Status != Complete || i.Metadata["model"] != "v3" || len(i.Metadata) != 1 {
+		t.Errorf("expected the processor to replace the metadata, got %s with %v", i.Status, i.Metadata)
+	}
+	if _, err := r.PurgeItems(ctx, ItemFilter{Metadata: map[string]string{"model": "v3"}}); r.supportsJSON() != (err == nil) {
+		t.Errorf("expected purging by metadata to depend on JSON support, got %v", err)
+	}
+}
+
+func TestItemMetadataSizeCap(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	large := ItemMetadata{"k": strings.Repeat("x", MaxItemMetadataSize)}
+	if r.Save(ctx, &Item{BaseModel: BaseModel{ID: "large"}, PartitionID: "p", Status: Available, Data: []byte(`{}`), Metadata: large}) {
+		t.Error("expected saving oversized metadata to fail")
+	}
+
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Status: Available, Data: []byte(`{}`)})
+	runForEvents(t, r, &Watcher{Processor: &metadataProcessor{metadata: large}, Repo: r, BatchSize: 1, PollInterval: 10 * time.Millisecond})
+	i, err := r.GetItem(ctx, "i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Status != Failed || !strings.Contains(i.ErrorMessages, "metadata") {
+		t.Errorf("expected oversized metadata from the processor to fail the item, got %s: %s", i.Status, i.ErrorMessages)
+	}
+
+}
@@ -0,0 +1,100 @@
+package state
+
+import "time"
+
+// Labels qualify a metric, e.g. by partition.
+type Labels map[string]string
+
+// Metrics receives measurements from the watcher, so they can be published to whichever
+// metrics system the caller uses. Implementations must be safe for concurrent use.
+type Metrics interface {
+	// Counter adds delta to the named counter.
+	Counter(name string, delta float64, labels Labels)
+	// Gauge sets the named gauge to value.
+	Gauge(name string, value float64, labels Labels)
+	// Duration records an observation of the named duration.
+	Duration(name string, d time.Duration, labels Labels)
+}
+
+// Names of the metrics reported by the watcher.
+const (
+	// MetricLimiterWait is the time an item processor spent waiting on the rate limiter.
+	MetricLimiterWait = "limiter_wait"
+	// MetricDeadlineMisses counts the items failed because their deadline passed, labelled by
+	// partition and gate name when failed by the watcher rather than a sweep.
+	MetricDeadlineMisses = "deadline_misses"
+	// MetricGateAdvanced counts the gates partitions advanced to, labelled by partition and
+	// the name of the new gate.
+	MetricGateAdvanced = "gate_advanced"
+	// MetricBreakerOpened counts the circuit breakers opened, labelled by partition, which is
+	// empty for the watcher's global breaker.
+	MetricBreakerOpened = "breaker_opened"
+	// MetricProcessingTimeouts counts the attempts abandoned after the watcher's
+	// ProcessingTimeout, labelled by partition and gate name, and the stuck items reclaimed by
+	// a sweep, unlabelled.
+	MetricProcessingTimeouts = "processing_timeouts"
+	// MetricProcessorPanics counts the attempts whose processor panicked, labelled by
+	// partition and gate name.
+	MetricProcessorPanics = "processor_panics"
+	// MetricAvailableLag is the number of seconds the oldest available item of a partition
+	// has waited, labelled by partition, as of each poll of the partition.
+	MetricAvailableLag = "available_lag_seconds"
+	// MetricSLABreaches counts the breaches of the watcher's SLAConfig, labelled by partition
+	// and SLA.
+	MetricSLABreaches = "sla_breaches"
+	// MetricPartitionStalls counts the polls of leased partitions the watchdog cancelled for
+	// taking over the StallThreshold, labelled by partition.
+	MetricPartitionStalls = "partition_stalls"
+	// MetricPartitionRetries counts the failed partitions retried by the watcher's sweeps,
+	// and MetricPartitionRetriesExhausted those failed once out of retries, labelled by
+	// partition.
+	MetricPartitionRetries          = "partition_retries"
+	MetricPartitionRetriesExhausted = "partition_retries_exhausted"
+	// MetricBatchLimit is the number of items the watcher processes at once, as adjusted by
+	// its AdaptiveBatch.
+	MetricBatchLimit = "batch_limit"
+	// MetricGroupItemsProcessed counts the items processed with a FairShare DispatchPolicy,
+	// labelled by group, for the throughput of each group.
+	MetricGroupItemsProcessed = "group_items_processed"
+	// MetricKindItemsProcessed counts the items processed with a FetchPolicy, labelled by kind,
+	// fresh or retry, for the throughput of each.
+	MetricKindItemsProcessed = "kind_items_processed"
+	// The gauges published by a Monitor: the number of live and dead owners, labelled by
+	// state, and the partitions leased by each live owner; the items of each Available
+	// partition, labelled by partition and status, and its gate, rate of completions per
+	// minute and ETA in seconds, see PartitionProgress, along with MetricAvailableLag; the
+	// number of leases orphaned by dead owners, and of items stuck in processing.
+	MetricOwners                = "owners"
+	MetricOwnerLeasedPartitions = "owner_leased_partitions"
+	MetricPartitionItems        = "partition_items"
+	MetricPartitionGate         = "partition_gate"
+	MetricPartitionRate         = "partition_rate_per_minute"
+	MetricPartitionETA          = "partition_eta_seconds"
+	MetricOrphanedLeases        = "orphaned_leases"
+	MetricStuckItems            = "stuck_items"
+	// The gauges of the repo's connection pool, see sql.DBStats, reported after each lease
+	// scan if the repo implements PoolStats. The wait count and duration are totals.
+	MetricPoolOpenConnections    = "db_open_connections"
+	MetricPoolInUseConnections   = "db_in_use_connections"
+	MetricPoolIdleConnections    = "db_idle_connections"
+	MetricPoolMaxOpenConnections = "db_max_open_connections"
+	MetricPoolWaitCount          = "db_wait_count"
+	MetricPoolWaitDuration       = "db_wait_duration_seconds"
+	// MetricRepoCalls counts the calls to the repo, and MetricRepoCallDuration records their
+	// durations, labelled by method, as reported by a statetest.CountingRepo.
+	MetricRepoCalls        = "repo_calls"
+	MetricRepoCallDuration = "repo_call_duration"
+)
+
+type nopMetrics struct{}
+
+func (nopMetrics) Counter(string, float64, Labels)        {}
+func (nopMetrics) Gauge(string, float64, Labels)          {}
+func (nopMetrics) Duration(string, time.Duration, Labels) {}
+
+func (w *Watcher) metrics() Metrics {
+	if w.Metrics == nil {
+		return nopMetrics{}
+	}
+	return w.Metrics
+}
@@ -0,0 +1,278 @@
+package migrations
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// createTables creates the tables of the models which don't exist, with their indexes.
+func createTables(tx *gorm.DB, models ...interface{}) error {
+	for _, model := range models {
+		if tx.Migrator().HasTable(model) {
+			continue
+		}
+		if err := tx.Migrator().CreateTable(model); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropTables drops the tables of the models which exist.
+func dropTables(tx *gorm.DB, models ...interface{}) error {
+	for _, model := range models {
+		if !tx.Migrator().HasTable(model) {
+			continue
+		}
+		if err := tx.Migrator().DropTable(model); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumns adds the model's fields which have no column yet.
+func addColumns(tx *gorm.DB, model interface{}, fields ...string) error {
+	for _, field := range fields {
+		if tx.Migrator().HasColumn(model, field) {
+			continue
+		}
+		if err := tx.Migrator().AddColumn(model, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createIndexes creates the model's named indexes which don't exist.
+func createIndexes(tx *gorm.DB, model interface{}, names ...string) error {
+	for _, name := range names {
+		if tx.Migrator().HasIndex(model, name) {
+			continue
+		}
+		if err := tx.Migrator().CreateIndex(model, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropIndexes drops the model's named indexes which exist.
+func dropIndexes(tx *gorm.DB, model interface{}, names ...string) error {
+	for _, name := range names {
+		if !tx.Migrator().HasIndex(model, name) {
+			continue
+		}
+		if err := tx.Migrator().DropIndex(model, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxIndexName is the shortest limit on the length of index names among the dialects,
+// Postgres' 63 bytes.
+const maxIndexName = 63
+
+var unsafeIndexChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// IndexName returns the name of the table's index with the suffix. Index names are unique per
+// database in some dialects, so they are derived from the table's name, prefix included, which
+// is reduced to letters, digits and underscores so as to be valid in every dialect. A hash of
+// the table's name is added if it had to be changed or truncated, so that tables whose names
+// differ only by those characters don't collide.
+func IndexName(table, suffix string) string {
+	name := unsafeIndexChars.ReplaceAllString(table, "_")
+	if name == table && len(name)+len(suffix)+1 <= maxIndexName {
+		return name + "_" + suffix
+	}
+	h := sha1.Sum([]byte(table))
+	hash := hex.EncodeToString(h[:4])
+	if max := maxIndexName - len(suffix) - len(hash) - 2; len(name) > max {
+		name = name[:max]
+	}
+	return name + "_" + hash + "_" + suffix
+}
+
+// createIndex creates the index of the model's table with the columns, in order, named by
+// IndexName with the suffix, unless it exists. where, if set, filters the rows indexed.
+func createIndex(tx *gorm.DB, model interface{}, suffix string, unique bool, columns []string, where string) error {
+	stmt := &gorm.Statement{DB: tx}
+	if err := stmt.Parse(model); err != nil {
+		return err
+	}
+	name := IndexName(stmt.Table, suffix)
+	if tx.Migrator().HasIndex(model, name) {
+		return nil
+	}
+	sql := "CREATE INDEX "
+	if unique {
+		sql = "CREATE UNIQUE INDEX "
+	}
+	quoted := make([]string, len(columns))
+	for n, column := range columns {
+		quoted[n] = stmt.Quote(column)
+	}
+	sql += stmt.Quote(name) + " ON " + stmt.Quote(stmt.Table) + " (" + strings.Join(quoted, ",") + ")"
+	if where != "" {
+		sql += " WHERE " + where
+	}
+	return tx.Exec(sql).Error
+}
+
+// dropIndex drops the index of the model's table named by IndexName with the suffix, if it
+// exists.
+func dropIndex(tx *gorm.DB, model interface{}, suffix string) error {
+	stmt := &gorm.Statement{DB: tx}
+	if err := stmt.Parse(model); err != nil {
+		return err
+	}
+	return dropIndexes(tx, model, IndexName(stmt.Table, suffix))
+}
+
+// dropColumns drops the columns of the model's fields which exist. Their indexes must be
+// dropped first.
+func dropColumns(tx *gorm.DB, model interface{}, fields ...string) error {
+	stmt := &gorm.Statement{DB: tx}
+	if err := stmt.Parse(model); err != nil {
+		return err
+	}
+	for _, field := range fields {
+		if !tx.Migrator().HasColumn(model, field) {
+			continue
+		}
+		column := field
+		if f := stmt.Schema.LookUpField(field); f != nil {
+			column = f.DBName
+		}
+		var err error
+		switch tx.Dialector.Name() {
+		case "sqlite":
+			// SQLite only drops columns since 3.35, and gorm's rebuild of the table loses
+			// its indexes.
+			err = rebuildSQLiteTable(tx, stmt.Table, column)
+		case "sqlserver":
+			// SQL Server refuses to drop a column with a default constraint.
+			if err = tx.Exec(`DECLARE @name sysname;
+SELECT @name = d.name FROM sys.default_constraints d JOIN sys.columns c ON c.object_id = d.parent_object_id AND c.column_id = d.parent_column_id
+WHERE d.parent_object_id = OBJECT_ID(?) AND c.name = ?;
+IF @name IS NOT NULL EXEC('ALTER TABLE ' + QUOTENAME(?) + ' DROP CONSTRAINT ' + QUOTENAME(@name))`, stmt.Table, column, stmt.Table).Error; err == nil {
+				err = tx.Exec("ALTER TABLE ? DROP COLUMN ?", clause.Table{Name: stmt.Table}, clause.Column{Name: column}).Error
+			}
+		default:
+			err = tx.Migrator().DropColumn(model, field)
+		}
+		if err != nil {
+			return fmt.Errorf("error dropping column %s of %s: %w", column, stmt.Table, err)
+		}
+	}
+	return nil
+}
+
+// rebuildSQLiteTable recreates the table without the column, keeping its constraints and
+// indexes.
+func rebuildSQLiteTable(tx *gorm.DB, table, column string) error {
+	var createSQL string
+	if err := tx.Raw("SELECT sql FROM sqlite_master WHERE type = ? AND name = ?", "table", table).Row().Scan(&createSQL); err != nil {
+		return err
+	}
+	var indexes []string
+	rows, err := tx.Raw("SELECT sql FROM sqlite_master WHERE type = ? AND tbl_name = ? AND sql IS NOT NULL", "index", table).Rows()
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var sql string
+		if err := rows.Scan(&sql); err != nil {
+			rows.Close()
+			return err
+		}
+		indexes = append(indexes, sql)
+	}
+	rows.Close()
+
+	start, end := strings.Index(createSQL, "("), strings.LastIndex(createSQL, ")")
+	if start < 0 || end < start {
+		return fmt.Errorf("unexpected definition of table %s: %s", table, createSQL)
+	}
+	var kept, columns []string
+	for _, def := range splitDefinitions(createSQL[start+1 : end]) {
+		name, isColumn := definedColumn(def)
+		if strings.EqualFold(name, column) {
+			continue
+		}
+		kept = append(kept, def)
+		if isColumn {
+			columns = append(columns, "`"+name+"`")
+		}
+	}
+	temp := table + "__temp"
+	for _, sql := range append([]string{
+		fmt.Sprintf("CREATE TABLE `%s` (%s)", temp, strings.Join(kept, ",")),
+		fmt.Sprintf("INSERT INTO `%s` (%s) SELECT %[2]s FROM `%s`", temp, strings.Join(columns, ","), table),
+		fmt.Sprintf("DROP TABLE `%s`", table),
+		fmt.Sprintf("ALTER TABLE `%s` RENAME TO `%s`", temp, table),
+	}, indexes...) {
+		if err := tx.Exec(sql).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitDefinitions splits the body of a CREATE TABLE statement into its column and constraint
+// definitions, at the commas outside parentheses and quotes.
+func splitDefinitions(body string) []string {
+	var defs []string
+	depth, start := 0, 0
+	var quote byte
+	for n := 0; n < len(body); n++ {
+		c := body[n]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '`' || c == '"' || c == '\'':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			defs = append(defs, body[start:n])
+			start = n + 1
+		}
+	}
+	return append(defs, body[start:])
+}
+
+// definedColumn returns the column defined by a definition of splitDefinitions, and false if
+// it is a table constraint.
+func definedColumn(def string) (string, bool) {
+	def = strings.TrimSpace(def)
+	if def == "" {
+		return "", false
+	}
+	if q := def[0]; q == '`' || q == '"' || q == '[' {
+		closing := q
+		if q == '[' {
+			closing = ']'
+		}
+		if end := strings.IndexByte(def[1:], closing); end >= 0 {
+			return def[1 : end+1], true
+		}
+	}
+	name := strings.Fields(def)[0]
+	switch strings.ToUpper(name) {
+	case "PRIMARY", "CONSTRAINT", "UNIQUE", "CHECK", "FOREIGN":
+		return "", false
+	}
+	return name, true
+}
@@ -0,0 +1,105 @@
+// Package migrations holds the versioned steps of the state package's schema, so that schema
+// changes can be reviewed and applied deliberately, e.g. by a single job ahead of a rollout,
+// rather than by every watcher at startup.
+//
+// The steps describe the tables as they were at each version, rather than with the state
+// package's models, which only describe the latest version. Every Up step skips the tables,
+// columns and indexes which already exist, so that databases created by the AutoMigrate of
+// earlier releases can adopt the migrations from version 0.
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"gorm.io/gorm"
+)
+
+// Migration is a versioned step of the schema.
+type Migration struct {
+	Version int
+	Name    string
+	// Up applies the step, and Down reverts it, each within a transaction.
+	Up   func(tx *gorm.DB) error
+	Down func(tx *gorm.DB) error
+}
+
+// SchemaMigration records a migration applied to the database.
+type SchemaMigration struct {
+	Version   int       `gorm:"primaryKey;autoIncrement:false"`
+	Name      string    `gorm:"not null"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+// Latest returns the version of the last migration.
+func Latest() int {
+	return Migrations[len(Migrations)-1].Version
+}
+
+// Version returns the version of the database's schema, 0 if no migration was applied.
+func Version(ctx context.Context, db *gorm.DB) (int, error) {
+	db = db.WithContext(ctx)
+	if !db.Migrator().HasTable(&SchemaMigration{}) {
+		return 0, nil
+	}
+	var version int
+	err := db.Model(&SchemaMigration{}).Select("COALESCE(MAX(version), 0)").Row().Scan(&version)
+	return version, err
+}
+
+// MigrateTo applies the Up steps of the migrations up to version, or the Down steps of those
+// above it, in order. Each step is applied in its own transaction, along with its record in
+// the schema_migrations table.
+func MigrateTo(ctx context.Context, db *gorm.DB, version int) error {
+	if version < 0 || version > Latest() {
+		return fmt.Errorf("unknown schema version %d, the latest is %d", version, Latest())
+	}
+	db = db.WithContext(ctx)
+	current, err := Version(ctx, db)
+	if err != nil {
+		return err
+	}
+	if current == version {
+		return nil
+	}
+	if current > Latest() {
+		return fmt.Errorf("the schema version %d is newer than this release's %d", current, Latest())
+	}
+	if !db.Migrator().HasTable(&SchemaMigration{}) {
+		if err := db.Migrator().CreateTable(&SchemaMigration{}); err != nil {
+			return err
+		}
+	}
+	for _, m := range Migrations {
+		if m.Version <= current || m.Version > version {
+			continue
+		}
+		glog.Infof("applying schema migration %d: %s", m.Version, m.Name)
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		}); err != nil {
+			return fmt.Errorf("error applying schema migration %d %s: %w", m.Version, m.Name, err)
+		}
+	}
+	for n := len(Migrations) - 1; n >= 0; n-- {
+		m := Migrations[n]
+		if m.Version > current || m.Version <= version {
+			continue
+		}
+		glog.Infof("reverting schema migration %d: %s", m.Version, m.Name)
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Down(tx); err != nil {
+				return err
+			}
+			return tx.Where("version = ?", m.Version).Delete(&SchemaMigration{}).Error
+		}); err != nil {
+			return fmt.Errorf("error reverting schema migration %d %s: %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
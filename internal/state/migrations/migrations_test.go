@@ -0,0 +1,189 @@
+package migrations_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state/migrations"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+func openTestDB(t *testing.T) *gorm.DB {
+	f, err := ioutil.TempFile("", "test_migrations_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	db, err := gorm.Open(sqlite.Open(f.Name()), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+		NamingStrategy: schema.NamingStrategy{
+			TablePrefix: "test_",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+		os.Remove(f.Name())
+	})
+	return db
+}
+
+var models = []interface{}{&state.Item{}, &state.Partition{}, &state.OutboxEvent{}, &state.Owner{}, &state.Leadership{}, &state.TenantQuota{}, &state.LeaseEvent{}}
+
+// checkSchema fails the test unless every column and index of the state package's models exists.
+func checkSchema(t *testing.T, db *gorm.DB) {
+	t.Helper()
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range stmt.Schema.Fields {
+			if f.DBName != "" && !db.Migrator().HasColumn(model, f.DBName) {
+				t.Errorf("expected column %s of %s", f.DBName, stmt.Table)
+			}
+		}
+		for name := range stmt.Schema.ParseIndexes() {
+			if !db.Migrator().HasIndex(model, name) {
+				t.Errorf("expected index %s of %s", name, stmt.Table)
+			}
+		}
+	}
+}
+
+func checkVersion(t *testing.T, db *gorm.DB, expected int) {
+	t.Helper()
+	v, err := migrations.Version(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != expected {
+		t.Errorf("expected schema version %d, got %d", expected, v)
+	}
+}
+
+func TestMigrateTo(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	checkVersion(t, db, 0)
+	latest := migrations.Latest()
+	if err := migrations.MigrateTo(ctx, db, latest); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, db, latest)
+	checkSchema(t, db)
+
+	// Migrating again, or reapplying every step, changes nothing.
+	if err := migrations.MigrateTo(ctx, db, latest); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations.Migrations {
+		if err := db.Transaction(m.Up); err != nil {
+			t.Errorf("error reapplying migration %d: %s", m.Version, err)
+		}
+	}
+	checkVersion(t, db, latest)
+	checkSchema(t, db)
+
+	// The steps from the one adding processing_started_at on are reverted, keeping the data
+	// and the other indexes.
+	r := &state.GormRepo{DB: db}
+	if !r.Save(ctx, &state.Item{BaseModel: state.BaseModel{ID: "i"}, PartitionID: "p", Data: []byte(`{}`)}) {
+		t.Fatal("error saving item")
+	}
+	version := 0
+	for _, m := range migrations.Migrations {
+		if m.Name == "add item processing start times" {
+			version = m.Version - 1
+		}
+	}
+	if err := migrations.MigrateTo(ctx, db, version); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, db, version)
+	if db.Migrator().HasColumn(&state.Item{}, "ProcessingStartedAt") {
+		t.Error("expected processing_started_at to be dropped")
+	}
+	for _, index := range []string{"feed_idx", "seq_idx", "idempotency_idx", "Deadline"} {
+		if !db.Migrator().HasIndex(&state.Item{}, index) {
+			t.Errorf("expected index %s to be kept", index)
+		}
+	}
+	var count int64
+	if err := db.Model(&state.Item{}).Where("id = ?", "i").Count(&count).Error; err != nil || count != 1 {
+		t.Errorf("expected the item to be kept, got %d, %v", count, err)
+	}
+
+	if err := migrations.MigrateTo(ctx, db, latest); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, db, latest)
+	checkSchema(t, db)
+
+	if err := migrations.MigrateTo(ctx, db, 0); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, db, 0)
+	for _, model := range models {
+		if db.Migrator().HasTable(model) {
+			t.Errorf("expected the table of %T to be dropped", model)
+		}
+	}
+	if err := migrations.MigrateTo(ctx, db, latest+1); err == nil {
+		t.Error("expected an error migrating to an unknown version")
+	}
+}
+
+func TestAdoptAutoMigratedSchema(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	// Earlier releases created the schema with gorm's AutoMigrate.
+	if err := db.AutoMigrate(models...); err != nil {
+		t.Fatal(err)
+	}
+	item := &state.Item{BaseModel: state.BaseModel{ID: "i"}, PartitionID: "p", Data: []byte(`"data"`), Result: []byte(`"result"`)}
+	if err := db.Create(item).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := migrations.MigrateTo(ctx, db, migrations.Latest()); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, db, migrations.Latest())
+	checkSchema(t, db)
+	var result []byte
+	if err := db.Model(&state.Item{}).Select("result").Where("id = ?", "i").Row().Scan(&result); err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != `"result"` {
+		t.Errorf("expected the item's result to be kept, got %s", result)
+	}
+}
+
+func TestIndexName(t *testing.T) {
+	for _, tc := range []struct {
+		table, expected string
+	}{
+		{"items", "items_feed_idx"},
+		{"test_items", "test_items_feed_idx"},
+		{"/tmp/test_db_1items", "_tmp_test_db_1items_464dabf7_feed_idx"},
+		{strings.Repeat("x", 100), strings.Repeat("x", 45) + "_50e48369_feed_idx"},
+	} {
+		if name := migrations.IndexName(tc.table, "feed_idx"); name != tc.expected {
+			t.Errorf("expected the index of %s to be named %s, got %s", tc.table, tc.expected, name)
+		}
+	}
+	if migrations.IndexName("a/items", "feed_idx") == migrations.IndexName("a.items", "feed_idx") {
+		t.Error("expected the indexes of tables differing by invalid characters not to collide")
+	}
+}
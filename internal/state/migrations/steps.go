@@ -0,0 +1,763 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// The models of each step are declared within it, with the names of the state package's
+// models so that their tables and indexes are named alike, and only the fields the step needs.
+
+// Migrations are the steps of the schema, in order of their versions.
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create items and partitions",
+		Up: func(tx *gorm.DB) error {
+			type Item struct {
+				ID            string `gorm:"primaryKey"`
+				Version       int    `gorm:"default:0;not null"`
+				CreatedAt     time.Time
+				RetryCount    int       `gorm:"default:0;not null"`
+				PartitionID   string    `gorm:"not null;index:feed_idx"`
+				Gate          int       `gorm:"not null;default:0;index:feed_idx"`
+				Status        int64     `gorm:"not null;default:1;index:feed_idx"`
+				ErrorMessages string    `gorm:"default:'';not null"`
+				UpdatedAt     time.Time `gorm:"not null;index:feed_idx"`
+				Data          []byte    `gorm:"not null"`
+			}
+			type Partition struct {
+				ID        string `gorm:"primaryKey"`
+				Version   int    `gorm:"default:0;not null"`
+				CreatedAt time.Time
+				UpdatedAt time.Time
+				Gate      int       `gorm:"default:0;not null"`
+				Status    int64     `gorm:"default:1;not null"`
+				Owner     string    `gorm:"not null;default=''"`
+				Until     time.Time `gorm:"not null"`
+			}
+			return createTables(tx, &Item{}, &Partition{})
+		},
+		Down: func(tx *gorm.DB) error {
+			type Item struct{ ID string }
+			type Partition struct{ ID string }
+			return dropTables(tx, &Item{}, &Partition{})
+		},
+	},
+	{
+		Version: 2,
+		Name:    "create outbox events",
+		Up: func(tx *gorm.DB) error {
+			type OutboxEvent struct {
+				ID            string    `gorm:"primaryKey"`
+				AggregateType string    `gorm:"not null"`
+				AggregateID   string    `gorm:"not null"`
+				EventType     string    `gorm:"not null"`
+				Payload       []byte    `gorm:"not null"`
+				CreatedAt     time.Time `gorm:"not null;index"`
+				ClaimedUntil  time.Time `gorm:"not null"`
+				PublishedAt   *time.Time
+			}
+			return createTables(tx, &OutboxEvent{})
+		},
+		Down: func(tx *gorm.DB) error {
+			type OutboxEvent struct {
+				ID string `gorm:"primaryKey"`
+			}
+			return dropTables(tx, &OutboxEvent{})
+		},
+	},
+	{
+		Version: 3,
+		Name:    "add item sequence and priority",
+		Up: func(tx *gorm.DB) error {
+			type Item struct {
+				PartitionID string `gorm:"index:seq_idx,priority:1"`
+				Gate        int    `gorm:"index:seq_idx,priority:2"`
+				Status      int64  `gorm:"index:seq_idx,priority:3"`
+				Sequence    int64  `gorm:"not null;default:0;index:seq_idx,priority:4"`
+				Priority    int    `gorm:"not null;default:0"`
+			}
+			if err := addColumns(tx, &Item{}, "Sequence", "Priority"); err != nil {
+				return err
+			}
+			return createIndexes(tx, &Item{}, "seq_idx")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Item struct {
+				Sequence int64 `gorm:"index:seq_idx"`
+				Priority int
+			}
+			if err := dropIndexes(tx, &Item{}, "seq_idx"); err != nil {
+				return err
+			}
+			return dropColumns(tx, &Item{}, "Sequence", "Priority")
+		},
+	},
+	{
+		Version: 4,
+		Name:    "add item results",
+		Up: func(tx *gorm.DB) error {
+			type Item struct {
+				Result []byte
+			}
+			if tx.Migrator().HasColumn(&Item{}, "Result") {
+				return nil
+			}
+			if err := addColumns(tx, &Item{}, "Result"); err != nil {
+				return err
+			}
+			// Before Result was added, the processor's output overwrote Data.
+			return tx.Model(&Item{}).Where("result IS NULL").UpdateColumn("result", gorm.Expr("data")).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			type Item struct {
+				Result []byte
+			}
+			return dropColumns(tx, &Item{}, "Result")
+		},
+	},
+	{
+		Version: 5,
+		Name:    "add tenants",
+		Up: func(tx *gorm.DB) error {
+			type Item struct {
+				Tenant string `gorm:"not null;default:'';index"`
+			}
+			type Partition struct {
+				Tenant string `gorm:"not null;default:'';index"`
+			}
+			for _, model := range []interface{}{&Item{}, &Partition{}} {
+				if err := addColumns(tx, model, "Tenant"); err != nil {
+					return err
+				}
+				if err := createIndexes(tx, model, "Tenant"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			type Item struct {
+				Tenant string `gorm:"index"`
+			}
+			type Partition struct {
+				Tenant string `gorm:"index"`
+			}
+			for _, model := range []interface{}{&Item{}, &Partition{}} {
+				if err := dropIndexes(tx, model, "Tenant"); err != nil {
+					return err
+				}
+				if err := dropColumns(tx, model, "Tenant"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 6,
+		Name:    "add partition labels",
+		Up: func(tx *gorm.DB) error {
+			type Partition struct {
+				Labels string `gorm:"not null;default:'{}'"`
+			}
+			return addColumns(tx, &Partition{}, "Labels")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Partition struct {
+				Labels string
+			}
+			return dropColumns(tx, &Partition{}, "Labels")
+		},
+	},
+	{
+		Version: 7,
+		Name:    "add item metadata",
+		Up: func(tx *gorm.DB) error {
+			type Item struct {
+				Metadata string `gorm:"not null;default:'{}'"`
+			}
+			return addColumns(tx, &Item{}, "Metadata")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Item struct {
+				Metadata string
+			}
+			return dropColumns(tx, &Item{}, "Metadata")
+		},
+	},
+	{
+		Version: 8,
+		Name:    "create owners",
+		Up: func(tx *gorm.DB) error {
+			type Owner struct {
+				OwnerID          string    `gorm:"primaryKey"`
+				Hostname         string    `gorm:"not null;default:''"`
+				StartedAt        time.Time `gorm:"not null"`
+				LastHeartbeat    time.Time `gorm:"not null;index"`
+				LeasedPartitions int       `gorm:"not null;default:0"`
+				Version          string    `gorm:"not null;default:''"`
+			}
+			return createTables(tx, &Owner{})
+		},
+		Down: func(tx *gorm.DB) error {
+			type Owner struct {
+				OwnerID string `gorm:"primaryKey"`
+			}
+			return dropTables(tx, &Owner{})
+		},
+	},
+	{
+		Version: 9,
+		Name:    "add partition fences",
+		Up: func(tx *gorm.DB) error {
+			type Partition struct {
+				Fence int64 `gorm:"not null;default:0"`
+			}
+			return addColumns(tx, &Partition{}, "Fence")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Partition struct {
+				Fence int64
+			}
+			return dropColumns(tx, &Partition{}, "Fence")
+		},
+	},
+	{
+		Version: 10,
+		Name:    "create leaderships",
+		Up: func(tx *gorm.DB) error {
+			type Leadership struct {
+				ID        string `gorm:"primaryKey"`
+				Version   int    `gorm:"default:0;not null"`
+				CreatedAt time.Time
+				UpdatedAt time.Time
+				Owner     string    `gorm:"not null;default:''"`
+				Until     time.Time `gorm:"not null"`
+			}
+			return createTables(tx, &Leadership{})
+		},
+		Down: func(tx *gorm.DB) error {
+			type Leadership struct{ ID string }
+			return dropTables(tx, &Leadership{})
+		},
+	},
+	{
+		Version: 11,
+		Name:    "add item deadlines",
+		Up: func(tx *gorm.DB) error {
+			type Item struct {
+				Deadline *time.Time `gorm:"index"`
+			}
+			if err := addColumns(tx, &Item{}, "Deadline"); err != nil {
+				return err
+			}
+			return createIndexes(tx, &Item{}, "Deadline")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Item struct {
+				Deadline *time.Time `gorm:"index"`
+			}
+			if err := dropIndexes(tx, &Item{}, "Deadline"); err != nil {
+				return err
+			}
+			return dropColumns(tx, &Item{}, "Deadline")
+		},
+	},
+	{
+		Version: 12,
+		Name:    "add item idempotency keys",
+		Up: func(tx *gorm.DB) error {
+			type Item struct {
+				PartitionID    string  `gorm:"uniqueIndex:idempotency_idx,priority:1"`
+				IdempotencyKey *string `gorm:"size:256;uniqueIndex:idempotency_idx,priority:2,option:WHERE idempotency_key IS NOT NULL"`
+			}
+			if err := addColumns(tx, &Item{}, "IdempotencyKey"); err != nil {
+				return err
+			}
+			return createIndexes(tx, &Item{}, "idempotency_idx")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Item struct {
+				IdempotencyKey *string `gorm:"uniqueIndex:idempotency_idx"`
+			}
+			if err := dropIndexes(tx, &Item{}, "idempotency_idx"); err != nil {
+				return err
+			}
+			return dropColumns(tx, &Item{}, "IdempotencyKey")
+		},
+	},
+	{
+		Version: 13,
+		Name:    "add partition dependencies",
+		Up: func(tx *gorm.DB) error {
+			type Partition struct {
+				DependsOn string `gorm:"not null;default:'';index"`
+			}
+			if err := addColumns(tx, &Partition{}, "DependsOn"); err != nil {
+				return err
+			}
+			return createIndexes(tx, &Partition{}, "DependsOn")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Partition struct {
+				DependsOn string `gorm:"index"`
+			}
+			if err := dropIndexes(tx, &Partition{}, "DependsOn"); err != nil {
+				return err
+			}
+			return dropColumns(tx, &Partition{}, "DependsOn")
+		},
+	},
+	{
+		Version: 14,
+		Name:    "add partition gate plans and max gates",
+		Up: func(tx *gorm.DB) error {
+			type Partition struct {
+				GatePlan string `gorm:"not null;default:'[]'"`
+				MaxGate  int    `gorm:"not null;default:0"`
+			}
+			return addColumns(tx, &Partition{}, "GatePlan", "MaxGate")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Partition struct {
+				GatePlan string
+				MaxGate  int
+			}
+			return dropColumns(tx, &Partition{}, "GatePlan", "MaxGate")
+		},
+	},
+	{
+		Version: 15,
+		Name:    "add max retries and retry times",
+		Up: func(tx *gorm.DB) error {
+			type Item struct {
+				MaxRetries *int
+				RetryAt    *time.Time
+			}
+			type Partition struct {
+				MaxRetries *int
+			}
+			if err := addColumns(tx, &Item{}, "MaxRetries", "RetryAt"); err != nil {
+				return err
+			}
+			return addColumns(tx, &Partition{}, "MaxRetries")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Item struct {
+				MaxRetries *int
+				RetryAt    *time.Time
+			}
+			type Partition struct {
+				MaxRetries *int
+			}
+			if err := dropColumns(tx, &Item{}, "MaxRetries", "RetryAt"); err != nil {
+				return err
+			}
+			return dropColumns(tx, &Partition{}, "MaxRetries")
+		},
+	},
+	{
+		Version: 16,
+		Name:    "add item processing start times",
+		Up: func(tx *gorm.DB) error {
+			type Item struct {
+				ProcessingStartedAt *time.Time `gorm:"index"`
+			}
+			if err := addColumns(tx, &Item{}, "ProcessingStartedAt"); err != nil {
+				return err
+			}
+			return createIndexes(tx, &Item{}, "ProcessingStartedAt")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Item struct {
+				ProcessingStartedAt *time.Time `gorm:"index"`
+			}
+			if err := dropIndexes(tx, &Item{}, "ProcessingStartedAt"); err != nil {
+				return err
+			}
+			return dropColumns(tx, &Item{}, "ProcessingStartedAt")
+		},
+	},
+	{
+		Version: 17,
+		Name:    "name item and partition indexes by table",
+		Up: func(tx *gorm.DB) error {
+			type Item struct{ ID string }
+			type Partition struct{ ID string }
+			// The indexes were named alike for every table prefix, colliding in the dialects whose
+			// index names are unique per database, and gorm ordered the columns of feed_idx at
+			// random.
+			if err := dropIndexes(tx, &Item{}, "feed_idx", "seq_idx", "idempotency_idx"); err != nil {
+				return err
+			}
+			// The equality columns of GetAvailableItems come first, followed by those it orders by.
+			if err := createIndex(tx, &Item{}, "feed_idx", false, []string{"partition_id", "status", "gate", "updated_at"}, ""); err != nil {
+				return err
+			}
+			if err := createIndex(tx, &Item{}, "seq_idx", false, []string{"partition_id", "status", "gate", "sequence", "id"}, ""); err != nil {
+				return err
+			}
+			// SQL Server treats NULLs as equal in unique indexes, so the index is filtered to keyed
+			// items.
+			if err := createIndex(tx, &Item{}, "idempotency_idx", true, []string{"partition_id", "idempotency_key"}, "idempotency_key IS NOT NULL"); err != nil {
+				return err
+			}
+			return createIndex(tx, &Partition{}, "lease_idx", false, []string{"status", "until"}, "")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Item struct {
+				PartitionID    string    `gorm:"index:feed_idx;index:seq_idx,priority:1;uniqueIndex:idempotency_idx,priority:1"`
+				Gate           int       `gorm:"index:feed_idx;index:seq_idx,priority:2"`
+				Status         int64     `gorm:"index:feed_idx;index:seq_idx,priority:3"`
+				UpdatedAt      time.Time `gorm:"index:feed_idx"`
+				Sequence       int64     `gorm:"index:seq_idx,priority:4"`
+				IdempotencyKey *string   `gorm:"uniqueIndex:idempotency_idx,priority:2,option:WHERE idempotency_key IS NOT NULL"`
+			}
+			type Partition struct{ ID string }
+			for _, suffix := range []string{"feed_idx", "seq_idx", "idempotency_idx"} {
+				if err := dropIndex(tx, &Item{}, suffix); err != nil {
+					return err
+				}
+			}
+			if err := dropIndex(tx, &Partition{}, "lease_idx"); err != nil {
+				return err
+			}
+			return createIndexes(tx, &Item{}, "feed_idx", "seq_idx", "idempotency_idx")
+		},
+	},
+	{
+		Version: 18,
+		Name:    "add item progress index",
+		Up: func(tx *gorm.DB) error {
+			type Item struct{ ID string }
+			// GetPartitionProgress seeks the oldest available item, and the recent completions.
+			return createIndex(tx, &Item{}, "progress_idx", false, []string{"partition_id", "status", "updated_at"}, "")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Item struct{ ID string }
+			return dropIndex(tx, &Item{}, "progress_idx")
+		},
+	},
+	{
+		Version: 19,
+		Name:    "add partition activation times",
+		Up: func(tx *gorm.DB) error {
+			type Partition struct {
+				ActivateAt *time.Time
+			}
+			return addColumns(tx, &Partition{}, "ActivateAt")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Partition struct {
+				ActivateAt *time.Time
+			}
+			return dropColumns(tx, &Partition{}, "ActivateAt")
+		},
+	},
+	{
+		Version: 20,
+		Name:    "add item schema versions",
+		Up: func(tx *gorm.DB) error {
+			type Item struct {
+				SchemaVersion int `gorm:"not null;default:0"`
+			}
+			return addColumns(tx, &Item{}, "SchemaVersion")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Item struct {
+				SchemaVersion int
+			}
+			return dropColumns(tx, &Item{}, "SchemaVersion")
+		},
+	},
+	{
+		Version: 21,
+		Name:    "add item data hashes",
+		Up: func(tx *gorm.DB) error {
+			type Item struct {
+				DataHash string `gorm:"size:64;not null;default:''"`
+			}
+			if err := addColumns(tx, &Item{}, "DataHash"); err != nil {
+				return err
+			}
+			// FindCompletedByHash looks up the partition's items by hash.
+			return createIndex(tx, &Item{}, "hash_idx", false, []string{"partition_id", "data_hash", "gate", "status"}, "")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Item struct {
+				DataHash string
+			}
+			if err := dropIndex(tx, &Item{}, "hash_idx"); err != nil {
+				return err
+			}
+			return dropColumns(tx, &Item{}, "DataHash")
+		},
+	},
+	{
+		Version: 22,
+		Name:    "add item last owners",
+		Up: func(tx *gorm.DB) error {
+			type Item struct {
+				LastOwner       string `gorm:"size:256;not null;default:''"`
+				LastProcessedAt *time.Time
+			}
+			if err := addColumns(tx, &Item{}, "LastOwner", "LastProcessedAt"); err != nil {
+				return err
+			}
+			// ListItems filters the items an owner processed recently.
+			return createIndex(tx, &Item{}, "owner_idx", false, []string{"last_owner", "last_processed_at"}, "")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Item struct {
+				LastOwner       string
+				LastProcessedAt *time.Time
+			}
+			if err := dropIndex(tx, &Item{}, "owner_idx"); err != nil {
+				return err
+			}
+			return dropColumns(tx, &Item{}, "LastOwner", "LastProcessedAt")
+		},
+	},
+	{
+		Version: 23,
+		Name:    "add item trace contexts",
+		Up: func(tx *gorm.DB) error {
+			type Item struct {
+				TraceContext string `gorm:"size:512;not null;default:''"`
+			}
+			return addColumns(tx, &Item{}, "TraceContext")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Item struct {
+				TraceContext string
+			}
+			return dropColumns(tx, &Item{}, "TraceContext")
+		},
+	},
+	{
+		Version: 24,
+		Name:    "add pending item quotas",
+		Up: func(tx *gorm.DB) error {
+			type Partition struct {
+				MaxPendingItems *int
+			}
+			type TenantQuota struct {
+				Tenant          string `gorm:"primaryKey"`
+				MaxPendingItems *int
+				UpdatedAt       time.Time
+			}
+			if err := addColumns(tx, &Partition{}, "MaxPendingItems"); err != nil {
+				return err
+			}
+			return createTables(tx, &TenantQuota{})
+		},
+		Down: func(tx *gorm.DB) error {
+			type Partition struct {
+				MaxPendingItems *int
+			}
+			type TenantQuota struct {
+				Tenant string `gorm:"primaryKey"`
+			}
+			if err := dropTables(tx, &TenantQuota{}); err != nil {
+				return err
+			}
+			return dropColumns(tx, &Partition{}, "MaxPendingItems")
+		},
+	},
+	{
+		Version: 25,
+		Name:    "add partition lease backoffs",
+		Up: func(tx *gorm.DB) error {
+			type Partition struct {
+				LeaseableAfter *time.Time
+			}
+			return addColumns(tx, &Partition{}, "LeaseableAfter")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Partition struct {
+				LeaseableAfter *time.Time
+			}
+			return dropColumns(tx, &Partition{}, "LeaseableAfter")
+		},
+	},
+	{
+		Version: 26,
+		Name:    "pin id column lengths",
+		Up: func(tx *gorm.DB) error {
+			// SQLite ignores lengths, and SQL Server already sizes key columns nvarchar(256),
+			// but MySQL defaults them to varchar(191).
+			switch tx.Dialector.Name() {
+			case "sqlite", "sqlserver":
+				return nil
+			}
+			type Partition struct {
+				ID string `gorm:"primaryKey;size:256"`
+			}
+			type Item struct {
+				ID          string `gorm:"primaryKey;size:256"`
+				PartitionID string `gorm:"not null;size:256"`
+			}
+			type Leadership struct {
+				ID string `gorm:"primaryKey;size:256"`
+			}
+			for _, c := range []struct {
+				model interface{}
+				field string
+			}{{&Partition{}, "ID"}, {&Item{}, "ID"}, {&Item{}, "PartitionID"}, {&Leadership{}, "ID"}} {
+				if err := tx.Migrator().AlterColumn(c.model, c.field); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		// Shrinking the columns back could truncate IDs, so they are left as they are.
+		Down: func(tx *gorm.DB) error {
+			return nil
+		},
+	},
+	{
+		Version: 27,
+		Name:    "add partition lease times",
+		Up: func(tx *gorm.DB) error {
+			type Partition struct {
+				LeasedAt *time.Time
+			}
+			return addColumns(tx, &Partition{}, "LeasedAt")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Partition struct {
+				LeasedAt *time.Time
+			}
+			return dropColumns(tx, &Partition{}, "LeasedAt")
+		},
+	},
+	{
+		Version: 28,
+		Name:    "create lease events",
+		Up: func(tx *gorm.DB) error {
+			type LeaseEvent struct {
+				ID          string    `gorm:"primaryKey;size:256"`
+				PartitionID string    `gorm:"size:256;not null;index:lease_history_idx,priority:1"`
+				OldOwner    string    `gorm:"size:256;not null;default:''"`
+				NewOwner    string    `gorm:"size:256;not null;default:''"`
+				Reason      string    `gorm:"size:32;not null"`
+				AcquiredAt  time.Time `gorm:"not null;index:lease_history_idx,priority:2"`
+				Until       time.Time `gorm:"not null"`
+				Fence       int64     `gorm:"not null;default:0"`
+			}
+			return createTables(tx, &LeaseEvent{})
+		},
+		Down: func(tx *gorm.DB) error {
+			type LeaseEvent struct {
+				ID string `gorm:"primaryKey"`
+			}
+			return dropTables(tx, &LeaseEvent{})
+		},
+	},
+	{
+		Version: 29,
+		Name:    "add item claims",
+		Up: func(tx *gorm.DB) error {
+			type Item struct {
+				Owner        string `gorm:"size:256;not null;default:''"`
+				VisibleAfter *time.Time
+			}
+			if err := addColumns(tx, &Item{}, "Owner", "VisibleAfter"); err != nil {
+				return err
+			}
+			// ClaimItems seeks the available items across partitions, whatever their gate.
+			return createIndex(tx, &Item{}, "claim_idx", false, []string{"status", "visible_after"}, "")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Item struct {
+				Owner        string `gorm:"size:256;not null;default:''"`
+				VisibleAfter *time.Time
+			}
+			if err := dropIndex(tx, &Item{}, "claim_idx"); err != nil {
+				return err
+			}
+			return dropColumns(tx, &Item{}, "Owner", "VisibleAfter")
+		},
+	},
+	{
+		Version: 30,
+		Name:    "add partition status reasons",
+		Up: func(tx *gorm.DB) error {
+			type Partition struct {
+				StatusReason string `gorm:"size:1024;not null;default:''"`
+			}
+			return addColumns(tx, &Partition{}, "StatusReason")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Partition struct {
+				StatusReason string `gorm:"size:1024;not null;default:''"`
+			}
+			return dropColumns(tx, &Partition{}, "StatusReason")
+		},
+	},
+	{
+		Version: 31,
+		Name:    "add partition retries",
+		Up: func(tx *gorm.DB) error {
+			type Partition struct {
+				MaxPartitionRetries    int        `gorm:"not null;default:0"`
+				PartitionRetryCooldown int64      `gorm:"not null;default:0"`
+				PartitionRetryCount    int        `gorm:"not null;default:0"`
+				RetryAt                *time.Time `gorm:"index"`
+			}
+			if err := addColumns(tx, &Partition{}, "MaxPartitionRetries", "PartitionRetryCooldown", "PartitionRetryCount", "RetryAt"); err != nil {
+				return err
+			}
+			return createIndexes(tx, &Partition{}, "RetryAt")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Partition struct {
+				MaxPartitionRetries    int        `gorm:"not null;default:0"`
+				PartitionRetryCooldown int64      `gorm:"not null;default:0"`
+				PartitionRetryCount    int        `gorm:"not null;default:0"`
+				RetryAt                *time.Time `gorm:"index"`
+			}
+			if err := dropIndexes(tx, &Partition{}, "RetryAt"); err != nil {
+				return err
+			}
+			return dropColumns(tx, &Partition{}, "MaxPartitionRetries", "PartitionRetryCooldown", "PartitionRetryCount", "RetryAt")
+		},
+	},
+	{
+		Version: 32,
+		Name:    "add partition failure tolerance",
+		Up: func(tx *gorm.DB) error {
+			type Partition struct {
+				FailureTolerance *float64
+			}
+			return addColumns(tx, &Partition{}, "FailureTolerance")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Partition struct {
+				FailureTolerance *float64
+			}
+			return dropColumns(tx, &Partition{}, "FailureTolerance")
+		},
+	},
+	{
+		Version: 33,
+		Name:    "add partition max concurrency",
+		Up: func(tx *gorm.DB) error {
+			type Partition struct {
+				MaxConcurrency int `gorm:"not null;default:0"`
+				ClaimedCount   int `gorm:"not null;default:0"`
+			}
+			return addColumns(tx, &Partition{}, "MaxConcurrency", "ClaimedCount")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Partition struct {
+				MaxConcurrency int `gorm:"not null;default:0"`
+				ClaimedCount   int `gorm:"not null;default:0"`
+			}
+			return dropColumns(tx, &Partition{}, "MaxConcurrency", "ClaimedCount")
+		},
+	},
+}
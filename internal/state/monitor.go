@@ -0,0 +1,206 @@
+package state
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+	"github.com/golang/glog"
+)
+
+// DefaultMonitorInterval is how often a Monitor scans the partitions by default.
+var DefaultMonitorInterval = 30 * time.Second
+
+// MonitorRepo is the part of the Repo a Monitor reads.
+type MonitorRepo interface {
+	ItemReader
+	LeaseRepo
+}
+
+// Monitor publishes the progress and lag of the Available partitions, and the owners leasing
+// them, without leasing or processing anything. It also reports the leases orphaned by dead
+// owners, and the items stuck in processing. A single Monitor is meant to run alongside the
+// watchers, e.g. as its own replica.
+type Monitor struct {
+	Repo MonitorRepo
+	// Interval is how often the partitions are scanned. Defaults to DefaultMonitorInterval.
+	Interval time.Duration
+	// Metrics receives the measurements. Defaults to discarding them.
+	Metrics Metrics
+	// StuckItemThreshold, if set, is how long an item may be in processing before it is
+	// reported stuck. Only the watchers with a ProcessingTimeout record when processing starts.
+	StuckItemThreshold time.Duration
+	// Clock defaults to the real time, and is overridden in tests.
+	Clock clock.Clock
+	// EventBuffer is the capacity of the Events channel. Defaults to DefaultEventBuffer.
+	EventBuffer int
+
+	events        chan Event
+	droppedEvents int64
+	// orphaned are the owners of the orphaned leases reported, by partition, and stuck the
+	// partitions with stuck items reported.
+	orphaned map[string]string
+	stuck    map[string]bool
+}
+
+// Events returns the LeaseOrphaned and ItemsStuck events, sent once per partition until the
+// lease expires or is taken over, or the items are reclaimed. The channel is closed when the
+// monitor stops. Like Watcher.Events, it must be called before Start, and events that don't
+// fit in the buffer are dropped.
+func (m *Monitor) Events() <-chan Event {
+	if m.events == nil {
+		if m.EventBuffer == 0 {
+			m.EventBuffer = DefaultEventBuffer
+		}
+		m.events = make(chan Event, m.EventBuffer)
+	}
+	return m.events
+}
+
+// DroppedEvents returns the number of events dropped because the Events buffer was full.
+func (m *Monitor) DroppedEvents() int64 {
+	return atomic.LoadInt64(&m.droppedEvents)
+}
+
+func (m *Monitor) emit(e Event) {
+	if m.events == nil {
+		return
+	}
+	e.Time = m.Clock.Now()
+	select {
+	case m.events <- e:
+	default:
+		atomic.AddInt64(&m.droppedEvents, 1)
+	}
+}
+
+func (m *Monitor) metrics() Metrics {
+	if m.Metrics == nil {
+		return nopMetrics{}
+	}
+	return m.Metrics
+}
+
+// Start scans the partitions every Interval until ctx is done.
+func (m *Monitor) Start(ctx context.Context) {
+	m.Clock = clock.Or(m.Clock)
+	if m.Interval <= 0 {
+		m.Interval = DefaultMonitorInterval
+	}
+	if m.events != nil {
+		defer close(m.events)
+	}
+	for {
+		if err := m.scan(ctx); err != nil && ctx.Err() == nil {
+			glog.Errorf("error scanning partitions for the monitor: %s", err)
+		}
+		select {
+		case <-m.Clock.After(m.Interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// scan publishes the owners and the Available partitions, and reports the orphaned leases and
+// stuck items.
+func (m *Monitor) scan(ctx context.Context) error {
+	owners, err := m.Repo.ListOwners(ctx)
+	if err != nil {
+		return err
+	}
+	live, dead := 0, map[string]bool{}
+	for _, o := range owners {
+		if o.Dead {
+			dead[o.OwnerID] = true
+			continue
+		}
+		live++
+		m.metrics().Gauge(MetricOwnerLeasedPartitions, float64(o.LeasedPartitions), Labels{"owner": o.OwnerID})
+	}
+	m.metrics().Gauge(MetricOwners, float64(live), Labels{"state": "live"})
+	m.metrics().Gauge(MetricOwners, float64(len(dead)), Labels{"state": "dead"})
+
+	orphaned := map[string]string{}
+	page := PageRequest{}
+	for {
+		partitions, token, err := m.Repo.ListPartitions(ctx, PartitionFilter{Status: Available}, page)
+		if err != nil {
+			return err
+		}
+		for _, p := range partitions {
+			if err := m.publishPartition(ctx, p); err != nil {
+				return err
+			}
+			if l := p.leaseStateAt(m.Clock.Now()); l.Status == LeaseActive && dead[l.Owner] {
+				orphaned[p.ID] = l.Owner
+			}
+		}
+		if token == "" {
+			break
+		}
+		page.Token = token
+	}
+	m.reportOrphans(orphaned)
+
+	if m.StuckItemThreshold > 0 {
+		stuck, err := m.Repo.CountStuckItems(ctx, m.StuckItemThreshold)
+		if err != nil {
+			return err
+		}
+		m.reportStuck(stuck)
+	}
+	return nil
+}
+
+// publishPartition publishes the progress and lag of the partition.
+func (m *Monitor) publishPartition(ctx context.Context, p *Partition) error {
+	progress, err := m.Repo.GetPartitionProgress(ctx, p.ID)
+	if IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lag, err := m.Repo.GetAvailableLag(ctx, p)
+	if err != nil {
+		return err
+	}
+	for status, n := range map[Status]int{Available: progress.Available, Complete: progress.Complete, Failed: progress.Failed, Cancelled: progress.Cancelled} {
+		m.metrics().Gauge(MetricPartitionItems, float64(n), Labels{"partition": p.ID, "status": status.String()})
+	}
+	m.metrics().Gauge(MetricPartitionGate, float64(progress.Gate), Labels{"partition": p.ID})
+	m.metrics().Gauge(MetricPartitionRate, progress.RecentRatePerMinute, Labels{"partition": p.ID})
+	m.metrics().Gauge(MetricPartitionETA, progress.ETA.Seconds(), Labels{"partition": p.ID})
+	m.metrics().Gauge(MetricAvailableLag, lag.Seconds(), Labels{"partition": p.ID})
+	return nil
+}
+
+// reportOrphans reports the partitions newly orphaned, by their owner.
+func (m *Monitor) reportOrphans(orphaned map[string]string) {
+	for id, owner := range orphaned {
+		if m.orphaned[id] != owner {
+			glog.Warningf("partition %s is leased by dead owner %s", id, owner)
+			m.emit(Event{Type: LeaseOrphaned, PartitionID: id, Owner: owner})
+		}
+	}
+	m.orphaned = orphaned
+	m.metrics().Gauge(MetricOrphanedLeases, float64(len(orphaned)), nil)
+}
+
+// reportStuck reports the partitions with newly stuck items.
+func (m *Monitor) reportStuck(counts map[string]int) {
+	stuck := map[string]bool{}
+	total := 0
+	for id, n := range counts {
+		stuck[id] = true
+		total += n
+		if !m.stuck[id] {
+			glog.Warningf("%d items of partition %s are stuck in processing", n, id)
+			m.emit(Event{Type: ItemsStuck, PartitionID: id, Count: n})
+		}
+	}
+	m.stuck = stuck
+	m.metrics().Gauge(MetricStuckItems, float64(total), nil)
+}
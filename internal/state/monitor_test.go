@@ -0,0 +1,165 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+)
+
+// labelledGauges records the last value of each gauge, by name and labels.
+type labelledGauges struct {
+	nopMetrics
+	mu     sync.Mutex
+	gauges map[string]float64
+}
+
+func gaugeKey(name string, labels Labels) string {
+	var pairs []string
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return fmt.Sprintf("%s{%s}", name, strings.Join(pairs, ","))
+}
+
+func (m *labelledGauges) Gauge(name string, value float64, labels Labels) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges[gaugeKey(name, labels)] = value
+}
+
+func (m *labelledGauges) get(name string, labels Labels) (float64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.gauges[gaugeKey(name, labels)]
+	return v, ok
+}
+
+func TestMonitor(t *testing.T) {
+	r := getTestRepo(t)
+	ctx := context.Background()
+	// p1 is alive, while p2 stopped sending heartbeats with a lease on p2_owned.
+	r.Heartbeat(ctx, &Owner{OwnerID: "p1", LeasedPartitions: 3})
+	r.Heartbeat(ctx, &Owner{OwnerID: "p2"})
+	if err := r.DB.Model(&Owner{}).Where("owner_id = ?", "p2").Update("last_heartbeat", time.Now().Add(-time.Minute)).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"p1_owned", "p2_owned"} {
+		if err := r.DB.Model(&Partition{}).Where("id = ?", id).Update("until", time.Now().Add(time.Hour)).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An item of the orphaned partition has been in processing for an hour.
+	if err := r.DB.Model(&Item{}).Where("id = ?", "s4_owned").Update("processing_started_at", time.Now().Add(-time.Hour)).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	m := &labelledGauges{gauges: map[string]float64{}}
+	mon := &Monitor{Repo: r, Metrics: m, StuckItemThreshold: time.Minute}
+	events := mon.Events()
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		mon.Start(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	var got []Event
+	for len(got) < 2 {
+		select {
+		case e := <-events:
+			got = append(got, e)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("expected an orphaned lease and stuck items to be reported, got %v", got)
+		}
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].Type < got[j].Type })
+	if got[0].Type != LeaseOrphaned || got[0].PartitionID != "p2_owned" || got[0].Owner != "p2" {
+		t.Errorf("expected the lease of p2_owned to be orphaned, got %+v", got[0])
+	}
+	if got[1].Type != ItemsStuck || got[1].PartitionID != "p2_owned" || got[1].Count != 1 {
+		t.Errorf("expected an item of p2_owned to be stuck, got %+v", got[1])
+	}
+
+	for _, tc := range []struct {
+		name   string
+		labels Labels
+		value  float64
+	}{
+		{MetricOwners, Labels{"state": "live"}, 1},
+		{MetricOwners, Labels{"state": "dead"}, 1},
+		{MetricOwnerLeasedPartitions, Labels{"owner": "p1"}, 3},
+		{MetricOrphanedLeases, nil, 1},
+		{MetricStuckItems, nil, 1},
+		{MetricPartitionItems, Labels{"partition": "p2_owned", "status": "Available"}, 2},
+		{MetricPartitionItems, Labels{"partition": "p2_owned", "status": "Failed"}, 0},
+		{MetricPartitionGate, Labels{"partition": "p2_owned"}, 0},
+	} {
+		if v, ok := m.get(tc.name, tc.labels); !ok || v != tc.value {
+			t.Errorf("expected %s %v to be %v, got %v", tc.name, tc.labels, tc.value, v)
+		}
+	}
+	if _, ok := m.get(MetricAvailableLag, Labels{"partition": "p2_owned"}); !ok {
+		t.Error("expected the lag of p2_owned to be published")
+	}
+	// Only Available partitions are published.
+	for _, id := range []string{"p1_disabled", "p1_unowned"} {
+		if _, ok := m.get(MetricPartitionGate, Labels{"partition": id}); ok {
+			t.Errorf("expected %s not to be published", id)
+		}
+	}
+}
+
+func TestMonitorReportsOnce(t *testing.T) {
+	r := getTestRepo(t)
+	ctx := context.Background()
+	r.Heartbeat(ctx, &Owner{OwnerID: "p2"})
+	r.DeadOwnerThreshold = time.Millisecond
+	if err := r.DB.Model(&Partition{}).Where("id = ?", "p2_owned").Update("until", time.Now().Add(time.Hour)).Error; err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	mon := &Monitor{Repo: r, StuckItemThreshold: time.Minute, Clock: clock.Or(nil)}
+	events := mon.Events()
+	scan := func() []EventType {
+		t.Helper()
+		if err := mon.scan(ctx); err != nil {
+			t.Fatal(err)
+		}
+		var types []EventType
+		for {
+			select {
+			case e := <-events:
+				types = append(types, e.Type)
+			default:
+				return types
+			}
+		}
+	}
+
+	if types := scan(); len(types) != 1 || types[0] != LeaseOrphaned {
+		t.Fatalf("expected the orphaned lease to be reported, got %v", types)
+	}
+	if types := scan(); len(types) != 0 {
+		t.Errorf("expected the orphaned lease to be reported once, got %v", types)
+	}
+	// Once the lease expires, a new orphaned lease is reported again.
+	r.DB.Model(&Partition{}).Where("id = ?", "p2_owned").Update("until", time.Now())
+	if types := scan(); len(types) != 0 {
+		t.Errorf("expected no events, got %v", types)
+	}
+	r.DB.Model(&Partition{}).Where("id = ?", "p2_owned").Update("until", time.Now().Add(time.Hour))
+	if types := scan(); len(types) != 1 || types[0] != LeaseOrphaned {
+		t.Errorf("expected the orphaned lease to be reported again, got %v", types)
+	}
+}
@@ -0,0 +1,25 @@
+package state
+
+import "fmt"
+
+// DefaultMaxGateSkip is the default number of gates a processor may move an item ahead by,
+// see Watcher.MaxGateSkip.
+var DefaultMaxGateSkip = 1
+
+// checkNextGate rejects a response moving an item back, more than MaxGateSkip gates ahead,
+// past its partition's MaxGate, or past the end of its partition's GatePlan. Applying such a
+// gate would strand the item at a gate that is no longer, or never, processed.
+func (w *Watcher) checkNextGate(i *Item, resp *ProcessorResponse) error {
+	from, next := i.partition.plan.Name(i.Gate), resp.NextGate
+	switch {
+	case next < i.Gate:
+		return NonRetryableError(fmt.Sprintf("processor moved item back from gate %s to %s", from, i.partition.plan.Name(next)))
+	case next-i.Gate > w.MaxGateSkip:
+		return NonRetryableError(fmt.Sprintf("processor moved item from gate %s to %s, past the maximum skip of %d", from, i.partition.plan.Name(next), w.MaxGateSkip))
+	case i.partition.maxGate > 0 && next > i.partition.maxGate:
+		return NonRetryableError(fmt.Sprintf("processor moved item to gate %d, past the partition's max gate %d", next, i.partition.maxGate))
+	case len(i.partition.plan) > 0 && next >= len(i.partition.plan):
+		return NonRetryableError(fmt.Sprintf("processor moved item from gate %s to gate %d, past the end of the plan %s", from, next, i.partition.plan))
+	}
+	return nil
+}
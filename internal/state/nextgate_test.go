@@ -0,0 +1,75 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckNextGate(t *testing.T) {
+	w := &Watcher{}
+	for _, tc := range []struct {
+		name    string
+		item    *Item
+		next    int
+		maxSkip int
+		wantErr string
+	}{
+		{name: "same gate", item: &Item{Gate: 2}, next: 2},
+		{name: "next gate", item: &Item{Gate: 2}, next: 3},
+		{name: "negative", item: &Item{}, next: -3, wantErr: "back from gate 0 to -3"},
+		{name: "backwards", item: &Item{Gate: 2}, next: 1, wantErr: "back from gate 2 to 1"},
+		{name: "oversized", item: &Item{}, next: 2_000_000, wantErr: "past the maximum skip of 1"},
+		{name: "allowed skip", item: &Item{}, next: 3, maxSkip: 3},
+		{name: "skip past the max skip", item: &Item{}, next: 4, maxSkip: 3, wantErr: "past the maximum skip of 3"},
+		{name: "past the max gate", item: &Item{Gate: 1, partition: partitionConfig{maxGate: 1}}, next: 2, wantErr: "max gate 1"},
+		{name: "past the plan", item: &Item{Gate: 1, partition: partitionConfig{plan: GatePlan{"validate", "upload"}}}, next: 2, wantErr: "past the end of the plan"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w.MaxGateSkip = DefaultMaxGateSkip
+			if tc.maxSkip != 0 {
+				w.MaxGateSkip = tc.maxSkip
+			}
+			err := w.checkNextGate(tc.item, &ProcessorResponse{NextGate: tc.next})
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("expected gate %d to be allowed, got %v", tc.next, err)
+				}
+				return
+			}
+			if err == nil || IsRetryable(err) || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("expected a non-retryable error %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestInvalidNextGateFailsItem(t *testing.T) {
+	for _, gate := range []int{-3, 2_000_000} {
+		t.Run(fmt.Sprint(gate), func(t *testing.T) {
+			r := openTestRepo(t)
+			ctx := context.Background()
+			r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+			r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Data: []byte(fmt.Sprintf(`{"times":1,"gate":%d}`, gate))})
+
+			events := runForEvents(t, r, &Watcher{Processor: &testProcessor{}, Repo: r, BatchSize: 1, PollInterval: 10 * time.Millisecond, AutoClose: true})
+
+			var failed bool
+			for _, e := range events {
+				failed = failed || (e.Type == ItemFailed && !IsRetryable(e.Err))
+			}
+			if !failed {
+				t.Errorf("expected a non-retryable failure, got events %v", events)
+			}
+			i, err := r.GetItem(ctx, "i")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i.Status != Failed || i.Gate != 0 || !strings.Contains(i.ErrorMessages, "processor moved item") {
+				t.Errorf("expected the item to fail at gate 0, got %s at gate %d with %q", i.Status, i.Gate, i.ErrorMessages)
+			}
+		})
+	}
+}
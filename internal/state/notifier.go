@@ -0,0 +1,205 @@
+package state
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jackc/pgx/v4"
+)
+
+// NotifyChannel is the Postgres channel on which item availability is published. The payload
+// is the partition ID.
+var NotifyChannel = "state_items_available"
+
+// ListenRetryInterval is how long ListenPostgres waits before reconnecting after an error.
+var ListenRetryInterval = 5 * time.Second
+
+// Notifier is optionally implemented by repos which can push notice of newly available items,
+// so that watchers pick them up without waiting for their next poll.
+type Notifier interface {
+	// Subscribe returns a channel which receives a value whenever items may have become
+	// available in the partition, until ctx is done. A nil channel means notifications are
+	// unsupported, and the watcher relies on polling alone.
+	Subscribe(ctx context.Context, partitionID string) <-chan struct{}
+	// NotifyItemAvailable wakes the subscribers of the partition.
+	NotifyItemAvailable(ctx context.Context, partitionID string)
+}
+
+// Notifications fans out item availability to the subscribers of each partition. Wakeups are
+// coalesced, a subscriber that has not yet consumed a notification receives only one.
+type Notifications struct {
+	mu   sync.Mutex
+	subs map[string]map[chan struct{}]struct{}
+}
+
+// Subscribe to notifications for the partition until ctx is done.
+func (n *Notifications) Subscribe(ctx context.Context, partitionID string) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	n.mu.Lock()
+	if n.subs == nil {
+		n.subs = map[string]map[chan struct{}]struct{}{}
+	}
+	if n.subs[partitionID] == nil {
+		n.subs[partitionID] = map[chan struct{}]struct{}{}
+	}
+	n.subs[partitionID][ch] = struct{}{}
+	n.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		n.mu.Lock()
+		delete(n.subs[partitionID], ch)
+		if len(n.subs[partitionID]) == 0 {
+			delete(n.subs, partitionID)
+		}
+		n.mu.Unlock()
+	}()
+	return ch
+}
+
+// Publish wakes the subscribers of the partition.
+func (n *Notifications) Publish(partitionID string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for ch := range n.subs[partitionID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Listen publishes each partition ID received on ids until it is closed. It connects a
+// notification source from other processes, such as the Postgres LISTEN of ListenPostgres, to
+// the local subscribers.
+func (n *Notifications) Listen(ids <-chan string) {
+	for id := range ids {
+		n.Publish(id)
+	}
+}
+
+// ListenPostgres runs a LISTEN on NotifyChannel, over a connection of its own to the Postgres
+// database of the dsn, and publishes the partitions notified by other processes to n until ctx
+// is done. The connection is reopened after an error, once the ListenRetryInterval passed;
+// items made available meanwhile are found by the next poll. Returns an error only if the dsn
+// can't be parsed.
+func ListenPostgres(ctx context.Context, dsn string, n *Notifications) error {
+	config, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return err
+	}
+	ids := make(chan string)
+	defer close(ids)
+	go n.Listen(ids)
+	for ctx.Err() == nil {
+		err := listenPostgres(ctx, config, ids)
+		if ctx.Err() != nil {
+			break
+		}
+		glog.Warningf("error listening on %s, reconnecting in %s: %s", NotifyChannel, ListenRetryInterval, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(ListenRetryInterval):
+		}
+	}
+	return nil
+}
+
+// listenPostgres sends the payload of each notification on NotifyChannel to ids until the
+// connection fails or ctx is done.
+func listenPostgres(ctx context.Context, config *pgx.ConnConfig, ids chan<- string) error {
+	conn, err := pgx.ConnectConfig(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{NotifyChannel}.Sanitize()); err != nil {
+		return err
+	}
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		ids <- n.Payload
+	}
+}
+
+// Subscribe implements Notifier. It returns nil unless the repo has Notifications.
+func (db *GormRepo) Subscribe(ctx context.Context, partitionID string) <-chan struct{} {
+	if db.Notifications == nil {
+		return nil
+	}
+	return db.Notifications.Subscribe(ctx, partitionID)
+}
+
+// NotifyItemAvailable implements Notifier. Subscribers in this process are woken directly; on
+// Postgres the partition is also published on NotifyChannel for other processes. Within a
+// transaction, both are delivered once it commits, so that woken watchers see its items.
+func (db *GormRepo) NotifyItemAvailable(ctx context.Context, partitionID string) {
+	switch {
+	case db.Notifications == nil:
+	case db.pending != nil:
+		db.pending.add(partitionID)
+	default:
+		db.Notifications.Publish(partitionID)
+	}
+	if db.Dialector.Name() != "postgres" {
+		return
+	}
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	if err := db.WithContext(ctx).Exec("SELECT pg_notify(?, ?)", NotifyChannel, partitionID).Error; err != nil {
+		glog.Warningf("error notifying partition %s: %s", partitionID, err)
+	}
+}
+
+// pendingNotifications are the partitions notified within a transaction, published to the
+// local subscribers once it commits.
+type pendingNotifications struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+func (p *pendingNotifications) add(partitionID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, id := range p.ids {
+		if id == partitionID {
+			return
+		}
+	}
+	p.ids = append(p.ids, partitionID)
+}
+
+// publish wakes the subscribers of each pending partition.
+func (p *pendingNotifications) publish(n *Notifications) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, id := range p.ids {
+		n.Publish(id)
+	}
+}
+
+// notifyItems notifies each partition with an available item once.
+func (db *GormRepo) notifyItems(ctx context.Context, items ...*Item) {
+	seen := map[string]bool{}
+	for _, i := range items {
+		if i.Status == Available && !seen[i.PartitionID] {
+			seen[i.PartitionID] = true
+			db.NotifyItemAvailable(ctx, i.PartitionID)
+		}
+	}
+}
+
+// subscribe returns the notifications for the partition, or nil if the repo does not
+// support them.
+func (w *Watcher) subscribe(ctx context.Context, partitionID string) <-chan struct{} {
+	n, ok := w.Repo.(Notifier)
+	if !ok {
+		return nil
+	}
+	return n.Subscribe(ctx, partitionID)
+}
@@ -0,0 +1,248 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+func TestNotifications(t *testing.T) {
+	var n Notifications
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := n.Subscribe(ctx, "p")
+	other := n.Subscribe(context.Background(), "q")
+
+	n.Publish("p")
+	n.Publish("p")
+	select {
+	case <-ch:
+	default:
+		t.Fatal("expected a notification")
+	}
+	select {
+	case <-ch:
+		t.Error("expected notifications to be coalesced")
+	default:
+	}
+	select {
+	case <-other:
+		t.Error("unexpected notification for another partition")
+	default:
+	}
+
+	cancel()
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		n.mu.Lock()
+		subscribed := len(n.subs["p"]) > 0
+		n.mu.Unlock()
+		if !subscribed {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal("subscription not removed after cancellation")
+		}
+	}
+
+	if ch := (&GormRepo{}).Subscribe(context.Background(), "p"); ch != nil {
+		t.Error("expected no notifications without a Notifications hub")
+	}
+}
+
+func TestNotificationsAfterCommit(t *testing.T) {
+	r := openTestRepo(t)
+	r.Notifications = &Notifications{}
+	ctx := context.Background()
+	ch := r.Subscribe(ctx, "p")
+	notified := func() bool {
+		select {
+		case <-ch:
+			return true
+		default:
+			return false
+		}
+	}
+
+	err := r.Transaction(ctx, func(tx *GormRepo) error {
+		if !tx.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Status: Available, Data: []byte(`{}`)}) {
+			t.Fatal("expected the item to be saved")
+		}
+		if notified() {
+			t.Error("expected no notification before the transaction commits")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !notified() {
+		t.Error("expected a notification once the transaction committed")
+	}
+
+	r.Transaction(ctx, func(tx *GormRepo) error {
+		tx.Save(ctx, &Item{BaseModel: BaseModel{ID: "j"}, PartitionID: "p", Status: Available, Data: []byte(`{}`)})
+		return errors.New("rolled back")
+	})
+	if notified() {
+		t.Error("expected no notification of a rolled back transaction")
+	}
+}
+
+func TestNotifiedPickupLatency(t *testing.T) {
+	r := openTestRepo(t)
+	r.Notifications = &Notifications{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+
+	w := &Watcher{
+		Processor:    &testProcessor{},
+		Repo:         r,
+		OwnerID:      "w",
+		BatchSize:    1,
+		PollInterval: 30 * time.Second,
+	}
+	done := make(chan struct{})
+	go func() {
+		w.Start(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// The watcher subscribes before its first poll of the partition, which takes the lease
+	// and is then saved.
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		if p, err := r.GetPartition(ctx, "p"); err == nil && p.Owner == "w" && p.Version > 1 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("partition was never leased")
+		}
+	}
+
+	start := time.Now()
+	if err := r.CreateItems(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Data: []byte(`{"times": 1}`)}); err != nil {
+		t.Fatal(err)
+	}
+	for ; ; time.Sleep(time.Millisecond) {
+		if i, err := r.GetItem(ctx, "i"); err == nil && i.Status == Complete {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("item was not picked up before the next poll")
+		}
+	}
+	if latency := time.Since(start); latency > 100*time.Millisecond {
+		t.Errorf("expected the item to be picked up within 100ms, took %s", latency)
+	}
+}
+
+// openPostgresTestRepos returns two repos, as two processes would open them, on the same tables
+// of the Postgres database of STATE_TEST_POSTGRES_DSN, migrated and dropped once the test
+// completes. The test is skipped if the variable isn't set.
+func openPostgresTestRepos(t *testing.T) (string, *GormRepo, *GormRepo) {
+	dsn := os.Getenv("STATE_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("STATE_TEST_POSTGRES_DSN not set")
+	}
+	prefix := fmt.Sprintf("test_%d_", time.Now().UnixNano())
+	open := func() *GormRepo {
+		db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
+			Logger:         logger.Default.LogMode(logger.Silent),
+			NamingStrategy: schema.NamingStrategy{TablePrefix: prefix},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewGormRepo(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			if sqlDB, err := db.DB(); err == nil {
+				sqlDB.Close()
+			}
+		})
+		return r
+	}
+	a, b := open(), open()
+	if err := a.AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := a.MigrateTo(context.Background(), 0); err != nil {
+			t.Errorf("error dropping the tables: %s", err)
+		}
+	})
+	return dsn, a, b
+}
+
+func TestPostgresNotifiedPickupLatency(t *testing.T) {
+	dsn, r, other := openPostgresTestRepos(t)
+	r.Notifications = &Notifications{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+
+	listening := make(chan error)
+	go func() {
+		listening <- ListenPostgres(ctx, dsn, r.Notifications)
+	}()
+	w := &Watcher{
+		Processor:    &testProcessor{},
+		Repo:         r,
+		OwnerID:      "w",
+		BatchSize:    1,
+		PollInterval: 30 * time.Second,
+	}
+	done := make(chan struct{})
+	go func() {
+		w.Start(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+		if err := <-listening; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		if p, err := r.GetPartition(ctx, "p"); err == nil && p.Owner == "w" && p.Version > 1 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("partition was never leased")
+		}
+	}
+	// Give the listener time to connect, as its LISTEN is not observable.
+	time.Sleep(time.Second)
+
+	// The item is created by another process, which only reaches the watcher through Postgres.
+	start := time.Now()
+	if err := other.CreateItems(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Data: []byte(`{"times": 1}`)}); err != nil {
+		t.Fatal(err)
+	}
+	for ; ; time.Sleep(time.Millisecond) {
+		if i, err := r.GetItem(ctx, "i"); err == nil && i.Status == Complete {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("item was not picked up before the next poll")
+		}
+	}
+	if latency := time.Since(start); latency > 100*time.Millisecond {
+		t.Errorf("expected the item to be picked up within 100ms, took %s", latency)
+	}
+}
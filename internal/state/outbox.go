@@ -0,0 +1,232 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+)
+
+// DefaultOutboxClaimDuration is how long a claimed outbox batch is reserved for its publisher
+// before it may be claimed again.
+var DefaultOutboxClaimDuration = 30 * time.Second
+
+var errSaveConflict = errors.New("save conflict")
+
+// OutboxEvent is a state change recorded in the same transaction as the change itself, for
+// at-least-once delivery by an OutboxPublisher.
+type OutboxEvent struct {
+	ID string `gorm:"primaryKey"`
+	// AggregateType is "item" or "partition", and AggregateID its ID.
+	AggregateType string `gorm:"not null"`
+	AggregateID   string `gorm:"not null"`
+	// EventType is the name of the EventType, e.g. ItemCompleted.
+	EventType string `gorm:"not null"`
+	// Payload is the JSON encoded ItemPayload or PartitionPayload.
+	Payload   []byte    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null;index"`
+	// ClaimedUntil reserves the event for the publisher which claimed it.
+	ClaimedUntil time.Time `gorm:"not null"`
+	PublishedAt  *time.Time
+}
+
+// ItemPayload is the payload of item outbox events.
+type ItemPayload struct {
+	ID          string `json:"id"`
+	PartitionID string `json:"partition_id"`
+	Gate        int    `json:"gate"`
+	Status      Status `json:"status"`
+	RetryCount  int    `json:"retry_count"`
+	Error       string `json:"error,omitempty"`
+	// Owner is the OwnerID of the watcher that made the attempt.
+	Owner string `json:"owner,omitempty"`
+}
+
+// PartitionPayload is the payload of partition outbox events, with the counts of the
+// partition's items by status when they were saved, and its StatusReason.
+type PartitionPayload struct {
+	ID     string         `json:"id"`
+	Gate   int            `json:"gate"`
+	Status Status         `json:"status"`
+	Counts map[Status]int `json:"counts,omitempty"`
+	Reason string         `json:"reason,omitempty"`
+}
+
+func newOutboxEvent(aggregateType, id string, t EventType, payload interface{}) *OutboxEvent {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		// The payloads are plain structs, this can't happen.
+		panic(err)
+	}
+	return &OutboxEvent{ID: uuid.New().String(), AggregateType: aggregateType, AggregateID: id, EventType: t.String(), Payload: b}
+}
+
+// itemOutboxEvents returns the outbox events for an item about to be saved by the watcher.
+func itemOutboxEvents(i *Item, err error) []*OutboxEvent {
+	var t EventType
+	switch i.Status {
+	case Complete:
+		t = ItemCompleted
+	case Failed:
+		t = ItemFailed
+	default:
+		return nil
+	}
+	payload := ItemPayload{ID: i.ID, PartitionID: i.PartitionID, Gate: i.Gate, Status: i.Status, RetryCount: i.RetryCount, Owner: i.LastOwner}
+	if err != nil {
+		payload.Error = err.Error()
+	}
+	return []*OutboxEvent{newOutboxEvent("item", i.ID, t, payload)}
+}
+
+// partitionOutboxEvents returns the outbox events for a partition about to be saved by the
+// watcher, which previously had the given status, and the counts of items.
+func partitionOutboxEvents(p *Partition, status Status, counts map[Status]int) []*OutboxEvent {
+	if p.Status == status {
+		return nil
+	}
+	var t EventType
+	switch p.Status {
+	case Complete:
+		t = PartitionCompleted
+	case Failed:
+		t = PartitionFailed
+	default:
+		return nil
+	}
+	return []*OutboxEvent{newOutboxEvent("partition", p.ID, t, PartitionPayload{ID: p.ID, Gate: p.Gate, Status: p.Status, Counts: counts, Reason: p.StatusReason})}
+}
+
+// SaveWithOutbox saves the model like Save, and if OutboxEnabled is set, writes the events to
+// the outbox in the same transaction.
+func (db *GormRepo) SaveWithOutbox(ctx context.Context, m Model, events ...*OutboxEvent) bool {
+	if !db.OutboxEnabled || len(events) == 0 {
+		return db.Save(ctx, m)
+	}
+	saved := false
+	err := db.Transaction(ctx, func(tx *GormRepo) error {
+		if saved = tx.Save(ctx, m); !saved {
+			return errSaveConflict
+		}
+		return tx.WithContext(ctx).Create(&events).Error
+	})
+	if err != nil {
+		if saved {
+			// The save was rolled back along with the events.
+			m.DecrementVersion()
+		}
+		if !errors.Is(err, errSaveConflict) {
+			glog.Warningf("error saving model %s with outbox events: %s", m.GetID(), err)
+		}
+		return false
+	}
+	return true
+}
+
+// ClaimOutboxBatch reserves up to limit of the oldest unpublished events for claimFor, so that
+// concurrent publishers do not deliver the same events.
+func (db *GormRepo) ClaimOutboxBatch(ctx context.Context, limit int, claimFor time.Duration) ([]*OutboxEvent, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	now := clock.Or(db.Clock).Now()
+	var candidates []*OutboxEvent
+	if err := db.WithContext(ctx).Where("published_at IS NULL AND claimed_until < ?", now).Order(
+		"created_at").Limit(limit).Find(&candidates).Error; err != nil {
+		return nil, err
+	}
+	var claimed []*OutboxEvent
+	for _, e := range candidates {
+		// Claim each event conditionally, another publisher may have claimed it since.
+		res := db.WithContext(ctx).Model(&OutboxEvent{}).Where(
+			"id = ? AND published_at IS NULL AND claimed_until < ?", e.ID, now).Update("claimed_until", now.Add(claimFor))
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		if res.RowsAffected == 1 {
+			e.ClaimedUntil = now.Add(claimFor)
+			claimed = append(claimed, e)
+		}
+	}
+	return claimed, nil
+}
+
+// MarkOutboxPublished records that the events were delivered.
+func (db *GormRepo) MarkOutboxPublished(ctx context.Context, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	return db.WithContext(ctx).Model(&OutboxEvent{}).Where("id IN ?", ids).Update("published_at", clock.Or(db.Clock).Now()).Error
+}
+
+// Sink delivers outbox events downstream, e.g. to a message broker.
+type Sink interface {
+	// Publish delivers the events. Events are retried if an error is returned, so the sink
+	// must tolerate duplicates.
+	Publish(ctx context.Context, events []*OutboxEvent) error
+}
+
+// OutboxPublisher delivers outbox events to a Sink at least once.
+type OutboxPublisher struct {
+	Repo OutboxRepo
+	Sink Sink
+	// BatchSize is the number of events claimed at a time. Defaults to 100.
+	BatchSize    int
+	PollInterval time.Duration
+	// ClaimDuration defaults to DefaultOutboxClaimDuration.
+	ClaimDuration time.Duration
+	// Clock defaults to the real time, and is overridden in tests.
+	Clock clock.Clock
+}
+
+// Start publishes events until ctx is done.
+func (p *OutboxPublisher) Start(ctx context.Context) {
+	if p.PollInterval == 0 {
+		p.PollInterval = DefaultPollInterval
+	}
+	p.Clock = clock.Or(p.Clock)
+	for {
+		n, err := p.PublishBatch(ctx)
+		if err != nil && ctx.Err() == nil {
+			glog.Errorf("error publishing outbox events: %s", err)
+		}
+		// Keep going while there is a backlog.
+		if err == nil && n > 0 {
+			continue
+		}
+		select {
+		case <-p.Clock.After(p.PollInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// PublishBatch claims, delivers, and marks published a single batch of events, returning the
+// number of events published.
+func (p *OutboxPublisher) PublishBatch(ctx context.Context) (int, error) {
+	if p.BatchSize == 0 {
+		p.BatchSize = 100
+	}
+	if p.ClaimDuration == 0 {
+		p.ClaimDuration = DefaultOutboxClaimDuration
+	}
+	events, err := p.Repo.ClaimOutboxBatch(ctx, p.BatchSize, p.ClaimDuration)
+	if err != nil || len(events) == 0 {
+		return 0, err
+	}
+	if err := p.Sink.Publish(ctx, events); err != nil {
+		// The claim expires, and the events are retried.
+		return 0, err
+	}
+	ids := make([]string, len(events))
+	for n, e := range events {
+		ids[n] = e.ID
+	}
+	return len(events), p.Repo.MarkOutboxPublished(ctx, ids...)
+}
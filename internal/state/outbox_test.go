@@ -0,0 +1,186 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingSink struct {
+	mu     sync.Mutex
+	events []*OutboxEvent
+	err    error
+}
+
+func (s *recordingSink) Publish(ctx context.Context, events []*OutboxEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.events = append(s.events, events...)
+	return nil
+}
+
+func countOutbox(t *testing.T, r *GormRepo) int64 {
+	var n int64
+	if err := r.DB.Model(&OutboxEvent{}).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestOutboxRollback(t *testing.T) {
+	r := openTestRepo(t)
+	r.OutboxEnabled = true
+	ctx := context.Background()
+	i := &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Status: Available, Data: []byte(`{}`)}
+	r.Save(ctx, i)
+
+	// A conflicting save writes nothing.
+	stale := *i
+	i.RetryCount++
+	r.Save(ctx, i)
+	stale.Status = Complete
+	if r.SaveWithOutbox(ctx, &stale, itemOutboxEvents(&stale, nil)...) {
+		t.Fatal("expected a stale save to fail")
+	}
+	if n := countOutbox(t, r); n != 0 {
+		t.Errorf("expected no outbox rows after a conflict, got %d", n)
+	}
+
+	// Rolling back the surrounding transaction discards the events with the save.
+	i.Status = Complete
+	rollback := errors.New("rollback")
+	err := r.Transaction(ctx, func(tx *GormRepo) error {
+		if !tx.SaveWithOutbox(ctx, i, itemOutboxEvents(i, nil)...) {
+			t.Error("failed to save item")
+		}
+		return rollback
+	})
+	if !errors.Is(err, rollback) {
+		t.Fatalf("expected the rollback error, got %v", err)
+	}
+	if n := countOutbox(t, r); n != 0 {
+		t.Errorf("expected no outbox rows after a rollback, got %d", n)
+	}
+	got, err := r.GetItem(ctx, "i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != Available {
+		t.Errorf("expected the item save to be rolled back, got %s", got.Status)
+	}
+
+	// Saves without events are plain saves.
+	r.OutboxEnabled = false
+	i, _ = r.GetItem(ctx, "i")
+	i.Status = Complete
+	if !r.SaveWithOutbox(ctx, i, itemOutboxEvents(i, nil)...) {
+		t.Fatal("failed to save item")
+	}
+	if n := countOutbox(t, r); n != 0 {
+		t.Errorf("expected no outbox rows with the outbox disabled, got %d", n)
+	}
+}
+
+func TestOutboxPublisher(t *testing.T) {
+	r := openTestRepo(t)
+	r.OutboxEnabled = true
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i1"}, PartitionID: "p", Status: Available, Data: []byte(`{"times": 1}`)})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i2"}, PartitionID: "p", Status: Available, Data: []byte(`{"times": 1}`)})
+
+	w := &Watcher{Processor: &testProcessor{}, Repo: r, BatchSize: 2, PollInterval: 10 * time.Millisecond, AutoClose: true}
+	events := w.Events()
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		w.Start(wctx)
+		close(done)
+	}()
+	for e := range events {
+		if e.Type == PartitionCompleted {
+			cancel()
+		}
+	}
+	<-done
+
+	// A failing sink leaves the events to be claimed again.
+	sink := &recordingSink{err: errors.New("unavailable")}
+	pub := &OutboxPublisher{Repo: r, Sink: sink, ClaimDuration: time.Nanosecond}
+	if _, err := pub.PublishBatch(ctx); err == nil {
+		t.Fatal("expected the sink error")
+	}
+
+	sink.err = nil
+	n, err := pub.PublishBatch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 events, got %d", n)
+	}
+	counts := map[string]int{}
+	for _, e := range sink.events {
+		counts[e.AggregateType+" "+e.EventType]++
+	}
+	if counts["item ItemCompleted"] != 2 || counts["partition PartitionCompleted"] != 1 {
+		t.Errorf("unexpected events %v", counts)
+	}
+	var payload ItemPayload
+	for _, e := range sink.events {
+		if e.AggregateType == "item" {
+			if err := json.Unmarshal(e.Payload, &payload); err != nil {
+				t.Fatal(err)
+			}
+			if payload.ID != e.AggregateID || payload.PartitionID != "p" || payload.Status != Complete {
+				t.Errorf("unexpected payload %+v", payload)
+			}
+			continue
+		}
+		var partition PartitionPayload
+		if err := json.Unmarshal(e.Payload, &partition); err != nil {
+			t.Fatal(err)
+		}
+		if partition.ID != "p" || partition.Status != Complete || partition.Counts[Complete] != 2 {
+			t.Errorf("unexpected partition payload %+v", partition)
+		}
+	}
+
+	if n, err := pub.PublishBatch(ctx); err != nil || n != 0 {
+		t.Errorf("expected published events not to be delivered again, got %d, %v", n, err)
+	}
+}
+
+func TestOutboxClaim(t *testing.T) {
+	r := openTestRepo(t)
+	r.OutboxEnabled = true
+	ctx := context.Background()
+	for _, id := range []string{"i1", "i2", "i3"} {
+		i := &Item{BaseModel: BaseModel{ID: id}, PartitionID: "p", Status: Complete, Data: []byte(`{}`)}
+		if !r.SaveWithOutbox(ctx, i, itemOutboxEvents(i, nil)...) {
+			t.Fatal("failed to save item")
+		}
+	}
+
+	first, err := r.ClaimOutboxBatch(ctx, 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := r.ClaimOutboxBatch(ctx, 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 2 || len(second) != 1 {
+		t.Fatalf("expected claims not to overlap, got %d and %d events", len(first), len(second))
+	}
+	if first[0].AggregateID != "i1" || first[1].AggregateID != "i2" || second[0].AggregateID != "i3" {
+		t.Error("expected events to be claimed oldest first")
+	}
+}
@@ -0,0 +1,104 @@
+package state
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+	"github.com/golang/glog"
+)
+
+// DefaultDeadOwnerThreshold is how long an owner may go without a heartbeat before it is
+// considered dead. It must be several times the LeaseInterval of the watchers.
+var DefaultDeadOwnerThreshold = 15 * time.Second
+
+// Owner is a watcher instance, registered in the owners table by its heartbeats.
+type Owner struct {
+	OwnerID          string    `gorm:"primaryKey"`
+	Hostname         string    `gorm:"not null;default:''"`
+	StartedAt        time.Time `gorm:"not null"`
+	LastHeartbeat    time.Time `gorm:"not null;index"`
+	LeasedPartitions int       `gorm:"not null;default:0"`
+	// Version is the version of the watcher's build, as reported by the watcher.
+	Version string `gorm:"not null;default:''"`
+	// Dead is set by ListOwners when the owner hasn't sent a heartbeat within the repo's
+	// DeadOwnerThreshold.
+	Dead bool `gorm:"-"`
+}
+
+func (db *GormRepo) deadOwnerThreshold() time.Duration {
+	if db.DeadOwnerThreshold == 0 {
+		return DefaultDeadOwnerThreshold
+	}
+	return db.DeadOwnerThreshold
+}
+
+// Heartbeat registers the owner, or updates its registration, with the current time as its
+// last heartbeat.
+func (db *GormRepo) Heartbeat(ctx context.Context, o *Owner) error {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	o.LastHeartbeat = clock.Or(db.Clock).Now()
+	res := db.WithContext(ctx).Model(&Owner{}).Where("owner_id = ?", o.OwnerID).Updates(map[string]interface{}{
+		"hostname":          o.Hostname,
+		"last_heartbeat":    o.LastHeartbeat,
+		"leased_partitions": o.LeasedPartitions,
+		"version":           o.Version,
+	})
+	if res.Error != nil || res.RowsAffected > 0 {
+		return res.Error
+	}
+	if o.StartedAt.IsZero() {
+		o.StartedAt = o.LastHeartbeat
+	}
+	return db.WithContext(ctx).Create(o).Error
+}
+
+// ListOwners returns every registered owner, including dead ones, ordered by ID.
+func (db *GormRepo) ListOwners(ctx context.Context) ([]*Owner, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	var owners []*Owner
+	if err := db.WithContext(ctx).Order("owner_id").Find(&owners).Error; err != nil {
+		return nil, err
+	}
+	deadline := clock.Or(db.Clock).Now().Add(-db.deadOwnerThreshold())
+	for _, o := range owners {
+		o.Dead = o.LastHeartbeat.Before(deadline)
+	}
+	return owners, nil
+}
+
+// register returns the watcher's entry in the owners table, having sent its first heartbeat.
+func (w *Watcher) register(ctx context.Context) *Owner {
+	hostname, err := os.Hostname()
+	if err != nil {
+		glog.Warningf("error getting hostname: %s", err)
+	}
+	o := &Owner{OwnerID: w.OwnerID, Hostname: hostname, StartedAt: w.Clock.Now(), Version: w.Version}
+	w.beat(ctx, o)
+	return o
+}
+
+// heartbeat updates the watcher's entry in the owners table every LeaseInterval, until ctx is
+// done.
+func (w *Watcher) heartbeat(ctx context.Context, o *Owner) {
+	for {
+		select {
+		case <-w.Clock.After(w.LeaseInterval):
+			w.beat(ctx, o)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *Watcher) beat(ctx context.Context, o *Owner) {
+	w.mu.Lock()
+	o.LeasedPartitions = len(w.leases)
+	w.mu.Unlock()
+	if err := w.Repo.Heartbeat(ctx, o); err != nil && ctx.Err() == nil {
+		glog.Errorf("error sending heartbeat for owner %s: %s", w.OwnerID, err)
+	}
+}
@@ -0,0 +1,134 @@
+package state
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestOwnerHeartbeat(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Status: Available, Data: []byte(`{"times": 1}`)})
+	runForEvents(t, r, &Watcher{Processor: &testProcessor{}, Repo: r, OwnerID: "w1", Version: "v1.2.3", PollInterval: 10 * time.Millisecond, AutoClose: true})
+
+	owners, err := r.ListOwners(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostname, _ := os.Hostname()
+	if len(owners) != 1 || owners[0].OwnerID != "w1" || owners[0].Version != "v1.2.3" || owners[0].Hostname != hostname || owners[0].Dead {
+		t.Fatalf("expected the watcher to be registered, got %+v", owners)
+	}
+	started := owners[0].StartedAt
+
+	if err := r.Heartbeat(ctx, &Owner{OwnerID: "w1", LeasedPartitions: 3}); err != nil {
+		t.Fatal(err)
+	}
+	owners, _ = r.ListOwners(ctx)
+	if !owners[0].StartedAt.Equal(started) || owners[0].LeasedPartitions != 3 || owners[0].LastHeartbeat.Before(started) {
+		t.Errorf("expected the heartbeat to update the registration, got %+v", owners[0])
+	}
+
+	r.DeadOwnerThreshold = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	if owners, _ = r.ListOwners(ctx); !owners[0].Dead {
+		t.Error("expected an owner without recent heartbeats to be dead")
+	}
+}
+
+func TestStealFromDeadOwners(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	until := time.Now().Add(time.Hour)
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "dead"}, Owner: "w1", Until: until})
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "alive"}, Owner: "w2", Until: until})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "dead", Status: Available, Data: []byte(`{"times": 1}`)})
+	r.Heartbeat(ctx, &Owner{OwnerID: "w1"})
+	r.Heartbeat(ctx, &Owner{OwnerID: "w2"})
+	// w1 stops sending heartbeats.
+	if err := r.DB.Model(&Owner{}).Where("owner_id = ?", "w1").Update("last_heartbeat", time.Now().Add(-time.Minute)).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if partitions, err := r.GetPotentialLeases(ctx, nil); err != nil || len(partitions) != 0 {
+		t.Errorf("expected unexpired leases to be kept by default, got %v, %v", partitionIDs(partitions), err)
+	}
+	r.StealFromDeadOwners = true
+	partitions, err := r.GetPotentialLeases(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(partitions) != 1 || partitions[0].ID != "dead" {
+		t.Fatalf("expected only the partition of the dead owner, got %v", partitionIDs(partitions))
+	}
+
+	runForEvents(t, r, &Watcher{Processor: &testProcessor{}, Repo: r, OwnerID: "w3", PollInterval: 10 * time.Millisecond, AutoClose: true})
+	p, err := r.GetPartition(ctx, "dead")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != Complete || p.Owner != "w3" {
+		t.Errorf("expected the partition to be taken over and completed before its lease expired, got %s owned by %s", p.Status, p.Owner)
+	}
+}
+
+func partitionIDs(partitions []*Partition) (out []string) {
+	for _, p := range partitions {
+		out = append(out, p.ID)
+	}
+	return out
+}
+
+func TestItemLastOwner(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "ok"}, PartitionID: "p", Status: Available, Data: []byte(`{"times": 1}`)})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "fail"}, PartitionID: "p", Status: Available, Data: []byte(`{"fail": true}`), MaxRetries: new(int)})
+	start := time.Now()
+	events := runForEvents(t, r, &Watcher{Processor: &testProcessor{}, Repo: r, OwnerID: "pod-a", PollInterval: 10 * time.Millisecond, AutoClose: true})
+
+	for _, id := range []string{"ok", "fail"} {
+		i, err := r.GetItem(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i.LastOwner != "pod-a" || i.LastProcessedAt == nil || i.LastProcessedAt.Before(start) {
+			t.Errorf("expected item %s to record its last attempt, got %q at %v", id, i.LastOwner, i.LastProcessedAt)
+		}
+	}
+	for _, e := range events {
+		if e.ItemID != "" && e.Owner != "pod-a" {
+			t.Errorf("expected the item events to carry the owner, got %+v", e)
+		}
+	}
+	items, _, err := r.ListItems(ctx, ItemFilter{LastOwner: "pod-a", ProcessedSince: start}, PageRequest{})
+	if err != nil || len(items) != 2 {
+		t.Errorf("expected both items processed by pod-a, got %d %v", len(items), err)
+	}
+	if items, _, _ = r.ListItems(ctx, ItemFilter{LastOwner: "pod-b"}, PageRequest{}); len(items) != 0 {
+		t.Errorf("expected no items processed by pod-b, got %d", len(items))
+	}
+
+	// A watcher losing a save conflict doesn't overwrite the attempt that won it.
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "raced"}, PartitionID: "p", Status: Available, Data: []byte(`{}`)})
+	winner, _ := r.GetItem(ctx, "raced")
+	loser, _ := r.GetItem(ctx, "raced")
+	now := time.Now()
+	winner.LastOwner, winner.LastProcessedAt, winner.Status = "pod-a", &now, Complete
+	if !r.Save(ctx, winner) {
+		t.Fatal("error saving item")
+	}
+	later := now.Add(time.Second)
+	loser.LastOwner, loser.LastProcessedAt, loser.Status = "pod-b", &later, Failed
+	if r.Save(ctx, loser) {
+		t.Fatal("expected the stale save to fail")
+	}
+	i, _ := r.GetItem(ctx, "raced")
+	if i.LastOwner != "pod-a" || !i.LastProcessedAt.Equal(now) || i.Status != Complete {
+		t.Errorf("expected the owner of the saved attempt, got %s at %s with %s", i.LastOwner, i.LastProcessedAt, i.Status)
+	}
+}
@@ -0,0 +1,55 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+)
+
+// MaxPanicStackSize is the most bytes of a panic's stack trace kept in its PanicError, and so
+// in the item's ErrorMessages. The full trace is logged.
+var MaxPanicStackSize = 1 << 10
+
+// PanicError is the error of an attempt whose processor panicked. It is retried by
+// DefaultRetryClassifier; a RetryClassifier can fail the item instead, e.g. when panics come
+// from malformed payloads.
+type PanicError struct {
+	// Value is the value the processor panicked with.
+	Value interface{}
+	// Stack is the goroutine's stack trace, truncated to MaxPanicStackSize.
+	Stack string
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("processor panicked: %v\n%s", e.Value, e.Stack)
+}
+
+// IsPanic returns whether the error, or one it wraps, is a PanicError.
+func IsPanic(err error) bool {
+	var pe *PanicError
+	return errors.As(err, &pe)
+}
+
+// recoverProcessor turns a panic of the processor into a PanicError. It must be deferred.
+func recoverProcessor(i *Item, err *error) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	stack := string(debug.Stack())
+	glog.Errorf("processor panicked on item %s in partition %s: %v\n%s", i.ID, i.PartitionID, v, stack)
+	if MaxPanicStackSize > 0 && len(stack) > MaxPanicStackSize {
+		stack = strings.ToValidUTF8(stack[:MaxPanicStackSize], "") + "..."
+	}
+	*err = &PanicError{Value: v, Stack: stack}
+}
+
+// panicked records an attempt whose processor panicked.
+func (w *Watcher) panicked(i *Item) {
+	atomic.AddInt64(&w.counters.panics, 1)
+	w.metrics().Counter(MetricProcessorPanics, 1, Labels{"partition": i.PartitionID, "gate": i.partition.plan.Name(i.Gate)})
+}
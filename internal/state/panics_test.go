@@ -0,0 +1,94 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// panickingProcessor panics on payloads asking it to, and completes the items otherwise.
+type panickingProcessor struct {
+	testProcessor
+}
+
+func (*panickingProcessor) Process(id string, b []byte) (*ProcessorResponse, error) {
+	if bytes.Contains(b, []byte(`"panic"`)) {
+		var m map[string]int
+		m["malformed"]++
+	}
+	return &ProcessorResponse{Complete: true, Data: b}, nil
+}
+
+func TestProcessorPanics(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		classifier  func(error) RetryDecision
+		timeout     time.Duration
+		wantRetries int
+	}{
+		{name: "retried", wantRetries: 2},
+		{name: "with timeout", timeout: time.Minute, wantRetries: 2},
+		{
+			name: "classified",
+			classifier: func(err error) RetryDecision {
+				if IsPanic(err) {
+					return Fail
+				}
+				return DefaultRetryClassifier(err)
+			},
+			wantRetries: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := openTestRepo(t)
+			ctx := context.Background()
+			r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}, MaxRetries: retries(1)})
+			for n := 0; n < 3; n++ {
+				r.Save(ctx, &Item{BaseModel: BaseModel{ID: fmt.Sprint(n)}, PartitionID: "p", Data: []byte(`{}`)})
+			}
+			// The failed item fails the partition, so it goes last.
+			r.Save(ctx, &Item{BaseModel: BaseModel{ID: "panic"}, PartitionID: "p", Data: []byte(`{"panic": true}`)})
+
+			m := &counterMetrics{counters: map[string]float64{}}
+			w := &Watcher{
+				Processor:         &panickingProcessor{},
+				Repo:              r,
+				BatchSize:         1,
+				PollInterval:      10 * time.Millisecond,
+				AutoClose:         true,
+				Metrics:           m,
+				RetryClassifier:   tc.classifier,
+				ProcessingTimeout: tc.timeout,
+			}
+			runForEvents(t, r, w)
+
+			items, _, err := r.ListItems(ctx, ItemFilter{}, PageRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, i := range items {
+				if i.ID != "panic" {
+					if i.Status != Complete {
+						t.Errorf("expected item %s to complete, got %s", i.ID, i.Status)
+					}
+					continue
+				}
+				if i.Status != Failed || i.RetryCount != tc.wantRetries {
+					t.Errorf("expected the panicking item to fail after %d attempts, got %s after %d", tc.wantRetries, i.Status, i.RetryCount)
+				}
+				if !strings.Contains(i.ErrorMessages, "processor panicked: assignment to entry in nil map") {
+					t.Errorf("expected the panic to be recorded, got %q", i.ErrorMessages)
+				}
+			}
+			if stats := w.Stats(); stats.Panics != int64(tc.wantRetries) {
+				t.Errorf("expected %d panics, got %+v", tc.wantRetries, stats)
+			}
+			if got := m.counters[MetricProcessorPanics]; got != float64(tc.wantRetries) {
+				t.Errorf("expected %d panics to be counted, got %v", tc.wantRetries, got)
+			}
+		})
+	}
+}
@@ -16,17 +16,100 @@ type Partition struct {
 	// Whether the partition is "enabled" represents if there is potential
 	// work to do, in the form of available Items.
 	Status Status `gorm:"default:1;not null"`
+	// StatusReason is why the watcher last changed the partition's status: a summary of the
+	// errors of its failed items once Failed, or of its items and duration once Complete. It
+	// is cleared when the partition is made Available again, and at most
+	// MaxStatusReasonLength bytes.
+	StatusReason string `gorm:"size:1024;not null;default:''"`
 	// If leased, the current Owner
 	Owner string `gorm:"not null;default=''"`
 	// The time until the lease is active.
 	Until time.Time `gorm:"not null"`
+	// Tenant owns the partition and its items, see GormRepo.Tenant.
+	Tenant string `gorm:"not null;default:'';index"`
+	// Labels are matched against the Selector of watchers.
+	Labels PartitionLabels `gorm:"not null;default:'{}'"`
+	// Fence is incremented each time the partition changes owner, and is passed to
+	// processors as a fencing token, see ProcessRequest.
+	Fence int64 `gorm:"not null;default:0"`
+	// DependsOn is the ID of a partition that must be Complete before this one is leased.
+	DependsOn string `gorm:"not null;default:'';index"`
+	// GatePlan, if set, names the partition's gates. Items can't move past the end of the
+	// plan, nor skip gates beyond the watcher's MaxGateSkip.
+	GatePlan GatePlan `gorm:"not null;default:'[]'"`
+	// MaxGate, if set, is the partition's last gate. Its gate never advances past it, items
+	// can't be moved past it, and items created past it are never processed. The partition
+	// completes once every item at or before it is done, with or without AutoClose.
+	MaxGate int `gorm:"not null;default:0"`
+	// MaxRetries, if set, overrides the package's MaxRetries for the partition's items, unless
+	// they set their own. -1 retries indefinitely.
+	MaxRetries *int
+	// FailureTolerance, if set, overrides the watcher's FailureTolerance for the partition:
+	// the fraction of its items, from 0 to 1, which may fail without failing it.
+	FailureTolerance *float64
+	// MaxPendingItems, if set, caps the partition's Available items: CreateItems fails with
+	// an ErrQuotaExceeded rather than go past it.
+	MaxPendingItems *int
+	// ActivateAt, if set, is when the partition may first be leased, e.g. the occurrence of a
+	// Scheduler's schedule it was created for.
+	ActivateAt *time.Time
+	// LeaseableAfter, if set, is when the partition may be leased again, after a watcher found
+	// nothing to do in it. It is cleared when items are created or remediated in it.
+	LeaseableAfter *time.Time
+	// LeasedAt is when the partition was last leased, nil if it never was. It is kept when the
+	// lease is released, see LeaseState.
+	LeasedAt *time.Time
+	// MaxPartitionRetries, if set, is how many times the partition is retried automatically
+	// once Failed, PartitionRetryCooldown after it failed, by watchers with a
+	// PartitionRetrySweepInterval, see RetryFailedPartitions. PartitionRetryCount is the
+	// number of retries so far, and RetryAt when the next one is due, if any.
+	MaxPartitionRetries    int           `gorm:"not null;default:0"`
+	PartitionRetryCooldown time.Duration `gorm:"not null;default:0"`
+	PartitionRetryCount    int           `gorm:"not null;default:0"`
+	RetryAt                *time.Time    `gorm:"index"`
+	// MaxConcurrency, if set, is the most items of the partition processed at once: a watcher
+	// never has more of them in flight, whatever its BatchSize, and in ItemLeaseMode, no more
+	// of them are claimed at once across watchers. ClaimedCount is the number of its items
+	// claimed in ItemLeaseMode, as counted by the last claim of its items, see ClaimItems.
+	MaxConcurrency int `gorm:"not null;default:0"`
+	ClaimedCount   int `gorm:"not null;default:0"`
 }
 
-// Expired returns true/false if the partition's lease is expired.
-func (p *Partition) Expired() bool {
-	return p.Until.Before(time.Now())
+// partitionConfig is the configuration of a partition that applies to processing its items.
+type partitionConfig struct {
+	plan       GatePlan
+	maxGate    int
+	maxRetries *int
+	labels     PartitionLabels
+	// maxConcurrency is the partition's MaxConcurrency.
+	maxConcurrency int
 }
 
-func (p *Partition) InActive() bool {
-	return p.Status == Complete || p.Expired()
+// failureTolerance returns the partition's FailureTolerance, or the fallback if unset.
+func (p *Partition) failureTolerance(fallback float64) float64 {
+	if p.FailureTolerance != nil {
+		return *p.FailureTolerance
+	}
+	return fallback
+}
+
+func (p *Partition) config() partitionConfig {
+	return partitionConfig{plan: p.GatePlan, maxGate: p.MaxGate, maxRetries: p.MaxRetries, labels: p.Labels, maxConcurrency: p.MaxConcurrency}
+}
+
+// Expired returns whether the partition's lease is expired at now, e.g. the time of the
+// watcher's or repo's Clock. The lease's Until is compared with now at TimestampPrecision, so
+// that a lease read back with less precision than it was written with doesn't expire early.
+func (p *Partition) Expired(now time.Time) bool {
+	return beforeAtPrecision(p.Until, now)
+}
+
+// Scheduled returns true if the partition's ActivateAt is yet to come at now.
+func (p *Partition) Scheduled(now time.Time) bool {
+	return p.ActivateAt != nil && p.ActivateAt.After(now)
+}
+
+// InActive returns whether the partition is complete, or its lease is expired, at now.
+func (p *Partition) InActive(now time.Time) bool {
+	return p.Status == Complete || p.Expired(now)
 }
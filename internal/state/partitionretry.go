@@ -0,0 +1,108 @@
+package state
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+	"github.com/golang/glog"
+	"gorm.io/gorm"
+)
+
+// retriesLeft returns whether the failed partition is retried automatically, see
+// MaxPartitionRetries.
+func (p *Partition) retriesLeft() bool {
+	return p.PartitionRetryCount < p.MaxPartitionRetries
+}
+
+// retriesExhausted returns whether the partition was retried automatically as many times as
+// it may be, and is left Failed for an operator.
+func (p *Partition) retriesExhausted() bool {
+	return p.MaxPartitionRetries > 0 && !p.retriesLeft()
+}
+
+// partitionRetryAt returns the RetryAt of the partition as the watcher changes its status to
+// p.Status at now: after its PartitionRetryCooldown if it failed with retries left, and none
+// otherwise.
+func partitionRetryAt(p *Partition, now time.Time) *time.Time {
+	if p.Status != Failed || !p.retriesLeft() {
+		return nil
+	}
+	at := now.Add(p.PartitionRetryCooldown)
+	return &at
+}
+
+// RetryFailedPartitions retries the Failed partitions whose RetryAt has passed, as
+// RetryFailedItems and ReopenPartition would, resetting the RetryCount of their Available and
+// Failed items and incrementing their PartitionRetryCount, and returns the partitions retried.
+// Partitions saved concurrently, e.g. by an operator, are skipped.
+func (db *GormRepo) RetryFailedPartitions(ctx context.Context) ([]*Partition, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	now := clock.Or(db.Clock).Now()
+	var due []*Partition
+	if err := db.scoped(db.WithContext(ctx)).Where("status = ? AND retry_at <= ? AND partition_retry_count < max_partition_retries", Failed, now).
+		Find(&due).Error; err != nil {
+		return nil, err
+	}
+	var retried []*Partition
+	for _, p := range due {
+		ok := false
+		err := db.Transaction(ctx, func(tx *GormRepo) error {
+			// The partition is written first, so that SQLite takes the write lock up front.
+			res := tx.WithContext(ctx).Model(&Partition{}).Where("id = ? AND version = ?", p.ID, p.Version).Updates(map[string]interface{}{
+				"status":                Available,
+				"status_reason":         "",
+				"retry_at":              nil,
+				"partition_retry_count": gorm.Expr("partition_retry_count + 1"),
+				"owner":                 "",
+				"until":                 now,
+				"leaseable_after":       nil,
+				"version":               gorm.Expr("version + 1"),
+				"updated_at":            now,
+			})
+			if res.Error != nil || res.RowsAffected == 0 {
+				return res.Error
+			}
+			ok = true
+			return tx.WithContext(ctx).Model(&Item{}).Where("partition_id = ? AND status IN ?", p.ID, []Status{Available, Failed}).
+				Updates(map[string]interface{}{
+					"status":      Available,
+					"retry_count": 0,
+					"version":     gorm.Expr("version + 1"),
+					"updated_at":  now,
+				}).Error
+		})
+		if err != nil {
+			return retried, err
+		}
+		if ok {
+			p.Status, p.StatusReason, p.RetryAt = Available, "", nil
+			p.PartitionRetryCount++
+			p.Version++
+			retried = append(retried, p)
+		}
+	}
+	return retried, nil
+}
+
+// sweepFailedPartitions retries the failed partitions whose cooldown passed, if
+// PartitionRetrySweepInterval has passed since the last sweep, returning the time of the last
+// sweep.
+func (w *Watcher) sweepFailedPartitions(ctx context.Context, last time.Time) time.Time {
+	if w.PartitionRetrySweepInterval <= 0 || w.Clock.Since(last) < w.PartitionRetrySweepInterval {
+		return last
+	}
+	retried, err := w.Repo.RetryFailedPartitions(ctx)
+	if err != nil && ctx.Err() == nil {
+		glog.Errorf("error retrying failed partitions: %s", err)
+	}
+	for _, p := range retried {
+		glog.Warningf("retrying failed partition %s, retry %d of %d", p.ID, p.PartitionRetryCount, p.MaxPartitionRetries)
+		atomic.AddInt64(&w.counters.partitionRetries, 1)
+		w.metrics().Counter(MetricPartitionRetries, 1, Labels{"partition": p.ID})
+		w.emit(Event{Type: PartitionRetried, PartitionID: p.ID, Count: p.PartitionRetryCount})
+	}
+	return w.Clock.Now()
+}
@@ -0,0 +1,147 @@
+package state_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state/statetest"
+)
+
+const retryCooldown = 30 * time.Minute
+
+// retryingRepo returns a repo whose partition is retried twice, retryCooldown after failing,
+// with item a failing without retries.
+func retryingRepo(t *testing.T, sim *statetest.Simulator) *state.GormRepo {
+	t.Helper()
+	r := simRepo(t, sim, "a", "b")
+	if err := r.Model(&state.Partition{}).Where("id = ?", "p").Updates(map[string]interface{}{
+		"max_partition_retries":    2,
+		"partition_retry_cooldown": retryCooldown,
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// retryDue returns the partition once failed, checking that its retry is due after the cooldown.
+func retryDue(t *testing.T, r *state.GormRepo, failedBy time.Time) *state.Partition {
+	t.Helper()
+	p, err := r.GetPartition(context.Background(), "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != state.Failed || p.RetryAt == nil || p.RetryAt.After(failedBy.Add(retryCooldown)) {
+		t.Fatalf("expected the partition to fail by %s with a retry due after the cooldown, got %s with retry at %v", failedBy, p.Status, p.RetryAt)
+	}
+	return p
+}
+
+func retryFailed(t *testing.T, r *state.GormRepo) []*state.Partition {
+	t.Helper()
+	retried, err := r.RetryFailedPartitions(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return retried
+}
+
+func TestPartitionAutoRetry(t *testing.T) {
+	ctx := context.Background()
+	sim := statetest.NewSimulator(1, simStart)
+	r := retryingRepo(t, sim)
+	w := simWatcher(r, "w")
+	w.Processor = &failingProcessor{fail: map[string]bool{"a": true}}
+	events := w.Events()
+	sim.Add(w)
+
+	for retry := 1; retry <= 2; retry++ {
+		sim.Run(ctx, 5*time.Second)
+		p := retryDue(t, r, sim.Clock.Now())
+
+		// The partition isn't retried before its cooldown passes. The watcher has nothing to do
+		// meanwhile, so the clock skips its idle lease scans.
+		sim.Clock.Advance(p.RetryAt.Sub(sim.Clock.Now()) - time.Second)
+		if retried := retryFailed(t, r); len(retried) != 0 {
+			t.Fatalf("expected no retry within the cooldown, got %d", len(retried))
+		}
+		sim.Run(ctx, time.Second)
+		retried := retryFailed(t, r)
+		if len(retried) != 1 || retried[0].PartitionRetryCount != retry {
+			t.Fatalf("expected retry %d of the partition, got %+v", retry, retried)
+		}
+		p, err := r.GetPartition(ctx, "p")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Status != state.Available || p.PartitionRetryCount != retry || p.RetryAt != nil || p.StatusReason != "" {
+			t.Errorf("expected the partition to be available again, got %s after %d retries, retry at %v, reason %q", p.Status, p.PartitionRetryCount, p.RetryAt, p.StatusReason)
+		}
+		a, err := r.GetItem(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Status != state.Available || a.RetryCount != 0 {
+			t.Errorf("expected the failed item to be retried afresh, got %s after %d retries", a.Status, a.RetryCount)
+		}
+	}
+
+	// Out of retries, the partition is left failed.
+	sim.Run(ctx, 5*time.Second)
+	p, err := r.GetPartition(ctx, "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != state.Failed || p.RetryAt != nil || p.PartitionRetryCount != 2 {
+		t.Fatalf("expected the partition to stay failed after 2 retries, got %s after %d retries, retry at %v", p.Status, p.PartitionRetryCount, p.RetryAt)
+	}
+	sim.Clock.Advance(2 * retryCooldown)
+	if retried := retryFailed(t, r); len(retried) != 0 {
+		t.Errorf("expected no retry past MaxPartitionRetries, got %d", len(retried))
+	}
+
+	exhausted := 0
+	for len(events) > 0 {
+		if e := <-events; e.Type == state.PartitionRetriesExhausted {
+			exhausted++
+			if e.Count != 2 {
+				t.Errorf("expected the event to carry the 2 retries, got %d", e.Count)
+			}
+		}
+	}
+	if exhausted != 1 {
+		t.Errorf("expected one PartitionRetriesExhausted event, got %d", exhausted)
+	}
+}
+
+func TestPartitionAutoRetrySucceeds(t *testing.T) {
+	ctx := context.Background()
+	sim := statetest.NewSimulator(1, simStart)
+	r := retryingRepo(t, sim)
+	w := simWatcher(r, "w")
+	proc := &failingProcessor{fail: map[string]bool{"a": true}}
+	w.Processor = proc
+	sim.Add(w)
+
+	sim.Run(ctx, 5*time.Second)
+	retryDue(t, r, sim.Clock.Now())
+	// The item's failure is resolved during the cooldown.
+	proc.fail["a"] = false
+	sim.Clock.Advance(retryCooldown)
+	if retried := retryFailed(t, r); len(retried) != 1 {
+		t.Fatalf("expected the partition to be retried, got %d", len(retried))
+	}
+	sim.Run(ctx, 5*time.Second)
+	p, err := r.GetPartition(ctx, "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != state.Complete || p.PartitionRetryCount != 1 || p.RetryAt != nil {
+		t.Fatalf("expected the partition to complete at its first retry, got %s after %d retries, retry at %v", p.Status, p.PartitionRetryCount, p.RetryAt)
+	}
+	sim.Clock.Advance(2 * retryCooldown)
+	if retried := retryFailed(t, r); len(retried) != 0 {
+		t.Errorf("expected no retry of the completed partition, got %d", len(retried))
+	}
+}
@@ -0,0 +1,101 @@
+package state
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrPoolSaturated is reported by Healthcheck while every connection the repo may open is in
+// use, so that queries wait for one.
+var ErrPoolSaturated = errors.New("connection pool saturated")
+
+// RepoOption configures a GormRepo made by NewGormRepo.
+type RepoOption func(r *GormRepo, pool *sql.DB)
+
+// WithMaxOpenConns limits the connections the repo opens to the database, in use or idle. By
+// default it is unlimited, which a fleet of watchers can use to exhaust the server's.
+func WithMaxOpenConns(n int) RepoOption {
+	return func(_ *GormRepo, pool *sql.DB) { pool.SetMaxOpenConns(n) }
+}
+
+// WithMaxIdleConns sets the number of idle connections the repo keeps open for reuse.
+func WithMaxIdleConns(n int) RepoOption {
+	return func(_ *GormRepo, pool *sql.DB) { pool.SetMaxIdleConns(n) }
+}
+
+// WithConnMaxLifetime closes connections once they have been open for d, e.g. so that they are
+// rebalanced after a failover.
+func WithConnMaxLifetime(d time.Duration) RepoOption {
+	return func(_ *GormRepo, pool *sql.DB) { pool.SetConnMaxLifetime(d) }
+}
+
+// WithStatementTimeout sets the repo's Timeout, after which each query's context is cancelled.
+// The drivers abort the statement in their dialect's way: SQL Server is sent an attention
+// signal, Postgres a cancel request, and SQLite is interrupted.
+func WithStatementTimeout(d time.Duration) RepoOption {
+	return func(r *GormRepo, _ *sql.DB) { r.Timeout = d }
+}
+
+// NewGormRepo returns a repo for the database, applying the options to its connection pool.
+// The other fields of the repo can be set on the result. The database is made to store and
+// return timestamps in UTC, whatever the time zone of the host.
+func NewGormRepo(db *gorm.DB, opts ...RepoOption) (*GormRepo, error) {
+	pool, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	if err := useUTC(db); err != nil {
+		return nil, err
+	}
+	r := &GormRepo{DB: db}
+	for _, opt := range opts {
+		opt(r, pool)
+	}
+	return r, nil
+}
+
+// PoolStats returns the statistics of the repo's connection pool.
+func (db *GormRepo) PoolStats() (sql.DBStats, error) {
+	pool, err := db.DB.DB()
+	if err != nil {
+		return sql.DBStats{}, err
+	}
+	return pool.Stats(), nil
+}
+
+// checkPool returns ErrPoolSaturated if every connection the pool may open is in use.
+func checkPool(stats sql.DBStats) error {
+	if stats.MaxOpenConnections > 0 && stats.InUse >= stats.MaxOpenConnections {
+		return fmt.Errorf("%w: %d of %d connections in use, %d waits for a connection so far", ErrPoolSaturated, stats.InUse, stats.MaxOpenConnections, stats.WaitCount)
+	}
+	return nil
+}
+
+// poolStatter is implemented by repos that report the statistics of their connection pool.
+type poolStatter interface {
+	PoolStats() (sql.DBStats, error)
+}
+
+// reportPoolStats publishes the statistics of the repo's connection pool to the watcher's
+// Metrics, if the repo reports them.
+func (w *Watcher) reportPoolStats() {
+	p, ok := w.Repo.(poolStatter)
+	if !ok {
+		return
+	}
+	stats, err := p.PoolStats()
+	if err != nil {
+		return
+	}
+	m := w.metrics()
+	m.Gauge(MetricPoolOpenConnections, float64(stats.OpenConnections), nil)
+	m.Gauge(MetricPoolInUseConnections, float64(stats.InUse), nil)
+	m.Gauge(MetricPoolIdleConnections, float64(stats.Idle), nil)
+	m.Gauge(MetricPoolMaxOpenConnections, float64(stats.MaxOpenConnections), nil)
+	m.Gauge(MetricPoolWaitCount, float64(stats.WaitCount), nil)
+	m.Gauge(MetricPoolWaitDuration, stats.WaitDuration.Seconds(), nil)
+}
@@ -0,0 +1,61 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type gaugeMetrics struct {
+	nopMetrics
+	mu     sync.Mutex
+	gauges map[string]float64
+}
+
+func (m *gaugeMetrics) Gauge(name string, value float64, labels Labels) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges[name] = value
+}
+
+func TestNewGormRepo(t *testing.T) {
+	r, err := NewGormRepo(openTestRepo(t).DB, WithMaxOpenConns(2), WithMaxIdleConns(1), WithConnMaxLifetime(time.Minute), WithStatementTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Timeout != time.Second {
+		t.Errorf("expected a statement timeout of 1s, got %s", r.Timeout)
+	}
+	stats, err := r.PoolStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.MaxOpenConnections != 2 {
+		t.Errorf("expected at most 2 open connections, got %d", stats.MaxOpenConnections)
+	}
+
+	ctx := context.Background()
+	if err := r.Healthcheck(ctx); err != nil {
+		t.Fatal(err)
+	}
+	pool, _ := r.DB.DB()
+	for n := 0; n < 2; n++ {
+		conn, err := pool.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	if err := r.Healthcheck(ctx); !errors.Is(err, ErrPoolSaturated) {
+		t.Errorf("expected the pool to be saturated, got %v", err)
+	}
+
+	m := &gaugeMetrics{gauges: map[string]float64{}}
+	w := &Watcher{Repo: r, Metrics: m}
+	w.reportPoolStats()
+	if m.gauges[MetricPoolInUseConnections] != 2 || m.gauges[MetricPoolMaxOpenConnections] != 2 {
+		t.Errorf("expected the pool stats to be reported, got %v", m.gauges)
+	}
+}
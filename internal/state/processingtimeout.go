@@ -0,0 +1,216 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+	"github.com/golang/glog"
+)
+
+// ErrProcessingTimeout fails the attempts abandoned after the watcher's ProcessingTimeout, and
+// those of items reclaimed after they were stuck in processing, see ReclaimStuckItems. It is
+// retryable.
+var ErrProcessingTimeout = errors.New("processing timed out")
+
+// processWithTimeout calls the processor, abandoning the call after the watcher's
+// processingTimeout. The processor's context is cancelled then, but a Processor that doesn't
+// take one keeps running in the background until it returns.
+func (w *Watcher) processWithTimeout(ctx context.Context, i *Item) (*ProcessorResponse, error) {
+	timeout := w.processingTimeout()
+	if timeout <= 0 {
+		return w.process(ctx, i)
+	}
+	callCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	type result struct {
+		resp *ProcessorResponse
+		err  error
+	}
+	done := make(chan result, 1)
+	// An abandoned call may outlive the attempt, which goes on to change the item.
+	c := *i
+	go func() {
+		resp, err := w.process(callCtx, &c)
+		done <- result{resp, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil && ctx.Err() == nil && errors.Is(callCtx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%w after %s: %s", ErrProcessingTimeout, timeout, r.err)
+		}
+		return r.resp, r.err
+	case <-callCtx.Done():
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%w after %s", ErrProcessingTimeout, timeout)
+	}
+}
+
+// startProcessing records when the item's processing started, if the watcher has a
+// processingTimeout, so that it can be reclaimed should the watcher stop before saving the
+// attempt. It returns false if the item could not be saved, e.g. as the partition changed
+// owner.
+func (w *Watcher) startProcessing(ctx context.Context, i *Item) bool {
+	if w.processingTimeout() <= 0 {
+		return true
+	}
+	now := w.Clock.Now()
+	i.ProcessingStartedAt = &now
+	ctx, cancel := w.saveContext(ctx)
+	defer cancel()
+	if !w.Repo.Save(ctx, i) {
+		i.ProcessingStartedAt = nil
+		return false
+	}
+	return true
+}
+
+// stopProcessing clears the item's ProcessingStartedAt for an attempt that is abandoned
+// without saving its result, so that the item isn't reclaimed meanwhile.
+func (w *Watcher) stopProcessing(ctx context.Context, i *Item) {
+	if i.ProcessingStartedAt == nil {
+		return
+	}
+	i.ProcessingStartedAt = nil
+	if ctx.Err() != nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := w.saveContext(ctx)
+	defer cancel()
+	if w.Repo.Save(ctx, i) {
+		w.recordSave(i)
+	} else {
+		glog.Warningf("error clearing the processing start of item %s in partition %s", i.ID, i.PartitionID)
+	}
+}
+
+// timeout records an attempt abandoned after the watcher's processingTimeout.
+func (w *Watcher) timeout(i *Item) {
+	atomic.AddInt64(&w.counters.processingTimeouts, 1)
+	w.metrics().Counter(MetricProcessingTimeouts, 1, Labels{"partition": i.PartitionID, "gate": i.partition.plan.Name(i.Gate)})
+}
+
+// ReclaimStuckItems makes the Available items of every partition whose processing started
+// more than olderThan ago available again, e.g. after their watcher crashed mid attempt, and
+// returns the number of items reclaimed. The attempt counts against the item's retries as an
+// ErrProcessingTimeout, failing the item once they are exhausted. Items saved concurrently,
+// e.g. by a watcher, are skipped.
+func (db *GormRepo) ReclaimStuckItems(ctx context.Context, olderThan time.Duration) (int, error) {
+	reclaimed := 0
+	after := ""
+	now := clock.Or(db.Clock).Now()
+	cutoff := now.Add(-olderThan)
+	err := fmt.Errorf("%w: stuck in processing for over %s", ErrProcessingTimeout, olderThan)
+	partitions := map[string]partitionConfig{}
+	for {
+		items, lerr := db.stuckItems(ctx, cutoff, after)
+		if lerr != nil || len(items) == 0 {
+			return reclaimed, lerr
+		}
+		for _, i := range items {
+			config, ok := partitions[i.PartitionID]
+			if !ok {
+				p, perr := db.GetPartition(ctx, i.PartitionID)
+				if perr != nil {
+					return reclaimed, perr
+				}
+				config = p.config()
+				partitions[i.PartitionID] = config
+			}
+			i.partition = config
+			d := Retry
+			max, set := i.maxRetries()
+			if !set {
+				max = MaxRetries
+			}
+			if !retriesLeft(i.RetryCount+1, max) {
+				d = Fail
+			}
+			i.ProcessingStartedAt = nil
+			i.error(err, d, now)
+			if db.SaveWithOutbox(ctx, i, itemOutboxEvents(i, err)...) {
+				reclaimed++
+			}
+		}
+		after = items[len(items)-1].ID
+	}
+}
+
+// stuckItems returns a page of the Available items whose processing started before cutoff,
+// ordered by ID from after.
+func (db *GormRepo) stuckItems(ctx context.Context, cutoff time.Time, after string) (items []*Item, err error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	if err := db.scoped(db.WithContext(ctx)).Where("status = ? AND processing_started_at < ? AND id > ?", Available, cutoff, after).Order(
+		"id").Limit(DefaultPageSize).Find(&items).Error; err != nil {
+		return nil, err
+	}
+	return items, db.load(ctx, items...)
+}
+
+// CountStuckItems returns the number of Available items of each partition whose processing
+// started more than olderThan ago, as reclaimed by ReclaimStuckItems.
+func (db *GormRepo) CountStuckItems(ctx context.Context, olderThan time.Duration) (map[string]int, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	rows, err := db.scoped(db.reader(ctx).WithContext(ctx)).Model(&Item{}).Select("partition_id, COUNT(*)").Where(
+		"status = ? AND processing_started_at < ?", Available, clock.Or(db.Clock).Now().Add(-olderThan)).Group("partition_id").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[string]int{}
+	for rows.Next() {
+		var (
+			partitionID string
+			count       int
+		)
+		if err := rows.Scan(&partitionID, &count); err != nil {
+			return nil, err
+		}
+		counts[partitionID] = count
+	}
+	return counts, rows.Err()
+}
+
+// stuckItemThreshold returns the watcher's StuckItemThreshold, defaulting to twice its
+// processingTimeout.
+func (w *Watcher) stuckItemThreshold() time.Duration {
+	if w.StuckItemThreshold > 0 {
+		return w.StuckItemThreshold
+	}
+	return 2 * w.processingTimeout()
+}
+
+// processingTimeout returns the shorter of the watcher's ProcessingTimeout and
+// MaxProcessingTime that are set, or 0 if neither is.
+func (w *Watcher) processingTimeout() time.Duration {
+	if w.ProcessingTimeout > 0 && (w.MaxProcessingTime <= 0 || w.ProcessingTimeout < w.MaxProcessingTime) {
+		return w.ProcessingTimeout
+	}
+	return w.MaxProcessingTime
+}
+
+// sweepStuckItems reclaims the stuck items of every partition, if StuckSweepInterval has
+// passed since the last sweep, returning the time of the last sweep.
+func (w *Watcher) sweepStuckItems(ctx context.Context, last time.Time) time.Time {
+	threshold := w.stuckItemThreshold()
+	if w.StuckSweepInterval <= 0 || threshold <= 0 || w.Clock.Since(last) < w.StuckSweepInterval {
+		return last
+	}
+	n, err := w.Repo.ReclaimStuckItems(ctx, threshold)
+	if err != nil && ctx.Err() == nil {
+		glog.Errorf("error reclaiming stuck items: %s", err)
+	}
+	if n > 0 {
+		glog.Warningf("reclaimed %d items stuck in processing", n)
+		atomic.AddInt64(&w.counters.processingTimeouts, int64(n))
+		w.metrics().Counter(MetricProcessingTimeouts, float64(n), nil)
+	}
+	return w.Clock.Now()
+}
@@ -0,0 +1,145 @@
+package state
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hangingProcessor hangs on its first call until released, ignoring its context, and completes
+// the items otherwise, recording whether their processing start was saved.
+type hangingProcessor struct {
+	testProcessor
+	repo    *GormRepo
+	release chan struct{}
+	mu      sync.Mutex
+	calls   int
+	started bool
+}
+
+func (p *hangingProcessor) Process(id string, b []byte) (*ProcessorResponse, error) {
+	p.mu.Lock()
+	p.calls++
+	first := p.calls == 1
+	p.mu.Unlock()
+	if first {
+		<-p.release
+		return &ProcessorResponse{Complete: true, Data: b}, nil
+	}
+	i, err := p.repo.GetItem(context.Background(), id)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	p.started = i.ProcessingStartedAt != nil
+	p.mu.Unlock()
+	return &ProcessorResponse{Complete: true, Data: b}, nil
+}
+
+func TestProcessingTimeout(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Data: []byte(`{}`)})
+
+	proc := &hangingProcessor{repo: r, release: make(chan struct{})}
+	defer close(proc.release)
+	m := &counterMetrics{counters: map[string]float64{}}
+	w := &Watcher{Processor: proc, Repo: r, BatchSize: 1, PollInterval: 10 * time.Millisecond, AutoClose: true, Metrics: m, ProcessingTimeout: 50 * time.Millisecond}
+	events := runForEvents(t, r, w)
+
+	if events[len(events)-1].Type != PartitionCompleted {
+		t.Fatalf("expected the partition to complete, got events %v", eventTypes(events))
+	}
+	i, err := r.GetItem(ctx, "i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.RetryCount != 1 || !strings.Contains(i.ErrorMessages, ErrProcessingTimeout.Error()) {
+		t.Errorf("expected the timeout to count as a retry, got %d retries with errors %q", i.RetryCount, i.ErrorMessages)
+	}
+	if i.ProcessingStartedAt != nil {
+		t.Errorf("expected the processing start to be cleared, got %s", i.ProcessingStartedAt)
+	}
+	proc.mu.Lock()
+	if !proc.started {
+		t.Error("expected the processing start to be saved before processing")
+	}
+	proc.mu.Unlock()
+	if stats := w.Stats(); stats.ProcessingTimeouts != 1 || stats.ItemErrors != 0 {
+		t.Errorf("expected a timeout rather than an error, got %+v", stats)
+	}
+	if got := m.counters[MetricProcessingTimeouts]; got != 1 {
+		t.Errorf("expected a timeout to be counted, got %v", got)
+	}
+}
+
+func TestMaxProcessingTime(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Data: []byte(`{}`)})
+
+	proc := &hangingProcessor{repo: r, release: make(chan struct{})}
+	defer close(proc.release)
+	w := &Watcher{Processor: proc, Repo: r, BatchSize: 1, PollInterval: 10 * time.Millisecond, AutoClose: true,
+		ItemLeaseMode: true, VisibilityTimeout: 20 * time.Millisecond, MaxProcessingTime: 100 * time.Millisecond}
+	events := runForEvents(t, r, w)
+
+	if events[len(events)-1].Type != PartitionCompleted {
+		t.Fatalf("expected the partition to complete, got events %v", eventTypes(events))
+	}
+	i, err := r.GetItem(ctx, "i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.RetryCount != 1 || !strings.Contains(i.ErrorMessages, ErrProcessingTimeout.Error()) {
+		t.Errorf("expected the attempt to time out despite its claim being extended, got %d retries with errors %q", i.RetryCount, i.ErrorMessages)
+	}
+	if g, ok := w.Repo.(*GormRepo); !ok || g.MaxProcessingTime != w.MaxProcessingTime || r.MaxProcessingTime != 0 {
+		t.Errorf("expected a copy of the repo to be given the MaxProcessingTime")
+	}
+	if stats := w.Stats(); stats.ProcessingTimeouts != 1 {
+		t.Errorf("expected a timeout, got %+v", stats)
+	}
+}
+
+func TestReclaimStuckItems(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	stuck, recent := time.Now().Add(-time.Hour), time.Now()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "no retries"}, MaxRetries: retries(0)})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "stuck"}, PartitionID: "p", Data: []byte(`{}`), ProcessingStartedAt: &stuck})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "recent"}, PartitionID: "p", Data: []byte(`{}`), ProcessingStartedAt: &recent})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "idle"}, PartitionID: "p", Data: []byte(`{}`)})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "exhausted"}, PartitionID: "no retries", Data: []byte(`{}`), ProcessingStartedAt: &stuck})
+
+	n, err := r.ReclaimStuckItems(ctx, 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 items to be reclaimed, got %d", n)
+	}
+	for id, want := range map[string]struct {
+		status  Status
+		retries int
+		started bool
+	}{
+		"stuck":     {Available, 1, false},
+		"recent":    {Available, 0, true},
+		"idle":      {Available, 0, false},
+		"exhausted": {Failed, 1, false},
+	} {
+		i, err := r.GetItem(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i.Status != want.status || i.RetryCount != want.retries || (i.ProcessingStartedAt != nil) != want.started {
+			t.Errorf("expected item %s to be %s after %d retries, got %s after %d, started at %v", id, want.status, want.retries, i.Status, i.RetryCount, i.ProcessingStartedAt)
+		}
+	}
+}
@@ -12,6 +12,12 @@ type Processor interface {
 	Healthcheck(ctx context.Context) error
 }
 
+// ContextProcessor is optionally implemented by processors that want the watcher's context,
+// which is cancelled on shutdown. The watcher then calls ProcessContext instead of Process.
+type ContextProcessor interface {
+	ProcessContext(ctx context.Context, id string, b []byte) (*ProcessorResponse, error)
+}
+
 type nonRetryableError struct {
 	Err error
 	msg string
@@ -25,13 +31,52 @@ func (n *nonRetryableError) Error() string {
 	return n.msg
 }
 
+func (n *nonRetryableError) Unwrap() error {
+	return n.Err
+}
+
 func IsRetryable(e error) bool {
 	var t *nonRetryableError
 	return !errors.As(e, &t)
 }
 
+// ThrottledError is returned by processors whose target asked them to slow down, e.g. with an
+// HTTP 429. The watcher leaves the item to be fetched again, without counting the attempt
+// against its retries, and slows down polling its partition, see Watcher.MaxThrottleFactor.
+type ThrottledError struct {
+	Message string
+}
+
+func (e *ThrottledError) Error() string {
+	return "throttled: " + e.Message
+}
+
+// IsThrottled returns whether the error is, or wraps, a ThrottledError.
+func IsThrottled(e error) bool {
+	var t *ThrottledError
+	return errors.As(e, &t)
+}
+
 type ProcessorResponse struct {
+	// NextGate is the gate to move the item to, from its current gate up to the watcher's
+	// MaxGateSkip gates ahead. Other gates fail the item.
 	NextGate int
 	Complete bool
 	Data     []byte
+	// Metadata, if not nil, replaces the item's metadata.
+	Metadata ItemMetadata
+	// NewItems are created in the same transaction as the item is saved, up to the watcher's
+	// MaxNewItems.
+	NewItems []NewItem
+}
+
+// NewItem is an item discovered while processing another, see ProcessorResponse.NewItems.
+type NewItem struct {
+	// PartitionID defaults to the partition of the item that produced it.
+	PartitionID string
+	// ID defaults to a random UUID.
+	ID       string
+	Gate     int
+	Data     []byte
+	Priority int
 }
@@ -0,0 +1,101 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+	"gorm.io/gorm"
+)
+
+// DefaultProgressRateWindow is the window of recent completions the rate of a partition's
+// progress is measured over.
+var DefaultProgressRateWindow = 10 * time.Minute
+
+// PartitionProgress is how far a partition has got through its items.
+type PartitionProgress struct {
+	// Total is the number of items in the partition, and the others the number of them with
+	// each status. Items without a status are counted as Available.
+	Total     int `json:"total"`
+	Complete  int `json:"complete"`
+	Failed    int `json:"failed"`
+	Available int `json:"available"`
+	Cancelled int `json:"cancelled"`
+	Gate      int `json:"gate"`
+	MaxGate   int `json:"max_gate,omitempty"`
+	// OldestAvailableAge is how long the longest waiting available item has waited since it
+	// was last saved.
+	OldestAvailableAge time.Duration `json:"oldest_available_age"`
+	// RecentRatePerMinute is the number of items completed per minute over the repo's
+	// ProgressRateWindow.
+	RecentRatePerMinute float64 `json:"recent_rate_per_minute"`
+	// ETA is a crude estimate of the time left to complete the available items at the recent
+	// rate, zero if nothing was completed recently.
+	ETA time.Duration `json:"eta,omitempty"`
+}
+
+func (db *GormRepo) progressRateWindow() time.Duration {
+	if db.ProgressRateWindow <= 0 {
+		return DefaultProgressRateWindow
+	}
+	return db.ProgressRateWindow
+}
+
+// GetPartitionProgress returns the progress of the partition, or an ErrNotFound. It reads the
+// counts by status, the oldest available item and the recent completions off the items'
+// progress index, so as to be cheap enough to poll.
+func (db *GormRepo) GetPartitionProgress(ctx context.Context, id string) (*PartitionProgress, error) {
+	p, err := db.GetPartition(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := db.GetCountByStatus(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	progress := &PartitionProgress{
+		Complete:  counts[Complete],
+		Failed:    counts[Failed],
+		Available: counts[Available] + counts[Unknown],
+		Cancelled: counts[Cancelled],
+		Gate:      p.Gate,
+		MaxGate:   p.MaxGate,
+	}
+	for _, n := range counts {
+		progress.Total += n
+	}
+
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	now := clock.Or(db.Clock).Now()
+	if progress.Available > 0 {
+		oldest := &Item{}
+		err := db.scoped(db.reader(ctx).WithContext(ctx)).Select("updated_at").Where(
+			"partition_id = ? AND status = ?", id, Available).Order("updated_at").Take(oldest).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		if err == nil {
+			progress.OldestAvailableAge = now.Sub(oldest.UpdatedAt)
+		}
+	}
+	if progress.Complete > 0 {
+		window := db.progressRateWindow()
+		var recent int64
+		if err := db.scoped(db.reader(ctx).WithContext(ctx)).Model(&Item{}).Where(
+			"partition_id = ? AND status = ? AND updated_at >= ?", id, Complete, now.Add(-window)).Count(&recent).Error; err != nil {
+			return nil, err
+		}
+		progress.RecentRatePerMinute = float64(recent) / window.Minutes()
+	}
+	if progress.RecentRatePerMinute > 0 {
+		progress.ETA = time.Duration(float64(progress.Available) / progress.RecentRatePerMinute * float64(time.Minute))
+	}
+	return progress, nil
+}
+
+// Progress returns the progress of the partition, see GormRepo.GetPartitionProgress.
+func (w *Watcher) Progress(ctx context.Context, partitionID string) (*PartitionProgress, error) {
+	return w.Repo.GetPartitionProgress(ctx, partitionID)
+}
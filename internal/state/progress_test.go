@@ -0,0 +1,53 @@
+package state
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGetPartitionProgress(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}, Gate: 1, MaxGate: 3})
+	for id, status := range map[string]Status{
+		"c1": Complete, "c2": Complete, "c_old": Complete, "f": Failed, "x": Cancelled,
+		"a1": Available, "a2": Available, "a_old": Available,
+	} {
+		r.Save(ctx, &Item{BaseModel: BaseModel{ID: id}, PartitionID: "p", Status: status, Data: []byte(`{}`)})
+	}
+	for _, id := range []string{"c_old", "a_old"} {
+		if err := r.DB.Model(&Item{}).Where("id = ?", id).UpdateColumn("updated_at", time.Now().Add(-time.Hour)).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := &Watcher{Repo: r}
+	progress, err := w.Progress(ctx, "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.Total != 8 || progress.Complete != 3 || progress.Failed != 1 || progress.Cancelled != 1 || progress.Available != 3 || progress.Gate != 1 || progress.MaxGate != 3 {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+	if progress.OldestAvailableAge < time.Hour || progress.OldestAvailableAge > time.Hour+time.Minute {
+		t.Errorf("expected the oldest available item to have waited an hour, got %s", progress.OldestAvailableAge)
+	}
+	// Two items were completed within the default window of 10 minutes.
+	if progress.RecentRatePerMinute != 0.2 || progress.ETA != 15*time.Minute {
+		t.Errorf("expected a rate of 0.2 items per minute and an ETA of 15m, got %v and %s", progress.RecentRatePerMinute, progress.ETA)
+	}
+
+	r.ProgressRateWindow = 2 * time.Hour
+	if progress, err = r.GetPartitionProgress(ctx, "p"); err != nil || progress.RecentRatePerMinute != 3.0/120 {
+		t.Errorf("expected the rate over the window, got %+v, %v", progress, err)
+	}
+
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "empty"}})
+	if progress, err = r.GetPartitionProgress(ctx, "empty"); err != nil || *progress != (PartitionProgress{}) {
+		t.Errorf("expected no progress, got %+v, %v", progress, err)
+	}
+	if _, err := r.GetPartitionProgress(ctx, "missing"); !IsNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrQuotaExceeded is returned by CreateItems when its items would take a partition or a
+// tenant past its MaxPendingItems. None of the items are created, and the producer should
+// back off until watchers have drained the pending items.
+type ErrQuotaExceeded struct {
+	// Kind is "partition" or "tenant".
+	Kind string
+	ID   string
+	// Limit is the MaxPendingItems, Pending the number of Available items before the insert,
+	// and Adding the number of items it would have added.
+	Limit   int
+	Pending int
+	Adding  int
+}
+
+func (e *ErrQuotaExceeded) Error() string {
+	return fmt.Sprintf("%s %s has %d of at most %d pending items, can't add %d", e.Kind, e.ID, e.Pending, e.Limit, e.Adding)
+}
+
+// IsQuotaExceeded returns true if err, or any error it wraps, is an ErrQuotaExceeded.
+func IsQuotaExceeded(err error) bool {
+	var t *ErrQuotaExceeded
+	return errors.As(err, &t)
+}
+
+// TenantQuota holds the limits of a tenant across its partitions.
+type TenantQuota struct {
+	Tenant string `gorm:"primaryKey"`
+	// MaxPendingItems, if set, caps the tenant's Available items.
+	MaxPendingItems *int
+	UpdatedAt       time.Time
+}
+
+// QuotaUsage is the number of Available items of a partition or tenant, and its limit.
+type QuotaUsage struct {
+	Pending         int
+	MaxPendingItems *int
+}
+
+// GetPartitionQuotaUsage returns the number of Available items of the partition, and its
+// MaxPendingItems.
+func (db *GormRepo) GetPartitionQuotaUsage(ctx context.Context, id string) (*QuotaUsage, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	p := &Partition{}
+	if err := db.scoped(db.WithContext(ctx)).Select("id", "max_pending_items").Take(p, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &ErrNotFound{Kind: "partition", ID: id}
+		}
+		return nil, err
+	}
+	pending, err := db.countPending(ctx, "partition_id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	return &QuotaUsage{Pending: pending, MaxPendingItems: p.MaxPendingItems}, nil
+}
+
+// GetTenantQuotaUsage returns the number of Available items of the tenant, and its
+// MaxPendingItems.
+func (db *GormRepo) GetTenantQuotaUsage(ctx context.Context, tenant string) (*QuotaUsage, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	if err := db.checkTenant(tenant); err != nil {
+		return nil, err
+	}
+	q := &TenantQuota{}
+	if err := db.WithContext(ctx).Where("tenant = ?", tenant).Limit(1).Find(q).Error; err != nil {
+		return nil, err
+	}
+	pending, err := db.countPending(ctx, "tenant = ?", tenant)
+	if err != nil {
+		return nil, err
+	}
+	return &QuotaUsage{Pending: pending, MaxPendingItems: q.MaxPendingItems}, nil
+}
+
+// SetPartitionMaxPendingItems sets the MaxPendingItems of the partition, or clears it if nil.
+// Items already pending beyond a lowered limit are kept.
+func (db *GormRepo) SetPartitionMaxPendingItems(ctx context.Context, id string, max *int) error {
+	if err := checkMaxPendingItems(max); err != nil {
+		return err
+	}
+	return db.setLimit(ctx, &Partition{}, "partition", id, "max_pending_items", max)
+}
+
+// SetTenantMaxPendingItems sets the MaxPendingItems of the tenant, or clears it if nil.
+// Items already pending beyond a lowered limit are kept.
+func (db *GormRepo) SetTenantMaxPendingItems(ctx context.Context, tenant string, max *int) error {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	if err := db.checkTenant(tenant); err != nil {
+		return err
+	}
+	if err := checkMaxPendingItems(max); err != nil {
+		return err
+	}
+	return db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "tenant"}},
+		DoUpdates: clause.AssignmentColumns([]string{"max_pending_items", "updated_at"}),
+	}).Create(&TenantQuota{Tenant: tenant, MaxPendingItems: max}).Error
+}
+
+// checkMaxPendingItems rejects a negative MaxPendingItems.
+func checkMaxPendingItems(max *int) error {
+	if max != nil && *max < 0 {
+		return &ErrValidation{Field: "max_pending_items", Reason: fmt.Sprintf("can't be negative, got %d", *max)}
+	}
+	return nil
+}
+
+// checkTenant checks that a repo scoped to a tenant isn't used for another's quota.
+func (db *GormRepo) checkTenant(tenant string) error {
+	if db.Tenant != "" && tenant != db.Tenant {
+		reason := fmt.Sprintf("can't access the quota of tenant %q from tenant %q", tenant, db.Tenant)
+		return &ErrValidation{Field: "tenant", Reason: reason, Err: ErrWrongTenant}
+	}
+	return nil
+}
+
+func (db *GormRepo) countPending(ctx context.Context, query string, args ...interface{}) (int, error) {
+	var count int64
+	err := db.WithContext(ctx).Model(&Item{}).Where(query, args...).Where("status = ?", Available).Count(&count).Error
+	return int(count), err
+}
+
+// checkQuotas fails with an ErrQuotaExceeded if the new Available items would take their
+// partitions or tenants past their MaxPendingItems. It runs within CreateItems' transaction,
+// and first writes the rows holding the limits, so that concurrent inserts under the same
+// limit wait for each other's transactions rather than all counting the same pending items.
+func (db *GormRepo) checkQuotas(ctx context.Context, items []*Item) error {
+	adding := map[string]int{}
+	addingByTenant := map[string]int{}
+	var ids, tenants []string
+	for _, i := range items {
+		if i.Status != Available {
+			continue
+		}
+		if adding[i.PartitionID] == 0 {
+			ids = append(ids, i.PartitionID)
+		}
+		adding[i.PartitionID]++
+		if i.Tenant == "" {
+			continue
+		}
+		if addingByTenant[i.Tenant] == 0 {
+			tenants = append(tenants, i.Tenant)
+		}
+		addingByTenant[i.Tenant]++
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	var partitions []*Partition
+	limited := db.WithContext(ctx).Model(&Partition{}).Where("id IN ? AND max_pending_items IS NOT NULL", ids)
+	if err := limited.UpdateColumn("max_pending_items", gorm.Expr("max_pending_items")).Error; err != nil {
+		return err
+	}
+	if err := db.WithContext(ctx).Select("id", "max_pending_items").Where("id IN ? AND max_pending_items IS NOT NULL", ids).Order("id").Find(&partitions).Error; err != nil {
+		return err
+	}
+	for _, p := range partitions {
+		pending, err := db.countPending(ctx, "partition_id = ?", p.ID)
+		if err != nil {
+			return err
+		}
+		if pending+adding[p.ID] > *p.MaxPendingItems {
+			return &ErrQuotaExceeded{Kind: "partition", ID: p.ID, Limit: *p.MaxPendingItems, Pending: pending, Adding: adding[p.ID]}
+		}
+	}
+
+	if len(tenants) == 0 {
+		return nil
+	}
+	var quotas []*TenantQuota
+	limited = db.WithContext(ctx).Model(&TenantQuota{}).Where("tenant IN ? AND max_pending_items IS NOT NULL", tenants)
+	if err := limited.UpdateColumn("max_pending_items", gorm.Expr("max_pending_items")).Error; err != nil {
+		return err
+	}
+	if err := db.WithContext(ctx).Where("tenant IN ? AND max_pending_items IS NOT NULL", tenants).Order("tenant").Find(&quotas).Error; err != nil {
+		return err
+	}
+	for _, q := range quotas {
+		pending, err := db.countPending(ctx, "tenant = ?", q.Tenant)
+		if err != nil {
+			return err
+		}
+		if pending+addingByTenant[q.Tenant] > *q.MaxPendingItems {
+			return &ErrQuotaExceeded{Kind: "tenant", ID: q.Tenant, Limit: *q.MaxPendingItems, Pending: pending, Adding: addingByTenant[q.Tenant]}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package state_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state/statetest"
+)
+
+func quotaItems(partitionID, tenant string, from, n int) []*state.Item {
+	items := make([]*state.Item, n)
+	for k := range items {
+		items[k] = &state.Item{
+			BaseModel:   state.BaseModel{ID: fmt.Sprintf("%s-%d", partitionID, from+k)},
+			PartitionID: partitionID,
+			Tenant:      tenant,
+			Data:        []byte(`{}`),
+		}
+	}
+	return items
+}
+
+func TestPartitionQuota(t *testing.T) {
+	r := statetest.NewSQLiteRepo(t)
+	ctx := context.Background()
+	limit := 3
+	if err := r.CreatePartition(ctx, &state.Partition{BaseModel: state.BaseModel{ID: "p"}, MaxPendingItems: &limit}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.CreateItems(ctx, quotaItems("p", "", 0, 2)...); err != nil {
+		t.Fatal(err)
+	}
+	err := r.CreateItems(ctx, quotaItems("p", "", 2, 2)...)
+	var exceeded *state.ErrQuotaExceeded
+	if !errors.As(err, &exceeded) || exceeded.Kind != "partition" || exceeded.Pending != 2 || exceeded.Limit != 3 || exceeded.Adding != 2 {
+		t.Fatalf("expected the partition's quota to be exceeded, got %v", err)
+	}
+	if _, err := r.GetItem(ctx, "p-2"); !state.IsNotFound(err) {
+		t.Errorf("expected none of the items to be created, got %v", err)
+	}
+	usage, err := r.GetPartitionQuotaUsage(ctx, "p")
+	if err != nil || usage.Pending != 2 || *usage.MaxPendingItems != 3 {
+		t.Errorf("unexpected usage %+v %v", usage, err)
+	}
+
+	// Items that aren't Available don't count.
+	i, _ := r.GetItem(ctx, "p-0")
+	i.Status = state.Complete
+	if !r.Save(ctx, i) {
+		t.Fatal("expected the item to be saved")
+	}
+	if err := r.CreateItems(ctx, quotaItems("p", "", 2, 2)...); err != nil {
+		t.Errorf("expected the completed item to make room, got %v", err)
+	}
+
+	if err := r.SetPartitionMaxPendingItems(ctx, "p", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.CreateItems(ctx, quotaItems("p", "", 4, 10)...); err != nil {
+		t.Errorf("expected no quota once cleared, got %v", err)
+	}
+	if err := r.SetPartitionMaxPendingItems(ctx, "missing", &limit); !state.IsNotFound(err) {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
+
+func TestTenantQuota(t *testing.T) {
+	r := statetest.NewSQLiteRepo(t)
+	ctx := context.Background()
+	limit := 3
+	if err := r.SetTenantMaxPendingItems(ctx, "acme", &limit); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.CreateItems(ctx, append(quotaItems("a", "acme", 0, 2), quotaItems("other", "globex", 0, 5)...)...); err != nil {
+		t.Fatal(err)
+	}
+	// The quota applies across the tenant's partitions.
+	if err := r.CreateItems(ctx, quotaItems("b", "acme", 0, 2)...); !state.IsQuotaExceeded(err) {
+		t.Errorf("expected the tenant's quota to be exceeded, got %v", err)
+	}
+	if err := r.CreateItems(ctx, quotaItems("b", "acme", 0, 1)...); err != nil {
+		t.Errorf("expected the item to fit in the quota, got %v", err)
+	}
+	usage, err := r.GetTenantQuotaUsage(ctx, "acme")
+	if err != nil || usage.Pending != 3 || *usage.MaxPendingItems != 3 {
+		t.Errorf("unexpected usage %+v %v", usage, err)
+	}
+	if usage, err := r.GetTenantQuotaUsage(ctx, "globex"); err != nil || usage.Pending != 5 || usage.MaxPendingItems != nil {
+		t.Errorf("expected a tenant without a quota, got %+v %v", usage, err)
+	}
+
+	// Raising the limit updates the tenant's quota.
+	limit = 10
+	if err := r.SetTenantMaxPendingItems(ctx, "acme", &limit); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.CreateItems(ctx, quotaItems("b", "acme", 1, 7)...); err != nil {
+		t.Errorf("expected the raised quota to fit the items, got %v", err)
+	}
+	scoped := *r
+	scoped.Tenant = "globex"
+	if _, err := scoped.GetTenantQuotaUsage(ctx, "acme"); !errors.Is(err, state.ErrWrongTenant) {
+		t.Errorf("expected another tenant's quota to be refused, got %v", err)
+	}
+}
+
+func TestQuotaConcurrentInserts(t *testing.T) {
+	r := statetest.NewSQLiteRepo(t)
+	ctx := context.Background()
+	limit := 10
+	if err := r.CreatePartition(ctx, &state.Partition{BaseModel: state.BaseModel{ID: "p"}, Tenant: "acme", MaxPendingItems: &limit}); err != nil {
+		t.Fatal(err)
+	}
+	tenantLimit := 15
+	if err := r.SetTenantMaxPendingItems(ctx, "acme", &tenantLimit); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created, exceeded := map[string]int{}, map[string]int{}
+	for n := 0; n < 40; n++ {
+		partitionID := "p"
+		if n%2 == 1 {
+			partitionID = "q"
+		}
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			err := r.CreateItems(ctx, quotaItems(partitionID, "acme", n, 1)...)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				created[partitionID]++
+			case state.IsQuotaExceeded(err):
+				exceeded[partitionID]++
+			default:
+				t.Error(err)
+			}
+		}(n)
+	}
+	wg.Wait()
+
+	if created["p"] > 10 || created["p"]+created["q"] != 15 {
+		t.Errorf("expected at most 10 items in p and 15 for the tenant, got %v", created)
+	}
+	for _, id := range []string{"p", "q"} {
+		counts, err := r.GetCountByStatus(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if counts[state.Available] != created[id] {
+			t.Errorf("expected %d items in %s, got %d", created[id], id, counts[state.Available])
+		}
+	}
+	if usage, err := r.GetTenantQuotaUsage(ctx, "acme"); err != nil || usage.Pending != 15 {
+		t.Errorf("expected the tenant's quota to be used up, got %+v %v", usage, err)
+	}
+}
@@ -0,0 +1,85 @@
+package state_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state/statetest"
+)
+
+// failingProcessor fails the items in fail without retries, and completes the others.
+type failingProcessor struct {
+	fail map[string]bool
+}
+
+func (p *failingProcessor) Process(id string, b []byte) (*state.ProcessorResponse, error) {
+	if p.fail[id] {
+		return nil, state.NonRetryableError("bad item")
+	}
+	return &state.ProcessorResponse{Complete: true, Data: b}, nil
+}
+
+func (p *failingProcessor) Healthcheck(ctx context.Context) error {
+	return nil
+}
+
+func TestFailedPartitionRecovers(t *testing.T) {
+	ctx := context.Background()
+	for name, resolve := range map[string]func(r *state.GormRepo) error{
+		"redriven":  func(r *state.GormRepo) error { return r.RedriveItem(ctx, "a", nil) },
+		"cancelled": func(r *state.GormRepo) error { return r.CancelItem(ctx, "a") },
+	} {
+		t.Run(name, func(t *testing.T) {
+			sim := statetest.NewSimulator(1, simStart)
+			r := simRepo(t, sim, "a", "b")
+			proc := &failingProcessor{fail: map[string]bool{"a": true}}
+			first := simWatcher(r, "first")
+			first.Processor = proc
+			sim.Add(first)
+			sim.Run(ctx, 5*time.Second)
+			if p, _ := r.GetPartition(ctx, "p"); p.Status != state.Failed {
+				t.Fatalf("expected the partition to fail, got %s", p.Status)
+			}
+
+			// Once its watcher is gone, the partition isn't leased again while it has failed items.
+			sim.Crash(first)
+			sim.Run(ctx, time.Minute)
+			if partitions, err := r.GetPotentialLeases(ctx, nil); err != nil || len(partitions) != 0 {
+				t.Fatalf("expected the failed partition not to be leased, got %v %v", partitions, err)
+			}
+			withFailed := *r
+			withFailed.LeaseFailedPartitions = true
+			if partitions, err := withFailed.GetPotentialLeases(ctx, nil); err != nil || len(partitions) != 1 {
+				t.Errorf("expected the failed partition to be leased with LeaseFailedPartitions, got %v %v", partitions, err)
+			}
+
+			// Nor are its items processed by another watcher, including those added since it
+			// failed.
+			if err := r.CreateItems(ctx, &state.Item{BaseModel: state.BaseModel{ID: "c"}, PartitionID: "p", Data: []byte(`{}`)}); err != nil {
+				t.Fatal(err)
+			}
+			second := simWatcher(r, "second")
+			second.Processor = proc
+			sim.Add(second)
+			sim.Run(ctx, 5*time.Second)
+			if i, err := r.GetItem(ctx, "c"); err != nil || i.Status != state.Available || i.LastProcessedAt != nil {
+				t.Fatalf("expected the item of the failed partition to be left alone, got %+v %v", i, err)
+			}
+
+			proc.fail["a"] = false
+			if err := resolve(r); err != nil {
+				t.Fatal(err)
+			}
+			sim.Run(ctx, 5*time.Second)
+			p, err := r.GetPartition(ctx, "p")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Status != state.Complete || p.Owner != "second" {
+				t.Errorf("expected the partition to recover and complete, got %+v\n%v", p, sim.History)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package state
+
+import (
+	"context"
+	"fmt"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+	"gorm.io/gorm"
+)
+
+// RetryFailedItems moves every Failed item in the partition back to Available with a fresh
+// retry budget, and makes the partition Available again if it had failed. Returns the
+// number of items retried.
+func (db *GormRepo) RetryFailedItems(ctx context.Context, partitionID string) (int, error) {
+	var retried int64
+	now := clock.Or(db.Clock).Now()
+	err := db.Transaction(ctx, func(tx *GormRepo) error {
+		if _, err := tx.GetPartition(ctx, partitionID); err != nil {
+			return err
+		}
+		res := tx.scoped(tx.WithContext(ctx)).Model(&Item{}).Where(
+			"partition_id = ? AND status = ?", partitionID, Failed).Updates(map[string]interface{}{
+			"status":      Available,
+			"retry_count": 0,
+			"version":     gorm.Expr("version + 1"),
+			"updated_at":  now,
+		})
+		if res.Error != nil {
+			return res.Error
+		}
+		retried = res.RowsAffected
+		if err := tx.makeLeaseable(ctx, "id = ?", partitionID); err != nil {
+			return err
+		}
+		return tx.WithContext(ctx).Model(&Partition{}).Where(
+			"id = ? AND status = ?", partitionID, Failed).Updates(map[string]interface{}{
+			"status":        Available,
+			"status_reason": "",
+			"retry_at":      nil,
+			"version":       gorm.Expr("version + 1"),
+			"updated_at":    now,
+		}).Error
+	})
+	return int(retried), err
+}
+
+// ReopenPartition marks the partition Available so that it is picked up by watchers again,
+// optionally rewinding or advancing it to the given gate. Any lease left over from when the
+// partition was closed is released.
+func (db *GormRepo) ReopenPartition(ctx context.Context, id string, gate *int) error {
+	if err := checkGate(gate); err != nil {
+		return err
+	}
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	now := clock.Or(db.Clock).Now()
+	updates := map[string]interface{}{
+		"status":          Available,
+		"status_reason":   "",
+		"retry_at":        nil,
+		"owner":           "",
+		"until":           now,
+		"leaseable_after": nil,
+		"version":         gorm.Expr("version + 1"),
+		"updated_at":      now,
+	}
+	if gate != nil {
+		updates["gate"] = *gate
+	}
+	res := db.scoped(db.WithContext(ctx)).Model(&Partition{}).Where("id = ?", id).Updates(updates)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return &ErrNotFound{Kind: "partition", ID: id}
+	}
+	return nil
+}
+
+// RedriveItem makes an item Available to be processed again from its Data, discarding its
+// Result, errors and retries, and optionally moving it to the given gate.
+func (db *GormRepo) RedriveItem(ctx context.Context, id string, gate *int) error {
+	if err := checkGate(gate); err != nil {
+		return err
+	}
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	now := clock.Or(db.Clock).Now()
+	updates := map[string]interface{}{
+		"status":         Available,
+		"result":         nil,
+		"retry_count":    0,
+		"error_messages": "",
+		"retry_at":       nil,
+		"version":        gorm.Expr("version + 1"),
+		"updated_at":     now,
+	}
+	if gate != nil {
+		updates["gate"] = *gate
+	}
+	res := db.scoped(db.WithContext(ctx)).Model(&Item{}).Where("id = ?", id).Updates(updates)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return &ErrNotFound{Kind: "item", ID: id}
+	}
+	return db.makeLeaseable(ctx, "id IN (?)", db.WithContext(ctx).Model(&Item{}).Select("partition_id").Where("id = ?", id))
+}
+
+// checkGate rejects a negative gate to move a partition or item to.
+func checkGate(gate *int) error {
+	if gate != nil && *gate < 0 {
+		return &ErrValidation{Field: "gate", Reason: fmt.Sprintf("can't be negative, got %d", *gate)}
+	}
+	return nil
+}
+
+// CancelItem marks an Available or Failed item as Cancelled. Cancelling an item that is
+// already Complete or Cancelled is a no-op.
+func (db *GormRepo) CancelItem(ctx context.Context, id string) error {
+	now := clock.Or(db.Clock).Now()
+	return db.Transaction(ctx, func(tx *GormRepo) error {
+		i, err := tx.GetItem(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err := tx.makeLeaseable(ctx, "id = ?", i.PartitionID); err != nil {
+			return err
+		}
+		return tx.WithContext(ctx).Model(&Item{}).Where(
+			"id = ? AND status IN ?", id, []Status{Available, Failed}).Updates(map[string]interface{}{
+			"status":     Cancelled,
+			"version":    gorm.Expr("version + 1"),
+			"updated_at": now,
+		}).Error
+	})
+}
+
+// PurgeItems deletes the items matching the filter, along with their offloaded payloads, and
+// returns the number of items deleted. The filter must not be empty.
+func (db *GormRepo) PurgeItems(ctx context.Context, filter ItemFilter) (int, error) {
+	if filter.empty() {
+		return 0, &ErrValidation{Field: "filter", Reason: "refusing to purge every item, the filter is empty"}
+	}
+	if len(filter.Metadata) > 0 && !db.canSelectJSON(filter.Metadata) {
+		return 0, &ErrValidation{Field: "metadata", Reason: "purging by metadata requires a database that can query JSON, and keys without quotes or backslashes"}
+	}
+	purged := 0
+	for {
+		// Fetch the stored payloads, without rehydrating them, to find their blobs.
+		var items []*Item
+		err := db.Transaction(ctx, func(tx *GormRepo) error {
+			if err := tx.filterItems(tx.scoped(tx.WithContext(ctx)).Model(&Item{}), filter).Select(
+				"id", "data", "result").Limit(DefaultPageSize).Find(&items).Error; err != nil {
+				return err
+			}
+			if len(items) == 0 {
+				return nil
+			}
+			ids := make([]string, len(items))
+			for n, i := range items {
+				ids[n] = i.ID
+			}
+			return tx.WithContext(ctx).Where("id IN ?", ids).Delete(&Item{}).Error
+		})
+		if err != nil {
+			return purged, err
+		}
+		if len(items) == 0 {
+			return purged, nil
+		}
+		purged += len(items)
+		if err := db.deleteBlobs(ctx, items); err != nil {
+			return purged, err
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+	"github.com/golang/glog"
+	"gorm.io/gorm"
+)
+
+// DefaultMaxReplicaLag is how far behind the primary a GormRepo's ReadDB may be, by default,
+// before its reads fall back to the primary.
+var DefaultMaxReplicaLag = 10 * time.Second
+
+// ReplicaLagInterval is how often the lag of a ReadDB is measured.
+var ReplicaLagInterval = time.Second
+
+// replicaLag is the last measured lag of a ReadDB. It is kept apart from the GormRepo, which
+// is copied, e.g. for transactions.
+type replicaLag struct {
+	mu       sync.Mutex
+	measured time.Time
+	lag      time.Duration
+	err      error
+}
+
+// replicaLags are the replicaLags by ReadDB.
+var replicaLags sync.Map
+
+// reader returns the handle for the repo's heavy read queries: its ReadDB, unless that lags
+// behind the primary by more than MaxReplicaLag.
+func (db *GormRepo) reader(ctx context.Context) *gorm.DB {
+	if db.ReadDB == nil {
+		return db.DB
+	}
+	if lag, err := db.replicaLag(ctx); err != nil || lag > db.maxReplicaLag() {
+		return db.DB
+	}
+	return db.ReadDB
+}
+
+// maxReplicaLag returns the repo's MaxReplicaLag, defaulting to DefaultMaxReplicaLag.
+func (db *GormRepo) maxReplicaLag() time.Duration {
+	if db.MaxReplicaLag <= 0 {
+		return DefaultMaxReplicaLag
+	}
+	return db.MaxReplicaLag
+}
+
+// replicaLag returns the lag of the repo's ReadDB, measured at most every ReplicaLagInterval.
+func (db *GormRepo) replicaLag(ctx context.Context) (time.Duration, error) {
+	v, _ := replicaLags.LoadOrStore(db.ReadDB, &replicaLag{})
+	l := v.(*replicaLag)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := clock.Or(db.Clock)
+	if c.Since(l.measured) < ReplicaLagInterval {
+		return l.lag, l.err
+	}
+	l.lag, l.err = db.measureReplicaLag(ctx)
+	l.measured = c.Now()
+	if l.err != nil && ctx.Err() == nil {
+		glog.Warningf("error measuring the replica lag, reading from the primary: %s", l.err)
+	}
+	return l.lag, l.err
+}
+
+// measureReplicaLag estimates the lag of the repo's ReadDB as how far its most recently
+// updated partition is behind the primary's. Watchers renew their leases on every poll, so
+// while any partition is leased the estimate is within a poll interval.
+func (db *GormRepo) measureReplicaLag(ctx context.Context) (time.Duration, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	primary, err := lastPartitionUpdate(ctx, db.DB)
+	if err != nil {
+		return 0, err
+	}
+	replica, err := lastPartitionUpdate(ctx, db.ReadDB)
+	if err != nil || replica.After(primary) {
+		return 0, err
+	}
+	return primary.Sub(replica), nil
+}
+
+// lastPartitionUpdate returns when the database's most recently updated partition was
+// updated, or the zero time if there are none.
+func lastPartitionUpdate(ctx context.Context, tx *gorm.DB) (time.Time, error) {
+	var p Partition
+	err := tx.WithContext(ctx).Select("updated_at").Order("updated_at DESC").Take(&p).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return time.Time{}, nil
+	}
+	return p.UpdatedAt, err
+}
+
+// StaleReadWindow returns how old the repo's reads may be, if it reads from a ReadDB.
+func (db *GormRepo) StaleReadWindow() time.Duration {
+	if db.ReadDB == nil {
+		return 0
+	}
+	return db.maxReplicaLag() + ReplicaLagInterval
+}
+
+// staleReader is implemented by repos whose reads may be stale.
+type staleReader interface {
+	StaleReadWindow() time.Duration
+}
+
+// staleReadWindow returns how old the reads of the watcher's repo may be, 0 if they aren't
+// stale.
+func (w *Watcher) staleReadWindow() time.Duration {
+	if r, ok := w.Repo.(staleReader); ok {
+		return r.StaleReadWindow()
+	}
+	return 0
+}
+
+// savedVersions are the versions of the items the watcher saved within the repo's
+// StaleReadWindow, so that stale copies of them read from a replica aren't processed again.
+type savedVersions struct {
+	mu       sync.Mutex
+	versions map[string]savedVersion
+}
+
+type savedVersion struct {
+	version int
+	at      time.Time
+}
+
+// recordSave remembers the version of an item the watcher saved, if its repo's reads may be
+// stale.
+func (w *Watcher) recordSave(i *Item) {
+	if w.staleReadWindow() <= 0 {
+		return
+	}
+	w.saved.mu.Lock()
+	defer w.saved.mu.Unlock()
+	if w.saved.versions == nil {
+		w.saved.versions = map[string]savedVersion{}
+	}
+	w.saved.versions[i.ID] = savedVersion{version: i.Version, at: w.Clock.Now()}
+}
+
+// freshItems drops the items read before the watcher's own saves of them, which would only
+// conflict, and forgets the saves older than the repo's StaleReadWindow.
+func (w *Watcher) freshItems(items []*Item) []*Item {
+	window := w.staleReadWindow()
+	if window <= 0 {
+		return items
+	}
+	w.saved.mu.Lock()
+	defer w.saved.mu.Unlock()
+	for id, v := range w.saved.versions {
+		if w.Clock.Since(v.at) > window {
+			delete(w.saved.versions, id)
+		}
+	}
+	fresh := items[:0]
+	for _, i := range items {
+		v, ok := w.saved.versions[i.ID]
+		if ok && i.Version < v.version {
+			atomic.AddInt64(&w.counters.staleReads, 1)
+			continue
+		}
+		if ok {
+			delete(w.saved.versions, i.ID)
+		}
+		fresh = append(fresh, i)
+	}
+	return fresh
+}
@@ -0,0 +1,149 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// openReplica returns a handle on a snapshot of the repo's database, which doesn't see the
+// repo's later writes, like a replica lagging behind indefinitely.
+func openReplica(t *testing.T, r *GormRepo) *gorm.DB {
+	sqlDB, err := r.DB.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.CreateTemp("", "test_replica_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	// VACUUM INTO only writes new files.
+	os.Remove(f.Name())
+	if _, err := sqlDB.Exec("VACUUM INTO ?", f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	db, err := gorm.Open(sqlite.Open(f.Name()), &gorm.Config{
+		Logger:         logger.Default.LogMode(logger.Silent),
+		NamingStrategy: r.Config.NamingStrategy,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
+
+func TestReadReplicaRouting(t *testing.T) {
+	defer func(interval time.Duration) { ReplicaLagInterval = interval }(ReplicaLagInterval)
+	ReplicaLagInterval = 0
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Data: []byte(`{}`)})
+	r.ReadDB = openReplica(t, r)
+	// Writes to the primary after the snapshot are only visible to reads from the primary.
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "j"}, PartitionID: "p", Data: []byte(`{}`)})
+
+	read := func() int {
+		t.Helper()
+		items, err := r.GetAvailableItems(ctx, &Partition{BaseModel: BaseModel{ID: "p"}}, 10, OrderByUpdatedAt, AnyItems)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts, err := r.GetCountByStatus(ctx, "p")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed, _, err := r.ListItems(ctx, ItemFilter{PartitionID: "p"}, PageRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != counts[Available] || len(items) != len(listed) {
+			t.Fatalf("expected the reads to agree, got %d available items, counts %v and %d listed", len(items), counts, len(listed))
+		}
+		return len(items)
+	}
+	if n := read(); n != 1 {
+		t.Errorf("expected the reads to go to the replica, got %d items", n)
+	}
+	if err := r.Transaction(ctx, func(tx *GormRepo) error {
+		items, err := tx.GetAvailableItems(ctx, &Partition{BaseModel: BaseModel{ID: "p"}}, 10, OrderByUpdatedAt, AnyItems)
+		if len(items) != 2 {
+			t.Errorf("expected the reads of a transaction to go to the primary, got %d items", len(items))
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the primary's partitions are updated past MaxReplicaLag, reads fall back to it.
+	r.MaxReplicaLag = time.Minute
+	if err := r.Model(&Partition{}).Where("id = ?", "p").UpdateColumn("updated_at", time.Now().Add(time.Hour)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n := read(); n != 2 {
+		t.Errorf("expected the reads to fall back to the primary, got %d items", n)
+	}
+}
+
+// countingProcessor completes the items, counting the calls for each.
+type countingProcessor struct {
+	testProcessor
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (p *countingProcessor) Process(id string, b []byte) (*ProcessorResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls[id]++
+	return &ProcessorResponse{Complete: true, Data: b}, nil
+}
+
+func TestStaleReadsSkipped(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	for n := 0; n < 3; n++ {
+		r.Save(ctx, &Item{BaseModel: BaseModel{ID: fmt.Sprint(n)}, PartitionID: "p", Data: []byte(`{}`)})
+	}
+	// The replica never catches up, but is tolerated.
+	r.ReadDB = openReplica(t, r)
+	r.MaxReplicaLag = time.Hour
+
+	proc := &countingProcessor{calls: map[string]int{}}
+	w := &Watcher{Processor: proc, Repo: r, PollInterval: 10 * time.Millisecond}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		w.Start(ctx)
+		close(done)
+	}()
+	time.Sleep(500 * time.Millisecond)
+	cancel()
+	<-done
+
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+	for n := 0; n < 3; n++ {
+		if calls := proc.calls[fmt.Sprint(n)]; calls != 1 {
+			t.Errorf("expected item %d to be processed once, got %d calls", n, calls)
+		}
+	}
+	if stats := w.Stats(); stats.StaleReads == 0 || stats.SaveConflicts != 0 {
+		t.Errorf("expected the stale items to be skipped without conflicts, got %+v", stats)
+	}
+}
@@ -2,9 +2,16 @@ package state
 
 import (
 	"context"
+	"database/sql"
 	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state/migrations"
 	"github.com/golang/glog"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
@@ -19,6 +26,8 @@ const (
 	Available
 	Complete
 	Failed
+	// Cancelled items were withdrawn by an operator, and are neither processed nor counted as failures.
+	Cancelled
 )
 
 func (e Status) String() string {
@@ -29,6 +38,8 @@ func (e Status) String() string {
 		return "Complete"
 	case Failed:
 		return "Failed"
+	case Cancelled:
+		return "Cancelled"
 	case Unknown:
 		return "Unknown"
 	default:
@@ -39,34 +50,212 @@ func (e Status) String() string {
 func (e *Status) Scan(value interface{}) error { *e = Status(value.(int64)); return nil }
 func (e Status) Value() (driver.Value, error)  { return int64(e), nil }
 
-type Repo interface {
-	Save(ctx context.Context, m Model) bool
-	AutoMigrate() error
-	GetPotentialLeases(ctx context.Context) ([]*Partition, error)
-	GetAvailableItems(ctx context.Context, p *Partition, limit int) ([]*Item, error)
+// MarshalText encodes the status by name, so that JSON output is human readable.
+func (e Status) MarshalText() ([]byte, error) { return []byte(e.String()), nil }
+
+// UnmarshalText decodes a status name, as accepted by ParseStatus.
+func (e *Status) UnmarshalText(b []byte) (err error) {
+	*e, err = ParseStatus(string(b))
+	return err
+}
+
+// ParseStatus returns the Status with the given case-insensitive name.
+func ParseStatus(s string) (Status, error) {
+	for _, st := range []Status{Unknown, Available, Complete, Failed, Cancelled} {
+		if strings.EqualFold(s, st.String()) {
+			return st, nil
+		}
+	}
+	return Unknown, fmt.Errorf("unknown status: %q", s)
+}
+
+// ItemReader reads the items of partitions.
+type ItemReader interface {
+	GetAvailableItems(ctx context.Context, p *Partition, limit int, order ItemOrder, retries RetryFilter) ([]*Item, error)
 	GetCountByStatus(ctx context.Context, id string) (map[Status]int, error)
-	Healthcheck(ctx context.Context) error
+	CountAvailablePastGate(ctx context.Context, partitionID string, gate int) (int, error)
+	CountDelayedItems(ctx context.Context, p *Partition) (int, error)
+	CountDeadlineMisses(ctx context.Context, partitionID string) (int, error)
+	GetItem(ctx context.Context, id string) (*Item, error)
+	GetItemByIdempotencyKey(ctx context.Context, partitionID, key string) (*Item, error)
+	FindCompletedByHash(ctx context.Context, partitionID string, gate int, hash string) (*Item, error)
+	ListItems(ctx context.Context, filter ItemFilter, page PageRequest) ([]*Item, PageToken, error)
+	GetPartitionProgress(ctx context.Context, id string) (*PartitionProgress, error)
+	GetAvailableLag(ctx context.Context, p *Partition) (time.Duration, error)
+	CountStuckItems(ctx context.Context, olderThan time.Duration) (map[string]int, error)
+}
+
+// ItemWriter saves items, and the partitions whose gates and statuses they move, under OCC.
+type ItemWriter interface {
+	Save(ctx context.Context, m Model) bool
+	SaveWithOutbox(ctx context.Context, m Model, events ...*OutboxEvent) bool
 	Transaction(ctx context.Context, f func(db *GormRepo) error) error
+	TransactionWithOptions(ctx context.Context, opts TxOptions, f func(db *GormRepo) error) error
+	CreateItems(ctx context.Context, items ...*Item) error
+	GetOrCreateItem(ctx context.Context, i *Item) (*Item, bool, error)
+	FailExpiredItems(ctx context.Context) (int, error)
+	ReclaimStuckItems(ctx context.Context, olderThan time.Duration) (int, error)
+	ClaimItems(ctx context.Context, owner string, limit int, visibility time.Duration) ([]*Item, error)
+	ExtendItem(ctx context.Context, itemID, owner string, d time.Duration) (bool, error)
+}
+
+// LeaseRepo finds and reads the partitions to lease, and tracks the watchers leasing them.
+type LeaseRepo interface {
+	GetPotentialLeases(ctx context.Context, selector map[string]string) ([]*Partition, error)
+	GetPartition(ctx context.Context, id string) (*Partition, error)
+	ListPartitions(ctx context.Context, filter PartitionFilter, page PageRequest) ([]*Partition, PageToken, error)
+	CreatePartition(ctx context.Context, p *Partition) error
+	GetOrCreatePartition(ctx context.Context, p *Partition) (*Partition, bool, error)
+	AcquireLease(ctx context.Context, p *Partition, owner string, until time.Time) (bool, error)
+	TryAcquireLease(ctx context.Context, partitionID, owner string, until time.Time, fence bool) (bool, error)
+	AcquireLeases(ctx context.Context, candidates []string, owner string, until time.Time, limit int, fence bool) ([]*Partition, error)
+	ReleaseLease(ctx context.Context, p *Partition) error
+	ReleaseExpiredLeases(ctx context.Context) (int, error)
+	RetryFailedPartitions(ctx context.Context) ([]*Partition, error)
+	GetLeaseHistory(ctx context.Context, partitionID string, limit int) ([]*LeaseEvent, error)
+
+	Heartbeat(ctx context.Context, o *Owner) error
+	ListOwners(ctx context.Context) ([]*Owner, error)
+	AcquireLeadership(ctx context.Context, election, owner string, until time.Time) (bool, error)
+	ReleaseLeadership(ctx context.Context, election, owner string) error
+}
+
+// HealthChecker checks that the database is reachable.
+type HealthChecker interface {
+	Healthcheck(ctx context.Context) error
+}
+
+// AdminRepo remediates partitions and items on behalf of operators.
+type AdminRepo interface {
+	RetryFailedItems(ctx context.Context, partitionID string) (int, error)
+	ReopenPartition(ctx context.Context, id string, gate *int) error
+	SetPartitionMaxRetries(ctx context.Context, id string, maxRetries *int) error
+	SetItemMaxRetries(ctx context.Context, id string, maxRetries *int) error
+	CancelItem(ctx context.Context, id string) error
+	RedriveItem(ctx context.Context, id string, gate *int) error
+	PurgeItems(ctx context.Context, filter ItemFilter) (int, error)
+	ReencryptPartition(ctx context.Context, id string, keyID string) (int, error)
+	GetPartitionQuotaUsage(ctx context.Context, id string) (*QuotaUsage, error)
+	GetTenantQuotaUsage(ctx context.Context, tenant string) (*QuotaUsage, error)
+	SetPartitionMaxPendingItems(ctx context.Context, id string, max *int) error
+	SetTenantMaxPendingItems(ctx context.Context, tenant string, max *int) error
+	ExportPartition(ctx context.Context, id string, w io.Writer) error
+	ImportPartition(ctx context.Context, r io.Reader, opts ImportOptions) (*Partition, error)
+	PurgeLeaseEvents(ctx context.Context, before time.Time) (int, error)
+}
+
+// OutboxRepo claims and acknowledges the outbox events for an OutboxPublisher.
+type OutboxRepo interface {
+	ClaimOutboxBatch(ctx context.Context, limit int, claimFor time.Duration) ([]*OutboxEvent, error)
+	MarkOutboxPublished(ctx context.Context, ids ...string) error
+}
+
+// SchemaMigrator migrates the schema, see the migrations package.
+type SchemaMigrator interface {
+	AutoMigrate() error
+	MigrateTo(ctx context.Context, version int) error
+	SchemaVersion(ctx context.Context) (int, error)
+}
+
+// WatcherRepo is the part of the Repo a Watcher uses.
+type WatcherRepo interface {
+	ItemReader
+	ItemWriter
+	LeaseRepo
+	HealthChecker
+}
+
+// Repo is the union of the repo interfaces, implemented by GormRepo. Code that only needs
+// part of it should take the narrower interfaces, and partial fakes can embed
+// UnimplementedRepo.
+type Repo interface {
+	WatcherRepo
+	AdminRepo
+	OutboxRepo
+	SchemaMigrator
 }
 
 type GormRepo struct {
 	*gorm.DB
 	Timeout time.Duration
+	// Notifications, if set, wake watchers as soon as items become available. See Notifier.
+	Notifications *Notifications
+	// OutboxEnabled records completed and failed items and partitions, saved by
+	// the watcher as OutboxEvents in the same transaction.
+	OutboxEnabled bool
+	// Blobs, if set, holds item payloads larger than BlobThreshold bytes, which are replaced
+	// in the database by a small envelope. BlobThreshold defaults to DefaultBlobThreshold.
+	Blobs         BlobStore
+	BlobThreshold int
+	// Encryptor, if set, encrypts item Data, Result and ErrorMessages at rest with the key
+	// EncryptionKeyID. Values written with other keys remain readable.
+	Encryptor       Encryptor
+	EncryptionKeyID string
+	// Tenant, if set, scopes every query to the partitions and items of the tenant, and is
+	// assigned to the partitions and items saved without one.
+	Tenant string
+	// StealFromDeadOwners makes GetPotentialLeases also return partitions whose owner hasn't
+	// sent a heartbeat within DeadOwnerThreshold, before their lease expires. Defaults to
+	// DefaultDeadOwnerThreshold.
+	StealFromDeadOwners bool
+	DeadOwnerThreshold  time.Duration
+	// LeaseFailedPartitions makes Failed partitions which still have failed items eligible
+	// for a lease. By default they are left alone until the items are retried or cancelled,
+	// after which the watcher leasing the partition recovers it.
+	LeaseFailedPartitions bool
+	// DuplicateItems is what CreateItems does with items whose IdempotencyKey is taken.
+	// Defaults to DuplicateReturnExisting.
+	DuplicateItems DuplicateItemPolicy
+	// Clock is the time leases, heartbeats, deadlines and items' RetryAt are compared with, and
+	// defaults to the real time. It is overridden in tests, along with the watcher's.
+	Clock clock.Clock
+	// ReadDB, if set, is a read replica serving GetPotentialLeases, GetAvailableItems,
+	// GetCountByStatus and the list APIs, while writes, transactions and every other query go
+	// to DB. While the replica lags behind by more than MaxReplicaLag, which defaults to
+	// DefaultMaxReplicaLag, those reads go to DB too.
+	ReadDB        *gorm.DB
+	MaxReplicaLag time.Duration
+	// ProgressRateWindow is the window of recent completions GetPartitionProgress measures
+	// the rate of partitions' progress over. Defaults to DefaultProgressRateWindow.
+	ProgressRateWindow time.Duration
+	// IDGenerator generates the IDs of the partitions and items created without one, and
+	// defaults to UUIDv7. IDs are validated on creation, see MaxIDLength.
+	IDGenerator IDGenerator
+	// MaxProcessingTime, if set, bounds the claims extended by ExtendItem to MaxProcessingTime
+	// from the start of their item's processing, see Watcher.MaxProcessingTime.
+	MaxProcessingTime time.Duration
+
+	// txCtx is the context of the transaction the repo belongs to, if any, and pending the
+	// notifications it publishes once committed.
+	txCtx   context.Context
+	pending *pendingNotifications
 }
 
+// Healthcheck pings the database, failing with ErrPoolSaturated while every connection the
+// repo may open is in use.
 func (db *GormRepo) Healthcheck(ctx context.Context) error {
 	sqlDB, err := db.DB.DB()
 	if err != nil {
 		return err
 	}
+	if err := checkPool(sqlDB.Stats()); err != nil {
+		return err
+	}
 	return sqlDB.Ping()
 }
 
 func (db *GormRepo) WithTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
-	if db.Timeout == 0*time.Second {
-		db.Timeout = DefaultTimeout
+	if db.txCtx != nil {
+		// Calls within a transaction are bound by its context and timeout, whatever context
+		// they are passed.
+		return db.txCtx, func() {}
+	}
+	// The repo is shared between goroutines, so the default isn't stored.
+	timeout := db.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
 	}
-	return context.WithTimeout(ctx, db.Timeout)
+	return context.WithTimeout(ctx, timeout)
 }
 
 type Model interface {
@@ -77,7 +266,7 @@ type Model interface {
 }
 
 type BaseModel struct {
-	ID        string `gorm:"primaryKey"`
+	ID        string `gorm:"primaryKey;size:256"`
 	Version   int    `gorm:"default:0;not null"`
 	CreatedAt time.Time
 	UpdatedAt time.Time
@@ -87,6 +276,11 @@ func (m *BaseModel) GetID() string {
 	return m.ID
 }
 
+// SetID sets the ID of a model about to be created, see GormRepo.IDGenerator.
+func (m *BaseModel) SetID(id string) {
+	m.ID = id
+}
+
 func (m *BaseModel) GetVersion() int {
 	return m.Version
 }
@@ -99,24 +293,71 @@ func (m *BaseModel) DecrementVersion() {
 	m.Version--
 }
 
+// AutoMigrate applies every pending migration, see MigrateTo.
 func (db *GormRepo) AutoMigrate() error {
-	return db.DB.AutoMigrate(&Item{}, &Partition{})
+	return db.MigrateTo(context.Background(), migrations.Latest())
+}
+
+// MigrateTo migrates the schema up or down to the version, applying or reverting the steps of
+// the migrations package in order. Databases created by the AutoMigrate of earlier releases,
+// which predate the schema_migrations table, are at version 0 and adopt every step.
+func (db *GormRepo) MigrateTo(ctx context.Context, version int) error {
+	return migrations.MigrateTo(ctx, db.DB, version)
+}
+
+// SchemaVersion returns the version of the schema, 0 if no migration was applied.
+func (db *GormRepo) SchemaVersion(ctx context.Context) (int, error) {
+	return migrations.Version(ctx, db.DB)
 }
 
-func (db *GormRepo) GetPotentialLeases(ctx context.Context) (partitions []*Partition, err error) {
+// GetPotentialLeases returns the partitions that are eligible for a lease, see
+// eligibleForLease, aren't leased, have every label of the selector, and whose dependency, if
+// any, is complete. With StealFromDeadOwners, partitions leased by dead owners are returned
+// too.
+func (db *GormRepo) GetPotentialLeases(ctx context.Context, selector map[string]string) (partitions []*Partition, err error) {
 	ctx, cancel := db.WithTimeout(ctx)
 	defer cancel()
-	return partitions, db.WithContext(ctx).Where(
-		"status != ? AND until < ?",
-		Complete, time.Now()).Find(&partitions).Error
+	reader := db.reader(ctx)
+	now := clock.Or(db.Clock).Now()
+	tx := db.eligibleForLease(ctx, db.selectJSON(db.scoped(reader.WithContext(ctx)), "labels", selector), now)
+	complete := reader.WithContext(ctx).Model(&Partition{}).Select("id").Where("status = ?", Complete)
+	tx = tx.Where("depends_on = '' OR depends_on IN (?)", complete)
+	if db.StealFromDeadOwners {
+		dead := reader.WithContext(ctx).Model(&Owner{}).Select("owner_id").Where(
+			"last_heartbeat < ?", now.Add(-db.deadOwnerThreshold()))
+		tx = tx.Where("until < ? OR owner IN (?)", now, dead)
+	} else {
+		tx = tx.Where("until < ?", now)
+	}
+	if err := tx.Find(&partitions).Error; err != nil {
+		return nil, err
+	}
+	return matchingPartitions(partitions, selector), nil
 }
 
-func (db *GormRepo) GetAvailableItems(ctx context.Context, p *Partition, limit int) (items []*Item, err error) {
+// GetAvailableItems returns up to limit Available items at the partition's gate, skipping
+// those whose RetryAt is yet to come, and those the retry filter leaves out.
+func (db *GormRepo) GetAvailableItems(ctx context.Context, p *Partition, limit int, order ItemOrder, retries RetryFilter) (items []*Item, err error) {
 	ctx, cancel := db.WithTimeout(ctx)
 	defer cancel()
-	return items, db.WithContext(ctx).Where(
-		"partition_id = ? AND status = ? AND gate = ?", p.ID, Available, p.Gate).Limit(limit).Order(
-		"updated_at").Find(&items).Error
+	tx := db.scoped(db.reader(ctx).WithContext(ctx)).Where(
+		"partition_id = ? AND status = ? AND gate = ?", p.ID, Available, p.Gate).Where(
+		"retry_at IS NULL OR retry_at <= ?", clock.Or(db.Clock).Now())
+	if cond := retries.where(); cond != "" {
+		tx = tx.Where(cond)
+	}
+	if err := tx.Limit(limit).Order(order.orderBy()).Find(&items).Error; err != nil {
+		return nil, err
+	}
+	return items, db.load(ctx, items...)
+}
+
+// nextSequence returns the next sequence number for items in the partition.
+func (db *GormRepo) nextSequence(ctx context.Context, partitionID string) (int64, error) {
+	var max int64
+	err := db.WithContext(ctx).Model(&Item{}).Select("COALESCE(MAX(sequence), 0)").Where(
+		"partition_id = ?", partitionID).Scan(&max).Error
+	return max + 1, err
 }
 
 // Save the item. Modified to leverage OCC version control.
@@ -126,22 +367,195 @@ func (db *GormRepo) Save(ctx context.Context, m Model) bool {
 	ctx, cancel := db.WithTimeout(ctx)
 	defer cancel()
 	version := m.GetVersion()
+	if version == 0 {
+		if err := db.assignID(modelKind(m), m); err != nil {
+			glog.Warningf("error saving model %s, error: %s", m.GetID(), err)
+			return false
+		}
+	}
+	if err := db.claimTenant(m); err != nil {
+		glog.Warningf("error saving model %s, error: %s", m.GetID(), err)
+		return false
+	}
+	if p, ok := m.(*Partition); ok && version == 0 {
+		if err := db.checkDependencies(ctx, p); err != nil {
+			glog.Warningf("error saving partition %s, error: %s", p.ID, err)
+			return false
+		}
+	}
+	if i, ok := m.(*Item); ok && version == 0 {
+		if err := db.checkItemTenants(ctx, i); err != nil {
+			glog.Warningf("error saving item %s, error: %s", i.ID, err)
+			return false
+		}
+		if i.Sequence == 0 {
+			seq, err := db.nextSequence(ctx, i.PartitionID)
+			if err != nil {
+				glog.Warningf("error assigning a sequence to item %s, error: %s", i.ID, err)
+				return false
+			}
+			i.Sequence = seq
+		}
+	}
+	if i, ok := m.(*Item); ok {
+		restore, err := db.prepare(ctx, i, db.EncryptionKeyID)
+		if err != nil {
+			glog.Warningf("error saving model %s, error: %s", m.GetID(), err)
+			return false
+		}
+		saved := false
+		defer func() { restore(saved) }()
+		defer func() { saved = m.GetVersion() != version }()
+	}
+	where := []clause.Expression{clause.Expr{SQL: "version = ?", Vars: []interface{}{version}}}
+	if i, ok := m.(*Item); ok && i.Fence != 0 {
+		// Reject saves by a watcher that has lost the partition, even if the item is unchanged.
+		newer := db.WithContext(ctx).Model(&Partition{}).Select("id").Where("id = ? AND fence > ?", i.PartitionID, i.Fence)
+		where = append(where, clause.Expr{SQL: "NOT EXISTS (?)", Vars: []interface{}{newer}})
+	}
+	if p, ok := m.(*Partition); ok {
+		// Leases aren't versioned, see AcquireLease: reject saves by a watcher that has lost
+		// the partition.
+		where = append(where, clause.Expr{SQL: "fence = ?", Vars: []interface{}{p.Fence}})
+	}
 	m.IncrementVersion()
-	err := db.WithContext(ctx).Clauses(clause.Where{
-		Exprs: []clause.Expression{clause.Expr{SQL: "version = ?", Vars: []interface{}{version}}}}).Save(m).Error
+	err := db.scoped(db.WithContext(ctx)).Clauses(clause.Where{Exprs: where}).Save(m).Error
 	if err != nil {
 		glog.Warningf("error saving model %s, error: %s, %+v", m.GetID(), err, m)
 		m.DecrementVersion()
 		return false
 	}
+	if i, ok := m.(*Item); ok {
+		db.notifyItems(ctx, i)
+	}
 	return true
 }
 
+// CreateItems inserts new items in a single statement, at version 1 as Save does. Items
+// without a status are created as Available, and items without a sequence are numbered in
+// the order given. Items must belong to the same tenant as their partition. Items whose
+// IdempotencyKey is already taken in their partition are handled according to the repo's
+// DuplicateItems policy. No item is created if they would take a partition or tenant past
+// its MaxPendingItems, see ErrQuotaExceeded, and none if any of them already exists, see
+// ErrVersionConflict.
+func (db *GormRepo) CreateItems(ctx context.Context, items ...*Item) error {
+	_, err := db.createItems(ctx, false, items...)
+	return err
+}
+
+// createItems is CreateItems, skipping the items whose IDs are taken if ignoreExisting is
+// set. It returns the number of items inserted.
+func (db *GormRepo) createItems(ctx context.Context, ignoreExisting bool, items ...*Item) (int, error) {
+	if len(items) == 0 {
+		return 0, nil
+	}
+	var (
+		inserted []*Item
+		rows     int64
+	)
+	for _, i := range items {
+		if err := db.assignID("item", i); err != nil {
+			return 0, err
+		}
+	}
+	create := func(tx *GormRepo) error {
+		for _, i := range items {
+			if err := tx.claimTenant(i); err != nil {
+				return err
+			}
+		}
+		if err := tx.checkItemTenants(ctx, items...); err != nil {
+			return err
+		}
+		var err error
+		if inserted, err = tx.dedupe(ctx, items); err != nil || len(inserted) == 0 {
+			return err
+		}
+		next := map[string]int64{}
+		for _, i := range inserted {
+			if i.Status == Unknown {
+				i.Status = Available
+			}
+			// A batch insert can't fall back to the column default for some rows only.
+			if i.Metadata == nil {
+				i.Metadata = ItemMetadata{}
+			}
+			if i.Sequence != 0 {
+				continue
+			}
+			if _, ok := next[i.PartitionID]; !ok {
+				seq, err := tx.nextSequence(ctx, i.PartitionID)
+				if err != nil {
+					return err
+				}
+				next[i.PartitionID] = seq
+			}
+			i.Sequence = next[i.PartitionID]
+			next[i.PartitionID]++
+		}
+		if err := tx.checkQuotas(ctx, inserted); err != nil {
+			return err
+		}
+		// The partitions' lease backoffs end, as they have work to do.
+		if err := tx.makeLeaseable(ctx, "id IN ?", itemPartitionIDs(inserted)); err != nil {
+			return err
+		}
+		created := false
+		for _, i := range inserted {
+			// Rows are inserted at version 1, as Save does, so that the first Save of an
+			// item updates it rather than creating it again.
+			i := i
+			i.Version = 1
+			defer func() {
+				if !created {
+					i.Version = 0
+				}
+			}()
+			restore, err := tx.prepare(ctx, i, tx.EncryptionKeyID)
+			if err != nil {
+				return err
+			}
+			defer func() { restore(created) }()
+		}
+		insert := tx.WithContext(ctx)
+		if ignoreExisting {
+			insert = insert.Clauses(clause.OnConflict{DoNothing: true})
+		}
+		res := insert.Create(&inserted)
+		rows = res.RowsAffected
+		created = res.Error == nil && int(rows) == len(inserted)
+		return res.Error
+	}
+	err := db.Transaction(ctx, create)
+	// A concurrent insert of the same idempotency key won the race, the next attempt finds it.
+	for n := 1; n < createAttempts && err != nil && isUniqueViolation(err) && hasIdempotencyKeys(items); n++ {
+		err = db.Transaction(ctx, create)
+	}
+	if err != nil && isUniqueViolation(err) {
+		return 0, &ErrVersionConflict{Kind: "item", ID: batchID(items)}
+	}
+	if err != nil {
+		return 0, err
+	}
+	if rows > 0 {
+		db.notifyItems(ctx, inserted...)
+	}
+	return int(rows), nil
+}
+
+// batchID names a batch of items in an error, by its first item.
+func batchID(items []*Item) string {
+	if len(items) == 1 {
+		return items[0].ID
+	}
+	return fmt.Sprintf("%s (or another of a batch of %d)", items[0].ID, len(items))
+}
+
 // Return the number of each item object by status.
 func (db *GormRepo) GetCountByStatus(ctx context.Context, id string) (map[Status]int, error) {
 	ctx, cancel := db.WithTimeout(ctx)
 	defer cancel()
-	rows, err := db.WithContext(ctx).Model(&Item{}).Select("status, COUNT(*)").Where("partition_id = ?", id).Group("status").Rows()
+	rows, err := db.scoped(db.reader(ctx).WithContext(ctx)).Model(&Item{}).Select("status, COUNT(*)").Where("partition_id = ?", id).Group("status").Rows()
 	if err != nil {
 		return nil, err
 	}
@@ -161,10 +575,76 @@ func (db *GormRepo) GetCountByStatus(ctx context.Context, id string) (map[Status
 	return leaseCounts, nil
 }
 
+// TxOptions are the options of a transaction started by TransactionWithOptions.
+type TxOptions struct {
+	// Isolation is the transaction's isolation level, the database's default if zero.
+	Isolation sql.IsolationLevel
+	// ReadOnly makes the transaction read only. SQL Server's driver refuses read only
+	// transactions, and SQLite ignores it.
+	ReadOnly bool
+}
+
+// savepoints numbers the savepoints of nested transactions, so that their names are unique.
+var savepoints uint64
+
+// Transaction calls f with a repo whose queries run in a transaction, committed unless f
+// returns an error, which is returned as is, e.g. an ErrNotFound. The repo's methods are bound
+// by the transaction's context, including its single timeout, rather than by the contexts they
+// are passed.
+//
+// Called on the repo of a transaction, f runs nested in that transaction rather than in a
+// new one, which would wait on the outer transaction's locks. If f fails, its writes are
+// rolled back to a savepoint taken before it, leaving the outer transaction's, on databases
+// that support savepoints; on others f shares the outer transaction, which the error should
+// then fail.
 func (db *GormRepo) Transaction(ctx context.Context, f func(db *GormRepo) error) error {
+	return db.TransactionWithOptions(ctx, TxOptions{}, f)
+}
+
+// TransactionWithOptions is Transaction, starting the transaction with the options. A nested
+// transaction runs with the options of the outer one.
+func (db *GormRepo) TransactionWithOptions(ctx context.Context, opts TxOptions, f func(db *GormRepo) error) error {
+	if db.txCtx != nil {
+		return db.nested(f)
+	}
 	ctx, cancel := db.WithTimeout(ctx)
 	defer cancel()
-	return db.WithContext(ctx).Transaction(func(gdb *gorm.DB) error {
-		return f(&GormRepo{DB: gdb, Timeout: db.Timeout})
-	})
+	pending := &pendingNotifications{}
+	err := db.WithContext(ctx).Transaction(func(gdb *gorm.DB) error {
+		tx := *db
+		tx.DB = gdb
+		tx.txCtx = ctx
+		tx.pending = pending
+		// Reads within the transaction must see its writes.
+		tx.ReadDB = nil
+		return f(&tx)
+	}, &sql.TxOptions{Isolation: opts.Isolation, ReadOnly: opts.ReadOnly})
+	if err == nil && db.Notifications != nil {
+		pending.publish(db.Notifications)
+	}
+	return err
+}
+
+// nested runs f in the repo's transaction, within a savepoint rolled back if f fails or
+// panics.
+func (db *GormRepo) nested(f func(db *GormRepo) error) (err error) {
+	if _, ok := db.Dialector.(gorm.SavePointerDialectorInterface); !ok {
+		return f(db)
+	}
+	name := fmt.Sprintf("sp%d", atomic.AddUint64(&savepoints, 1))
+	if err := db.WithContext(db.txCtx).SavePoint(name).Error; err != nil {
+		return err
+	}
+	panicked := true
+	defer func() {
+		if !panicked && err == nil {
+			return
+		}
+		if rollbackErr := db.WithContext(db.txCtx).RollbackTo(name).Error; rollbackErr != nil {
+			glog.Errorf("error rolling back to savepoint %s: %s", name, rollbackErr)
+		}
+	}()
+	err = f(db)
+	panicked = false
+	return err
 }
@@ -2,8 +2,10 @@ package state
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"testing"
+	"time"
 )
 
 func TestSave(t *testing.T) {
@@ -44,3 +46,159 @@ func TestTransaction(t *testing.T) {
 	}
 
 }
+
+func TestTransactionContext(t *testing.T) {
+	r := openTestRepo(t)
+	r.Timeout = 50 * time.Millisecond
+	err := r.Transaction(context.Background(), func(tx *GormRepo) error {
+		time.Sleep(100 * time.Millisecond)
+		// The call doesn't get a timeout of its own, past the transaction's.
+		_, err := tx.GetCountByStatus(context.Background(), "p")
+		return err
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the transaction's timeout to apply to its calls, got %v", err)
+	}
+}
+
+func TestTransactionTypedErrors(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	if err := r.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: "p"}}); err != nil {
+		t.Fatal(err)
+	}
+	err := r.Transaction(ctx, func(tx *GormRepo) error {
+		_, err := tx.GetItem(ctx, "missing")
+		return err
+	})
+	var notFound *ErrNotFound
+	if !errors.As(err, &notFound) || notFound.Kind != "item" || notFound.ID != "missing" {
+		t.Errorf("expected the item not to be found through the transaction, got %v", err)
+	}
+
+	err = r.Transaction(ctx, func(tx *GormRepo) error {
+		return tx.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	})
+	var conflict *ErrVersionConflict
+	if !errors.As(err, &conflict) || conflict.ID != "p" {
+		t.Errorf("expected a version conflict through the transaction, got %v", err)
+	}
+
+	err = r.Transaction(ctx, func(tx *GormRepo) error {
+		return tx.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: "q"}, DependsOn: "q"})
+	})
+	var invalid *ErrValidation
+	if !errors.As(err, &invalid) || invalid.Field != "depends_on" || !errors.Is(err, ErrDependencyCycle) {
+		t.Errorf("expected a dependency cycle through the transaction, got %v", err)
+	}
+
+	limit := 0
+	if err := r.SetPartitionMaxPendingItems(ctx, "p", &limit); err != nil {
+		t.Fatal(err)
+	}
+	err = r.Transaction(ctx, func(tx *GormRepo) error {
+		return tx.CreateItems(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Data: []byte(`{}`)})
+	})
+	var quota *ErrQuotaExceeded
+	if !errors.As(err, &quota) || quota.ID != "p" {
+		t.Errorf("expected the quota to be exceeded through the transaction, got %v", err)
+	}
+}
+
+func TestNestedTransaction(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	errInner := errors.New("inner")
+	err := r.Transaction(ctx, func(tx *GormRepo) error {
+		if err := tx.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: "p"}}); err != nil {
+			return err
+		}
+		// The nested transactions write through the outer one, rather than waiting on its lock.
+		if err := tx.Transaction(ctx, func(tx *GormRepo) error {
+			return tx.CreateItems(ctx, &Item{BaseModel: BaseModel{ID: "kept"}, PartitionID: "p", Data: []byte(`{}`)})
+		}); err != nil {
+			return err
+		}
+		err := tx.Transaction(ctx, func(tx *GormRepo) error {
+			if err := tx.CreateItems(ctx, &Item{BaseModel: BaseModel{ID: "rolled back"}, PartitionID: "p", Data: []byte(`{}`)}); err != nil {
+				return err
+			}
+			return errInner
+		})
+		if !errors.Is(err, errInner) {
+			t.Errorf("expected the inner error, got %v", err)
+		}
+		func() {
+			defer func() { recover() }()
+			tx.Transaction(ctx, func(tx *GormRepo) error {
+				tx.CreateItems(ctx, &Item{BaseModel: BaseModel{ID: "panicked"}, PartitionID: "p", Data: []byte(`{}`)})
+				panic("inner")
+			})
+		}()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GetItem(ctx, "kept"); err != nil {
+		t.Errorf("expected the item of the committed nested transaction, got %v", err)
+	}
+	for _, id := range []string{"rolled back", "panicked"} {
+		if _, err := r.GetItem(ctx, id); !IsNotFound(err) {
+			t.Errorf("expected item %q to be rolled back to its savepoint, got %v", id, err)
+		}
+	}
+
+	err = r.Transaction(ctx, func(tx *GormRepo) error {
+		if err := tx.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: "q"}}); err != nil {
+			return err
+		}
+		return tx.Transaction(ctx, func(tx *GormRepo) error {
+			return errInner
+		})
+	})
+	if !errors.Is(err, errInner) {
+		t.Errorf("expected the inner error to fail the transaction, got %v", err)
+	}
+	if _, err := r.GetPartition(ctx, "q"); !IsNotFound(err) {
+		t.Errorf("expected the failed transaction to be rolled back, got %v", err)
+	}
+}
+
+func TestTransactionWithOptions(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	opts := TxOptions{Isolation: sql.LevelSerializable}
+	err := r.TransactionWithOptions(ctx, opts, func(tx *GormRepo) error {
+		if err := tx.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: "p"}}); err != nil {
+			return err
+		}
+		// The nested transaction runs in the outer one, whatever its options.
+		return tx.TransactionWithOptions(ctx, TxOptions{ReadOnly: true}, func(tx *GormRepo) error {
+			_, err := tx.GetPartition(ctx, "p")
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GetPartition(ctx, "p"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNestedTransactionDeadline(t *testing.T) {
+	r := openTestRepo(t)
+	r.Timeout = 50 * time.Millisecond
+	err := r.Transaction(context.Background(), func(tx *GormRepo) error {
+		// The nested transaction doesn't get a timeout of its own either.
+		return tx.Transaction(context.Background(), func(tx *GormRepo) error {
+			time.Sleep(100 * time.Millisecond)
+			_, err := tx.GetCountByStatus(context.Background(), "p")
+			return err
+		})
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the outer transaction's timeout to apply to the nested one, got %v", err)
+	}
+}
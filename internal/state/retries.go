@@ -0,0 +1,109 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+	"gorm.io/gorm"
+)
+
+// RetryDecision is what the watcher does with an item that failed to process, see
+// Watcher.RetryClassifier. It is one of Retry, Fail or RetryAfter.
+type RetryDecision struct {
+	fail  bool
+	after time.Duration
+}
+
+var (
+	// Retry retries the item after the delay of the watcher's RetryPolicy.
+	Retry = RetryDecision{}
+	// Fail fails the item without retrying it.
+	Fail = RetryDecision{fail: true}
+)
+
+// RetryAfter retries the item once d has passed, in place of the RetryPolicy's delay. The
+// policy still decides when to give up on the item.
+func RetryAfter(d time.Duration) RetryDecision {
+	return RetryDecision{after: d}
+}
+
+func (d RetryDecision) String() string {
+	switch {
+	case d.fail:
+		return "fail"
+	case d.after > 0:
+		return fmt.Sprintf("retry after %s", d.after)
+	default:
+		return "retry"
+	}
+}
+
+// DefaultRetryClassifier retries every error except those of NonRetryableError, see
+// IsRetryable.
+func DefaultRetryClassifier(err error) RetryDecision {
+	if IsRetryable(err) {
+		return Retry
+	}
+	return Fail
+}
+
+// classify returns the decision of the watcher's RetryClassifier for the processor's error.
+func (w *Watcher) classify(err error) RetryDecision {
+	if w.RetryClassifier == nil {
+		return DefaultRetryClassifier(err)
+	}
+	return w.RetryClassifier(err)
+}
+
+// CountDelayedItems returns the number of Available items at the partition's gate whose
+// RetryAt is yet to come, which GetAvailableItems skips.
+func (db *GormRepo) CountDelayedItems(ctx context.Context, p *Partition) (int, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	var count int64
+	err := db.scoped(db.WithContext(ctx)).Model(&Item{}).Where(
+		"partition_id = ? AND status = ? AND gate = ? AND retry_at > ?", p.ID, Available, p.Gate, clock.Or(db.Clock).Now()).Count(&count).Error
+	return int(count), err
+}
+
+// maxRetries returns the number of retries the item is allowed, if set: its own MaxRetries,
+// else its partition's. Otherwise the watcher's RetryPolicy decides.
+func (i *Item) maxRetries() (int, bool) {
+	if i.MaxRetries != nil {
+		return *i.MaxRetries, true
+	}
+	if i.partition.maxRetries != nil {
+		return *i.partition.maxRetries, true
+	}
+	return 0, false
+}
+
+// SetPartitionMaxRetries sets the MaxRetries of the partition, or clears it if nil.
+func (db *GormRepo) SetPartitionMaxRetries(ctx context.Context, id string, maxRetries *int) error {
+	return db.setLimit(ctx, &Partition{}, "partition", id, "max_retries", maxRetries)
+}
+
+// SetItemMaxRetries sets the MaxRetries of the item, or clears it if nil.
+func (db *GormRepo) SetItemMaxRetries(ctx context.Context, id string, maxRetries *int) error {
+	return db.setLimit(ctx, &Item{}, "item", id, "max_retries", maxRetries)
+}
+
+// setLimit sets an optional limit column of the partition or item, or clears it if nil.
+func (db *GormRepo) setLimit(ctx context.Context, model interface{}, kind, id, column string, limit *int) error {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	res := db.scoped(db.WithContext(ctx)).Model(model).Where("id = ?", id).Updates(map[string]interface{}{
+		column:       limit,
+		"version":    gorm.Expr("version + 1"),
+		"updated_at": clock.Or(db.Clock).Now(),
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return &ErrNotFound{Kind: kind, ID: id}
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingProcessor fails every attempt with a retryable error.
+type failingProcessor struct {
+	testProcessor
+	mu       sync.Mutex
+	attempts int
+}
+
+func (p *failingProcessor) Process(id string, b []byte) (*ProcessorResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.attempts++
+	return nil, errors.New("downstream unavailable")
+}
+
+func (p *failingProcessor) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.attempts
+}
+
+func retries(n int) *int {
+	return &n
+}
+
+func TestMaxRetriesPrecedence(t *testing.T) {
+	defer func(max int) { MaxRetries = max }(MaxRetries)
+	for _, tc := range []struct {
+		name       string
+		pkg        int
+		partition  *int
+		item       *int
+		wantFailed int
+	}{
+		{name: "package", pkg: 5, wantFailed: 6},
+		{name: "partition", pkg: 5, partition: retries(2), wantFailed: 3},
+		{name: "item", pkg: 5, partition: retries(2), item: retries(1), wantFailed: 2},
+		{name: "item without retries", pkg: 5, partition: retries(2), item: retries(0), wantFailed: 1},
+		{name: "infinite package", pkg: -1},
+		{name: "infinite partition", pkg: 5, partition: retries(-1)},
+		{name: "infinite item", pkg: 5, partition: retries(2), item: retries(-1)},
+		{name: "item over infinite partition", pkg: -1, partition: retries(-1), item: retries(3), wantFailed: 4},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			MaxRetries = tc.pkg
+			r := openTestRepo(t)
+			ctx := context.Background()
+			p := &Partition{BaseModel: BaseModel{ID: "p"}, MaxRetries: tc.partition}
+			r.Save(ctx, p)
+			r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", MaxRetries: tc.item, Data: []byte(`{}`)})
+			w := &Watcher{Processor: &failingProcessor{}, Repo: r, MaxGateSkip: 1}
+			w.init()
+
+			// Past every finite limit, items allowed to retry indefinitely are still Available.
+			failedAt := 0
+			for attempt := 1; attempt <= 10 && failedAt == 0; attempt++ {
+				i, err := r.GetItem(ctx, "i")
+				if err != nil {
+					t.Fatal(err)
+				}
+				i.partition = p.config()
+				w.processItem(ctx, i)
+				if i.Status == Failed {
+					failedAt = attempt
+				}
+			}
+			if failedAt != tc.wantFailed {
+				t.Errorf("expected the item to fail on attempt %d, got %d", tc.wantFailed, failedAt)
+			}
+		})
+	}
+}
+
+func TestPartitionMaxRetries(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}, MaxRetries: retries(1)})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Data: []byte(`{}`)})
+
+	proc := &failingProcessor{}
+	runForEvents(t, r, &Watcher{Processor: proc, Repo: r, BatchSize: 1, PollInterval: 10 * time.Millisecond, AutoClose: true})
+
+	if proc.attempts != 2 {
+		t.Errorf("expected the partition's retries to apply, got %d attempts", proc.attempts)
+	}
+}
+
+func TestSetMaxRetries(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", MaxRetries: retries(3), Data: []byte(`{}`)})
+
+	if err := r.SetPartitionMaxRetries(ctx, "p", retries(-1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetItemMaxRetries(ctx, "i", nil); err != nil {
+		t.Fatal(err)
+	}
+	p, err := r.GetPartition(ctx, "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := r.GetItem(ctx, "i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.MaxRetries == nil || *p.MaxRetries != -1 || i.MaxRetries != nil {
+		t.Errorf("expected the partition to retry indefinitely and the item to inherit it, got %+v and %+v", p, i)
+	}
+	if err := r.SetItemMaxRetries(ctx, "missing", nil); !IsNotFound(err) {
+		t.Errorf("expected a missing item to be not found, got %v", err)
+	}
+}
+
+// constraintError stands in for a driver's error type that a RetryClassifier recognises.
+type constraintError struct {
+	constraint string
+}
+
+func (e *constraintError) Error() string {
+	return "violates constraint " + e.constraint
+}
+
+// classifiedProcessor fails the items with the error of their ID, recording when.
+type classifiedProcessor struct {
+	testProcessor
+	errs map[string]error
+
+	mu       sync.Mutex
+	attempts []time.Time
+}
+
+func (p *classifiedProcessor) Process(id string, b []byte) (*ProcessorResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.attempts = append(p.attempts, time.Now())
+	if err := p.errs[id]; err != nil {
+		return nil, err
+	}
+	return &ProcessorResponse{Complete: true, Data: b}, nil
+}
+
+func TestRetryClassifier(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	proc := &classifiedProcessor{errs: map[string]error{
+		"constraint":    fmt.Errorf("error inserting the report: %w", &constraintError{"reports_pk"}),
+		"timeout":       errors.New("timeout"),
+		"non-retryable": NonRetryableError("bad input"),
+		"throttled":     errors.New("throttled"),
+	}}
+	w := &Watcher{Processor: proc, Repo: r, MaxGateSkip: 1, RetryClassifier: func(err error) RetryDecision {
+		var cerr *constraintError
+		switch {
+		case errors.As(err, &cerr):
+			return Fail
+		case err.Error() == "throttled":
+			return RetryAfter(time.Hour)
+		}
+		return Retry
+	}}
+	w.init()
+
+	for _, tc := range []struct {
+		id         string
+		wantStatus Status
+		wantDelay  bool
+	}{
+		{id: "constraint", wantStatus: Failed},
+		{id: "timeout", wantStatus: Available},
+		// The classifier takes precedence over IsRetryable.
+		{id: "non-retryable", wantStatus: Available},
+		{id: "throttled", wantStatus: Available, wantDelay: true},
+	} {
+		t.Run(tc.id, func(t *testing.T) {
+			r.Save(ctx, &Item{BaseModel: BaseModel{ID: tc.id}, PartitionID: "p", Data: []byte(`{}`)})
+			i, err := r.GetItem(ctx, tc.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.processItem(ctx, i)
+			if i, err = r.GetItem(ctx, tc.id); err != nil {
+				t.Fatal(err)
+			}
+			if i.Status != tc.wantStatus || i.RetryCount != 1 {
+				t.Errorf("expected the item to be %s after 1 retry, got %s after %d", tc.wantStatus, i.Status, i.RetryCount)
+			}
+			if delayed := i.RetryAt != nil && i.RetryAt.After(time.Now()); delayed != tc.wantDelay {
+				t.Errorf("expected the retry to be delayed: %t, got retry at %v", tc.wantDelay, i.RetryAt)
+			}
+		})
+	}
+
+	items, err := r.GetAvailableItems(ctx, &Partition{BaseModel: BaseModel{ID: "p"}}, 10, OrderByUpdatedAt, AnyItems)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].ID == "throttled" || items[1].ID == "throttled" {
+		t.Errorf("expected the throttled item to wait for its retry, got %v", items)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Data: []byte(`{}`)})
+
+	delay := 300 * time.Millisecond
+	proc := &classifiedProcessor{errs: map[string]error{"i": errors.New("throttled")}}
+	var classified int
+	w := &Watcher{Processor: proc, Repo: r, BatchSize: 1, PollInterval: 10 * time.Millisecond, AutoClose: true, RetryClassifier: func(err error) RetryDecision {
+		classified++
+		if classified == 1 {
+			return RetryAfter(delay)
+		}
+		return Fail
+	}}
+	runForEvents(t, r, w)
+
+	if len(proc.attempts) != 2 {
+		t.Fatalf("expected 2 attempts, got %d", len(proc.attempts))
+	}
+	if waited := proc.attempts[1].Sub(proc.attempts[0]); waited < delay {
+		t.Errorf("expected the retry to wait %s, got %s", delay, waited)
+	}
+	i, err := r.GetItem(ctx, "i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Status != Failed || i.RetryAt != nil {
+		t.Errorf("expected the item to fail without a retry time, got %+v", i)
+	}
+}
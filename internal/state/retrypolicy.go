@@ -0,0 +1,112 @@
+package state
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy decides when the watcher retries an item whose processing failed, and when it
+// gives up on it, see Watcher.RetryPolicy.
+type RetryPolicy interface {
+	// NextDelay returns how long to wait before retrying an item whose attempt failed with
+	// err, with attempt counting the failed attempts from 1, or false to fail the item.
+	NextDelay(attempt int, err error) (time.Duration, bool)
+}
+
+// Fixed retries items after the same Delay, up to MaxRetries times, or indefinitely if
+// negative. The default policy retries immediately up to the package's MaxRetries.
+type Fixed struct {
+	Delay      time.Duration
+	MaxRetries int
+}
+
+// NextDelay returns the fixed delay, until the retries run out.
+func (f Fixed) NextDelay(attempt int, err error) (time.Duration, bool) {
+	return f.Delay, retriesLeft(attempt, f.MaxRetries)
+}
+
+// DefaultMultiplier is the factor by which Exponential delays grow by default.
+const DefaultMultiplier = 2
+
+// Exponential retries items Immediate times without delay, then after Initial, multiplying
+// the delay by Multiplier after each attempt, up to Max if set. Items are retried up to
+// MaxRetries times in all, or indefinitely if negative.
+type Exponential struct {
+	Immediate int
+	Initial   time.Duration
+	Max       time.Duration
+	// Multiplier defaults to DefaultMultiplier.
+	Multiplier float64
+	// Jitter randomly shortens each delay by up to this fraction of it, between 0 and 1, so
+	// that items failing together don't all retry together.
+	Jitter     float64
+	MaxRetries int
+}
+
+// NextDelay returns the exponential delay for the attempt, until the retries run out.
+func (e Exponential) NextDelay(attempt int, err error) (time.Duration, bool) {
+	if !retriesLeft(attempt, e.MaxRetries) {
+		return 0, false
+	}
+	if attempt <= e.Immediate {
+		return 0, true
+	}
+	multiplier := e.Multiplier
+	if multiplier == 0 {
+		multiplier = DefaultMultiplier
+	}
+	delay := float64(e.Initial) * math.Pow(multiplier, float64(attempt-e.Immediate-1))
+	if e.Max > 0 && delay > float64(e.Max) {
+		delay = float64(e.Max)
+	}
+	delay -= delay * e.Jitter * rand.Float64()
+	// Durations past the range of an int64 overflow rather than saturate.
+	if delay >= math.MaxInt64 {
+		return math.MaxInt64, true
+	}
+	return time.Duration(delay), true
+}
+
+// NoRetry fails items on their first error.
+type NoRetry struct{}
+
+// NextDelay always gives up.
+func (NoRetry) NextDelay(attempt int, err error) (time.Duration, bool) {
+	return 0, false
+}
+
+// retriesLeft returns whether an item may be retried after the given failed attempt, up to
+// maxRetries times or indefinitely if negative.
+func retriesLeft(attempt, maxRetries int) bool {
+	return maxRetries < 0 || attempt <= maxRetries
+}
+
+// retryPolicy returns the watcher's RetryPolicy, or the default Fixed policy.
+func (w *Watcher) retryPolicy() RetryPolicy {
+	if w.RetryPolicy == nil {
+		return Fixed{MaxRetries: MaxRetries}
+	}
+	return w.RetryPolicy
+}
+
+// retryDecision applies the watcher's RetryPolicy to the decision for the item's error. A
+// delay from RetryAfter takes precedence over the policy's, and the MaxRetries of the item or
+// its partition, if set, over when the policy gives up.
+func (w *Watcher) retryDecision(i *Item, err error, d RetryDecision) RetryDecision {
+	if d.fail {
+		return d
+	}
+	attempt := i.RetryCount + 1
+	delay, ok := w.retryPolicy().NextDelay(attempt, err)
+	if maxRetries, set := i.maxRetries(); set {
+		ok = retriesLeft(attempt, maxRetries)
+	}
+	if !ok {
+		return Fail
+	}
+	if d.after == 0 {
+		d.after = delay
+	}
+	return d
+}
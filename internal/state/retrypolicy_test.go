@@ -0,0 +1,168 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+)
+
+type delay struct {
+	d  time.Duration
+	ok bool
+}
+
+func nextDelays(p RetryPolicy, attempts int) []delay {
+	var delays []delay
+	for attempt := 1; attempt <= attempts; attempt++ {
+		d, ok := p.NextDelay(attempt, errors.New("test error"))
+		delays = append(delays, delay{d, ok})
+	}
+	return delays
+}
+
+func TestRetryPolicies(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy RetryPolicy
+		want   []delay
+	}{
+		{name: "fixed", policy: Fixed{Delay: time.Second, MaxRetries: 2}, want: []delay{{time.Second, true}, {time.Second, true}, {0, false}}},
+		{name: "fixed indefinitely", policy: Fixed{MaxRetries: -1}, want: []delay{{0, true}, {0, true}, {0, true}}},
+		{name: "no retry", policy: NoRetry{}, want: []delay{{0, false}}},
+		{name: "exponential", policy: Exponential{Initial: time.Second, MaxRetries: 4}, want: []delay{
+			{time.Second, true}, {2 * time.Second, true}, {4 * time.Second, true}, {8 * time.Second, true}, {0, false}}},
+		{name: "exponential capped", policy: Exponential{Initial: time.Second, Max: 5 * time.Second, Multiplier: 3, MaxRetries: -1}, want: []delay{
+			{time.Second, true}, {3 * time.Second, true}, {5 * time.Second, true}, {5 * time.Second, true}}},
+		{name: "immediate then exponential", policy: Exponential{Immediate: 3, Initial: time.Minute, Max: time.Hour, MaxRetries: -1}, want: []delay{
+			{0, true}, {0, true}, {0, true}, {time.Minute, true}, {2 * time.Minute, true}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := nextDelays(tc.policy, len(tc.want))
+			for n := range tc.want {
+				if got[n].ok != tc.want[n].ok || (got[n].ok && got[n].d != tc.want[n].d) {
+					t.Errorf("expected attempt %d to retry after %+v, got %+v", n+1, tc.want[n], got[n])
+				}
+			}
+		})
+	}
+}
+
+func TestExponentialJitter(t *testing.T) {
+	p := Exponential{Initial: time.Second, Jitter: 0.5, MaxRetries: -1}
+	varied := false
+	for n := 0; n < 100; n++ {
+		d, _ := p.NextDelay(3, nil)
+		if d <= 2*time.Second || d > 4*time.Second {
+			t.Fatalf("expected a delay within half of 4s, got %s", d)
+		}
+		varied = varied || d != 4*time.Second
+	}
+	if !varied {
+		t.Error("expected jitter to vary the delay")
+	}
+	if d, ok := (Exponential{Initial: time.Hour, MaxRetries: -1}).NextDelay(100, nil); !ok || d != math.MaxInt64 {
+		t.Errorf("expected the delay to saturate, got %s", d)
+	}
+}
+
+func TestRetryDecision(t *testing.T) {
+	defer func(max int) { MaxRetries = max }(MaxRetries)
+	MaxRetries = 2
+	for _, tc := range []struct {
+		name     string
+		policy   RetryPolicy
+		item     *int
+		retries  int
+		decision RetryDecision
+		want     RetryDecision
+	}{
+		{name: "default policy", retries: 1, decision: Retry, want: Retry},
+		{name: "default policy exhausted", retries: 2, decision: Retry, want: Fail},
+		{name: "classified as failed", policy: Fixed{MaxRetries: -1}, decision: Fail, want: Fail},
+		{name: "policy delay", policy: Fixed{Delay: time.Minute, MaxRetries: 1}, decision: Retry, want: RetryAfter(time.Minute)},
+		{name: "classifier delay", policy: Fixed{Delay: time.Minute, MaxRetries: 1}, decision: RetryAfter(time.Hour), want: RetryAfter(time.Hour)},
+		{name: "policy exhausted", policy: Fixed{Delay: time.Minute, MaxRetries: 1}, retries: 1, decision: RetryAfter(time.Hour), want: Fail},
+		{name: "item retries past the policy", policy: NoRetry{}, item: retries(3), retries: 2, decision: Retry, want: Retry},
+		{name: "item retries within the policy", policy: Fixed{Delay: time.Minute, MaxRetries: -1}, item: retries(3), retries: 3, decision: Retry, want: Fail},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := &Watcher{RetryPolicy: tc.policy}
+			i := &Item{RetryCount: tc.retries, MaxRetries: tc.item}
+			if got := w.retryDecision(i, errors.New("test error"), tc.decision); got != tc.want {
+				t.Errorf("expected to %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDelays(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Data: []byte(`{}`)})
+	c := clock.NewFake(time.Now())
+	r.Clock = c
+	proc := &failingProcessor{}
+	w := &Watcher{
+		Processor:     proc,
+		Repo:          r,
+		BatchSize:     1,
+		PollInterval:  10 * time.Second,
+		LeaseInterval: 10 * time.Second,
+		LeaseDuration: time.Hour,
+		Clock:         c,
+		RetryPolicy:   Exponential{Initial: time.Minute, MaxRetries: 2},
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		w.Start(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Each failed attempt is saved before the clock moves on, so that its delay starts from
+	// the time it was processed.
+	waitRetries := func(n int) {
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+			if i, err := r.GetItem(context.Background(), "i"); err == nil && i.RetryCount == n {
+				c.BlockUntil(4)
+				return
+			}
+		}
+		t.Fatalf("expected %d failed attempts, got %d", n, proc.count())
+	}
+	advance := func(d time.Duration) {
+		for n := time.Duration(0); n < d; n += 10 * time.Second {
+			c.Advance(10 * time.Second)
+			c.BlockUntil(4)
+		}
+	}
+
+	waitRetries(1)
+	advance(50 * time.Second)
+	if proc.count() != 1 {
+		t.Errorf("expected no retry within the first minute, got %d attempts", proc.count())
+	}
+	advance(10 * time.Second)
+	waitRetries(2)
+	advance(110 * time.Second)
+	if proc.count() != 2 {
+		t.Errorf("expected no retry within the next 2 minutes, got %d attempts", proc.count())
+	}
+	advance(10 * time.Second)
+	waitRetries(3)
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		if i, err := r.GetItem(context.Background(), "i"); err == nil && i.Status == Failed {
+			return
+		}
+	}
+	t.Error("expected the item to fail once the policy gave up")
+}
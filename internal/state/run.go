@@ -0,0 +1,133 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// DefaultMaxRepoOutage is how long the repo may fail every call of a watcher before Run gives
+// up, by default.
+var DefaultMaxRepoOutage = 5 * time.Minute
+
+// ErrRepoUnreachable is the fatal error of a watcher whose repo failed every call for its
+// MaxRepoOutage.
+var ErrRepoUnreachable = errors.New("repo unreachable")
+
+// ErrInvalidConfig is the sentinel error of the ErrValidation returned by Run when a field of
+// the watcher is invalid.
+var ErrInvalidConfig = errors.New("invalid watcher config")
+
+// Run runs the watcher until ctx is done, returning nil, or until a fatal error stops it,
+// returning the error once its leases are released: an ErrValidation of ErrInvalidConfig if a
+// field is invalid, before anything is started, ErrRepoUnreachable once the repo failed for
+// the MaxRepoOutage, or an ErrValidation of the repo, as retrying the call fails the same way.
+// Other errors are transient: they are logged, and the call is retried on the next poll or
+// scan. Sets some defaults if not set. A watcher may only be run once.
+func (w *Watcher) Run(ctx context.Context) error {
+	defer func() {
+		if w.events != nil {
+			close(w.events)
+		}
+	}()
+	if err := w.validate(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w.mu.Lock()
+	w.stopRun = cancel
+	w.mu.Unlock()
+
+	w.init()
+	// Startup counts as progress, so that a freshly started watcher is live.
+	atomic.StoreInt64(&w.counters.lastLeaseScan, w.Clock.Now().UnixNano())
+	atomic.StoreInt64(&w.counters.lastItemSave, w.Clock.Now().UnixNano())
+	w.watch(ctx)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.fatalErr
+}
+
+// validate returns an ErrValidation of ErrInvalidConfig for the first invalid field of the
+// watcher, if any.
+func (w *Watcher) validate() error {
+	invalid := func(field, reason string) error {
+		return &ErrValidation{Field: field, Reason: reason, Err: ErrInvalidConfig}
+	}
+	switch {
+	case w.Repo == nil:
+		return invalid("Repo", "not set")
+	case w.Processor == nil:
+		return invalid("Processor", "not set")
+	case w.BatchSize < 0:
+		return invalid("BatchSize", "negative")
+	case w.MaxInFlightPerPartition < 0:
+		return invalid("MaxInFlightPerPartition", "negative")
+	case w.AdaptiveBatch.enabled() && w.AdaptiveBatch.MinBatch > w.AdaptiveBatch.MaxBatch:
+		return invalid("AdaptiveBatch", "MinBatch above MaxBatch")
+	case w.FailureTolerance < 0 || w.FailureTolerance > 1:
+		return invalid("FailureTolerance", "not between 0 and 1")
+	case w.FetchPolicy.Mode < FetchAll || w.FetchPolicy.Mode > Interleaved:
+		return invalid("FetchPolicy", fmt.Sprintf("unknown mode %d", w.FetchPolicy.Mode))
+	case w.PollInterval < 0:
+		return invalid("PollInterval", "negative")
+	case w.LeaseInterval < 0:
+		return invalid("LeaseInterval", "negative")
+	case w.LeaseDuration < 0:
+		return invalid("LeaseDuration", "negative")
+	case w.SettleInterval < 0:
+		return invalid("SettleInterval", "negative")
+	}
+	return nil
+}
+
+// fail stops the watcher with the fatal error, unless it already stopped with another.
+func (w *Watcher) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.fatalErr != nil {
+		return
+	}
+	glog.Errorf("stopping watcher %s on fatal error: %s", w.OwnerID, err)
+	w.fatalErr = err
+	if w.stopRun != nil {
+		w.stopRun()
+	}
+}
+
+// repoFailed classifies an error of the repo. Validation errors are fatal, as are the errors
+// of a repo which failed every call since more than the MaxRepoOutage; the others are
+// transient. Errors of calls cut short by the end of ctx are ignored.
+func (w *Watcher) repoFailed(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	if IsValidation(err) {
+		w.fail(err)
+		return
+	}
+	now := w.Clock.Now()
+	since := atomic.LoadInt64(&w.counters.repoOutageStart)
+	if since == 0 {
+		atomic.CompareAndSwapInt64(&w.counters.repoOutageStart, 0, now.UnixNano())
+		return
+	}
+	max := w.MaxRepoOutage
+	if max == 0 {
+		max = DefaultMaxRepoOutage
+	}
+	if outage := now.Sub(time.Unix(0, since)); max > 0 && outage > max {
+		w.fail(fmt.Errorf("%w for %s: %w", ErrRepoUnreachable, outage.Round(time.Millisecond), err))
+	}
+}
+
+// repoReached ends the outage of the repo, if any.
+func (w *Watcher) repoReached() {
+	atomic.StoreInt64(&w.counters.repoOutageStart, 0)
+}
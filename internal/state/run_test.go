@@ -0,0 +1,98 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unreachableRepo fails every scan for potential leases with err.
+type unreachableRepo struct {
+	*GormRepo
+	err error
+}
+
+func (r *unreachableRepo) GetPotentialLeases(ctx context.Context, selector map[string]string) ([]*Partition, error) {
+	return nil, r.err
+}
+
+// runWithin runs the watchers with RunAll, failing the test unless they stop within a while.
+func runWithin(t *testing.T, ctx context.Context, watchers ...*Watcher) error {
+	done := make(chan error, 1)
+	go func() { done <- RunAll(ctx, watchers...) }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("watchers did not stop")
+		return nil
+	}
+}
+
+func TestRunInvalidConfig(t *testing.T) {
+	r := openTestRepo(t)
+	for _, w := range []*Watcher{
+		{Repo: r},
+		{Repo: r, Processor: &testProcessor{}, FailureTolerance: 2},
+		{Repo: r, Processor: &testProcessor{}, AdaptiveBatch: AdaptiveBatch{MinBatch: 4, MaxBatch: 2}},
+	} {
+		events := w.Events()
+		err := w.Run(context.Background())
+		if !IsValidation(err) || !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("expected an invalid config error, got %v", err)
+		}
+		if _, ok := <-events; ok {
+			t.Errorf("expected the events to be closed")
+		}
+	}
+}
+
+func TestRunCleanShutdown(t *testing.T) {
+	r := openTestRepo(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Watcher{Processor: &testProcessor{}, Repo: r, PollInterval: 5 * time.Millisecond}
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if err := runWithin(t, ctx, w); err != nil {
+		t.Errorf("expected a clean shutdown, got %v", err)
+	}
+}
+
+func TestRunFatalErrors(t *testing.T) {
+	transient := errors.New("connection refused")
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"outage", transient, ErrRepoUnreachable},
+		{"validation", &ErrValidation{Field: "selector", Reason: "malformed"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := openTestRepo(t)
+			healthy := &Watcher{OwnerID: "healthy", Processor: &testProcessor{}, Repo: r, PollInterval: 5 * time.Millisecond}
+			failing := &Watcher{OwnerID: "failing", Processor: &testProcessor{}, Repo: &unreachableRepo{GormRepo: r, err: tt.err},
+				PollInterval: 5 * time.Millisecond, MaxRepoOutage: 50 * time.Millisecond}
+			err := runWithin(t, context.Background(), healthy, failing)
+			if !errors.Is(err, tt.err) || !strings.HasPrefix(err.Error(), "watcher failing: ") {
+				t.Fatalf("expected the failing watcher's error, got %v", err)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestRunTransientErrors(t *testing.T) {
+	r := openTestRepo(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Watcher{Processor: &testProcessor{}, Repo: &unreachableRepo{GormRepo: r, err: errors.New("connection refused")},
+		PollInterval: 5 * time.Millisecond, MaxRepoOutage: -1}
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if err := runWithin(t, ctx, w); err != nil {
+		t.Errorf("expected transient errors to be retried until shutdown, got %v", err)
+	}
+}
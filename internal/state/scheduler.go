@@ -0,0 +1,160 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+	"github.com/golang/glog"
+	"github.com/robfig/cron/v3"
+)
+
+// DefaultScheduleIDFormat is the layout of the occurrences in the IDs of scheduled partitions.
+const DefaultScheduleIDFormat = "2006-01-02T15:04"
+
+// DefaultScheduleLead is how long before its occurrence a scheduled partition is created.
+const DefaultScheduleLead = time.Hour
+
+// ParseSchedule parses a standard cron expression of five fields, e.g. "0 2 * * *" for 02:00
+// every day, or a descriptor such as "@daily".
+func ParseSchedule(expr string) (cron.Schedule, error) {
+	return cron.ParseStandard(expr)
+}
+
+// Scheduler creates the partitions of a recurring schedule ahead of time, each with an
+// ActivateAt of its occurrence, so that watchers only lease it from then on. Partitions are
+// named after their occurrences, so that the schedulers of several replicas create each one
+// once, along with clones of Items. Occurrences missed while no scheduler was running aren't
+// created afterwards.
+type Scheduler struct {
+	Repo WatcherRepo
+	// Schedule is a cron expression, see ParseSchedule, evaluated in Location, UTC by default.
+	Schedule string
+	Location *time.Location
+	// Template is copied for each occurrence's partition, e.g. with labels matching the
+	// watchers' selector. Its ID is replaced with IDPrefix followed by the occurrence, in
+	// Location, formatted with IDFormat, which defaults to DefaultScheduleIDFormat.
+	Template Partition
+	IDPrefix string
+	IDFormat string
+	// Items, if any, are cloned into each occurrence's partition, with IDs of the partition's
+	// followed by the template's.
+	Items []*Item
+	// Lead is how long before its occurrence each partition is created. Defaults to
+	// DefaultScheduleLead.
+	Lead time.Duration
+	// RetryInterval is how long to wait after failing to create a partition. Defaults to
+	// DefaultPollInterval.
+	RetryInterval time.Duration
+	// Clock defaults to the real time, and is overridden in tests.
+	Clock clock.Clock
+}
+
+// Start creates the partitions of each occurrence until ctx is done.
+func (s *Scheduler) Start(ctx context.Context) error {
+	sched, err := ParseSchedule(s.Schedule)
+	if err != nil {
+		return err
+	}
+	if s.RetryInterval == 0 {
+		s.RetryInterval = DefaultPollInterval
+	}
+	s.Clock = clock.Or(s.Clock)
+	for {
+		wait := s.RetryInterval
+		if next, err := s.schedule(ctx, sched); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			glog.Errorf("error scheduling partitions of %q: %s", s.Schedule, err)
+		} else {
+			wait = next.Sub(s.Clock.Now())
+		}
+		select {
+		case <-s.Clock.After(wait):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// CreateDue creates the partitions of the coming occurrences due within the Lead, returning
+// when the next one is due to be created.
+func (s *Scheduler) CreateDue(ctx context.Context) (time.Time, error) {
+	sched, err := ParseSchedule(s.Schedule)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return s.schedule(ctx, sched)
+}
+
+func (s *Scheduler) schedule(ctx context.Context, sched cron.Schedule) (time.Time, error) {
+	lead := s.Lead
+	if lead == 0 {
+		lead = DefaultScheduleLead
+	}
+	loc := s.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	now := clock.Or(s.Clock).Now().In(loc)
+	next := sched.Next(now)
+	for !next.Add(-lead).After(now) {
+		if err := s.create(ctx, next); err != nil {
+			return time.Time{}, err
+		}
+		next = sched.Next(next)
+	}
+	return next.Add(-lead), nil
+}
+
+// PartitionID returns the ID of the partition of the occurrence.
+func (s *Scheduler) PartitionID(occurrence time.Time) string {
+	format := s.IDFormat
+	if format == "" {
+		format = DefaultScheduleIDFormat
+	}
+	if s.Location != nil {
+		occurrence = occurrence.In(s.Location)
+	} else {
+		occurrence = occurrence.UTC()
+	}
+	return s.IDPrefix + occurrence.Format(format)
+}
+
+// create creates the partition of the occurrence and its items in a transaction, unless it
+// already exists.
+func (s *Scheduler) create(ctx context.Context, occurrence time.Time) error {
+	id := s.PartitionID(occurrence)
+	if _, err := s.Repo.GetPartition(ctx, id); err == nil || !IsNotFound(err) {
+		return err
+	}
+	p := s.Template
+	p.BaseModel = BaseModel{ID: id}
+	activateAt := occurrence
+	p.ActivateAt = &activateAt
+	items := make([]*Item, len(s.Items))
+	for n, tmpl := range s.Items {
+		i := *tmpl
+		i.BaseModel = BaseModel{ID: id + "-" + tmpl.ID}
+		i.PartitionID = id
+		i.Sequence = 0
+		items[n] = &i
+	}
+	err := s.Repo.Transaction(ctx, func(tx *GormRepo) error {
+		if err := tx.CreatePartition(ctx, &p); err != nil {
+			return err
+		}
+		return tx.CreateItems(ctx, items...)
+	})
+	if err == nil {
+		glog.Infof("scheduled partition %s to activate at %s", id, occurrence)
+		return nil
+	}
+	// Another replica's scheduler may have created it first.
+	if _, getErr := s.Repo.GetPartition(ctx, id); getErr == nil {
+		return nil
+	}
+	return fmt.Errorf("error creating partition %s: %w", id, err)
+}
@@ -0,0 +1,132 @@
+package state
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+)
+
+func leaseable(t *testing.T, r *GormRepo, id string) bool {
+	t.Helper()
+	partitions, err := r.GetPotentialLeases(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range partitions {
+		if p.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSchedulerActivation(t *testing.T) {
+	r := openTestRepo(t)
+	c := clock.NewFake(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC))
+	r.Clock = c
+	s := &Scheduler{
+		Repo:     r,
+		Schedule: "0 2 * * *",
+		Template: Partition{Labels: PartitionLabels{"report": "daily"}},
+		IDPrefix: "daily-report-",
+		IDFormat: "2006-01-02",
+		Items:    []*Item{{BaseModel: BaseModel{ID: "summary"}, Data: []byte(`{"kind":"summary"}`)}},
+		Lead:     time.Hour,
+		Clock:    c,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.Start(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	c.BlockUntil(1)
+	if _, err := r.GetPartition(ctx, "daily-report-2024-05-01"); !IsNotFound(err) {
+		t.Fatalf("expected the partition not to be created more than the lead ahead, got %v", err)
+	}
+
+	c.Advance(time.Hour)
+	c.BlockUntil(1)
+	p, err := r.GetPartition(ctx, "daily-report-2024-05-01")
+	if err != nil {
+		t.Fatalf("expected the partition to be created the lead ahead, got %v", err)
+	}
+	if want := time.Date(2024, 5, 1, 2, 0, 0, 0, time.UTC); p.ActivateAt == nil || !p.ActivateAt.Equal(want) || p.Labels["report"] != "daily" {
+		t.Errorf("expected a partition from the template activating at %s, got %+v", want, p)
+	}
+	if i, err := r.GetItem(ctx, "daily-report-2024-05-01-summary"); err != nil || i.PartitionID != p.ID || i.Status != Available {
+		t.Errorf("expected the template item to be cloned, got %+v %v", i, err)
+	}
+	if leaseable(t, r, p.ID) {
+		t.Error("expected the partition not to be leased before its activation")
+	}
+
+	c.Advance(time.Hour)
+	if !leaseable(t, r, p.ID) {
+		t.Error("expected the partition to be leased once active")
+	}
+
+	// The next occurrence is created a day later.
+	c.BlockUntil(1)
+	c.Advance(23 * time.Hour)
+	c.BlockUntil(1)
+	if _, err := r.GetPartition(ctx, "daily-report-2024-05-02"); err != nil {
+		t.Errorf("expected the next occurrence's partition, got %v", err)
+	}
+}
+
+func TestSchedulerReplicas(t *testing.T) {
+	r := openTestRepo(t)
+	c := clock.NewFake(time.Date(2024, 5, 1, 1, 30, 0, 0, time.UTC))
+	r.Clock = c
+	replica := func() *Scheduler {
+		return &Scheduler{
+			Repo:     r,
+			Schedule: "@daily",
+			IDPrefix: "nightly-",
+			Items:    []*Item{{BaseModel: BaseModel{ID: "a"}, Data: []byte(`{}`)}, {BaseModel: BaseModel{ID: "b"}, Data: []byte(`{}`)}},
+			Lead:     24 * time.Hour,
+			Clock:    c,
+		}
+	}
+	ctx := context.Background()
+	for n := 0; n < 3; n++ {
+		next, err := replica().CreateDue(ctx)
+		if err != nil {
+			t.Fatalf("expected replica %d to find the partition created, got %v", n, err)
+		}
+		if want := time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC); !next.Equal(want) {
+			t.Errorf("expected the next partition to be due at %s, got %s", want, next)
+		}
+	}
+	var partitions, items int64
+	r.DB.Model(&Partition{}).Where("id LIKE ?", "nightly-%").Count(&partitions)
+	r.DB.Model(&Item{}).Where("partition_id = ?", "nightly-2024-05-02T00:00").Count(&items)
+	if partitions != 1 || items != 2 {
+		t.Errorf("expected a single partition of 2 items, got %d partitions and %d items", partitions, items)
+	}
+
+	// Replicas racing to create the partition both succeed.
+	errs := make(chan error)
+	for n := 0; n < 2; n++ {
+		go func() {
+			err := replica().create(ctx, time.Date(2024, 5, 3, 0, 0, 0, 0, time.UTC))
+			errs <- err
+		}()
+	}
+	for n := 0; n < 2; n++ {
+		if err := <-errs; err != nil {
+			t.Errorf("expected concurrent replicas not to fail, got %v", err)
+		}
+	}
+	r.DB.Model(&Item{}).Where("partition_id = ?", "nightly-2024-05-03T00:00").Count(&items)
+	if items != 2 {
+		t.Errorf("expected the partition's items once, got %d", items)
+	}
+}
@@ -0,0 +1,32 @@
+package state
+
+import "fmt"
+
+// upgrade upgrades the item's payload to the watcher's CurrentSchemaVersion with its
+// Upgraders, returning a NonRetryableError if it can't.
+func (w *Watcher) upgrade(i *Item) error {
+	if w.CurrentSchemaVersion == 0 {
+		return nil
+	}
+	data, version := i.Data, i.SchemaVersion
+	for version < w.CurrentSchemaVersion {
+		upgrader, ok := w.Upgraders[version]
+		if !ok {
+			return NonRetryableError(fmt.Sprintf("no upgrader of item data from schema version %d to %d", version, w.CurrentSchemaVersion))
+		}
+		next, nextVersion, err := upgrader(data)
+		if err != nil {
+			return NonRetryableError(fmt.Sprintf("error upgrading item data from schema version %d: %s", version, err))
+		}
+		// An upgrader that doesn't move forward would never reach the current version.
+		if nextVersion <= version {
+			return NonRetryableError(fmt.Sprintf("upgrader of item data from schema version %d returned version %d", version, nextVersion))
+		}
+		data, version = next, nextVersion
+	}
+	if version != i.SchemaVersion {
+		// The repo hashes the upgraded payload as it is saved, if it may.
+		i.Data, i.SchemaVersion, i.DataHash = data, version, ""
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// payloadProcessor records the payloads it receives, by item.
+type payloadProcessor struct {
+	testProcessor
+	mu     sync.Mutex
+	inputs map[string]string
+}
+
+func (p *payloadProcessor) Process(id string, buf []byte) (*ProcessorResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inputs[id] = string(buf)
+	return &ProcessorResponse{Complete: true, Data: []byte(`{}`)}, nil
+}
+
+func TestSchemaUpgrade(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	if err := r.CreateItems(ctx,
+		&Item{BaseModel: BaseModel{ID: "v1"}, PartitionID: "p", SchemaVersion: 1, Data: []byte(`{"name":"a"}`)},
+		&Item{BaseModel: BaseModel{ID: "v3"}, PartitionID: "p", SchemaVersion: 3, Data: []byte(`{"full_name":"c","tags":[]}`)},
+		&Item{BaseModel: BaseModel{ID: "broken"}, PartitionID: "p", SchemaVersion: 1, Data: []byte(`not json`)},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	var upgrades int
+	proc := &payloadProcessor{inputs: map[string]string{}}
+	w := &Watcher{
+		Processor:            proc,
+		Repo:                 r,
+		BatchSize:            1,
+		PollInterval:         10 * time.Millisecond,
+		AutoClose:            true,
+		CurrentSchemaVersion: 3,
+		Upgraders: map[int]func([]byte) ([]byte, int, error){
+			// v2 renames name to full_name.
+			1: func(b []byte) ([]byte, int, error) {
+				upgrades++
+				var v1 struct{ Name string }
+				if err := json.Unmarshal(b, &v1); err != nil {
+					return nil, 0, err
+				}
+				b, err := json.Marshal(map[string]string{"full_name": v1.Name})
+				return b, 2, err
+			},
+			// v3 adds tags.
+			2: func(b []byte) ([]byte, int, error) {
+				upgrades++
+				v2 := map[string]interface{}{}
+				if err := json.Unmarshal(b, &v2); err != nil {
+					return nil, 0, err
+				}
+				v2["tags"] = []string{}
+				b, err := json.Marshal(v2)
+				return b, 3, err
+			},
+		},
+	}
+	runForEvents(t, r, w)
+
+	if got := proc.inputs["v1"]; got != `{"full_name":"a","tags":[]}` {
+		t.Errorf("expected the processor to receive the upgraded payload, got %s", got)
+	}
+	if got := proc.inputs["v3"]; got != `{"full_name":"c","tags":[]}` {
+		t.Errorf("expected the processor to receive the latest payload as is, got %s", got)
+	}
+	if _, ok := proc.inputs["broken"]; ok {
+		t.Error("expected the item that failed to upgrade not to be processed")
+	}
+	// v1 went through both upgraders, and broken failed the first.
+	if upgrades != 3 {
+		t.Errorf("expected 3 upgrades, got %d", upgrades)
+	}
+
+	i, err := r.GetItem(ctx, "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Status != Complete || i.SchemaVersion != 3 || string(i.Data) != `{"full_name":"a","tags":[]}` {
+		t.Errorf("expected the upgrade to be saved, got %s at version %d with %s", i.Status, i.SchemaVersion, i.Data)
+	}
+	if i, err = r.GetItem(ctx, "broken"); err != nil {
+		t.Fatal(err)
+	}
+	if i.Status != Failed || i.RetryCount != 1 || i.SchemaVersion != 1 || !strings.Contains(i.ErrorMessages, "error upgrading item data from schema version 1") {
+		t.Errorf("expected the item to fail without retries, got %s after %d attempts at version %d: %s", i.Status, i.RetryCount, i.SchemaVersion, i.ErrorMessages)
+	}
+}
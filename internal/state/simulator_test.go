@@ -0,0 +1,157 @@
+package state_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state/statetest"
+)
+
+var simStart = time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+// gateProcessor moves each item to gate 1 the first time it is processed, and completes it
+// the second.
+type gateProcessor struct {
+	calls map[string]int
+}
+
+func (p *gateProcessor) Process(id string, b []byte) (*state.ProcessorResponse, error) {
+	if p.calls == nil {
+		p.calls = map[string]int{}
+	}
+	p.calls[id]++
+	return &state.ProcessorResponse{NextGate: 1, Complete: p.calls[id] > 1, Data: b}, nil
+}
+
+func (p *gateProcessor) Healthcheck(ctx context.Context) error {
+	return nil
+}
+
+func simRepo(t *testing.T, sim *statetest.Simulator, items ...string) *state.GormRepo {
+	t.Helper()
+	r := statetest.NewSQLiteRepo(t)
+	r.Clock = sim.Clock
+	ctx := context.Background()
+	if err := r.CreatePartition(ctx, &state.Partition{BaseModel: state.BaseModel{ID: "p"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range items {
+		if err := r.CreateItems(ctx, &state.Item{BaseModel: state.BaseModel{ID: id}, PartitionID: "p", Data: []byte(`{}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return r
+}
+
+func simWatcher(r state.Repo, owner string) *state.Watcher {
+	return &state.Watcher{
+		Repo:          r,
+		Processor:     &gateProcessor{},
+		OwnerID:       owner,
+		PollInterval:  time.Second,
+		LeaseInterval: 2 * time.Second,
+		LeaseDuration: 30 * time.Second,
+		AutoClose:     true,
+	}
+}
+
+func TestSimulatorLeaseExpiry(t *testing.T) {
+	ctx := context.Background()
+	for seed := int64(1); seed <= 5; seed++ {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			sim := statetest.NewSimulator(seed, simStart)
+			r := simRepo(t, sim, "a", "b")
+			a, b := simWatcher(r, "a"), simWatcher(r, "b")
+			// The first watcher's processor hangs, so it keeps the lease without progress.
+			sim.Before = func(s statetest.Step) error {
+				if s.Watcher == a && s.Kind == statetest.ProcessStep {
+					return errors.New("hung")
+				}
+				return nil
+			}
+			sim.Add(a)
+			sim.Run(ctx, 5*time.Second)
+			sim.Crash(a)
+			sim.Add(b)
+
+			// The lease is held until 30s after the crashed watcher's last poll.
+			sim.Run(ctx, 20*time.Second)
+			p, err := r.GetPartition(ctx, "p")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Owner != "a" || p.Fence != 1 {
+				t.Fatalf("expected the lease to be held by a, got owner %q at fence %d", p.Owner, p.Fence)
+			}
+
+			sim.Run(ctx, 30*time.Second)
+			if p, err = r.GetPartition(ctx, "p"); err != nil {
+				t.Fatal(err)
+			}
+			if p.Owner != "b" || p.Fence != 2 || p.Status != state.Complete {
+				t.Errorf("expected b to take over the expired lease and complete the partition, got %+v\n%v", p, sim.History)
+			}
+		})
+	}
+}
+
+func TestSimulatorGateAdvanceRace(t *testing.T) {
+	ctx := context.Background()
+	for seed := int64(1); seed <= 5; seed++ {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			sim := statetest.NewSimulator(seed, simStart)
+			r := simRepo(t, sim, "a")
+			w := simWatcher(r, "w")
+			raced := false
+			// An item arrives at gate 0 after the poll deciding to advance past it was read.
+			sim.Before = func(s statetest.Step) error {
+				if s.Kind == statetest.SaveStep && s.Gate == 1 && !raced {
+					raced = true
+					return r.CreateItems(ctx, &state.Item{BaseModel: state.BaseModel{ID: "late"}, PartitionID: "p", Data: []byte(`{}`)})
+				}
+				return nil
+			}
+			sim.Add(w)
+			sim.Run(ctx, 20*time.Second)
+			if !raced {
+				t.Fatal("expected the poll to decide to advance the gate")
+			}
+
+			p, err := r.GetPartition(ctx, "p")
+			if err != nil {
+				t.Fatal(err)
+			}
+			counts, err := r.GetCountByStatus(ctx, "p")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Status != state.Complete || counts[state.Complete] != 2 {
+				t.Errorf("expected both items to complete, got partition at gate %d, status %s, counts %v\n%v", p.Gate, p.Status, counts, sim.History)
+			}
+		})
+	}
+}
+
+func TestSimulatorIsDeterministic(t *testing.T) {
+	ctx := context.Background()
+	run := func(seed int64) []string {
+		sim := statetest.NewSimulator(seed, simStart)
+		r := simRepo(t, sim, "a", "b", "c", "d")
+		sim.Add(simWatcher(r, "x"))
+		sim.Add(simWatcher(r, "y"))
+		sim.Run(ctx, 10*time.Second)
+		var steps []string
+		for _, s := range sim.History {
+			steps = append(steps, s.String())
+		}
+		return steps
+	}
+	if a, b := run(7), run(7); !reflect.DeepEqual(a, b) {
+		t.Errorf("expected a seed to reproduce the run, got\n%v\nand\n%v", a, b)
+	}
+}
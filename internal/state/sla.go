@@ -0,0 +1,171 @@
+package state
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// DefaultSLARecoveryRatio is the fraction of its threshold a breached measurement must fall
+// below to recover, by default.
+var DefaultSLARecoveryRatio = 0.8
+
+// SLA names a threshold of SLAConfig.
+type SLA string
+
+const (
+	SLAItemAge      SLA = "item_age"
+	SLAFailureRatio SLA = "failure_ratio"
+	SLARetryRate    SLA = "retry_rate"
+	SLAGateDuration SLA = "gate_duration"
+)
+
+// SLAConfig are thresholds the watcher checks each leased partition against as it polls it.
+// A partition breaching a threshold is reported once, with an SLABreached event, until it
+// recovers by falling below RecoveryRatio of the threshold, reported with an SLARecovered
+// event. Zero thresholds aren't checked.
+type SLAConfig struct {
+	// MaxItemAge is the longest the partition's oldest available item may wait, see the
+	// watcher's AvailableLags.
+	MaxItemAge time.Duration
+	// MaxFailureRatio is the greatest fraction of the partition's items that may be Failed.
+	MaxFailureRatio float64
+	// MaxRetriesPerMinute is the most attempts of the partition's items the watcher may
+	// retry over the last minute, beyond which the processor is likely in a retry storm.
+	MaxRetriesPerMinute float64
+	// MaxGateDuration is the longest the partition may stay at a gate, measured from when the
+	// watcher first saw it there.
+	MaxGateDuration time.Duration
+	// RecoveryRatio is the fraction of a threshold a breached measurement must fall below to
+	// recover, so that a measurement hovering around its threshold doesn't flap. Defaults to
+	// DefaultSLARecoveryRatio.
+	RecoveryRatio float64
+	// AlertFunc, if set, is called with each SLABreached and SLARecovered event, in addition
+	// to it being sent on Events. It is called from the partition's poll, so it must not block.
+	AlertFunc func(Event)
+}
+
+func (c SLAConfig) enabled() bool {
+	return c.MaxItemAge > 0 || c.MaxFailureRatio > 0 || c.MaxRetriesPerMinute > 0 || c.MaxGateDuration > 0
+}
+
+func (c SLAConfig) recoveryRatio() float64 {
+	if c.RecoveryRatio <= 0 || c.RecoveryRatio > 1 {
+		return DefaultSLARecoveryRatio
+	}
+	return c.RecoveryRatio
+}
+
+// slaState is what the watcher tracks of a leased partition to check its SLAs.
+type slaState struct {
+	gate      int
+	gateSince time.Time
+	// retries are the times of the attempts retried over the last minute.
+	retries  []time.Time
+	breached map[SLA]bool
+}
+
+// slaState returns the SLA state of the leased partition, guarded by mu.
+func (w *Watcher) slaState(partitionID string) *slaState {
+	if w.slas == nil {
+		w.slas = map[string]*slaState{}
+	}
+	s, ok := w.slas[partitionID]
+	if !ok {
+		s = &slaState{gate: -1, breached: map[SLA]bool{}}
+		w.slas[partitionID] = s
+	}
+	return s
+}
+
+// recentRetries drops the retries older than a minute, returning the number left.
+func (s *slaState) recentRetries(now time.Time) int {
+	i := 0
+	for i < len(s.retries) && now.Sub(s.retries[i]) >= time.Minute {
+		i++
+	}
+	s.retries = s.retries[i:]
+	return len(s.retries)
+}
+
+// noteRetry counts a retried attempt of the partition's items towards MaxRetriesPerMinute.
+func (w *Watcher) noteRetry(partitionID string) {
+	if w.SLA.MaxRetriesPerMinute <= 0 {
+		return
+	}
+	now := w.Clock.Now()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.leases[partitionID]; !ok {
+		return
+	}
+	s := w.slaState(partitionID)
+	s.recentRetries(now)
+	s.retries = append(s.retries, now)
+}
+
+// checkSLA checks the partition against the SLAConfig, as polled at its gate with the lag of
+// its oldest available item and its counts of items by status, and reports the breaches and
+// recoveries.
+func (w *Watcher) checkSLA(p *Partition, lag time.Duration, counts map[Status]int) {
+	if !w.SLA.enabled() {
+		return
+	}
+	now := w.Clock.Now()
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	failureRatio := 0.0
+	if total > 0 {
+		failureRatio = float64(counts[Failed]) / float64(total)
+	}
+
+	w.mu.Lock()
+	s := w.slaState(p.ID)
+	if s.gate != p.Gate {
+		s.gate, s.gateSince = p.Gate, now
+	}
+	measurements := []struct {
+		sla              SLA
+		value, threshold float64
+	}{
+		{SLAItemAge, lag.Seconds(), w.SLA.MaxItemAge.Seconds()},
+		{SLAFailureRatio, failureRatio, w.SLA.MaxFailureRatio},
+		{SLARetryRate, float64(s.recentRetries(now)), w.SLA.MaxRetriesPerMinute},
+		{SLAGateDuration, now.Sub(s.gateSince).Seconds(), w.SLA.MaxGateDuration.Seconds()},
+	}
+	var events []Event
+	for _, m := range measurements {
+		if m.threshold <= 0 {
+			continue
+		}
+		e := Event{PartitionID: p.ID, SLA: m.sla, SLAValue: m.value, SLAThreshold: m.threshold}
+		switch {
+		case !s.breached[m.sla] && m.value > m.threshold:
+			s.breached[m.sla] = true
+			e.Type = SLABreached
+		case s.breached[m.sla] && m.value < m.threshold*w.SLA.recoveryRatio():
+			s.breached[m.sla] = false
+			e.Type = SLARecovered
+		default:
+			continue
+		}
+		events = append(events, e)
+	}
+	w.mu.Unlock()
+
+	for _, e := range events {
+		if e.Type == SLABreached {
+			glog.Warningf("partition %s breached its %s SLA: %v over %v", e.PartitionID, e.SLA, e.SLAValue, e.SLAThreshold)
+			w.metrics().Counter(MetricSLABreaches, 1, Labels{"partition": e.PartitionID, "sla": string(e.SLA)})
+		} else {
+			glog.Infof("partition %s recovered its %s SLA: %v", e.PartitionID, e.SLA, e.SLAValue)
+		}
+		e.Time = now
+		w.emit(e)
+		if w.SLA.AlertFunc != nil {
+			w.SLA.AlertFunc(e)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package state
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+)
+
+// slaEvents returns the events sent so far.
+func slaEvents(events <-chan Event) (out []Event) {
+	for {
+		select {
+		case e := <-events:
+			out = append(out, e)
+		default:
+			return out
+		}
+	}
+}
+
+func TestSLA(t *testing.T) {
+	c := clock.NewFake(time.Now())
+	var alerts []Event
+	w := &Watcher{Clock: c, SLA: SLAConfig{
+		MaxItemAge:          10 * time.Minute,
+		MaxFailureRatio:     0.5,
+		MaxRetriesPerMinute: 2,
+		MaxGateDuration:     time.Hour,
+		AlertFunc:           func(e Event) { alerts = append(alerts, e) },
+	}}
+	events := w.Events()
+	p := &Partition{BaseModel: BaseModel{ID: "p"}}
+	w.leases = map[string]*Partition{p.ID: p}
+	expect := func(typ EventType, slas ...SLA) {
+		t.Helper()
+		got := slaEvents(events)
+		if len(got) != len(slas) {
+			t.Fatalf("expected %v events for %v, got %v", typ, slas, got)
+		}
+		for i, e := range got {
+			if e.Type != typ || e.SLA != slas[i] || e.PartitionID != "p" || !e.Time.Equal(c.Now()) {
+				t.Errorf("expected a %s event for %s, got %+v", typ, slas[i], e)
+			}
+		}
+	}
+	healthy := map[Status]int{Complete: 3, Failed: 1}
+
+	w.checkSLA(p, time.Minute, healthy)
+	expect(SLABreached)
+
+	// Items waiting too long breach once, however long they keep waiting.
+	w.checkSLA(p, 11*time.Minute, healthy)
+	expect(SLABreached, SLAItemAge)
+	w.checkSLA(p, 20*time.Minute, healthy)
+	expect(SLABreached)
+	// Falling back just under the threshold doesn't recover, only under 80% of it.
+	w.checkSLA(p, 9*time.Minute, healthy)
+	expect(SLARecovered)
+	w.checkSLA(p, 11*time.Minute, healthy)
+	expect(SLARecovered)
+	w.checkSLA(p, 7*time.Minute, healthy)
+	expect(SLARecovered, SLAItemAge)
+
+	w.checkSLA(p, 0, map[Status]int{Complete: 1, Failed: 2})
+	expect(SLABreached, SLAFailureRatio)
+	w.checkSLA(p, 0, map[Status]int{Complete: 9, Failed: 2})
+	expect(SLARecovered, SLAFailureRatio)
+
+	// Retries are counted over the last minute.
+	for i := 0; i < 3; i++ {
+		w.noteRetry("p")
+	}
+	w.noteRetry("unleased")
+	w.checkSLA(p, 0, healthy)
+	expect(SLABreached, SLARetryRate)
+	c.Advance(time.Minute)
+	w.checkSLA(p, 0, healthy)
+	expect(SLARecovered, SLARetryRate)
+
+	c.Advance(time.Hour)
+	w.checkSLA(p, 0, healthy)
+	expect(SLABreached, SLAGateDuration)
+	p.Gate++
+	w.checkSLA(p, 0, healthy)
+	expect(SLARecovered, SLAGateDuration)
+
+	if len(alerts) != 8 || alerts[7].Type != SLARecovered || alerts[7].SLA != SLAGateDuration {
+		t.Errorf("expected every event to be alerted, got %v", alerts)
+	}
+	if _, ok := w.slas["unleased"]; ok {
+		t.Error("expected the retries of unleased partitions not to be tracked")
+	}
+}
+
+func TestWatcherSLA(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	p := &Partition{BaseModel: BaseModel{ID: "p"}}
+	r.Save(ctx, p)
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Status: Available, Data: []byte(`{"times": 1}`)})
+	age(t, r, "i", time.Hour)
+
+	var alerts []Event
+	w := &Watcher{Processor: &testProcessor{}, Repo: r, PollInterval: 10 * time.Millisecond, AutoClose: true,
+		SLA: SLAConfig{MaxItemAge: time.Minute, AlertFunc: func(e Event) { alerts = append(alerts, e) }}}
+	var slas []EventType
+	for _, e := range runForEvents(t, r, w) {
+		if e.Type == SLABreached || e.Type == SLARecovered {
+			slas = append(slas, e.Type)
+		}
+	}
+	// The partition recovers once the item is processed.
+	if len(slas) != 2 || slas[0] != SLABreached || slas[1] != SLARecovered {
+		t.Errorf("expected the waiting item to breach the SLA, then recover, got %v", slas)
+	}
+	if len(alerts) != 2 || alerts[0].SLA != SLAItemAge || alerts[0].SLAValue < time.Hour.Seconds() {
+		t.Errorf("expected the breach to be alerted with the item's age, got %v", alerts)
+	}
+}
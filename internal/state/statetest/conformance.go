@@ -0,0 +1,929 @@
+package statetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+)
+
+// RepoConformance runs the behaviors every Repo implementation must share. newRepo must
+// return an empty, migrated repo on each call.
+func RepoConformance(t *testing.T, newRepo func(t *testing.T) state.Repo) {
+	t.Run("GetNotFound", func(t *testing.T) { testGetNotFound(t, newRepo(t)) })
+	t.Run("TypedErrors", func(t *testing.T) { testTypedErrors(t, newRepo(t)) })
+	t.Run("GetPartitionAndItem", func(t *testing.T) { testGet(t, newRepo(t)) })
+	t.Run("ListPartitionsFilter", func(t *testing.T) { testListPartitionsFilter(t, newRepo(t)) })
+	t.Run("ListItemsFilter", func(t *testing.T) { testListItemsFilter(t, newRepo(t)) })
+	t.Run("ListPagination", func(t *testing.T) { testListPagination(t, newRepo(t)) })
+	t.Run("ListPaginationStableUnderWrites", func(t *testing.T) { testListPaginationStable(t, newRepo(t)) })
+	t.Run("CreateItems", func(t *testing.T) { testCreateItems(t, newRepo(t)) })
+	t.Run("FetchOrder", func(t *testing.T) { testFetchOrder(t, newRepo(t)) })
+	t.Run("PartitionLabels", func(t *testing.T) { testPartitionLabels(t, newRepo(t)) })
+	t.Run("PartitionDependencies", func(t *testing.T) { testPartitionDependencies(t, newRepo(t)) })
+	t.Run("IdempotencyKeys", func(t *testing.T) { testIdempotencyKeys(t, newRepo(t)) })
+	t.Run("ConcurrentDuplicateInserts", func(t *testing.T) { testConcurrentDuplicateInserts(t, newRepo(t)) })
+	t.Run("GetOrCreate", func(t *testing.T) { testGetOrCreate(t, newRepo(t)) })
+	t.Run("ConcurrentGetOrCreate", func(t *testing.T) { testConcurrentGetOrCreate(t, newRepo(t)) })
+	t.Run("TryAcquireLease", func(t *testing.T) { testTryAcquireLease(t, newRepo(t)) })
+	t.Run("AcquireLeases", func(t *testing.T) { testAcquireLeases(t, newRepo(t)) })
+	t.Run("ConcurrentLeaseAcquisition", func(t *testing.T) { testConcurrentLeaseAcquisition(t, newRepo(t)) })
+	t.Run("ClaimItems", func(t *testing.T) { testClaimItems(t, newRepo(t)) })
+	t.Run("ConcurrentItemClaims", func(t *testing.T) { testConcurrentItemClaims(t, newRepo(t)) })
+}
+
+func mustSave(t *testing.T, r state.Repo, m state.Model) {
+	t.Helper()
+	if !r.Save(context.Background(), m) {
+		t.Fatalf("failed to save %s", m.GetID())
+	}
+}
+
+func ids(items []*state.Item) (out []string) {
+	for _, i := range items {
+		out = append(out, i.ID)
+	}
+	return out
+}
+
+func partitionIDs(partitions []*state.Partition) (out []string) {
+	for _, p := range partitions {
+		out = append(out, p.ID)
+	}
+	return out
+}
+
+func sameIDs(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	seen := map[string]bool{}
+	for _, id := range got {
+		seen[id] = true
+	}
+	for _, id := range want {
+		if !seen[id] {
+			return false
+		}
+	}
+	return true
+}
+
+func testGetNotFound(t *testing.T, r state.Repo) {
+	ctx := context.Background()
+	if _, err := r.GetPartition(ctx, "missing"); !state.IsNotFound(err) {
+		t.Errorf("expected not found error for partition, got %v", err)
+	}
+	if _, err := r.GetItem(ctx, "missing"); !state.IsNotFound(err) {
+		t.Errorf("expected not found error for item, got %v", err)
+	}
+}
+
+func testTypedErrors(t *testing.T, r state.Repo) {
+	ctx := context.Background()
+	mustSave(t, r, &state.Partition{BaseModel: state.BaseModel{ID: "p1"}})
+	mustSave(t, r, &state.Item{BaseModel: state.BaseModel{ID: "i1"}, PartitionID: "p1", Data: []byte(`{}`)})
+	negative := -1
+
+	for name, err := range map[string]error{
+		"reopen":            r.ReopenPartition(ctx, "missing", nil),
+		"redrive":           r.RedriveItem(ctx, "missing", nil),
+		"cancel":            r.CancelItem(ctx, "missing"),
+		"partition retries": r.SetPartitionMaxRetries(ctx, "missing", nil),
+		"item retries":      r.SetItemMaxRetries(ctx, "missing", nil),
+		"export":            r.ExportPartition(ctx, "missing", io.Discard),
+		"partition quota":   r.SetPartitionMaxPendingItems(ctx, "missing", nil),
+	} {
+		if !state.IsNotFound(err) {
+			t.Errorf("%s: expected not found error, got %v", name, err)
+		}
+	}
+
+	_, purgeErr := r.PurgeItems(ctx, state.ItemFilter{})
+	for name, err := range map[string]error{
+		"gate plan":       r.CreatePartition(ctx, &state.Partition{BaseModel: state.BaseModel{ID: "p2"}, GatePlan: state.GatePlan{"a", "a"}}),
+		"reopen gate":     r.ReopenPartition(ctx, "p1", &negative),
+		"redrive gate":    r.RedriveItem(ctx, "i1", &negative),
+		"purge filter":    purgeErr,
+		"partition quota": r.SetPartitionMaxPendingItems(ctx, "p1", &negative),
+		"tenant quota":    r.SetTenantMaxPendingItems(ctx, "acme", &negative),
+	} {
+		var v *state.ErrValidation
+		if !errors.As(err, &v) || v.Field == "" {
+			t.Errorf("%s: expected validation error, got %v", name, err)
+		}
+	}
+
+	for name, err := range map[string]error{
+		"partition": r.CreatePartition(ctx, &state.Partition{BaseModel: state.BaseModel{ID: "p1"}}),
+		"item":      r.CreateItems(ctx, &state.Item{BaseModel: state.BaseModel{ID: "i1"}, PartitionID: "p1", Data: []byte(`{}`)}),
+	} {
+		var c *state.ErrVersionConflict
+		if !errors.As(err, &c) || c.ID != "p1" && c.ID != "i1" {
+			t.Errorf("%s: expected version conflict, got %v", name, err)
+		}
+	}
+}
+
+func testGet(t *testing.T, r state.Repo) {
+	ctx := context.Background()
+	mustSave(t, r, &state.Partition{BaseModel: state.BaseModel{ID: "p1"}, Owner: "o1", Gate: 2})
+	mustSave(t, r, &state.Item{BaseModel: state.BaseModel{ID: "i1"}, PartitionID: "p1", Status: state.Available, Data: []byte(`{}`)})
+
+	p, err := r.GetPartition(ctx, "p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Owner != "o1" || p.Gate != 2 {
+		t.Errorf("unexpected partition %+v", p)
+	}
+	i, err := r.GetItem(ctx, "i1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.PartitionID != "p1" || string(i.Data) != `{}` {
+		t.Errorf("unexpected item %+v", i)
+	}
+}
+
+func testListPartitionsFilter(t *testing.T, r state.Repo) {
+	ctx := context.Background()
+	mustSave(t, r, &state.Partition{BaseModel: state.BaseModel{ID: "a_1"}, Status: state.Available, Owner: "o1"})
+	mustSave(t, r, &state.Partition{BaseModel: state.BaseModel{ID: "a_2"}, Status: state.Failed, Owner: "o2"})
+	mustSave(t, r, &state.Partition{BaseModel: state.BaseModel{ID: "ab"}, Status: state.Complete, Owner: "o1"})
+	mustSave(t, r, &state.Partition{BaseModel: state.BaseModel{ID: "c%_!1"}, Status: state.Complete, Owner: "o2"})
+	mustSave(t, r, &state.Partition{BaseModel: state.BaseModel{ID: "cxy!1"}, Status: state.Complete, Owner: "o2"})
+	since := time.Now()
+	mustSave(t, r, &state.Partition{BaseModel: state.BaseModel{ID: "b_1"}, Status: state.Failed, Owner: "o1"})
+
+	cases := []struct {
+		name   string
+		filter state.PartitionFilter
+		want   []string
+	}{
+		{"all", state.PartitionFilter{}, []string{"a_1", "a_2", "ab", "b_1", "c%_!1", "cxy!1"}},
+		{"status", state.PartitionFilter{Status: state.Failed}, []string{"a_2", "b_1"}},
+		{"owner", state.PartitionFilter{Owner: "o1"}, []string{"a_1", "ab", "b_1"}},
+		// The underscore must be matched literally, not as a LIKE wildcard.
+		{"prefix", state.PartitionFilter{IDPrefix: "a_"}, []string{"a_1", "a_2"}},
+		{"wildcard prefix", state.PartitionFilter{IDPrefix: "c%_!"}, []string{"c%_!1"}},
+		{"updated since", state.PartitionFilter{UpdatedSince: since}, []string{"b_1"}},
+		{"combined", state.PartitionFilter{Status: state.Failed, Owner: "o1"}, []string{"b_1"}},
+	}
+	for _, tc := range cases {
+		got, token, err := r.ListPartitions(ctx, tc.filter, state.PageRequest{})
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if token != "" {
+			t.Errorf("%s: expected no further pages, got token %q", tc.name, token)
+		}
+		if !sameIDs(partitionIDs(got), tc.want) {
+			t.Errorf("%s: wanted %v, got %v", tc.name, tc.want, partitionIDs(got))
+		}
+	}
+}
+
+func testListItemsFilter(t *testing.T, r state.Repo) {
+	ctx := context.Background()
+	mustSave(t, r, &state.Item{BaseModel: state.BaseModel{ID: "i1"}, PartitionID: "p_1", Status: state.Available, Data: []byte(`{}`)})
+	mustSave(t, r, &state.Item{BaseModel: state.BaseModel{ID: "i2"}, PartitionID: "p_1", Status: state.Failed, RetryCount: 3, Data: []byte(`{}`)})
+	mustSave(t, r, &state.Item{BaseModel: state.BaseModel{ID: "i3"}, PartitionID: "p_2", Status: state.Available, RetryCount: 1, Data: []byte(`{}`)})
+	since := time.Now()
+	mustSave(t, r, &state.Item{BaseModel: state.BaseModel{ID: "i4"}, PartitionID: "px", Status: state.Complete, Data: []byte(`{}`)})
+
+	zero, two := 0, 2
+	cases := []struct {
+		name   string
+		filter state.ItemFilter
+		want   []string
+	}{
+		{"all", state.ItemFilter{}, []string{"i1", "i2", "i3", "i4"}},
+		{"status", state.ItemFilter{Status: state.Available}, []string{"i1", "i3"}},
+		{"partition", state.ItemFilter{PartitionID: "p_1"}, []string{"i1", "i2"}},
+		{"partition prefix", state.ItemFilter{PartitionIDPrefix: "p_"}, []string{"i1", "i2", "i3"}},
+		{"updated since", state.ItemFilter{UpdatedSince: since}, []string{"i4"}},
+		{"retried", state.ItemFilter{RetryCountGreaterThan: &zero}, []string{"i2", "i3"}},
+		{"retried more than twice", state.ItemFilter{RetryCountGreaterThan: &two}, []string{"i2"}},
+	}
+	for _, tc := range cases {
+		got, _, err := r.ListItems(ctx, tc.filter, state.PageRequest{})
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if !sameIDs(ids(got), tc.want) {
+			t.Errorf("%s: wanted %v, got %v", tc.name, tc.want, ids(got))
+		}
+	}
+}
+
+func testListPagination(t *testing.T, r state.Repo) {
+	ctx := context.Background()
+	var want []string
+	for n := 0; n < 7; n++ {
+		p := &state.Partition{BaseModel: state.BaseModel{ID: fmt.Sprintf("p%d", n)}}
+		mustSave(t, r, p)
+		want = append(want, p.ID)
+	}
+
+	var got []string
+	page := state.PageRequest{Size: 3}
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("too many pages")
+		}
+		partitions, token, err := r.ListPartitions(ctx, state.PartitionFilter{}, page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(partitions) > 3 {
+			t.Errorf("page too large: %d", len(partitions))
+		}
+		got = append(got, partitionIDs(partitions)...)
+		if token == "" {
+			break
+		}
+		page.Token = token
+	}
+	if !sameIDs(got, want) {
+		t.Errorf("wanted %v, got %v", want, got)
+	}
+
+	if _, _, err := r.ListPartitions(ctx, state.PartitionFilter{}, state.PageRequest{Token: "not a token"}); err == nil {
+		t.Error("expected error for an invalid page token")
+	}
+}
+
+func testListPaginationStable(t *testing.T, r state.Repo) {
+	ctx := context.Background()
+	var want []string
+	for n := 0; n < 6; n++ {
+		i := &state.Item{BaseModel: state.BaseModel{ID: fmt.Sprintf("i%d", n)}, PartitionID: "p", Status: state.Available, Data: []byte(`{}`)}
+		mustSave(t, r, i)
+		want = append(want, i.ID)
+	}
+
+	first, token, err := r.ListItems(ctx, state.ItemFilter{}, state.PageRequest{Size: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Writing an item that was already returned must not cause unseen items to be skipped.
+	first[0].RetryCount++
+	mustSave(t, r, first[0])
+
+	seen := map[string]bool{}
+	for _, i := range first {
+		seen[i.ID] = true
+	}
+	for token != "" {
+		var items []*state.Item
+		items, token, err = r.ListItems(ctx, state.ItemFilter{}, state.PageRequest{Size: 2, Token: token})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, i := range items {
+			seen[i.ID] = true
+		}
+	}
+	for _, id := range want {
+		if !seen[id] {
+			t.Errorf("item %s skipped during pagination", id)
+		}
+	}
+}
+
+func testCreateItems(t *testing.T, r state.Repo) {
+	ctx := context.Background()
+	err := r.CreateItems(ctx,
+		&state.Item{BaseModel: state.BaseModel{ID: "i1"}, PartitionID: "p", Data: []byte(`{}`)},
+		&state.Item{BaseModel: state.BaseModel{ID: "i2"}, PartitionID: "p", Gate: 1, Status: state.Failed, Data: []byte(`{}`)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i1, err := r.GetItem(ctx, "i1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i1.Status != state.Available {
+		t.Errorf("expected items to default to Available, got %s", i1.Status)
+	}
+	i2, err := r.GetItem(ctx, "i2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i2.Status != state.Failed || i2.Gate != 1 {
+		t.Errorf("unexpected item %+v", i2)
+	}
+	// Created items must be writable with the usual OCC semantics.
+	i2.Status = state.Available
+	if !r.Save(ctx, i2) {
+		t.Error("failed to save a created item")
+	}
+
+	if err := r.CreateItems(ctx, &state.Item{BaseModel: state.BaseModel{ID: "i1"}, PartitionID: "p", Data: []byte(`{}`)}); !state.IsVersionConflict(err) {
+		t.Errorf("expected a version conflict creating a duplicate item, got %v", err)
+	}
+}
+
+func key(k string) *string {
+	return &k
+}
+
+func testIdempotencyKeys(t *testing.T, r state.Repo) {
+	ctx := context.Background()
+	first := &state.Item{BaseModel: state.BaseModel{ID: "i1"}, PartitionID: "p", Data: []byte(`{}`), IdempotencyKey: key("k")}
+	if err := r.CreateItems(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	retry := &state.Item{BaseModel: state.BaseModel{ID: "i2"}, PartitionID: "p", Data: []byte(`{}`), IdempotencyKey: key("k")}
+	batch := &state.Item{BaseModel: state.BaseModel{ID: "i3"}, PartitionID: "p", Data: []byte(`{}`), IdempotencyKey: key("other")}
+	batchDup := &state.Item{BaseModel: state.BaseModel{ID: "i4"}, PartitionID: "p", Data: []byte(`{}`), IdempotencyKey: key("other")}
+	if err := r.CreateItems(ctx, retry, batch, batchDup,
+		&state.Item{BaseModel: state.BaseModel{ID: "i5"}, PartitionID: "p", Data: []byte(`{}`)},
+		&state.Item{BaseModel: state.BaseModel{ID: "i6"}, PartitionID: "p", Data: []byte(`{}`)},
+		&state.Item{BaseModel: state.BaseModel{ID: "i7"}, PartitionID: "q", Data: []byte(`{}`), IdempotencyKey: key("k")},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if retry.ID != "i1" || batchDup.ID != "i3" {
+		t.Errorf("expected duplicates to take the existing IDs, got %s and %s", retry.ID, batchDup.ID)
+	}
+	items, _, err := r.ListItems(ctx, state.ItemFilter{}, state.PageRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(items), []string{"i1", "i3", "i5", "i6", "i7"}; !sameIDs(got, want) {
+		t.Errorf("got items %v, want %v", got, want)
+	}
+
+	i, err := r.GetItemByIdempotencyKey(ctx, "q", "k")
+	if err != nil || i.ID != "i7" {
+		t.Errorf("expected item i7 by its key, got %v, %v", i, err)
+	}
+	if _, err := r.GetItemByIdempotencyKey(ctx, "p", "missing"); !state.IsNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
+
+func testConcurrentDuplicateInserts(t *testing.T, r state.Repo) {
+	ctx := context.Background()
+	const producers = 8
+	items := make([]*state.Item, producers)
+	errs := make([]error, producers)
+	var wg sync.WaitGroup
+	for n := range items {
+		items[n] = &state.Item{BaseModel: state.BaseModel{ID: fmt.Sprintf("i%d", n)}, PartitionID: "p", Data: []byte(`{}`), IdempotencyKey: key("k")}
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			errs[n] = r.CreateItems(ctx, items[n])
+		}(n)
+	}
+	wg.Wait()
+
+	existing, err := r.GetItemByIdempotencyKey(ctx, "p", "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, i := range items {
+		if errs[n] != nil {
+			t.Errorf("producer %d failed: %s", n, errs[n])
+		} else if i.ID != existing.ID {
+			t.Errorf("producer %d got ID %s, want the existing %s", n, i.ID, existing.ID)
+		}
+	}
+	all, _, err := r.ListItems(ctx, state.ItemFilter{PartitionID: "p"}, state.PageRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 {
+		t.Errorf("expected a single item, got %v", ids(all))
+	}
+}
+
+func testFetchOrder(t *testing.T, r state.Repo) {
+	ctx := context.Background()
+	var items []*state.Item
+	for n := 0; n < 5; n++ {
+		items = append(items, &state.Item{BaseModel: state.BaseModel{ID: fmt.Sprintf("i%d", 4-n)}, PartitionID: "p", Data: []byte(`{}`)})
+	}
+	items[3].Priority = 1
+	// Items created together share a timestamp, so only the sequence records their order.
+	if err := r.CreateItems(ctx, items...); err != nil {
+		t.Fatal(err)
+	}
+	mustSave(t, r, &state.Item{BaseModel: state.BaseModel{ID: "i5"}, PartitionID: "p", Status: state.Available, Data: []byte(`{}`)})
+	mustSave(t, r, &state.Item{BaseModel: state.BaseModel{ID: "other"}, PartitionID: "q", Status: state.Available, Data: []byte(`{}`)})
+
+	// Retrying an item updates it, which moves it to the back only when ordering by update.
+	first, err := r.GetItem(ctx, "i4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.RetryCount++
+	mustSave(t, r, first)
+
+	p := &state.Partition{BaseModel: state.BaseModel{ID: "p"}}
+	cases := []struct {
+		order state.ItemOrder
+		want  []string
+	}{
+		{state.OrderBySequence, []string{"i4", "i3", "i2", "i1", "i0", "i5"}},
+		{state.OrderByPriority, []string{"i1", "i4", "i3", "i2", "i0", "i5"}},
+		{state.OrderByCreatedAt, []string{"i4", "i3", "i2", "i1", "i0", "i5"}},
+	}
+	for _, tc := range cases {
+		got, err := r.GetAvailableItems(ctx, p, 10, tc.order, state.AnyItems)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(ids(got)) != fmt.Sprint(tc.want) {
+			t.Errorf("%s: wanted %v, got %v", tc.order, tc.want, ids(got))
+		}
+	}
+	got, err := r.GetAvailableItems(ctx, p, 10, state.OrderByUpdatedAt, state.AnyItems)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 6 || got[5].ID != "i4" {
+		t.Errorf("%s: expected the retried item last, got %v", state.OrderByUpdatedAt, ids(got))
+	}
+
+	// The retry filter splits the retried item from the fresh ones.
+	for filter, want := range map[state.RetryFilter][]string{
+		state.FreshItems:   {"i3", "i2", "i1", "i0", "i5"},
+		state.RetriedItems: {"i4"},
+	} {
+		got, err := r.GetAvailableItems(ctx, p, 10, state.OrderBySequence, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(ids(got)) != fmt.Sprint(want) {
+			t.Errorf("retry filter %d: wanted %v, got %v", filter, want, ids(got))
+		}
+	}
+}
+
+func testPartitionLabels(t *testing.T, r state.Repo) {
+	ctx := context.Background()
+	for id, labels := range map[string]state.PartitionLabels{
+		"gpu":       {"gpu": "true", "zone": "a"},
+		"cpu":       {"gpu": "false", "zone": "a"},
+		"unlabeled": nil,
+		"odd":       {`we"ird`: "x"},
+	} {
+		if err := r.CreatePartition(ctx, &state.Partition{BaseModel: state.BaseModel{ID: id}, Labels: labels}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.CreatePartition(ctx, &state.Partition{BaseModel: state.BaseModel{ID: "gpu"}}); !state.IsVersionConflict(err) {
+		t.Errorf("expected a version conflict creating an existing partition, got %v", err)
+	}
+	p, err := r.GetPartition(ctx, "gpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Labels["gpu"] != "true" || p.Labels["zone"] != "a" || p.Status != state.Available {
+		t.Errorf("expected the labels to round trip, got %v", p.Labels)
+	}
+
+	for _, tc := range []struct {
+		selector map[string]string
+		want     []string
+	}{
+		{nil, []string{"gpu", "cpu", "unlabeled", "odd"}},
+		{map[string]string{"gpu": "true"}, []string{"gpu"}},
+		{map[string]string{"zone": "a"}, []string{"gpu", "cpu"}},
+		{map[string]string{"zone": "a", "gpu": "false"}, []string{"cpu"}},
+		{map[string]string{"zone": "b"}, nil},
+		{map[string]string{`we"ird`: "x"}, []string{"odd"}},
+	} {
+		leases, err := r.GetPotentialLeases(ctx, tc.selector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := partitionIDs(leases); !sameIDs(got, tc.want) {
+			t.Errorf("selector %v: expected leases %v, got %v", tc.selector, tc.want, got)
+		}
+		listed, _, err := r.ListPartitions(ctx, state.PartitionFilter{Labels: tc.selector}, state.PageRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := partitionIDs(listed); !sameIDs(got, tc.want) {
+			t.Errorf("selector %v: expected listed partitions %v, got %v", tc.selector, tc.want, got)
+		}
+	}
+}
+
+func testPartitionDependencies(t *testing.T, r state.Repo) {
+	ctx := context.Background()
+	// Dependents may be created before their dependency.
+	for _, p := range []*state.Partition{
+		{BaseModel: state.BaseModel{ID: "stage2"}, DependsOn: "stage1"},
+		{BaseModel: state.BaseModel{ID: "stage1"}},
+		{BaseModel: state.BaseModel{ID: "x"}, DependsOn: "y"},
+	} {
+		if err := r.CreatePartition(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []*state.Partition{
+		{BaseModel: state.BaseModel{ID: "self"}, DependsOn: "self"},
+		{BaseModel: state.BaseModel{ID: "y"}, DependsOn: "x"},
+	} {
+		if err := r.CreatePartition(ctx, p); !errors.Is(err, state.ErrDependencyCycle) || !state.IsValidation(err) {
+			t.Errorf("expected partition %s to be rejected as a cycle, got %v", p.ID, err)
+		}
+	}
+	if r.Save(ctx, &state.Partition{BaseModel: state.BaseModel{ID: "y"}, DependsOn: "x"}) {
+		t.Error("expected saving a new partition closing a cycle to fail")
+	}
+
+	leases, err := r.GetPotentialLeases(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := partitionIDs(leases); !sameIDs(got, []string{"stage1"}) {
+		t.Errorf("expected only stage1 to be leasable, got %v", got)
+	}
+	p, err := r.GetPartition(ctx, "stage1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Status = state.Complete
+	mustSave(t, r, p)
+	leases, err = r.GetPotentialLeases(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := partitionIDs(leases); !sameIDs(got, []string{"stage2"}) {
+		t.Errorf("expected stage2 to be leasable once stage1 completes, got %v", got)
+	}
+	dependents, _, err := r.ListPartitions(ctx, state.PartitionFilter{DependsOn: "stage1"}, state.PageRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := partitionIDs(dependents); !sameIDs(got, []string{"stage2"}) {
+		t.Errorf("expected stage2 to depend on stage1, got %v", got)
+	}
+}
+
+func testGetOrCreate(t *testing.T, r state.Repo) {
+	ctx := context.Background()
+	p, created, err := r.GetOrCreatePartition(ctx, &state.Partition{BaseModel: state.BaseModel{ID: "p"}, Gate: 1})
+	if err != nil || !created {
+		t.Fatalf("expected the partition to be created, got %v, %v", created, err)
+	}
+	mustSave(t, r, p)
+	p, created, err = r.GetOrCreatePartition(ctx, &state.Partition{BaseModel: state.BaseModel{ID: "p"}, Gate: 3})
+	if err != nil || created {
+		t.Fatalf("expected the existing partition, got %v, %v", created, err)
+	}
+	if p.Gate != 1 || p.Version != 2 {
+		t.Errorf("expected the existing partition to be left as is, got gate %d at version %d", p.Gate, p.Version)
+	}
+
+	i, created, err := r.GetOrCreateItem(ctx, &state.Item{BaseModel: state.BaseModel{ID: "i"}, PartitionID: "p", Data: []byte(`{"n":1}`)})
+	if err != nil || !created || i.Status != state.Available {
+		t.Fatalf("expected the item to be created as Available, got %+v, %v, %v", i, created, err)
+	}
+	i, created, err = r.GetOrCreateItem(ctx, &state.Item{BaseModel: state.BaseModel{ID: "i"}, PartitionID: "p", Data: []byte(`{"n":2}`)})
+	if err != nil || created {
+		t.Fatalf("expected the existing item, got %v, %v", created, err)
+	}
+	if string(i.Data) != `{"n":1}` || i.Version != 1 {
+		t.Errorf("expected the existing item to be left as is, got %s at version %d", i.Data, i.Version)
+	}
+
+	if _, _, err := r.GetOrCreatePartition(ctx, &state.Partition{BaseModel: state.BaseModel{ID: "q"}, DependsOn: "q"}); !state.IsValidation(err) {
+		t.Errorf("expected a partition depending on itself to be rejected, got %v", err)
+	}
+}
+
+func testConcurrentGetOrCreate(t *testing.T, r state.Repo) {
+	ctx := context.Background()
+	const producers = 16
+	var (
+		wg                sync.WaitGroup
+		mu                sync.Mutex
+		partitions, items int
+	)
+	for n := 0; n < producers; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			_, pCreated, err := r.GetOrCreatePartition(ctx, &state.Partition{BaseModel: state.BaseModel{ID: "p"}})
+			if err != nil {
+				t.Errorf("producer %d failed to get or create the partition: %s", n, err)
+			}
+			i, iCreated, err := r.GetOrCreateItem(ctx, &state.Item{BaseModel: state.BaseModel{ID: "i"}, PartitionID: "p", Data: []byte(`{}`)})
+			if err != nil {
+				t.Errorf("producer %d failed to get or create the item: %s", n, err)
+			} else if i.ID != "i" {
+				t.Errorf("producer %d got item %s", n, i.ID)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if pCreated {
+				partitions++
+			}
+			if iCreated {
+				items++
+			}
+		}(n)
+	}
+	wg.Wait()
+	if partitions != 1 || items != 1 {
+		t.Errorf("expected a single producer to create each, got %d partitions and %d items created", partitions, items)
+	}
+	all, _, err := r.ListItems(ctx, state.ItemFilter{PartitionID: "p"}, state.PageRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[0].Version != 1 {
+		t.Errorf("expected a single item, as created, got %v", ids(all))
+	}
+}
+
+func testTryAcquireLease(t *testing.T, r state.Repo) {
+	ctx := context.Background()
+	if err := r.CreatePartition(ctx, &state.Partition{BaseModel: state.BaseModel{ID: "p"}}); err != nil {
+		t.Fatal(err)
+	}
+	acquire := func(owner string, until time.Time, fence, want bool) *state.Partition {
+		t.Helper()
+		if ok, err := r.TryAcquireLease(ctx, "p", owner, until, fence); err != nil || ok != want {
+			t.Fatalf("expected %s leasing the partition until %s to return %t, got %t, %v", owner, until, want, ok, err)
+		}
+		p, err := r.GetPartition(ctx, "p")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	check := func(p *state.Partition, owner string, fence int64) {
+		t.Helper()
+		if p.Owner != owner || p.Fence != fence || p.Version != 1 {
+			t.Errorf("expected the partition leased by %q at fence %d and version 1, got %q at fence %d and version %d", owner, fence, p.Owner, p.Fence, p.Version)
+		}
+	}
+	now := time.Now()
+
+	// A new partition is leased, moving its fence on.
+	p := acquire("a", now.Add(time.Minute), true, true)
+	check(p, "a", 1)
+	if p.LeasedAt == nil || p.LeaseState().Status != state.LeaseActive {
+		t.Errorf("expected an active lease, got %+v", p.LeaseState())
+	}
+	// An active lease is kept from others.
+	check(acquire("b", now.Add(time.Minute), true, false), "a", 1)
+	// Re-acquiring one's own lease extends it, at the same fence.
+	p = acquire("a", now.Add(2*time.Minute), true, true)
+	check(p, "a", 1)
+	if !p.Until.After(now.Add(time.Minute)) {
+		t.Errorf("expected the lease to be extended, got until %s", p.Until)
+	}
+	// Once expired, the lease is taken over, moving the fence on, or not without fencing.
+	acquire("a", now.Add(-time.Second), true, true)
+	check(acquire("b", now.Add(time.Minute), true, true), "b", 2)
+	acquire("b", now.Add(-time.Second), true, true)
+	check(acquire("c", now.Add(time.Minute), false, true), "c", 2)
+
+	// A released lease may be taken right away.
+	if err := r.ReleaseLease(ctx, p); err == nil {
+		t.Error("expected a stale release to conflict")
+	}
+	if p, err := r.GetPartition(ctx, "p"); err != nil {
+		t.Fatal(err)
+	} else if err := r.ReleaseLease(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * state.TimestampPrecision)
+	check(acquire("d", now.Add(time.Minute), true, true), "d", 3)
+
+	// Complete partitions aren't leased, nor are missing ones.
+	acquire("d", now.Add(-time.Second), true, true)
+	p, err := r.GetPartition(ctx, "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Status = state.Complete
+	mustSave(t, r, p)
+	if ok, err := r.TryAcquireLease(ctx, "p", "e", now.Add(time.Minute), true); err != nil || ok {
+		t.Errorf("expected the complete partition not to be leased, got %t, %v", ok, err)
+	}
+	if ok, err := r.TryAcquireLease(ctx, "missing", "e", now.Add(time.Minute), true); err != nil || ok {
+		t.Errorf("expected a missing partition not to be leased, got %t, %v", ok, err)
+	}
+}
+
+func testAcquireLeases(t *testing.T, r state.Repo) {
+	ctx := context.Background()
+	for _, id := range []string{"p1", "p2", "p3", "p4"} {
+		if err := r.CreatePartition(ctx, &state.Partition{BaseModel: state.BaseModel{ID: id}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	until := time.Now().Add(time.Minute)
+	if ok, err := r.TryAcquireLease(ctx, "p2", "b", until, true); err != nil || !ok {
+		t.Fatalf("expected b to lease p2, got %t, %v", ok, err)
+	}
+	candidates := []string{"p1", "p2", "p3", "p4", "missing"}
+
+	// Up to the limit is claimed, skipping the partitions leased by others.
+	claimed, err := r.AcquireLeases(ctx, candidates, "a", until, 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 2 {
+		t.Fatalf("expected 2 partitions to be claimed, got %v", partitionIDs(claimed))
+	}
+	first := map[string]bool{}
+	for _, p := range claimed {
+		first[p.ID] = true
+		if p.ID == "p2" || p.Owner != "a" || p.Fence != 1 || p.LeasedAt == nil || !p.Until.After(time.Now()) {
+			t.Errorf("expected a claimed partition leased by a at fence 1, got %+v", p)
+		}
+	}
+
+	// Claiming again takes the rest, and re-acquires the partitions already leased.
+	claimed, err = r.AcquireLeases(ctx, candidates, "a", until.Add(time.Minute), len(candidates), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := partitionIDs(claimed); !sameIDs(got, []string{"p1", "p3", "p4"}) {
+		t.Errorf("expected every partition but p2 to be claimed, got %v", got)
+	}
+	for _, p := range claimed {
+		if p.Owner != "a" || p.Fence != 1 || !p.Until.After(until) {
+			t.Errorf("expected %s to be leased by a at fence 1, extended, got %+v", p.ID, p)
+		}
+	}
+	if p, err := r.GetPartition(ctx, "p2"); err != nil || p.Owner != "b" {
+		t.Errorf("expected p2 to be left to b, got %+v, %v", p, err)
+	}
+
+	if claimed, err := r.AcquireLeases(ctx, nil, "a", until, 10, true); err != nil || len(claimed) != 0 {
+		t.Errorf("expected no candidates to claim nothing, got %v, %v", partitionIDs(claimed), err)
+	}
+}
+
+func testConcurrentLeaseAcquisition(t *testing.T, r state.Repo) {
+	ctx := context.Background()
+	if err := r.CreatePartition(ctx, &state.Partition{BaseModel: state.BaseModel{ID: "p"}}); err != nil {
+		t.Fatal(err)
+	}
+	const watchers = 16
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		owners []string
+	)
+	for n := 0; n < watchers; n++ {
+		wg.Add(1)
+		go func(owner string) {
+			defer wg.Done()
+			ok, err := r.TryAcquireLease(ctx, "p", owner, time.Now().Add(time.Minute), true)
+			if err != nil {
+				t.Errorf("watcher %s failed to lease the partition: %s", owner, err)
+			}
+			if ok {
+				mu.Lock()
+				owners = append(owners, owner)
+				mu.Unlock()
+			}
+		}(fmt.Sprintf("w%d", n))
+	}
+	wg.Wait()
+	if len(owners) != 1 {
+		t.Fatalf("expected a single watcher to lease the partition, got %v", owners)
+	}
+	if p, err := r.GetPartition(ctx, "p"); err != nil || p.Owner != owners[0] || p.Fence != 1 {
+		t.Errorf("expected the partition leased by %s at fence 1, got %+v, %v", owners[0], p, err)
+	}
+}
+
+func testClaimItems(t *testing.T, r state.Repo) {
+	ctx := context.Background()
+	for _, p := range []*state.Partition{
+		{BaseModel: state.BaseModel{ID: "p1"}},
+		{BaseModel: state.BaseModel{ID: "p2"}, Gate: 1},
+		{BaseModel: state.BaseModel{ID: "done"}, Status: state.Complete},
+	} {
+		if err := r.CreatePartition(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	retryAt := time.Now().Add(time.Hour)
+	if err := r.CreateItems(ctx,
+		&state.Item{BaseModel: state.BaseModel{ID: "low"}, PartitionID: "p1", Data: []byte("{}")},
+		&state.Item{BaseModel: state.BaseModel{ID: "high"}, PartitionID: "p1", Priority: 1, Data: []byte("{}")},
+		&state.Item{BaseModel: state.BaseModel{ID: "at_gate"}, PartitionID: "p2", Gate: 1, Data: []byte("{}")},
+		&state.Item{BaseModel: state.BaseModel{ID: "past_gate"}, PartitionID: "p1", Gate: 1, Data: []byte("{}")},
+		&state.Item{BaseModel: state.BaseModel{ID: "before_gate"}, PartitionID: "p2", Data: []byte("{}")},
+		&state.Item{BaseModel: state.BaseModel{ID: "delayed"}, PartitionID: "p1", RetryAt: &retryAt, Data: []byte("{}")},
+		&state.Item{BaseModel: state.BaseModel{ID: "complete"}, PartitionID: "done", Data: []byte("{}")},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// The highest priority items are claimed first, only at the gates of their partitions.
+	claimed, err := r.ClaimItems(ctx, "a", 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(claimed); !sameIDs(got, []string{"high"}) {
+		t.Fatalf("expected the high priority item to be claimed, got %v", got)
+	}
+	if i := claimed[0]; i.Owner != "a" || i.VisibleAfter == nil || !i.VisibleAfter.After(time.Now()) {
+		t.Errorf("expected the item claimed by a for a minute, got %+v", i)
+	}
+	claimed, err = r.ClaimItems(ctx, "b", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(claimed); !sameIDs(got, []string{"low", "at_gate"}) {
+		t.Errorf("expected the items at their partitions' gates to be claimed, got %v", got)
+	}
+	if claimed, err := r.ClaimItems(ctx, "c", 10, time.Minute); err != nil || len(claimed) != 0 {
+		t.Errorf("expected the claimed items to be hidden, got %v, %v", ids(claimed), err)
+	}
+
+	// A claim is extended by its owner only, and claimed again once it expires.
+	if ok, err := r.ExtendItem(ctx, "high", "b", time.Minute); err != nil || ok {
+		t.Errorf("expected b not to extend a's claim, got %t, %v", ok, err)
+	}
+	if ok, err := r.ExtendItem(ctx, "high", "a", -time.Second); err != nil || !ok {
+		t.Fatalf("expected a to extend its claim, got %t, %v", ok, err)
+	}
+	claimed, err = r.ClaimItems(ctx, "c", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(claimed); !sameIDs(got, []string{"high"}) || claimed[0].Owner != "c" {
+		t.Errorf("expected the expired claim to be taken over by c, got %v", got)
+	}
+	if ok, err := r.ExtendItem(ctx, "high", "a", time.Minute); err != nil || ok {
+		t.Errorf("expected a's expired claim not to be extended once taken over, got %t, %v", ok, err)
+	}
+
+	// Claims don't move the items' versions, so the save of a lost claim conflicts.
+	i := claimed[0]
+	stale := *i
+	i.Status, i.Owner, i.VisibleAfter = state.Complete, "", nil
+	mustSave(t, r, i)
+	if r.Save(ctx, &stale) {
+		t.Error("expected the save of the lost claim to conflict")
+	}
+	if claimed, err := r.ClaimItems(ctx, "a", 0, time.Minute); err != nil || len(claimed) != 0 {
+		t.Errorf("expected a zero limit to claim nothing, got %v, %v", ids(claimed), err)
+	}
+}
+
+func testConcurrentItemClaims(t *testing.T, r state.Repo) {
+	ctx := context.Background()
+	if err := r.CreatePartition(ctx, &state.Partition{BaseModel: state.BaseModel{ID: "p"}}); err != nil {
+		t.Fatal(err)
+	}
+	const items, watchers = 8, 16
+	for n := 0; n < items; n++ {
+		if err := r.CreateItems(ctx, &state.Item{BaseModel: state.BaseModel{ID: fmt.Sprintf("i%d", n)}, PartitionID: "p", Data: []byte("{}")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		owners = map[string]string{}
+	)
+	for n := 0; n < watchers; n++ {
+		wg.Add(1)
+		go func(owner string) {
+			defer wg.Done()
+			claimed, err := r.ClaimItems(ctx, owner, 2, time.Minute)
+			if err != nil {
+				t.Errorf("watcher %s failed to claim items: %s", owner, err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, i := range claimed {
+				if prev, ok := owners[i.ID]; ok {
+					t.Errorf("item %s claimed by both %s and %s", i.ID, prev, owner)
+				}
+				owners[i.ID] = owner
+			}
+		}(fmt.Sprintf("w%d", n))
+	}
+	wg.Wait()
+	if len(owners) != items {
+		t.Errorf("expected every item to be claimed once, got %v", owners)
+	}
+}
@@ -0,0 +1,450 @@
+package statetest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+)
+
+var errNoPoolStats = errors.New("repo doesn't report pool stats")
+
+// Call is a call to a Repo recorded by a CountingRepo.
+type Call struct {
+	Method string
+	// Args are the call's arguments, but for its context.
+	Args     []interface{}
+	Duration time.Duration
+}
+
+// CountingRepo decorates a Repo, recording the method, arguments and duration of each call,
+// e.g. to pin the number of round trips the watcher makes per item in tests. It is safe for
+// concurrent use. The calls made within a Transaction go to the transaction's repo, and are
+// only recorded as the Transaction call.
+//
+// With Metrics set, it also reports each call as the state.MetricRepoCalls counter and the
+// state.MetricRepoCallDuration duration, labelled by method, for repos which don't report
+// their own, and with CountOnly set it keeps counts and durations but not the calls
+// themselves, so that its memory stays bounded in production.
+type CountingRepo struct {
+	state.Repo
+	Metrics   state.Metrics
+	CountOnly bool
+
+	mu        sync.Mutex
+	calls     []Call
+	counts    map[string]int
+	durations map[string]time.Duration
+}
+
+// record records a call to the method which started at start.
+func (r *CountingRepo) record(method string, start time.Time, args ...interface{}) {
+	d := time.Since(start)
+	if r.Metrics != nil {
+		labels := state.Labels{"method": method}
+		r.Metrics.Counter(state.MetricRepoCalls, 1, labels)
+		r.Metrics.Duration(state.MetricRepoCallDuration, d, labels)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.counts == nil {
+		r.counts = map[string]int{}
+		r.durations = map[string]time.Duration{}
+	}
+	r.counts[method]++
+	r.durations[method] += d
+	if !r.CountOnly {
+		r.calls = append(r.calls, Call{Method: method, Args: args, Duration: d})
+	}
+}
+
+// Calls returns the calls recorded, in order, or those to the given methods.
+func (r *CountingRepo) Calls(methods ...string) []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var calls []Call
+	for _, c := range r.calls {
+		if len(methods) == 0 {
+			calls = append(calls, c)
+			continue
+		}
+		for _, m := range methods {
+			if c.Method == m {
+				calls = append(calls, c)
+				break
+			}
+		}
+	}
+	return calls
+}
+
+// Count returns the number of calls to the given methods, or to every method.
+func (r *CountingRepo) Count(methods ...string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for m, count := range r.counts {
+		for _, method := range methods {
+			if m == method {
+				n += count
+			}
+		}
+		if len(methods) == 0 {
+			n += count
+		}
+	}
+	return n
+}
+
+// Counts returns the number of calls to each method called.
+func (r *CountingRepo) Counts() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counts := map[string]int{}
+	for m, n := range r.counts {
+		counts[m] = n
+	}
+	return counts
+}
+
+// Durations returns the total duration of the calls to each method called.
+func (r *CountingRepo) Durations() map[string]time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	durations := map[string]time.Duration{}
+	for m, d := range r.durations {
+		durations[m] = d
+	}
+	return durations
+}
+
+// Reset forgets the calls recorded so far.
+func (r *CountingRepo) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls, r.counts, r.durations = nil, nil, nil
+}
+
+// Subscribe and NotifyItemAvailable pass through to the repo if it is a state.Notifier, so
+// that watchers keep their notifications.
+func (r *CountingRepo) Subscribe(ctx context.Context, partitionID string) <-chan struct{} {
+	if n, ok := r.Repo.(state.Notifier); ok {
+		return n.Subscribe(ctx, partitionID)
+	}
+	return nil
+}
+
+func (r *CountingRepo) NotifyItemAvailable(ctx context.Context, partitionID string) {
+	if n, ok := r.Repo.(state.Notifier); ok {
+		n.NotifyItemAvailable(ctx, partitionID)
+	}
+}
+
+// PoolStats and StaleReadWindow pass through to the repo, like GormRepo's.
+func (r *CountingRepo) PoolStats() (sql.DBStats, error) {
+	if p, ok := r.Repo.(interface{ PoolStats() (sql.DBStats, error) }); ok {
+		return p.PoolStats()
+	}
+	return sql.DBStats{}, errNoPoolStats
+}
+
+func (r *CountingRepo) StaleReadWindow() time.Duration {
+	if s, ok := r.Repo.(interface{ StaleReadWindow() time.Duration }); ok {
+		return s.StaleReadWindow()
+	}
+	return 0
+}
+
+func (r *CountingRepo) Save(ctx context.Context, m state.Model) bool {
+	defer r.record("Save", time.Now(), m)
+	return r.Repo.Save(ctx, m)
+}
+
+func (r *CountingRepo) SaveWithOutbox(ctx context.Context, m state.Model, events ...*state.OutboxEvent) bool {
+	defer r.record("SaveWithOutbox", time.Now(), m, events)
+	return r.Repo.SaveWithOutbox(ctx, m, events...)
+}
+
+func (r *CountingRepo) Transaction(ctx context.Context, f func(db *state.GormRepo) error) error {
+	defer r.record("Transaction", time.Now())
+	return r.Repo.Transaction(ctx, f)
+}
+
+func (r *CountingRepo) TransactionWithOptions(ctx context.Context, opts state.TxOptions, f func(db *state.GormRepo) error) error {
+	defer r.record("TransactionWithOptions", time.Now(), opts)
+	return r.Repo.TransactionWithOptions(ctx, opts, f)
+}
+
+func (r *CountingRepo) CreateItems(ctx context.Context, items ...*state.Item) error {
+	defer r.record("CreateItems", time.Now(), items)
+	return r.Repo.CreateItems(ctx, items...)
+}
+
+func (r *CountingRepo) GetOrCreateItem(ctx context.Context, i *state.Item) (*state.Item, bool, error) {
+	defer r.record("GetOrCreateItem", time.Now(), i)
+	return r.Repo.GetOrCreateItem(ctx, i)
+}
+
+func (r *CountingRepo) FailExpiredItems(ctx context.Context) (int, error) {
+	defer r.record("FailExpiredItems", time.Now())
+	return r.Repo.FailExpiredItems(ctx)
+}
+
+func (r *CountingRepo) ReclaimStuckItems(ctx context.Context, olderThan time.Duration) (int, error) {
+	defer r.record("ReclaimStuckItems", time.Now(), olderThan)
+	return r.Repo.ReclaimStuckItems(ctx, olderThan)
+}
+
+func (r *CountingRepo) ClaimItems(ctx context.Context, owner string, limit int, visibility time.Duration) ([]*state.Item, error) {
+	defer r.record("ClaimItems", time.Now(), owner, limit, visibility)
+	return r.Repo.ClaimItems(ctx, owner, limit, visibility)
+}
+
+func (r *CountingRepo) ExtendItem(ctx context.Context, itemID, owner string, d time.Duration) (bool, error) {
+	defer r.record("ExtendItem", time.Now(), itemID, owner, d)
+	return r.Repo.ExtendItem(ctx, itemID, owner, d)
+}
+
+func (r *CountingRepo) GetAvailableItems(ctx context.Context, p *state.Partition, limit int, order state.ItemOrder, retries state.RetryFilter) ([]*state.Item, error) {
+	defer r.record("GetAvailableItems", time.Now(), p, limit, order, retries)
+	return r.Repo.GetAvailableItems(ctx, p, limit, order, retries)
+}
+
+func (r *CountingRepo) GetPartitionProgress(ctx context.Context, id string) (*state.PartitionProgress, error) {
+	defer r.record("GetPartitionProgress", time.Now(), id)
+	return r.Repo.GetPartitionProgress(ctx, id)
+}
+
+func (r *CountingRepo) GetAvailableLag(ctx context.Context, p *state.Partition) (time.Duration, error) {
+	defer r.record("GetAvailableLag", time.Now(), p)
+	return r.Repo.GetAvailableLag(ctx, p)
+}
+
+func (r *CountingRepo) CountStuckItems(ctx context.Context, olderThan time.Duration) (map[string]int, error) {
+	defer r.record("CountStuckItems", time.Now(), olderThan)
+	return r.Repo.CountStuckItems(ctx, olderThan)
+}
+
+func (r *CountingRepo) GetCountByStatus(ctx context.Context, id string) (map[state.Status]int, error) {
+	defer r.record("GetCountByStatus", time.Now(), id)
+	return r.Repo.GetCountByStatus(ctx, id)
+}
+
+func (r *CountingRepo) CountAvailablePastGate(ctx context.Context, partitionID string, gate int) (int, error) {
+	defer r.record("CountAvailablePastGate", time.Now(), partitionID, gate)
+	return r.Repo.CountAvailablePastGate(ctx, partitionID, gate)
+}
+
+func (r *CountingRepo) CountDelayedItems(ctx context.Context, p *state.Partition) (int, error) {
+	defer r.record("CountDelayedItems", time.Now(), p)
+	return r.Repo.CountDelayedItems(ctx, p)
+}
+
+func (r *CountingRepo) CountDeadlineMisses(ctx context.Context, partitionID string) (int, error) {
+	defer r.record("CountDeadlineMisses", time.Now(), partitionID)
+	return r.Repo.CountDeadlineMisses(ctx, partitionID)
+}
+
+func (r *CountingRepo) GetItem(ctx context.Context, id string) (*state.Item, error) {
+	defer r.record("GetItem", time.Now(), id)
+	return r.Repo.GetItem(ctx, id)
+}
+
+func (r *CountingRepo) GetItemByIdempotencyKey(ctx context.Context, partitionID, key string) (*state.Item, error) {
+	defer r.record("GetItemByIdempotencyKey", time.Now(), partitionID, key)
+	return r.Repo.GetItemByIdempotencyKey(ctx, partitionID, key)
+}
+
+func (r *CountingRepo) ListItems(ctx context.Context, filter state.ItemFilter, page state.PageRequest) ([]*state.Item, state.PageToken, error) {
+	defer r.record("ListItems", time.Now(), filter, page)
+	return r.Repo.ListItems(ctx, filter, page)
+}
+
+func (r *CountingRepo) GetPotentialLeases(ctx context.Context, selector map[string]string) ([]*state.Partition, error) {
+	defer r.record("GetPotentialLeases", time.Now(), selector)
+	return r.Repo.GetPotentialLeases(ctx, selector)
+}
+
+func (r *CountingRepo) GetPartition(ctx context.Context, id string) (*state.Partition, error) {
+	defer r.record("GetPartition", time.Now(), id)
+	return r.Repo.GetPartition(ctx, id)
+}
+
+func (r *CountingRepo) ListPartitions(ctx context.Context, filter state.PartitionFilter, page state.PageRequest) ([]*state.Partition, state.PageToken, error) {
+	defer r.record("ListPartitions", time.Now(), filter, page)
+	return r.Repo.ListPartitions(ctx, filter, page)
+}
+
+func (r *CountingRepo) CreatePartition(ctx context.Context, p *state.Partition) error {
+	defer r.record("CreatePartition", time.Now(), p)
+	return r.Repo.CreatePartition(ctx, p)
+}
+
+func (r *CountingRepo) GetOrCreatePartition(ctx context.Context, p *state.Partition) (*state.Partition, bool, error) {
+	defer r.record("GetOrCreatePartition", time.Now(), p)
+	return r.Repo.GetOrCreatePartition(ctx, p)
+}
+
+func (r *CountingRepo) AcquireLease(ctx context.Context, p *state.Partition, owner string, until time.Time) (bool, error) {
+	defer r.record("AcquireLease", time.Now(), p, owner, until)
+	return r.Repo.AcquireLease(ctx, p, owner, until)
+}
+
+func (r *CountingRepo) TryAcquireLease(ctx context.Context, partitionID, owner string, until time.Time, fence bool) (bool, error) {
+	defer r.record("TryAcquireLease", time.Now(), partitionID, owner, until, fence)
+	return r.Repo.TryAcquireLease(ctx, partitionID, owner, until, fence)
+}
+
+func (r *CountingRepo) AcquireLeases(ctx context.Context, candidates []string, owner string, until time.Time, limit int, fence bool) ([]*state.Partition, error) {
+	defer r.record("AcquireLeases", time.Now(), candidates, owner, until, limit, fence)
+	return r.Repo.AcquireLeases(ctx, candidates, owner, until, limit, fence)
+}
+
+func (r *CountingRepo) ReleaseLease(ctx context.Context, p *state.Partition) error {
+	defer r.record("ReleaseLease", time.Now(), p)
+	return r.Repo.ReleaseLease(ctx, p)
+}
+
+func (r *CountingRepo) GetLeaseHistory(ctx context.Context, partitionID string, limit int) ([]*state.LeaseEvent, error) {
+	defer r.record("GetLeaseHistory", time.Now(), partitionID, limit)
+	return r.Repo.GetLeaseHistory(ctx, partitionID, limit)
+}
+
+func (r *CountingRepo) PurgeLeaseEvents(ctx context.Context, before time.Time) (int, error) {
+	defer r.record("PurgeLeaseEvents", time.Now(), before)
+	return r.Repo.PurgeLeaseEvents(ctx, before)
+}
+
+func (r *CountingRepo) ReleaseExpiredLeases(ctx context.Context) (int, error) {
+	defer r.record("ReleaseExpiredLeases", time.Now())
+	return r.Repo.ReleaseExpiredLeases(ctx)
+}
+
+func (r *CountingRepo) RetryFailedPartitions(ctx context.Context) ([]*state.Partition, error) {
+	defer r.record("RetryFailedPartitions", time.Now())
+	return r.Repo.RetryFailedPartitions(ctx)
+}
+
+func (r *CountingRepo) Heartbeat(ctx context.Context, o *state.Owner) error {
+	defer r.record("Heartbeat", time.Now(), o)
+	return r.Repo.Heartbeat(ctx, o)
+}
+
+func (r *CountingRepo) ListOwners(ctx context.Context) ([]*state.Owner, error) {
+	defer r.record("ListOwners", time.Now())
+	return r.Repo.ListOwners(ctx)
+}
+
+func (r *CountingRepo) AcquireLeadership(ctx context.Context, election, owner string, until time.Time) (bool, error) {
+	defer r.record("AcquireLeadership", time.Now(), election, owner, until)
+	return r.Repo.AcquireLeadership(ctx, election, owner, until)
+}
+
+func (r *CountingRepo) ReleaseLeadership(ctx context.Context, election, owner string) error {
+	defer r.record("ReleaseLeadership", time.Now(), election, owner)
+	return r.Repo.ReleaseLeadership(ctx, election, owner)
+}
+
+func (r *CountingRepo) Healthcheck(ctx context.Context) error {
+	defer r.record("Healthcheck", time.Now())
+	return r.Repo.Healthcheck(ctx)
+}
+
+func (r *CountingRepo) RetryFailedItems(ctx context.Context, partitionID string) (int, error) {
+	defer r.record("RetryFailedItems", time.Now(), partitionID)
+	return r.Repo.RetryFailedItems(ctx, partitionID)
+}
+
+func (r *CountingRepo) ReopenPartition(ctx context.Context, id string, gate *int) error {
+	defer r.record("ReopenPartition", time.Now(), id, gate)
+	return r.Repo.ReopenPartition(ctx, id, gate)
+}
+
+func (r *CountingRepo) SetPartitionMaxRetries(ctx context.Context, id string, maxRetries *int) error {
+	defer r.record("SetPartitionMaxRetries", time.Now(), id, maxRetries)
+	return r.Repo.SetPartitionMaxRetries(ctx, id, maxRetries)
+}
+
+func (r *CountingRepo) SetItemMaxRetries(ctx context.Context, id string, maxRetries *int) error {
+	defer r.record("SetItemMaxRetries", time.Now(), id, maxRetries)
+	return r.Repo.SetItemMaxRetries(ctx, id, maxRetries)
+}
+
+func (r *CountingRepo) CancelItem(ctx context.Context, id string) error {
+	defer r.record("CancelItem", time.Now(), id)
+	return r.Repo.CancelItem(ctx, id)
+}
+
+func (r *CountingRepo) RedriveItem(ctx context.Context, id string, gate *int) error {
+	defer r.record("RedriveItem", time.Now(), id, gate)
+	return r.Repo.RedriveItem(ctx, id, gate)
+}
+
+func (r *CountingRepo) PurgeItems(ctx context.Context, filter state.ItemFilter) (int, error) {
+	defer r.record("PurgeItems", time.Now(), filter)
+	return r.Repo.PurgeItems(ctx, filter)
+}
+
+func (r *CountingRepo) ReencryptPartition(ctx context.Context, id string, keyID string) (int, error) {
+	defer r.record("ReencryptPartition", time.Now(), id, keyID)
+	return r.Repo.ReencryptPartition(ctx, id, keyID)
+}
+
+func (r *CountingRepo) GetPartitionQuotaUsage(ctx context.Context, id string) (*state.QuotaUsage, error) {
+	defer r.record("GetPartitionQuotaUsage", time.Now(), id)
+	return r.Repo.GetPartitionQuotaUsage(ctx, id)
+}
+
+func (r *CountingRepo) GetTenantQuotaUsage(ctx context.Context, tenant string) (*state.QuotaUsage, error) {
+	defer r.record("GetTenantQuotaUsage", time.Now(), tenant)
+	return r.Repo.GetTenantQuotaUsage(ctx, tenant)
+}
+
+func (r *CountingRepo) SetPartitionMaxPendingItems(ctx context.Context, id string, max *int) error {
+	defer r.record("SetPartitionMaxPendingItems", time.Now(), id, max)
+	return r.Repo.SetPartitionMaxPendingItems(ctx, id, max)
+}
+
+func (r *CountingRepo) SetTenantMaxPendingItems(ctx context.Context, tenant string, max *int) error {
+	defer r.record("SetTenantMaxPendingItems", time.Now(), tenant, max)
+	return r.Repo.SetTenantMaxPendingItems(ctx, tenant, max)
+}
+
+func (r *CountingRepo) ExportPartition(ctx context.Context, id string, w io.Writer) error {
+	defer r.record("ExportPartition", time.Now(), id)
+	return r.Repo.ExportPartition(ctx, id, w)
+}
+
+func (r *CountingRepo) ImportPartition(ctx context.Context, rd io.Reader, opts state.ImportOptions) (*state.Partition, error) {
+	defer r.record("ImportPartition", time.Now(), opts)
+	return r.Repo.ImportPartition(ctx, rd, opts)
+}
+
+func (r *CountingRepo) ClaimOutboxBatch(ctx context.Context, limit int, claimFor time.Duration) ([]*state.OutboxEvent, error) {
+	defer r.record("ClaimOutboxBatch", time.Now(), limit, claimFor)
+	return r.Repo.ClaimOutboxBatch(ctx, limit, claimFor)
+}
+
+func (r *CountingRepo) MarkOutboxPublished(ctx context.Context, ids ...string) error {
+	defer r.record("MarkOutboxPublished", time.Now(), ids)
+	return r.Repo.MarkOutboxPublished(ctx, ids...)
+}
+
+func (r *CountingRepo) AutoMigrate() error {
+	defer r.record("AutoMigrate", time.Now())
+	return r.Repo.AutoMigrate()
+}
+
+func (r *CountingRepo) MigrateTo(ctx context.Context, version int) error {
+	defer r.record("MigrateTo", time.Now(), version)
+	return r.Repo.MigrateTo(ctx, version)
+}
+
+func (r *CountingRepo) SchemaVersion(ctx context.Context) (int, error) {
+	defer r.record("SchemaVersion", time.Now())
+	return r.Repo.SchemaVersion(ctx)
+}
@@ -0,0 +1,489 @@
+package statetest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+)
+
+// ErrInjected is returned by the calls failed by FaultyRepo and FaultyProcessor.
+var ErrInjected = errors.New("injected fault")
+
+// faults draws the faults to inject from a seeded source. The sequence of faults is
+// deterministic under a seed, though which calls receive them depends on scheduling when
+// called concurrently.
+type faults struct {
+	mu    sync.Mutex
+	rng   *rand.Rand
+	calls int
+}
+
+// roll returns whether an event with the given probability happens.
+func (f *faults) roll(seed int64, rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rng == nil {
+		f.rng = rand.New(rand.NewSource(seed))
+	}
+	return f.rng.Float64() < rate
+}
+
+// count counts a call, returning the number of calls so far.
+func (f *faults) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	return f.calls
+}
+
+// FaultyRepo decorates a Repo with injected failures, latency, and save conflicts, for
+// testing how code built on the repo copes with an unreliable database. Transactions and
+// migrations are passed through untouched.
+type FaultyRepo struct {
+	state.Repo
+	// Seed seeds the random faults.
+	Seed int64
+	// FailRate is the probability of failing each call.
+	FailRate float64
+	// FailEvery fails every Nth call, counting calls to every method, if non-zero.
+	FailEvery int
+	// FailMethods fails every call to the methods with these names, e.g. "GetPotentialLeases".
+	FailMethods map[string]bool
+	// ConflictRate is the probability of a save failing on a version conflict, as if the model
+	// had been modified concurrently. The model is left with a stale version, and subsequent
+	// saves of it fail too.
+	ConflictRate float64
+	// Latency is added to every call.
+	Latency time.Duration
+
+	faults faults
+}
+
+// fail sleeps for the latency, and returns ErrInjected if the call to method should fail.
+func (r *FaultyRepo) fail(method string) error {
+	if r.Latency > 0 {
+		time.Sleep(r.Latency)
+	}
+	n := r.faults.count()
+	if r.faults.roll(r.Seed, r.FailRate) || (r.FailEvery > 0 && n%r.FailEvery == 0) || r.FailMethods[method] {
+		return ErrInjected
+	}
+	return nil
+}
+
+// conflict makes the model stale if a conflict is rolled, so that saving it fails.
+func (r *FaultyRepo) conflict(m state.Model) {
+	if r.faults.roll(r.Seed, r.ConflictRate) && m.GetVersion() > 0 {
+		m.DecrementVersion()
+	}
+}
+
+func (r *FaultyRepo) Save(ctx context.Context, m state.Model) bool {
+	if r.fail("Save") != nil {
+		return false
+	}
+	r.conflict(m)
+	return r.Repo.Save(ctx, m)
+}
+
+func (r *FaultyRepo) SaveWithOutbox(ctx context.Context, m state.Model, events ...*state.OutboxEvent) bool {
+	if r.fail("SaveWithOutbox") != nil {
+		return false
+	}
+	r.conflict(m)
+	return r.Repo.SaveWithOutbox(ctx, m, events...)
+}
+
+func (r *FaultyRepo) GetPotentialLeases(ctx context.Context, selector map[string]string) ([]*state.Partition, error) {
+	if err := r.fail("GetPotentialLeases"); err != nil {
+		return nil, err
+	}
+	return r.Repo.GetPotentialLeases(ctx, selector)
+}
+
+func (r *FaultyRepo) GetAvailableItems(ctx context.Context, p *state.Partition, limit int, order state.ItemOrder, retries state.RetryFilter) ([]*state.Item, error) {
+	if err := r.fail("GetAvailableItems"); err != nil {
+		return nil, err
+	}
+	return r.Repo.GetAvailableItems(ctx, p, limit, order, retries)
+}
+
+func (r *FaultyRepo) GetCountByStatus(ctx context.Context, id string) (map[state.Status]int, error) {
+	if err := r.fail("GetCountByStatus"); err != nil {
+		return nil, err
+	}
+	return r.Repo.GetCountByStatus(ctx, id)
+}
+
+func (r *FaultyRepo) GetPartitionProgress(ctx context.Context, id string) (*state.PartitionProgress, error) {
+	if err := r.fail("GetPartitionProgress"); err != nil {
+		return nil, err
+	}
+	return r.Repo.GetPartitionProgress(ctx, id)
+}
+
+func (r *FaultyRepo) GetAvailableLag(ctx context.Context, p *state.Partition) (time.Duration, error) {
+	if err := r.fail("GetAvailableLag"); err != nil {
+		return 0, err
+	}
+	return r.Repo.GetAvailableLag(ctx, p)
+}
+
+func (r *FaultyRepo) CountStuckItems(ctx context.Context, olderThan time.Duration) (map[string]int, error) {
+	if err := r.fail("CountStuckItems"); err != nil {
+		return nil, err
+	}
+	return r.Repo.CountStuckItems(ctx, olderThan)
+}
+
+func (r *FaultyRepo) CountAvailablePastGate(ctx context.Context, partitionID string, gate int) (int, error) {
+	if err := r.fail("CountAvailablePastGate"); err != nil {
+		return 0, err
+	}
+	return r.Repo.CountAvailablePastGate(ctx, partitionID, gate)
+}
+
+func (r *FaultyRepo) CountDelayedItems(ctx context.Context, p *state.Partition) (int, error) {
+	if err := r.fail("CountDelayedItems"); err != nil {
+		return 0, err
+	}
+	return r.Repo.CountDelayedItems(ctx, p)
+}
+
+func (r *FaultyRepo) Healthcheck(ctx context.Context) error {
+	if err := r.fail("Healthcheck"); err != nil {
+		return err
+	}
+	return r.Repo.Healthcheck(ctx)
+}
+
+func (r *FaultyRepo) GetPartition(ctx context.Context, id string) (*state.Partition, error) {
+	if err := r.fail("GetPartition"); err != nil {
+		return nil, err
+	}
+	return r.Repo.GetPartition(ctx, id)
+}
+
+func (r *FaultyRepo) GetItem(ctx context.Context, id string) (*state.Item, error) {
+	if err := r.fail("GetItem"); err != nil {
+		return nil, err
+	}
+	return r.Repo.GetItem(ctx, id)
+}
+
+func (r *FaultyRepo) ListPartitions(ctx context.Context, filter state.PartitionFilter, page state.PageRequest) ([]*state.Partition, state.PageToken, error) {
+	if err := r.fail("ListPartitions"); err != nil {
+		return nil, "", err
+	}
+	return r.Repo.ListPartitions(ctx, filter, page)
+}
+
+func (r *FaultyRepo) ListItems(ctx context.Context, filter state.ItemFilter, page state.PageRequest) ([]*state.Item, state.PageToken, error) {
+	if err := r.fail("ListItems"); err != nil {
+		return nil, "", err
+	}
+	return r.Repo.ListItems(ctx, filter, page)
+}
+
+func (r *FaultyRepo) CreatePartition(ctx context.Context, p *state.Partition) error {
+	if err := r.fail("CreatePartition"); err != nil {
+		return err
+	}
+	return r.Repo.CreatePartition(ctx, p)
+}
+
+func (r *FaultyRepo) GetOrCreatePartition(ctx context.Context, p *state.Partition) (*state.Partition, bool, error) {
+	if err := r.fail("GetOrCreatePartition"); err != nil {
+		return nil, false, err
+	}
+	return r.Repo.GetOrCreatePartition(ctx, p)
+}
+
+func (r *FaultyRepo) AcquireLease(ctx context.Context, p *state.Partition, owner string, until time.Time) (bool, error) {
+	if err := r.fail("AcquireLease"); err != nil {
+		return false, err
+	}
+	return r.Repo.AcquireLease(ctx, p, owner, until)
+}
+
+func (r *FaultyRepo) TryAcquireLease(ctx context.Context, partitionID, owner string, until time.Time, fence bool) (bool, error) {
+	if err := r.fail("TryAcquireLease"); err != nil {
+		return false, err
+	}
+	return r.Repo.TryAcquireLease(ctx, partitionID, owner, until, fence)
+}
+
+func (r *FaultyRepo) AcquireLeases(ctx context.Context, candidates []string, owner string, until time.Time, limit int, fence bool) ([]*state.Partition, error) {
+	if err := r.fail("AcquireLeases"); err != nil {
+		return nil, err
+	}
+	return r.Repo.AcquireLeases(ctx, candidates, owner, until, limit, fence)
+}
+
+func (r *FaultyRepo) ReleaseLease(ctx context.Context, p *state.Partition) error {
+	if err := r.fail("ReleaseLease"); err != nil {
+		return err
+	}
+	return r.Repo.ReleaseLease(ctx, p)
+}
+
+func (r *FaultyRepo) GetLeaseHistory(ctx context.Context, partitionID string, limit int) ([]*state.LeaseEvent, error) {
+	if err := r.fail("GetLeaseHistory"); err != nil {
+		return nil, err
+	}
+	return r.Repo.GetLeaseHistory(ctx, partitionID, limit)
+}
+
+func (r *FaultyRepo) PurgeLeaseEvents(ctx context.Context, before time.Time) (int, error) {
+	if err := r.fail("PurgeLeaseEvents"); err != nil {
+		return 0, err
+	}
+	return r.Repo.PurgeLeaseEvents(ctx, before)
+}
+
+func (r *FaultyRepo) ReleaseExpiredLeases(ctx context.Context) (int, error) {
+	if err := r.fail("ReleaseExpiredLeases"); err != nil {
+		return 0, err
+	}
+	return r.Repo.ReleaseExpiredLeases(ctx)
+}
+
+func (r *FaultyRepo) RetryFailedPartitions(ctx context.Context) ([]*state.Partition, error) {
+	if err := r.fail("RetryFailedPartitions"); err != nil {
+		return nil, err
+	}
+	return r.Repo.RetryFailedPartitions(ctx)
+}
+
+func (r *FaultyRepo) CreateItems(ctx context.Context, items ...*state.Item) error {
+	if err := r.fail("CreateItems"); err != nil {
+		return err
+	}
+	return r.Repo.CreateItems(ctx, items...)
+}
+
+func (r *FaultyRepo) GetOrCreateItem(ctx context.Context, i *state.Item) (*state.Item, bool, error) {
+	if err := r.fail("GetOrCreateItem"); err != nil {
+		return nil, false, err
+	}
+	return r.Repo.GetOrCreateItem(ctx, i)
+}
+
+func (r *FaultyRepo) RetryFailedItems(ctx context.Context, partitionID string) (int, error) {
+	if err := r.fail("RetryFailedItems"); err != nil {
+		return 0, err
+	}
+	return r.Repo.RetryFailedItems(ctx, partitionID)
+}
+
+func (r *FaultyRepo) ReopenPartition(ctx context.Context, id string, gate *int) error {
+	if err := r.fail("ReopenPartition"); err != nil {
+		return err
+	}
+	return r.Repo.ReopenPartition(ctx, id, gate)
+}
+
+func (r *FaultyRepo) SetPartitionMaxRetries(ctx context.Context, id string, maxRetries *int) error {
+	if err := r.fail("SetPartitionMaxRetries"); err != nil {
+		return err
+	}
+	return r.Repo.SetPartitionMaxRetries(ctx, id, maxRetries)
+}
+
+func (r *FaultyRepo) SetItemMaxRetries(ctx context.Context, id string, maxRetries *int) error {
+	if err := r.fail("SetItemMaxRetries"); err != nil {
+		return err
+	}
+	return r.Repo.SetItemMaxRetries(ctx, id, maxRetries)
+}
+
+func (r *FaultyRepo) CancelItem(ctx context.Context, id string) error {
+	if err := r.fail("CancelItem"); err != nil {
+		return err
+	}
+	return r.Repo.CancelItem(ctx, id)
+}
+
+func (r *FaultyRepo) RedriveItem(ctx context.Context, id string, gate *int) error {
+	if err := r.fail("RedriveItem"); err != nil {
+		return err
+	}
+	return r.Repo.RedriveItem(ctx, id, gate)
+}
+
+func (r *FaultyRepo) PurgeItems(ctx context.Context, filter state.ItemFilter) (int, error) {
+	if err := r.fail("PurgeItems"); err != nil {
+		return 0, err
+	}
+	return r.Repo.PurgeItems(ctx, filter)
+}
+
+func (r *FaultyRepo) ReencryptPartition(ctx context.Context, id string, keyID string) (int, error) {
+	if err := r.fail("ReencryptPartition"); err != nil {
+		return 0, err
+	}
+	return r.Repo.ReencryptPartition(ctx, id, keyID)
+}
+
+func (r *FaultyRepo) GetPartitionQuotaUsage(ctx context.Context, id string) (*state.QuotaUsage, error) {
+	if err := r.fail("GetPartitionQuotaUsage"); err != nil {
+		return nil, err
+	}
+	return r.Repo.GetPartitionQuotaUsage(ctx, id)
+}
+
+func (r *FaultyRepo) GetTenantQuotaUsage(ctx context.Context, tenant string) (*state.QuotaUsage, error) {
+	if err := r.fail("GetTenantQuotaUsage"); err != nil {
+		return nil, err
+	}
+	return r.Repo.GetTenantQuotaUsage(ctx, tenant)
+}
+
+func (r *FaultyRepo) SetPartitionMaxPendingItems(ctx context.Context, id string, max *int) error {
+	if err := r.fail("SetPartitionMaxPendingItems"); err != nil {
+		return err
+	}
+	return r.Repo.SetPartitionMaxPendingItems(ctx, id, max)
+}
+
+func (r *FaultyRepo) SetTenantMaxPendingItems(ctx context.Context, tenant string, max *int) error {
+	if err := r.fail("SetTenantMaxPendingItems"); err != nil {
+		return err
+	}
+	return r.Repo.SetTenantMaxPendingItems(ctx, tenant, max)
+}
+
+func (r *FaultyRepo) ExportPartition(ctx context.Context, id string, w io.Writer) error {
+	if err := r.fail("ExportPartition"); err != nil {
+		return err
+	}
+	return r.Repo.ExportPartition(ctx, id, w)
+}
+
+func (r *FaultyRepo) ImportPartition(ctx context.Context, rd io.Reader, opts state.ImportOptions) (*state.Partition, error) {
+	if err := r.fail("ImportPartition"); err != nil {
+		return nil, err
+	}
+	return r.Repo.ImportPartition(ctx, rd, opts)
+}
+
+func (r *FaultyRepo) GetItemByIdempotencyKey(ctx context.Context, partitionID, key string) (*state.Item, error) {
+	if err := r.fail("GetItemByIdempotencyKey"); err != nil {
+		return nil, err
+	}
+	return r.Repo.GetItemByIdempotencyKey(ctx, partitionID, key)
+}
+
+func (r *FaultyRepo) FailExpiredItems(ctx context.Context) (int, error) {
+	if err := r.fail("FailExpiredItems"); err != nil {
+		return 0, err
+	}
+	return r.Repo.FailExpiredItems(ctx)
+}
+
+func (r *FaultyRepo) ReclaimStuckItems(ctx context.Context, olderThan time.Duration) (int, error) {
+	if err := r.fail("ReclaimStuckItems"); err != nil {
+		return 0, err
+	}
+	return r.Repo.ReclaimStuckItems(ctx, olderThan)
+}
+
+func (r *FaultyRepo) ClaimItems(ctx context.Context, owner string, limit int, visibility time.Duration) ([]*state.Item, error) {
+	if err := r.fail("ClaimItems"); err != nil {
+		return nil, err
+	}
+	return r.Repo.ClaimItems(ctx, owner, limit, visibility)
+}
+
+func (r *FaultyRepo) ExtendItem(ctx context.Context, itemID, owner string, d time.Duration) (bool, error) {
+	if err := r.fail("ExtendItem"); err != nil {
+		return false, err
+	}
+	return r.Repo.ExtendItem(ctx, itemID, owner, d)
+}
+
+func (r *FaultyRepo) CountDeadlineMisses(ctx context.Context, partitionID string) (int, error) {
+	if err := r.fail("CountDeadlineMisses"); err != nil {
+		return 0, err
+	}
+	return r.Repo.CountDeadlineMisses(ctx, partitionID)
+}
+
+func (r *FaultyRepo) ClaimOutboxBatch(ctx context.Context, limit int, claimFor time.Duration) ([]*state.OutboxEvent, error) {
+	if err := r.fail("ClaimOutboxBatch"); err != nil {
+		return nil, err
+	}
+	return r.Repo.ClaimOutboxBatch(ctx, limit, claimFor)
+}
+
+func (r *FaultyRepo) MarkOutboxPublished(ctx context.Context, ids ...string) error {
+	if err := r.fail("MarkOutboxPublished"); err != nil {
+		return err
+	}
+	return r.Repo.MarkOutboxPublished(ctx, ids...)
+}
+
+func (r *FaultyRepo) Heartbeat(ctx context.Context, o *state.Owner) error {
+	if err := r.fail("Heartbeat"); err != nil {
+		return err
+	}
+	return r.Repo.Heartbeat(ctx, o)
+}
+
+func (r *FaultyRepo) ListOwners(ctx context.Context) ([]*state.Owner, error) {
+	if err := r.fail("ListOwners"); err != nil {
+		return nil, err
+	}
+	return r.Repo.ListOwners(ctx)
+}
+
+func (r *FaultyRepo) AcquireLeadership(ctx context.Context, election, owner string, until time.Time) (bool, error) {
+	if err := r.fail("AcquireLeadership"); err != nil {
+		return false, err
+	}
+	return r.Repo.AcquireLeadership(ctx, election, owner, until)
+}
+
+func (r *FaultyRepo) ReleaseLeadership(ctx context.Context, election, owner string) error {
+	if err := r.fail("ReleaseLeadership"); err != nil {
+		return err
+	}
+	return r.Repo.ReleaseLeadership(ctx, election, owner)
+}
+
+// FaultyProcessor decorates a Processor with injected errors and slow responses.
+type FaultyProcessor struct {
+	state.Processor
+	// Seed seeds the random faults.
+	Seed int64
+	// ErrorRate is the probability of a call failing with a retryable error, and
+	// NonRetryableRate with a non-retryable one.
+	ErrorRate        float64
+	NonRetryableRate float64
+	// SlowRate is the probability of a call being delayed by Latency.
+	SlowRate float64
+	Latency  time.Duration
+
+	faults faults
+}
+
+func (p *FaultyProcessor) Process(id string, b []byte) (*state.ProcessorResponse, error) {
+	if p.faults.roll(p.Seed, p.SlowRate) {
+		time.Sleep(p.Latency)
+	}
+	if p.faults.roll(p.Seed, p.NonRetryableRate) {
+		return nil, state.NonRetryableError(ErrInjected.Error())
+	}
+	if p.faults.roll(p.Seed, p.ErrorRate) {
+		return nil, ErrInjected
+	}
+	return p.Processor.Process(id, b)
+}
@@ -0,0 +1,259 @@
+package statetest
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+)
+
+// StepKind is the kind of a step run by a Simulator.
+type StepKind int
+
+const (
+	// ScanStep scans for potential leases, every LeaseInterval of the watcher.
+	ScanStep StepKind = iota
+	// FetchStep reads a poll of a watched partition, every PollInterval of the watcher.
+	FetchStep
+	// SaveStep saves the lease and decision of the poll read by the previous FetchStep.
+	SaveStep
+	// ProcessStep processes an item of a saved poll, and saves its result.
+	ProcessStep
+)
+
+func (k StepKind) String() string {
+	switch k {
+	case ScanStep:
+		return "scan"
+	case FetchStep:
+		return "fetch"
+	case SaveStep:
+		return "save"
+	case ProcessStep:
+		return "process"
+	}
+	return fmt.Sprintf("StepKind(%d)", int(k))
+}
+
+// Step is a step of a watcher run by a Simulator.
+type Step struct {
+	Kind    StepKind
+	Watcher *state.Watcher
+	// PartitionID is the partition of all but a ScanStep, and ItemID the item of a ProcessStep.
+	PartitionID string
+	ItemID      string
+	// Gate is the gate decided on by the poll of a SaveStep, or the item's of a ProcessStep.
+	Gate int
+	At   time.Time
+}
+
+func (s Step) String() string {
+	switch s.Kind {
+	case ScanStep:
+		return fmt.Sprintf("%s %s %s", s.At.Format(time.StampMilli), s.Watcher.OwnerID, s.Kind)
+	case ProcessStep:
+		return fmt.Sprintf("%s %s %s %s/%s at gate %d", s.At.Format(time.StampMilli), s.Watcher.OwnerID, s.Kind, s.PartitionID, s.ItemID, s.Gate)
+	}
+	return fmt.Sprintf("%s %s %s %s", s.At.Format(time.StampMilli), s.Watcher.OwnerID, s.Kind, s.PartitionID)
+}
+
+// Simulator runs the steps of watchers one at a time on a fake clock, for reproducing the
+// orderings of lease scans, polls and item processing that real goroutines and timers make
+// nearly impossible to hit. The steps due at the same time run in an order drawn from the
+// seed, so that a seed reproduces a run, and the clock only advances once no step is due.
+//
+// The watchers are driven through their step methods, see state.Watcher.ScanLeases, and must
+// not be started. Their repos should use the simulator's Clock, for leases to expire on it.
+// Background work, such as sweeps, heartbeats and the watchdog, isn't simulated.
+type Simulator struct {
+	Clock *clock.Fake
+	// Before, if set, is called before each step, e.g. to change the repo at a specific step.
+	// A step for which it returns an error fails, as if the watcher had crashed mid-step: a
+	// failed scan is retried a LeaseInterval later, a failed fetch or save stops the watcher
+	// watching the partition until its lease expires, and a failed process leaves the item to
+	// be processed again.
+	Before func(Step) error
+	// History holds the steps run so far, failed or not.
+	History []Step
+
+	rng      *rand.Rand
+	tasks    []*task
+	watchers map[*state.Watcher]*simWatcher
+}
+
+// simWatcher is the state a watcher's loop keeps between steps.
+type simWatcher struct {
+	leased map[string]bool
+	queued map[string]bool
+}
+
+// task is a step due to run.
+type task struct {
+	step      Step
+	due       time.Time
+	partition *state.Partition
+	poll      *state.Poll
+	item      *state.Item
+}
+
+// NewSimulator returns a Simulator drawing its orderings from seed, with its clock at start.
+func NewSimulator(seed int64, start time.Time) *Simulator {
+	return &Simulator{
+		Clock:    clock.NewFake(start),
+		rng:      rand.New(rand.NewSource(seed)),
+		watchers: map[*state.Watcher]*simWatcher{},
+	}
+}
+
+// Add sets the watcher's defaults and clock, and schedules its first lease scan.
+func (s *Simulator) Add(w *state.Watcher) {
+	w.Clock = s.Clock
+	w.Init()
+	s.watchers[w] = &simWatcher{leased: map[string]bool{}, queued: map[string]bool{}}
+	s.schedule(&task{step: Step{Kind: ScanStep, Watcher: w}, due: s.Clock.Now()})
+}
+
+// Crash drops the watcher's pending steps, as if its process died: its leases aren't
+// released, and expire.
+func (s *Simulator) Crash(w *state.Watcher) {
+	s.drop(func(t *task) bool { return t.step.Watcher == w })
+	delete(s.watchers, w)
+}
+
+// Step runs the next step, first advancing the clock to it if none is due. It returns false
+// if there are no steps left.
+func (s *Simulator) Step(ctx context.Context) bool {
+	if len(s.tasks) == 0 {
+		return false
+	}
+	if next := s.next(); next.After(s.Clock.Now()) {
+		s.Clock.Advance(next.Sub(s.Clock.Now()))
+	}
+	s.run(ctx, s.pick())
+	return true
+}
+
+// Run runs the steps due within d, leaving the clock d later.
+func (s *Simulator) Run(ctx context.Context, d time.Duration) {
+	end := s.Clock.Now().Add(d)
+	for len(s.tasks) > 0 && !s.next().After(end) && ctx.Err() == nil {
+		s.Step(ctx)
+	}
+	if now := s.Clock.Now(); end.After(now) {
+		s.Clock.Advance(end.Sub(now))
+	}
+}
+
+// next returns when the earliest step is due.
+func (s *Simulator) next() time.Time {
+	next := s.tasks[0].due
+	for _, t := range s.tasks[1:] {
+		if t.due.Before(next) {
+			next = t.due
+		}
+	}
+	return next
+}
+
+// pick removes one of the steps due from the schedule at random, and returns it.
+func (s *Simulator) pick() *task {
+	now := s.Clock.Now()
+	var due []int
+	for n, t := range s.tasks {
+		if !t.due.After(now) {
+			due = append(due, n)
+		}
+	}
+	n := due[s.rng.Intn(len(due))]
+	t := s.tasks[n]
+	s.tasks = append(s.tasks[:n], s.tasks[n+1:]...)
+	return t
+}
+
+func (s *Simulator) schedule(t *task) {
+	s.tasks = append(s.tasks, t)
+}
+
+// drop removes the pending steps matching the predicate.
+func (s *Simulator) drop(match func(t *task) bool) {
+	kept := s.tasks[:0]
+	for _, t := range s.tasks {
+		if match(t) {
+			if t.item != nil {
+				delete(s.watchers[t.step.Watcher].queued, t.item.ID)
+			}
+			continue
+		}
+		kept = append(kept, t)
+	}
+	s.tasks = kept
+}
+
+// forget stops the watcher watching the partition, dropping its pending steps.
+func (s *Simulator) forget(w *state.Watcher, sw *simWatcher, id string) {
+	w.Forget(id)
+	delete(sw.leased, id)
+	s.drop(func(t *task) bool { return t.step.Watcher == w && t.step.PartitionID == id })
+}
+
+func (s *Simulator) run(ctx context.Context, t *task) {
+	w, now := t.step.Watcher, s.Clock.Now()
+	sw := s.watchers[w]
+	t.step.At = now
+	s.History = append(s.History, t.step)
+	var err error
+	if s.Before != nil {
+		err = s.Before(t.step)
+	}
+
+	switch t.step.Kind {
+	case ScanStep:
+		if err == nil {
+			for _, p := range w.ScanLeases(ctx) {
+				sw.leased[p.ID] = false
+				s.schedule(&task{step: Step{Kind: FetchStep, Watcher: w, PartitionID: p.ID}, due: now, partition: p})
+			}
+		}
+		s.schedule(&task{step: Step{Kind: ScanStep, Watcher: w}, due: now.Add(w.LeaseInterval)})
+	case FetchStep:
+		var poll *state.Poll
+		if err == nil {
+			poll, err = w.FetchPoll(ctx, t.partition)
+		}
+		if err != nil {
+			s.forget(w, sw, t.partition.ID)
+			return
+		}
+		step := Step{Kind: SaveStep, Watcher: w, PartitionID: t.partition.ID, Gate: t.partition.Gate}
+		s.schedule(&task{step: step, due: now, partition: t.partition, poll: poll})
+	case SaveStep:
+		if err != nil {
+			s.forget(w, sw, t.partition.ID)
+			return
+		}
+		items, ok := w.SavePoll(ctx, t.poll, sw.leased[t.partition.ID])
+		if !ok {
+			s.forget(w, sw, t.partition.ID)
+			return
+		}
+		sw.leased[t.partition.ID] = true
+		for _, i := range items {
+			if sw.queued[i.ID] {
+				continue
+			}
+			sw.queued[i.ID] = true
+			step := Step{Kind: ProcessStep, Watcher: w, PartitionID: i.PartitionID, ItemID: i.ID, Gate: i.Gate}
+			s.schedule(&task{step: step, due: now, item: i})
+		}
+		step := Step{Kind: FetchStep, Watcher: w, PartitionID: t.partition.ID}
+		s.schedule(&task{step: step, due: now.Add(w.PollInterval), partition: t.partition})
+	case ProcessStep:
+		delete(sw.queued, t.item.ID)
+		if err == nil {
+			w.ProcessItem(ctx, t.item)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Package statetest contains helpers for testing code built on the state package, including
+// a conformance suite that every Repo implementation should pass.
+package statetest
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+// NewSQLiteRepo returns a migrated GormRepo backed by an empty sqlite database in a temp
+// file, which is removed when the test completes.
+func NewSQLiteRepo(t testing.TB) *state.GormRepo {
+	t.Helper()
+	f, err := ioutil.TempFile("", "statetest_db_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// We set a table prefix to make sure nothing is reliant on the default table names.
+	// Transactions take the write lock up front and wait for it, so that concurrent writers
+	// are serialized rather than failing with "database is locked".
+	db, err := gorm.Open(sqlite.Open(f.Name()+"?_busy_timeout=5000&_txlock=immediate"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+		NamingStrategy: schema.NamingStrategy{
+			TablePrefix: "statetest_",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := state.NewGormRepo(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+		if err := os.Remove(f.Name()); err != nil {
+			t.Errorf("temp file remove error: %s", err)
+		}
+	})
+	return r
+}
@@ -0,0 +1,148 @@
+package state
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a point in time snapshot of a watcher's activity.
+type Stats struct {
+	OwnerID string `json:"owner_id"`
+	// Leases are the IDs of the partitions currently leased by the watcher.
+	Leases []string `json:"leases"`
+	// Leader is whether the watcher leads its LeaderElection.
+	Leader bool `json:"leader,omitempty"`
+	// BatchLimit is the number of items the watcher processes at once: its BatchSize, or the
+	// limit of its AdaptiveBatch.
+	BatchLimit int `json:"batch_limit"`
+	// QueueDepth is the number of items waiting for a free item processor.
+	QueueDepth int `json:"queue_depth"`
+	// InFlight is the number of items being processed for each leased partition.
+	InFlight map[string]int `json:"in_flight"`
+	// MaxConcurrency is the MaxConcurrency, which caps InFlight, of the partitions with items
+	// queued or in flight which set one.
+	MaxConcurrency map[string]int `json:"max_concurrency,omitempty"`
+
+	ItemsProcessed int64 `json:"items_processed"`
+	ItemsCompleted int64 `json:"items_completed"`
+	// ItemsDeduplicated is the number of items completed with the result of an earlier item
+	// with the same payload, without processing them, see DedupeByHash. They are also counted
+	// as ItemsCompleted.
+	ItemsDeduplicated int64 `json:"items_deduplicated,omitempty"`
+	// ItemErrors is the number of failed attempts, other than ProcessingTimeouts.
+	ItemErrors    int64 `json:"item_errors"`
+	SaveConflicts int64 `json:"save_conflicts"`
+	// StaleReads is the number of items read from a lagging replica after the watcher had
+	// saved them, which were skipped rather than processed again, see GormRepo.ReadDB.
+	StaleReads int64 `json:"stale_reads,omitempty"`
+	// DeadlineMisses is the number of items failed because their deadline passed, including
+	// by the watcher's sweeps.
+	DeadlineMisses int64 `json:"deadline_misses"`
+	// ProcessingTimeouts is the number of attempts abandoned after the ProcessingTimeout,
+	// including the stuck items reclaimed by the watcher's sweeps.
+	ProcessingTimeouts int64 `json:"processing_timeouts"`
+	// Panics is the number of attempts whose processor panicked, also counted as ItemErrors.
+	Panics int64 `json:"panics"`
+	// Stalls is the number of polls of leased partitions the watchdog cancelled for taking
+	// over the StallThreshold.
+	Stalls int64 `json:"stalls"`
+	// PartitionRetries is the number of failed partitions retried by the watcher's sweeps,
+	// see MaxPartitionRetries.
+	PartitionRetries int64 `json:"partition_retries,omitempty"`
+	// DroppedEvents is the number of events dropped because the Events buffer was full.
+	DroppedEvents int64 `json:"dropped_events"`
+	// PollInterval is the current interval between polls of each leased partition, which
+	// grows while the watcher is idle.
+	PollInterval time.Duration `json:"poll_interval"`
+	// LimiterWait is the total time item processors have spent waiting on the rate limiter.
+	LimiterWait time.Duration `json:"limiter_wait"`
+	// Throttles is the number of attempts the processor throttled, and ThrottleFactors the
+	// factors by which the throttled partitions' poll intervals are multiplied.
+	Throttles       int64          `json:"throttles"`
+	ThrottleFactors map[string]int `json:"throttle_factors,omitempty"`
+	// Breakers are the states of the leased partitions' circuit breakers which aren't closed,
+	// and GlobalBreaker that of the watcher's, see BreakerThreshold.
+	Breakers      map[string]BreakerState `json:"breakers,omitempty"`
+	GlobalBreaker BreakerState            `json:"global_breaker,omitempty"`
+	// AvailableLags are how long the oldest available item of each leased partition has
+	// waited, as of its last poll, and MaxAvailableLag the greatest of them.
+	AvailableLags   map[string]time.Duration `json:"available_lags,omitempty"`
+	MaxAvailableLag time.Duration            `json:"max_available_lag"`
+
+	LastLeaseScan time.Time `json:"last_lease_scan"`
+	LastItemSave  time.Time `json:"last_item_save"`
+}
+
+// watcherCounters are updated atomically by the watcher's goroutines.
+type watcherCounters struct {
+	itemsProcessed     int64
+	itemsCompleted     int64
+	itemsDeduplicated  int64
+	itemErrors         int64
+	saveConflicts      int64
+	deadlineMisses     int64
+	limiterWait        int64
+	droppedEvents      int64
+	throttles          int64
+	processingTimeouts int64
+	panics             int64
+	staleReads         int64
+	stalls             int64
+	partitionRetries   int64
+	// Consecutive idle lease scans, and whether work was found since the last scan.
+	idleScans int64
+	workSeen  int32
+
+	// Unix nanosecond timestamps of the last progress made by the watcher's loops.
+	lastLeaseScan int64
+	lastItemSave  int64
+	// repoOutageStart is the Unix nanosecond timestamp of the first failure of the repo since
+	// it was last reached, or 0.
+	repoOutageStart int64
+}
+
+// Stats returns a snapshot of the watcher's current leases, queue and counters.
+func (w *Watcher) Stats() Stats {
+	w.mu.Lock()
+	leases := make([]string, 0, len(w.leases))
+	for id := range w.leases {
+		leases = append(leases, id)
+	}
+	w.mu.Unlock()
+	sort.Strings(leases)
+	breakers, global := w.breakerStates()
+	lags, maxLag := w.availableLags()
+
+	return Stats{
+		OwnerID:            w.OwnerID,
+		Leases:             leases,
+		Leader:             w.IsLeader(),
+		BatchLimit:         w.batchLimit(),
+		QueueDepth:         w.dispatch.queued(),
+		InFlight:           w.dispatch.inFlight(),
+		MaxConcurrency:     w.dispatch.maxConcurrency(),
+		ItemsProcessed:     atomic.LoadInt64(&w.counters.itemsProcessed),
+		ItemsCompleted:     atomic.LoadInt64(&w.counters.itemsCompleted),
+		ItemsDeduplicated:  atomic.LoadInt64(&w.counters.itemsDeduplicated),
+		ItemErrors:         atomic.LoadInt64(&w.counters.itemErrors),
+		SaveConflicts:      atomic.LoadInt64(&w.counters.saveConflicts),
+		DeadlineMisses:     atomic.LoadInt64(&w.counters.deadlineMisses),
+		ProcessingTimeouts: atomic.LoadInt64(&w.counters.processingTimeouts),
+		Panics:             atomic.LoadInt64(&w.counters.panics),
+		StaleReads:         atomic.LoadInt64(&w.counters.staleReads),
+		Stalls:             atomic.LoadInt64(&w.counters.stalls),
+		PartitionRetries:   atomic.LoadInt64(&w.counters.partitionRetries),
+		DroppedEvents:      atomic.LoadInt64(&w.counters.droppedEvents),
+		PollInterval:       w.partitionPollInterval(),
+		LimiterWait:        time.Duration(atomic.LoadInt64(&w.counters.limiterWait)),
+		Throttles:          atomic.LoadInt64(&w.counters.throttles),
+		ThrottleFactors:    w.throttleFactors(),
+		Breakers:           breakers,
+		GlobalBreaker:      global,
+		AvailableLags:      lags,
+		MaxAvailableLag:    maxLag,
+		LastLeaseScan:      time.Unix(0, atomic.LoadInt64(&w.counters.lastLeaseScan)),
+		LastItemSave:       time.Unix(0, atomic.LoadInt64(&w.counters.lastItemSave)),
+	}
+}
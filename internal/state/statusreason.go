@@ -0,0 +1,124 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// MaxStatusReasonLength is the most bytes of a partition's StatusReason, past which it is
+// truncated.
+const MaxStatusReasonLength = 1024
+
+const (
+	// statusReasonTopErrors is the number of distinct errors listed in the StatusReason of a
+	// failed partition.
+	statusReasonTopErrors = 3
+	// statusReasonSampleSize is the most failed items whose errors are summarized.
+	statusReasonSampleSize = 100
+)
+
+// statusReason returns the StatusReason of the partition as the watcher changes its status:
+// for a failed partition, its failed items' last errors, for a completed one, the counts of its
+// items and how long it took, and none otherwise.
+func (w *Watcher) statusReason(ctx context.Context, p *Partition, counts map[Status]int) string {
+	switch p.Status {
+	case Complete:
+		return completeReason(counts, w.Clock.Now().Sub(p.CreatedAt))
+	case Failed:
+		ctx, cancel := w.fetchContext(ctx)
+		defer cancel()
+		items, _, err := w.Repo.ListItems(ctx, ItemFilter{PartitionID: p.ID, Status: Failed}, PageRequest{Size: statusReasonSampleSize})
+		if err != nil {
+			glog.Warningf("error reading the failed items of partition %s to summarize them: %s", p.ID, err)
+		}
+		return failedReason(p.GateName(), counts[Failed], items)
+	}
+	return ""
+}
+
+// completeReason summarizes the items of a partition that completed after d, noting the failed
+// items skipped within its failure tolerance.
+func completeReason(counts map[Status]int, d time.Duration) string {
+	total := 0
+	var parts []string
+	for _, s := range []Status{Complete, Cancelled, Failed, Available} {
+		if counts[s] > 0 {
+			total += counts[s]
+			parts = append(parts, fmt.Sprintf("%d %s", counts[s], strings.ToLower(s.String())))
+		}
+	}
+	reason := fmt.Sprintf("%d items", total)
+	if len(parts) > 0 {
+		reason += ": " + strings.Join(parts, ", ")
+	}
+	reason = fmt.Sprintf("%s; took %s", reason, d.Round(time.Second))
+	if counts[Failed] > 0 {
+		reason += fmt.Sprintf("; skipped %d failed items within the failure tolerance", counts[Failed])
+	}
+	return truncateReason(reason)
+}
+
+// failedReason summarizes the failed items of a partition failed at the gate, listing the
+// most common of their last errors, among those of the items read, with their counts.
+func failedReason(gate string, failed int, items []*Item) string {
+	if failed < len(items) {
+		failed = len(items)
+	}
+	reason := fmt.Sprintf("%d items failed at gate %s", failed, gate)
+	type summary struct {
+		msg   string
+		count int
+	}
+	var errs []*summary
+	byKey := map[string]*summary{}
+	for _, i := range items {
+		msg := lastError(i.ErrorMessages)
+		if msg == "" {
+			continue
+		}
+		key := errorKey(msg)
+		if s, ok := byKey[key]; ok {
+			s.count++
+			continue
+		}
+		byKey[key] = &summary{msg: msg, count: 1}
+		errs = append(errs, byKey[key])
+	}
+	if len(errs) == 0 {
+		return truncateReason(reason)
+	}
+	sort.SliceStable(errs, func(a, b int) bool { return errs[a].count > errs[b].count })
+	if len(errs) > statusReasonTopErrors {
+		errs = errs[:statusReasonTopErrors]
+	}
+	top := make([]string, len(errs))
+	for n, s := range errs {
+		top[n] = fmt.Sprintf("%s (%d)", s.msg, s.count)
+	}
+	return truncateReason(fmt.Sprintf("%s; most common errors: %s", reason, strings.Join(top, "; ")))
+}
+
+// lastError returns the most recent of an item's ErrorMessages.
+func lastError(messages string) string {
+	if n := strings.LastIndexByte(messages, '\n'); n >= 0 {
+		messages = messages[n+1:]
+	}
+	if _, ok := parseOmittedErrors(messages); ok {
+		return ""
+	}
+	return strings.TrimSpace(messages)
+}
+
+// truncateReason cuts the reason to MaxStatusReasonLength bytes, marking it as truncated.
+func truncateReason(reason string) string {
+	if len(reason) <= MaxStatusReasonLength {
+		return reason
+	}
+	const marker = "..."
+	return strings.ToValidUTF8(reason[:MaxStatusReasonLength-len(marker)], "") + marker
+}
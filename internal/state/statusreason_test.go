@@ -0,0 +1,135 @@
+package state
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestFailedReason(t *testing.T) {
+	failed := func(messages ...string) *Item {
+		return &Item{Status: Failed, ErrorMessages: strings.Join(messages, "\n")}
+	}
+	testCases := []struct {
+		name   string
+		failed int
+		items  []*Item
+		want   string
+	}{
+		{"no items read", 2, nil, "2 items failed at gate 1"},
+		{"no errors", 1, []*Item{failed()}, "1 items failed at gate 1"},
+		{
+			"last errors by count",
+			5,
+			[]*Item{
+				failed("bad input"),
+				failed("bad input", "timeout contacting anonymizer at 2024-05-01T00:00:00Z"),
+				failed("timeout contacting anonymizer at 2024-05-01T00:01:00Z"),
+				failed("...3 earlier errors omitted", "connection refused, attempt 3"),
+				failed("connection refused, attempt 4"),
+			},
+			"5 items failed at gate 1; most common errors: timeout contacting anonymizer at 2024-05-01T00:00:00Z (2); connection refused, attempt 3 (2); bad input (1)",
+		},
+		{
+			"top errors only",
+			4,
+			[]*Item{failed("a"), failed("b"), failed("c"), failed("d"), failed("d")},
+			"5 items failed at gate 1; most common errors: d (2); a (1); b (1)",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := failedReason("1", tc.failed, tc.items); got != tc.want {
+				t.Errorf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCompleteReason(t *testing.T) {
+	got := completeReason(map[Status]int{Complete: 11, Cancelled: 1}, 200*time.Second+300*time.Millisecond)
+	if want := "12 items: 11 complete, 1 cancelled; took 3m20s"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	got = completeReason(map[Status]int{Complete: 3, Failed: 1}, time.Minute)
+	if want := "4 items: 3 complete, 1 failed; took 1m0s; skipped 1 failed items within the failure tolerance"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if got, want := completeReason(nil, time.Second), "0 items; took 1s"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestStatusReasonTruncated(t *testing.T) {
+	long := strings.Repeat("é", MaxStatusReasonLength)
+	got := failedReason("0", 1, []*Item{{ErrorMessages: long}})
+	if len(got) > MaxStatusReasonLength || !strings.HasSuffix(got, "...") || !utf8.ValidString(got) {
+		t.Errorf("expected the reason to be truncated to %d bytes of valid UTF-8, got %d bytes: %q", MaxStatusReasonLength, len(got), got)
+	}
+	if !strings.HasPrefix(got, "1 items failed at gate 0; most common errors: éé") {
+		t.Errorf("expected the reason to keep its start, got %q", got[:64])
+	}
+}
+
+func TestWatcherStatusReason(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	for id, msg := range map[string]string{"f1": "bad input", "f2": "timeout contacting anonymizer", "f3": "timeout contacting anonymizer"} {
+		if err := r.CreateItems(ctx, &Item{BaseModel: BaseModel{ID: id}, PartitionID: "p", Data: []byte(`{"times": 1}`)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Model(&Item{}).Where("id = ?", id).Updates(map[string]interface{}{"status": Failed, "error_messages": msg}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Status: Available, Data: []byte(`{"times": 1}`)})
+
+	events := runForEvents(t, r, &Watcher{Processor: &testProcessor{}, Repo: r, BatchSize: 1, PollInterval: 10 * time.Millisecond})
+	want := "3 items failed at gate 0; most common errors: timeout contacting anonymizer (2); bad input (1)"
+	p, err := r.GetPartition(ctx, "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != Failed || p.StatusReason != want {
+		t.Errorf("expected the partition to fail with reason %q, got %s with %q", want, p.Status, p.StatusReason)
+	}
+	var failed *Event
+	for n := range events {
+		if events[n].Type == PartitionFailed {
+			failed = &events[n]
+		}
+	}
+	if failed == nil || failed.Reason != want {
+		t.Errorf("expected the failure event to carry the reason, got %+v", failed)
+	}
+
+	if err := r.ReopenPartition(ctx, "p", nil); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := r.GetPartition(ctx, "p"); err != nil || p.StatusReason != "" {
+		t.Errorf("expected the reason to be cleared on reopen, got %q, %v", p.StatusReason, err)
+	}
+
+	// The items completing, the partition completes with their counts.
+	for _, id := range []string{"f1", "f2"} {
+		if err := r.CancelItem(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Model(&Item{}).Where("id = ?", "f3").Update("status", Available).Error; err != nil {
+		t.Fatal(err)
+	}
+	events = runForEvents(t, r, &Watcher{Processor: &testProcessor{}, Repo: r, BatchSize: 2, PollInterval: 10 * time.Millisecond, AutoClose: true})
+	if p, err = r.GetPartition(ctx, "p"); err != nil {
+		t.Fatal(err)
+	}
+	if want := "4 items: 2 complete, 2 cancelled; took "; p.Status != Complete || !strings.HasPrefix(p.StatusReason, want) {
+		t.Errorf("expected the partition to complete with reason %q..., got %s with %q", want, p.Status, p.StatusReason)
+	}
+	if e := events[len(events)-1]; e.Type != PartitionCompleted || e.Reason != p.StatusReason {
+		t.Errorf("expected the completion event to carry the reason, got %+v", e)
+	}
+}
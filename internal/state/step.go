@@ -0,0 +1,69 @@
+package state
+
+import "context"
+
+// The methods below run the steps of Start's loop one at a time, on the caller's goroutine,
+// for statetest.Simulator to interleave the steps of watchers deterministically. A watcher
+// driven by them must not also be started.
+
+// Init sets the defaults of the watcher's unset fields, as Start does.
+func (w *Watcher) Init() {
+	w.init()
+}
+
+// ScanLeases scans for potential leases once, and returns the partitions the watcher started
+// watching. Each is leased by its first SavePoll.
+func (w *Watcher) ScanLeases(ctx context.Context) []*Partition {
+	var watched []*Partition
+	w.scanLeases(ctx, func(p *Partition) {
+		watched = append(watched, p)
+	})
+	return watched
+}
+
+// Poll is a poll of a watched partition read by FetchPoll, and not yet saved by SavePoll.
+type Poll struct {
+	Partition *Partition
+	poll      *partitionPoll
+}
+
+// FetchPoll reads a poll of the watched partition, deciding on its progress. On error the
+// watcher stops watching the partition, as Start's loop does.
+func (w *Watcher) FetchPoll(ctx context.Context, p *Partition) (*Poll, error) {
+	poll, err := w.decide(ctx, p)
+	if err != nil {
+		w.forget(p.ID)
+		return nil, err
+	}
+	return &Poll{Partition: p, poll: poll}, nil
+}
+
+// SavePoll saves the poll's lease and decision, leased being whether an earlier poll already
+// leased the partition, and returns the items to process under the lease. It returns false if
+// the watcher stopped watching the partition, as it lost the lease or the partition is no
+// longer active. Items already being processed aren't filtered out, unlike in Start's loop.
+func (w *Watcher) SavePoll(ctx context.Context, poll *Poll, leased bool) ([]*Item, bool) {
+	p := poll.Partition
+	if !w.commit(ctx, p, poll.poll, &leased) {
+		w.forget(p.ID)
+		return nil, false
+	}
+	if w.breakerPaused(p.ID) {
+		return nil, true
+	}
+	return poll.poll.items, true
+}
+
+// Forget stops watching the partition without releasing its lease, as when a poll fails.
+func (w *Watcher) Forget(id string) {
+	w.forget(id)
+}
+
+// ProcessItem processes an item returned by SavePoll and saves the result, as an item
+// processor does. The watcher's Limiter is not waited on.
+func (w *Watcher) ProcessItem(ctx context.Context, i *Item) {
+	if w.admit(i) {
+		w.processItem(ctx, i)
+	}
+	w.releaseProbe(i)
+}
@@ -0,0 +1,159 @@
+package state_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state/statetest"
+)
+
+// countingProcessor completes every item, counting the attempts of each.
+type countingProcessor struct {
+	mu       sync.Mutex
+	attempts map[string]int
+}
+
+func (p *countingProcessor) Process(id string, b []byte) (*state.ProcessorResponse, error) {
+	p.mu.Lock()
+	p.attempts[id]++
+	p.mu.Unlock()
+	return &state.ProcessorResponse{Complete: true, Data: b}, nil
+}
+
+func (p *countingProcessor) Healthcheck(ctx context.Context) error {
+	return nil
+}
+
+func TestFaultyProcessorDeterministic(t *testing.T) {
+	outcomes := func() (out []bool) {
+		p := &statetest.FaultyProcessor{Processor: &countingProcessor{attempts: map[string]int{}}, Seed: 42, ErrorRate: 0.5}
+		for n := 0; n < 20; n++ {
+			_, err := p.Process("i", nil)
+			out = append(out, err == nil)
+		}
+		return out
+	}
+	if a, b := outcomes(), outcomes(); fmt.Sprint(a) != fmt.Sprint(b) {
+		t.Errorf("expected the same faults under the same seed, got %v and %v", a, b)
+	}
+}
+
+func TestFaultyRepo(t *testing.T) {
+	r := &statetest.FaultyRepo{Repo: statetest.NewSQLiteRepo(t), FailEvery: 2, FailMethods: map[string]bool{"ListOwners": true}}
+	ctx := context.Background()
+	if _, err := r.GetPartition(ctx, "p"); !state.IsNotFound(err) {
+		t.Errorf("expected the first call to pass through, got %v", err)
+	}
+	if _, err := r.GetPartition(ctx, "p"); err != statetest.ErrInjected {
+		t.Errorf("expected every second call to fail, got %v", err)
+	}
+	if _, err := r.ListOwners(ctx); err != statetest.ErrInjected {
+		t.Errorf("expected the method to fail, got %v", err)
+	}
+
+	r.FailEvery, r.ConflictRate = 0, 1
+	p := &state.Partition{BaseModel: state.BaseModel{ID: "p"}}
+	if !r.Save(ctx, p) {
+		t.Fatal("expected new models to be saved")
+	}
+	if r.Save(ctx, p) || r.Save(ctx, p) {
+		t.Error("expected a conflict to leave the model stale")
+	}
+}
+
+func TestStressWithFaults(t *testing.T) {
+	defer func(b bool) { state.OverrideMinLeaseDuration = b }(state.OverrideMinLeaseDuration)
+	state.OverrideMinLeaseDuration = true
+	repo := statetest.NewSQLiteRepo(t)
+	// Partitions failed by the injected non-retryable errors keep being leased, for their
+	// remaining items to be processed.
+	repo.LeaseFailedPartitions = true
+	ctx := context.Background()
+	const partitions, itemsPerPartition = 4, 25
+	for p := 0; p < partitions; p++ {
+		id := fmt.Sprint("p", p)
+		repo.Save(ctx, &state.Partition{BaseModel: state.BaseModel{ID: id}})
+		var items []*state.Item
+		for i := 0; i < itemsPerPartition; i++ {
+			items = append(items, &state.Item{BaseModel: state.BaseModel{ID: fmt.Sprint(id, "-", i)}, PartitionID: id, Data: []byte(`{}`)})
+		}
+		if err := repo.CreateItems(ctx, items...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	proc := &countingProcessor{attempts: map[string]int{}}
+	wctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	var events []<-chan state.Event
+	for n := int64(1); n <= 2; n++ {
+		w := &state.Watcher{
+			Repo:      &statetest.FaultyRepo{Repo: repo, Seed: n, FailRate: 0.05, ConflictRate: 0.05},
+			Processor: &statetest.FaultyProcessor{Processor: proc, Seed: n, ErrorRate: 0.08, NonRetryableRate: 0.02},
+			OwnerID:   fmt.Sprint("w", n),
+			BatchSize: 4,
+			// Partitions abandoned after a failed save are picked up again quickly.
+			PollInterval:  10 * time.Millisecond,
+			LeaseDuration: 100 * time.Millisecond,
+			AutoClose:     true,
+			EventBuffer:   10000,
+		}
+		events = append(events, w.Events())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.Start(wctx)
+		}()
+	}
+
+	terminal := func() bool {
+		for p := 0; p < partitions; p++ {
+			counts, err := repo.GetCountByStatus(ctx, fmt.Sprint("p", p))
+			if err != nil || counts[state.Available] > 0 {
+				return false
+			}
+		}
+		return true
+	}
+	for start := time.Now(); !terminal(); time.Sleep(20 * time.Millisecond) {
+		if time.Since(start) > 30*time.Second {
+			cancel()
+			wg.Wait()
+			t.Fatal("items did not terminate despite the faults")
+		}
+	}
+	cancel()
+	wg.Wait()
+
+	// Each item is saved in a terminal state exactly once, however many times it was attempted.
+	saves := map[string]int{}
+	for _, ch := range events {
+		for e := range ch {
+			if e.Type == state.ItemCompleted || e.Type == state.ItemFailed {
+				saves[e.ItemID]++
+			}
+		}
+	}
+	items, _, err := repo.ListItems(ctx, state.ItemFilter{}, state.PageRequest{Size: partitions * itemsPerPartition})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != partitions*itemsPerPartition {
+		t.Fatalf("expected %d items, got %d", partitions*itemsPerPartition, len(items))
+	}
+	for _, i := range items {
+		if i.Status != state.Complete && i.Status != state.Failed {
+			t.Errorf("item %s ended %s", i.ID, i.Status)
+		}
+		if saves[i.ID] != 1 {
+			t.Errorf("expected item %s to reach %s once, got %d", i.ID, i.Status, saves[i.ID])
+		}
+		if i.Status == state.Complete && proc.attempts[i.ID] == 0 {
+			t.Errorf("item %s completed without being processed", i.ID)
+		}
+	}
+}
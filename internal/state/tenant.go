@@ -0,0 +1,95 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// ErrWrongTenant is wrapped by the ErrValidation returned when an object would be written
+// under another tenant, or a tenant's quota accessed from another.
+var ErrWrongTenant = errors.New("wrong tenant")
+
+// scoped restricts the query to the repo's tenant, if it has one.
+func (db *GormRepo) scoped(tx *gorm.DB) *gorm.DB {
+	if db.Tenant == "" {
+		return tx
+	}
+	return tx.Where("tenant = ?", db.Tenant)
+}
+
+// claimTenant assigns the repo's tenant to a model without one, and checks that the model
+// doesn't belong to another tenant.
+func (db *GormRepo) claimTenant(m Model) error {
+	var tenant *string
+	switch m := m.(type) {
+	case *Partition:
+		tenant = &m.Tenant
+	case *Item:
+		tenant = &m.Tenant
+	default:
+		return nil
+	}
+	if db.Tenant == "" {
+		return nil
+	}
+	if *tenant == "" {
+		*tenant = db.Tenant
+	}
+	if *tenant != db.Tenant {
+		reason := fmt.Sprintf("%s %s belongs to tenant %q, not %q", kindOf(m), m.GetID(), *tenant, db.Tenant)
+		return &ErrValidation{Field: "tenant", Reason: reason, Err: ErrWrongTenant}
+	}
+	return nil
+}
+
+func kindOf(m Model) string {
+	if _, ok := m.(*Item); ok {
+		return "item"
+	}
+	return "partition"
+}
+
+// checkItemTenants checks that new items belong to the same tenant as their partitions.
+// Items may be created before their partition.
+func (db *GormRepo) checkItemTenants(ctx context.Context, items ...*Item) error {
+	var ids []string
+	seen := map[string]bool{}
+	for _, i := range items {
+		if !seen[i.PartitionID] {
+			seen[i.PartitionID] = true
+			ids = append(ids, i.PartitionID)
+		}
+	}
+	var partitions []*Partition
+	if err := db.WithContext(ctx).Select("id", "tenant").Where("id IN ?", ids).Find(&partitions).Error; err != nil {
+		return err
+	}
+	tenants := map[string]string{}
+	for _, p := range partitions {
+		tenants[p.ID] = p.Tenant
+	}
+	for _, i := range items {
+		if tenant, ok := tenants[i.PartitionID]; ok && tenant != i.Tenant {
+			reason := fmt.Sprintf("item %s of tenant %q can't be added to partition %s of tenant %q", i.ID, i.Tenant, i.PartitionID, tenant)
+			return &ErrValidation{Field: "tenant", Reason: reason, Err: ErrWrongTenant}
+		}
+	}
+	return nil
+}
+
+// ownItems drops items of other tenants, in case the repo isn't scoped to the watcher's.
+func (w *Watcher) ownItems(items []*Item) []*Item {
+	if w.Tenant == "" {
+		return items
+	}
+	own := items[:0]
+	for _, i := range items {
+		if i.Tenant == w.Tenant {
+			own = append(own, i)
+		}
+	}
+	return own
+}
@@ -0,0 +1,112 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func seedTenants(t *testing.T, r *GormRepo) {
+	ctx := context.Background()
+	for _, tenant := range []string{"a", "b"} {
+		if !r.Save(ctx, &Partition{BaseModel: BaseModel{ID: tenant + "-p"}, Tenant: tenant}) {
+			t.Fatal("failed to save partition")
+		}
+		if err := r.CreateItems(ctx, &Item{BaseModel: BaseModel{ID: tenant + "-i"}, PartitionID: tenant + "-p", Tenant: tenant, Data: []byte(`{"times":3}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTenantWatcher(t *testing.T) {
+	for name, repo := range map[string]func(r *GormRepo) Repo{
+		"scoped repo": func(r *GormRepo) Repo { return r },
+		// The watcher can't scope other repos, and filters their results instead.
+		"unscoped repo": func(r *GormRepo) Repo { return &FairRepo{GormRepo: r} },
+	} {
+		r := openTestRepo(t)
+		seedTenants(t, r)
+		w := &Watcher{Processor: &testProcessor{}, Repo: repo(r), BatchSize: 2, PollInterval: 10 * time.Millisecond, AutoClose: true, Tenant: "a"}
+		for _, e := range runForEvents(t, r, w) {
+			if e.PartitionID != "a-p" {
+				t.Errorf("%s: unexpected event %s for partition %s", name, e.Type, e.PartitionID)
+			}
+		}
+		ctx := context.Background()
+		if p, _ := r.GetPartition(ctx, "a-p"); p.Status != Complete {
+			t.Errorf("%s: expected the tenant's partition to complete, got %s", name, p.Status)
+		}
+		if p, _ := r.GetPartition(ctx, "b-p"); p.Owner != "" || p.Version != 1 {
+			t.Errorf("%s: expected the other tenant's partition to never be leased, got owner %q", name, p.Owner)
+		}
+		if i, _ := r.GetItem(ctx, "b-i"); i.Status != Available || len(i.Result) != 0 {
+			t.Errorf("%s: expected the other tenant's item to never be processed, got %s", name, i.Status)
+		}
+	}
+}
+
+func TestTenantRepo(t *testing.T) {
+	r := openTestRepo(t)
+	seedTenants(t, r)
+	ctx := context.Background()
+	a := *r
+	a.Tenant = "a"
+
+	partitions, _, err := a.ListPartitions(ctx, PartitionFilter{}, PageRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(partitions) != 1 || partitions[0].ID != "a-p" {
+		t.Errorf("expected only the tenant's partition, got %v", partitions)
+	}
+	items, _, err := a.ListItems(ctx, ItemFilter{}, PageRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].ID != "a-i" {
+		t.Errorf("expected only the tenant's item, got %v", items)
+	}
+	if leases, _ := a.GetPotentialLeases(ctx, nil); len(leases) != 1 {
+		t.Errorf("expected only the tenant's partition to be leasable, got %d", len(leases))
+	}
+	if _, err := a.GetItem(ctx, "b-i"); !IsNotFound(err) {
+		t.Errorf("expected another tenant's item to be not found, got %v", err)
+	}
+	if counts, _ := a.GetCountByStatus(ctx, "b-p"); len(counts) != 0 {
+		t.Errorf("expected no counts for another tenant's partition, got %v", counts)
+	}
+	if err := a.CancelItem(ctx, "b-i"); !IsNotFound(err) {
+		t.Errorf("expected another tenant's item to be not found, got %v", err)
+	}
+
+	// New objects take the repo's tenant.
+	p := &Partition{BaseModel: BaseModel{ID: "a-q"}}
+	i := &Item{BaseModel: BaseModel{ID: "a-j"}, PartitionID: "a-q", Data: []byte(`{}`)}
+	if !a.Save(ctx, p) || !a.Save(ctx, i) {
+		t.Fatal("failed to save")
+	}
+	if p.Tenant != "a" || i.Tenant != "a" {
+		t.Errorf("expected the repo's tenant to be assigned, got %q and %q", p.Tenant, i.Tenant)
+	}
+	if a.Save(ctx, &Partition{BaseModel: BaseModel{ID: "b-q"}, Tenant: "b"}) {
+		t.Error("expected saving another tenant's partition to fail")
+	}
+	b, _ := r.GetPartition(ctx, "b-p")
+	b.Tenant = "a"
+	if a.Save(ctx, b) {
+		t.Error("expected taking over another tenant's partition to fail")
+	}
+
+	// Items can't be created under another tenant's partition.
+	err = r.CreateItems(ctx, &Item{BaseModel: BaseModel{ID: "x"}, PartitionID: "b-p", Tenant: "a", Data: []byte(`{}`)})
+	if !errors.Is(err, ErrWrongTenant) {
+		t.Errorf("expected a wrong tenant error, got %v", err)
+	}
+	if r.Save(ctx, &Item{BaseModel: BaseModel{ID: "y"}, PartitionID: "b-p", Data: []byte(`{}`)}) {
+		t.Error("expected saving an item without the partition's tenant to fail")
+	}
+	if _, err := r.GetItem(ctx, "x"); !IsNotFound(err) {
+		t.Errorf("expected the item not to be created, got %v", err)
+	}
+}
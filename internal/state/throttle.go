@@ -0,0 +1,77 @@
+package state
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// DefaultMaxThrottleFactor is the most a throttled partition's poll interval is multiplied by,
+// see Watcher.MaxThrottleFactor.
+var DefaultMaxThrottleFactor = 16
+
+// throttle doubles the factor by which the partition's poll interval is multiplied, up to the
+// watcher's MaxThrottleFactor, after the processor was throttled.
+func (w *Watcher) throttle(partitionID string) {
+	atomic.AddInt64(&w.counters.throttles, 1)
+	max := w.MaxThrottleFactor
+	if max == 0 {
+		max = DefaultMaxThrottleFactor
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.throttles == nil {
+		w.throttles = map[string]int{}
+	}
+	factor := 2 * w.throttleFactor(partitionID)
+	if factor > max {
+		factor = max
+	}
+	if factor != w.throttles[partitionID] {
+		glog.Warningf("processor throttled partition %s, slowing its polling by %dx", partitionID, factor)
+	}
+	w.throttles[partitionID] = factor
+}
+
+// unthrottle resets the partition's poll interval after the processor succeeded.
+func (w *Watcher) unthrottle(partitionID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.throttles[partitionID]; ok {
+		glog.Infof("processor no longer throttling partition %s", partitionID)
+		delete(w.throttles, partitionID)
+	}
+}
+
+// throttleFactor returns the factor by which the partition's poll interval is multiplied, 1
+// unless it is throttled. Must be called with mu held.
+func (w *Watcher) throttleFactor(partitionID string) int {
+	if factor, ok := w.throttles[partitionID]; ok {
+		return factor
+	}
+	return 1
+}
+
+// throttledPollInterval returns the interval for polling the partition, slowed down while the
+// processor throttles it, and capped like partitionPollInterval.
+func (w *Watcher) throttledPollInterval(partitionID string) time.Duration {
+	w.mu.Lock()
+	factor := w.throttleFactor(partitionID)
+	w.mu.Unlock()
+	return w.capPollInterval(time.Duration(factor) * w.idleInterval(w.PollInterval))
+}
+
+// throttleFactors returns the factors of the throttled partitions.
+func (w *Watcher) throttleFactors() map[string]int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.throttles) == 0 {
+		return nil
+	}
+	factors := make(map[string]int, len(w.throttles))
+	for id, factor := range w.throttles {
+		factors[id] = factor
+	}
+	return factors
+}
@@ -0,0 +1,104 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// throttlingProcessor throttles every other call, and completes the items otherwise.
+type throttlingProcessor struct {
+	testProcessor
+	mu    sync.Mutex
+	calls int
+}
+
+func (p *throttlingProcessor) Process(id string, b []byte) (*ProcessorResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls++
+	if p.calls%2 == 1 {
+		return nil, &ThrottledError{Message: "HTTP 429"}
+	}
+	return &ProcessorResponse{Complete: true, Data: b}, nil
+}
+
+func TestThrottledItemsNotRetried(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	// Any attempt counted against the items' retries would fail them.
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}, MaxRetries: retries(0)})
+	for n := 0; n < 5; n++ {
+		r.Save(ctx, &Item{BaseModel: BaseModel{ID: fmt.Sprint(n)}, PartitionID: "p", Data: []byte(`{}`)})
+	}
+
+	w := &Watcher{Processor: &throttlingProcessor{}, Repo: r, BatchSize: 1, PollInterval: 10 * time.Millisecond, AutoClose: true}
+	events := runForEvents(t, r, w)
+
+	if events[len(events)-1].Type == PartitionFailed {
+		t.Fatalf("expected the partition to complete, got events %v", eventTypes(events))
+	}
+	items, _, err := r.ListItems(ctx, ItemFilter{}, PageRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range items {
+		if i.Status != Complete || i.RetryCount != 0 || i.ErrorMessages != "" {
+			t.Errorf("expected item %s to complete without retries, got %s after %d retries", i.ID, i.Status, i.RetryCount)
+		}
+	}
+	if stats := w.Stats(); stats.Throttles < 5 || stats.ItemErrors != 0 {
+		t.Errorf("expected throttles rather than errors, got %+v", stats)
+	}
+}
+
+func TestThrottleFactor(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Data: []byte(`{}`)})
+	w := &Watcher{Processor: &flakyThrottler{throttles: 4}, Repo: r, MaxGateSkip: 1, PollInterval: time.Second, LeaseDuration: time.Minute, MaxThrottleFactor: 8}
+	w.init()
+
+	for _, want := range []int{2, 4, 8, 8, 0} {
+		i, err := r.GetItem(ctx, "i")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.processItem(ctx, i)
+		if got := w.Stats().ThrottleFactors["p"]; got != want {
+			t.Errorf("expected a throttle factor of %d, got %d", want, got)
+		}
+		if want > 0 {
+			if got := w.throttledPollInterval("p"); got != time.Duration(want)*time.Second {
+				t.Errorf("expected the poll interval to be %ds, got %s", want, got)
+			}
+		}
+	}
+	if got := w.throttledPollInterval("p"); got != time.Second {
+		t.Errorf("expected the poll interval to reset after a success, got %s", got)
+	}
+	w.MaxThrottleFactor = 100
+	for n := 0; n < 10; n++ {
+		w.throttle("p")
+	}
+	if got := w.throttledPollInterval("p"); got != 30*time.Second {
+		t.Errorf("expected the poll interval to renew the lease in time, got %s", got)
+	}
+}
+
+// flakyThrottler throttles the given number of calls, then completes the items.
+type flakyThrottler struct {
+	testProcessor
+	throttles int
+}
+
+func (p *flakyThrottler) Process(id string, b []byte) (*ProcessorResponse, error) {
+	if p.throttles > 0 {
+		p.throttles--
+		return nil, fmt.Errorf("error calling the target: %w", &ThrottledError{Message: "HTTP 429"})
+	}
+	return &ProcessorResponse{Complete: true, Data: b}, nil
+}
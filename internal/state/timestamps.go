@@ -0,0 +1,208 @@
+package state
+
+import (
+	"reflect"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// TimestampPrecision is the precision lease times are compared at, that of the coarsest column
+// type they may be stored in, so that a time read back rounded or truncated by the database
+// compares as the time that was written.
+const TimestampPrecision = time.Millisecond
+
+// UTC returns the time in UTC, without its monotonic clock reading, as timestamps are stored.
+// Times stored in local time by pods in different time zones don't compare as they should,
+// notably as text in SQLite.
+func UTC(t time.Time) time.Time {
+	return t.UTC().Round(0)
+}
+
+// beforeAtPrecision returns true if a is before b at TimestampPrecision.
+func beforeAtPrecision(a, b time.Time) bool {
+	return a.Truncate(TimestampPrecision).Before(b.Truncate(TimestampPrecision))
+}
+
+const (
+	utcArgsCallback    = "state:utc_args"
+	utcResultsCallback = "state:utc_results"
+)
+
+// useUTC makes the database store and return timestamps in UTC: the CreatedAt and UpdatedAt
+// set by gorm, the time fields of the models and maps written, the times in conditions and
+// raw statements, and those of the models read. Registering the callbacks again is a no-op.
+func useUTC(db *gorm.DB) error {
+	db.Config.NowFunc = func() time.Time {
+		return UTC(time.Now())
+	}
+	cb := db.Callback()
+	if cb.Query().Get(utcArgsCallback) != nil {
+		return nil
+	}
+	for _, err := range []error{
+		cb.Create().Before("gorm:create").Register(utcArgsCallback, utcWrites),
+		cb.Update().Before("gorm:update").Register(utcArgsCallback, utcWrites),
+		cb.Delete().Before("gorm:delete").Register(utcArgsCallback, utcArgs),
+		cb.Query().Before("gorm:query").Register(utcArgsCallback, utcArgs),
+		cb.Row().Before("gorm:row").Register(utcArgsCallback, utcArgs),
+		cb.Raw().Before("gorm:raw").Register(utcArgsCallback, utcArgs),
+		cb.Query().After("gorm:query").Register(utcResultsCallback, utcResults),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// utcWrites converts the times a statement writes, and compares with, to UTC. The models
+// written are converted in place.
+func utcWrites(tx *gorm.DB) {
+	if tx.Statement.Dest != nil {
+		utcValue(reflect.ValueOf(tx.Statement.Dest))
+	}
+	utcArgs(tx)
+}
+
+// utcArgs converts the times a statement compares with to UTC.
+func utcArgs(tx *gorm.DB) {
+	stmt := tx.Statement
+	for n, v := range stmt.Vars {
+		stmt.Vars[n] = utcVar(v)
+	}
+	if c, ok := stmt.Clauses["WHERE"]; ok {
+		if where, ok := c.Expression.(clause.Where); ok {
+			where.Exprs = utcExprs(where.Exprs)
+			c.Expression = where
+			stmt.Clauses["WHERE"] = c
+		}
+	}
+}
+
+// utcResults converts the times of the models read to UTC.
+func utcResults(tx *gorm.DB) {
+	if tx.Error == nil && tx.Statement.Dest != nil {
+		utcValue(reflect.ValueOf(tx.Statement.Dest))
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// utcValue converts the times held by the value, its fields, elements or map values to UTC
+// in place.
+func utcValue(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			utcValue(v.Elem())
+		}
+	case reflect.Struct:
+		if v.Type() == timeType {
+			if v.CanSet() {
+				v.Set(reflect.ValueOf(UTC(v.Interface().(time.Time))))
+			}
+			return
+		}
+		for n := 0; n < v.NumField(); n++ {
+			if f := v.Field(n); f.CanSet() {
+				utcValue(f)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		switch v.Type().Elem().Kind() {
+		case reflect.Struct, reflect.Ptr, reflect.Interface, reflect.Map:
+			for n := 0; n < v.Len(); n++ {
+				utcValue(v.Index(n))
+			}
+		}
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.Interface {
+			return
+		}
+		for _, k := range v.MapKeys() {
+			if e := v.MapIndex(k); !e.IsNil() {
+				v.SetMapIndex(k, reflect.ValueOf(utcVar(e.Interface())))
+			}
+		}
+	}
+}
+
+// utcVar returns the argument of a statement with its times in UTC, leaving the caller's
+// values as they are.
+func utcVar(v interface{}) interface{} {
+	switch v := v.(type) {
+	case time.Time:
+		return UTC(v)
+	case *time.Time:
+		if v == nil {
+			return v
+		}
+		t := UTC(*v)
+		return &t
+	case clause.Expr:
+		v.Vars = utcVars(v.Vars)
+		return v
+	case clause.NamedExpr:
+		v.Vars = utcVars(v.Vars)
+		return v
+	}
+	return v
+}
+
+func utcVars(vars []interface{}) []interface{} {
+	converted := make([]interface{}, len(vars))
+	for n, v := range vars {
+		converted[n] = utcVar(v)
+	}
+	return converted
+}
+
+// utcExprs returns the conditions with their times in UTC.
+func utcExprs(exprs []clause.Expression) []clause.Expression {
+	converted := make([]clause.Expression, len(exprs))
+	for n, e := range exprs {
+		switch e := e.(type) {
+		case clause.Expr:
+			e.Vars = utcVars(e.Vars)
+			converted[n] = e
+		case clause.NamedExpr:
+			e.Vars = utcVars(e.Vars)
+			converted[n] = e
+		case clause.Eq:
+			e.Value = utcVar(e.Value)
+			converted[n] = e
+		case clause.Neq:
+			e.Value = utcVar(e.Value)
+			converted[n] = e
+		case clause.Gt:
+			e.Value = utcVar(e.Value)
+			converted[n] = e
+		case clause.Gte:
+			e.Value = utcVar(e.Value)
+			converted[n] = e
+		case clause.Lt:
+			e.Value = utcVar(e.Value)
+			converted[n] = e
+		case clause.Lte:
+			e.Value = utcVar(e.Value)
+			converted[n] = e
+		case clause.IN:
+			e.Values = utcVars(e.Values)
+			converted[n] = e
+		case clause.AndConditions:
+			e.Exprs = utcExprs(e.Exprs)
+			converted[n] = e
+		case clause.OrConditions:
+			e.Exprs = utcExprs(e.Exprs)
+			converted[n] = e
+		case clause.NotConditions:
+			e.Exprs = utcExprs(e.Exprs)
+			converted[n] = e
+		default:
+			converted[n] = e
+		}
+	}
+	return converted
+}
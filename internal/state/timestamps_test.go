@@ -0,0 +1,126 @@
+package state
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// inZone runs f with the local time zone of the host set to a fixed offset.
+func inZone(t *testing.T, offset time.Duration, f func()) {
+	t.Helper()
+	local := time.Local
+	defer func() { time.Local = local }()
+	time.Local = time.FixedZone(offset.String(), int(offset.Seconds()))
+	f()
+}
+
+func TestLeaseAcrossTimeZones(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name        string
+		write, read time.Duration
+	}{
+		{name: "east to west", write: 10 * time.Hour, read: -8 * time.Hour},
+		{name: "west to east", write: -8 * time.Hour, read: 10 * time.Hour},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := openTestRepo(t)
+			inZone(t, tt.write, func() {
+				p := &Partition{BaseModel: BaseModel{ID: "p"}, Owner: "a", Until: time.Now().Local().Add(30 * time.Second)}
+				if err := r.CreatePartition(ctx, p); err != nil {
+					t.Fatal(err)
+				}
+			})
+			inZone(t, tt.read, func() {
+				p, err := r.GetPartition(ctx, "p")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if p.Until.Location() != time.UTC || p.CreatedAt.Location() != time.UTC {
+					t.Errorf("expected timestamps to be read in UTC, got %s and %s", p.Until, p.CreatedAt)
+				}
+				if now := time.Now(); p.Expired(now) || p.InActive(now) {
+					t.Errorf("expected the lease until %s not to be expired at %s", p.Until, time.Now())
+				}
+				if left := time.Until(p.Until); left < 29*time.Second || left > 30*time.Second {
+					t.Errorf("expected the lease to have 30s left, got %s", left)
+				}
+				leases, err := r.GetPotentialLeases(ctx, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(leases) != 0 {
+					t.Errorf("expected the lease not to be expired in the database, got %d potential leases", len(leases))
+				}
+			})
+		})
+	}
+}
+
+func TestTimestampsStoredInUTC(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	inZone(t, 5*time.Hour, func() {
+		activateAt := time.Now().Add(time.Hour)
+		p := &Partition{BaseModel: BaseModel{ID: "p"}, Until: time.Now(), ActivateAt: &activateAt}
+		if err := r.CreatePartition(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Model(&Partition{}).Where("id = ?", "p").Update("until", time.Now()).Error; err != nil {
+			t.Fatal(err)
+		}
+	})
+	var until, createdAt, activateAt string
+	if err := r.Model(&Partition{}).Select("until, created_at, activate_at").Where("id = ?", "p").Row().Scan(&until, &createdAt, &activateAt); err != nil {
+		t.Fatal(err)
+	}
+	for name, v := range map[string]string{"until": until, "created_at": createdAt, "activate_at": activateAt} {
+		if !strings.HasSuffix(v, "+00:00") && !strings.HasSuffix(v, "Z") {
+			t.Errorf("expected %s to be stored in UTC, got %s", name, v)
+		}
+	}
+	p, err := r.GetPartition(ctx, "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range []time.Time{p.Until, p.CreatedAt, p.UpdatedAt, *p.ActivateAt} {
+		if ts.Location() != time.UTC || strings.Contains(ts.String(), "m=") {
+			t.Errorf("expected timestamps in UTC without monotonic clock readings, got %s", ts)
+		}
+	}
+}
+
+func TestUTCStripsMonotonicClock(t *testing.T) {
+	now := time.Now()
+	if !strings.Contains(now.String(), "m=") {
+		t.Skip("no monotonic clock")
+	}
+	u := UTC(now)
+	if strings.Contains(u.String(), "m=") || u.Location() != time.UTC || !u.Equal(now) {
+		t.Errorf("expected the same instant in UTC without a monotonic clock reading, got %s", u)
+	}
+}
+
+func TestExpiredAtPrecision(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 500*int(time.Microsecond), time.UTC)
+	for _, tt := range []struct {
+		name    string
+		until   time.Time
+		expired bool
+	}{
+		{name: "later", until: now.Add(30 * time.Second)},
+		{name: "truncated by the column", until: now.Truncate(TimestampPrecision)},
+		{name: "rounded by the column", until: now.Round(TimestampPrecision)},
+		{name: "a millisecond before", until: now.Add(-TimestampPrecision), expired: true},
+		{name: "a second before", until: now.Add(-time.Second), expired: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Partition{Until: tt.until}
+			if got := p.Expired(now); got != tt.expired {
+				t.Errorf("expected a lease until %s to be expired at %s: %t, got %t", tt.until, now, tt.expired, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package state
+
+import (
+	"context"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the name of the tracer of the watcher's and the client's spans.
+const TracerName = "dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+
+var tracePropagator = propagation.TraceContext{}
+
+// TraceContextFromContext returns the W3C trace context of the span active in ctx, as stored
+// in an item's TraceContext: its traceparent, followed by a space and its tracestate if it has
+// one. It returns "" without a span.
+func TraceContextFromContext(ctx context.Context) string {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ""
+	}
+	carrier := propagation.MapCarrier{}
+	tracePropagator.Inject(ctx, carrier)
+	if state := carrier.Get("tracestate"); state != "" {
+		return carrier.Get("traceparent") + " " + state
+	}
+	return carrier.Get("traceparent")
+}
+
+// ContextWithTraceContext returns ctx with the remote span of an item's TraceContext, which
+// spans started from it are children of. Invalid trace contexts are ignored.
+func ContextWithTraceContext(ctx context.Context, traceContext string) context.Context {
+	if traceContext == "" {
+		return ctx
+	}
+	parent, state, _ := strings.Cut(traceContext, " ")
+	return tracePropagator.Extract(ctx, propagation.MapCarrier{"traceparent": parent, "tracestate": state})
+}
+
+// startSpan starts the span of an attempt at the item, continuing its TraceContext, if the
+// watcher has a TracerProvider.
+func (w *Watcher) startSpan(ctx context.Context, i *Item) (context.Context, trace.Span) {
+	if w.TracerProvider == nil {
+		return ctx, nil
+	}
+	return w.TracerProvider.Tracer(TracerName).Start(ContextWithTraceContext(ctx, i.TraceContext), "process "+i.PartitionID,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("item.id", i.ID),
+			attribute.String("partition.id", i.PartitionID),
+			attribute.String("gate", i.partition.plan.Name(i.Gate)),
+			attribute.String("owner", w.OwnerID),
+			attribute.Int("retry_count", i.RetryCount),
+		))
+}
+
+// endSpan ends the span of an attempt, if it was traced, with the processor's error.
+func endSpan(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
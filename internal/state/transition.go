@@ -0,0 +1,112 @@
+package state
+
+// GateCounts are the counts of a partition's items that a poll decides its transition on.
+type GateCounts struct {
+	// ByStatus counts all of the partition's items by status.
+	ByStatus map[Status]int
+	// Remaining is the number of Available items at or before the partition's MaxGate, or all
+	// Available items without one.
+	Remaining int
+	// Delayed is the number of items at the gate waiting until their RetryAt, counted only
+	// when there are no items to process.
+	Delayed int
+}
+
+// TransitionConfig is the watcher's configuration that decides partition transitions.
+type TransitionConfig struct {
+	ManualCheckpoint bool
+	AutoClose        bool
+	// FailureTolerance is the watcher's FailureTolerance, unless the partition sets its own.
+	FailureTolerance float64
+}
+
+// PartitionTransition is the kind of a PartitionDecision.
+type PartitionTransition int
+
+const (
+	// HoldGate keeps the partition at its gate, e.g. while items at the gate are processed.
+	HoldGate PartitionTransition = iota
+	// FailPartition fails the partition, as some of its items failed.
+	FailPartition
+	// AdvanceGate moves the partition to its next gate, as all items at its gate are done.
+	AdvanceGate
+	// ClosePartition completes the partition, as all of its items are done.
+	ClosePartition
+	// RecoverPartition makes a Failed partition Available at its gate, as none of its items
+	// are failed anymore, e.g. after they were retried or cancelled.
+	RecoverPartition
+)
+
+func (t PartitionTransition) String() string {
+	switch t {
+	case HoldGate:
+		return "HoldGate"
+	case FailPartition:
+		return "FailPartition"
+	case AdvanceGate:
+		return "AdvanceGate"
+	case ClosePartition:
+		return "ClosePartition"
+	case RecoverPartition:
+		return "RecoverPartition"
+	}
+	return "Unknown"
+}
+
+// PartitionDecision is the transition decided on by a poll of a partition, and the status
+// and gate the partition is saved with.
+type PartitionDecision struct {
+	Transition PartitionTransition
+	Status     Status
+	Gate       int
+}
+
+// decidePartitionTransition decides the transition of the partition from the counts of its
+// items, inFlight being the number of items at its gate fetched to be processed:
+//   - failed items fail the partition, unless their share of its items is within its
+//     failure tolerance, in which case they are left behind at their gate;
+//   - otherwise, while there are remaining items, the partition is Available, and advances
+//     past its gate once none are to be processed or delayed at the gate, unless gates are
+//     advanced manually or it is at its MaxGate;
+//   - once there are none, it completes if AutoClose is set or it has a MaxGate, and is left
+//     as is otherwise;
+//   - a Failed partition held at its gate without failed items recovers to Available.
+//
+// Cancelled items neither fail the partition nor hold it at its gate.
+func decidePartitionTransition(p *Partition, counts GateCounts, inFlight int, cfg TransitionConfig) PartitionDecision {
+	hold := PartitionDecision{Transition: HoldGate, Status: p.Status, Gate: p.Gate}
+	if p.Status == Failed {
+		hold = PartitionDecision{Transition: RecoverPartition, Status: Available, Gate: p.Gate}
+	}
+	if !failuresTolerated(counts.ByStatus, p.failureTolerance(cfg.FailureTolerance)) {
+		return PartitionDecision{Transition: FailPartition, Status: Failed, Gate: p.Gate}
+	}
+	if counts.Remaining > 0 {
+		hold.Status = Available
+		if inFlight > 0 || counts.Delayed > 0 || cfg.ManualCheckpoint || (p.MaxGate > 0 && p.Gate >= p.MaxGate) {
+			return hold
+		}
+		return PartitionDecision{Transition: AdvanceGate, Status: Available, Gate: p.Gate + 1}
+	}
+	if inFlight > 0 || (!cfg.AutoClose && p.MaxGate == 0) {
+		return hold
+	}
+	return PartitionDecision{Transition: ClosePartition, Status: Complete, Gate: p.Gate}
+}
+
+// failuresTolerated returns whether the failed items among those counted are within the
+// tolerance, a fraction of the items which aren't cancelled. The share is of all of the
+// partition's items rather than those at its gate: it only grows as items fail, so that a
+// partition fails as soon as it is past its tolerance, and a gate's failures tolerated as it
+// advances are still tolerated at the following gates.
+func failuresTolerated(counts map[Status]int, tolerance float64) bool {
+	failed := counts[Failed]
+	if failed == 0 {
+		return true
+	}
+	if tolerance <= 0 {
+		return false
+	}
+	total := counts[Available] + counts[Complete] + failed
+	return float64(failed)/float64(total) <= tolerance
+}
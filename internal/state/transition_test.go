@@ -0,0 +1,206 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecidePartitionTransition(t *testing.T) {
+	hold := func(status Status) PartitionDecision {
+		return PartitionDecision{Transition: HoldGate, Status: status, Gate: 2}
+	}
+	advance := PartitionDecision{Transition: AdvanceGate, Status: Available, Gate: 3}
+	fail := PartitionDecision{Transition: FailPartition, Status: Failed, Gate: 2}
+	closed := PartitionDecision{Transition: ClosePartition, Status: Complete, Gate: 2}
+	recover := PartitionDecision{Transition: RecoverPartition, Status: Available, Gate: 2}
+	tests := []struct {
+		name     string
+		status   Status
+		maxGate  int
+		counts   GateCounts
+		inFlight int
+		cfg      TransitionConfig
+		want     PartitionDecision
+	}{
+		{name: "failed item", counts: GateCounts{ByStatus: map[Status]int{Failed: 1, Available: 3}, Remaining: 3}, want: fail},
+		{name: "failed item with items in flight", counts: GateCounts{ByStatus: map[Status]int{Failed: 1, Available: 3}, Remaining: 3}, inFlight: 3, want: fail},
+		{name: "failed item once done", counts: GateCounts{ByStatus: map[Status]int{Failed: 1, Complete: 3}}, cfg: TransitionConfig{AutoClose: true}, want: fail},
+		{name: "failed item of a complete partition", status: Complete, counts: GateCounts{ByStatus: map[Status]int{Failed: 1}}, want: fail},
+		{name: "failures at the tolerance", counts: GateCounts{ByStatus: map[Status]int{Failed: 1, Complete: 3}}, cfg: TransitionConfig{AutoClose: true, FailureTolerance: 0.25}, want: closed},
+		{name: "failures above the tolerance", counts: GateCounts{ByStatus: map[Status]int{Failed: 2, Complete: 2}}, cfg: TransitionConfig{AutoClose: true, FailureTolerance: 0.25}, want: fail},
+		{name: "failures within the tolerance past the gate", counts: GateCounts{ByStatus: map[Status]int{Failed: 1, Available: 3}, Remaining: 3}, cfg: TransitionConfig{FailureTolerance: 0.25}, want: advance},
+		{name: "failures within the tolerance with items in flight", counts: GateCounts{ByStatus: map[Status]int{Failed: 1, Available: 3}, Remaining: 3}, inFlight: 1, cfg: TransitionConfig{FailureTolerance: 0.25}, want: hold(Available)},
+		{name: "cancelled items outside the tolerance", counts: GateCounts{ByStatus: map[Status]int{Failed: 1, Complete: 1, Cancelled: 2}}, cfg: TransitionConfig{AutoClose: true, FailureTolerance: 0.25}, want: fail},
+		{name: "failed partition within the tolerance", status: Failed, counts: GateCounts{ByStatus: map[Status]int{Failed: 1, Complete: 3}}, cfg: TransitionConfig{AutoClose: true, FailureTolerance: 0.25}, want: closed},
+		{name: "items in flight", counts: GateCounts{ByStatus: map[Status]int{Available: 3}, Remaining: 3}, inFlight: 2, want: hold(Available)},
+		{name: "items at future gates only", counts: GateCounts{ByStatus: map[Status]int{Available: 3}, Remaining: 3}, want: advance},
+		{name: "deferred items", counts: GateCounts{ByStatus: map[Status]int{Available: 3}, Remaining: 3, Delayed: 1}, want: hold(Available)},
+		{name: "manual checkpoint", counts: GateCounts{ByStatus: map[Status]int{Available: 3}, Remaining: 3}, cfg: TransitionConfig{ManualCheckpoint: true}, want: hold(Available)},
+		{name: "failed partition recovering", status: Failed, counts: GateCounts{ByStatus: map[Status]int{Available: 3}, Remaining: 3}, inFlight: 3, want: recover},
+		{name: "failed partition recovering past its gate", status: Failed, counts: GateCounts{ByStatus: map[Status]int{Available: 3}, Remaining: 3}, want: advance},
+		{name: "failed partition with its failed items cancelled", status: Failed, counts: GateCounts{ByStatus: map[Status]int{Cancelled: 1, Complete: 3}}, want: recover},
+		{name: "failed partition with its failed items cancelled and auto close", status: Failed, counts: GateCounts{ByStatus: map[Status]int{Cancelled: 1, Complete: 3}}, cfg: TransitionConfig{AutoClose: true}, want: closed},
+		{name: "failed partition with deferred items", status: Failed, counts: GateCounts{ByStatus: map[Status]int{Available: 1}, Remaining: 1, Delayed: 1}, want: recover},
+		{name: "reopened partition", status: Complete, counts: GateCounts{ByStatus: map[Status]int{Available: 1, Complete: 3}, Remaining: 1}, inFlight: 1, want: hold(Available)},
+		{name: "cancelled items only", counts: GateCounts{ByStatus: map[Status]int{Cancelled: 2, Complete: 1}}, cfg: TransitionConfig{AutoClose: true}, want: closed},
+		{name: "cancelled items at future gates", counts: GateCounts{ByStatus: map[Status]int{Cancelled: 2, Available: 1}, Remaining: 1}, want: advance},
+		{name: "done without auto close", counts: GateCounts{ByStatus: map[Status]int{Complete: 3}}, want: hold(Available)},
+		{name: "done with auto close", counts: GateCounts{ByStatus: map[Status]int{Complete: 3}}, cfg: TransitionConfig{AutoClose: true}, want: closed},
+		{name: "empty with auto close", counts: GateCounts{ByStatus: map[Status]int{}}, cfg: TransitionConfig{AutoClose: true}, want: closed},
+		{name: "auto close with items in flight", counts: GateCounts{ByStatus: map[Status]int{Available: 1}}, inFlight: 1, cfg: TransitionConfig{AutoClose: true}, want: hold(Available)},
+		{name: "auto close with manual checkpoint", counts: GateCounts{ByStatus: map[Status]int{Complete: 3}}, cfg: TransitionConfig{AutoClose: true, ManualCheckpoint: true}, want: closed},
+		{name: "complete stays complete", status: Complete, counts: GateCounts{ByStatus: map[Status]int{Complete: 3}}, want: hold(Complete)},
+		{name: "before max gate", maxGate: 3, counts: GateCounts{ByStatus: map[Status]int{Available: 3}, Remaining: 3}, want: advance},
+		{name: "at max gate", maxGate: 2, counts: GateCounts{ByStatus: map[Status]int{Available: 3}, Remaining: 3}, want: hold(Available)},
+		{name: "past max gate", maxGate: 1, counts: GateCounts{ByStatus: map[Status]int{Available: 3}, Remaining: 3}, want: hold(Available)},
+		{name: "items past max gate", maxGate: 2, counts: GateCounts{ByStatus: map[Status]int{Available: 3, Complete: 1}}, want: closed},
+		{name: "max gate with items in flight", maxGate: 2, counts: GateCounts{ByStatus: map[Status]int{Available: 1}}, inFlight: 1, want: hold(Available)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := tt.status
+			if status == Unknown {
+				status = Available
+			}
+			p := &Partition{Status: status, Gate: 2, MaxGate: tt.maxGate}
+			if got := decidePartitionTransition(p, tt.counts, tt.inFlight, tt.cfg); got != tt.want {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+			if p.Status != status || p.Gate != 2 {
+				t.Errorf("expected the partition to be left as is, got %+v", p)
+			}
+		})
+	}
+}
+
+// TestDecidePartitionTransitionInvariants checks the rules every decision follows, across
+// every combination of inputs.
+func TestDecidePartitionTransitionInvariants(t *testing.T) {
+	for _, status := range []Status{Available, Failed, Complete} {
+		for _, maxGate := range []int{0, 1, 2, 3} {
+			for _, failed := range []int{0, 1} {
+				for _, cancelled := range []int{0, 1} {
+					for _, remaining := range []int{0, 2} {
+						for _, delayed := range []int{0, 1} {
+							for _, inFlight := range []int{0, 1} {
+								for _, cfg := range []TransitionConfig{{}, {ManualCheckpoint: true}, {AutoClose: true}, {ManualCheckpoint: true, AutoClose: true}, {FailureTolerance: 0.25}, {AutoClose: true, FailureTolerance: 0.25}} {
+									p := &Partition{Status: status, Gate: 2, MaxGate: maxGate}
+									counts := GateCounts{
+										ByStatus:  map[Status]int{Failed: failed, Cancelled: cancelled, Available: remaining + inFlight, Complete: 1},
+										Remaining: remaining + inFlight,
+										Delayed:   delayed,
+									}
+									d := decidePartitionTransition(p, counts, inFlight, cfg)
+									in := fmt.Sprintf("status %s, max gate %d, counts %+v, in flight %d, %+v", status, maxGate, counts, inFlight, cfg)
+									checkTransition(t, in, d, p, counts, inFlight, cfg)
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func checkTransition(t *testing.T, in string, d PartitionDecision, p *Partition, counts GateCounts, inFlight int, cfg TransitionConfig) {
+	t.Helper()
+	if (d.Transition == FailPartition) != !failuresTolerated(counts.ByStatus, cfg.FailureTolerance) {
+		t.Errorf("%s: expected to fail exactly when more items failed than tolerated, got %+v", in, d)
+	}
+	if d.Transition == AdvanceGate {
+		if inFlight > 0 || counts.Delayed > 0 || cfg.ManualCheckpoint || (p.MaxGate > 0 && p.Gate >= p.MaxGate) {
+			t.Errorf("%s: expected the gate to be held, got %+v", in, d)
+		}
+		if d.Gate != p.Gate+1 || d.Status != Available {
+			t.Errorf("%s: expected to advance a single gate, got %+v", in, d)
+		}
+	} else if d.Gate != p.Gate {
+		t.Errorf("%s: expected the gate to be kept, got %+v", in, d)
+	}
+	if d.Transition == ClosePartition && (inFlight > 0 || counts.Remaining > 0 || d.Status != Complete) {
+		t.Errorf("%s: expected to close only once all items are done, got %+v", in, d)
+	}
+	if d.Transition == HoldGate && counts.Remaining > 0 && d.Status != Available {
+		t.Errorf("%s: expected a partition with items remaining to be available, got %+v", in, d)
+	}
+	if (d.Transition == RecoverPartition) != (p.Status == Failed && d.Transition != FailPartition && d.Transition != AdvanceGate && d.Transition != ClosePartition) {
+		t.Errorf("%s: expected to recover exactly when a failed partition is held at its gate, got %+v", in, d)
+	}
+	if d.Status == Failed && d.Transition != FailPartition {
+		t.Errorf("%s: expected a partition without failed items not to stay failed, got %+v", in, d)
+	}
+}
+
+func TestWatcherFailureTolerance(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	// createPartition creates a partition with a failed item at gate 0, among 5 items.
+	createPartition := func(id string, tolerance *float64) {
+		t.Helper()
+		if err := r.CreatePartition(ctx, &Partition{BaseModel: BaseModel{ID: id}, FailureTolerance: tolerance}); err != nil {
+			t.Fatal(err)
+		}
+		for n, gate := range []int{0, 0, 0, 0, 1} {
+			i := &Item{BaseModel: BaseModel{ID: fmt.Sprintf("%s%d", id, n)}, PartitionID: id, Gate: gate, Data: []byte(fmt.Sprintf(`{"times": 1, "gate": %d}`, gate))}
+			if err := r.CreateItems(ctx, i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := r.Model(&Item{}).Where("id = ?", id+"0").Updates(map[string]interface{}{"status": Failed, "error_messages": "bad input"}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	watcher := func() *Watcher {
+		return &Watcher{Processor: &testProcessor{}, Repo: r, BatchSize: 5, PollInterval: 10 * time.Millisecond, AutoClose: true, FailureTolerance: 0.2}
+	}
+
+	// A failed item out of 5 is exactly at the tolerance: the partition advances past it, and
+	// completes.
+	createPartition("p", nil)
+	events := runForEvents(t, r, watcher())
+	p, err := r.GetPartition(ctx, "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "skipped 1 failed items within the failure tolerance"; p.Status != Complete || p.Gate != 1 || !strings.HasSuffix(p.StatusReason, want) {
+		t.Errorf("expected the partition to complete at gate 1 with reason ...%q, got %s at gate %d with %q", want, p.Status, p.Gate, p.StatusReason)
+	}
+	if i, err := r.GetItem(ctx, "p0"); err != nil || i.Status != Failed || i.Gate != 0 {
+		t.Errorf("expected the failed item to be left behind at its gate, got %+v, %v", i, err)
+	}
+	var withFailures *Event
+	for n := range events {
+		if events[n].Type == PartitionCompletedWithFailures {
+			withFailures = &events[n]
+		}
+	}
+	if withFailures == nil || withFailures.Count != 1 || withFailures.Reason != p.StatusReason {
+		t.Errorf("expected the completion with 1 failed item to be reported, got %+v", withFailures)
+	}
+
+	// A partition without tolerance fails with its first failed item, as does one past it.
+	zero, below := 0.0, 0.1
+	for _, tc := range []struct {
+		id        string
+		tolerance *float64
+	}{{"q", &zero}, {"s", &below}} {
+		createPartition(tc.id, tc.tolerance)
+		events := runForEvents(t, r, watcher())
+		p, err := r.GetPartition(ctx, tc.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Status != Failed || p.Gate != 0 {
+			t.Errorf("expected partition %s to fail at gate 0, got %s at gate %d", tc.id, p.Status, p.Gate)
+		}
+		for _, e := range events {
+			if e.Type == PartitionCompletedWithFailures {
+				t.Errorf("expected partition %s not to complete, got %+v", tc.id, e)
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Codec marshals typed items to and from their payloads.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(b []byte, v interface{}) error
+}
+
+// JSONCodec marshals items as JSON.
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(b []byte, v interface{}) error {
+	return json.Unmarshal(b, v)
+}
+
+// Decision is what a TypedProcessor's func decided to do with an item.
+type Decision struct {
+	// Complete marks the item as done.
+	Complete bool
+	// NextGate is the gate to move the item to.
+	NextGate int
+}
+
+// TypedProcessor adapts a func processing items of type T into a Processor, by decoding each
+// item's payload into a T, and encoding the T returned as the item's result.
+type TypedProcessor[T any] struct {
+	Func func(ctx context.Context, id string, obj T) (T, Decision, error)
+	// Codec defaults to JSONCodec.
+	Codec Codec
+	// RetryDecodeErrors retries items whose payload can't be decoded, instead of failing them
+	// immediately.
+	RetryDecodeErrors bool
+	// HealthcheckFunc is called by Healthcheck if set.
+	HealthcheckFunc func(ctx context.Context) error
+}
+
+func (p *TypedProcessor[T]) codec() Codec {
+	if p.Codec == nil {
+		return JSONCodec{}
+	}
+	return p.Codec
+}
+
+func (p *TypedProcessor[T]) Process(id string, b []byte) (*ProcessorResponse, error) {
+	return p.ProcessContext(context.Background(), id, b)
+}
+
+func (p *TypedProcessor[T]) ProcessContext(ctx context.Context, id string, b []byte) (*ProcessorResponse, error) {
+	var obj T
+	if err := p.codec().Unmarshal(b, &obj); err != nil {
+		err = fmt.Errorf("error decoding item %s: %w", id, err)
+		if !p.RetryDecodeErrors {
+			err = &nonRetryableError{Err: err, msg: err.Error()}
+		}
+		return nil, err
+	}
+	out, decision, err := p.Func(ctx, id, obj)
+	if err != nil {
+		return nil, err
+	}
+	data, err := p.codec().Marshal(out)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding item %s: %w", id, err)
+	}
+	return &ProcessorResponse{NextGate: decision.NextGate, Complete: decision.Complete, Data: data}, nil
+}
+
+func (p *TypedProcessor[T]) Healthcheck(ctx context.Context) error {
+	if p.HealthcheckFunc == nil {
+		return nil
+	}
+	return p.HealthcheckFunc(ctx)
+}
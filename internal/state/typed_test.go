@@ -0,0 +1,69 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTypedProcessor(t *testing.T) {
+	type obj struct {
+		N int `json:"n"`
+	}
+	p := &TypedProcessor[obj]{Func: func(ctx context.Context, id string, o obj) (obj, Decision, error) {
+		o.N++
+		return o, Decision{Complete: o.N > 1, NextGate: o.N}, nil
+	}}
+	resp, err := p.Process("i", []byte(`{"n":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Data) != `{"n":2}` || !resp.Complete || resp.NextGate != 2 {
+		t.Errorf("unexpected response %+v with %s", resp, resp.Data)
+	}
+
+	if _, err := p.Process("i", []byte(`not json`)); err == nil || IsRetryable(err) {
+		t.Errorf("expected a non retryable decode error, got %v", err)
+	}
+	p.RetryDecodeErrors = true
+	if _, err := p.Process("i", []byte(`not json`)); err == nil || !IsRetryable(err) {
+		t.Errorf("expected a retryable decode error, got %v", err)
+	}
+}
+
+func TestTypedProcessorShutdown(t *testing.T) {
+	r := openTestRepo(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Status: Available, Data: []byte(`{}`)})
+
+	started := make(chan struct{})
+	p := &TypedProcessor[struct{}]{Func: func(ctx context.Context, id string, o struct{}) (struct{}, Decision, error) {
+		close(started)
+		<-ctx.Done()
+		return o, Decision{}, ctx.Err()
+	}}
+	w := &Watcher{Processor: p, Repo: r, BatchSize: 1, PollInterval: 10 * time.Millisecond}
+	done := make(chan struct{})
+	go func() {
+		w.Start(ctx)
+		close(done)
+	}()
+	<-started
+	cancel()
+	<-done
+
+	i, err := r.GetItem(context.Background(), "i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The interrupted attempt isn't counted against the item.
+	if i.Status != Available || i.RetryCount != 0 || i.ErrorMessages != "" {
+		t.Errorf("expected the item to be untouched, got %s with %d retries: %s", i.Status, i.RetryCount, i.ErrorMessages)
+	}
+	if !errors.Is(&nonRetryableError{Err: context.Canceled}, context.Canceled) {
+		t.Error("expected non retryable errors to unwrap")
+	}
+}
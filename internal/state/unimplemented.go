@@ -0,0 +1,254 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrUnimplemented is returned by the methods of UnimplementedRepo.
+var ErrUnimplemented = errors.New("repo method not implemented")
+
+// UnimplementedRepo implements Repo by failing every call with ErrUnimplemented, and every
+// save. Partial fakes embed it and override the methods they need, so that they keep
+// compiling as methods are added to Repo.
+type UnimplementedRepo struct{}
+
+var _ Repo = UnimplementedRepo{}
+
+func (UnimplementedRepo) GetAvailableItems(ctx context.Context, p *Partition, limit int, order ItemOrder, retries RetryFilter) ([]*Item, error) {
+	return nil, ErrUnimplemented
+}
+
+func (UnimplementedRepo) GetCountByStatus(ctx context.Context, id string) (map[Status]int, error) {
+	return nil, ErrUnimplemented
+}
+
+func (UnimplementedRepo) CountAvailablePastGate(ctx context.Context, partitionID string, gate int) (int, error) {
+	return 0, ErrUnimplemented
+}
+
+func (UnimplementedRepo) CountDelayedItems(ctx context.Context, p *Partition) (int, error) {
+	return 0, ErrUnimplemented
+}
+
+func (UnimplementedRepo) CountDeadlineMisses(ctx context.Context, partitionID string) (int, error) {
+	return 0, ErrUnimplemented
+}
+
+func (UnimplementedRepo) GetPartitionProgress(ctx context.Context, id string) (*PartitionProgress, error) {
+	return nil, ErrUnimplemented
+}
+
+func (UnimplementedRepo) GetAvailableLag(ctx context.Context, p *Partition) (time.Duration, error) {
+	return 0, ErrUnimplemented
+}
+
+func (UnimplementedRepo) CountStuckItems(ctx context.Context, olderThan time.Duration) (map[string]int, error) {
+	return nil, ErrUnimplemented
+}
+
+func (UnimplementedRepo) GetItem(ctx context.Context, id string) (*Item, error) {
+	return nil, ErrUnimplemented
+}
+
+func (UnimplementedRepo) GetItemByIdempotencyKey(ctx context.Context, partitionID, key string) (*Item, error) {
+	return nil, ErrUnimplemented
+}
+
+func (UnimplementedRepo) FindCompletedByHash(ctx context.Context, partitionID string, gate int, hash string) (*Item, error) {
+	return nil, ErrUnimplemented
+}
+
+func (UnimplementedRepo) ListItems(ctx context.Context, filter ItemFilter, page PageRequest) ([]*Item, PageToken, error) {
+	return nil, "", ErrUnimplemented
+}
+
+func (UnimplementedRepo) Save(ctx context.Context, m Model) bool {
+	return false
+}
+
+func (UnimplementedRepo) SaveWithOutbox(ctx context.Context, m Model, events ...*OutboxEvent) bool {
+	return false
+}
+
+func (UnimplementedRepo) Transaction(ctx context.Context, f func(db *GormRepo) error) error {
+	return ErrUnimplemented
+}
+
+func (UnimplementedRepo) TransactionWithOptions(ctx context.Context, opts TxOptions, f func(db *GormRepo) error) error {
+	return ErrUnimplemented
+}
+
+func (UnimplementedRepo) CreateItems(ctx context.Context, items ...*Item) error {
+	return ErrUnimplemented
+}
+
+func (UnimplementedRepo) GetOrCreateItem(ctx context.Context, i *Item) (*Item, bool, error) {
+	return nil, false, ErrUnimplemented
+}
+
+func (UnimplementedRepo) FailExpiredItems(ctx context.Context) (int, error) {
+	return 0, ErrUnimplemented
+}
+
+func (UnimplementedRepo) ReclaimStuckItems(ctx context.Context, olderThan time.Duration) (int, error) {
+	return 0, ErrUnimplemented
+}
+
+func (UnimplementedRepo) ClaimItems(ctx context.Context, owner string, limit int, visibility time.Duration) ([]*Item, error) {
+	return nil, ErrUnimplemented
+}
+
+func (UnimplementedRepo) ExtendItem(ctx context.Context, itemID, owner string, d time.Duration) (bool, error) {
+	return false, ErrUnimplemented
+}
+
+func (UnimplementedRepo) GetPotentialLeases(ctx context.Context, selector map[string]string) ([]*Partition, error) {
+	return nil, ErrUnimplemented
+}
+
+func (UnimplementedRepo) GetPartition(ctx context.Context, id string) (*Partition, error) {
+	return nil, ErrUnimplemented
+}
+
+func (UnimplementedRepo) ListPartitions(ctx context.Context, filter PartitionFilter, page PageRequest) ([]*Partition, PageToken, error) {
+	return nil, "", ErrUnimplemented
+}
+
+func (UnimplementedRepo) CreatePartition(ctx context.Context, p *Partition) error {
+	return ErrUnimplemented
+}
+
+func (UnimplementedRepo) GetOrCreatePartition(ctx context.Context, p *Partition) (*Partition, bool, error) {
+	return nil, false, ErrUnimplemented
+}
+
+func (UnimplementedRepo) AcquireLease(ctx context.Context, p *Partition, owner string, until time.Time) (bool, error) {
+	return false, ErrUnimplemented
+}
+
+func (UnimplementedRepo) TryAcquireLease(ctx context.Context, partitionID, owner string, until time.Time, fence bool) (bool, error) {
+	return false, ErrUnimplemented
+}
+
+func (UnimplementedRepo) AcquireLeases(ctx context.Context, candidates []string, owner string, until time.Time, limit int, fence bool) ([]*Partition, error) {
+	return nil, ErrUnimplemented
+}
+
+func (UnimplementedRepo) ReleaseLease(ctx context.Context, p *Partition) error {
+	return ErrUnimplemented
+}
+
+func (UnimplementedRepo) GetLeaseHistory(ctx context.Context, partitionID string, limit int) ([]*LeaseEvent, error) {
+	return nil, ErrUnimplemented
+}
+
+func (UnimplementedRepo) PurgeLeaseEvents(ctx context.Context, before time.Time) (int, error) {
+	return 0, ErrUnimplemented
+}
+
+func (UnimplementedRepo) ReleaseExpiredLeases(ctx context.Context) (int, error) {
+	return 0, ErrUnimplemented
+}
+
+func (UnimplementedRepo) RetryFailedPartitions(ctx context.Context) ([]*Partition, error) {
+	return nil, ErrUnimplemented
+}
+
+func (UnimplementedRepo) Heartbeat(ctx context.Context, o *Owner) error {
+	return ErrUnimplemented
+}
+
+func (UnimplementedRepo) ListOwners(ctx context.Context) ([]*Owner, error) {
+	return nil, ErrUnimplemented
+}
+
+func (UnimplementedRepo) AcquireLeadership(ctx context.Context, election, owner string, until time.Time) (bool, error) {
+	return false, ErrUnimplemented
+}
+
+func (UnimplementedRepo) ReleaseLeadership(ctx context.Context, election, owner string) error {
+	return ErrUnimplemented
+}
+
+func (UnimplementedRepo) Healthcheck(ctx context.Context) error {
+	return ErrUnimplemented
+}
+
+func (UnimplementedRepo) RetryFailedItems(ctx context.Context, partitionID string) (int, error) {
+	return 0, ErrUnimplemented
+}
+
+func (UnimplementedRepo) ReopenPartition(ctx context.Context, id string, gate *int) error {
+	return ErrUnimplemented
+}
+
+func (UnimplementedRepo) SetPartitionMaxRetries(ctx context.Context, id string, maxRetries *int) error {
+	return ErrUnimplemented
+}
+
+func (UnimplementedRepo) SetItemMaxRetries(ctx context.Context, id string, maxRetries *int) error {
+	return ErrUnimplemented
+}
+
+func (UnimplementedRepo) CancelItem(ctx context.Context, id string) error {
+	return ErrUnimplemented
+}
+
+func (UnimplementedRepo) RedriveItem(ctx context.Context, id string, gate *int) error {
+	return ErrUnimplemented
+}
+
+func (UnimplementedRepo) PurgeItems(ctx context.Context, filter ItemFilter) (int, error) {
+	return 0, ErrUnimplemented
+}
+
+func (UnimplementedRepo) ReencryptPartition(ctx context.Context, id string, keyID string) (int, error) {
+	return 0, ErrUnimplemented
+}
+
+func (UnimplementedRepo) GetPartitionQuotaUsage(ctx context.Context, id string) (*QuotaUsage, error) {
+	return nil, ErrUnimplemented
+}
+
+func (UnimplementedRepo) GetTenantQuotaUsage(ctx context.Context, tenant string) (*QuotaUsage, error) {
+	return nil, ErrUnimplemented
+}
+
+func (UnimplementedRepo) SetPartitionMaxPendingItems(ctx context.Context, id string, max *int) error {
+	return ErrUnimplemented
+}
+
+func (UnimplementedRepo) SetTenantMaxPendingItems(ctx context.Context, tenant string, max *int) error {
+	return ErrUnimplemented
+}
+
+func (UnimplementedRepo) ExportPartition(ctx context.Context, id string, w io.Writer) error {
+	return ErrUnimplemented
+}
+
+func (UnimplementedRepo) ImportPartition(ctx context.Context, r io.Reader, opts ImportOptions) (*Partition, error) {
+	return nil, ErrUnimplemented
+}
+
+func (UnimplementedRepo) ClaimOutboxBatch(ctx context.Context, limit int, claimFor time.Duration) ([]*OutboxEvent, error) {
+	return nil, ErrUnimplemented
+}
+
+func (UnimplementedRepo) MarkOutboxPublished(ctx context.Context, ids ...string) error {
+	return ErrUnimplemented
+}
+
+func (UnimplementedRepo) AutoMigrate() error {
+	return ErrUnimplemented
+}
+
+func (UnimplementedRepo) MigrateTo(ctx context.Context, version int) error {
+	return ErrUnimplemented
+}
+
+func (UnimplementedRepo) SchemaVersion(ctx context.Context) (int, error) {
+	return 0, ErrUnimplemented
+}
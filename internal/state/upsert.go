@@ -0,0 +1,66 @@
+package state
+
+import (
+	"context"
+
+	"gorm.io/gorm/clause"
+)
+
+// GetOrCreatePartition inserts the partition unless one with its ID exists, and returns the
+// stored partition either way, along with whether it was created. An existing partition is
+// left as is, version included, so that producers racing to create the same partition all
+// succeed and end up with the same row. A partition existing under another tenant is an
+// ErrVersionConflict.
+func (db *GormRepo) GetOrCreatePartition(ctx context.Context, p *Partition) (*Partition, bool, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	if err := db.prepareNewPartition(ctx, p); err != nil {
+		return nil, false, err
+	}
+	p.IncrementVersion()
+	// Inserts with ON CONFLICT DO NOTHING, or a MERGE on SQL Server.
+	res := db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(p)
+	if res.Error == nil && res.RowsAffected == 1 {
+		return p, true, nil
+	}
+	p.DecrementVersion()
+	if res.Error != nil {
+		return nil, false, res.Error
+	}
+	stored, err := db.GetPartition(ctx, p.ID)
+	if IsNotFound(err) {
+		return nil, false, &ErrVersionConflict{Kind: "partition", ID: p.ID}
+	}
+	return stored, false, err
+}
+
+// GetOrCreateItem creates the item as CreateItems does, unless one with its ID exists, and
+// returns the stored item either way, along with whether it was created. An existing item is
+// left as is, version included. An item whose IdempotencyKey is taken is handled according to
+// the repo's DuplicateItems policy, and the item holding the key returned as existing. An
+// item existing under another tenant is an ErrVersionConflict.
+func (db *GormRepo) GetOrCreateItem(ctx context.Context, i *Item) (*Item, bool, error) {
+	if err := db.assignID("item", i); err != nil {
+		return nil, false, err
+	}
+	stored, err := db.GetItem(ctx, i.ID)
+	if err == nil {
+		return stored, false, nil
+	}
+	if !IsNotFound(err) {
+		return nil, false, err
+	}
+	// The item may be created concurrently since it was looked up.
+	n, err := db.createItems(ctx, true, i)
+	if err != nil {
+		return nil, false, err
+	}
+	if n == 1 {
+		return i, true, nil
+	}
+	stored, err = db.GetItem(ctx, i.ID)
+	if IsNotFound(err) {
+		return nil, false, &ErrVersionConflict{Kind: "item", ID: i.ID}
+	}
+	return stored, false, err
+}
@@ -0,0 +1,112 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// partitionLoop is what the watchdog tracks of the polling loop of a leased partition.
+type partitionLoop struct {
+	// busySince is when the loop started its current poll, and stalledAt when the watchdog
+	// cancelled it, in Unix nanoseconds, or zero while the loop waits for its next poll.
+	busySince int64
+	stalledAt int64
+	stop      context.CancelFunc
+}
+
+func (l *partitionLoop) busy(now time.Time) {
+	atomic.StoreInt64(&l.busySince, now.UnixNano())
+}
+
+func (l *partitionLoop) idle() {
+	atomic.StoreInt64(&l.busySince, 0)
+}
+
+// startLoop returns the context of a new polling loop of the leased partition, which the
+// watchdog cancels if the loop stalls.
+func (w *Watcher) startLoop(ctx context.Context, partitionID string) (context.Context, *partitionLoop) {
+	loopCtx, stop := context.WithCancel(ctx)
+	loop := &partitionLoop{stop: stop}
+	w.mu.Lock()
+	if w.loops == nil {
+		w.loops = map[string]*partitionLoop{}
+	}
+	w.loops[partitionID] = loop
+	w.mu.Unlock()
+	return loopCtx, loop
+}
+
+// watchdog cancels the polls of leased partitions that take over the StallThreshold, every
+// lease interval until ctx is done.
+func (w *Watcher) watchdog(ctx context.Context) {
+	for {
+		select {
+		case <-w.Clock.After(w.LeaseInterval):
+			w.cancelStalls()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *Watcher) cancelStalls() {
+	now := w.Clock.Now()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for id, loop := range w.loops {
+		busySince := atomic.LoadInt64(&loop.busySince)
+		if busySince == 0 || atomic.LoadInt64(&loop.stalledAt) != 0 {
+			continue
+		}
+		if stalled := now.Sub(time.Unix(0, busySince)); stalled > w.StallThreshold {
+			glog.Warningf("poll of partition %s stalled for %s, restarting it", id, stalled.Round(time.Millisecond))
+			atomic.StoreInt64(&loop.stalledAt, now.UnixNano())
+			atomic.AddInt64(&w.counters.stalls, 1)
+			w.metrics().Counter(MetricPartitionStalls, 1, Labels{"partition": id})
+			loop.stop()
+		}
+	}
+}
+
+// reenter reloads the partition after its stalled poll was cancelled, returning whether the
+// watcher still holds its lease and should poll it again. Otherwise the partition is dropped,
+// to be leased afresh once its lease lapses.
+func (w *Watcher) reenter(ctx context.Context, p *Partition) bool {
+	fresh, err := w.Repo.GetPartition(ctx, p.ID)
+	if err != nil {
+		glog.Errorf("error reloading stalled partition %s: %s", p.ID, err)
+		return false
+	}
+	if fresh.Owner != w.OwnerID || fresh.InActive(w.Clock.Now()) {
+		glog.Infof("lease on stalled partition %s lapsed, dropping it", p.ID)
+		return false
+	}
+	w.mu.Lock()
+	*p = *fresh
+	w.mu.Unlock()
+	return true
+}
+
+// checkStalls returns an error if a poll the watchdog cancelled hasn't stopped within a lease
+// interval, e.g. because the repo call it is stuck in ignores its context.
+func (w *Watcher) checkStalls() error {
+	now := w.Clock.Now()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var errs []error
+	for id, loop := range w.loops {
+		stalledAt := atomic.LoadInt64(&loop.stalledAt)
+		if stalledAt == 0 {
+			continue
+		}
+		if since := now.Sub(time.Unix(0, stalledAt)); since > w.LeaseInterval {
+			errs = append(errs, fmt.Errorf("poll of partition %s cancelled %s ago is still stalled", id, since.Round(time.Millisecond)))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,99 @@
+package state
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// hangingRepo hangs the nth call to GetCountByStatus, until its context is done or, if
+// release is set, until release is closed, like a query without a deadline.
+type hangingRepo struct {
+	*GormRepo
+	nth     int32
+	calls   int32
+	release chan struct{}
+}
+
+func (r *hangingRepo) GetCountByStatus(ctx context.Context, partitionID string) (map[Status]int, error) {
+	if atomic.AddInt32(&r.calls, 1) == r.nth {
+		if r.release != nil {
+			<-r.release
+		} else {
+			<-ctx.Done()
+		}
+		return nil, ctx.Err()
+	}
+	return r.GormRepo.GetCountByStatus(ctx, partitionID)
+}
+
+func TestWatchdogRestartsStalledPoll(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Status: Available, Data: []byte(`{"times": 1}`)})
+
+	// The second poll hangs, once the partition is leased.
+	m := &counterMetrics{counters: map[string]float64{}}
+	w := &Watcher{Processor: &testProcessor{}, Repo: &hangingRepo{GormRepo: r, nth: 2}, PollInterval: 10 * time.Millisecond,
+		AutoClose: true, StallThreshold: 50 * time.Millisecond, Metrics: m}
+	events := runForEvents(t, r, w)
+
+	if last := events[len(events)-1]; last.Type != PartitionCompleted {
+		t.Fatalf("expected the partition to complete, got %v", eventTypes(events))
+	}
+	// The stalled poll was restarted under the same lease, rather than the partition leased
+	// again.
+	leases := 0
+	for _, e := range events {
+		if e.Type == PartitionLeased {
+			leases++
+		}
+	}
+	if leases != 1 {
+		t.Errorf("expected the partition to be leased once, got %v", eventTypes(events))
+	}
+	if stalls := w.Stats().Stalls; stalls != 1 {
+		t.Errorf("expected 1 stall, got %d", stalls)
+	}
+	if n := m.counters[MetricPartitionStalls]; n != 1 {
+		t.Errorf("expected 1 stall to be counted, got %v", n)
+	}
+}
+
+func TestWatchdogLiveness(t *testing.T) {
+	r := openTestRepo(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+
+	// The first poll hangs regardless of its context.
+	repo := &hangingRepo{GormRepo: r, nth: 1, release: make(chan struct{})}
+	w := &Watcher{Processor: &testProcessor{}, Repo: repo, PollInterval: 10 * time.Millisecond, StallThreshold: 50 * time.Millisecond}
+	done := make(chan struct{})
+	go func() {
+		w.Start(ctx)
+		close(done)
+	}()
+	defer func() {
+		close(repo.release)
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := w.Liveness(ctx)
+		if err != nil && strings.Contains(err.Error(), "partition p") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the stalled poll to fail liveness, got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stalls := w.Stats().Stalls; stalls != 1 {
+		t.Errorf("expected the poll to be cancelled once, got %d", stalls)
+	}
+}
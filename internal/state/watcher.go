@@ -2,12 +2,16 @@ package state
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
 	"github.com/golang/glog"
 	"github.com/google/uuid"
-	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // DefaultPollInterval used directly for polling items, and indirectly for acquiring leases.
@@ -18,14 +22,41 @@ var MinLeaseDuration = time.Second * 30
 
 var OverrideMinLeaseDuration = false
 
+// DefaultLivenessThreshold is the number of lease intervals a watcher may go without making
+// progress before Liveness reports it as wedged.
+var DefaultLivenessThreshold = 3
+
+// DefaultBatchSize is the number of items a watcher processes simultaneously, by default.
+var DefaultBatchSize = 10
+
 // Watcher watches partitions, leases them, and calls out to processor to process items.
 type Watcher struct {
 	Processor
-	Repo
+	// Repo is where the watcher leases partitions, and reads and saves their items.
+	Repo    WatcherRepo
 	OwnerID string
 
-	// BatchSize is the number of items to process simultaneously.
-	BatchSize    int
+	// BatchSize is the number of items to process simultaneously. Defaults to DefaultBatchSize.
+	BatchSize int
+	// AdaptiveBatch, if its MaxBatch is set, adjusts the number of items processed
+	// simultaneously between its MinBatch and MaxBatch, from the latency and errors of the
+	// processor, rather than processing BatchSize items. BatchSize is then its MaxBatch.
+	AdaptiveBatch AdaptiveBatch
+	// MaxInFlightPerPartition is the number of items each leased partition may have queued or
+	// being processed. Item processors take from the leased partitions in turn, so a large
+	// partition can't starve a small one. Defaults to BatchSize.
+	MaxInFlightPerPartition int
+	// Dispatch shares the item processors between groups of partitions, e.g. tenants, rather
+	// than between partitions alone, see DispatchPolicy.
+	Dispatch DispatchPolicy
+	// PromoteResultOnGate replaces an item's Data with its Result whenever the processor
+	// advances its gate, so that Data holds the input to the item's current gate rather than
+	// its original payload.
+	PromoteResultOnGate bool
+	// FetchOrder is the order in which each partition's available items are processed.
+	FetchOrder ItemOrder
+	// FetchPolicy splits each fetch between fresh items and retried ones, see FetchPolicy.
+	FetchPolicy  FetchPolicy
 	PollInterval time.Duration
 	// Whether to manually increment the gate for checkpoint purposes, or autoclose the partition.
 	// Set to true, if you don't want the watcher to automatically increment
@@ -33,26 +64,220 @@ type Watcher struct {
 	// This is especially useful if you continuously add items to a partition with no checkpointing.
 	ManualCheckpoint bool
 	AutoClose        bool
+	// FailureTolerance is the fraction of a partition's items, from 0 to 1, which may fail
+	// without failing the partition, unless it sets its own: the partition's gates advance
+	// past the failed items, which are left behind at their gate, and it completes once every
+	// other item is done. Cancelled items aren't counted. Zero fails the partition with its
+	// first failed item.
+	FailureTolerance float64
 	LeaseInterval    time.Duration
 	LeaseDuration    time.Duration
+	// LivenessThreshold is the number of lease intervals without progress after which
+	// Liveness fails. Defaults to DefaultLivenessThreshold.
+	LivenessThreshold int
+	// MaxRepoOutage is how long the repo may fail every call before Run stops with
+	// ErrRepoUnreachable. Defaults to DefaultMaxRepoOutage, and never stops if negative.
+	MaxRepoOutage time.Duration
+	// CriticalHealthChecks are the names of the checks of HealthReport whose failure makes the
+	// watcher unhealthy, rather than degraded. Defaults to DefaultCriticalHealthChecks.
+	CriticalHealthChecks []string
+
+	// RateLimit is the maximum number of items per second to process, with bursts of up to
+	// RateBurst items. Zero means unlimited. Ignored if Limiter is set.
+	RateLimit float64
+	RateBurst int
+	// Limiter paces item processing, and may be shared with other watchers.
+	Limiter Limiter
+	// IdleMaxInterval enables backing off polling while there is no work. After IdleThreshold
+	// consecutive lease scans find no new partitions, and no leased partition has available
+	// items, the poll and lease intervals double with each scan up to IdleMaxInterval. They
+	// reset as soon as any work is found.
+	IdleMaxInterval time.Duration
+	// IdleThreshold defaults to DefaultIdleThreshold.
+	IdleThreshold int
+	// AbandonBackoff is how long a partition isn't leased for after the watcher's first poll
+	// of it found nothing to do, e.g. as its items are done but it isn't closed. Defaults to
+	// DefaultAbandonBackoff.
+	AbandonBackoff time.Duration
+	// Metrics receives the watcher's measurements. Defaults to discarding them.
+	Metrics Metrics
+	// Clock defaults to the real time, and is overridden in tests.
+	Clock clock.Clock
+	// EventBuffer is the capacity of the Events channel. Defaults to DefaultEventBuffer.
+	EventBuffer int
+	// Tenant, if set, restricts the watcher to the tenant's partitions and items. A GormRepo
+	// without a tenant of its own is scoped to it.
+	Tenant string
+	// Selector restricts the watcher to partitions with all of these labels.
+	Selector map[string]string
+	// Version is reported in the watcher's heartbeats, see Owner.
+	Version string
+	// LeaderElection, if set, is the name of an election among the watchers sharing it. Only
+	// the leader leases partitions, the others stand by to take over within LeaseDuration of
+	// the leader stopping. See IsLeader.
+	LeaderElection string
+	// DeadlineSweepInterval, if set, is how often the watcher fails the expired items of every
+	// partition, including those nobody leases, see FailExpiredItems. With a LeaderElection,
+	// only the leader sweeps.
+	DeadlineSweepInterval time.Duration
+	// MaxNewItems is the number of new items a single processor response may create, beyond
+	// which the item fails. Defaults to DefaultMaxNewItems.
+	MaxNewItems int
+	// KeepRetriesAcrossGates keeps an item's RetryCount and ErrorMessages when the processor
+	// moves it to a later gate. By default they are reset, so that each gate has the full
+	// MaxRetries.
+	KeepRetriesAcrossGates bool
+	// MaxGateSkip is the number of gates a processor may move an item ahead by at once.
+	// Responses moving an item further, or back, fail the item. Defaults to DefaultMaxGateSkip.
+	MaxGateSkip int
+	// RetryClassifier, if set, decides whether the processor's errors are retried, and
+	// when, in place of DefaultRetryClassifier.
+	RetryClassifier func(error) RetryDecision
+	// RetryPolicy decides how long items wait between retries, and when they fail. Defaults
+	// to retrying immediately, up to MaxRetries times. The MaxRetries of an item or its
+	// partition, if set, overrides when the policy fails the item.
+	RetryPolicy RetryPolicy
+	// BreakerThreshold, if set, is the number of consecutive processor errors in a partition
+	// after which its circuit breaker opens, and the watcher stops processing the partition's
+	// items for BreakerCooldown, rather than spend their retries on an outage. A single item
+	// then probes the processor, closing the breaker if it succeeds or opening it again.
+	// Errors that the RetryClassifier fails the item for don't count.
+	BreakerThreshold int
+	// BreakerCooldown defaults to DefaultBreakerCooldown.
+	BreakerCooldown time.Duration
+	// GlobalBreaker also counts consecutive processor errors across the watcher's partitions,
+	// against the same threshold, pausing all of them while it is open.
+	GlobalBreaker bool
+	// MaxThrottleFactor is the most the poll interval of a partition is multiplied by, while
+	// the processor returns ThrottledErrors for its items. The factor doubles with each
+	// throttled attempt and resets on success. Defaults to DefaultMaxThrottleFactor.
+	MaxThrottleFactor int
+	// FetchTimeout, if set, bounds the reads of each lease scan and each poll of a leased
+	// partition, on top of the repo's own timeout of each statement.
+	FetchTimeout time.Duration
+	// SaveTimeout, if set, bounds each save of a partition or item, including its
+	// transaction, on top of the repo's own timeout of each statement.
+	SaveTimeout time.Duration
+	// ProcessingTimeout, if set, is how long the processor may take over an item, after which
+	// the attempt is abandoned and fails with ErrProcessingTimeout, counting against the item's
+	// retries. The watcher then also saves each item's ProcessingStartedAt before processing
+	// it, at the cost of an extra save per attempt.
+	ProcessingTimeout time.Duration
+	// MaxProcessingTime, if set, bounds an attempt however long its item's claim is extended,
+	// see ExtendItem: the attempt is abandoned as with a ProcessingTimeout once it has run for
+	// MaxProcessingTime. A GormRepo without a MaxProcessingTime of its own is given it.
+	MaxProcessingTime time.Duration
+	// StuckSweepInterval, if set, is how often the watcher reclaims the items of every
+	// partition stuck in processing for over StuckItemThreshold, e.g. after their watcher
+	// crashed, see ReclaimStuckItems. With a LeaderElection, only the leader sweeps.
+	StuckSweepInterval time.Duration
+	// StuckItemThreshold defaults to twice the ProcessingTimeout, or the MaxProcessingTime if
+	// shorter. It should be longer than the attempts of every watcher may take, or attempts
+	// still in progress are reclaimed.
+	StuckItemThreshold time.Duration
+	// LeaseSweepInterval, if set, is how often the watcher clears the owner of expired leases,
+	// see ReleaseExpiredLeases. With a LeaderElection, only the leader sweeps.
+	LeaseSweepInterval time.Duration
+	// PartitionRetrySweepInterval, if set, is how often the watcher retries the failed
+	// partitions whose cooldown passed, see MaxPartitionRetries and RetryFailedPartitions.
+	// With a LeaderElection, only the leader sweeps.
+	PartitionRetrySweepInterval time.Duration
+	// SLA are thresholds the leased partitions are checked against as they are polled.
+	SLA SLAConfig
+	// Assignment decides which of the partitions available for lease the watcher leases, and
+	// hands over those assigned to other owners. Defaults to Greedy.
+	Assignment AssignmentStrategy
+	// StallThreshold is how long a single poll of a leased partition may take, e.g. while a
+	// repo call hangs, before the watchdog cancels it and polls the partition afresh if its
+	// lease still holds. Defaults to the LeaseDuration, past which the lease lapses anyway.
+	StallThreshold time.Duration
+	// CurrentSchemaVersion, if set, is the schema version of the payloads the processor
+	// expects. Items enqueued with an older SchemaVersion are upgraded to it before processing,
+	// by chaining Upgraders, each keyed by the version it upgrades from and returning the
+	// upgraded payload and its version. The upgrade is saved along with the attempt, and items
+	// that can't be upgraded fail without retries. Only Data is upgraded: Results are written
+	// by the current processor.
+	CurrentSchemaVersion int
+	Upgraders            map[int]func([]byte) ([]byte, int, error)
+	// DedupeByHash completes items without processing them when an earlier item of their
+	// partition with the same DataHash completed at their gate, copying its Result. Items
+	// without a DataHash are processed as usual.
+	DedupeByHash bool
+	// ItemLeaseMode claims batches of items across partitions, see ClaimItems, rather than
+	// leasing partitions and polling each of them. Each item is hidden from other watchers for
+	// VisibilityTimeout, extended while it is processed, and claimed again once its claim
+	// expires, e.g. as its watcher stopped. Partitions still move through their gates, only
+	// their items at their current gate being claimed, but Selector and Assignment don't
+	// apply. Watchers sharing partitions must all use the same mode.
+	ItemLeaseMode bool
+	// VisibilityTimeout defaults to the LeaseDuration.
+	VisibilityTimeout time.Duration
+	// SettleInterval is how often the watcher settles every partition whose items may be
+	// claimed in ItemLeaseMode, including those which no saved item settles, such as a
+	// partition without items at its gate. Defaults to the LeaseInterval.
+	SettleInterval time.Duration
+	// TracerProvider, if set, traces each attempt with a span continuing the item's
+	// TraceContext, which is passed on to processors in their context.
+	TracerProvider trace.TracerProvider
 
-	itemQ  chan *Item
+	dispatch dispatcher
+	// batch adjusts the dispatcher's limit, with an AdaptiveBatch.
+	batch  *batchController
 	leases map[string]*Partition
-	mu     sync.Mutex
+	// handOvers stop watching the leased partitions, releasing them, guarded by mu.
+	handOvers map[string]context.CancelFunc
+	// throttles are the factors of the throttled partitions' poll intervals, guarded by mu.
+	throttles map[string]int
+	// lags are the lags of the leased partitions, see noteLag, guarded by mu.
+	lags map[string]time.Duration
+	// slas are the SLA states of the leased partitions, guarded by mu.
+	slas map[string]*slaState
+	// loops are the polling loops of the leased partitions, watched by the watchdog, guarded
+	// by mu.
+	loops    map[string]*partitionLoop
+	mu       sync.Mutex
+	counters watcherCounters
+	events   chan Event
+	leader   int32
+	breakers breakers
+	saved    savedVersions
+	// fatalErr is the fatal error the watcher stopped with, and stopRun stops Run, guarded by
+	// mu.
+	fatalErr error
+	stopRun  context.CancelFunc
 }
 
-// Start the watcher. Sets some defaults if not set.
+// Start the watcher. Sets some defaults if not set. Like Run, but logs the fatal error it
+// stops with, if any.
 func (w *Watcher) Start(ctx context.Context) {
+	if err := w.Run(ctx); err != nil {
+		glog.Errorf("watcher %s stopped: %s", w.OwnerID, err)
+	}
+}
+
+// init sets the defaults of the watcher's unset fields.
+func (w *Watcher) init() {
 	if w.PollInterval == 0 {
 		w.PollInterval = DefaultPollInterval
 	}
+	if w.AdaptiveBatch.enabled() {
+		w.batch = newBatchController(w.AdaptiveBatch)
+		w.BatchSize = w.batch.cfg.MaxBatch
+		w.dispatch.setLimit(w.batch.current())
+		w.metrics().Gauge(MetricBatchLimit, float64(w.batch.current()), nil)
+	}
 	if w.BatchSize == 0 {
-		w.BatchSize = 10
+		w.BatchSize = DefaultBatchSize
+	}
+	if w.MaxInFlightPerPartition == 0 {
+		w.MaxInFlightPerPartition = w.BatchSize
 	}
 	if w.OwnerID == "" {
 		w.OwnerID = uuid.New().String()
 	}
+	w.dispatch.policy = w.Dispatch
 	w.leases = map[string]*Partition{}
+	w.handOvers = map[string]context.CancelFunc{}
 	if w.LeaseInterval == 0 {
 		w.LeaseInterval = 2 * w.PollInterval
 	}
@@ -63,22 +288,78 @@ func (w *Watcher) Start(ctx context.Context) {
 		glog.Warning("overriding lease duration to 30s, recommended minimum")
 		w.LeaseDuration = MinLeaseDuration
 	}
-
-	w.itemQ = make(chan *Item, w.BatchSize)
-	w.watch(ctx)
+	if w.VisibilityTimeout == 0 {
+		w.VisibilityTimeout = w.LeaseDuration
+	}
+	if w.SettleInterval == 0 {
+		w.SettleInterval = w.LeaseInterval
+	}
+	if w.LivenessThreshold == 0 {
+		w.LivenessThreshold = DefaultLivenessThreshold
+	}
+	if w.StallThreshold == 0 {
+		w.StallThreshold = w.LeaseDuration
+	}
+	if w.IdleThreshold == 0 {
+		w.IdleThreshold = DefaultIdleThreshold
+	}
+	if w.AbandonBackoff == 0 {
+		w.AbandonBackoff = DefaultAbandonBackoff
+	}
+	if w.MaxNewItems == 0 {
+		w.MaxNewItems = DefaultMaxNewItems
+	}
+	if w.MaxGateSkip == 0 {
+		w.MaxGateSkip = DefaultMaxGateSkip
+	}
+	if w.MaxThrottleFactor == 0 {
+		w.MaxThrottleFactor = DefaultMaxThrottleFactor
+	}
+	if w.BreakerCooldown == 0 {
+		w.BreakerCooldown = DefaultBreakerCooldown
+	}
+	w.Clock = clock.Or(w.Clock)
+	if g, ok := w.Repo.(*GormRepo); ok && ((w.Tenant != "" && g.Tenant == "") || (w.MaxProcessingTime > 0 && g.MaxProcessingTime == 0)) {
+		scoped := *g
+		if scoped.Tenant == "" {
+			scoped.Tenant = w.Tenant
+		}
+		if scoped.MaxProcessingTime == 0 {
+			scoped.MaxProcessingTime = w.MaxProcessingTime
+		}
+		w.Repo = &scoped
+	}
+	if w.Limiter == nil && w.RateLimit > 0 {
+		w.Limiter = NewRateLimiter(w.RateLimit, w.RateBurst, w.Clock)
+	}
 }
 
 func (w *Watcher) watch(ctx context.Context) {
 	var wg sync.WaitGroup
 	glog.Infof("starting watcher %s", w.OwnerID)
-	wg.Add(w.BatchSize)
+	wg.Add(w.BatchSize + 2)
 	for i := 0; i < w.BatchSize; i++ {
 		go w.itemProcessor(ctx, &wg)
 	}
+	owner := w.register(ctx)
+	go func() {
+		defer wg.Done()
+		w.heartbeat(ctx, owner)
+	}()
+	go func() {
+		defer wg.Done()
+		w.watchdog(ctx)
+	}()
 
-	w.acquireLeases(ctx)
+	if w.LeaderElection != "" {
+		w.lead(ctx)
+	} else {
+		w.acquireLeases(ctx)
+	}
+	w.dispatch.close()
 
 	wg.Wait()
+	w.resign()
 	glog.Info("gracefully shutting down watcher")
 }
 
@@ -87,153 +368,593 @@ func (w *Watcher) watch(ctx context.Context) {
 // it writes "leases" the partition by writing to the 'owner'
 // and 'until' fields, and saves the lease in w.leases.
 func (w *Watcher) acquireLeases(ctx context.Context) {
+	if w.ItemLeaseMode {
+		w.claimItems(ctx)
+		return
+	}
 	var wg sync.WaitGroup
-	t := time.NewTicker(w.LeaseInterval)
-	defer t.Stop()
-	for {
-		partitions, err := w.GetPotentialLeases(ctx)
-		if err != nil {
-			glog.Errorf("error getting potential leases: %s", err)
-		}
-
-		for _, p := range partitions {
-			w.mu.Lock()
-			_, ok := w.leases[p.ID]
-			if ok {
-				glog.Warningf("leased partition expired: %s, consider increasing lease interval", p.ID)
-			} else {
-				wg.Add(1)
-				w.leases[p.ID] = p
-				p := p
-				go w.watchPartition(ctx, p, &wg)
-			}
-			w.mu.Unlock()
-		}
+	var lastSweep, lastStuckSweep, lastLeaseSweep, lastRetrySweep time.Time
+	for ctx.Err() == nil {
+		lastSweep = w.sweepExpiredItems(ctx, lastSweep)
+		lastStuckSweep = w.sweepStuckItems(ctx, lastStuckSweep)
+		lastLeaseSweep = w.sweepExpiredLeases(ctx, lastLeaseSweep)
+		lastRetrySweep = w.sweepFailedPartitions(ctx, lastRetrySweep)
+		w.scanLeases(ctx, func(p *Partition) {
+			wg.Add(1)
+			pctx, handOver := context.WithCancel(ctx)
+			w.handOvers[p.ID] = handOver
+			go func() {
+				defer handOver()
+				w.watchPartition(pctx, p, &wg)
+			}()
+		})
 		select {
-		case <-t.C:
-			continue
+		case <-w.Clock.After(w.idleInterval(w.LeaseInterval)):
 		case <-ctx.Done():
-			t.Stop()
-			wg.Wait()
-			close(w.itemQ)
-			return
 		}
 	}
+	wg.Wait()
 }
 
-func (w *Watcher) watchPartition(ctx context.Context, p *Partition, wg *sync.WaitGroup) {
-	t := time.NewTicker(w.PollInterval)
-	defer func() {
-		t.Stop()
+// scanLeases scans for potential leases once, adding those the watcher may lease to w.leases,
+// and calling watch for each of them with w.mu held.
+func (w *Watcher) scanLeases(ctx context.Context, watch func(p *Partition)) {
+	fetchCtx, cancel := w.fetchContext(ctx)
+	partitions, err := w.Repo.GetPotentialLeases(fetchCtx, w.Selector)
+	cancel()
+	if err != nil {
+		glog.Errorf("error getting potential leases: %s", err)
+		w.repoFailed(ctx, err)
+	} else {
+		w.repoReached()
+		atomic.StoreInt64(&w.counters.lastLeaseScan, w.Clock.Now().UnixNano())
+		w.noteLeaseScan(len(partitions))
+	}
+	w.reportPoolStats()
 
+	var candidates []string
+	for _, p := range w.assign(ctx, partitions) {
+		if (w.Tenant != "" && p.Tenant != w.Tenant) || !p.Labels.Matches(w.Selector) || p.Scheduled(w.Clock.Now()) {
+			continue
+		}
 		w.mu.Lock()
-		delete(w.leases, p.ID)
+		if _, ok := w.leases[p.ID]; ok {
+			glog.Warningf("leased partition expired: %s, consider increasing lease interval", p.ID)
+		} else {
+			candidates = append(candidates, p.ID)
+		}
 		w.mu.Unlock()
+	}
+	if len(candidates) == 0 {
+		return
+	}
+
+	// The candidates are claimed at once, those leased by other watchers since they were read
+	// being skipped.
+	saveCtx, cancel := w.saveContext(ctx)
+	claimed, err := w.Repo.AcquireLeases(saveCtx, candidates, w.OwnerID, w.Clock.Now().Add(w.LeaseDuration), len(candidates), true)
+	cancel()
+	if err != nil {
+		glog.Errorf("error leasing partitions: %s", err)
+		return
+	}
+	if n := len(candidates) - len(claimed); n > 0 {
+		atomic.AddInt64(&w.counters.saveConflicts, int64(n))
+		glog.Infof("%d partitions were leased since they were read, not leasing them", n)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, p := range claimed {
+		w.leases[p.ID] = p
+		watch(p)
+	}
+}
+
+func (w *Watcher) watchPartition(ctx context.Context, p *Partition, wg *sync.WaitGroup) {
+	leased := false
+	defer func() {
+		// The lease claimed by the scan is released if the partition was never polled, for
+		// the next scan to pick it up again, as it is on shutdown.
+		if (ctx.Err() != nil || !leased) && p.Owner == w.OwnerID && !p.InActive(w.Clock.Now()) {
+			w.releaseLease(p)
+		}
+		w.forget(p.ID)
 		wg.Done()
 	}()
+	subCtx, unsubscribe := context.WithCancel(ctx)
+	defer unsubscribe()
+	notify := w.subscribe(subCtx, p.ID)
 
 	for {
-		items, err := w.GetAvailableItems(ctx, p, w.BatchSize-len(w.itemQ))
-		if err != nil {
-			glog.Errorf("error querying for items %s", err)
+		loopCtx, loop := w.startLoop(ctx, p.ID)
+		w.pollPartition(loopCtx, p, notify, &leased, loop)
+		stalled := loopCtx.Err() != nil && ctx.Err() == nil
+		loop.stop()
+		if !stalled || !w.reenter(ctx, p) {
 			return
 		}
-		counts, err := w.GetCountByStatus(ctx, p.ID)
+	}
+}
+
+// pollPartition polls the leased partition every poll interval, or when notified of new
+// items, until ctx is done or the partition is no longer leased or active. Each poll saves
+// the partition's lease, along with its progress, and offers its available items to the item
+// processors.
+func (w *Watcher) pollPartition(ctx context.Context, p *Partition, notify <-chan struct{}, leased *bool, loop *partitionLoop) {
+	for ctx.Err() == nil {
+		loop.busy(w.Clock.Now())
+		poll, err := w.decide(ctx, p)
 		if err != nil {
-			glog.Errorf("error fetching count by lease status for partition %s: %s", p.ID, err)
+			// The partition is leased again by a later scan, once its lease expires.
+			glog.Errorf("error polling partition %s: %s", p.ID, err)
+			w.repoFailed(ctx, err)
 			return
 		}
+		w.repoReached()
+		if !w.commit(ctx, p, poll, leased) {
+			return
+		}
+		if len(poll.items) > 0 {
+			w.noteWork()
+		}
+		if !w.breakerPaused(p.ID) {
+			w.dispatch.offer(p.ID, poll.items, w.MaxInFlightPerPartition, poll.since)
+		}
+		loop.idle()
+		select {
+		case <-w.Clock.After(w.throttledPollInterval(p.ID)):
+		case <-notify:
+		case <-ctx.Done():
+		}
+	}
+}
 
-		if counts[Failed] > 0 {
-			glog.Warningf("failures detected within partition %s, moving to failed status", p.ID)
-			p.Status = Failed
-		} else if counts[Available] > 0 {
-			glog.Infof("all items at this gate done, incrementing gate for partition %s", p.ID)
-			p.Status = Available
-			if len(items) == 0 && !w.ManualCheckpoint {
-				p.Gate++
-			}
-		} else {
-			glog.Infof("all items done! closing out partition %s", p.ID)
-			if len(items) == 0 && w.AutoClose {
-				p.Status = Complete
-			}
+// decide reads a poll of the leased partition, and decides whether it fails, advances its
+// gate, or completes, updating p. The decision isn't saved until commit.
+func (w *Watcher) decide(ctx context.Context, p *Partition) (*partitionPoll, error) {
+	gate, status := p.Gate, p.Status
+	poll, err := w.fetchPartition(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	poll.gate, poll.status = gate, status
+	w.checkSLA(p, poll.lag, poll.counts)
+
+	counts := GateCounts{ByStatus: poll.counts, Remaining: poll.remaining, Delayed: poll.delayed}
+	cfg := TransitionConfig{ManualCheckpoint: w.ManualCheckpoint, AutoClose: w.AutoClose, FailureTolerance: w.FailureTolerance}
+	d := decidePartitionTransition(p, counts, len(poll.items), cfg)
+	switch d.Transition {
+	case FailPartition:
+		glog.Warningf("failures detected within partition %s, moving to failed status", p.ID)
+	case AdvanceGate:
+		glog.Infof("all items at gate %s done, incrementing gate for partition %s", p.GateName(), p.ID)
+	case ClosePartition:
+		glog.Infof("all items done! closing out partition %s", p.ID)
+	case RecoverPartition:
+		glog.Infof("no failed items left in partition %s, recovering it", p.ID)
+	}
+	p.Status, p.Gate = d.Status, d.Gate
+	return poll, nil
+}
+
+// commit saves the partition's lease along with the decision of the poll, and readies the
+// poll's items to be processed under the lease. It returns false if the watcher should stop
+// polling the partition, as it lost the lease, the partition is no longer active, or the
+// first poll found nothing to do in it.
+func (w *Watcher) commit(ctx context.Context, p *Partition, poll *partitionPoll, leased *bool) bool {
+	gate, status := poll.gate, poll.status
+	if !*leased && poll.idle(p) {
+		w.abandon(ctx, p)
+		return false
+	}
+	until := w.Clock.Now().Add(w.LeaseDuration)
+	// Partitions are claimed when scanned, but may have been read without being leased.
+	if !*leased && p.Owner != w.OwnerID && !w.acquireLease(ctx, p, until) {
+		return false
+	}
+	p.Until = until
+	if !w.savePartition(ctx, p, gate, status, poll.counts) {
+		if !*leased {
+			// The partition changed since it was read, so the poll's decision is stale. The
+			// lease is released for the next scan to pick the partition up again.
+			atomic.AddInt64(&w.counters.saveConflicts, 1)
+			glog.Infof("partition %s changed since it was read, not leasing it", p.ID)
+			w.releaseLease(p)
+			return false
 		}
+		glog.Errorf("error saving patition %s", p.ID)
+		return false
+	}
+	w.emitPartitionEvents(p, gate, status, poll.counts, !*leased)
+	*leased = true
+	if p.Status == Complete && status != Complete {
+		w.unblockDependents(ctx, p)
+	}
+	if p.InActive(w.Clock.Now()) {
+		glog.Warningf("partition no longer active %s", p.ID)
+		return false
+	}
+	for _, i := range poll.items {
+		i.Fence = p.Fence
+		i.partition = p.config()
+	}
+	return true
+}
 
-		p.Owner = w.OwnerID
-		p.Until = time.Now().Add(w.LeaseDuration)
-		if !w.Save(ctx, p) {
-			glog.Errorf("error saving patition %s", p.ID)
-			return
+// partitionPoll is what a poll of a leased partition decides on: the items to process, the
+// partition's lag, the number of its items delayed until their RetryAt when there are none to
+// process, its counts of items by status, and the number of its items remaining past its gate.
+// since is the dispatcher's mark from before the items were fetched, and gate and status are
+// the partition's as it was read.
+type partitionPoll struct {
+	gate      int
+	status    Status
+	items     []*Item
+	since     uint64
+	lag       time.Duration
+	delayed   int
+	counts    map[Status]int
+	remaining int
+}
 
+// fetchPartition reads the poll of the leased partition, within the FetchTimeout.
+func (w *Watcher) fetchPartition(ctx context.Context, p *Partition) (*partitionPoll, error) {
+	ctx, cancel := w.fetchContext(ctx)
+	defer cancel()
+	// Items already queued or in flight are still available, and are skipped by offer, as are
+	// those finishing while they are fetched.
+	poll := &partitionPoll{since: w.dispatch.mark()}
+	items, err := w.fetchAvailableItems(ctx, p, w.MaxInFlightPerPartition)
+	if err != nil {
+		return nil, fmt.Errorf("querying for items: %w", err)
+	}
+	poll.lag = w.noteLag(ctx, p, items)
+	poll.items = w.freshItems(w.ownItems(items))
+	// Items waiting to be retried hold the partition at its gate, like those fetched.
+	if len(poll.items) == 0 {
+		if poll.delayed, err = w.Repo.CountDelayedItems(ctx, p); err != nil {
+			return nil, fmt.Errorf("counting the delayed items: %w", err)
 		}
-		if p.InActive() {
-			glog.Warningf("partition no longer active %s", p.ID)
-			return
+	}
+	if poll.counts, err = w.Repo.GetCountByStatus(ctx, p.ID); err != nil {
+		return nil, fmt.Errorf("fetching count by lease status: %w", err)
+	}
+	if poll.remaining, err = remainingItems(ctx, w.Repo, p, poll.counts); err != nil {
+		return nil, fmt.Errorf("counting the remaining items: %w", err)
+	}
+	return poll, nil
+}
+
+// fetchContext returns the context of a fetch, bounded by the FetchTimeout if set.
+func (w *Watcher) fetchContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if w.FetchTimeout > 0 {
+		return context.WithTimeout(ctx, w.FetchTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// saveContext returns the context of a save, bounded by the SaveTimeout if set.
+func (w *Watcher) saveContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if w.SaveTimeout > 0 {
+		return context.WithTimeout(ctx, w.SaveTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// errProgressChanged rolls back the save of a partition whose progress no longer holds.
+var errProgressChanged = errors.New("partition progress changed")
+
+// savePartition saves the partition's lease, along with the watcher's decision to advance its
+// gate or complete it since it was read at the gate and status. The items counted for the
+// decision may have changed since, e.g. when a failed item is retried, so the decision is
+// checked again within the same transaction as the save, and dropped if it no longer holds.
+// The counts of items are recorded in the partition's outbox events.
+func (w *Watcher) savePartition(ctx context.Context, p *Partition, gate int, status Status, counts map[Status]int) bool {
+	reason, retryAt := p.StatusReason, p.RetryAt
+	if p.Status != status {
+		p.StatusReason = w.statusReason(ctx, p, counts)
+		p.RetryAt = partitionRetryAt(p, w.Clock.Now())
+	}
+	ctx, cancel := w.saveContext(ctx)
+	defer cancel()
+	if p.Gate == gate && (p.Status != Complete || status == Complete) {
+		return w.Repo.SaveWithOutbox(ctx, p, partitionOutboxEvents(p, status, counts)...)
+	}
+	saved := false
+	err := w.Repo.Transaction(ctx, func(tx *GormRepo) error {
+		// The partition is written before the items are read, so that SQLite takes the write
+		// lock up front rather than upgrading the transaction's read lock, which fails while
+		// other writers hold it.
+		if saved = tx.SaveWithOutbox(ctx, p, partitionOutboxEvents(p, status, counts)...); !saved {
+			return errSaveConflict
 		}
-		for _, i := range items {
-			w.itemQ <- i
+		ok, err := progressHolds(ctx, tx, p, gate, p.failureTolerance(w.FailureTolerance))
+		if err == nil && !ok {
+			err = errProgressChanged
 		}
-		select {
-		case <-t.C:
-			continue
-		case <-ctx.Done():
-			return
+		return err
+	})
+	if err == nil {
+		return true
+	}
+	if saved {
+		// The save was rolled back.
+		p.DecrementVersion()
+	}
+	if errors.Is(err, errProgressChanged) {
+		glog.Infof("items of partition %s changed since they were counted, keeping it at gate %s", p.ID, p.GatePlan.Name(gate))
+		p.Gate, p.Status, p.StatusReason, p.RetryAt = gate, status, reason, retryAt
+		return w.Repo.SaveWithOutbox(ctx, p, partitionOutboxEvents(p, status, counts)...)
+	}
+	if !errors.Is(err, errSaveConflict) {
+		glog.Errorf("error saving partition %s: %s", p.ID, err)
+	}
+	return false
+}
+
+// progressHolds returns whether the partition may still advance past the gate, or complete,
+// as it is about to be saved, according to its items within the transaction and the failure
+// tolerance.
+func progressHolds(ctx context.Context, tx *GormRepo, p *Partition, gate int, tolerance float64) (bool, error) {
+	counts, err := tx.GetCountByStatus(ctx, p.ID)
+	if err != nil || !failuresTolerated(counts, tolerance) {
+		return false, err
+	}
+	if p.Gate > gate {
+		if n, err := tx.countAvailableAtGate(ctx, p.ID, gate); err != nil || n > 0 {
+			return false, err
 		}
 	}
+	if p.Status == Complete {
+		if n, err := remainingItems(ctx, tx, p, counts); err != nil || n > 0 {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// forget stops watching the partition, dropping its lease and the state kept for it, without
+// releasing the lease.
+func (w *Watcher) forget(id string) {
+	w.dispatch.drop(id)
+	w.dropBreaker(id)
+	w.mu.Lock()
+	delete(w.leases, id)
+	delete(w.handOvers, id)
+	delete(w.throttles, id)
+	delete(w.lags, id)
+	delete(w.slas, id)
+	delete(w.loops, id)
+	w.mu.Unlock()
+}
+
+// releaseLease expires the watcher's lease on the partition, so that other watchers can
+// pick it up immediately rather than waiting out the lease duration.
+func (w *Watcher) releaseLease(p *Partition) {
+	// The watcher's context may already be cancelled.
+	ctx, cancel := w.saveContext(context.Background())
+	defer cancel()
+	if err := w.Repo.ReleaseLease(ctx, p); err != nil {
+		glog.Warningf("error releasing lease on partition %s: %s", p.ID, err)
+		return
+	}
+	w.emit(Event{Type: PartitionReleased, PartitionID: p.ID})
+	glog.Infof("released lease on partition %s", p.ID)
 }
 
 func (w *Watcher) itemProcessor(ctx context.Context, wg *sync.WaitGroup) {
-	for item := range w.itemQ {
-		// We don't care about the result, since it will just get added back on the queue later on failure.
-		w.processItem(ctx, item)
+	for {
+		item, ok := w.dispatch.take()
+		if !ok {
+			break
+		}
+		// Once shutting down, drain the queue without starting new work. Those items will
+		// be picked up again by whichever watcher next leases their partition.
+		if ctx.Err() == nil && w.admit(item) && w.waitForLimiter(ctx) {
+			// We don't care about the result, since it will just get added back on the queue later on failure.
+			// Processing the item resets its retries as it advances.
+			kind := "fresh"
+			if item.RetryCount > 0 {
+				kind = "retry"
+			}
+			w.processItem(ctx, item)
+			if w.Dispatch.FairShare {
+				w.metrics().Counter(MetricGroupItemsProcessed, 1, Labels{"group": w.Dispatch.group(item)})
+			}
+			if w.FetchPolicy.Mode != FetchAll {
+				w.metrics().Counter(MetricKindItemsProcessed, 1, Labels{"kind": kind})
+			}
+		}
+		w.releaseProbe(item)
+		w.dispatch.done(item)
 	}
 	wg.Done()
 }
 
+// waitForLimiter blocks until the rate limiter allows another item to be processed, returning
+// false if the watcher is shutting down.
+func (w *Watcher) waitForLimiter(ctx context.Context) bool {
+	if w.Limiter == nil {
+		return true
+	}
+	start := w.Clock.Now()
+	err := w.Limiter.Wait(ctx)
+	waited := w.Clock.Since(start)
+	atomic.AddInt64(&w.counters.limiterWait, int64(waited))
+	w.metrics().Duration(MetricLimiterWait, waited, nil)
+	if err != nil {
+		if ctx.Err() == nil {
+			glog.Errorf("rate limiter error: %s", err)
+		}
+		return false
+	}
+	return true
+}
+
 // processItem sends the items to the processor, handles error and continuation responses.
 func (w *Watcher) processItem(ctx context.Context, i *Item) {
+	var err error
+	var newItems []*Item
+	abandoned := false
+	gate := i.Gate
 	defer func() {
-		if !w.Save(ctx, i) {
+		if abandoned {
+			return
+		}
+		// Persist the result of an item that was in flight during shutdown, rather than
+		// throwing away the work.
+		saveCtx := ctx
+		if ctx.Err() != nil {
+			saveCtx = context.Background()
+		}
+		// The item's claim ends with the attempt.
+		if w.ItemLeaseMode {
+			i.Owner, i.VisibleAfter = "", nil
+		}
+		if !w.saveItem(saveCtx, i, err, newItems) {
+			atomic.AddInt64(&w.counters.saveConflicts, 1)
 			glog.Warningf("error saving item %s to partition %s", i.ID, i.PartitionID)
+		} else {
+			w.recordSave(i)
+			w.emitItemEvent(i, err)
+			if err != nil && i.Status == Available {
+				w.noteRetry(i.PartitionID)
+			}
+			if w.ItemLeaseMode && (i.Status != Available || i.Gate != gate) {
+				w.settlePartition(saveCtx, i.PartitionID)
+			}
 		}
+		atomic.StoreInt64(&w.counters.lastItemSave, w.Clock.Now().UnixNano())
 	}()
-	glog.Infof("%s is processing object with ID: %s in partition: %s, s: %s", w.OwnerID, i.ID, i.PartitionID, i.Data)
-	resp, err := w.Process(i.ID, i.Data)
+	if i.expired(w.Clock.Now()) {
+		// Failing an item that waited past its deadline, e.g. while retrying, takes precedence
+		// over processing it.
+		err = ErrDeadlineExceeded
+		w.missDeadline(i)
+		i.error(err, Fail, w.Clock.Now())
+		return
+	}
+	now := w.Clock.Now()
+	i.LastOwner, i.LastProcessedAt = w.OwnerID, &now
+	if err = w.upgrade(i); err != nil {
+		atomic.AddInt64(&w.counters.itemErrors, 1)
+		i.error(err, Fail, w.Clock.Now())
+		return
+	}
+	if w.deduplicate(ctx, i) {
+		return
+	}
+	glog.Infof("%s is processing object with ID: %s in partition: %s at gate: %s, s: %s", w.OwnerID, i.ID, i.PartitionID, i.partition.plan.Name(i.Gate), i.input())
+	if !w.startProcessing(ctx, i) {
+		abandoned = true
+		atomic.AddInt64(&w.counters.saveConflicts, 1)
+		glog.Warningf("error starting to process item %s in partition %s", i.ID, i.PartitionID)
+		return
+	}
+	atomic.AddInt64(&w.counters.itemsProcessed, 1)
+	spanCtx, span := w.startSpan(ctx, i)
+	release := w.keepClaimed(ctx, i)
+	start := w.Clock.Now()
+	resp, err := w.processWithTimeout(spanCtx, i)
+	release()
+	if ctx.Err() == nil {
+		w.observeAttempt(w.Clock.Now().Sub(start), err != nil)
+	}
+	endSpan(span, err)
+	// An item abandoned because of shutdown is left as is, for the next lease.
+	if err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		abandoned = true
+		w.stopProcessing(ctx, i)
+		return
+	}
+	// So is a throttled item, for the next poll, which is slowed down meanwhile.
+	if IsThrottled(err) {
+		abandoned = true
+		w.throttle(i.PartitionID)
+		w.stopProcessing(ctx, i)
+		return
+	}
 	if err != nil {
-		i.error(err)
+		// Only the processor's errors go to the RetryClassifier, the watcher's own checks
+		// below fail the item regardless.
+		d := w.classify(err)
+		w.recordAttempt(i, !d.fail)
+		if IsPanic(err) {
+			w.panicked(i)
+		}
+		if errors.Is(err, ErrProcessingTimeout) {
+			w.timeout(i)
+		} else {
+			atomic.AddInt64(&w.counters.itemErrors, 1)
+		}
+		i.error(err, w.retryDecision(i, err, d), w.Clock.Now())
 		return
 	}
+	w.recordAttempt(i, false)
+	w.unthrottle(i.PartitionID)
+	if resp.Metadata != nil {
+		if _, merr := resp.Metadata.Value(); merr != nil {
+			err = NonRetryableError(merr.Error())
+		}
+	}
+	if err == nil {
+		err = w.checkNextGate(i, resp)
+	}
+	if err == nil {
+		newItems, err = w.newItems(i, resp.NewItems)
+	}
+	if err != nil {
+		atomic.AddInt64(&w.counters.itemErrors, 1)
+		i.error(err, w.retryDecision(i, err, DefaultRetryClassifier(err)), w.Clock.Now())
+		return
+	}
+	i.RetryAt = nil
+	i.ProcessingStartedAt = nil
 	if resp.Complete {
+		atomic.AddInt64(&w.counters.itemsCompleted, 1)
 		i.Status = Complete
 	}
+	if w.PromoteResultOnGate && resp.NextGate != i.Gate {
+		i.Data, i.DataHash = resp.Data, ""
+	}
+	if resp.NextGate > i.Gate && !resp.Complete && !w.KeepRetriesAcrossGates {
+		i.resetRetries()
+	}
 	i.Gate = resp.NextGate
-	i.Data = resp.Data
+	i.Result = resp.Data
+	if resp.Metadata != nil {
+		i.Metadata = resp.Metadata
+	}
 }
 
+// Healthcheck reports whether the watcher is ready, see Readiness.
 func (w *Watcher) Healthcheck(ctx context.Context) error {
-	var wg sync.WaitGroup
-	wg.Add(2)
-	var dbErr, procErr error
-	go func() {
-		dbErr = w.Repo.Healthcheck(ctx)
-		wg.Done()
-	}()
+	return w.Readiness(ctx)
+}
 
-	go func() {
-		procErr = w.Processor.Healthcheck(ctx)
-		wg.Done()
-	}()
-	wg.Wait()
-	if dbErr != nil && procErr != nil {
-		return errors.Wrap(dbErr, procErr.Error())
+// Readiness checks that the repo and processor are reachable, returning the errors of all
+// failed checks, critical or not. It returns early if ctx is done before the checks complete.
+// See HealthReport for the details of each check.
+func (w *Watcher) Readiness(ctx context.Context) error {
+	return w.HealthReport(ctx).Err()
+}
+
+// Liveness checks that the watcher's internal loops are making progress: the lease loop must
+// have completed a scan, and, while items are backed up, the item processors must have saved
+// an item, within the last LivenessThreshold lease intervals. The polls of leased partitions
+// the watchdog cancelled must also have stopped within a lease interval.
+func (w *Watcher) Liveness(ctx context.Context) error {
+	lastScan := atomic.LoadInt64(&w.counters.lastLeaseScan)
+	if lastScan == 0 {
+		return errors.New("watcher not started")
 	}
-	if dbErr != nil {
-		return dbErr
+	threshold := time.Duration(w.LivenessThreshold) * w.LeaseInterval
+	if since := w.Clock.Since(time.Unix(0, lastScan)); since > threshold {
+		return fmt.Errorf("no successful lease scan in %s", since.Round(time.Millisecond))
 	}
-	if procErr != nil {
-		return procErr
+	lastSave := atomic.LoadInt64(&w.counters.lastItemSave)
+	if since := w.Clock.Since(time.Unix(0, lastSave)); w.dispatch.queued() > 0 && since > threshold {
+		return fmt.Errorf("items are queued and no item has been saved in %s", since.Round(time.Millisecond))
 	}
-
-	return nil
+	return w.checkStalls()
 }
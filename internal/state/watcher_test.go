@@ -1,19 +1,19 @@
 package state
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"testing"
 	"time"
 
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
 	"github.com/golang/glog"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -29,8 +29,8 @@ type FairRepo struct {
 	owner string
 }
 
-func (r *FairRepo) GetPotentialLeases(ctx context.Context) (partitions []*Partition, err error) {
-	all, err := r.GormRepo.GetPotentialLeases(ctx)
+func (r *FairRepo) GetPotentialLeases(ctx context.Context, selector map[string]string) (partitions []*Partition, err error) {
+	all, err := r.GormRepo.GetPotentialLeases(ctx, selector)
 	if err != nil {
 		return nil, err
 	}
@@ -49,19 +49,23 @@ type dataObj struct {
 	Gate      int  `json:"gate,omitempty"`
 }
 
+// testProcessor completes dataObjs once they have been processed Times times, and fails
+// those with Fail set.
 type testProcessor struct{}
 
-func (d *dataObj) Marshal() ([]byte, error) {
-	buf := bytes.Buffer{}
-	if err := json.NewEncoder(&buf).Encode(d); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+var typedTestProcessor = &TypedProcessor[dataObj]{
+	Func: func(ctx context.Context, id string, d dataObj) (dataObj, Decision, error) {
+		if d.Fail {
+			return d, Decision{}, errors.New("moving to failed item")
+		}
+		d.Processed++
+		return d, Decision{Complete: d.Processed >= d.Times, NextGate: d.Gate}, nil
+	},
 }
 
 func objFromData(buf []byte) (dataObj, error) {
 	d := dataObj{}
-	err := json.NewDecoder(bytes.NewBuffer(buf)).Decode(&d)
+	err := JSONCodec{}.Unmarshal(buf, &d)
 	return d, err
 }
 
@@ -70,22 +74,11 @@ func (p *testProcessor) Healthcheck(ctx context.Context) error {
 }
 
 func (p *testProcessor) Process(id string, buf []byte) (*ProcessorResponse, error) {
-	d, err := objFromData(buf)
-
-	if err != nil {
-		return nil, err
-	}
-
-	if d.Fail {
-		return nil, errors.New("moving to failed item")
-	}
-	d.Processed++
-
-	data, err := d.Marshal()
-	return &ProcessorResponse{Data: data, Complete: d.Processed >= d.Times, NextGate: d.Gate}, err
+	return typedTestProcessor.Process(id, buf)
 }
 
-func getTestRepo(t *testing.T) *GormRepo {
+// openTestRepo returns an empty, migrated repo backed by a sqlite temp file.
+func openTestRepo(t *testing.T) *GormRepo {
 	f, err := ioutil.TempFile("", "test_db_")
 	if err != nil {
 		t.Fatal(err)
@@ -105,11 +98,29 @@ func getTestRepo(t *testing.T) *GormRepo {
 	if err != nil {
 		t.Fatal(err)
 	}
-	r := &GormRepo{DB: db}
+	r, err := NewGormRepo(db)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if err := r.AutoMigrate(); err != nil {
 		t.Fatal(err)
 	}
+	t.Cleanup(func() {
+		sqlDB, err := db.DB()
+		if err != nil {
+			t.Fatalf("error getting underlying sql db from gorm: %s", err)
+		}
+		sqlDB.Close()
+
+		if err := os.Remove(f.Name()); err != nil {
+			t.Errorf("temp file remove error: %s", err)
+		}
+	})
+	return r
+}
 
+func getTestRepo(t *testing.T) *GormRepo {
+	r := openTestRepo(t)
 	ctx := context.Background()
 	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p1_unowned"}, Status: Failed})
 	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p2_unowned"}})
@@ -215,18 +226,6 @@ func getTestRepo(t *testing.T) *GormRepo {
 		PartitionID: "p1_gate",
 		Data:        []byte(`{"times": 3, "gate":1}`),
 	})
-
-	t.Cleanup(func() {
-		sqlDB, err := db.DB()
-		if err != nil {
-			t.Fatalf("error getting underlying sql db from gorm: %s", err)
-		}
-		sqlDB.Close()
-
-		if err := os.Remove(f.Name()); err != nil {
-			t.Errorf("temp file remove error: %s", err)
-		}
-	})
 	return r
 }
 
@@ -362,16 +361,16 @@ func TestWatcher(t *testing.T) {
 	for _, tc := range testCases {
 
 		s := itemMap[tc.itemID]
-		got, err := objFromData(s.Data)
+		got, err := objFromData(s.input())
 		if err != nil {
-			t.Errorf("error marshaling data: %s", s.Data)
+			t.Errorf("error marshaling data: %s", s.input())
 		}
 		want, err := objFromData(tc.wantData)
 		if err != nil {
 			t.Errorf("error marshaling data: %s", string(tc.wantData))
 		}
 		if got != want {
-			t.Errorf("failed test case %s, wanted data: %s, got %s. error messages: %s", tc.itemID, tc.wantData, s.Data, s.ErrorMessages)
+			t.Errorf("failed test case %s, wanted data: %s, got %s. error messages: %s", tc.itemID, tc.wantData, s.input(), s.ErrorMessages)
 		}
 		if tc.wantStatus != s.Status {
 			t.Errorf("failed test case %s, wanted status: %v, got %v", tc.itemID, tc.wantStatus, s.Status)
@@ -403,7 +402,7 @@ func (p *healthcheckProc) Healthcheck(ctx context.Context) error {
 }
 
 type healthcheckRepo struct {
-	GormRepo
+	UnimplementedRepo
 	shouldFail bool
 }
 
@@ -439,3 +438,233 @@ func TestHealthcheck(t *testing.T) {
 		t.Error("expected repo error from healthcheck")
 	}
 }
+
+func TestReleaseLeasesOnShutdown(t *testing.T) {
+	r := getTestRepo(t)
+	w := Watcher{
+		Processor:     &testProcessor{},
+		Repo:          &FairRepo{GormRepo: r, owner: "p2"},
+		OwnerID:       "p2",
+		BatchSize:     1,
+		PollInterval:  time.Millisecond,
+		LeaseInterval: time.Second,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	w.Start(ctx)
+
+	partitions := []*Partition{}
+	r.DB.Model(&Partition{}).Where("owner = ?", "p2").Find(&partitions)
+	if len(partitions) == 0 {
+		t.Fatal("expected the watcher to have leased partitions")
+	}
+	for _, p := range partitions {
+		if !p.Expired(time.Now()) {
+			t.Errorf("expected lease on partition %s to be released, leased until %s", p.ID, p.Until)
+		}
+	}
+}
+
+type blockingProc struct {
+	testProcessor
+}
+
+// Healthcheck ignores ctx, and never returns.
+func (p *blockingProc) Healthcheck(ctx context.Context) error {
+	select {}
+}
+
+func TestReadinessHonorsContext(t *testing.T) {
+	w := Watcher{
+		Processor: &blockingProc{},
+		Repo:      &healthcheckRepo{shouldFail: true},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := w.Readiness(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if err == nil || !strings.Contains(err.Error(), "failed repo healthcheck") {
+		t.Errorf("expected the repo error to be reported along with the deadline, got %v", err)
+	}
+}
+
+func TestReadinessJoinsErrors(t *testing.T) {
+	w := Watcher{
+		Processor: &healthcheckProc{shouldFail: true},
+		Repo:      &healthcheckRepo{shouldFail: true},
+	}
+	err := w.Readiness(context.Background())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{"repo: failed repo healthcheck", "processor: failed processor healthcheck"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %q", want, err)
+		}
+	}
+}
+
+func TestHealthReport(t *testing.T) {
+	proc := &healthcheckProc{}
+	repo := &healthcheckRepo{}
+	w := Watcher{
+		Processor: proc,
+		Repo:      repo,
+	}
+	report := w.HealthReport(context.Background())
+	if report.Status != HealthOK || len(report.Checks) != 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	proc.shouldFail = true
+	report = w.HealthReport(context.Background())
+	if report.Status != HealthDegraded {
+		t.Errorf("expected a failed processor to degrade the watcher, got %s", report.Status)
+	}
+	if c := report.Checks[1]; c.Name != HealthCheckProcessor || c.OK || c.Critical || c.Error != "failed processor healthcheck" {
+		t.Errorf("unexpected processor check %+v", c)
+	}
+
+	repo.shouldFail = true
+	if report = w.HealthReport(context.Background()); report.Status != HealthDown {
+		t.Errorf("expected a failed repo to take the watcher down, got %s", report.Status)
+	}
+
+	repo.shouldFail = false
+	w.CriticalHealthChecks = []string{HealthCheckRepo, HealthCheckProcessor}
+	if report = w.HealthReport(context.Background()); report.Status != HealthDown {
+		t.Errorf("expected a failed critical processor to take the watcher down, got %s", report.Status)
+	}
+}
+
+func TestHealthReportTimesOut(t *testing.T) {
+	w := Watcher{
+		Processor: &blockingProc{},
+		Repo:      &healthcheckRepo{},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	report := w.HealthReport(ctx)
+	if report.Status != HealthDegraded {
+		t.Errorf("expected a hung processor to degrade the watcher, got %s", report.Status)
+	}
+	if c := report.Checks[1]; c.OK || c.Error != context.DeadlineExceeded.Error() || c.Latency < 50*time.Millisecond {
+		t.Errorf("unexpected processor check %+v", c)
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	c := clock.NewFake(time.Now())
+	w := Watcher{LeaseInterval: time.Second, LivenessThreshold: 2, Clock: c}
+	if err := w.Liveness(context.Background()); err == nil {
+		t.Error("expected a watcher that hasn't started to not be live")
+	}
+
+	w.counters.lastLeaseScan = c.Now().UnixNano()
+	w.counters.lastItemSave = c.Now().Add(-time.Hour).UnixNano()
+	if err := w.Liveness(context.Background()); err != nil {
+		t.Errorf("expected a recent lease scan to be live, got %s", err)
+	}
+
+	// Stale item saves only matter when items are backed up.
+	w.dispatch.offer("p", []*Item{{BaseModel: BaseModel{ID: "i"}, PartitionID: "p"}}, 1, 0)
+	if err := w.Liveness(context.Background()); err == nil {
+		t.Error("expected a backed up queue with no recent saves to not be live")
+	}
+	w.dispatch.drop("p")
+
+	c.Advance(3 * time.Second)
+	if err := w.Liveness(context.Background()); err == nil {
+		t.Error("expected a stale lease scan to not be live")
+	}
+}
+
+func TestSavePartitionRechecksProgress(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	w := &Watcher{Repo: r, OwnerID: "w"}
+	w.init()
+	p := &Partition{BaseModel: BaseModel{ID: "p"}, Status: Available}
+	r.Save(ctx, p)
+	// The item is retried after the watcher counted the partition's items as done.
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Status: Available, Data: []byte(`{}`)})
+
+	p.Gate++
+	if !w.savePartition(ctx, p, 0, Available, nil) {
+		t.Fatal("expected the partition's lease to be saved")
+	}
+	p.Status = Complete
+	if !w.savePartition(ctx, p, 0, Available, nil) {
+		t.Fatal("expected the partition's lease to be saved")
+	}
+	saved, err := r.GetPartition(ctx, "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Gate != 0 || saved.Status != Available {
+		t.Errorf("expected the partition to stay at gate 0, got gate %d, status %s", saved.Gate, saved.Status)
+	}
+
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i", Version: 1}, PartitionID: "p", Status: Complete, Data: []byte(`{}`)})
+	p.Gate++
+	if !w.savePartition(ctx, p, 0, Available, nil) || p.Gate != 1 {
+		t.Errorf("expected the partition to advance to gate 1, got %d", p.Gate)
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Status: Available, Data: []byte(`{"times": 1}`)})
+
+	// The first poll hangs until the FetchTimeout, well before the watchdog steps in, and the
+	// partition is leased again by the next lease scan.
+	w := &Watcher{Processor: &testProcessor{}, Repo: &hangingRepo{GormRepo: r, nth: 1}, PollInterval: 10 * time.Millisecond,
+		AutoClose: true, FetchTimeout: 50 * time.Millisecond}
+	events := runForEvents(t, r, w)
+	if last := events[len(events)-1]; last.Type != PartitionCompleted {
+		t.Fatalf("expected the partition to complete, got %v", eventTypes(events))
+	}
+	if stalls := w.Stats().Stalls; stalls != 0 {
+		t.Errorf("expected the poll to time out rather than stall, got %d stalls", stalls)
+	}
+}
+
+// hangingSaveRepo hangs the first save of an item until its context is done.
+type hangingSaveRepo struct {
+	*GormRepo
+	hung int32
+}
+
+func (r *hangingSaveRepo) SaveWithOutbox(ctx context.Context, m Model, events ...*OutboxEvent) bool {
+	if _, ok := m.(*Item); ok && atomic.CompareAndSwapInt32(&r.hung, 0, 1) {
+		<-ctx.Done()
+		return false
+	}
+	return r.GormRepo.SaveWithOutbox(ctx, m, events...)
+}
+
+func TestSaveTimeout(t *testing.T) {
+	r := openTestRepo(t)
+	ctx := context.Background()
+	r.Save(ctx, &Partition{BaseModel: BaseModel{ID: "p"}})
+	r.Save(ctx, &Item{BaseModel: BaseModel{ID: "i"}, PartitionID: "p", Status: Available, Data: []byte(`{"times": 1}`)})
+
+	// The item's first save times out, leaving it available to be processed again.
+	proc := &recordingProcessor{}
+	w := &Watcher{Processor: proc, Repo: &hangingSaveRepo{GormRepo: r}, BatchSize: 1, PollInterval: 10 * time.Millisecond,
+		AutoClose: true, SaveTimeout: 50 * time.Millisecond}
+	events := runForEvents(t, r, w)
+	if last := events[len(events)-1]; last.Type != PartitionCompleted {
+		t.Fatalf("expected the partition to complete, got %v", eventTypes(events))
+	}
+	if len(proc.inputs) != 2 {
+		t.Errorf("expected the item to be processed again after its save timed out, got %v", proc.inputs)
+	}
+	if conflicts := w.Stats().SaveConflicts; conflicts != 1 {
+		t.Errorf("expected the timed out save to be counted, got %d", conflicts)
+	}
+}
@@ -0,0 +1,155 @@
+// Package webhook notifies external systems over HTTP when partitions complete or fail. The
+// Sink delivers the partitions' outbox events, see state.OutboxPublisher, so notifications
+// are persisted in the same transaction as the partition, and survive restarts.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/clock"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/processors/httprocessor"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+)
+
+// EventIDHeader holds the ID of the outbox event, the same for each delivery of a
+// notification, so that receivers can discard duplicates.
+const EventIDHeader = "X-Event-ID"
+
+var (
+	// DefaultTimeout is how long each delivery may take, by default.
+	DefaultTimeout = 10 * time.Second
+	// DefaultRetryPolicy retries deliveries for about half a minute, within the outbox's
+	// DefaultOutboxClaimDuration.
+	DefaultRetryPolicy state.RetryPolicy = state.Exponential{Initial: time.Second, Max: 8 * time.Second, MaxRetries: 5}
+)
+
+// Notification is the JSON body posted for each event, e.g.
+// {"event": "partition_completed", "partition_id": "p", "counts": {"Complete": 10}, ...}.
+type Notification struct {
+	Event       string               `json:"event"`
+	PartitionID string               `json:"partition_id"`
+	Gate        int                  `json:"gate"`
+	Status      state.Status         `json:"status"`
+	Counts      map[state.Status]int `json:"counts"`
+	Reason      string               `json:"reason,omitempty"`
+	Timestamp   time.Time            `json:"timestamp"`
+}
+
+// Sink posts a Notification to the URL for each PartitionCompleted and PartitionFailed
+// outbox event, retrying each until the URL responds with a 2xx status or the RetryPolicy
+// gives up. The batch is then claimed again once the outbox's ClaimDuration has passed, so
+// the ClaimDuration should outlast the retries. Other events are skipped.
+type Sink struct {
+	URL string
+	// SigningKeys, if set, sign every notification in the httprocessor.SignatureHeader, which
+	// receivers check with httprocessor.VerifyRequest.
+	SigningKeys []httprocessor.SigningKey
+	// RetryPolicy defaults to DefaultRetryPolicy.
+	RetryPolicy state.RetryPolicy
+	// Client defaults to a client with a DefaultTimeout.
+	Client *http.Client
+	// Clock defaults to the real time, and is overridden in tests.
+	Clock clock.Clock
+}
+
+// Publish delivers the notifications of the events, in order.
+func (s *Sink) Publish(ctx context.Context, events []*state.OutboxEvent) error {
+	for _, e := range events {
+		if e.AggregateType != "partition" || (e.EventType != state.PartitionCompleted.String() && e.EventType != state.PartitionFailed.String()) {
+			continue
+		}
+		if err := s.deliver(ctx, e); err != nil {
+			return fmt.Errorf("error notifying %s of event %s: %w", s.URL, e.ID, err)
+		}
+	}
+	return nil
+}
+
+// deliver posts the event's notification until it is accepted, or the retries run out.
+func (s *Sink) deliver(ctx context.Context, e *state.OutboxEvent) error {
+	var payload state.PartitionPayload
+	if err := json.Unmarshal(e.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid payload: %w", err)
+	}
+	body, err := json.Marshal(Notification{
+		Event:       snakeCase(e.EventType),
+		PartitionID: payload.ID,
+		Gate:        payload.Gate,
+		Status:      payload.Status,
+		Counts:      payload.Counts,
+		Reason:      payload.Reason,
+		Timestamp:   e.CreatedAt.UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	policy := s.RetryPolicy
+	if policy == nil {
+		policy = DefaultRetryPolicy
+	}
+	for attempt := 1; ; attempt++ {
+		err := s.post(ctx, e.ID, body)
+		if err == nil {
+			return nil
+		}
+		delay, ok := policy.NextDelay(attempt, err)
+		if !ok {
+			return err
+		}
+		select {
+		case <-clock.Or(s.Clock).After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *Sink) post(ctx context.Context, id string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventIDHeader, id)
+	if len(s.SigningKeys) > 0 {
+		req.Header.Set(httprocessor.SignatureHeader, httprocessor.Sign(s.SigningKeys, time.Now(), body))
+	}
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: DefaultTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// The body is drained, up to a limit, for the connection to be reused.
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+// snakeCase returns the event type's name in snake case, e.g. partition_completed.
+func snakeCase(s string) string {
+	var b strings.Builder
+	for n, r := range s {
+		if unicode.IsUpper(r) {
+			if n > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,101 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/processors/httprocessor"
+	"dev.azure.com/CSECodeHub/378940+-+PWC+Health+OSIC+Platform+-+DICOM/SQLStateProcessor/internal/state"
+)
+
+// flakyServer fails the first requests, then records the notifications it accepts.
+type flakyServer struct {
+	mu       sync.Mutex
+	failures int
+	attempts int
+	eventIDs []string
+	accepted []Notification
+	keyIDs   []string
+}
+
+func (s *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts++
+	s.eventIDs = append(s.eventIDs, r.Header.Get(EventIDHeader))
+	if s.attempts <= s.failures {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	keyID, err := httprocessor.VerifyRequest(r, []httprocessor.SigningKey{{ID: "lims", Secret: []byte("secret")}})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	var n Notification
+	if err := json.Unmarshal(body, &n); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.keyIDs = append(s.keyIDs, keyID)
+	s.accepted = append(s.accepted, n)
+}
+
+func partitionEvent(t *testing.T, id string, eventType state.EventType, payload state.PartitionPayload) *state.OutboxEvent {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &state.OutboxEvent{ID: id, AggregateType: "partition", AggregateID: payload.ID, EventType: eventType.String(), Payload: b, CreatedAt: time.Now()}
+}
+
+func TestRetryUntilAccepted(t *testing.T) {
+	server := &flakyServer{failures: 2}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	sink := &Sink{
+		URL:         ts.URL,
+		SigningKeys: []httprocessor.SigningKey{{ID: "lims", Secret: []byte("secret")}},
+		RetryPolicy: state.Fixed{Delay: time.Millisecond, MaxRetries: 3},
+	}
+	events := []*state.OutboxEvent{
+		{ID: "e1", AggregateType: "item", AggregateID: "i", EventType: state.ItemCompleted.String(), Payload: []byte(`{}`)},
+		partitionEvent(t, "e2", state.PartitionCompleted, state.PartitionPayload{ID: "p", Gate: 2, Status: state.Complete, Counts: map[state.Status]int{state.Complete: 10}}),
+	}
+	if err := sink.Publish(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+	if server.attempts != 3 {
+		t.Errorf("expected the notification to be retried until accepted, got %d attempts", server.attempts)
+	}
+	for _, id := range server.eventIDs {
+		if id != "e2" {
+			t.Errorf("expected every attempt to carry the event's ID, got %v", server.eventIDs)
+			break
+		}
+	}
+	if len(server.accepted) != 1 || server.keyIDs[0] != "lims" {
+		t.Fatalf("expected a single signed notification, got %v signed by %v", server.accepted, server.keyIDs)
+	}
+	n := server.accepted[0]
+	if n.Event != "partition_completed" || n.PartitionID != "p" || n.Gate != 2 || n.Counts[state.Complete] != 10 || n.Timestamp.IsZero() {
+		t.Errorf("unexpected notification %+v", n)
+	}
+
+	// Once the retries run out, the batch is left to the outbox to claim again.
+	server.attempts, server.failures = 0, 10
+	err := sink.Publish(context.Background(), []*state.OutboxEvent{partitionEvent(t, "e3", state.PartitionFailed, state.PartitionPayload{ID: "p", Status: state.Failed})})
+	if err == nil {
+		t.Error("expected an error once the retries ran out")
+	}
+	if server.attempts != 4 {
+		t.Errorf("expected the first attempt and 3 retries, got %d", server.attempts)
+	}
+}